@@ -0,0 +1,369 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// The outcomes of the keys pushed to announcers, as reported by the announced
+// keys metric.
+const (
+	announceProvided = "provided"
+	announceFailed   = "failed"
+	announceDropped  = "dropped"
+)
+
+// AnnounceOutcome is the outcome of the announcement of a key pushed to an
+// Announcer.
+type AnnounceOutcome struct {
+	Key cid.Cid
+	// Attempts is the number of times the key was provided, including the
+	// successful one.
+	Attempts int
+	// Err is nil if the key was provided, the error of the last attempt if
+	// all of them failed, and ErrAnnouncerClosed if the announcer was closed
+	// before the key was provided.
+	Err error
+}
+
+type announcerOptions struct {
+	batchSize     int
+	batchInterval time.Duration
+	maxAttempts   int
+	backoffBase   time.Duration
+	backoffMax    time.Duration
+	report        func(AnnounceOutcome)
+}
+
+// AnnouncerOption configures an Announcer.
+type AnnouncerOption func(*announcerOptions) error
+
+var announcerDefaults = announcerOptions{
+	batchSize:     256,
+	batchInterval: time.Second,
+	maxAttempts:   3,
+	backoffBase:   30 * time.Second,
+	backoffMax:    10 * time.Minute,
+}
+
+// AnnounceBatch sets the number of keys the announcer accumulates before
+// handing them to the provide scheduler, and how long it waits for a batch to
+// fill up before handing over a partial one.
+//
+// Defaults to 256 keys and one second.
+func AnnounceBatch(size int, interval time.Duration) AnnouncerOption {
+	return func(o *announcerOptions) error {
+		if size <= 0 {
+			return fmt.Errorf("announce batch size must be positive, got %d", size)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("announce batch interval must be positive, got %s", interval)
+		}
+		o.batchSize = size
+		o.batchInterval = interval
+		return nil
+	}
+}
+
+// AnnounceRetries sets the number of times the announcer tries to provide a
+// key before giving up, and the backoff between attempts, which doubles from
+// base after every failure up to max.
+//
+// Defaults to 3 attempts, with a backoff from 30 seconds up to 10 minutes.
+func AnnounceRetries(attempts int, base, max time.Duration) AnnouncerOption {
+	return func(o *announcerOptions) error {
+		if attempts <= 0 {
+			return fmt.Errorf("announce attempts must be positive, got %d", attempts)
+		}
+		if base <= 0 || max < base {
+			return fmt.Errorf("invalid announce backoff: base %s, max %s", base, max)
+		}
+		o.maxAttempts = attempts
+		o.backoffBase = base
+		o.backoffMax = max
+		return nil
+	}
+}
+
+// AnnounceReport sets the function called with the outcome of every key
+// pushed to the announcer. It is called from the announcer's goroutines and
+// must not block.
+func AnnounceReport(report func(AnnounceOutcome)) AnnouncerOption {
+	return func(o *announcerOptions) error {
+		o.report = report
+		return nil
+	}
+}
+
+// Announcer provides the keys that applications push to it as content
+// becomes available. It batches and deduplicates them, hands them to the
+// provide scheduler of the DHT (see ScheduleProvide), which bounds the
+// concurrency and the rate of the provides, retries the failed ones with an
+// exponential backoff and reports the outcome of every key.
+//
+// A key pushed again while it is being announced is only announced once. Once
+// the DHT is closed, the keys not announced yet are reported with the error of
+// its context.
+type Announcer struct {
+	dht  *IpfsDHT
+	opts announcerOptions
+
+	mu     sync.Mutex
+	closed bool
+	batch  []cid.Cid
+	timer  *time.Timer
+	// keys maps the multihashes of the keys being announced to their
+	// announcement.
+	keys    map[string]*announcement
+	retries map[string]*time.Timer
+
+	// stopWatch stops watching for the DHT to close
+	stopWatch func() bool
+}
+
+// announcement is a key being announced.
+type announcement struct {
+	key      cid.Cid
+	attempts int
+}
+
+// NewAnnouncer returns an Announcer providing keys with dht. It returns
+// routing.ErrNotSupported if dht doesn't serve provider records.
+func NewAnnouncer(dht *IpfsDHT, opts ...AnnouncerOption) (*Announcer, error) {
+	if !dht.enableProviders {
+		return nil, routing.ErrNotSupported
+	}
+	o := announcerDefaults
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	a := &Announcer{
+		dht:     dht,
+		opts:    o,
+		keys:    make(map[string]*announcement),
+		retries: make(map[string]*time.Timer),
+	}
+	a.stopWatch = context.AfterFunc(dht.ctx, a.abort)
+	return a, nil
+}
+
+// Push queues keys to be announced. It doesn't block, the keys being
+// provided in the background.
+func (a *Announcer) Push(keys ...cid.Cid) error {
+	for _, k := range keys {
+		if !k.Defined() {
+			return fmt.Errorf("invalid cid: undefined")
+		}
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrAnnouncerClosed
+	}
+	var failed []AnnounceOutcome
+	for _, k := range keys {
+		mh := string(k.Hash())
+		if _, ok := a.keys[mh]; ok {
+			continue
+		}
+		a.keys[mh] = &announcement{key: k}
+		a.batch = append(a.batch, k)
+		if len(a.batch) >= a.opts.batchSize {
+			failed = append(failed, a.flushLocked()...)
+		}
+	}
+	if len(a.batch) > 0 && a.timer == nil {
+		a.timer = time.AfterFunc(a.opts.batchInterval, a.flush)
+	}
+	a.mu.Unlock()
+
+	a.reportAll(failed, announceFailed)
+	return nil
+}
+
+// Pending returns the number of keys being announced, batched, scheduled or
+// waiting to be retried.
+func (a *Announcer) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.keys)
+}
+
+// Close stops the announcer. The keys batched or waiting to be retried are
+// dropped, and reported with ErrAnnouncerClosed. The keys already handed to
+// the provide scheduler are still provided, but their outcome isn't reported.
+func (a *Announcer) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.stopWatch()
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	dropped := make([]AnnounceOutcome, 0, len(a.batch)+len(a.retries))
+	for _, k := range a.batch {
+		dropped = append(dropped, AnnounceOutcome{Key: k, Err: ErrAnnouncerClosed})
+	}
+	for mh, t := range a.retries {
+		t.Stop()
+		an := a.keys[mh]
+		dropped = append(dropped, AnnounceOutcome{Key: an.key, Attempts: an.attempts, Err: ErrAnnouncerClosed})
+	}
+	a.batch, a.keys, a.retries = nil, nil, nil
+	a.mu.Unlock()
+
+	a.reportAll(dropped, announceDropped)
+	return nil
+}
+
+// abort fails the keys batched or waiting to be retried once the DHT is
+// closed. The scheduled ones are failed by the provide scheduler.
+func (a *Announcer) abort() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	waiting := a.batch
+	for mh, t := range a.retries {
+		t.Stop()
+		waiting = append(waiting, a.keys[mh].key)
+	}
+	a.batch, a.retries = nil, make(map[string]*time.Timer)
+	failed := a.failLocked(waiting, a.dht.ctx.Err())
+	a.mu.Unlock()
+
+	a.reportAll(failed, announceFailed)
+}
+
+func (a *Announcer) flush() {
+	a.mu.Lock()
+	var failed []AnnounceOutcome
+	if !a.closed {
+		failed = a.flushLocked()
+	}
+	a.mu.Unlock()
+
+	a.reportAll(failed, announceFailed)
+}
+
+// flushLocked hands the batch over to the provide scheduler. It returns the
+// outcomes of the keys refused as the DHT is closed, to be reported once
+// unlocked.
+func (a *Announcer) flushLocked() []AnnounceOutcome {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	if len(a.batch) == 0 {
+		return nil
+	}
+	batch := a.batch
+	a.batch = nil
+	if err := a.dht.provideScheduler.enqueue(batch, a.provided); err != nil {
+		return a.failLocked(batch, err)
+	}
+	return nil
+}
+
+// failLocked ends the announcement of keys with err.
+func (a *Announcer) failLocked(keys []cid.Cid, err error) []AnnounceOutcome {
+	failed := make([]AnnounceOutcome, 0, len(keys))
+	for _, k := range keys {
+		mh := string(k.Hash())
+		if an, ok := a.keys[mh]; ok {
+			failed = append(failed, AnnounceOutcome{Key: k, Attempts: an.attempts, Err: err})
+			delete(a.keys, mh)
+		}
+	}
+	return failed
+}
+
+// provided is called by the provide scheduler with the outcome of a provide,
+// and retries it if it failed and attempts remain.
+func (a *Announcer) provided(k cid.Cid, err error) {
+	mh := string(k.Hash())
+
+	a.mu.Lock()
+	an, ok := a.keys[mh]
+	if a.closed || !ok {
+		a.mu.Unlock()
+		return
+	}
+	an.attempts++
+	attempts := an.attempts
+	// no provide runs once the DHT is closed, so don't retry
+	if err == nil || attempts >= a.opts.maxAttempts || a.dht.ctx.Err() != nil {
+		delete(a.keys, mh)
+		a.mu.Unlock()
+
+		outcome := announceProvided
+		if err != nil {
+			outcome = announceFailed
+		}
+		a.report(AnnounceOutcome{Key: k, Attempts: attempts, Err: err}, outcome)
+		return
+	}
+	a.retries[mh] = time.AfterFunc(a.backoff(attempts), func() {
+		a.mu.Lock()
+		if _, ok := a.retries[mh]; a.closed || !ok {
+			// closed, or aborted with the DHT
+			a.mu.Unlock()
+			return
+		}
+		delete(a.retries, mh)
+		var failed []AnnounceOutcome
+		if err := a.dht.provideScheduler.enqueue([]cid.Cid{k}, a.provided); err != nil {
+			failed = a.failLocked([]cid.Cid{k}, err)
+		}
+		a.mu.Unlock()
+
+		a.reportAll(failed, announceFailed)
+	})
+	a.mu.Unlock()
+}
+
+// backoff returns the delay before the attempt following the given number of
+// failed ones.
+func (a *Announcer) backoff(failed int) time.Duration {
+	d := a.opts.backoffBase
+	for i := 1; i < failed && d < a.opts.backoffMax; i++ {
+		d *= 2
+	}
+	if d > a.opts.backoffMax {
+		d = a.opts.backoffMax
+	}
+	return d
+}
+
+func (a *Announcer) reportAll(outcomes []AnnounceOutcome, outcome string) {
+	for _, o := range outcomes {
+		a.report(o, outcome)
+	}
+}
+
+func (a *Announcer) report(o AnnounceOutcome, outcome string) {
+	metrics.AnnouncedKeys.Add(a.dht.ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)), a.dht.protoAttr)
+	if a.opts.report != nil {
+		a.opts.report(o)
+	}
+}
@@ -0,0 +1,185 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false)
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	outcomes := make(chan AnnounceOutcome, 10)
+	a, err := NewAnnouncer(d1, AnnounceBatch(2, time.Hour), AnnounceReport(func(o AnnounceOutcome) { outcomes <- o }))
+	require.NoError(t, err)
+	defer a.Close()
+
+	// the duplicate doesn't count in the batch, which only fills up with
+	// the second key
+	require.NoError(t, a.Push(testCaseCids[0], testCaseCids[0]))
+	require.NoError(t, a.Push(testCaseCids[1]))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case o := <-outcomes:
+			require.NoError(t, o.Err)
+			require.Equal(t, 1, o.Attempts)
+		case <-time.After(5 * time.Second):
+			t.Fatal("keys not announced")
+		}
+	}
+	require.Eventually(t, func() bool {
+		for _, c := range testCaseCids[:2] {
+			provs, err := d2.providerStore.GetProviders(ctx, c.Hash())
+			if err != nil || len(provs) != 1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, a.Pending())
+}
+
+func TestAnnouncerRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// without peers, every provide fails
+	d := setupDHT(ctx, t, false)
+
+	outcomes := make(chan AnnounceOutcome, 1)
+	a, err := NewAnnouncer(d,
+		AnnounceBatch(1, time.Hour),
+		AnnounceRetries(3, time.Millisecond, 2*time.Millisecond),
+		AnnounceReport(func(o AnnounceOutcome) { outcomes <- o }),
+	)
+	require.NoError(t, err)
+	defer a.Close()
+
+	require.NoError(t, a.Push(testCaseCids[0]))
+	select {
+	case o := <-outcomes:
+		require.Error(t, o.Err)
+		require.Equal(t, testCaseCids[0], o.Key)
+		require.Equal(t, 3, o.Attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("key not reported")
+	}
+}
+
+func TestAnnouncerClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+
+	var outcomes []AnnounceOutcome
+	a, err := NewAnnouncer(d, AnnounceBatch(10, time.Hour), AnnounceReport(func(o AnnounceOutcome) { outcomes = append(outcomes, o) }))
+	require.NoError(t, err)
+
+	require.NoError(t, a.Push(testCaseCids[:3]...))
+	require.Equal(t, 3, a.Pending())
+	require.NoError(t, a.Close())
+
+	require.Len(t, outcomes, 3)
+	for _, o := range outcomes {
+		require.ErrorIs(t, o.Err, ErrAnnouncerClosed)
+	}
+	require.ErrorIs(t, a.Push(testCaseCids[3]), ErrAnnouncerClosed)
+}
+
+func TestAnnouncerCloseScheduled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first key fails and waits to be retried, the second one is being
+	// provided, waiting for the rate limit, and the third one is queued
+	d := setupDHT(ctx, t, false, ProvideSchedulerLimits(1, 0.001))
+	outcomes := make(chan AnnounceOutcome, 3)
+	a, err := NewAnnouncer(d,
+		AnnounceBatch(1, time.Hour),
+		AnnounceRetries(3, time.Hour, time.Hour),
+		AnnounceReport(func(o AnnounceOutcome) { outcomes <- o }),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Push(testCaseCids[:3]...))
+	require.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.retries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// only the key waiting to be retried is dropped, the scheduler still
+	// provides the others
+	require.NoError(t, a.Close())
+	require.Len(t, outcomes, 1)
+	o := <-outcomes
+	require.ErrorIs(t, o.Err, ErrAnnouncerClosed)
+	require.Equal(t, testCaseCids[0], o.Key)
+	require.Equal(t, 1, o.Attempts)
+	require.Equal(t, 1, d.ScheduledProvides())
+
+	// and their outcome isn't reported
+	require.NoError(t, d.Close())
+	require.Eventually(t, func() bool { return d.ScheduledProvides() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, outcomes)
+}
+
+func TestAnnouncerDHTClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first key fails and waits to be retried, the second one waits for
+	// the rate limit and the third one in the queue
+	d := setupDHT(ctx, t, false, ProvideSchedulerLimits(1, 0.001))
+	outcomes := make(chan AnnounceOutcome, 3)
+	a, err := NewAnnouncer(d,
+		AnnounceBatch(1, time.Hour),
+		AnnounceRetries(3, time.Hour, time.Hour),
+		AnnounceReport(func(o AnnounceOutcome) { outcomes <- o }),
+	)
+	require.NoError(t, err)
+	defer a.Close()
+
+	require.NoError(t, a.Push(testCaseCids[:3]...))
+	require.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.retries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, d.Close())
+	for i := 0; i < 3; i++ {
+		select {
+		case o := <-outcomes:
+			require.Error(t, o.Err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("keys not reported")
+		}
+	}
+	require.Zero(t, a.Pending())
+	require.Error(t, d.ScheduleProvide(testCaseCids[3]))
+}
+
+func TestAnnouncerOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	_, err := NewAnnouncer(d, AnnounceBatch(0, time.Second))
+	require.Error(t, err)
+	_, err = NewAnnouncer(d, AnnounceRetries(1, time.Minute, time.Second))
+	require.Error(t, err)
+
+	d = setupDHT(ctx, t, false, DisableProviders())
+	_, err = NewAnnouncer(d)
+	require.Error(t, err)
+}
@@ -0,0 +1,196 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/boxo/ipns"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// ServerAnswer is the answer of one of the closest servers to an audited key.
+type ServerAnswer struct {
+	Peer peer.ID
+	// Err is set if the request to the server failed, the other fields are
+	// then empty.
+	Err error
+
+	// Value is the record value the server holds for the key, nil if none.
+	Value []byte
+	// Seq is the sequence number of an IPNS record, 0 for other records.
+	Seq uint64
+	// Invalid is the reason Value was rejected by the validator, if it was.
+	Invalid error
+
+	// Providers are the providers the server holds for the key.
+	Providers []peer.ID
+
+	// Disagrees is set if the server answered, but not with the consensus of
+	// the audit.
+	Disagrees bool
+}
+
+// KeyAudit reports the answers of the closest servers to a key side by side.
+type KeyAudit struct {
+	Key string
+	// Servers are the answers of the closest servers, closest first.
+	Servers []ServerAnswer
+
+	// Value is the best valid value held by the servers, as selected by the
+	// validator, for an audit of a record.
+	Value []byte
+	// Providers are the providers held by a majority of the servers that
+	// answered, for an audit of providers.
+	Providers []peer.ID
+}
+
+// Disagreeing returns the servers that answered without agreeing with the
+// consensus.
+func (a *KeyAudit) Disagreeing() []peer.ID {
+	var ps []peer.ID
+	for _, s := range a.Servers {
+		if s.Disagrees {
+			ps = append(ps, s.Peer)
+		}
+	}
+	return ps
+}
+
+// AuditValue looks up the closest servers to key and asks each of them
+// individually for the record they hold. The answers are reported side by side
+// and the servers missing the best valid record, or holding a different or an
+// invalid one, are flagged as disagreeing. A key whose closest servers
+// disagree may be the target of a poisoning attempt, or may just not have
+// been republished recently.
+func (dht *IpfsDHT) AuditValue(ctx context.Context, key string) (*KeyAudit, error) {
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+	audit, err := dht.auditKey(ctx, key, func(ctx context.Context, p peer.ID, a *ServerAnswer) error {
+		rec, _, err := dht.protoMessenger.GetValue(ctx, p, key)
+		if err != nil || rec == nil {
+			return err
+		}
+		a.Value = rec.GetValue()
+		if a.Invalid = dht.Validator.Validate(key, a.Value); a.Invalid == nil && strings.HasPrefix(key, "/ipns/") {
+			if ir, err := ipns.UnmarshalRecord(a.Value); err == nil {
+				a.Seq, _ = ir.Sequence()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var valid [][]byte
+	for _, s := range audit.Servers {
+		if s.Err == nil && s.Value != nil && s.Invalid == nil {
+			valid = append(valid, s.Value)
+		}
+	}
+	if len(valid) > 0 {
+		if i, err := dht.Validator.Select(key, valid); err == nil {
+			audit.Value = valid[i]
+		}
+	}
+	for i := range audit.Servers {
+		s := &audit.Servers[i]
+		s.Disagrees = s.Err == nil && (s.Invalid != nil || !bytes.Equal(s.Value, audit.Value))
+	}
+	return audit, nil
+}
+
+// AuditProviders looks up the closest servers to key and asks each of them
+// individually for the providers they hold. The answers are reported side by
+// side; the providers held by a majority of the servers that answered form
+// the consensus, and the servers holding a different set are flagged as
+// disagreeing.
+func (dht *IpfsDHT) AuditProviders(ctx context.Context, key cid.Cid) (*KeyAudit, error) {
+	if !dht.enableProviders {
+		return nil, routing.ErrNotSupported
+	} else if !key.Defined() {
+		return nil, fmt.Errorf("%w: undefined cid", ErrInvalidKey)
+	}
+	mh := key.Hash()
+	audit, err := dht.auditKey(ctx, string(mh), func(ctx context.Context, p peer.ID, a *ServerAnswer) error {
+		provs, _, err := dht.protoMessenger.GetProviders(ctx, p, mh)
+		if err != nil {
+			return err
+		}
+		for _, ai := range provs {
+			a.Providers = append(a.Providers, ai.ID)
+		}
+		sort.Slice(a.Providers, func(i, j int) bool { return a.Providers[i] < a.Providers[j] })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	answered := 0
+	held := make(map[peer.ID]int)
+	for _, s := range audit.Servers {
+		if s.Err != nil {
+			continue
+		}
+		answered++
+		for _, p := range s.Providers {
+			held[p]++
+		}
+	}
+	for p, n := range held {
+		if 2*n > answered {
+			audit.Providers = append(audit.Providers, p)
+		}
+	}
+	sort.Slice(audit.Providers, func(i, j int) bool { return audit.Providers[i] < audit.Providers[j] })
+	for i := range audit.Servers {
+		s := &audit.Servers[i]
+		s.Disagrees = s.Err == nil && !equalPeers(s.Providers, audit.Providers)
+	}
+	return audit, nil
+}
+
+// auditKey asks each of the closest servers to key for their answer with ask.
+func (dht *IpfsDHT) auditKey(ctx context.Context, key string, ask func(ctx context.Context, p peer.ID, a *ServerAnswer) error) (*KeyAudit, error) {
+	closest, err := dht.GetClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	audit := &KeyAudit{Key: key, Servers: make([]ServerAnswer, len(closest))}
+	var wg sync.WaitGroup
+	for i, p := range closest {
+		audit.Servers[i].Peer = p
+		wg.Add(1)
+		go func(a *ServerAnswer) {
+			defer wg.Done()
+			if err := ask(ctx, a.Peer, a); err != nil {
+				*a = ServerAnswer{Peer: a.Peer, Err: err}
+			}
+		}(&audit.Servers[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func equalPeers(a, b []peer.ID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ptest "github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	test "github.com/libp2p/go-libp2p-kad-dht/internal/testing"
+)
+
+func TestAudit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	servers := make([]*IpfsDHT, 4)
+	for i := range servers {
+		servers[i] = setupDHT(ctx, t, false, DisableAutoRefresh())
+		connect(t, ctx, a, servers[i])
+	}
+	a.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	b, c, d, e := servers[0], servers[1], servers[2], servers[3]
+
+	t.Run("value", func(t *testing.T) {
+		for dht, val := range map[*IpfsDHT]string{b: "newer", c: "valid", e: "newer"} {
+			rec := record.MakePutRecord("/v/audit", []byte(val))
+			rec.TimeReceived = internal.FormatRFC3339(time.Now())
+			require.NoError(t, dht.putLocal(ctx, "/v/audit", rec))
+		}
+
+		audit, err := a.AuditValue(ctx, "/v/audit")
+		require.NoError(t, err)
+		require.Len(t, audit.Servers, 4)
+		require.Equal(t, "newer", string(audit.Value))
+		require.ElementsMatch(t, []peer.ID{c.self, d.self}, audit.Disagreeing())
+		for _, s := range audit.Servers {
+			require.NoError(t, s.Err)
+			if s.Peer == d.self {
+				require.Nil(t, s.Value)
+			}
+		}
+	})
+
+	t.Run("providers", func(t *testing.T) {
+		key := testCaseCids[0]
+		p1, p2 := ptest.RandPeerIDFatal(t), ptest.RandPeerIDFatal(t)
+		for _, dht := range []*IpfsDHT{b, c, e} {
+			require.NoError(t, dht.ProviderStore().AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: p1}))
+		}
+		require.NoError(t, c.ProviderStore().AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: p2}))
+
+		audit, err := a.AuditProviders(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, audit.Servers, 4)
+		require.Equal(t, []peer.ID{p1}, audit.Providers)
+		require.ElementsMatch(t, []peer.ID{c.self, d.self}, audit.Disagreeing())
+	})
+}
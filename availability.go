@@ -0,0 +1,300 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// KeyAvailability is the availability of a key monitored by an
+// AvailabilityMonitor.
+type KeyAvailability struct {
+	// Key is the record key, or the CID for the keys whose providers are
+	// monitored.
+	Key       string
+	Providers bool
+
+	// Available is set if the last check found the record, or at least one
+	// provider, on one of the closest servers to the key. Replicas is the
+	// number of closest servers that held it.
+	Available bool
+	Replicas  int
+	// Err is the reason the last check failed, if it couldn't reach the
+	// closest servers.
+	Err error
+
+	Checks        int
+	Successes     int
+	LastChecked   time.Time
+	LastAvailable time.Time
+}
+
+// SuccessRatio returns the ratio of the checks that found the key available.
+func (a KeyAvailability) SuccessRatio() float64 {
+	if a.Checks == 0 {
+		return 0
+	}
+	return float64(a.Successes) / float64(a.Checks)
+}
+
+// AvailabilityMonitor periodically checks that a set of keys remains
+// resolvable from the network. It is created with MonitorAvailability.
+type AvailabilityMonitor struct {
+	dht      *IpfsDHT
+	interval time.Duration
+	alert    func(KeyAvailability)
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	keys   map[string]*KeyAvailability
+	closed bool
+}
+
+// MonitorAvailability starts checking, every interval, that the keys added
+// with WatchValue and WatchProviders are held by the closest servers to them,
+// so that publishers learn when their records drop out of the network and can
+// republish them. Each check asks the closest servers individually, like
+// AuditValue and AuditProviders.
+//
+// alert, if not nil, is called with the availability of a key whenever it
+// changes: when a key is first found unavailable, drops out, or becomes
+// available again. It is called synchronously from the monitor and should
+// return quickly.
+//
+// The keys are monitored until ctx is canceled, Close is called or the DHT is
+// closed.
+func (dht *IpfsDHT) MonitorAvailability(ctx context.Context, interval time.Duration, alert func(KeyAvailability)) (*AvailabilityMonitor, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("availability check interval must be positive")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m := &AvailabilityMonitor{
+		dht:      dht,
+		interval: interval,
+		alert:    alert,
+		wake:     make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		keys:     make(map[string]*KeyAvailability),
+	}
+
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+		defer close(m.done)
+		defer cancel()
+		m.run(ctx)
+	}()
+	return m, nil
+}
+
+// WatchValue adds the record key to the monitored keys. It is checked right
+// away.
+func (m *AvailabilityMonitor) WatchValue(key string) {
+	m.watch("/value"+key, &KeyAvailability{Key: key})
+}
+
+// WatchProviders adds the providers of c to the monitored keys. They are
+// checked right away.
+func (m *AvailabilityMonitor) WatchProviders(c cid.Cid) {
+	m.watch("/providers/"+c.String(), &KeyAvailability{Key: c.String(), Providers: true})
+}
+
+// UnwatchValue stops monitoring the record key.
+func (m *AvailabilityMonitor) UnwatchValue(key string) {
+	m.unwatch("/value" + key)
+}
+
+// UnwatchProviders stops monitoring the providers of c.
+func (m *AvailabilityMonitor) UnwatchProviders(c cid.Cid) {
+	m.unwatch("/providers/" + c.String())
+}
+
+// Status returns the availability of the monitored keys, sorted by key.
+func (m *AvailabilityMonitor) Status() []KeyAvailability {
+	m.mu.Lock()
+	status := make([]KeyAvailability, 0, len(m.keys))
+	for _, a := range m.keys {
+		status = append(status, *a)
+	}
+	m.mu.Unlock()
+	sort.Slice(status, func(i, j int) bool { return status[i].Key < status[j].Key })
+	return status
+}
+
+// Close stops monitoring the keys.
+func (m *AvailabilityMonitor) Close() {
+	m.cancel()
+	<-m.done
+}
+
+func (m *AvailabilityMonitor) watch(id string, a *KeyAvailability) {
+	m.mu.Lock()
+	if _, ok := m.keys[id]; !ok {
+		m.keys[id] = a
+	}
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *AvailabilityMonitor) unwatch(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.keys[id]; ok {
+		if !m.closed && a.Checks > 0 && !a.Available {
+			metrics.UnavailableKeys.Add(context.Background(), -1, m.dht.protoAttr)
+		}
+		delete(m.keys, id)
+	}
+}
+
+func (m *AvailabilityMonitor) run(ctx context.Context) {
+	defer func() {
+		// the unavailable keys are no longer monitored
+		m.mu.Lock()
+		m.closed = true
+		for _, a := range m.keys {
+			if a.Checks > 0 && !a.Available {
+				metrics.UnavailableKeys.Add(context.Background(), -1, m.dht.protoAttr)
+			}
+		}
+		m.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.dht.ctx.Done():
+			return
+		case <-ticker.C:
+			m.checkAll(ctx, false)
+		case <-m.wake:
+			m.checkAll(ctx, true)
+		}
+	}
+}
+
+// checkAll checks the monitored keys one after the other, or only the ones
+// never checked if onlyNew is set.
+func (m *AvailabilityMonitor) checkAll(ctx context.Context, onlyNew bool) {
+	m.mu.Lock()
+	var ids []string
+	for id, a := range m.keys {
+		if !onlyNew || a.Checks == 0 {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		m.check(ctx, id)
+	}
+}
+
+func (m *AvailabilityMonitor) check(ctx context.Context, id string) {
+	m.mu.Lock()
+	a, ok := m.keys[id]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	key, providers := a.Key, a.Providers
+	m.mu.Unlock()
+
+	replicas, err := m.replicas(ctx, key, providers)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		m.dht.logger.Debugw("availability check failed", "key", internal.LoggableRecordKeyString(key), "error", err)
+	}
+	available := replicas > 0
+	kind, outcome := "value", "unavailable"
+	if providers {
+		kind = "providers"
+	}
+	if available {
+		outcome = "available"
+	}
+	metrics.KeyAvailabilityChecks.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("kind", kind),
+		attribute.String("outcome", outcome),
+	), m.dht.protoAttr)
+
+	m.mu.Lock()
+	if m.keys[id] != a {
+		// unwatched meanwhile
+		m.mu.Unlock()
+		return
+	}
+	wasUnavailable := a.Checks > 0 && !a.Available
+	changed := wasUnavailable == available || a.Checks == 0 && !available
+	if wasUnavailable && available {
+		metrics.UnavailableKeys.Add(ctx, -1, m.dht.protoAttr)
+	} else if !wasUnavailable && !available {
+		metrics.UnavailableKeys.Add(ctx, 1, m.dht.protoAttr)
+	}
+	now := time.Now()
+	a.Available, a.Replicas, a.Err = available, replicas, err
+	a.Checks++
+	a.LastChecked = now
+	if available {
+		a.Successes++
+		a.LastAvailable = now
+	}
+	status := *a
+	m.mu.Unlock()
+
+	if changed && m.alert != nil {
+		m.alert(status)
+	}
+}
+
+// replicas returns the number of closest servers to the key holding a valid
+// record, or providers.
+func (m *AvailabilityMonitor) replicas(ctx context.Context, key string, providers bool) (int, error) {
+	var audit *KeyAudit
+	if providers {
+		c, err := cid.Decode(key)
+		if err != nil {
+			return 0, err
+		}
+		if audit, err = m.dht.AuditProviders(ctx, c); err != nil {
+			return 0, err
+		}
+	} else {
+		var err error
+		if audit, err = m.dht.AuditValue(ctx, key); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for _, s := range audit.Servers {
+		if s.Err == nil && (len(s.Providers) > 0 || s.Value != nil && s.Invalid == nil) {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+func TestAvailabilityMonitor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+
+	rec := record.MakePutRecord("/v/avail", []byte("value"))
+	rec.TimeReceived = internal.FormatRFC3339(time.Now())
+	require.NoError(t, b.putLocal(ctx, "/v/avail", rec))
+	require.NoError(t, b.ProviderStore().AddProvider(ctx, testCaseCids[0].Hash(), peer.AddrInfo{ID: b.self}))
+
+	_, err := a.MonitorAvailability(ctx, 0, nil)
+	require.Error(t, err)
+
+	alerts := make(chan KeyAvailability, 10)
+	m, err := a.MonitorAvailability(ctx, 100*time.Millisecond, func(ka KeyAvailability) { alerts <- ka })
+	require.NoError(t, err)
+	defer m.Close()
+
+	m.WatchValue("/v/avail")
+	m.WatchProviders(testCaseCids[0])
+	m.WatchValue("/v/missing")
+
+	next := func() KeyAvailability {
+		select {
+		case ka := <-alerts:
+			return ka
+		case <-time.After(5 * time.Second):
+			t.Fatal("no alert")
+		}
+		return KeyAvailability{}
+	}
+	ka := next()
+	require.Equal(t, "/v/missing", ka.Key)
+	require.False(t, ka.Available)
+
+	require.Eventually(t, func() bool {
+		for _, ka := range m.Status() {
+			if ka.Checks == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, ka := range m.Status() {
+		if ka.Key == "/v/missing" {
+			continue
+		}
+		require.True(t, ka.Available, ka.Key)
+		require.Equal(t, 1, ka.Replicas)
+		require.Equal(t, ka.Providers, ka.Key == testCaseCids[0].String())
+	}
+
+	// the record drops out
+	require.NoError(t, b.datastore.Delete(ctx, mkDsKey("/v/avail")))
+	ka = next()
+	for ka.Key != "/v/avail" {
+		ka = next()
+	}
+	require.False(t, ka.Available)
+	require.Less(t, ka.SuccessRatio(), 1.0)
+	require.False(t, ka.LastAvailable.IsZero())
+
+	m.UnwatchValue("/v/avail")
+	require.Len(t, m.Status(), 2)
+}
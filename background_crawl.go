@@ -0,0 +1,182 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"sort"
+	"sync"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// backgroundCrawler keeps knowledge of the whole keyspace, not just of our
+// neighborhood: it splits the keyspace into 2^bits regions and, every
+// interval, looks up a random key of the next region in turn, remembering the
+// peers found. The lookups are then seeded with the remembered peers of the
+// region of their target, in addition to the routing table peers, saving the
+// hops to cold key ranges. A region is refreshed once per cycle of
+// interval*2^bits, and the addresses of its peers kept for two cycles.
+//
+// A nil *backgroundCrawler doesn't crawl.
+type backgroundCrawler struct {
+	dht      *IpfsDHT
+	interval time.Duration
+	bits     int
+	// next is the region crawled next, only used by the crawl goroutine.
+	next int
+
+	mu      sync.Mutex
+	regions [][]crawledPeer
+}
+
+type crawledPeer struct {
+	id  peer.ID
+	key kb.ID
+}
+
+func newBackgroundCrawler(dht *IpfsDHT, interval time.Duration, bits int) *backgroundCrawler {
+	if interval <= 0 {
+		return nil
+	}
+	return &backgroundCrawler{dht: dht, interval: interval, bits: bits, regions: make([][]crawledPeer, 1<<bits)}
+}
+
+func (c *backgroundCrawler) start() {
+	if c == nil {
+		return
+	}
+	c.dht.wg.Add(1)
+	go func() {
+		defer c.dht.wg.Done()
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !c.dht.Profile().PauseCrawl {
+					c.crawl()
+				}
+			case <-c.dht.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// crawl looks up a random key of the next region and remembers the peers
+// found in it.
+func (c *backgroundCrawler) crawl() {
+	region := c.next
+	c.next = (c.next + 1) % len(c.regions)
+
+	var target [32]byte
+	if _, err := rand.Read(target[:]); err != nil {
+		c.dht.logger.Warnw("failed to generate a background crawl target", "error", err)
+		return
+	}
+	for i := 0; i < c.bits; i++ {
+		mask := byte(0x80 >> (i % 8))
+		if region&(1<<(c.bits-1-i)) != 0 {
+			target[i/8] |= mask
+		} else {
+			target[i/8] &^= mask
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.dht.ctx, c.interval)
+	defer cancel()
+	peers, err := c.dht.GetClosestPeersToKey(ctx, target)
+	if err != nil && len(peers) == 0 {
+		if c.dht.ctx.Err() == nil {
+			c.dht.logger.Debugw("background crawl failed", "region", region, "error", err)
+		}
+		return
+	}
+
+	ttl := 2 * c.interval * time.Duration(len(c.regions))
+	crawled := make([]crawledPeer, 0, len(peers))
+	for _, p := range peers {
+		if p == c.dht.self {
+			continue
+		}
+		addrs := c.dht.peerstore.Addrs(p)
+		if len(addrs) == 0 {
+			continue
+		}
+		c.dht.peerstore.AddAddrs(p, addrs, ttl)
+		crawled = append(crawled, crawledPeer{id: p, key: c.dht.kadPeerID(p)})
+	}
+	c.mu.Lock()
+	c.regions[region] = crawled
+	c.mu.Unlock()
+}
+
+// seed adds to seeds the n remembered peers closest to target, for a lookup
+// of target to start from.
+func (c *backgroundCrawler) seed(target kb.ID, seeds []peer.ID, n int) []peer.ID {
+	if c == nil {
+		return seeds
+	}
+	c.mu.Lock()
+	crawled := append([]crawledPeer(nil), c.regions[c.regionOf(target)]...)
+	c.mu.Unlock()
+
+	sort.Slice(crawled, func(i, j int) bool { return xorCloser(crawled[i].key, crawled[j].key, target) })
+
+	known := make(map[peer.ID]struct{}, len(seeds))
+	for _, p := range seeds {
+		known[p] = struct{}{}
+	}
+	for _, cp := range crawled {
+		if n == 0 {
+			break
+		}
+		if _, ok := known[cp.id]; ok || len(c.dht.peerstore.Addrs(cp.id)) == 0 {
+			continue
+		}
+		seeds = append(seeds, cp.id)
+		n--
+	}
+	return seeds
+}
+
+// peers returns the remembered peers of all the regions.
+func (c *backgroundCrawler) peers() []peer.ID {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var peers []peer.ID
+	for _, crawled := range c.regions {
+		for _, cp := range crawled {
+			peers = append(peers, cp.id)
+		}
+	}
+	return peers
+}
+
+// regionOf returns the region of the keyspace id is in.
+func (c *backgroundCrawler) regionOf(id kb.ID) int {
+	var region int
+	for i := 0; i < c.bits; i++ {
+		region <<= 1
+		if id[i/8]&(0x80>>(i%8)) != 0 {
+			region |= 1
+		}
+	}
+	return region
+}
+
+// xorCloser tells whether a is closer to target than b.
+func xorCloser(a, b, target kb.ID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundCrawl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), BackgroundCrawl(time.Hour, 1))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+	others := []*IpfsDHT{b}
+	for i := 0; i < 3; i++ {
+		d := setupDHT(ctx, t, false, DisableAutoRefresh())
+		connect(t, ctx, b, d)
+		others = append(others, d)
+	}
+	require.Equal(t, 1, a.routingTable.Size())
+
+	// crawl both halves of the keyspace
+	a.crawl.crawl()
+	a.crawl.crawl()
+
+	low, high := make(kb.ID, 32), make(kb.ID, 32)
+	high[0] = 0x80
+	found := make(map[peer.ID]struct{})
+	for _, target := range []kb.ID{low, high} {
+		seeds := a.crawl.seed(target, nil, 20)
+		for i := 1; i < len(seeds); i++ {
+			require.True(t, xorCloser(a.kadPeerID(seeds[i-1]), a.kadPeerID(seeds[i]), target), "seeds should be sorted by distance")
+		}
+		for _, p := range seeds {
+			found[p] = struct{}{}
+		}
+	}
+	for _, d := range others {
+		require.Contains(t, found, d.self)
+	}
+
+	// the seeds already picked from the routing table aren't repeated
+	seeds := a.crawl.seed(low, []peer.ID{b.self}, 20)
+	require.Equal(t, b.self, seeds[0])
+	for _, p := range seeds[1:] {
+		require.NotEqual(t, b.self, p)
+	}
+	require.Len(t, a.crawl.seed(low, nil, 1), 1)
+
+	require.Equal(t, time.Hour, a.Config().BackgroundCrawl.Interval)
+	_, err := New(ctx, a.host, BackgroundCrawl(time.Hour, 17))
+	require.Error(t, err)
+}
@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+const (
+	// opServe accounts the requests we answer.
+	opServe = "Serve"
+	// opOther accounts the messages sent outside of any routing operation
+	// (e.g. the liveness checks of the routing table peers).
+	opOther = "Other"
+)
+
+// BandwidthStats counts the bytes of the DHT messages exchanged, including
+// their length prefix but not the transport overhead.
+type BandwidthStats struct {
+	Sent     int64
+	Received int64
+}
+
+// bandwidthAccounting attributes the bytes of the DHT messages to the remote
+// peers and to the routing operations (PutValue, GetValue, Provide, ...,
+// Serve for the requests we answer). Only the most recently active peers are
+// tracked.
+type bandwidthAccounting struct {
+	mu    sync.Mutex
+	total BandwidthStats
+	ops   map[string]*BandwidthStats
+	peers *lru.LRU // nil if per-peer accounting is disabled
+
+	protoAttr metric.MeasurementOption
+}
+
+func newBandwidthAccounting(maxPeers int, protoAttr metric.MeasurementOption) *bandwidthAccounting {
+	bw := &bandwidthAccounting{ops: make(map[string]*BandwidthStats), protoAttr: protoAttr}
+	if maxPeers > 0 {
+		bw.peers, _ = lru.NewLRU(maxPeers, nil)
+	}
+	return bw
+}
+
+func (bw *bandwidthAccounting) record(ctx context.Context, p peer.ID, op string, sent, received int) {
+	chargeProvideBudget(ctx, sent, received)
+	if op == "" {
+		op = opOther
+	}
+
+	bw.mu.Lock()
+	bw.total.Sent += int64(sent)
+	bw.total.Received += int64(received)
+	s, ok := bw.ops[op]
+	if !ok {
+		s = &BandwidthStats{}
+		bw.ops[op] = s
+	}
+	s.Sent += int64(sent)
+	s.Received += int64(received)
+	if bw.peers != nil {
+		v, ok := bw.peers.Get(p)
+		if !ok {
+			v = &BandwidthStats{}
+			bw.peers.Add(p, v)
+		}
+		ps := v.(*BandwidthStats)
+		ps.Sent += int64(sent)
+		ps.Received += int64(received)
+	}
+	bw.mu.Unlock()
+
+	attrs := metric.WithAttributes(attribute.String(metrics.KeyOperation, op))
+	if sent > 0 {
+		metrics.OperationSentBytes.Add(ctx, int64(sent), attrs, bw.protoAttr)
+	}
+	if received > 0 {
+		metrics.OperationReceivedBytes.Add(ctx, int64(received), attrs, bw.protoAttr)
+	}
+}
+
+// wireSize returns the size of a n bytes message once written on a stream,
+// with its varint length prefix.
+func wireSize(n int) int {
+	prefix := 1
+	for v := n >> 7; v != 0; v >>= 7 {
+		prefix++
+	}
+	return prefix + n
+}
+
+func msgWireSize(m *pb.Message) int {
+	return wireSize(m.Size())
+}
+
+// accountingSender accounts the messages sent through the wrapped sender.
+type accountingSender struct {
+	pb.MessageSenderWithDisconnect
+	bw *bandwidthAccounting
+}
+
+func (s *accountingSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+	switch {
+	case err == nil:
+		s.bw.record(ctx, p, internal.Operation(ctx), msgWireSize(pmes), msgWireSize(resp))
+	case errors.Is(err, net.ErrNoResponse):
+		// the request went out even though no response came back
+		s.bw.record(ctx, p, internal.Operation(ctx), msgWireSize(pmes), 0)
+	}
+	return resp, err
+}
+
+func (s *accountingSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	err := s.MessageSenderWithDisconnect.SendMessage(ctx, p, pmes)
+	if err == nil {
+		s.bw.record(ctx, p, internal.Operation(ctx), msgWireSize(pmes), 0)
+	}
+	return err
+}
+
+// BandwidthTotals returns the bytes of all the DHT messages exchanged.
+func (dht *IpfsDHT) BandwidthTotals() BandwidthStats {
+	dht.bandwidth.mu.Lock()
+	defer dht.bandwidth.mu.Unlock()
+	return dht.bandwidth.total
+}
+
+// BandwidthByOperation returns the bytes exchanged per routing operation,
+// keyed by the name of the IpfsDHT method that started it ("GetValue",
+// "Provide", ...), "Refresh" for the routing table refreshes, "Serve" for the
+// requests we answered and "Other" for the rest.
+func (dht *IpfsDHT) BandwidthByOperation() map[string]BandwidthStats {
+	dht.bandwidth.mu.Lock()
+	defer dht.bandwidth.mu.Unlock()
+	out := make(map[string]BandwidthStats, len(dht.bandwidth.ops))
+	for op, s := range dht.bandwidth.ops {
+		out[op] = *s
+	}
+	return out
+}
+
+// BandwidthByPeer returns the bytes exchanged with each of the most recently
+// active peers (see the BandwidthAccountingPeers option). Per-peer figures are
+// not exported as metrics to keep their cardinality bounded.
+func (dht *IpfsDHT) BandwidthByPeer() map[peer.ID]BandwidthStats {
+	dht.bandwidth.mu.Lock()
+	defer dht.bandwidth.mu.Unlock()
+	if dht.bandwidth.peers == nil {
+		return nil
+	}
+	out := make(map[peer.ID]BandwidthStats, dht.bandwidth.peers.Len())
+	for _, k := range dht.bandwidth.peers.Keys() {
+		v, _ := dht.bandwidth.peers.Peek(k)
+		out[k.(peer.ID)] = *v.(*BandwidthStats)
+	}
+	return out
+}
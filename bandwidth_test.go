@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthAccounting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false, BandwidthAccountingPeers(0))
+	connect(t, ctx, a, b)
+
+	require.NoError(t, a.PutValue(ctx, "/v/bw", []byte("value")))
+	val, err := a.GetValue(ctx, "/v/bw")
+	require.NoError(t, err)
+	require.Equal(t, "value", string(val))
+
+	ops := a.BandwidthByOperation()
+	for _, op := range []string{"PutValue", "GetValue"} {
+		require.Positive(t, ops[op].Sent, op)
+		require.Positive(t, ops[op].Received, op)
+	}
+	var sum BandwidthStats
+	for _, s := range ops {
+		sum.Sent += s.Sent
+		sum.Received += s.Received
+	}
+	require.Equal(t, a.BandwidthTotals(), sum)
+
+	// what a sent b received, and the other way around
+	peers := a.BandwidthByPeer()
+	require.Positive(t, peers[b.self].Sent)
+	served := b.BandwidthByOperation()[opServe]
+	require.LessOrEqual(t, ops["PutValue"].Sent+ops["GetValue"].Sent, served.Received)
+	require.Nil(t, b.BandwidthByPeer())
+}
+
+func TestBandwidthAccountingNoResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+
+	// b reads the requests, but resets the streams instead of answering
+	for _, proto := range b.serverProtocols {
+		b.host.SetStreamHandler(proto, func(s network.Stream) {
+			s.Read(make([]byte, 1))
+			s.Reset()
+		})
+	}
+	connectNoSync(t, ctx, a, b)
+
+	pmes := pb.NewMessage(pb.Message_GET_VALUE, []byte("/v/bw"), 0)
+	_, err := a.msgSender.SendRequest(startRequest(ctx, "GetValue"), b.self, pmes)
+	require.ErrorIs(t, err, net.ErrNoResponse)
+
+	// the request is accounted for even though it got no response
+	s := a.BandwidthByOperation()["GetValue"]
+	require.GreaterOrEqual(t, s.Sent, int64(msgWireSize(pmes)))
+	require.Zero(t, s.Received)
+}
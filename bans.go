@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// PeerBlocker blocks the connections of the banned peers, see PropagateBans.
+type PeerBlocker = dhtcfg.PeerBlocker
+
+// peerBans are the peers kept out of the routing table and the lookups, and
+// whose streams are reset.
+type peerBans struct {
+	propagate PeerBlocker
+	source    connmgr.ConnectionGater
+
+	mu    sync.RWMutex
+	peers map[peer.ID]string // peer -> reason
+}
+
+func newPeerBans(propagate PeerBlocker, source connmgr.ConnectionGater) *peerBans {
+	return &peerBans{
+		propagate: propagate,
+		source:    source,
+		peers:     make(map[peer.ID]string),
+	}
+}
+
+func (b *peerBans) banned(p peer.ID) bool {
+	b.mu.RLock()
+	_, ok := b.peers[p]
+	b.mu.RUnlock()
+	return ok || b.source != nil && !b.source.InterceptPeerDial(p)
+}
+
+// BanPeer bans p from the DHT for reason, until UnbanPeer: it is evicted from
+// the routing table and kept out of it, it isn't queried anymore and its
+// streams are reset. With PropagateBans, the ban is propagated to the
+// connection gater and p is disconnected.
+func (dht *IpfsDHT) BanPeer(p peer.ID, reason string) error {
+	if p == dht.self {
+		return fmt.Errorf("can't ban self")
+	}
+	dht.bans.mu.Lock()
+	dht.bans.peers[p] = reason
+	dht.bans.mu.Unlock()
+
+	dht.evictPeer(p, evictBanned)
+	dht.msgSender.OnDisconnect(dht.ctx, p)
+	metrics.BannedPeers.Add(dht.ctx, 1, dht.protoAttr)
+	dht.logger.Infow("banned peer", "peer", p, "reason", reason)
+
+	if dht.bans.propagate == nil {
+		return nil
+	}
+	if err := dht.bans.propagate.BlockPeer(p); err != nil {
+		return fmt.Errorf("propagating ban: %w", err)
+	}
+	return dht.host.Network().ClosePeer(p)
+}
+
+// UnbanPeer lifts the ban of p set with BanPeer, and its propagation. Peers
+// banned by the gater of BansFromGater stay banned until it accepts them.
+func (dht *IpfsDHT) UnbanPeer(p peer.ID) error {
+	dht.bans.mu.Lock()
+	_, ok := dht.bans.peers[p]
+	delete(dht.bans.peers, p)
+	dht.bans.mu.Unlock()
+
+	if !ok || dht.bans.propagate == nil {
+		return nil
+	}
+	if err := dht.bans.propagate.UnblockPeer(p); err != nil {
+		return fmt.Errorf("propagating unban: %w", err)
+	}
+	return nil
+}
+
+// BannedPeers returns the peers banned with BanPeer and the reasons they were
+// banned for.
+func (dht *IpfsDHT) BannedPeers() map[peer.ID]string {
+	dht.bans.mu.RLock()
+	defer dht.bans.mu.RUnlock()
+	banned := make(map[peer.ID]string, len(dht.bans.peers))
+	for p, reason := range dht.bans.peers {
+		banned[p] = reason
+	}
+	return banned
+}
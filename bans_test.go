@@ -0,0 +1,65 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/conngater"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gater, err := conngater.NewBasicConnectionGater(nil)
+	require.NoError(t, err)
+	a := setupDHT(ctx, t, false, PropagateBans(gater))
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+	connect(t, ctx, b, a)
+
+	require.NoError(t, a.BanPeer(b.self, "misbehaving"))
+	require.Equal(t, map[peer.ID]string{b.self: "misbehaving"}, a.BannedPeers())
+	require.Empty(t, a.routingTable.Find(b.self))
+	require.Equal(t, []peer.ID{b.self}, gater.ListBlockedPeers())
+	require.NotEqual(t, network.Connected, a.host.Network().Connectedness(b.self))
+	valid, err := a.validRTPeer(b.self)
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Error(t, a.BanPeer(a.self, "self"))
+
+	require.NoError(t, a.UnbanPeer(b.self))
+	require.Empty(t, a.BannedPeers())
+	require.Empty(t, gater.ListBlockedPeers())
+	valid, err = a.validRTPeer(b.self)
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
+func TestBansFromGater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gater, err := conngater.NewBasicConnectionGater(nil)
+	require.NoError(t, err)
+	a := setupDHT(ctx, t, false, BansFromGater(gater))
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+	require.True(t, a.Config().BanSource)
+
+	// b's requests are refused once the gater blocks it
+	require.NoError(t, b.protoMessenger.Ping(ctx, a.self))
+	require.NoError(t, gater.BlockPeer(b.self))
+	require.Error(t, b.protoMessenger.Ping(ctx, a.self))
+
+	valid, err := a.validRTPeer(b.self)
+	require.NoError(t, err)
+	require.False(t, valid)
+	// nor is it queried
+	peers, err := a.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.Empty(t, peers)
+}
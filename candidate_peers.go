@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pstore "github.com/libp2p/go-libp2p/core/peerstore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// maxCandidateDials bounds the dials to the candidate peers of
+// AddCandidatePeers in flight.
+const maxCandidateDials = 32
+
+// The outcomes of the candidate peers, as reported by the candidate peers
+// metric.
+const (
+	candidateChecked = "checked" // connected, passed to the routing table
+	candidateDialed  = "dialed"
+	candidateDropped = "dropped" // too many dials running
+	candidateIgnored = "ignored" // not useful to the routing table
+)
+
+// AddCandidatePeers feeds peers discovered by other means, e.g. GossipSub,
+// mDNS, rendezvous or static configuration, to the routing table, to populate
+// it faster in partially connected topologies. They go through the same
+// checks as the peers the DHT finds by itself: the peers not needed by the
+// routing table are ignored, the other ones are connected to if they aren't
+// already and only added once they proved to be DHT servers.
+//
+// It doesn't block, the candidates being checked in the background. Dials
+// beyond a few dozens in flight are dropped.
+func (dht *IpfsDHT) AddCandidatePeers(peers ...peer.AddrInfo) {
+	for _, ai := range peers {
+		if ai.ID == dht.self || ai.ID == "" || !dht.routingTable.UsefulNewPeer(ai.ID) {
+			dht.recordCandidate(candidateIgnored)
+			continue
+		}
+		dht.maybeAddAddrs(ai.ID, ai.Addrs, pstore.TempAddrTTL)
+		if dht.host.Network().Connectedness(ai.ID) == network.Connected {
+			dht.recordCandidate(candidateChecked)
+			dht.peerFound(ai.ID)
+			continue
+		}
+
+		select {
+		case dht.candidateDials <- struct{}{}:
+		default:
+			dht.recordCandidate(candidateDropped)
+			continue
+		}
+		dht.recordCandidate(candidateDialed)
+		dht.wg.Add(1)
+		go func(p peer.ID) {
+			defer dht.wg.Done()
+			defer func() { <-dht.candidateDials }()
+			ctx, cancel := context.WithTimeout(dht.ctx, dht.lookupCheckTimeout)
+			defer cancel()
+			// identifying the connected peer passes it to the routing table
+			if err := dht.host.Connect(ctx, dht.peerstore.PeerInfo(p)); err != nil {
+				dht.logger.Debugw("failed to connect to candidate peer", "peer", p, "error", err)
+			}
+		}(ai.ID)
+	}
+}
+
+func (dht *IpfsDHT) recordCandidate(outcome string) {
+	metrics.CandidatePeers.Add(dht.ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)), dht.protoAttr)
+}
@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddCandidatePeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, true)
+
+	d.AddCandidatePeers(
+		peer.AddrInfo{ID: d.self, Addrs: d.host.Addrs()},
+		peer.AddrInfo{ID: server.self, Addrs: server.host.Addrs()},
+		peer.AddrInfo{ID: client.self, Addrs: client.host.Addrs()},
+	)
+	require.Eventually(t, func() bool {
+		return d.routingTable.Find(server.self) != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	// clients aren't added, nor is self
+	require.Equal(t, 1, d.routingTable.Size())
+}
@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// capabilityCache remembers the optional protocol features of the peers, as
+// they advertised them in their last response, for ttl. Peers identify told
+// us don't speak any of our protocols are remembered as having none, so that
+// no extension is attempted against them.
+type capabilityCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	peers map[peer.ID]capabilityEntry
+	// sweepAt is the number of entries above which the expired ones are
+	// removed, twice the number of live entries after the last sweep.
+	sweepAt int
+}
+
+type capabilityEntry struct {
+	caps    pb.Capabilities
+	expires time.Time
+}
+
+// minCapabilitySweep is the number of entries below which the expired ones
+// are left in the cache.
+const minCapabilitySweep = 256
+
+func newCapabilityCache(ttl time.Duration) *capabilityCache {
+	return &capabilityCache{
+		ttl:     ttl,
+		peers:   make(map[peer.ID]capabilityEntry),
+		sweepAt: minCapabilitySweep,
+	}
+}
+
+// set records the capabilities of p as of now.
+func (c *capabilityCache) set(p peer.ID, caps pb.Capabilities) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.peers[p] = capabilityEntry{caps: caps, expires: now.Add(c.ttl)}
+	if len(c.peers) <= c.sweepAt {
+		return
+	}
+	for q, e := range c.peers {
+		if now.After(e.expires) {
+			delete(c.peers, q)
+		}
+	}
+	c.sweepAt = max(2*len(c.peers), minCapabilitySweep)
+}
+
+// get returns the capabilities of p, reporting false if they are unknown or
+// expired.
+func (c *capabilityCache) get(p peer.ID) (pb.Capabilities, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.peers[p]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.peers, p)
+		return 0, false
+	}
+	return e.caps, true
+}
+
+// capabilitySender records the capabilities advertised in the responses
+// received through the wrapped sender.
+type capabilitySender struct {
+	pb.MessageSenderWithDisconnect
+	capabilities *capabilityCache
+}
+
+func (s *capabilitySender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+	if err == nil {
+		s.capabilities.set(p, pb.Capabilities(resp.GetCapabilities()))
+	}
+	return resp, err
+}
+
+// PeerCapabilities returns the optional protocol features p advertised in its
+// last response to us, or zero if it never answered one of our requests, or
+// did so longer than the capability cache TTL ago.
+func (dht *IpfsDHT) PeerCapabilities(p peer.ID) pb.Capabilities {
+	caps, _ := dht.peerCapabilities.get(p)
+	return caps
+}
+
+// PeerSupports reports whether p is known to support all the optional
+// protocol features of f. Requests should only use a feature with the peers
+// it reports, the others being either older or unknown: a feature is not
+// attempted against a peer again until one of its responses advertised it.
+func (dht *IpfsDHT) PeerSupports(p peer.ID, f pb.Capabilities) bool {
+	caps, ok := dht.peerCapabilities.get(p)
+	return ok && caps.Has(f)
+}
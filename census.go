@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"sort"
+
+	"github.com/libp2p/go-libp2p-kad-dht/crawler"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Census counts peers by agent, transport and DHT protocol, see
+// IpfsDHT.Census.
+type Census = crawler.Census
+
+// Census counts the routing table peers, along with the peers found by the
+// background crawl if enabled, by what identify told about them: their agent,
+// the transports they listen on and the DHT protocols they support. Comparing
+// censuses over time tracks the adoption of upgrades across the network; the
+// peers crawled by the crawler package are counted with crawler.TakeCensus.
+func (dht *IpfsDHT) Census() Census {
+	peers := dht.routingTable.ListPeers()
+	if crawled := dht.crawl.peers(); len(crawled) > 0 {
+		seen := make(map[peer.ID]struct{}, len(peers))
+		for _, p := range peers {
+			seen[p] = struct{}{}
+		}
+		for _, p := range crawled {
+			if _, ok := seen[p]; !ok {
+				seen[p] = struct{}{}
+				peers = append(peers, p)
+			}
+		}
+	}
+	return crawler.TakeCensus(dht.peerstore, peers)
+}
+
+// maxCensusLabels bounds the agents and the peer protocols the census metrics
+// are labeled with, as peers choose them. The less common ones are counted as
+// otherCensusLabel.
+const maxCensusLabels = 16
+
+const otherCensusLabel = "other"
+
+// topCensusLabels keeps the maxCensusLabels largest counts of counts, and
+// sums the other ones under otherCensusLabel.
+func topCensusLabels(counts map[string]int) map[string]int {
+	if len(counts) <= maxCensusLabels {
+		return counts
+	}
+	labels := make([]string, 0, len(counts))
+	for l := range counts {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if counts[labels[i]] != counts[labels[j]] {
+			return counts[labels[i]] > counts[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	top := make(map[string]int, maxCensusLabels+1)
+	for i, l := range labels {
+		if i < maxCensusLabels && l != otherCensusLabel {
+			top[l] = counts[l]
+		} else {
+			top[otherCensusLabel] += counts[l]
+		}
+	}
+	return top
+}
+
+func (dht *IpfsDHT) observeCensus(observe func(inst *metrics.Instrument, value float64, attrs ...attribute.KeyValue)) {
+	c := dht.Census()
+	for agent, n := range topCensusLabels(c.Agents) {
+		observe(metrics.PeerAgents, float64(n), attribute.String(metrics.KeyAgent, agent))
+	}
+	for t, n := range c.Transports {
+		observe(metrics.PeerTransports, float64(n), attribute.String(metrics.KeyTransport, t))
+	}
+	for p, n := range topCensusLabels(c.Protocols) {
+		observe(metrics.PeerProtocols, float64(n), attribute.String(metrics.KeyPeerProtocol, p))
+	}
+}
@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestCensus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+
+	proto := string(a.protocols[0])
+	require.Eventually(t, func() bool {
+		return a.Census().Protocols[proto] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	census := a.Census()
+	require.Equal(t, 1, census.Peers)
+	require.NotEmpty(t, census.Transports)
+	agents := 0
+	for _, n := range census.Agents {
+		agents += n
+	}
+	require.Equal(t, 1, agents)
+
+	var observed float64
+	a.observeCensus(func(inst *metrics.Instrument, value float64, attrs ...attribute.KeyValue) {
+		if inst == metrics.PeerProtocols && len(attrs) == 1 && attrs[0].Value.AsString() == proto {
+			observed = value
+		}
+	})
+	require.Equal(t, 1.0, observed)
+}
+
+func TestTopCensusLabels(t *testing.T) {
+	counts := make(map[string]int)
+	for i := 0; i < 3*maxCensusLabels; i++ {
+		counts[fmt.Sprintf("agent/%d", i)] = i + 1
+	}
+	top := topCensusLabels(counts)
+	require.Len(t, top, maxCensusLabels+1)
+	require.Equal(t, 3*maxCensusLabels, top[fmt.Sprintf("agent/%d", 3*maxCensusLabels-1)])
+	require.NotContains(t, top, "agent/0")
+
+	total := 0
+	for _, n := range top {
+		total += n
+	}
+	require.Equal(t, 3*maxCensusLabels*(3*maxCensusLabels+1)/2, total)
+}
@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+const (
+	// churnWindow is the window the routing table churn is measured over.
+	churnWindow = time.Hour
+	// deadPeerRatioWeight is the weight of the last lookup in the moving
+	// average of the dead peer ratio.
+	deadPeerRatioWeight = 0.05
+)
+
+// ChurnStats estimates the churn of the network, as seen by the DHT. It helps
+// tuning the reprovide interval and the replication of the records: the
+// higher the churn, the sooner the peers holding a record are gone.
+type ChurnStats struct {
+	// RoutingTableChurn is the fraction of the routing table peers replaced
+	// per hour, over the last hour.
+	RoutingTableChurn float64
+	// Removed is the number of peers removed from the routing table over
+	// the last hour.
+	Removed int
+	// DeadPeerRatio is the moving average of the fraction of the peers
+	// contacted by the lookups that were unreachable.
+	DeadPeerRatio float64
+	// Lookups is the number of lookups DeadPeerRatio was measured over.
+	Lookups int64
+}
+
+type churnEstimator struct {
+	mu sync.Mutex
+	// removals are the times peers were removed from the routing table
+	// within the last churnWindow, oldest first.
+	removals  []time.Time
+	deadRatio float64
+	lookups   int64
+}
+
+func (c *churnEstimator) peerRemoved() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.trimLocked(now)
+	c.removals = append(c.removals, now)
+}
+
+func (c *churnEstimator) trimLocked(now time.Time) {
+	i := 0
+	for i < len(c.removals) && now.Sub(c.removals[i]) > churnWindow {
+		i++
+	}
+	c.removals = append(c.removals[:0], c.removals[i:]...)
+}
+
+// lookupDone accounts for the peers found unreachable by a completed lookup.
+func (c *churnEstimator) lookupDone(qps *qpeerset.QueryPeerset) {
+	dead := len(qps.GetClosestInStates(qpeerset.PeerUnreachable))
+	contacted := dead + len(qps.GetClosestInStates(qpeerset.PeerQueried))
+	if contacted == 0 {
+		return
+	}
+	ratio := float64(dead) / float64(contacted)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lookups == 0 {
+		c.deadRatio = ratio
+	} else {
+		c.deadRatio += deadPeerRatioWeight * (ratio - c.deadRatio)
+	}
+	c.lookups++
+}
+
+func (c *churnEstimator) stats(rtSize int) ChurnStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trimLocked(time.Now())
+	s := ChurnStats{Removed: len(c.removals), DeadPeerRatio: c.deadRatio, Lookups: c.lookups}
+	if rtSize > 0 {
+		s.RoutingTableChurn = float64(s.Removed) / float64(rtSize)
+	}
+	return s
+}
+
+// Churn returns the estimated churn of the network. It is also exported as
+// the libp2p.io/dht/kad/routing_table_churn and lookup_dead_peer_ratio gauges.
+func (dht *IpfsDHT) Churn() ChurnStats {
+	return dht.churn.stats(dht.routingTable.Size())
+}
+
+func (dht *IpfsDHT) observeChurn(observe func(inst *metrics.Instrument, value float64, attrs ...attribute.KeyValue)) {
+	s := dht.Churn()
+	observe(metrics.RoutingTableChurn, s.RoutingTableChurn)
+	if s.Lookups > 0 {
+		observe(metrics.LookupDeadPeerRatio, s.DeadPeerRatio)
+	}
+}
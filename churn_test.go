@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+func TestChurnEstimator(t *testing.T) {
+	var c churnEstimator
+
+	c.peerRemoved()
+	c.peerRemoved()
+	c.removals[0] = time.Now().Add(-2 * churnWindow)
+	s := c.stats(4)
+	require.Equal(t, 1, s.Removed)
+	require.Equal(t, .25, s.RoutingTableChurn)
+	require.Zero(t, c.stats(0).RoutingTableChurn)
+
+	qps := qpeerset.NewQueryPeerset("key")
+	for i, state := range []qpeerset.PeerState{qpeerset.PeerQueried, qpeerset.PeerQueried, qpeerset.PeerUnreachable, qpeerset.PeerHeard} {
+		p := peer.ID(rune('a' + i))
+		qps.TryAdd(p, "")
+		qps.SetState(p, state)
+	}
+	c.lookupDone(qps)
+	s = c.stats(4)
+	require.Equal(t, int64(1), s.Lookups)
+	require.InDelta(t, 1./3, s.DeadPeerRatio, 1e-9)
+
+	// a lookup without unreachable peers lowers the average
+	c.lookupDone(qpeerset.NewQueryPeerset("key"))
+	require.Equal(t, int64(1), c.stats(4).Lookups)
+	qps = qpeerset.NewQueryPeerset("key")
+	qps.TryAdd("a", "")
+	qps.SetState("a", qpeerset.PeerQueried)
+	c.lookupDone(qps)
+	require.Less(t, c.stats(4).DeadPeerRatio, 1./3)
+}
+
+func TestChurn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+
+	_, err := a.GetClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), a.Churn().Lookups)
+	require.Zero(t, a.Churn().DeadPeerRatio)
+
+	a.routingTable.RemovePeer(b.self)
+	require.Equal(t, 1, a.Churn().Removed)
+}
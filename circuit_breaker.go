@@ -0,0 +1,267 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// errCircuitOpen is returned for the RPCs to a peer whose circuit breaker is
+// open.
+var errCircuitOpen = errors.New("circuit breaker open for peer")
+
+// maxCircuitBreakerEntries bounds the number of peers with failures tracked,
+// stale entries are pruned once it is reached.
+const maxCircuitBreakerEntries = 4096
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreakers holds a circuit breaker per remote peer. A breaker opens
+// after failures consecutive RPC failures within window, failing the RPCs to
+// the peer for cooldown. It then half-opens, letting a single trial RPC
+// through, whose outcome closes or opens it again.
+//
+// A nil *circuitBreakers lets all the RPCs through.
+type circuitBreakers struct {
+	failures         int
+	window, cooldown time.Duration
+
+	mu    sync.Mutex
+	peers map[peer.ID]*breaker
+
+	protoAttr metric.MeasurementOption
+}
+
+type breaker struct {
+	state breakerState
+	// fails counts the consecutive failures since firstFail.
+	fails     int
+	firstFail time.Time
+	openedAt  time.Time
+	// trial is set while the trial RPC of a half-open breaker is running.
+	trial bool
+}
+
+func newCircuitBreakers(failures int, window, cooldown time.Duration, protoAttr metric.MeasurementOption) *circuitBreakers {
+	if failures <= 0 {
+		return nil
+	}
+	return &circuitBreakers{
+		failures: failures,
+		window:   window,
+		cooldown: cooldown,
+		peers:    make(map[peer.ID]*breaker),
+
+		protoAttr: protoAttr,
+	}
+}
+
+// isOpen reports whether the RPCs to p would currently fail, without taking
+// the trial of a half-open breaker.
+func (c *circuitBreakers) isOpen(p peer.ID) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.peers[p]
+	if !ok {
+		return false
+	}
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) < c.cooldown
+	case breakerHalfOpen:
+		return b.trial
+	}
+	return false
+}
+
+// allow reports whether an RPC may be sent to p. The caller must then report
+// its outcome with done, or call interrupted if it says nothing about p.
+func (c *circuitBreakers) allow(p peer.ID) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.peers[p]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < c.cooldown {
+			return false
+		}
+		c.setStateLocked(b, breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// done records the outcome of an RPC allowed to p.
+func (c *circuitBreakers) done(p peer.ID, failed bool) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.peers[p]
+	if !failed {
+		if ok {
+			c.setStateLocked(b, breakerClosed)
+			delete(c.peers, p)
+		}
+		return
+	}
+	if !ok {
+		if len(c.peers) >= maxCircuitBreakerEntries {
+			c.pruneLocked(now)
+		}
+		b = &breaker{}
+		c.peers[p] = b
+	}
+
+	switch b.state {
+	case breakerClosed:
+		if b.fails == 0 || now.Sub(b.firstFail) > c.window {
+			b.fails, b.firstFail = 0, now
+		}
+		b.fails++
+		if b.fails >= c.failures {
+			c.setStateLocked(b, breakerOpen)
+			b.openedAt = now
+		}
+	case breakerHalfOpen:
+		b.trial = false
+		c.setStateLocked(b, breakerOpen)
+		b.openedAt = now
+	}
+}
+
+func (c *circuitBreakers) setStateLocked(b *breaker, s breakerState) {
+	if b.state == s {
+		return
+	}
+	ctx := context.Background()
+	if b.state == breakerClosed {
+		metrics.OpenCircuitBreakers.Add(ctx, 1, c.protoAttr)
+	} else if s == breakerClosed {
+		metrics.OpenCircuitBreakers.Add(ctx, -1, c.protoAttr)
+	}
+	b.state = s
+	metrics.CircuitBreakerTransitions.Add(ctx, 1, metric.WithAttributes(attribute.String("state", s.String())), c.protoAttr)
+}
+
+// pruneLocked forgets the failures older than the window and the breakers
+// that stayed open, or half-open without a trial running, long after their
+// cooldown.
+func (c *circuitBreakers) pruneLocked(now time.Time) {
+	for p, b := range c.peers {
+		switch b.state {
+		case breakerClosed:
+			if now.Sub(b.firstFail) > c.window {
+				delete(c.peers, p)
+			}
+		case breakerOpen, breakerHalfOpen:
+			if !b.trial && now.Sub(b.openedAt) > c.cooldown+c.window {
+				c.setStateLocked(b, breakerClosed)
+				delete(c.peers, p)
+			}
+		}
+	}
+}
+
+// interrupted releases the trial of a half-open breaker whose RPC was
+// interrupted, without counting it as a failure or a success.
+func (c *circuitBreakers) interrupted(p peer.ID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.peers[p]; ok {
+		b.trial = false
+	}
+}
+
+// state returns the state of the breaker of p.
+func (c *circuitBreakers) state(p peer.ID) breakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.peers[p]; ok {
+		return b.state
+	}
+	return breakerClosed
+}
+
+// breakerSender fails the RPCs to the peers whose circuit breaker is open,
+// and feeds the breakers with the outcome of the others. RPCs interrupted by
+// their context, or refused by our own resource manager, say nothing about
+// the peer.
+type breakerSender struct {
+	pb.MessageSenderWithDisconnect
+	breakers *circuitBreakers
+}
+
+func (s *breakerSender) record(ctx context.Context, p peer.ID, err error) {
+	if err != nil && (ctx.Err() != nil || errors.Is(err, network.ErrResourceLimitExceeded)) {
+		s.breakers.interrupted(p)
+		return
+	}
+	s.breakers.done(p, err != nil)
+}
+
+func (s *breakerSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	if !s.breakers.allow(p) {
+		return nil, errCircuitOpen
+	}
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+	s.record(ctx, p, err)
+	return resp, err
+}
+
+func (s *breakerSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	if !s.breakers.allow(p) {
+		return errCircuitOpen
+	}
+	err := s.MessageSenderWithDisconnect.SendMessage(ctx, p, pmes)
+	s.record(ctx, p, err)
+	return err
+}
@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	require.Nil(t, newCircuitBreakers(0, time.Minute, time.Minute, metric.WithAttributes()))
+	c := newCircuitBreakers(3, time.Minute, 50*time.Millisecond, metric.WithAttributes())
+	p := peer.ID("peer")
+
+	// failures interrupted by a success don't open the breaker
+	for _, failed := range []bool{true, true, false, true, true} {
+		require.True(t, c.allow(p))
+		c.done(p, failed)
+	}
+	require.Equal(t, breakerClosed, c.state(p))
+
+	require.True(t, c.allow(p))
+	c.done(p, true)
+	require.Equal(t, breakerOpen, c.state(p))
+	require.True(t, c.isOpen(p))
+	require.False(t, c.allow(p))
+
+	// a single trial is let through after the cooldown
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, c.isOpen(p))
+	require.True(t, c.allow(p))
+	require.Equal(t, breakerHalfOpen, c.state(p))
+	require.False(t, c.allow(p))
+	require.True(t, c.isOpen(p))
+
+	// the trial failed
+	c.done(p, true)
+	require.Equal(t, breakerOpen, c.state(p))
+	require.False(t, c.allow(p))
+
+	// an interrupted trial is retried, then succeeds
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, c.allow(p))
+	c.interrupted(p)
+	require.Equal(t, breakerHalfOpen, c.state(p))
+	require.True(t, c.allow(p))
+	c.done(p, false)
+	require.Equal(t, breakerClosed, c.state(p))
+	require.True(t, c.allow(p))
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	c := newCircuitBreakers(2, 20*time.Millisecond, time.Minute, metric.WithAttributes())
+	p := peer.ID("peer")
+
+	c.done(p, true)
+	time.Sleep(30 * time.Millisecond)
+	// the first failure is out of the window
+	c.done(p, true)
+	require.Equal(t, breakerClosed, c.state(p))
+	c.done(p, true)
+	require.Equal(t, breakerOpen, c.state(p))
+}
+
+func TestCircuitBreakerPrune(t *testing.T) {
+	setupTestTelemetry()
+	proto := metrics.WithProtocol("/prune-test")
+	open := func() int64 {
+		return counterValue(t, "libp2p.io/dht/kad/open_circuit_breakers", attribute.String(metrics.KeyProtocol, "/prune-test"))
+	}
+	before := open()
+	c := newCircuitBreakers(1, 10*time.Millisecond, 10*time.Millisecond, proto)
+	open1, halfOpen, trial := peer.ID("open"), peer.ID("half-open"), peer.ID("trial")
+
+	for _, p := range []peer.ID{open1, halfOpen, trial} {
+		c.done(p, true)
+	}
+	require.EqualValues(t, 3, open()-before)
+	time.Sleep(15 * time.Millisecond)
+	// the trial of halfOpen was interrupted, the one of trial still runs
+	require.True(t, c.allow(halfOpen))
+	c.interrupted(halfOpen)
+	require.True(t, c.allow(trial))
+
+	time.Sleep(15 * time.Millisecond)
+	c.mu.Lock()
+	c.pruneLocked(time.Now())
+	c.mu.Unlock()
+	require.NotContains(t, c.peers, open1)
+	require.NotContains(t, c.peers, halfOpen)
+	require.Equal(t, breakerHalfOpen, c.state(trial))
+	require.EqualValues(t, 1, open()-before)
+}
+
+func TestCircuitBreakerRPCs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, CircuitBreaker(2, time.Minute, time.Minute))
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+	require.NoError(t, a.Ping(ctx, b.self))
+
+	// b starts resetting the streams
+	for _, proto := range b.serverProtocols {
+		b.host.SetStreamHandler(proto, func(s network.Stream) { s.Reset() })
+	}
+	require.NoError(t, a.host.Network().ClosePeer(b.self))
+	for i := 0; i < 2; i++ {
+		err := a.Ping(ctx, b.self)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, errCircuitOpen)
+	}
+	require.ErrorIs(t, a.Ping(ctx, b.self), errCircuitOpen)
+}
@@ -0,0 +1,233 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// committeeMinResolveInterval rate limits the lookups triggered by routing
+// table changes.
+const committeeMinResolveInterval = 10 * time.Second
+
+// CommitteeEvent reports a change of the closest peers to a watched key.
+type CommitteeEvent struct {
+	// Members is the new committee, closest peer first.
+	Members []peer.ID
+	// Joined and Left are the peers that entered and left the committee.
+	Joined []peer.ID
+	Left   []peer.ID
+	// Lasted is how long the previous committee remained unchanged.
+	Lasted time.Duration
+}
+
+// Committee is a continuously updated view of the closest peers to a key.
+// It is created with WatchCommittee.
+type Committee struct {
+	dht      *IpfsDHT
+	key      string
+	interval time.Duration
+
+	events chan CommitteeEvent
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	members []peer.ID
+	since   time.Time
+	// inRT are the members that were in the routing table when the
+	// committee was last resolved.
+	inRT map[peer.ID]struct{}
+}
+
+// WatchCommittee looks up the closest peers to key and keeps them up to
+// date, for applications that need a stable group of peers around a key
+// rather than the one-shot answer of GetClosestPeers. The committee is
+// resolved again every interval, and sooner when the routing table learns of
+// a closer peer or loses a member. Every change is sent on Events, which must
+// be drained for the committee to keep being updated.
+//
+// WatchCommittee returns once the first lookup completed. The committee is
+// watched until ctx is canceled, Close is called or the DHT is closed.
+func (dht *IpfsDHT) WatchCommittee(ctx context.Context, key string, interval time.Duration) (*Committee, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("committee resolution interval must be positive")
+	}
+	members, err := dht.GetClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c := &Committee{
+		dht:      dht,
+		key:      key,
+		interval: interval,
+		events:   make(chan CommitteeEvent, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		members:  members,
+		since:    time.Now(),
+	}
+	c.inRT = c.membersInRT(members)
+
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+		defer close(c.done)
+		defer close(c.events)
+		defer cancel()
+		c.run(ctx)
+	}()
+	return c, nil
+}
+
+// Members returns the current committee, closest peer first.
+func (c *Committee) Members() []peer.ID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]peer.ID(nil), c.members...)
+}
+
+// Since returns when the committee last changed.
+func (c *Committee) Since() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.since
+}
+
+// Events returns the channel the committee changes are sent on. It is closed
+// when the committee stops being watched.
+func (c *Committee) Events() <-chan CommitteeEvent {
+	return c.events
+}
+
+// Close stops watching the committee.
+func (c *Committee) Close() {
+	c.cancel()
+	<-c.done
+}
+
+func (c *Committee) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	var lastResolve time.Time
+	for {
+		rtChanged := c.dht.rtChanged()
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.dht.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rtChanged:
+			if time.Since(lastResolve) < committeeMinResolveInterval || !c.rtAffects() {
+				continue
+			}
+		}
+
+		lastResolve = time.Now()
+		members, err := c.dht.GetClosestPeers(ctx, c.key)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.dht.logger.Debugw("failed to resolve committee", "key", internal.LoggableRecordKeyString(c.key), "error", err)
+			}
+			continue
+		}
+		if ev, changed := c.update(members); changed {
+			select {
+			case c.events <- ev:
+			case <-ctx.Done():
+				return
+			case <-c.dht.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// update replaces the committee with members, reporting whether it changed.
+func (c *Committee) update(members []peer.ID) (CommitteeEvent, bool) {
+	inRT := c.membersInRT(members)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inRT = inRT
+
+	ev := CommitteeEvent{Members: members}
+	old := make(map[peer.ID]struct{}, len(c.members))
+	for _, p := range c.members {
+		old[p] = struct{}{}
+	}
+	for _, p := range members {
+		if _, ok := old[p]; ok {
+			delete(old, p)
+		} else {
+			ev.Joined = append(ev.Joined, p)
+		}
+	}
+	for _, p := range c.members {
+		if _, ok := old[p]; ok {
+			ev.Left = append(ev.Left, p)
+		}
+	}
+	if len(ev.Joined) == 0 && len(ev.Left) == 0 {
+		return ev, false
+	}
+
+	now := time.Now()
+	ev.Lasted = now.Sub(c.since)
+	c.members = members
+	c.since = now
+	return ev, true
+}
+
+func (c *Committee) membersInRT(members []peer.ID) map[peer.ID]struct{} {
+	inRT := make(map[peer.ID]struct{})
+	for _, p := range members {
+		if c.dht.routingTable.Find(p) != "" {
+			inRT[p] = struct{}{}
+		}
+	}
+	return inRT
+}
+
+// rtAffects reports whether the routing table knows of a peer closer to the
+// key than a member of the committee, or lost a member.
+func (c *Committee) rtAffects() bool {
+	c.mu.Lock()
+	members := c.members
+	inRT := c.inRT
+	c.mu.Unlock()
+
+	if len(members) == 0 {
+		return true
+	}
+	for p := range inRT {
+		if c.dht.routingTable.Find(p) == "" {
+			return true
+		}
+	}
+
+	inCommittee := make(map[peer.ID]struct{}, len(members))
+	for _, p := range members {
+		inCommittee[p] = struct{}{}
+	}
+	target := c.dht.kadKey(c.key)
+	farthest := c.dht.keyspaceHash.Distance([]byte(members[len(members)-1]), target)
+	for _, p := range c.dht.routingTable.NearestPeers(target, len(members)) {
+		if _, ok := inCommittee[p]; ok {
+			continue
+		}
+		if bytes.Compare(c.dht.keyspaceHash.Distance([]byte(p), target), farthest) < 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchCommittee(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	c, err := dhts[0].WatchCommittee(ctx, "hello", 50*time.Millisecond)
+	require.NoError(t, err)
+	defer c.Close()
+	members := c.Members()
+	require.Len(t, members, 4)
+
+	var gone *IpfsDHT
+	for _, d := range dhts[1:] {
+		if d.self == members[0] {
+			gone = d
+		}
+	}
+	require.NoError(t, gone.Close())
+	require.NoError(t, gone.host.Close())
+	for _, d := range dhts {
+		d.peerstore.ClearAddrs(gone.self)
+	}
+
+	select {
+	case ev := <-c.Events():
+		require.Contains(t, ev.Left, gone.self)
+		require.NotContains(t, ev.Members, gone.self)
+		require.Equal(t, ev.Members, c.Members())
+		require.Positive(t, ev.Lasted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the committee did not change")
+	}
+
+	c.Close()
+	_, ok := <-c.Events()
+	require.False(t, ok)
+}
@@ -0,0 +1,533 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+)
+
+// routingTable is the subset of the kbucket routing table API used by the DHT,
+// implemented by both *kb.RoutingTable and *compactRoutingTable.
+type routingTable interface {
+	Find(id peer.ID) peer.ID
+	NearestPeers(id kb.ID, count int) []peer.ID
+	ListPeers() []peer.ID
+	GetPeerInfos() []kb.PeerInfo
+	Size() int
+	NPeersForCpl(cpl uint) int
+	Print()
+
+	UsefulNewPeer(p peer.ID) bool
+	TryAddPeer(p peer.ID, queryPeer bool, isReplaceable bool) (bool, error)
+	RemovePeer(p peer.ID)
+	MarkAllPeersIrreplaceable()
+	UpdateLastSuccessfulOutboundQueryAt(p peer.ID, t time.Time) bool
+	UpdateLastUsefulAt(p peer.ID, t time.Time) bool
+
+	GenRandPeerID(targetCpl uint) (peer.ID, error)
+	GetTrackedCplsForRefresh() []time.Time
+	ResetCplRefreshedAtForID(id kb.ID, newTime time.Time)
+
+	GetDiversityStats() []peerdiversity.CplDiversityStats
+}
+
+var (
+	_ routingTable = (*kb.RoutingTable)(nil)
+	_ routingTable = (*compactRoutingTable)(nil)
+)
+
+// compactRoutingTableSnapshot copies the peers of the compact routing table
+// into a *kb.RoutingTable, for the callers of RoutingTable.
+func (dht *IpfsDHT) compactRoutingTableSnapshot() *kb.RoutingTable {
+	infos := dht.routingTable.GetPeerInfos()
+	// the buckets of the snapshot are big enough for every peer to fit, the
+	// compact table may place them with another keyspace hash
+	bucketSize := dht.bucketSize
+	if len(infos) > bucketSize {
+		bucketSize = len(infos)
+	}
+	// the latency of the peers was checked when they were added to the
+	// compact table, and no peer is ever replaced in the snapshot
+	rt, _ := kb.NewRoutingTable(bucketSize, dht.selfKey, math.MaxInt64, dht.peerstore, 0, nil)
+	for _, pi := range infos {
+		if _, err := rt.TryAddPeer(pi.Id, false, false); err != nil {
+			continue
+		}
+		rt.UpdateLastUsefulAt(pi.Id, pi.LastUsefulAt)
+		rt.UpdateLastSuccessfulOutboundQueryAt(pi.Id, pi.LastSuccessfulOutboundQueryAt)
+	}
+	return rt
+}
+
+// maxCompactCplForRefresh mirrors the highest cpl the kbucket routing table
+// refreshes.
+const maxCompactCplForRefresh uint = 15
+
+// Each peer of a compactRoutingTable is packed in its bucket as:
+//
+//	id length (1 byte) | id | last useful | last successful outbound query | added at | flags (1 byte)
+//
+// where the timestamps are big endian uint32 seconds since the table was
+// created, plus one (zero stands for the zero time).
+const (
+	compactEntryOverhead     = 1 + 3*4 + 1
+	compactFlagReplaceable   = 1
+	compactMaxPeerIDLen      = 255
+	compactLastUsefulOffset  = 0
+	compactLastSuccessOffset = 4
+	compactAddedAtOffset     = 8
+	compactFlagsOffset       = 12
+)
+
+// compactRoutingTable is a low-memory routing table for embedded devices. It
+// has one bucket per common prefix length, each packing its peers in a single
+// byte slice, and keeps no per-peer state besides that (notably no cached
+// Kademlia keys: they are hashed again when needed). Timestamps only have a
+// one second resolution. The diversity filter is not supported.
+type compactRoutingTable struct {
+	local      kb.ID
+	hash       internal.KeyspaceHash
+	bucketSize int
+	maxLatency time.Duration
+	metrics    peerstore.Metrics
+	epoch      time.Time
+
+	mu      sync.RWMutex
+	buckets [][]byte
+	size    int
+
+	cplRefreshLk   sync.Mutex
+	cplRefreshedAt [maxCompactCplForRefresh + 1]time.Time
+
+	// called after a peer was added to or removed from the table
+	PeerAdded   func(peer.ID)
+	PeerRemoved func(peer.ID)
+
+	// logger is the logger Print logs through
+	logger *zap.SugaredLogger
+}
+
+func newCompactRoutingTable(bucketSize int, local kb.ID, hash internal.KeyspaceHash, latency time.Duration, m peerstore.Metrics) *compactRoutingTable {
+	return &compactRoutingTable{
+		local:       local,
+		hash:        hash,
+		bucketSize:  bucketSize,
+		maxLatency:  latency,
+		metrics:     m,
+		epoch:       time.Now(),
+		PeerAdded:   func(peer.ID) {},
+		PeerRemoved: func(peer.ID) {},
+		logger:      &logger.SugaredLogger,
+	}
+}
+
+func (rt *compactRoutingTable) encodeTime(t time.Time) uint32 {
+	if t.IsZero() {
+		return 0
+	}
+	d := t.Sub(rt.epoch)
+	if d < 0 {
+		d = 0
+	}
+	return uint32(d/time.Second) + 1
+}
+
+func (rt *compactRoutingTable) decodeTime(v uint32) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return rt.epoch.Add(time.Duration(v-1) * time.Second)
+}
+
+func (rt *compactRoutingTable) cpl(p peer.ID) int {
+	return kb.CommonPrefixLen(rt.hash.ID([]byte(p)), rt.local)
+}
+
+// compactEntry returns the id and the fixed size fields of the entry at off.
+func compactEntry(b []byte, off int) (id []byte, fields []byte) {
+	n := int(b[off])
+	return b[off+1 : off+1+n], b[off+1+n : off+compactEntryOverhead+n]
+}
+
+func compactEntryLen(b []byte, off int) int {
+	return compactEntryOverhead + int(b[off])
+}
+
+// find returns the offset of p in bucket b, or -1.
+func compactFind(b []byte, p peer.ID) int {
+	for off := 0; off < len(b); off += compactEntryLen(b, off) {
+		if id, _ := compactEntry(b, off); string(id) == string(p) {
+			return off
+		}
+	}
+	return -1
+}
+
+func compactCount(b []byte) int {
+	n := 0
+	for off := 0; off < len(b); off += compactEntryLen(b, off) {
+		n++
+	}
+	return n
+}
+
+func (rt *compactRoutingTable) bucket(cpl int) []byte {
+	if cpl < len(rt.buckets) {
+		return rt.buckets[cpl]
+	}
+	return nil
+}
+
+// Find returns p if it is in the routing table, or the empty peer ID.
+func (rt *compactRoutingTable) Find(p peer.ID) peer.ID {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if compactFind(rt.bucket(rt.cpl(p)), p) < 0 {
+		return ""
+	}
+	return p
+}
+
+// NearestPeers returns the count peers of the table closest to id.
+func (rt *compactRoutingTable) NearestPeers(id kb.ID, count int) []peer.ID {
+	cpl := kb.CommonPrefixLen(id, rt.local)
+
+	var candidates []peer.ID
+	collect := func(b []byte) {
+		for off := 0; off < len(b); off += compactEntryLen(b, off) {
+			pid, _ := compactEntry(b, off)
+			candidates = append(candidates, peer.ID(pid))
+		}
+	}
+
+	rt.mu.RLock()
+	// same search order as the kbucket routing table: the target bucket first,
+	// then the buckets further from us and last the ones closer to us
+	collect(rt.bucket(cpl))
+	if len(candidates) < count {
+		for i := cpl + 1; i < len(rt.buckets); i++ {
+			collect(rt.buckets[i])
+		}
+	}
+	for i := min(cpl, len(rt.buckets)) - 1; i >= 0 && len(candidates) < count; i-- {
+		collect(rt.buckets[i])
+	}
+	rt.mu.RUnlock()
+
+	dists := make([][]byte, len(candidates))
+	for i, p := range candidates {
+		k := rt.hash.ID([]byte(p))
+		for j := range k {
+			k[j] ^= id[j]
+		}
+		dists[i] = k
+	}
+	sort.Sort(&compactByDistance{peers: candidates, dists: dists})
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+type compactByDistance struct {
+	peers []peer.ID
+	dists [][]byte
+}
+
+func (s *compactByDistance) Len() int { return len(s.peers) }
+func (s *compactByDistance) Less(i, j int) bool {
+	return bytes.Compare(s.dists[i], s.dists[j]) < 0
+}
+func (s *compactByDistance) Swap(i, j int) {
+	s.peers[i], s.peers[j] = s.peers[j], s.peers[i]
+	s.dists[i], s.dists[j] = s.dists[j], s.dists[i]
+}
+
+// ListPeers returns all the peers of the table.
+func (rt *compactRoutingTable) ListPeers() []peer.ID {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	peers := make([]peer.ID, 0, rt.size)
+	for _, b := range rt.buckets {
+		for off := 0; off < len(b); off += compactEntryLen(b, off) {
+			id, _ := compactEntry(b, off)
+			peers = append(peers, peer.ID(id))
+		}
+	}
+	return peers
+}
+
+// GetPeerInfos returns the information stored about all the peers of the
+// table.
+func (rt *compactRoutingTable) GetPeerInfos() []kb.PeerInfo {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	infos := make([]kb.PeerInfo, 0, rt.size)
+	for _, b := range rt.buckets {
+		for off := 0; off < len(b); off += compactEntryLen(b, off) {
+			id, f := compactEntry(b, off)
+			infos = append(infos, kb.PeerInfo{
+				Id:                            peer.ID(id),
+				LastUsefulAt:                  rt.decodeTime(binary.BigEndian.Uint32(f[compactLastUsefulOffset:])),
+				LastSuccessfulOutboundQueryAt: rt.decodeTime(binary.BigEndian.Uint32(f[compactLastSuccessOffset:])),
+				AddedAt:                       rt.decodeTime(binary.BigEndian.Uint32(f[compactAddedAtOffset:])),
+			})
+		}
+	}
+	return infos
+}
+
+// Size returns the number of peers in the table.
+func (rt *compactRoutingTable) Size() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.size
+}
+
+// NPeersForCpl returns the number of peers sharing cpl bits with us.
+func (rt *compactRoutingTable) NPeersForCpl(cpl uint) int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if cpl >= uint(len(rt.buckets)) {
+		return 0
+	}
+	return compactCount(rt.buckets[cpl])
+}
+
+// Print logs the peers of the table, bucket by bucket.
+func (rt *compactRoutingTable) Print() {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	rt.logger.Infow("compact routing table", "bucket_size", rt.bucketSize)
+	for cpl, b := range rt.buckets {
+		var peers []peer.ID
+		for off := 0; off < len(b); off += compactEntryLen(b, off) {
+			id, _ := compactEntry(b, off)
+			peers = append(peers, peer.ID(id))
+		}
+		rt.logger.Infow("compact routing table bucket", "cpl", cpl, "peers", peers)
+	}
+}
+
+// UsefulNewPeer reports whether p isn't in the table yet and its bucket has
+// room for it, or contains replaceable peers.
+func (rt *compactRoutingTable) UsefulNewPeer(p peer.ID) bool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	b := rt.bucket(rt.cpl(p))
+	if compactFind(b, p) >= 0 {
+		return false
+	}
+	return compactCount(b) < rt.bucketSize || compactReplaceable(b) >= 0
+}
+
+// compactReplaceable returns the offset of a replaceable peer in b, or -1.
+func compactReplaceable(b []byte) int {
+	for off := 0; off < len(b); off += compactEntryLen(b, off) {
+		if _, f := compactEntry(b, off); f[compactFlagsOffset]&compactFlagReplaceable != 0 {
+			return off
+		}
+	}
+	return -1
+}
+
+// TryAddPeer tries to add p to the table, following the semantics of the
+// kbucket routing table: it returns true if p was added, false with a nil error
+// if p already was in the table.
+func (rt *compactRoutingTable) TryAddPeer(p peer.ID, queryPeer bool, isReplaceable bool) (bool, error) {
+	if len(p) > compactMaxPeerIDLen {
+		return false, fmt.Errorf("peer ID too long for the compact routing table")
+	}
+	now := time.Now()
+	cpl := rt.cpl(p)
+
+	rt.mu.Lock()
+	b := rt.bucket(cpl)
+	if off := compactFind(b, p); off >= 0 {
+		// give the peer its usefulness bump the first time we query it
+		_, f := compactEntry(b, off)
+		if queryPeer && binary.BigEndian.Uint32(f[compactLastUsefulOffset:]) == 0 {
+			binary.BigEndian.PutUint32(f[compactLastUsefulOffset:], rt.encodeTime(now))
+		}
+		rt.mu.Unlock()
+		return false, nil
+	}
+
+	if rt.metrics.LatencyEWMA(p) > rt.maxLatency {
+		rt.mu.Unlock()
+		return false, kb.ErrPeerRejectedHighLatency
+	}
+
+	var replaced peer.ID
+	if compactCount(b) >= rt.bucketSize {
+		off := compactReplaceable(b)
+		if off < 0 {
+			rt.mu.Unlock()
+			return false, kb.ErrPeerRejectedNoCapacity
+		}
+		id, _ := compactEntry(b, off)
+		replaced = peer.ID(id)
+		b = append(b[:off], b[off+compactEntryLen(b, off):]...)
+		rt.size--
+	}
+
+	var lastUseful uint32
+	if queryPeer {
+		lastUseful = rt.encodeTime(now)
+	}
+	var flags byte
+	if isReplaceable {
+		flags = compactFlagReplaceable
+	}
+	entry := make([]byte, compactEntryOverhead+len(p))
+	entry[0] = byte(len(p))
+	f := entry[1+copy(entry[1:], p):]
+	binary.BigEndian.PutUint32(f[compactLastUsefulOffset:], lastUseful)
+	binary.BigEndian.PutUint32(f[compactLastSuccessOffset:], rt.encodeTime(now))
+	binary.BigEndian.PutUint32(f[compactAddedAtOffset:], rt.encodeTime(now))
+	f[compactFlagsOffset] = flags
+
+	for len(rt.buckets) <= cpl {
+		rt.buckets = append(rt.buckets, nil)
+	}
+	// new peers go first, like in the kbucket routing table
+	rt.buckets[cpl] = append(entry, b...)
+	rt.size++
+	rt.mu.Unlock()
+
+	rt.PeerAdded(p)
+	if replaced != "" {
+		rt.PeerRemoved(replaced)
+	}
+	return true, nil
+}
+
+// RemovePeer evicts p from the table.
+func (rt *compactRoutingTable) RemovePeer(p peer.ID) {
+	cpl := rt.cpl(p)
+	rt.mu.Lock()
+	b := rt.bucket(cpl)
+	off := compactFind(b, p)
+	if off < 0 {
+		rt.mu.Unlock()
+		return
+	}
+	rt.buckets[cpl] = append(b[:off], b[off+compactEntryLen(b, off):]...)
+	rt.size--
+	// drop the trailing empty buckets
+	for len(rt.buckets) > 0 && len(rt.buckets[len(rt.buckets)-1]) == 0 {
+		rt.buckets = rt.buckets[:len(rt.buckets)-1]
+	}
+	rt.mu.Unlock()
+
+	rt.PeerRemoved(p)
+}
+
+// MarkAllPeersIrreplaceable marks all the peers of the table as irreplaceable.
+func (rt *compactRoutingTable) MarkAllPeersIrreplaceable() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, b := range rt.buckets {
+		for off := 0; off < len(b); off += compactEntryLen(b, off) {
+			_, f := compactEntry(b, off)
+			f[compactFlagsOffset] &^= compactFlagReplaceable
+		}
+	}
+}
+
+func (rt *compactRoutingTable) updateTime(p peer.ID, offset int, t time.Time) bool {
+	cpl := rt.cpl(p)
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	b := rt.bucket(cpl)
+	off := compactFind(b, p)
+	if off < 0 {
+		return false
+	}
+	_, f := compactEntry(b, off)
+	binary.BigEndian.PutUint32(f[offset:], rt.encodeTime(t))
+	return true
+}
+
+// UpdateLastSuccessfulOutboundQueryAt updates the time of the last successful
+// query to p. It returns false if p isn't in the table.
+func (rt *compactRoutingTable) UpdateLastSuccessfulOutboundQueryAt(p peer.ID, t time.Time) bool {
+	return rt.updateTime(p, compactLastSuccessOffset, t)
+}
+
+// UpdateLastUsefulAt updates the time p was last useful. It returns false if p
+// isn't in the table.
+func (rt *compactRoutingTable) UpdateLastUsefulAt(p peer.ID, t time.Time) bool {
+	return rt.updateTime(p, compactLastUsefulOffset, t)
+}
+
+// GenRandPeerID generates a random peer ID sharing exactly targetCpl bits with
+// us. Rather than keeping a prefix table in memory, it draws random IDs until
+// one fits, which takes 2^(targetCpl+1) attempts on average.
+func (rt *compactRoutingTable) GenRandPeerID(targetCpl uint) (peer.ID, error) {
+	if targetCpl > maxCompactCplForRefresh {
+		return "", fmt.Errorf("cannot generate peer ID for Cpl greater than %d", maxCompactCplForRefresh)
+	}
+	var digest [sha256.Size]byte
+	for {
+		if _, err := rand.Read(digest[:]); err != nil {
+			return "", err
+		}
+		id, err := mh.Encode(digest[:], mh.SHA2_256)
+		if err != nil {
+			return "", err
+		}
+		if rt.cpl(peer.ID(id)) == int(targetCpl) {
+			return peer.ID(id), nil
+		}
+	}
+}
+
+// GetTrackedCplsForRefresh returns the last refresh time of each cpl up to the
+// highest one of the peers in the table.
+func (rt *compactRoutingTable) GetTrackedCplsForRefresh() []time.Time {
+	rt.mu.RLock()
+	maxCpl := uint(0)
+	if len(rt.buckets) > 0 {
+		maxCpl = uint(len(rt.buckets) - 1)
+	}
+	rt.mu.RUnlock()
+	if maxCpl > maxCompactCplForRefresh {
+		maxCpl = maxCompactCplForRefresh
+	}
+
+	rt.cplRefreshLk.Lock()
+	defer rt.cplRefreshLk.Unlock()
+	return append([]time.Time(nil), rt.cplRefreshedAt[:maxCpl+1]...)
+}
+
+// ResetCplRefreshedAtForID sets the refresh time of the cpl of id.
+func (rt *compactRoutingTable) ResetCplRefreshedAtForID(id kb.ID, newTime time.Time) {
+	cpl := uint(kb.CommonPrefixLen(id, rt.local))
+	if cpl > maxCompactCplForRefresh {
+		return
+	}
+	rt.cplRefreshLk.Lock()
+	rt.cplRefreshedAt[cpl] = newTime
+	rt.cplRefreshLk.Unlock()
+}
+
+// GetDiversityStats returns nil, the compact routing table has no diversity
+// filter.
+func (rt *compactRoutingTable) GetDiversityStats() []peerdiversity.CplDiversityStats {
+	return nil
+}
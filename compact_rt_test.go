@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactRoutingTable(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	defer ps.Close()
+
+	local := kb.ConvertPeerID(test.RandPeerIDFatal(t))
+	crt := newCompactRoutingTable(4, local, nil, time.Minute, ps)
+	ref, err := kb.NewRoutingTable(4, local, time.Minute, ps, time.Hour, nil)
+	require.NoError(t, err)
+
+	var added, removed []peer.ID
+	crt.PeerAdded = func(p peer.ID) { added = append(added, p) }
+	crt.PeerRemoved = func(p peer.ID) { removed = append(removed, p) }
+
+	for i := 0; i < 100; i++ {
+		p := test.RandPeerIDFatal(t)
+		ok1, err1 := crt.TryAddPeer(p, true, false)
+		ok2, err2 := ref.TryAddPeer(p, true, false)
+		require.Equal(t, ok2, ok1)
+		require.Equal(t, err2, err1)
+	}
+	require.Equal(t, ref.Size(), crt.Size())
+	require.Len(t, added, crt.Size())
+	require.ElementsMatch(t, ref.ListPeers(), crt.ListPeers())
+	for cpl := uint(0); cpl < 8; cpl++ {
+		require.Equal(t, ref.NPeersForCpl(cpl), crt.NPeersForCpl(cpl))
+	}
+	for i := 0; i < 10; i++ {
+		target := kb.ConvertPeerID(test.RandPeerIDFatal(t))
+		require.Equal(t, ref.NearestPeers(target, 10), crt.NearestPeers(target, 10))
+	}
+
+	// adding a peer again is a no-op
+	p := crt.ListPeers()[0]
+	ok, err := crt.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, p, crt.Find(p))
+
+	// timestamps are kept with a one second resolution
+	at := time.Now().Add(time.Hour)
+	require.True(t, crt.UpdateLastUsefulAt(p, at))
+	for _, pi := range crt.GetPeerInfos() {
+		if pi.Id == p {
+			require.WithinDuration(t, at, pi.LastUsefulAt, time.Second)
+			require.False(t, pi.AddedAt.IsZero())
+		}
+	}
+
+	crt.RemovePeer(p)
+	require.Equal(t, []peer.ID{p}, removed)
+	require.Empty(t, crt.Find(p))
+	require.False(t, crt.UpdateLastUsefulAt(p, at))
+
+	for cpl := uint(0); cpl < 4; cpl++ {
+		id, err := crt.GenRandPeerID(cpl)
+		require.NoError(t, err)
+		require.Equal(t, int(cpl), kb.CommonPrefixLen(local, kb.ConvertPeerID(id)))
+	}
+}
+
+func TestCompactRoutingTableReplace(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	defer ps.Close()
+
+	local := kb.ConvertPeerID(test.RandPeerIDFatal(t))
+	crt := newCompactRoutingTable(1, local, nil, time.Minute, ps)
+
+	// find two peers for the same bucket
+	var p1, p2 peer.ID
+	for p2 == "" {
+		p := test.RandPeerIDFatal(t)
+		if kb.CommonPrefixLen(local, kb.ConvertPeerID(p)) != 0 {
+			continue
+		}
+		if p1 == "" {
+			p1 = p
+		} else {
+			p2 = p
+		}
+	}
+
+	ok, err := crt.TryAddPeer(p1, false, true)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, crt.UsefulNewPeer(p2))
+
+	crt.MarkAllPeersIrreplaceable()
+	require.False(t, crt.UsefulNewPeer(p2))
+	_, err = crt.TryAddPeer(p2, false, false)
+	require.ErrorIs(t, err, kb.ErrPeerRejectedNoCapacity)
+
+	crt.RemovePeer(p1)
+	ok, err = crt.TryAddPeer(p1, false, true)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = crt.TryAddPeer(p2, false, false)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []peer.ID{p2}, crt.ListPeers())
+}
+
+func TestCompactRoutingTableLookups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 6, CompactRoutingTable())
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[i-1], dhts[i])
+	}
+	require.Equal(t, 1, dhts[0].RoutingTable().Size())
+	require.Equal(t, dhts[1].self, dhts[0].RoutingTable().Find(dhts[1].self))
+	require.Equal(t, 1, dhts[0].RoutingTableSize())
+	peers := dhts[0].RoutingTablePeers()
+	require.Len(t, peers, 1)
+	require.Equal(t, dhts[1].self, peers[0].Id)
+
+	require.NoError(t, dhts[0].PutValue(ctx, "/v/compact", []byte("compact")))
+	val, err := dhts[len(dhts)-1].GetValue(ctx, "/v/compact")
+	require.NoError(t, err)
+	require.Equal(t, "compact", string(val))
+}
@@ -0,0 +1,359 @@
+package dht
+
+import (
+	"sort"
+	"time"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ConfigView is a snapshot of the effective configuration of a DHT, once the
+// defaults, the options and the fallbacks have been applied. It supports
+// JSON marshalling, so it can be dumped by monitoring and debugging tools.
+//
+// Settings holding a function or an interface, such as filters and hooks,
+// are reported by whether they are set.
+type ConfigView struct {
+	Mode               ModeOpt
+	ProtocolPrefix     protocol.ID
+	V1ProtocolOverride protocol.ID `json:",omitempty"`
+	Protocols          []protocol.ID
+	ServerProtocols    []protocol.ID
+	RefusedProtocols   []protocol.ID `json:",omitempty"`
+	// Handlers is the dispatch table of the DHT, see IpfsDHT.Handlers.
+	Handlers               []MessageHandler
+	BucketSize             int
+	Concurrency            int
+	Resiliency             int
+	MaxRecordAge           time.Duration
+	EnableProviders        bool
+	EnableValues           bool
+	LookupCheckConcurrency int
+	LookupCheckTimeout     time.Duration
+	DisableLookupCheck     bool
+	PingProbes             bool
+	SelfRecord             bool
+
+	// ValidatorNamespaces lists the namespaces of a namespaced validator.
+	ValidatorNamespaces []string `json:",omitempty"`
+	CustomValidator     bool
+	QueryPeerFilter     bool
+	AddressFilter       bool
+	OnRequestHook       bool
+	OnDialFailure       bool
+	OnOutboundRequest   bool
+	OnRequestExtension  bool
+	OnResponseExtension bool
+	DialRanker          bool
+	PeerRanker          bool
+	GeoResolver         bool
+	ProviderFilter      bool
+	ConflictResolver    bool
+	CustomLogger        bool
+
+	RoutingTable struct {
+		RefreshQueryTimeout time.Duration
+		RefreshInterval     time.Duration
+		AutoRefresh         bool
+		LatencyTolerance    time.Duration
+		CheckInterval       time.Duration
+		PeerFilter          bool
+		DiversityFilter     bool
+		Compact             bool
+		DisconnectPolicy    DisconnectPolicy
+		DisconnectGrace     time.Duration
+		Probing             struct {
+			MinInterval time.Duration
+			MaxInterval time.Duration
+			Rate        float64
+		}
+	}
+
+	EnableOptimisticProvide       bool
+	OptimisticProvideJobsPoolSize int
+
+	RememberedPeers struct {
+		Size   int
+		MinAge time.Duration
+	}
+
+	MaxOutboundRequests int
+	DialBackoff         struct {
+		Base time.Duration
+		Max  time.Duration
+	}
+	RequestTimeout struct {
+		Floor      time.Duration
+		Ceiling    time.Duration
+		Multiplier float64
+	}
+	CircuitBreaker struct {
+		Failures int
+		Window   time.Duration
+		Cooldown time.Duration
+	}
+	SelfAudit struct {
+		Interval time.Duration
+		Sample   int
+		Report   bool
+	}
+	RequestSigning struct {
+		Sign    bool
+		Require bool
+		Audit   bool
+	}
+	Greylist         bool
+	BanPropagation   bool
+	BanSource        bool
+	ProviderDenylist bool
+	SpamKeys         struct {
+		Threshold int
+		Window    time.Duration
+		Policy    SpamKeyPolicy
+		Report    bool
+	}
+	OriginQuota struct {
+		Records   int
+		Providers int
+		Bytes     int64
+	}
+	BackgroundCrawl struct {
+		Interval time.Duration
+		Bits     int
+		Paused   bool
+	}
+	ConnectionPreference  ConnectionPreference
+	RelayAddrPolicy       RelayAddrPolicy
+	FindPeerVerifyTimeout time.Duration
+	NegativeCacheTTL      time.Duration
+
+	ProvideScheduler struct {
+		Workers        int
+		Rate           float64
+		Budget         int
+		BudgetInterval time.Duration
+	}
+
+	// ReprovideRefresh is the age from which the provider records already
+	// held by the closest peers are stored again, zero if they always are.
+	ReprovideRefresh time.Duration
+
+	NamespaceReplication map[string]int `json:",omitempty"`
+	// KeyspaceGapReplication is the extra replication of the keys in a
+	// keyspace gap, zero if disabled.
+	KeyspaceGapReplication int
+
+	ValueCorrection struct {
+		Disabled bool
+		MaxPeers int
+		Rate     float64
+	}
+
+	PassiveCache struct {
+		Size int
+		TTL  time.Duration
+	}
+
+	ProxyClients             []peer.ID `json:",omitempty"`
+	BandwidthAccountingPeers int
+	SlowRequestThreshold     time.Duration
+	// LatencyBuckets are the process-wide buckets of the latency histograms,
+	// see metrics.SetLatencyBuckets.
+	LatencyBuckets     []float64
+	Capabilities       pb.Capabilities
+	CapabilityCacheTTL time.Duration
+	// KeyspaceHash is the name of the keyspace hash, empty for sha256.
+	KeyspaceHash string `json:",omitempty"`
+	ShardBits    int
+	QueryWorkers int
+
+	InboundHandlers struct {
+		Max          int
+		QueueTimeout time.Duration
+	}
+
+	// ProviderWriteBehind is unused when a custom provider store is set.
+	ProviderWriteBehind struct {
+		Interval time.Duration
+		WALPath  string `json:",omitempty"`
+	}
+
+	LookupMemory struct {
+		Budget   int64
+		FailFast bool
+	}
+
+	// StreamPool is unused when a custom message sender is set.
+	StreamPool struct {
+		MaxStreamsPerPeer   int
+		IdleTimeout         time.Duration
+		HealthCheckInterval time.Duration
+	}
+}
+
+func newConfigView(cfg *dhtcfg.Config, protocols, serverProtocols []protocol.ID) ConfigView {
+	v := ConfigView{
+		Mode:                          cfg.Mode,
+		ProtocolPrefix:                cfg.ProtocolPrefix,
+		V1ProtocolOverride:            cfg.V1ProtocolOverride,
+		Protocols:                     protocols,
+		ServerProtocols:               serverProtocols,
+		RefusedProtocols:              cfg.RefusedProtocols,
+		BucketSize:                    cfg.BucketSize,
+		Concurrency:                   cfg.Concurrency,
+		Resiliency:                    cfg.Resiliency,
+		MaxRecordAge:                  cfg.MaxRecordAge,
+		EnableProviders:               cfg.EnableProviders,
+		EnableValues:                  cfg.EnableValues,
+		LookupCheckConcurrency:        cfg.LookupCheckConcurrency,
+		LookupCheckTimeout:            cfg.LookupCheckTimeout,
+		PingProbes:                    cfg.PingProbes,
+		SelfRecord:                    cfg.SelfRecord,
+		DisableLookupCheck:            cfg.DisableLookupCheck,
+		CustomValidator:               cfg.ValidatorChanged,
+		QueryPeerFilter:               cfg.QueryPeerFilter != nil,
+		AddressFilter:                 cfg.AddressFilter != nil,
+		OnRequestHook:                 cfg.OnRequestHook != nil,
+		OnDialFailure:                 cfg.OnDialFailure != nil,
+		OnOutboundRequest:             cfg.OnOutbound != nil,
+		OnRequestExtension:            cfg.OnRequestExtension != nil,
+		OnResponseExtension:           cfg.OnResponseExtension != nil,
+		DialRanker:                    cfg.DialRanker != nil,
+		PeerRanker:                    cfg.PeerRanker != nil,
+		GeoResolver:                   cfg.GeoResolver != nil,
+		ProviderFilter:                cfg.ProviderFilter != nil,
+		ConflictResolver:              cfg.ConflictResolver != nil,
+		CustomLogger:                  cfg.Logger != nil,
+		EnableOptimisticProvide:       cfg.EnableOptimisticProvide,
+		OptimisticProvideJobsPoolSize: cfg.OptimisticProvideJobsPoolSize,
+		MaxOutboundRequests:           cfg.MaxOutboundRequests,
+		ConnectionPreference:          cfg.ConnectionPreference,
+		RelayAddrPolicy:               cfg.RelayAddrPolicy,
+		FindPeerVerifyTimeout:         cfg.FindPeerVerifyTimeout,
+		NegativeCacheTTL:              cfg.NegativeCacheTTL,
+		ReprovideRefresh:              cfg.ReprovideRefresh,
+		NamespaceReplication:          cfg.NamespaceReplication,
+		KeyspaceGapReplication:        cfg.KeyspaceGaps.ExtraReplication,
+		ProxyClients:                  cfg.ProxyClients,
+		BandwidthAccountingPeers:      cfg.BandwidthAccountingPeers,
+		SlowRequestThreshold:          cfg.SlowRequestThreshold,
+		LatencyBuckets:                metrics.LatencyBuckets(),
+		Capabilities:                  cfg.Capabilities,
+		CapabilityCacheTTL:            cfg.CapabilityCacheTTL,
+		KeyspaceHash:                  cfg.KeyspaceHash.Name,
+		ShardBits:                     cfg.ShardBits,
+		QueryWorkers:                  cfg.QueryWorkers,
+	}
+
+	if nsval, ok := cfg.Validator.(record.NamespacedValidator); ok {
+		for ns := range nsval {
+			v.ValidatorNamespaces = append(v.ValidatorNamespaces, ns)
+		}
+		sort.Strings(v.ValidatorNamespaces)
+	}
+
+	v.RoutingTable.RefreshQueryTimeout = cfg.RoutingTable.RefreshQueryTimeout
+	v.RoutingTable.RefreshInterval = cfg.RoutingTable.RefreshInterval
+	v.RoutingTable.AutoRefresh = cfg.RoutingTable.AutoRefresh
+	v.RoutingTable.LatencyTolerance = cfg.RoutingTable.LatencyTolerance
+	v.RoutingTable.CheckInterval = cfg.RoutingTable.CheckInterval
+	v.RoutingTable.PeerFilter = cfg.RoutingTable.PeerFilter != nil
+	v.RoutingTable.DiversityFilter = cfg.RoutingTable.DiversityFilter != nil
+	v.RoutingTable.Compact = cfg.RoutingTable.Compact
+	v.RoutingTable.DisconnectPolicy = cfg.RoutingTable.DisconnectPolicy
+	v.RoutingTable.DisconnectGrace = cfg.RoutingTable.DisconnectGrace
+	v.RoutingTable.Probing.MinInterval = cfg.RoutingTable.Probing.MinInterval
+	v.RoutingTable.Probing.MaxInterval = cfg.RoutingTable.Probing.MaxInterval
+	v.RoutingTable.Probing.Rate = cfg.RoutingTable.Probing.Rate
+
+	v.RememberedPeers.Size = cfg.RememberedPeers.Size
+	v.RememberedPeers.MinAge = cfg.RememberedPeers.MinAge
+	v.DialBackoff.Base = cfg.DialBackoff.Base
+	v.DialBackoff.Max = cfg.DialBackoff.Max
+	v.RequestTimeout.Floor = cfg.RequestTimeout.Floor
+	v.RequestTimeout.Ceiling = cfg.RequestTimeout.Ceiling
+	v.RequestTimeout.Multiplier = cfg.RequestTimeout.Multiplier
+	v.CircuitBreaker.Failures = cfg.CircuitBreaker.Failures
+	v.CircuitBreaker.Window = cfg.CircuitBreaker.Window
+	v.CircuitBreaker.Cooldown = cfg.CircuitBreaker.Cooldown
+	v.SelfAudit.Interval = cfg.SelfAudit.Interval
+	v.SelfAudit.Sample = cfg.SelfAudit.Sample
+	v.SelfAudit.Report = cfg.SelfAudit.Report != nil
+	v.RequestSigning.Sign = cfg.RequestSigning.Sign
+	v.RequestSigning.Require = cfg.RequestSigning.Require
+	v.RequestSigning.Audit = cfg.RequestSigning.Audit != nil
+	v.Greylist = cfg.Greylist != nil
+	v.BanPropagation = cfg.Bans.Propagate != nil
+	v.BanSource = cfg.Bans.Source != nil
+	v.ProviderDenylist = cfg.Denylist != nil
+	v.SpamKeys.Threshold = cfg.SpamKeys.Threshold
+	v.SpamKeys.Window = cfg.SpamKeys.Window
+	v.SpamKeys.Policy = cfg.SpamKeys.Policy
+	v.SpamKeys.Report = cfg.SpamKeys.Report != nil
+	v.OriginQuota.Records = cfg.OriginQuota.Records
+	v.OriginQuota.Providers = cfg.OriginQuota.Providers
+	v.OriginQuota.Bytes = cfg.OriginQuota.Bytes
+	v.BackgroundCrawl.Interval = cfg.BackgroundCrawl.Interval
+	v.BackgroundCrawl.Bits = cfg.BackgroundCrawl.Bits
+	v.BackgroundCrawl.Paused = cfg.BackgroundCrawl.Paused
+	v.ProvideScheduler.Workers = cfg.ProvideScheduler.Workers
+	v.ProvideScheduler.Rate = cfg.ProvideScheduler.Rate
+	v.ProvideScheduler.Budget = cfg.ProvideScheduler.Budget
+	v.ProvideScheduler.BudgetInterval = cfg.ProvideScheduler.BudgetInterval
+	v.ValueCorrection.Disabled = cfg.ValueCorrection.Disabled
+	v.ValueCorrection.MaxPeers = cfg.ValueCorrection.MaxPeers
+	v.ValueCorrection.Rate = cfg.ValueCorrection.Rate
+	v.PassiveCache.Size = cfg.PassiveCache.Size
+	v.PassiveCache.TTL = cfg.PassiveCache.TTL
+	v.StreamPool.MaxStreamsPerPeer = cfg.StreamPool.MaxStreamsPerPeer
+	v.StreamPool.IdleTimeout = cfg.StreamPool.IdleTimeout
+	v.StreamPool.HealthCheckInterval = cfg.StreamPool.HealthCheckInterval
+	v.InboundHandlers.Max = cfg.InboundHandlers.Max
+	v.InboundHandlers.QueueTimeout = cfg.InboundHandlers.QueueTimeout
+	v.ProviderWriteBehind.Interval = cfg.ProviderWriteBehind.Interval
+	v.ProviderWriteBehind.WALPath = cfg.ProviderWriteBehind.WALPath
+	v.LookupMemory.Budget = cfg.LookupMemory.Budget
+	v.LookupMemory.FailFast = cfg.LookupMemory.FailFast
+
+	return v.clone()
+}
+
+// clone returns a copy of v that shares no slice or map with it.
+func (v ConfigView) clone() ConfigView {
+	v.Protocols = append([]protocol.ID(nil), v.Protocols...)
+	v.ServerProtocols = append([]protocol.ID(nil), v.ServerProtocols...)
+	v.RefusedProtocols = append([]protocol.ID(nil), v.RefusedProtocols...)
+	v.ValidatorNamespaces = append([]string(nil), v.ValidatorNamespaces...)
+	v.ProxyClients = append([]peer.ID(nil), v.ProxyClients...)
+	v.LatencyBuckets = append([]float64(nil), v.LatencyBuckets...)
+	if v.NamespaceReplication != nil {
+		m := make(map[string]int, len(v.NamespaceReplication))
+		for ns, n := range v.NamespaceReplication {
+			m[ns] = n
+		}
+		v.NamespaceReplication = m
+	}
+	return v
+}
+
+// Config returns the effective configuration of the DHT. The limits set by
+// the current resource profile (see SetProfile) replace the configured ones.
+// The returned view is a copy: modifying it has no effect on the DHT.
+func (dht *IpfsDHT) Config() ConfigView {
+	v := dht.config.clone()
+	p := dht.Profile()
+	if v.RoutingTable.AutoRefresh {
+		v.RoutingTable.RefreshInterval = p.RefreshInterval
+	}
+	v.MaxOutboundRequests = p.MaxOutboundRequests
+	v.Handlers = dht.Handlers()
+	v.ProvideScheduler.Workers = p.ProvideWorkers
+	v.ProvideScheduler.Rate = p.ProvideRate
+	v.BackgroundCrawl.Paused = p.PauseCrawl
+	return v
+}
@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigView(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false,
+		BucketSize(10),
+		NegativeCacheTTL(time.Minute),
+		NamespaceReplication("v", 3),
+	)
+
+	cfg := d.Config()
+	require.Equal(t, ModeServer, cfg.Mode)
+	require.Equal(t, 10, cfg.BucketSize)
+	require.Equal(t, time.Minute, cfg.NegativeCacheTTL)
+	require.Equal(t, map[string]int{"v": 3}, cfg.NamespaceReplication)
+	require.Contains(t, cfg.ValidatorNamespaces, "v")
+	require.False(t, cfg.RoutingTable.AutoRefresh)
+	require.NotEmpty(t, cfg.Protocols)
+	require.Equal(t, metrics.LatencyBuckets(), cfg.LatencyBuckets)
+
+	_, err := json.Marshal(cfg)
+	require.NoError(t, err)
+
+	// The view is a copy.
+	cfg.NamespaceReplication["v"] = 5
+	cfg.Protocols[0] = "/bogus"
+	require.Equal(t, 3, d.Config().NamespaceReplication["v"])
+	require.NotEqual(t, "/bogus", string(d.Config().Protocols[0]))
+
+	require.NoError(t, d.SetProfile(BatterySaverProfile))
+	cfg = d.Config()
+	require.Equal(t, BatterySaverProfile.MaxOutboundRequests, cfg.MaxOutboundRequests)
+	require.Equal(t, BatterySaverProfile.ProvideWorkers, cfg.ProvideScheduler.Workers)
+
+	_, err = New(ctx, d.host, LatencyBuckets(10, 1))
+	require.Error(t, err)
+	d2, err := New(ctx, d.host, LatencyBuckets(metrics.LatencyBuckets()...))
+	require.NoError(t, err)
+	require.NoError(t, d2.Close())
+}
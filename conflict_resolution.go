@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// RecordCandidate is a distinct valid record value found by SearchValue,
+// along with the peers (From) that returned it.
+type RecordCandidate = dhtcfg.RecordCandidate
+
+// ConflictResolution is the outcome of a ConflictResolver.
+//
+// Value is the winning record value, either one of the candidates or a merge
+// of them, and must pass the record validator. A nil Value keeps the value
+// chosen by the validator's Select.
+//
+// Correct lists the peers the winning value is put to. A nil Correct puts it to
+// all the closest peers that didn't return it, like when no resolver is
+// configured; an empty non-nil Correct disables corrections.
+type ConflictResolution = dhtcfg.ConflictResolution
+
+// ConflictResolver is called by SearchValue when the lookup found more than one
+// valid value for key. candidates lists every distinct value with the peers
+// that returned it, best is the value chosen by the validator and closest the
+// closest peers to key found by the lookup.
+type ConflictResolver = dhtcfg.ConflictResolver
+
+// recordCandidates collects the distinct values returned during a SearchValue.
+// A nil *recordCandidates collects nothing.
+type recordCandidates struct {
+	mu    sync.Mutex
+	cands []RecordCandidate
+}
+
+func (c *recordCandidates) add(v recvdVal) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.cands {
+		if bytes.Equal(c.cands[i].Value, v.Val) {
+			c.cands[i].From = append(c.cands[i].From, v.From)
+			return
+		}
+	}
+	c.cands = append(c.cands, RecordCandidate{Value: v.Val, From: []peer.ID{v.From}})
+}
+
+func (c *recordCandidates) list() []RecordCandidate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]RecordCandidate(nil), c.cands...)
+}
+
+// resolveConflict runs the conflict resolver, if the lookup found more than one
+// value. It returns the winning value, the peers to correct, and whether the
+// resolver changed the winning value.
+func (dht *IpfsDHT) resolveConflict(key string, cands *recordCandidates, best []byte, closest []peer.ID, peersWithBest map[peer.ID]struct{}) ([]byte, []peer.ID, bool) {
+	defaultCorrections := func(peersWithBest map[peer.ID]struct{}) []peer.ID {
+		updatePeers := make([]peer.ID, 0, len(closest))
+		for _, p := range closest {
+			if _, ok := peersWithBest[p]; !ok {
+				updatePeers = append(updatePeers, p)
+			}
+		}
+		return updatePeers
+	}
+
+	if cands == nil {
+		return best, defaultCorrections(peersWithBest), false
+	}
+	list := cands.list()
+	if len(list) < 2 {
+		return best, defaultCorrections(peersWithBest), false
+	}
+
+	res := dht.conflictResolver(key, list, best, closest)
+	changed := false
+	if res.Value != nil && !bytes.Equal(res.Value, best) {
+		if err := dht.Validator.Validate(key, res.Value); err != nil {
+			dht.logger.Warnw("conflict resolver returned an invalid value", "key", key, "error", err)
+		} else {
+			best, changed = res.Value, true
+			peersWithBest = make(map[peer.ID]struct{})
+			for _, c := range list {
+				if bytes.Equal(c.Value, best) {
+					for _, p := range c.From {
+						peersWithBest[p] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+
+	if res.Correct != nil {
+		return best, res.Correct, changed
+	}
+	return best, defaultCorrections(peersWithBest), changed
+}
@@ -0,0 +1,108 @@
+package crawler
+
+import (
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// UnknownAgent is the agent of the peers whose agent version isn't known,
+// as they weren't identified.
+const UnknownAgent = "unknown"
+
+// Census counts peers by what identify told about them, to track the
+// adoption of upgrades across the network.
+type Census struct {
+	Peers int
+	// Agents counts the peers by agent, the agent version reported by
+	// identify trimmed to its name and version (e.g. "kubo/0.25.0" for
+	// "kubo/0.25.0/3f884d3").
+	Agents map[string]int
+	// Transports counts the peers by transport (e.g. "tcp", "quic-v1",
+	// "webtransport") they listen on, a peer counting once for every one.
+	Transports map[string]int
+	// Protocols counts the peers by DHT protocol (e.g. "/ipfs/kad/1.0.0")
+	// they support, a peer counting once for every one.
+	Protocols map[string]int
+}
+
+// transports are the transport protocols Census reports, the last one of an
+// address being its transport: "/ip4/.../udp/.../quic-v1/webtransport" is a
+// webtransport address.
+var transports = map[int]struct{}{
+	ma.P_TCP:           {},
+	ma.P_UDP:           {},
+	ma.P_QUIC:          {},
+	ma.P_QUIC_V1:       {},
+	ma.P_WEBTRANSPORT:  {},
+	ma.P_WEBRTC:        {},
+	ma.P_WEBRTC_DIRECT: {},
+	ma.P_WS:            {},
+	ma.P_WSS:           {},
+	ma.P_CIRCUIT:       {},
+}
+
+// TakeCensus counts peers by the identify data ps holds about them, for
+// instance the peers crawled by a DefaultCrawler, with the peerstore of its
+// host.
+func TakeCensus(ps peerstore.Peerstore, peers []peer.ID) Census {
+	c := Census{
+		Peers:      len(peers),
+		Agents:     make(map[string]int),
+		Transports: make(map[string]int),
+		Protocols:  make(map[string]int),
+	}
+	for _, p := range peers {
+		agent := UnknownAgent
+		if v, err := ps.Get(p, "AgentVersion"); err == nil {
+			if s, ok := v.(string); ok && s != "" {
+				agent = trimAgent(s)
+			}
+		}
+		c.Agents[agent]++
+
+		seen := make(map[string]struct{})
+		for _, a := range ps.Addrs(p) {
+			t := transportOf(a)
+			if _, ok := seen[t]; ok || t == "" {
+				continue
+			}
+			seen[t] = struct{}{}
+			c.Transports[t]++
+		}
+
+		protos, err := ps.GetProtocols(p)
+		if err != nil {
+			continue
+		}
+		for _, proto := range protos {
+			if strings.Contains(string(proto), "/kad/") {
+				c.Protocols[string(proto)]++
+			}
+		}
+	}
+	return c
+}
+
+// trimAgent trims an agent version to its name and version.
+func trimAgent(agent string) string {
+	parts := strings.SplitN(agent, "/", 3)
+	if len(parts) < 2 {
+		return agent
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// transportOf returns the name of the transport of a, empty if unknown.
+func transportOf(a ma.Multiaddr) string {
+	var name string
+	ma.ForEach(a, func(c ma.Component) bool {
+		if _, ok := transports[c.Protocol().Code]; ok {
+			name = c.Protocol().Name
+		}
+		return true
+	})
+	return name
+}
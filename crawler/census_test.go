@@ -0,0 +1,47 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestTakeCensus(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	a, b, c := peer.ID("a"), peer.ID("b"), peer.ID("c")
+	ps.AddAddrs(a, []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/4001"),
+		ma.StringCast("/ip4/1.2.3.4/udp/4001/quic-v1"),
+		ma.StringCast("/ip6/::1/udp/4001/quic-v1/webtransport"),
+	}, time.Hour)
+	ps.AddAddrs(b, []ma.Multiaddr{
+		ma.StringCast("/ip4/5.6.7.8/tcp/4001"),
+		ma.StringCast("/ip6/::2/tcp/4001"),
+	}, time.Hour)
+	ps.Put(a, "AgentVersion", "kubo/0.25.0/3f884d3")
+	ps.Put(b, "AgentVersion", "kubo/0.25.0")
+	ps.SetProtocols(a, "/ipfs/kad/1.0.0", "/ipfs/id/1.0.0")
+	ps.SetProtocols(b, "/ipfs/kad/1.0.0", "/ipfs/lan/kad/1.0.0")
+
+	census := TakeCensus(ps, []peer.ID{a, b, c})
+	if census.Peers != 3 {
+		t.Errorf("expected 3 peers, got %d", census.Peers)
+	}
+	if len(census.Agents) != 2 || census.Agents["kubo/0.25.0"] != 2 || census.Agents[UnknownAgent] != 1 {
+		t.Errorf("unexpected agents %v", census.Agents)
+	}
+	if len(census.Transports) != 3 || census.Transports["tcp"] != 2 || census.Transports["quic-v1"] != 1 || census.Transports["webtransport"] != 1 {
+		t.Errorf("unexpected transports %v", census.Transports)
+	}
+	if len(census.Protocols) != 2 || census.Protocols["/ipfs/kad/1.0.0"] != 2 || census.Protocols["/ipfs/lan/kad/1.0.0"] != 1 {
+		t.Errorf("unexpected protocols %v", census.Protocols)
+	}
+}
@@ -38,6 +38,7 @@ type (
 		host                 host.Host
 		dhtRPC               *pb.ProtocolMessenger
 		dialAddressExtendDur time.Duration
+		exporters            []Exporter
 	}
 )
 
@@ -65,6 +66,7 @@ func NewDefaultCrawler(host host.Host, opts ...Option) (*DefaultCrawler, error)
 		host:                 host,
 		dhtRPC:               pm,
 		dialAddressExtendDur: o.dialAddressExtendDur,
+		exporters:            o.exporters,
 	}, nil
 }
 
@@ -156,6 +158,7 @@ func (c *DefaultCrawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo
 		}()
 	}
 
+	defer c.flushExporters()
 	defer wg.Wait()
 	defer close(jobs)
 
@@ -209,8 +212,12 @@ func (c *DefaultCrawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo
 				if handleSuccess != nil {
 					handleSuccess(res.peer, rtPeers)
 				}
-			} else if handleFail != nil {
-				handleFail(res.peer, res.err)
+				c.export(res.peer, rtPeers, nil)
+			} else {
+				if handleFail != nil {
+					handleFail(res.peer, res.err)
+				}
+				c.export(res.peer, nil, res.err)
 			}
 			outstanding--
 		case jobCh <- nextPeerID:
@@ -222,6 +229,31 @@ func (c *DefaultCrawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo
 	}
 }
 
+// export passes the outcome of crawling p to the exporters.
+func (c *DefaultCrawler) export(p peer.ID, rtPeers []*peer.AddrInfo, err error) {
+	if len(c.exporters) == 0 {
+		return
+	}
+	var addrs []string
+	for _, a := range c.host.Peerstore().Addrs(p) {
+		addrs = append(addrs, a.String())
+	}
+	r := newPeerRecord(p, addrs, rtPeers, err)
+	for _, e := range c.exporters {
+		if err := e.Export(r); err != nil {
+			logger.Warnf("failed to export crawl record of peer %v: %v", p, err)
+		}
+	}
+}
+
+func (c *DefaultCrawler) flushExporters() {
+	for _, e := range c.exporters {
+		if err := e.Flush(); err != nil {
+			logger.Warnf("failed to flush crawl exporter: %v", err)
+		}
+	}
+}
+
 type queryResult struct {
 	peer peer.ID
 	data map[peer.ID]*peer.AddrInfo
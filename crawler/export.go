@@ -0,0 +1,155 @@
+package crawler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SchemaVersion is the version of the schema of the exported PeerRecords. It
+// is bumped whenever a field is renamed, removed or changes meaning, so that
+// the pipelines consuming crawl output can tell the records apart.
+const SchemaVersion = 1
+
+// PeerRecord is the outcome of crawling a peer, as exported. The parquet tags
+// let Parquet writers derive their schema from it.
+type PeerRecord struct {
+	SchemaVersion int       `json:"schema_version" parquet:"schema_version"`
+	CrawledAt     time.Time `json:"crawled_at" parquet:"crawled_at,timestamp(millisecond)"`
+	Peer          string    `json:"peer" parquet:"peer"`
+	Addrs         []string  `json:"addrs" parquet:"addrs,list"`
+	// Reachable tells whether the peer answered, with its routing table
+	// peers listed in Neighbors, or failed with Error.
+	Reachable bool     `json:"reachable" parquet:"reachable"`
+	Neighbors []string `json:"neighbors,omitempty" parquet:"neighbors,list"`
+	Error     string   `json:"error,omitempty" parquet:"error,optional"`
+}
+
+// Exporter receives the PeerRecords of a crawl, see WithExporters. Its
+// methods are called from the goroutine running the crawl.
+type Exporter interface {
+	Export(PeerRecord) error
+	// Flush is called at the end of every crawl.
+	Flush() error
+}
+
+func newPeerRecord(p peer.ID, addrs []string, neighbors []*peer.AddrInfo, err error) PeerRecord {
+	r := PeerRecord{
+		SchemaVersion: SchemaVersion,
+		CrawledAt:     time.Now().UTC(),
+		Peer:          p.String(),
+		Addrs:         addrs,
+		Reachable:     err == nil,
+	}
+	for _, ai := range neighbors {
+		r.Neighbors = append(r.Neighbors, ai.ID.String())
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+type jsonExporter struct {
+	enc *json.Encoder
+}
+
+// NewJSONExporter returns an Exporter writing the records to w as JSON lines.
+func NewJSONExporter(w io.Writer) Exporter {
+	return &jsonExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *jsonExporter) Export(r PeerRecord) error {
+	return e.enc.Encode(r)
+}
+
+func (e *jsonExporter) Flush() error {
+	return nil
+}
+
+// csvHeader are the columns of the CSV export, in order.
+var csvHeader = []string{"schema_version", "crawled_at", "peer", "addrs", "reachable", "neighbors", "error"}
+
+type csvExporter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+// NewCSVExporter returns an Exporter writing the records to w as CSV, after a
+// header row. The addresses and neighbors are separated by spaces and the
+// times formatted as RFC 3339.
+func NewCSVExporter(w io.Writer) Exporter {
+	return &csvExporter{w: csv.NewWriter(w)}
+}
+
+func (e *csvExporter) Export(r PeerRecord) error {
+	if !e.wroteHeader {
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+		e.wroteHeader = true
+	}
+	return e.w.Write([]string{
+		strconv.Itoa(r.SchemaVersion),
+		r.CrawledAt.Format(time.RFC3339Nano),
+		r.Peer,
+		strings.Join(r.Addrs, " "),
+		strconv.FormatBool(r.Reachable),
+		strings.Join(r.Neighbors, " "),
+		r.Error,
+	})
+}
+
+func (e *csvExporter) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// RowWriter writes PeerRecords in batches, the way columnar formats do. The
+// generic writers of Parquet libraries, such as parquet-go's
+// GenericWriter[PeerRecord], implement it.
+type RowWriter interface {
+	Write(rows []PeerRecord) (int, error)
+}
+
+type rowExporter struct {
+	w     RowWriter
+	rows  []PeerRecord
+	batch int
+}
+
+// NewRowExporter returns an Exporter writing the records to w in batches of
+// batch records, the last one being written when the crawl ends. Closing w,
+// to write the footer of a Parquet file for instance, is up to the caller.
+func NewRowExporter(w RowWriter, batch int) (Exporter, error) {
+	if batch < 1 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", batch)
+	}
+	return &rowExporter{w: w, batch: batch}, nil
+}
+
+func (e *rowExporter) Export(r PeerRecord) error {
+	e.rows = append(e.rows, r)
+	if len(e.rows) < e.batch {
+		return nil
+	}
+	return e.Flush()
+}
+
+func (e *rowExporter) Flush() error {
+	if len(e.rows) == 0 {
+		return nil
+	}
+	n, err := e.w.Write(e.rows)
+	if err == nil && n < len(e.rows) {
+		err = io.ErrShortWrite
+	}
+	e.rows = nil
+	return err
+}
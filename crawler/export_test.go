@@ -0,0 +1,102 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func testRecords() []PeerRecord {
+	return []PeerRecord{
+		newPeerRecord("a", []string{"/ip4/1.2.3.4/tcp/4001"}, []*peer.AddrInfo{{ID: "b"}, {ID: "c"}}, nil),
+		newPeerRecord("b", nil, nil, errors.New("connection refused")),
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewJSONExporter(&buf)
+	for _, r := range testRecords() {
+		if err := e.Export(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := json.NewDecoder(&buf)
+	for _, want := range testRecords() {
+		var r PeerRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.SchemaVersion != SchemaVersion || r.Peer != want.Peer || r.Reachable != want.Reachable || r.Error != want.Error || len(r.Neighbors) != len(want.Neighbors) {
+			t.Errorf("unexpected record %+v, expected %+v", r, want)
+		}
+	}
+}
+
+func TestCSVExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewCSVExporter(&buf)
+	for _, r := range testRecords() {
+		if err := e.Export(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "schema_version" {
+		t.Fatalf("expected a header and two rows, got %v", rows)
+	}
+	if rows[1][0] != "1" || rows[1][4] != "true" || rows[1][5] != peer.ID("b").String()+" "+peer.ID("c").String() {
+		t.Errorf("unexpected row %v", rows[1])
+	}
+	if rows[2][4] != "false" || rows[2][6] != "connection refused" {
+		t.Errorf("unexpected row %v", rows[2])
+	}
+}
+
+type rowWriter struct {
+	batches [][]PeerRecord
+}
+
+func (w *rowWriter) Write(rows []PeerRecord) (int, error) {
+	w.batches = append(w.batches, append([]PeerRecord(nil), rows...))
+	return len(rows), nil
+}
+
+func TestRowExporter(t *testing.T) {
+	if _, err := NewRowExporter(&rowWriter{}, 0); err == nil {
+		t.Fatal("expected a zero batch size to be rejected")
+	}
+
+	w := &rowWriter{}
+	e, err := NewRowExporter(w, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := append(testRecords(), testRecords()[0])
+	for _, r := range records {
+		if err := e.Export(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.batches) != 1 || len(w.batches[0]) != 2 {
+		t.Fatalf("expected a full batch to be written, got %v", w.batches)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.batches) != 2 || len(w.batches[1]) != 1 || w.batches[1][0].Peer != records[2].Peer {
+		t.Fatalf("expected the last record to be written on flush, got %v", w.batches)
+	}
+}
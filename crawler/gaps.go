@@ -0,0 +1,104 @@
+package crawler
+
+import (
+	"fmt"
+
+	kbucket "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// maxGapBits bounds the number of prefix bits of the regions FindGaps splits
+// the keyspace into.
+const maxGapBits = 20
+
+// Gap is a region of the keyspace, the keys starting with the first Bits
+// bits of Prefix, with abnormally few reachable servers.
+type Gap struct {
+	Prefix kbucket.ID
+	Bits   int
+	// Servers is the number of reachable servers found in the region, and
+	// Expected the number expected if the servers were evenly spread.
+	Servers  int
+	Expected float64
+}
+
+// Contains tells whether the key id, in the keyspace, is in the region.
+func (g Gap) Contains(id kbucket.ID) bool {
+	return len(id) == len(g.Prefix) && kbucket.CommonPrefixLen(id, g.Prefix) >= g.Bits
+}
+
+// Gaps are availability holes of the keyspace, see FindGaps.
+type Gaps []Gap
+
+// Contains tells whether the key id, in the keyspace, is in one of the gaps.
+func (gs Gaps) Contains(id kbucket.ID) bool {
+	for _, g := range gs {
+		if g.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindGaps splits the keyspace into the 2^bits regions sharing a prefix of
+// bits bits, and returns the regions holding less than ratio times the
+// servers expected if they were evenly spread. servers are the keys of the
+// reachable servers, typically the peers the crawler queried successfully
+// converted with kbucket.ConvertPeerID.
+//
+// The fewer servers per region, the more gaps are mere noise: bits is best
+// chosen to have a few dozen servers per region, log2(len(servers)/32).
+func FindGaps(servers []kbucket.ID, bits int, ratio float64) (Gaps, error) {
+	if bits < 1 || bits > maxGapBits {
+		return nil, fmt.Errorf("prefix bits must be between 1 and %d, got %d", maxGapBits, bits)
+	}
+	if ratio <= 0 || ratio > 1 {
+		return nil, fmt.Errorf("ratio must be in (0, 1], got %v", ratio)
+	}
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	counts := make([]int, 1<<bits)
+	for _, id := range servers {
+		counts[prefixOf(id, bits)]++
+	}
+	expected := float64(len(servers)) / float64(len(counts))
+
+	var gaps Gaps
+	for region, n := range counts {
+		if float64(n) >= ratio*expected {
+			continue
+		}
+		gaps = append(gaps, Gap{
+			Prefix:   regionPrefix(region, bits, len(servers[0])),
+			Bits:     bits,
+			Servers:  n,
+			Expected: expected,
+		})
+	}
+	return gaps, nil
+}
+
+// prefixOf returns the first bits bits of id.
+func prefixOf(id kbucket.ID, bits int) int {
+	var v int
+	for i := 0; i < bits; i++ {
+		v <<= 1
+		if i/8 < len(id) && id[i/8]&(0x80>>(i%8)) != 0 {
+			v |= 1
+		}
+	}
+	return v
+}
+
+// regionPrefix returns the key of size bytes starting with the bits bits of
+// region, followed by zeros.
+func regionPrefix(region, bits, size int) kbucket.ID {
+	id := make(kbucket.ID, size)
+	for i := 0; i < bits; i++ {
+		if region&(1<<(bits-1-i)) != 0 {
+			id[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return id
+}
@@ -0,0 +1,43 @@
+package crawler
+
+import (
+	"testing"
+
+	kbucket "github.com/libp2p/go-libp2p-kbucket"
+)
+
+func TestFindGaps(t *testing.T) {
+	// 4 regions of 2 bits, the servers of the "10" region missing
+	var servers []kbucket.ID
+	for _, first := range []byte{0x00, 0x40, 0xc0} {
+		for i := 0; i < 10; i++ {
+			servers = append(servers, kbucket.ID{first | byte(i), 0xff})
+		}
+	}
+	servers = append(servers, kbucket.ID{0x80, 0x01})
+
+	gaps, err := FindGaps(servers, 2, .5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 1 {
+		t.Fatalf("expected one gap, got %v", gaps)
+	}
+	g := gaps[0]
+	if g.Bits != 2 || g.Servers != 1 || g.Expected != 31./4 {
+		t.Errorf("unexpected gap %+v", g)
+	}
+	if !gaps.Contains(kbucket.ID{0xa5, 0x00}) || !g.Contains(kbucket.ID{0x80, 0x00}) {
+		t.Error("expected the keys starting with 10 to be in the gap")
+	}
+	if gaps.Contains(kbucket.ID{0x40, 0x00}) || gaps.Contains(kbucket.ID{0xc0, 0x00}) {
+		t.Error("expected the other keys not to be in the gap")
+	}
+
+	if _, err := FindGaps(servers, 0, .5); err == nil {
+		t.Error("expected zero prefix bits to be rejected")
+	}
+	if _, err := FindGaps(servers, 2, 0); err == nil {
+		t.Error("expected a zero ratio to be rejected")
+	}
+}
@@ -16,6 +16,7 @@ type options struct {
 	connectTimeout       time.Duration
 	perMsgTimeout        time.Duration
 	dialAddressExtendDur time.Duration
+	exporters            []Exporter
 }
 
 // defaults are the default crawler options. This option will be automatically
@@ -71,3 +72,13 @@ func WithDialAddrExtendDuration(ext time.Duration) Option {
 		return nil
 	}
 }
+
+// WithExporters sets exporters receiving a PeerRecord for every peer crawled,
+// reachable or not, in addition to the callbacks passed to Run. A failure to
+// export a record is logged and doesn't stop the crawl.
+func WithExporters(exporters ...Exporter) Option {
+	return func(o *options) error {
+		o.exporters = append(o.exporters, exporters...)
+		return nil
+	}
+}
@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// errOtherLookupPath is returned by the query function of a lookup path for
+// the peers the other path queries.
+var errOtherLookupPath = errors.New("peer queried by the other lookup path")
+
+// lookupPaths assigns each peer to one of the two independent paths of a
+// cross-validated lookup, the first one to query it.
+type lookupPaths struct {
+	mu      sync.Mutex
+	claimed map[peer.ID]int
+}
+
+// lookupPath is one of the two paths of a cross-validated lookup.
+type lookupPath struct {
+	paths *lookupPaths
+	index int
+}
+
+type lookupPathKey struct{}
+
+func withLookupPath(ctx context.Context, p lookupPath) context.Context {
+	return context.WithValue(ctx, lookupPathKey{}, p)
+}
+
+func lookupPathFromContext(ctx context.Context) (lookupPath, bool) {
+	p, ok := ctx.Value(lookupPathKey{}).(lookupPath)
+	return p, ok
+}
+
+// claim reports whether p may be queried by the path, assigning it to the
+// path if it wasn't yet.
+func (p lookupPath) claim(id peer.ID) bool {
+	p.paths.mu.Lock()
+	defer p.paths.mu.Unlock()
+	i, ok := p.paths.claimed[id]
+	if !ok {
+		p.paths.claimed[id] = p.index
+		return true
+	}
+	return i == p.index
+}
+
+// seeds keeps every other peer of the seed peers, closest first, so that both
+// paths start from peers as close to the target.
+func (p lookupPath) seeds(peers []peer.ID) []peer.ID {
+	var seeds []peer.ID
+	for i, id := range peers {
+		if i%2 == p.index && p.claim(id) {
+			seeds = append(seeds, id)
+		}
+	}
+	return seeds
+}
+
+func (p lookupPath) queryFn(queryFn queryFn) queryFn {
+	return func(ctx context.Context, id peer.ID) ([]*peer.AddrInfo, error) {
+		if !p.claim(id) {
+			return nil, errOtherLookupPath
+		}
+		return queryFn(ctx, id)
+	}
+}
+
+// crossValidatedValue runs the lookups of GetValue with the CrossValidate
+// option, each waiting for nvals values if positive.
+func (dht *IpfsDHT) crossValidatedValue(ctx context.Context, key string, nvals int) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	paths := &lookupPaths{claimed: map[peer.ID]int{dht.self: -1}}
+	var (
+		wg     sync.WaitGroup
+		values [2][]byte
+		errs   [2]error
+	)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pctx := withLookupPath(ctx, lookupPath{paths: paths, index: i})
+			stopCh := make(chan struct{})
+			valCh, _, lookupErr := dht.getValues(pctx, key, stopCh)
+			numResponses := 0
+			values[i], _, _ = dht.processValues(pctx, key, valCh, func(ctx context.Context, v recvdVal, better bool) bool {
+				numResponses++
+				if nvals > 0 && numResponses > nvals {
+					close(stopCh)
+					return true
+				}
+				return false
+			})
+			if values[i] == nil {
+				// a lookup that failed found nothing either
+				errs[i] = <-lookupErr
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("lookup path %d failed: %w", i, err)
+		}
+	}
+	switch {
+	case values[0] == nil && values[1] == nil:
+		return nil, ErrNotFound
+	case bytes.Equal(values[0], values[1]):
+		dht.requestLogger(ctx).Debugf("GetValue %v %x", internal.LoggableRecordKeyString(key), values[0])
+		return values[0], nil
+	}
+	metrics.LookupPathDivergences.Add(ctx, 1, dht.protoAttr)
+	dht.requestLogger(ctx).Warnw("lookup paths diverged", "key", internal.LoggableRecordKeyString(key))
+	return nil, &DivergenceError{Key: key, Values: values}
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrossValidate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// each path is seeded with one of the two servers, which don't know each
+	// other
+	d := setupDHT(ctx, t, false)
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, d, a)
+	connect(t, ctx, d, b)
+
+	store := func(s *IpfsDHT, key, val string) {
+		rec := record.MakePutRecord(key, []byte(val))
+		rec.TimeReceived = internal.FormatRFC3339(time.Now())
+		require.NoError(t, s.putLocal(ctx, key, rec))
+	}
+
+	store(a, "/v/same", "value")
+	store(b, "/v/same", "value")
+	val, err := d.GetValue(ctx, "/v/same", CrossValidate())
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	store(a, "/v/suppressed", "value")
+	_, err = d.GetValue(ctx, "/v/suppressed", CrossValidate())
+	var derr *DivergenceError
+	require.ErrorAs(t, err, &derr)
+	require.ErrorIs(t, err, ErrPathsDiverged)
+	require.ElementsMatch(t, [][]byte{[]byte("value"), nil}, derr.Values[:])
+
+	// without cross-validation, the record of a is found
+	val, err = d.GetValue(ctx, "/v/suppressed")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	_, err = d.GetValue(ctx, "/v/missing", CrossValidate())
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// a single peer can only seed one of the paths
+	c := setupDHT(ctx, t, false)
+	connect(t, ctx, c, a)
+	_, err = c.GetValue(ctx, "/v/same", CrossValidate())
+	require.ErrorIs(t, err, ErrTooFewPeersForPaths)
+}
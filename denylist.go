@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// Denylist tells the keys, multihashes, whose providers a server refuses to
+// store and serve. See ProviderDenylist.
+type Denylist = dhtcfg.Denylist
+
+// compactDenylist is a Denylist parsed by ParseDenylist.
+type compactDenylist struct {
+	denied, allowed             map[string]struct{}
+	deniedHashes, allowedHashes map[[sha256.Size]byte]struct{}
+}
+
+// ParseDenylist parses a denylist in the compact denylist format of IPIP-383,
+// keeping the entries that apply to provider records:
+//
+//	# comment
+//	/ipfs/bafybeihfg3d7rdltd43u3tfvncx7n5loqofbsobojcadtmokrljfthuc7y
+//	/ipfs/QmecDgNqCRirkc3Cjz9eoRBNwXGckJ9WvTdmY16HP88768/*
+//	//d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7
+//	!/ipfs/bafkreidrdwltdaoscttgbcp2jyxqfpfbtpu4xusvrcdsqx3fqmt5wxxwlm
+//
+// /ipfs/ entries deny the multihash of their CID, unless they block a path
+// under it only. Double-hashed entries, prefixed with //, deny the keys whose
+// base58btc encoding has the given sha2-256 digest, in hex or as a multihash.
+// Entries prefixed with ! allow keys denied by others. The header, ending with
+// a --- line, and the entries of other namespaces (e.g. /ipns/) are ignored.
+func ParseDenylist(r io.Reader) (Denylist, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "---" {
+			// everything before was the header
+			lines = lines[:0]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	l := &compactDenylist{
+		denied:        make(map[string]struct{}),
+		allowed:       make(map[string]struct{}),
+		deniedHashes:  make(map[[sha256.Size]byte]struct{}),
+		allowedHashes: make(map[[sha256.Size]byte]struct{}),
+	}
+	for i, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys, hashes := l.denied, l.deniedHashes
+		if rule, ok := strings.CutPrefix(line, "!"); ok {
+			line = rule
+			keys, hashes = l.allowed, l.allowedHashes
+		}
+
+		switch {
+		case strings.HasPrefix(line, "//"):
+			h, err := parseDoubleHash(line[2:])
+			if err != nil {
+				return nil, fmt.Errorf("denylist entry %d: %w", i+1, err)
+			}
+			hashes[h] = struct{}{}
+		case strings.HasPrefix(line, "/ipfs/"):
+			c, path, _ := strings.Cut(line[len("/ipfs/"):], "/")
+			if path != "" && path != "*" {
+				continue
+			}
+			k, err := cid.Decode(c)
+			if err != nil {
+				return nil, fmt.Errorf("denylist entry %d: %w", i+1, err)
+			}
+			keys[string(k.Hash())] = struct{}{}
+		}
+	}
+	return l, nil
+}
+
+func parseDoubleHash(s string) ([sha256.Size]byte, error) {
+	var h [sha256.Size]byte
+	if b, err := hex.DecodeString(s); err == nil && len(b) == sha256.Size {
+		copy(h[:], b)
+		return h, nil
+	}
+	mh, err := multihash.FromB58String(s)
+	if err != nil {
+		return h, fmt.Errorf("invalid double hash %q", s)
+	}
+	dmh, err := multihash.Decode(mh)
+	if err != nil || dmh.Code != multihash.SHA2_256 || len(dmh.Digest) != sha256.Size {
+		return h, fmt.Errorf("double hash %q is not a sha2-256 multihash", s)
+	}
+	copy(h[:], dmh.Digest)
+	return h, nil
+}
+
+func (l *compactDenylist) Denied(key []byte) bool {
+	h := sha256.Sum256([]byte(multihash.Multihash(key).B58String()))
+	if _, ok := l.allowed[string(key)]; ok {
+		return false
+	}
+	if _, ok := l.allowedHashes[h]; ok {
+		return false
+	}
+	if _, ok := l.denied[string(key)]; ok {
+		return true
+	}
+	_, ok := l.deniedHashes[h]
+	return ok
+}
+
+// deniedProviders reports whether the providers of key are denied, counting
+// the request if they are.
+func (dht *IpfsDHT) deniedProviders(ctx context.Context, key []byte, t pb.Message_MessageType) bool {
+	if dht.denylist == nil || !dht.denylist.Denied(key) {
+		return false
+	}
+	metrics.DeniedProviderRequests.Add(ctx, 1, metric.WithAttributes(attribute.String(metrics.KeyMessageType, t.String())), dht.protoAttr)
+	return true
+}
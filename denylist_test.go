@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDenylist(t *testing.T) {
+	denied, subpath, allowed, hashed := testCaseCids[0], testCaseCids[1], testCaseCids[2], testCaseCids[3]
+	h := sha256.Sum256([]byte(hashed.Hash().B58String()))
+
+	l, err := ParseDenylist(strings.NewReader(`version: 1
+name: test
+---
+# comment
+/ipfs/` + denied.String() + `
+/ipfs/` + subpath.String() + `/some/path
+/ipfs/` + allowed.String() + `/*
+!/ipfs/` + allowed.String() + `
+//` + hex.EncodeToString(h[:]) + `
+/ipns/example.org
+`))
+	require.NoError(t, err)
+	require.True(t, l.Denied(denied.Hash()))
+	require.False(t, l.Denied(subpath.Hash()), "only a path under the CID is denied")
+	require.False(t, l.Denied(allowed.Hash()))
+	require.True(t, l.Denied(hashed.Hash()))
+	require.False(t, l.Denied(testCaseCids[4].Hash()))
+
+	_, err = ParseDenylist(strings.NewReader("/ipfs/notacid\n"))
+	require.Error(t, err)
+}
+
+func TestProviderDenylist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	denied, kept := testCaseCids[0], testCaseCids[1]
+	l, err := ParseDenylist(strings.NewReader("/ipfs/" + denied.String() + "\n"))
+	require.NoError(t, err)
+	server := setupDHT(ctx, t, false, DisableAutoRefresh(), ProviderDenylist(l))
+	client := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, client, server)
+	require.True(t, server.Config().ProviderDenylist)
+
+	for _, c := range []cid.Cid{denied, kept} {
+		require.NoError(t, client.protoMessenger.PutProvider(ctx, server.self, c.Hash(), client.host))
+	}
+	require.Eventually(t, func() bool {
+		provs, _, err := client.protoMessenger.GetProviders(ctx, server.self, kept.Hash())
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	provs, _ := server.providerStore.GetProviders(ctx, denied.Hash())
+	require.Empty(t, provs, "the provider of a denied key should not be stored")
+
+	// the providers stored before the key was denied aren't served
+	require.NoError(t, server.providerStore.AddProvider(ctx, denied.Hash(), client.peerstore.PeerInfo(client.self)))
+	served, _, err := client.protoMessenger.GetProviders(ctx, server.self, denied.Hash())
+	require.NoError(t, err)
+	require.Empty(t, served)
+}
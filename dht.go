@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-routing-helpers/tracing"
@@ -16,10 +18,13 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/routing"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
@@ -65,7 +70,8 @@ const (
 )
 
 const (
-	kad1 protocol.ID = "/kad/1.0.0"
+	kad1        protocol.ID = "/kad/1.0.0"
+	kadObserver protocol.ID = "/kad/observer/1.0.0"
 )
 
 const (
@@ -76,14 +82,17 @@ const (
 // IpfsDHT is an implementation of Kademlia with S/Kademlia modifications.
 // It is used to implement the base Routing module.
 type IpfsDHT struct {
-	host      host.Host // the network services we need
-	self      peer.ID   // Local peer (yourself)
-	selfKey   kb.ID
-	peerstore peerstore.Peerstore // Peer Registry
+	host    host.Host // the network services we need
+	self    peer.ID   // Local peer (yourself)
+	selfKey kb.ID
+	// keyspaceHash maps keys and peer IDs into the keyspace
+	keyspaceHash internal.KeyspaceHash
+	shardBits    int
+	peerstore    peerstore.Peerstore // Peer Registry
 
 	datastore ds.Datastore // Local data
 
-	routingTable *kb.RoutingTable // Array of routing tables for differently distanced nodes
+	routingTable routingTable // Array of routing tables for differently distanced nodes
 	// providerStore stores & manages the provider records for this Dht peer.
 	providerStore providers.ProviderStore
 
@@ -100,6 +109,17 @@ type IpfsDHT struct {
 
 	protoMessenger *pb.ProtocolMessenger
 	msgSender      pb.MessageSenderWithDisconnect
+	bandwidth      *bandwidthAccounting
+	// disconnects applies the disconnect policy to the routing table peers.
+	disconnects *disconnectTracker
+	// probes checks the liveness of the routing table peers, nil when the
+	// refresh manager does.
+	probes *probeScheduler
+	// geo locates the routing table peers, nil without a GeoResolver.
+	geo *geoLocator
+
+	// peerCapabilities are the capabilities the peers advertised.
+	peerCapabilities *capabilityCache
 
 	stripedPutLocks [256]sync.Mutex
 
@@ -109,6 +129,20 @@ type IpfsDHT struct {
 
 	// DHT protocols we can respond to.
 	serverProtocols []protocol.ID
+	// protoAttr tags the metrics recorded by the DHT with its primary
+	// protocol.
+	protoAttr metric.MeasurementOption
+
+	// protocolShims translate the messages of the additional protocols we
+	// respond to.
+	protocolShims map[protocol.ID]ProtocolShim
+
+	// the peers we proxy lookups for, see ProxyFor
+	proxyClients map[peer.ID]struct{}
+
+	// set in ModeObserver, in which observerProtocol is advertised
+	observer         bool
+	observerProtocol protocol.ID
 
 	auto   ModeOpt
 	mode   mode
@@ -119,8 +153,15 @@ type IpfsDHT struct {
 	beta       int // The number of peers closest to a target that must have responded for a query path to terminate
 
 	queryPeerFilter        QueryFilterFunc
+	dialRanker             DialRankFunc
+	peerRanker             atomic.Pointer[PeerRanker]
+	providerFilter         ProviderFilterFunc
+	connPreference         ConnectionPreference
+	relayAddrPolicy        RelayAddrPolicy
 	routingTablePeerFilter RouteTableFilterFunc
 	rtPeerDiversityFilter  peerdiversity.PeerIPGroupFilter
+	// refusedProtocols keeps their speakers out of the routing table.
+	refusedProtocols []protocol.ID
 
 	autoRefresh bool
 
@@ -129,14 +170,109 @@ type IpfsDHT struct {
 	// number of concurrent lookupCheck operations
 	lookupCheckCapacity int
 	lookupChecksLk      sync.Mutex
+	// candidateDials bounds the dials of AddCandidatePeers.
+	candidateDials chan struct{}
+	// disableLookupCheck adds the new servers without a lookup check.
+	disableLookupCheck bool
+	// pingProbes probes the peers advertising pb.CapPing with a PING.
+	pingProbes bool
+	// our signed peer record, included in the responses with closer peers
+	selfRecord *selfRecord
+
+	// bounds the outbound query RPCs across all concurrent queries, nil if
+	// unlimited. Replaced when the profile changes.
+	outboundLimiter atomic.Pointer[outboundLimiter]
+
+	// runs the requests of the lookups
+	queryWorkers *queryWorkerPool
+
+	// bounds the memory of the running lookups, nil if unbounded
+	lookupMemory *lookupMemory
+
+	// bounds the inbound requests handled concurrently, nil if unbounded
+	handlerBudget *handlerBudget
+
+	// when the resource manager last refused a stream, see Overloaded
+	resourceLimits resourceLimits
+
+	// the current resource profile, see SetProfile
+	profile   Profile
+	profileLk sync.Mutex
+	// setProfileLk serializes SetProfile, which applies the profile without
+	// holding profileLk
+	setProfileLk sync.Mutex
+
+	// peers that recently failed to dial, nil if disabled.
+	dialBackoff DialBackoffCache // nil if disabled
+
+	// per-peer circuit breakers of the outbound RPCs, nil if disabled.
+	breakers *circuitBreakers
 
 	// A function returning a set of bootstrap peers to fallback on if all other attempts to fix
 	// the routing table fail (or, e.g., this is the first time this node is
 	// connecting to the network).
 	bootstrapPeers func() []peer.AddrInfo
 
+	// how long FindPeer may spend connecting to a found peer to verify its
+	// addresses, 0 if addresses aren't verified.
+	findPeerVerifyTimeout time.Duration
+
+	// recent FindPeer and FindProviders misses
+	negativeCache *negativeCache
+
+	// when our provider records were stored on the closest peers, nil if
+	// Provide always stores them
+	provideLedger *provideLedger
+
+	// records and providers observed by our own lookups in client mode, nil
+	// if disabled
+	passiveCache *passiveCache
+
+	// peers whose streams are reset, nil if none
+	greylist PeerGreylist
+
+	// peers banned by the operator or the connection gater
+	bans *peerBans
+
+	// keys whose providers aren't stored nor served, nil if none
+	denylist Denylist
+
+	// keys receiving anomalous ADD_PROVIDER rates, nil if not detected
+	spamKeys *spamDetector
+
+	// what each peer stored on this server, nil if unlimited
+	originQuotas *originQuotas
+
+	// connected providers reported to ProviderUsed
+	usedProviders *usedProviders
+
+	// long-lived peers persisted in the datastore, tried before the bootstrap
+	// peers when the routing table is empty.
+	rememberedPeersSize   int
+	rememberedPeersMinAge time.Duration
+	rememberedPeersLk     sync.Mutex
+	rememberedPeers       []rememberedPeer
+
 	maxRecordAge time.Duration
 
+	// chooses the winner when SearchValue finds divergent records, may be nil
+	conflictResolver ConflictResolver
+
+	// policy for the best record push-back to outdated peers in SearchValue
+	correction struct {
+		disabled bool
+		maxPeers int
+		limiter  *correctionLimiter
+	}
+
+	// number of peers records are stored with, per namespace
+	nsReplication map[string]int
+	// inKeyspaceGap and gapReplication raise the replication of the
+	// provider records of the keys in a keyspace gap, see
+	// KeyspaceGapReplication.
+	inKeyspaceGap  func(id kb.ID) bool
+	gapReplication int
+
 	// Allows disabling dht subsystems. These should _only_ be set on
 	// "forked" DHTs (e.g., DHTs with custom protocols and/or private
 	// networks).
@@ -148,6 +284,11 @@ type IpfsDHT struct {
 	addPeerToRTChan   chan peer.ID
 	refreshFinishedCh chan struct{}
 
+	// rtChangedCh is closed (and replaced) every time a peer is added to or
+	// removed from the routing table.
+	rtChangedLk sync.Mutex
+	rtChangedCh chan struct{}
+
 	rtFreezeTimeout time.Duration
 
 	// network size estimator
@@ -157,6 +298,32 @@ type IpfsDHT struct {
 	// a bound channel to limit asynchronicity of in-flight ADD_PROVIDER RPCs
 	optProvJobsPool chan struct{}
 
+	// runs the provides queued with ScheduleProvide
+	provideScheduler *provideScheduler
+
+	// periodically checks the placement of the stored keys, nil if disabled
+	selfAudit       *selfAuditor
+	lastSelfAuditLk sync.Mutex
+	lastSelfAudit   *SelfAuditReport
+
+	// crawl seeds the lookups with the peers of its background crawls, nil
+	// unless enabled.
+	crawl *backgroundCrawler
+
+	// ignoredMessages counts the messages ignored in client mode since they
+	// were last logged, at lastIgnoredLog (unix nanoseconds).
+	ignoredMessages atomic.Int64
+	lastIgnoredLog  atomic.Int64
+
+	// unregisterStreams stops the open streams gauges from reporting ours
+	unregisterStreams func()
+	// unregisterGauges stops the other gauges computed on demand, like the
+	// churn, from reporting ours
+	unregisterGauges func()
+
+	// churn estimates the churn of the network, see Churn
+	churn *churnEstimator
+
 	// configuration variables for tests
 	testAddressUpdateProcessing bool
 
@@ -165,6 +332,29 @@ type IpfsDHT struct {
 	addrFilter func([]ma.Multiaddr) []ma.Multiaddr
 
 	onRequestHook func(ctx context.Context, s network.Stream, req *pb.Message)
+	onDialFailure DialFailureHook
+
+	// onRequestExtension sets the extension of our responses, if any.
+	onRequestExtension RequestExtensionHook
+
+	// requireSigned rejects the unsigned storage requests, passing the
+	// signed ones to auditSigned if set.
+	requireSigned bool
+	auditSigned   func(context.Context, SignedRequest)
+
+	// inbound requests whose handler takes longer are logged, 0 if disabled
+	slowRequestThreshold time.Duration
+
+	// capabilities are advertised in our responses.
+	capabilities pb.Capabilities
+
+	// config is the effective configuration, as returned by Config.
+	config ConfigView
+
+	// logger and baseLogger log on behalf of this instance; they default to
+	// the package-wide loggers unless the Logger option is used.
+	logger     *zap.SugaredLogger
+	baseLogger *zap.Logger
 }
 
 // Assert that IPFS assumptions about interfaces aren't broken. These aren't a
@@ -194,11 +384,18 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 		return nil, err
 	}
 
+	if cfg.LatencyBuckets != nil {
+		if err := metrics.SetLatencyBuckets(cfg.LatencyBuckets); err != nil {
+			return nil, err
+		}
+	}
+
 	dht, err := makeDHT(h, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create DHT, err=%s", err)
 	}
 
+	dht.config = newConfigView(&cfg, dht.protocols, dht.serverProtocols)
 	dht.autoRefresh = cfg.RoutingTable.AutoRefresh
 
 	dht.maxRecordAge = cfg.MaxRecordAge
@@ -207,7 +404,56 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 	dht.disableFixLowPeers = cfg.DisableFixLowPeers
 
 	dht.Validator = cfg.Validator
-	dht.msgSender = cfg.MsgSenderBuilder(h, dht.protocols)
+	dht.bandwidth = newBandwidthAccounting(cfg.BandwidthAccountingPeers, dht.protoAttr)
+	dht.peerCapabilities = newCapabilityCache(cfg.CapabilityCacheTTL)
+	dht.spamKeys = newSpamDetector(cfg.SpamKeys.Threshold, cfg.SpamKeys.Window, cfg.SpamKeys.Policy, cfg.SpamKeys.Report, dht.protoAttr)
+	var msgSender pb.MessageSenderWithDisconnect
+	if cfg.MsgSenderBuilder != nil {
+		msgSender = &latencySender{
+			MessageSenderWithDisconnect: cfg.MsgSenderBuilder(h, dht.protocols),
+			metrics:                     h.Peerstore(),
+		}
+	} else {
+		msgSender = net.NewPooledMessageSender(dht.ctx, h, dht.protocols, cfg.StreamPool, dht.logger)
+	}
+	dht.breakers = newCircuitBreakers(cfg.CircuitBreaker.Failures, cfg.CircuitBreaker.Window, cfg.CircuitBreaker.Cooldown, dht.protoAttr)
+	msgSender = &accountingSender{
+		MessageSenderWithDisconnect: &resourceLimitSender{
+			MessageSenderWithDisconnect: msgSender,
+			limits:                      &dht.resourceLimits,
+		},
+		bw: dht.bandwidth,
+	}
+	rt := cfg.RequestTimeout
+	if timeouts := newRequestTimeouts(rt.Floor, rt.Ceiling, rt.Multiplier, h.Peerstore()); timeouts != nil {
+		msgSender = &timeoutSender{MessageSenderWithDisconnect: msgSender, timeouts: timeouts}
+	}
+	if dht.breakers != nil {
+		msgSender = &breakerSender{MessageSenderWithDisconnect: msgSender, breakers: dht.breakers}
+	}
+	if cfg.RequestSigning.Sign {
+		key := h.Peerstore().PrivKey(h.ID())
+		if key == nil {
+			return nil, fmt.Errorf("signing requests: no private key for %s", h.ID())
+		}
+		msgSender = &signingSender{MessageSenderWithDisconnect: msgSender, key: key}
+	}
+	if cfg.OnOutbound != nil {
+		msgSender = &hookSender{MessageSenderWithDisconnect: msgSender, hook: cfg.OnOutbound}
+	}
+	if cfg.OnResponseExtension != nil {
+		msgSender = &extensionSender{MessageSenderWithDisconnect: msgSender, hook: cfg.OnResponseExtension}
+	}
+	if cab, ok := peerstore.GetCertifiedAddrBook(h.Peerstore()); ok {
+		msgSender = &peerRecordSender{MessageSenderWithDisconnect: msgSender, cab: cab, logger: dht.logger}
+		if cfg.SelfRecord {
+			dht.selfRecord = &selfRecord{cab: cab, self: h.ID()}
+		}
+	}
+	dht.msgSender = &capabilitySender{
+		MessageSenderWithDisconnect: msgSender,
+		capabilities:                dht.peerCapabilities,
+	}
 	dht.protoMessenger, err = pb.NewProtocolMessenger(dht.msgSender)
 	if err != nil {
 		return nil, err
@@ -221,10 +467,28 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 		dht.mode = modeClient
 	case ModeAutoServer, ModeServer:
 		dht.mode = modeServer
+	case ModeObserver:
+		dht.mode = modeServer
+		dht.observer = true
 	default:
 		return nil, fmt.Errorf("invalid dht mode %d", cfg.Mode)
 	}
 
+	// build the subsystems before starting any goroutine, as they are read
+	// without synchronization by the lookups and the handlers
+	dht.selfAudit = newSelfAuditor(dht, cfg.SelfAudit.Interval, cfg.SelfAudit.Sample, cfg.SelfAudit.Report)
+	dht.crawl = newBackgroundCrawler(dht, cfg.BackgroundCrawl.Interval, cfg.BackgroundCrawl.Bits)
+	if dht.enableProviders {
+		budget := newProvideBudget(cfg.ProvideScheduler.Budget, cfg.ProvideScheduler.BudgetInterval)
+		dht.provideScheduler = newProvideScheduler(dht, cfg.ProvideScheduler.Workers, cfg.ProvideScheduler.Rate, budget)
+	}
+	if len(cfg.ProxyClients) > 0 {
+		dht.proxyClients = make(map[peer.ID]struct{}, len(cfg.ProxyClients))
+		for _, p := range cfg.ProxyClients {
+			dht.proxyClients[p] = struct{}{}
+		}
+	}
+
 	if dht.mode == modeServer {
 		if err := dht.moveToServerMode(); err != nil {
 			return nil, err
@@ -236,24 +500,53 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 		return nil, err
 	}
 
+	if dht.rememberedPeersSize > 0 {
+		if err := dht.loadRememberedPeers(ctx); err != nil {
+			dht.logger.Warnw("failed to load remembered peers", "error", err)
+		}
+		dht.runRememberedPeersLoop()
+	}
+
 	// go-routine to make sure we ALWAYS have RT peer addresses in the peerstore
 	// since RT membership is decoupled from connectivity
 	go dht.persistRTPeersInPeerStore()
 
 	dht.rtPeerLoop()
 
+	if dht.enableValues {
+		dht.runRecordsGCLoop()
+	}
+
 	// Fill routing table with currently connected peers that are DHT servers
 	for _, p := range dht.host.Network().Peers() {
 		dht.peerFound(p)
 	}
 
 	dht.rtRefreshManager.Start()
+	dht.probes.start()
+	dht.geo.start()
+	dht.selfAudit.start()
+	dht.unregisterStreams = metrics.RegisterStreams(dht.protocols[0], dht.openStreams)
+	dht.unregisterGauges = metrics.RegisterObserver(dht.protocols[0], func(observe func(*metrics.Instrument, float64, ...attribute.KeyValue)) {
+		dht.observeChurn(observe)
+		dht.observeCensus(observe)
+	})
+
+	if dht.proxyClients != nil {
+		dht.host.SetStreamHandler(cfg.ProtocolPrefix+kadProxy, dht.handleProxyStream)
+	}
+
+	if dht.provideScheduler != nil {
+		dht.provideScheduler.start()
+	}
 
 	// listens to the fix low peers chan and tries to fix the Routing Table
 	if !dht.disableFixLowPeers {
 		dht.runFixLowPeersLoop()
 	}
 
+	dht.crawl.start()
+
 	return dht, nil
 }
 
@@ -283,6 +576,9 @@ func makeDHT(h host.Host, cfg dhtcfg.Config) (*IpfsDHT, error) {
 	var protocols, serverProtocols []protocol.ID
 
 	v1proto := cfg.ProtocolPrefix + kad1
+	if cfg.KeyspaceHash.Hash != nil {
+		v1proto = cfg.ProtocolPrefix + "/" + protocol.ID(cfg.KeyspaceHash.Name) + kad1
+	}
 
 	if cfg.V1ProtocolOverride != "" {
 		v1proto = cfg.V1ProtocolOverride
@@ -290,35 +586,103 @@ func makeDHT(h host.Host, cfg dhtcfg.Config) (*IpfsDHT, error) {
 
 	protocols = []protocol.ID{v1proto}
 	serverProtocols = []protocol.ID{v1proto}
+	for p := range cfg.ProtocolShims {
+		if p != v1proto {
+			serverProtocols = append(serverProtocols, p)
+		}
+	}
+	for _, p := range cfg.RefusedProtocols {
+		if slices.Contains(serverProtocols, p) {
+			return nil, fmt.Errorf("refused protocol %s is spoken by the dht", p)
+		}
+	}
 
 	dht := &IpfsDHT{
 		datastore:              cfg.Datastore,
 		self:                   h.ID(),
-		selfKey:                kb.ConvertPeerID(h.ID()),
+		selfKey:                internal.KeyspaceHash(cfg.KeyspaceHash.Hash).ID([]byte(h.ID())),
+		keyspaceHash:           cfg.KeyspaceHash.Hash,
+		shardBits:              cfg.ShardBits,
 		peerstore:              h.Peerstore(),
 		host:                   h,
 		birth:                  time.Now(),
 		protocols:              protocols,
+		refusedProtocols:       cfg.RefusedProtocols,
 		serverProtocols:        serverProtocols,
+		protocolShims:          cfg.ProtocolShims,
+		protoAttr:              metrics.WithProtocol(protocols[0]),
+		churn:                  new(churnEstimator),
+		observerProtocol:       cfg.ProtocolPrefix + kadObserver,
 		bucketSize:             cfg.BucketSize,
 		alpha:                  cfg.Concurrency,
 		beta:                   cfg.Resiliency,
 		lookupCheckCapacity:    cfg.LookupCheckConcurrency,
+		candidateDials:         make(chan struct{}, maxCandidateDials),
+		disableLookupCheck:     cfg.DisableLookupCheck,
+		dialBackoff:            dialBackoffFor(cfg),
 		queryPeerFilter:        cfg.QueryPeerFilter,
+		dialRanker:             cfg.DialRanker,
+		providerFilter:         cfg.ProviderFilter,
+		connPreference:         cfg.ConnectionPreference,
+		relayAddrPolicy:        cfg.RelayAddrPolicy,
 		routingTablePeerFilter: cfg.RoutingTable.PeerFilter,
 		rtPeerDiversityFilter:  cfg.RoutingTable.DiversityFilter,
 		addrFilter:             cfg.AddressFilter,
 		onRequestHook:          cfg.OnRequestHook,
+		onRequestExtension:     cfg.OnRequestExtension,
+		onDialFailure:          cfg.OnDialFailure,
+		requireSigned:          cfg.RequestSigning.Require,
+		auditSigned:            cfg.RequestSigning.Audit,
+		slowRequestThreshold:   cfg.SlowRequestThreshold,
+		capabilities:           cfg.Capabilities,
+		logger:                 &logger.SugaredLogger,
+		baseLogger:             baseLogger,
+		findPeerVerifyTimeout:  cfg.FindPeerVerifyTimeout,
+		nsReplication:          cfg.NamespaceReplication,
+		inKeyspaceGap:          cfg.KeyspaceGaps.InGap,
+		gapReplication:         cfg.KeyspaceGaps.ExtraReplication,
+		conflictResolver:       cfg.ConflictResolver,
+		negativeCache:          newNegativeCache(cfg.NegativeCacheTTL),
+		provideLedger:          newProvideLedger(cfg.ReprovideRefresh),
+		lookupMemory:           newLookupMemory(cfg.LookupMemory.Budget, cfg.LookupMemory.FailFast),
+		handlerBudget:          newHandlerBudget(cfg.InboundHandlers.Max, cfg.InboundHandlers.QueueTimeout),
+		passiveCache:           newPassiveCache(cfg.PassiveCache.Size, cfg.PassiveCache.TTL),
+		greylist:               cfg.Greylist,
+		bans:                   newPeerBans(cfg.Bans.Propagate, cfg.Bans.Source),
+		denylist:               cfg.Denylist,
+		originQuotas:           newOriginQuotas(cfg.OriginQuota.Records, cfg.OriginQuota.Providers, cfg.OriginQuota.Bytes, cfg.MaxRecordAge),
+		usedProviders:          newUsedProviders(),
 
 		fixLowPeersChan: make(chan struct{}, 1),
 
 		addPeerToRTChan:   make(chan peer.ID),
 		refreshFinishedCh: make(chan struct{}),
+		rtChangedCh:       make(chan struct{}),
 
 		enableOptProv:   cfg.EnableOptimisticProvide,
 		optProvJobsPool: nil,
 	}
 
+	if cfg.Logger != nil {
+		dht.baseLogger = cfg.Logger
+		dht.logger = cfg.Logger.Sugar()
+	}
+
+	dht.outboundLimiter.Store(newOutboundLimiter(cfg.MaxOutboundRequests))
+	dht.profile = Profile{
+		MaxOutboundRequests: cfg.MaxOutboundRequests,
+		ProvideWorkers:      cfg.ProvideScheduler.Workers,
+		ProvideRate:         cfg.ProvideScheduler.Rate,
+		PauseCrawl:          cfg.BackgroundCrawl.Paused,
+	}
+	if cfg.RoutingTable.AutoRefresh {
+		dht.profile.RefreshInterval = cfg.RoutingTable.RefreshInterval
+	}
+
+	dht.correction.disabled = cfg.ValueCorrection.Disabled
+	dht.correction.maxPeers = cfg.ValueCorrection.MaxPeers
+	dht.correction.limiter = newCorrectionLimiter(cfg.ValueCorrection.Rate)
+
 	var maxLastSuccessfulOutboundThreshold time.Duration
 
 	// The threshold is calculated based on the expected amount of time that should pass before we
@@ -341,11 +705,24 @@ func makeDHT(h host.Host, cfg dhtcfg.Config) (*IpfsDHT, error) {
 	}
 	dht.routingTable = rt
 	dht.bootstrapPeers = cfg.BootstrapPeers
+	dht.rememberedPeersSize = cfg.RememberedPeers.Size
+	dht.rememberedPeersMinAge = cfg.RememberedPeers.MinAge
 
 	dht.lookupCheckTimeout = cfg.RoutingTable.RefreshQueryTimeout
+	dht.pingProbes = cfg.PingProbes
+	if cfg.PeerRanker != nil {
+		dht.SetPeerRanker(cfg.PeerRanker)
+	}
+	if cfg.LookupCheckTimeout > 0 {
+		dht.lookupCheckTimeout = cfg.LookupCheckTimeout
+	}
+	dht.disconnects = newDisconnectTracker(dht, cfg.RoutingTable.DisconnectPolicy, cfg.RoutingTable.DisconnectGrace)
+	probing := cfg.RoutingTable.Probing
+	dht.probes = newProbeScheduler(dht, probing.MinInterval, probing.MaxInterval, probing.Rate)
+	dht.geo = newGeoLocator(dht, cfg.GeoResolver)
 
 	// init network size estimator
-	dht.nsEstimator = netsize.NewEstimator(h.ID(), rt, cfg.BucketSize)
+	dht.nsEstimator = netsize.NewEstimatorWithHash(h.ID(), rt, cfg.BucketSize, cfg.KeyspaceHash.Hash)
 
 	if dht.enableOptProv {
 		dht.optProvJobsPool = make(chan struct{}, cfg.OptimisticProvideJobsPoolSize)
@@ -356,15 +733,30 @@ func makeDHT(h host.Host, cfg dhtcfg.Config) (*IpfsDHT, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct RT Refresh Manager,err=%s", err)
 	}
+	if dht.probes != nil {
+		dht.rtRefreshManager.DisablePeerChecks()
+	}
+	dht.rtRefreshManager.TagMetrics(dht.protoAttr)
+	if cfg.Logger != nil {
+		dht.rtRefreshManager.SetLogger(dht.logger)
+	}
 
 	// create a tagged context derived from the original context
 	// the DHT context should be done when the process is closed
 	dht.ctx, dht.cancel = context.WithCancel(dht.newContextWithLocalTags(context.Background()))
+	dht.queryWorkers = newQueryWorkerPool(cfg.QueryWorkers, dht.ctx.Done())
 
 	if cfg.ProviderStore != nil {
 		dht.providerStore = cfg.ProviderStore
 	} else {
-		dht.providerStore, err = providers.NewProviderManager(h.ID(), dht.peerstore, cfg.Datastore)
+		var provOpts []providers.Option
+		if wb := cfg.ProviderWriteBehind; wb.Interval > 0 {
+			provOpts = append(provOpts, providers.WriteBehind(wb.Interval, wb.WALPath))
+		}
+		if cfg.Logger != nil {
+			provOpts = append(provOpts, providers.Logger(dht.logger))
+		}
+		dht.providerStore, err = providers.NewProviderManager(h.ID(), dht.peerstore, cfg.Datastore, provOpts...)
 		if err != nil {
 			return nil, fmt.Errorf("initializing default provider manager (%v)", err)
 		}
@@ -389,6 +781,15 @@ func (dht *IpfsDHT) lookupCheck(ctx context.Context, p peer.ID) error {
 	return err
 }
 
+// probePeer checks that the routing table peer p is still alive, with a PING
+// if p advertises pb.CapPing and ping probes are enabled, or a lookup check.
+func (dht *IpfsDHT) probePeer(ctx context.Context, p peer.ID) error {
+	if dht.pingProbes && dht.PeerSupports(p, pb.CapPing) {
+		return dht.protoMessenger.Ping(ctx, p)
+	}
+	return dht.lookupCheck(ctx, p)
+}
+
 func makeRtRefreshManager(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutboundThreshold time.Duration) (*rtrefresh.RtRefreshManager, error) {
 	keyGenFnc := func(cpl uint) (string, error) {
 		p, err := dht.routingTable.GenRandPeerID(cpl)
@@ -396,15 +797,15 @@ func makeRtRefreshManager(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutb
 	}
 
 	queryFnc := func(ctx context.Context, key string) error {
-		_, err := dht.GetClosestPeers(ctx, key)
+		_, err := dht.GetClosestPeers(startRequest(ctx, "Refresh"), key)
 		return err
 	}
 
 	r, err := rtrefresh.NewRtRefreshManager(
-		dht.host, dht.routingTable, cfg.RoutingTable.AutoRefresh,
+		dht.host, refreshEvictions{dht.routingTable, dht}, cfg.RoutingTable.AutoRefresh,
 		keyGenFnc,
 		queryFnc,
-		dht.lookupCheck,
+		dht.probePeer,
 		cfg.RoutingTable.RefreshQueryTimeout,
 		cfg.RoutingTable.RefreshInterval,
 		maxLastSuccessfulOutboundThreshold,
@@ -413,12 +814,12 @@ func makeRtRefreshManager(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutb
 	return r, err
 }
 
-func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutboundThreshold time.Duration) (*kb.RoutingTable, error) {
+func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutboundThreshold time.Duration) (routingTable, error) {
 	// make a Routing Table Diversity Filter
 	var filter *peerdiversity.Filter
 	if dht.rtPeerDiversityFilter != nil {
 		df, err := peerdiversity.NewFilter(dht.rtPeerDiversityFilter, "rt/diversity", func(p peer.ID) int {
-			return kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(p))
+			return kb.CommonPrefixLen(dht.selfKey, dht.kadPeerID(p))
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to construct peer diversity filter: %w", err)
@@ -427,30 +828,46 @@ func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutbound
 		filter = df
 	}
 
-	rt, err := kb.NewRoutingTable(cfg.BucketSize, dht.selfKey, time.Minute, dht.host.Peerstore(), maxLastSuccessfulOutboundThreshold, filter)
-	if err != nil {
-		return nil, err
-	}
-
 	cmgr := dht.host.ConnManager()
 
-	rt.PeerAdded = func(p peer.ID) {
-		commonPrefixLen := kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(p))
+	peerAdded := func(p peer.ID) {
+		commonPrefixLen := kb.CommonPrefixLen(dht.selfKey, dht.kadPeerID(p))
 		if commonPrefixLen < protectedBuckets {
 			cmgr.Protect(p, kbucketTag)
 		} else {
 			cmgr.TagPeer(p, kbucketTag, baseConnMgrScore)
 		}
+		dht.probes.add(p)
+		dht.geo.add(p)
+		dht.notifyRTChanged()
 	}
-	rt.PeerRemoved = func(p peer.ID) {
+	peerRemoved := func(p peer.ID) {
 		cmgr.Unprotect(p, kbucketTag)
 		cmgr.UntagPeer(p, kbucketTag)
+		dht.probes.remove(p)
+		dht.churn.peerRemoved()
 
 		// try to fix the RT
 		dht.fixRTIfNeeded()
+		dht.notifyRTChanged()
 	}
 
-	return rt, err
+	if cfg.RoutingTable.Compact {
+		if filter != nil {
+			return nil, fmt.Errorf("the compact routing table does not support diversity filters")
+		}
+		rt := newCompactRoutingTable(cfg.BucketSize, dht.selfKey, dht.keyspaceHash, time.Minute, dht.host.Peerstore())
+		rt.PeerAdded, rt.PeerRemoved = peerAdded, peerRemoved
+		rt.logger = dht.logger
+		return rt, nil
+	}
+
+	rt, err := kb.NewRoutingTable(cfg.BucketSize, dht.selfKey, time.Minute, dht.host.Peerstore(), maxLastSuccessfulOutboundThreshold, filter)
+	if err != nil {
+		return nil, err
+	}
+	rt.PeerAdded, rt.PeerRemoved = peerAdded, peerRemoved
+	return rt, nil
 }
 
 // ProviderStore returns the provider storage object for storing and retrieving provider records.
@@ -504,39 +921,17 @@ func (dht *IpfsDHT) fixLowPeers() {
 		dht.peerFound(p)
 	}
 
-	// TODO Active Bootstrapping
-	// We should first use non-bootstrap peers we knew of from previous
-	// snapshots of the Routing Table before we connect to the bootstrappers.
-	// See https://github.com/libp2p/go-libp2p-kad-dht/issues/387.
-	if dht.routingTable.Size() == 0 && dht.bootstrapPeers != nil {
-		bootstrapPeers := dht.bootstrapPeers()
-		if len(bootstrapPeers) == 0 {
-			// No point in continuing, we have no peers!
-			return
+	// We first use non-bootstrap peers we knew of from previous snapshots
+	// of the Routing Table before we connect to the bootstrappers.
+	if dht.routingTable.Size() == 0 {
+		found, unreachable := dht.connectBootstrappers(dht.RememberedPeers(), 0)
+		if found < maxNBoostrappers && dht.bootstrapPeers != nil {
+			found, _ = dht.connectBootstrappers(dht.bootstrapPeers(), found)
 		}
-
-		found := 0
-		for _, i := range rand.Perm(len(bootstrapPeers)) {
-			ai := bootstrapPeers[i]
-			err := dht.Host().Connect(dht.ctx, ai)
-			if err == nil {
-				found++
-			} else {
-				logger.Warnw("failed to bootstrap", "peer", ai.ID, "error", err)
-			}
-
-			// Wait for two bootstrap peers, or try them all.
-			//
-			// Why two? In theory, one should be enough
-			// normally. However, if the network were to
-			// restart and everyone connected to just one
-			// bootstrapper, we'll end up with a mostly
-			// partitioned network.
-			//
-			// So we always bootstrap with two random peers.
-			if found == maxNBoostrappers {
-				break
-			}
+		// Forget the remembered peers that can't be connected to, unless
+		// we couldn't connect to anyone and are likely offline.
+		if found > 0 {
+			dht.forgetRememberedPeers(unreachable)
 		}
 	}
 
@@ -551,6 +946,40 @@ func (dht *IpfsDHT) fixLowPeers() {
 	}
 }
 
+// connectBootstrappers connects to the given peers in random order until
+// maxNBoostrappers connections (including the found already established ones)
+// succeeded. It returns the total number of successful connections, and the
+// peers that couldn't be connected to.
+func (dht *IpfsDHT) connectBootstrappers(bootstrapPeers []peer.AddrInfo, found int) (int, []peer.ID) {
+	var failed []peer.ID
+	for _, i := range rand.Perm(len(bootstrapPeers)) {
+		// Wait for two bootstrap peers, or try them all.
+		//
+		// Why two? In theory, one should be enough
+		// normally. However, if the network were to
+		// restart and everyone connected to just one
+		// bootstrapper, we'll end up with a mostly
+		// partitioned network.
+		//
+		// So we always bootstrap with two random peers.
+		if found >= maxNBoostrappers {
+			break
+		}
+
+		ai := bootstrapPeers[i]
+		err := dht.Host().Connect(dht.ctx, ai)
+		if err == nil {
+			found++
+		} else {
+			dht.logger.Warnw("failed to bootstrap", "peer", ai.ID, "error", err)
+			if dht.ctx.Err() == nil {
+				failed = append(failed, ai.ID)
+			}
+		}
+	}
+	return found, failed
+}
+
 // TODO This is hacky, horrible and the programmer needs to have his mother called a hamster.
 // SHOULD be removed once https://github.com/libp2p/go-libp2p/issues/800 goes in.
 func (dht *IpfsDHT) persistRTPeersInPeerStore() {
@@ -575,17 +1004,17 @@ func (dht *IpfsDHT) persistRTPeersInPeerStore() {
 // returns nil, nil when either nothing is found or the value found doesn't properly validate.
 // returns nil, some_error when there's a *datastore* error (i.e., something goes very wrong)
 func (dht *IpfsDHT) getLocal(ctx context.Context, key string) (*recpb.Record, error) {
-	logger.Debugw("finding value in datastore", "key", internal.LoggableRecordKeyString(key))
+	dht.logger.Debugw("finding value in datastore", "key", internal.LoggableRecordKeyString(key))
 
 	rec, err := dht.getRecordFromDatastore(ctx, mkDsKey(key))
 	if err != nil {
-		logger.Warnw("get local failed", "key", internal.LoggableRecordKeyString(key), "error", err)
+		dht.logger.Warnw("get local failed", "key", internal.LoggableRecordKeyString(key), "error", err)
 		return nil, err
 	}
 
 	// Double check the key. Can't hurt.
 	if rec != nil && string(rec.GetKey()) != key {
-		logger.Errorw("BUG: found a DHT record that didn't match it's key", "expected", internal.LoggableRecordKeyString(key), "got", rec.GetKey())
+		dht.logger.Errorw("BUG: found a DHT record that didn't match it's key", "expected", internal.LoggableRecordKeyString(key), "got", rec.GetKey())
 		return nil, nil
 
 	}
@@ -596,11 +1025,25 @@ func (dht *IpfsDHT) getLocal(ctx context.Context, key string) (*recpb.Record, er
 func (dht *IpfsDHT) putLocal(ctx context.Context, key string, rec *recpb.Record) error {
 	data, err := proto.Marshal(rec)
 	if err != nil {
-		logger.Warnw("failed to put marshal record for local put", "error", err, "key", internal.LoggableRecordKeyString(key))
+		dht.logger.Warnw("failed to put marshal record for local put", "error", err, "key", internal.LoggableRecordKeyString(key))
 		return err
 	}
 
-	return dht.datastore.Put(ctx, mkDsKey(key), data)
+	lk := dht.putLock([]byte(key))
+	lk.Lock()
+	defer lk.Unlock()
+	// the record is ours now, so it must not be evicted with the quota of
+	// the peer that stored it before
+	dht.originQuotas.release(key)
+	return dht.storeRecord(ctx, rec, data)
+}
+
+// putLock returns the striped lock serializing the puts of key.
+func (dht *IpfsDHT) putLock(key []byte) *sync.Mutex {
+	if len(key) == 0 {
+		return &dht.stripedPutLocks[0]
+	}
+	return &dht.stripedPutLocks[key[len(key)-1]]
 }
 
 func (dht *IpfsDHT) rtPeerLoop() {
@@ -635,6 +1078,7 @@ func (dht *IpfsDHT) rtPeerLoop() {
 					// the peer is already in our RT, but we just successfully queried it and so let's give it a
 					// bump on the query time so we don't ping it too soon for a liveliness check.
 					dht.routingTable.UpdateLastSuccessfulOutboundQueryAt(p, time.Now())
+					dht.probes.heard(p)
 				}
 			case <-dht.refreshFinishedCh:
 				bootstrapCount = bootstrapCount + 1
@@ -665,11 +1109,21 @@ func (dht *IpfsDHT) peerFound(p peer.ID) {
 		return
 	}
 
+	if dht.relayAddrPolicy == StripRelayAddrs && dht.onlyRelayed(p) {
+		dht.logger.Debugw("not adding relayed peer to the routing table", "peer", p)
+		return
+	}
+
 	// verify whether the remote peer advertises the right dht protocol
 	b, err := dht.validRTPeer(p)
 	if err != nil {
-		logger.Errorw("failed to validate if peer is a DHT peer", "peer", p, "error", err)
+		dht.logger.Errorw("failed to validate if peer is a DHT peer", "peer", p, "error", err)
 	} else if b {
+		if dht.disableLookupCheck {
+			dht.recordLookupCheck(lookupCheckSkipped)
+			dht.validPeerFound(p)
+			return
+		}
 
 		// check if the maximal number of concurrent lookup checks is reached
 		dht.lookupChecksLk.Lock()
@@ -677,6 +1131,7 @@ func (dht *IpfsDHT) peerFound(p peer.ID) {
 			dht.lookupChecksLk.Unlock()
 			// drop the new peer.ID if the maximal number of concurrent lookup
 			// checks is reached
+			dht.recordLookupCheck(lookupCheckDropped)
 			return
 		}
 		dht.lookupCheckCapacity--
@@ -694,20 +1149,38 @@ func (dht *IpfsDHT) peerFound(p peer.ID) {
 			dht.lookupChecksLk.Unlock()
 
 			if err != nil {
-				logger.Debugw("connected peer not answering DHT request as expected", "peer", p, "error", err)
+				dht.logger.Debugw("connected peer not answering DHT request as expected", "peer", p, "error", err)
+				dht.recordLookupCheck(lookupCheckFailed)
 				return
 			}
 
 			// if the FIND_NODE succeeded, the peer is considered as valid
+			dht.recordLookupCheck(lookupCheckPassed)
 			dht.validPeerFound(p)
 		}()
 	}
 }
 
+// The outcomes of the lookup checks of newly found servers, as reported by
+// the lookup check metric.
+const (
+	lookupCheckPassed  = "passed"
+	lookupCheckFailed  = "failed"
+	lookupCheckDropped = "dropped" // too many checks running
+	lookupCheckSkipped = "skipped" // lookup checks disabled
+)
+
+func (dht *IpfsDHT) recordLookupCheck(outcome string) {
+	metrics.LookupChecks.Add(dht.ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)), dht.protoAttr)
+}
+
 // validPeerFound signals the routingTable that we've found a peer that
 // supports the DHT protocol, and just answered correctly to a DHT FindPeers
 func (dht *IpfsDHT) validPeerFound(p peer.ID) {
-	if c := baseLogger.Check(zap.DebugLevel, "peer found"); c != nil {
+	if dht.foreignPeer(p) || dht.bans.banned(p) {
+		return
+	}
+	if c := dht.baseLogger.Check(zap.DebugLevel, "peer found"); c != nil {
 		c.Write(zap.String("peer", p.String()))
 	}
 
@@ -719,11 +1192,27 @@ func (dht *IpfsDHT) validPeerFound(p peer.ID) {
 }
 
 // peerStoppedDHT signals the routing table that a peer is unable to responsd to DHT queries anymore.
-func (dht *IpfsDHT) peerStoppedDHT(p peer.ID) {
-	logger.Debugw("peer stopped dht", "peer", p)
+// The reason is reported by the routing table eviction metric.
+func (dht *IpfsDHT) peerStoppedDHT(p peer.ID, reason string) {
+	dht.logger.Debugw("peer stopped dht", "peer", p, "reason", reason)
 	// A peer that does not support the DHT protocol is dead for us.
 	// There's no point in talking to anymore till it starts supporting the DHT protocol again.
-	dht.routingTable.RemovePeer(p)
+	dht.evictPeer(p, reason)
+}
+
+// notifyRTChanged wakes up everyone waiting on a routing table change.
+func (dht *IpfsDHT) notifyRTChanged() {
+	dht.rtChangedLk.Lock()
+	close(dht.rtChangedCh)
+	dht.rtChangedCh = make(chan struct{})
+	dht.rtChangedLk.Unlock()
+}
+
+// rtChanged returns a channel that is closed on the next routing table change.
+func (dht *IpfsDHT) rtChanged() <-chan struct{} {
+	dht.rtChangedLk.Lock()
+	defer dht.rtChangedLk.Unlock()
+	return dht.rtChangedCh
 }
 
 func (dht *IpfsDHT) fixRTIfNeeded() {
@@ -746,7 +1235,7 @@ func (dht *IpfsDHT) FindLocal(ctx context.Context, id peer.ID) peer.AddrInfo {
 
 // nearestPeersToQuery returns the routing tables closest peers.
 func (dht *IpfsDHT) nearestPeersToQuery(pmes *pb.Message, count int) []peer.ID {
-	closer := dht.routingTable.NearestPeers(kb.ConvertKey(string(pmes.GetKey())), count)
+	closer := dht.routingTable.NearestPeers(dht.kadKey(string(pmes.GetKey())), count)
 	return closer
 }
 
@@ -756,7 +1245,7 @@ func (dht *IpfsDHT) betterPeersToQuery(pmes *pb.Message, from peer.ID, count int
 
 	// no node? nil
 	if closer == nil {
-		logger.Infow("no closer peers to send", from)
+		dht.logger.Infow("no closer peers to send", from)
 		return nil
 	}
 
@@ -765,7 +1254,7 @@ func (dht *IpfsDHT) betterPeersToQuery(pmes *pb.Message, from peer.ID, count int
 
 		// == to self? thats bad
 		if clp == dht.self {
-			logger.Error("BUG betterPeersToQuery: attempted to return self! this shouldn't happen...")
+			dht.logger.Error("BUG betterPeersToQuery: attempted to return self! this shouldn't happen...")
 			return nil
 		}
 		// Dont send a peer back themselves
@@ -806,6 +1295,10 @@ func (dht *IpfsDHT) moveToServerMode() error {
 	for _, p := range dht.serverProtocols {
 		dht.host.SetStreamHandler(p, dht.handleNewStream)
 	}
+	if dht.observer {
+		// nothing is spoken over it, it is only there to be advertised
+		dht.host.SetStreamHandler(dht.observerProtocol, func(s network.Stream) { _ = s.Reset() })
+	}
 	return nil
 }
 
@@ -848,14 +1341,35 @@ func (dht *IpfsDHT) Context() context.Context {
 	return dht.ctx
 }
 
-// RoutingTable returns the DHT's routingTable.
+// RoutingTable returns the DHT's routingTable. With CompactRoutingTable, it
+// returns a snapshot of the compact table instead, built on every call:
+// changes made to it don't affect the DHT, and RoutingTableSize and
+// RoutingTablePeers are cheaper ways to inspect the table.
 func (dht *IpfsDHT) RoutingTable() *kb.RoutingTable {
-	return dht.routingTable
+	if rt, ok := dht.routingTable.(*kb.RoutingTable); ok {
+		return rt
+	}
+	return dht.compactRoutingTableSnapshot()
+}
+
+// RoutingTableSize returns the number of peers in the routing table, whichever
+// its implementation.
+func (dht *IpfsDHT) RoutingTableSize() int {
+	return dht.routingTable.Size()
+}
+
+// RoutingTablePeers returns the peers of the routing table, whichever its
+// implementation.
+func (dht *IpfsDHT) RoutingTablePeers() []kb.PeerInfo {
+	return dht.routingTable.GetPeerInfos()
 }
 
 // Close calls Process Close.
 func (dht *IpfsDHT) Close() error {
 	dht.cancel()
+	dht.unregisterStreams()
+	dht.unregisterGauges()
+	dht.disconnects.stop()
 	dht.wg.Wait()
 
 	var wg sync.WaitGroup
@@ -887,7 +1401,17 @@ func (dht *IpfsDHT) PeerID() peer.ID {
 
 // PeerKey returns a DHT key, converted from the DHT node's Peer ID.
 func (dht *IpfsDHT) PeerKey() []byte {
-	return kb.ConvertPeerID(dht.self)
+	return append([]byte(nil), dht.selfKey...)
+}
+
+// kadKey maps key into the keyspace of the DHT.
+func (dht *IpfsDHT) kadKey(key string) kb.ID {
+	return dht.keyspaceHash.ID([]byte(key))
+}
+
+// kadPeerID maps p into the keyspace of the DHT.
+func (dht *IpfsDHT) kadPeerID(p peer.ID) kb.ID {
+	return dht.keyspaceHash.ID([]byte(p))
 }
 
 // Host returns the libp2p host this DHT is operating with.
@@ -899,7 +1423,7 @@ func (dht *IpfsDHT) Host() host.Host {
 func (dht *IpfsDHT) Ping(ctx context.Context, p peer.ID) error {
 	ctx, span := internal.StartSpan(ctx, "IpfsDHT.Ping", trace.WithAttributes(attribute.Stringer("PeerID", p)))
 	defer span.End()
-	return dht.protoMessenger.Ping(ctx, p)
+	return dht.protoMessenger.Ping(startRequest(ctx, "Ping"), p)
 }
 
 // NetworkSize returns the most recent estimation of the DHT network size.
@@ -922,7 +1446,7 @@ func (dht *IpfsDHT) maybeAddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Dura
 	if p == dht.self || hasValidConnectedness(dht.host, p) {
 		return
 	}
-	dht.peerstore.AddAddrs(p, dht.filterAddrs(addrs), ttl)
+	dht.peerstore.AddAddrs(p, dht.filterAddrs(dht.applyRelayAddrPolicy(addrs)), ttl)
 }
 
 func (dht *IpfsDHT) filterAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	"github.com/multiformats/go-multiaddr"
@@ -40,6 +41,9 @@ func init() {
 // GetDefaultBootstrapPeerAddrInfos returns the peer.AddrInfos for the default
 // bootstrap peers so we can use these for initializing the DHT by passing these to the
 // BootstrapPeers(...) option.
+//
+// As it runs before any DHT exists, it logs the invalid addresses through the
+// package-wide "dht" logger.
 func GetDefaultBootstrapPeerAddrInfos() []peer.AddrInfo {
 	ds := make([]peer.AddrInfo, 0, len(DefaultBootstrapPeers))
 
@@ -47,7 +51,7 @@ func GetDefaultBootstrapPeerAddrInfos() []peer.AddrInfo {
 		info, err := peer.AddrInfoFromP2pAddr(DefaultBootstrapPeers[i])
 		if err != nil {
 			logger.Errorw("failed to convert bootstrapper address to peer addr info", "address",
-				DefaultBootstrapPeers[i].String(), err, "err")
+				DefaultBootstrapPeers[i].String(), "error", err)
 			continue
 		}
 		ds = append(ds, *info)
@@ -82,3 +86,108 @@ func (dht *IpfsDHT) RefreshRoutingTable() <-chan error {
 func (dht *IpfsDHT) ForceRefresh() <-chan error {
 	return dht.rtRefreshManager.Refresh(true)
 }
+
+// BootstrapProgress describes how far the routing table got in being
+// populated.
+type BootstrapProgress struct {
+	// Peers is the number of peers in the routing table.
+	Peers int
+	// PeersPerCpl holds the number of routing table peers for each common
+	// prefix length (CPL) with the local peer ID, up to the highest populated
+	// CPL.
+	PeersPerCpl []int
+}
+
+// BucketsPopulated returns the number of CPLs with at least one peer.
+func (p BootstrapProgress) BucketsPopulated() int {
+	n := 0
+	for _, c := range p.PeersPerCpl {
+		if c > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// CplCoverage returns the number of consecutive CPLs, starting at 0, that
+// have at least one peer.
+func (p BootstrapProgress) CplCoverage() int {
+	for i, c := range p.PeersPerCpl {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(p.PeersPerCpl)
+}
+
+// ReadinessCriteria defines when the routing table is considered ready.
+type ReadinessCriteria struct {
+	// MinPeers is the minimum number of peers in the routing table.
+	MinPeers int
+	// MinCplCoverage is the minimum number of consecutive CPLs, starting at 0,
+	// that must have at least one peer (see BootstrapProgress.CplCoverage).
+	MinCplCoverage int
+}
+
+// SatisfiedBy returns true if the given progress meets the criteria.
+func (c ReadinessCriteria) SatisfiedBy(p BootstrapProgress) bool {
+	return p.Peers >= c.MinPeers && p.CplCoverage() >= c.MinCplCoverage
+}
+
+// BootstrapProgress returns the current state of the routing table.
+func (dht *IpfsDHT) BootstrapProgress() BootstrapProgress {
+	peers := dht.routingTable.ListPeers()
+	progress := BootstrapProgress{Peers: len(peers)}
+	for _, p := range peers {
+		cpl := kb.CommonPrefixLen(dht.selfKey, dht.kadPeerID(p))
+		for len(progress.PeersPerCpl) <= cpl {
+			progress.PeersPerCpl = append(progress.PeersPerCpl, 0)
+		}
+		progress.PeersPerCpl[cpl]++
+	}
+	return progress
+}
+
+// BootstrapWithProgress acts like Bootstrap but waits for the triggered
+// routing table refresh to finish. The progress function is called every time
+// the routing table changes in the meantime, and once more when the refresh
+// finished.
+func (dht *IpfsDHT) BootstrapWithProgress(ctx context.Context, progress func(BootstrapProgress)) (err error) {
+	_, end := tracer.Bootstrap(dhtName, ctx)
+	defer func() { end(err) }()
+
+	dht.fixRTIfNeeded()
+	refreshCh := dht.rtRefreshManager.Refresh(false)
+	for {
+		changed := dht.rtChanged()
+		select {
+		case <-changed:
+			if progress != nil {
+				progress(dht.BootstrapProgress())
+			}
+		case err := <-refreshCh:
+			if progress != nil {
+				progress(dht.BootstrapProgress())
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WaitReady blocks until the routing table satisfies the given criteria or the
+// context is done. It is intended to back readiness probes.
+func (dht *IpfsDHT) WaitReady(ctx context.Context, criteria ReadinessCriteria) error {
+	for {
+		changed := dht.rtChanged()
+		if criteria.SatisfiedBy(dht.BootstrapProgress()) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
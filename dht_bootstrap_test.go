@@ -2,12 +2,17 @@ package dht
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
 
 	"github.com/stretchr/testify/require"
 )
@@ -199,3 +204,118 @@ func TestBootstrappersReplacable(t *testing.T) {
 	require.Contains(t, d.routingTable.ListPeers(), d3.self)
 	require.Contains(t, d.routingTable.ListPeers(), d4.self)
 }
+
+func TestRememberedPeers(t *testing.T) {
+	ctx := context.Background()
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	d1 := setupDHT(ctx, t, false, Datastore(dstore), RememberPeers(5, 0))
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	require.NoError(t, d1.saveRememberedPeers(ctx))
+	remembered := d1.RememberedPeers()
+	require.Len(t, remembered, 1)
+	require.Equal(t, d2.self, remembered[0].ID)
+
+	// a new DHT using the same datastore starts with the remembered peers
+	d3 := setupDHT(ctx, t, false, Datastore(dstore), RememberPeers(5, 0))
+	remembered = d3.RememberedPeers()
+	require.Len(t, remembered, 1)
+	require.Equal(t, d2.self, remembered[0].ID)
+
+	// and bootstraps from them when its routing table is empty
+	d3.fixLowPeers()
+	wait(t, ctx, d3, d2)
+}
+
+func TestRememberedPeersExpiry(t *testing.T) {
+	ctx := context.Background()
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}
+	fresh, stale, legacy := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	buf, err := json.Marshal(rememberedPeersRecord{
+		Peers: []peer.AddrInfo{{ID: fresh, Addrs: addrs}, {ID: stale, Addrs: addrs}, {ID: legacy, Addrs: addrs}},
+		LastSeen: map[string]time.Time{
+			fresh.String(): time.Now().Add(-time.Hour),
+			stale.String(): time.Now().Add(-rememberedPeersExpiry - time.Hour),
+		},
+	})
+	require.NoError(t, err)
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	require.NoError(t, dstore.Put(ctx, rememberedPeersDsKey, buf))
+
+	// the peers not seen for too long are forgotten on load
+	d := setupDHT(ctx, t, false, Datastore(dstore), RememberPeers(5, 0))
+	remembered := d.RememberedPeers()
+	require.Len(t, remembered, 2)
+	require.ElementsMatch(t, []peer.ID{fresh, legacy}, []peer.ID{remembered[0].ID, remembered[1].ID})
+
+	// and on save
+	d.rememberedPeersLk.Lock()
+	d.rememberedPeers[0].lastSeen = time.Now().Add(-rememberedPeersExpiry - time.Hour)
+	kept := d.rememberedPeers[1].ID
+	d.rememberedPeersLk.Unlock()
+	require.NoError(t, d.saveRememberedPeers(ctx))
+	remembered = d.RememberedPeers()
+	require.Len(t, remembered, 1)
+	require.Equal(t, kept, remembered[0].ID)
+
+	buf, err = dstore.Get(ctx, rememberedPeersDsKey)
+	require.NoError(t, err)
+	var rec rememberedPeersRecord
+	require.NoError(t, json.Unmarshal(buf, &rec))
+	require.Len(t, rec.Peers, 1)
+	require.Contains(t, rec.LastSeen, kept.String())
+}
+
+func TestRememberedPeersUnreachable(t *testing.T) {
+	ctx := context.Background()
+	d1 := setupDHT(ctx, t, false, RememberPeers(5, 0))
+	d2 := setupDHT(ctx, t, false)
+
+	dead := test.RandPeerIDFatal(t)
+	d1.rememberedPeersLk.Lock()
+	d1.rememberedPeers = []rememberedPeer{
+		{AddrInfo: peer.AddrInfo{ID: d2.self, Addrs: d2.host.Addrs()}, lastSeen: time.Now()},
+		{AddrInfo: peer.AddrInfo{ID: dead, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/1")}}, lastSeen: time.Now()},
+	}
+	d1.rememberedPeersLk.Unlock()
+
+	// the remembered peer that can't be connected to is forgotten
+	d1.fixLowPeers()
+	wait(t, ctx, d1, d2)
+	remembered := d1.RememberedPeers()
+	require.Len(t, remembered, 1)
+	require.Equal(t, d2.self, remembered[0].ID)
+}
+
+func TestWaitReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false)
+	d2 := setupDHT(ctx, t, false)
+
+	criteria := ReadinessCriteria{MinPeers: 1}
+	require.False(t, criteria.SatisfiedBy(d1.BootstrapProgress()))
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- d1.WaitReady(ctx, criteria) }()
+
+	connect(t, ctx, d1, d2)
+	require.NoError(t, <-errCh)
+
+	progress := d1.BootstrapProgress()
+	require.Equal(t, 1, progress.Peers)
+	require.Equal(t, 1, progress.BucketsPopulated())
+
+	var reports []BootstrapProgress
+	require.NoError(t, d1.BootstrapWithProgress(ctx, func(p BootstrapProgress) {
+		reports = append(reports, p)
+	}))
+	require.NotEmpty(t, reports)
+	require.Equal(t, 1, reports[len(reports)-1].Peers)
+
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer tcancel()
+	require.ErrorIs(t, d1.WaitReady(tctx, ReadinessCriteria{MinPeers: 2}), context.DeadlineExceeded)
+}
@@ -210,6 +210,72 @@ func privRTFilter(dht interface{}, conns []network.Conn) bool {
 
 var _ RouteTableFilterFunc = PrivateRoutingTableFilter
 
+// TransportFilter selects peers advertising addresses that use specific
+// transports or address families, for deployments on restricted networks. An
+// address is accepted if it contains all of the configured multiaddr protocols,
+// e.g. ma.P_QUIC_V1 for QUIC-only networks or ma.P_IP6 for IPv6-only networks.
+//
+// The protocols can be changed at runtime with SetProtocols. A filter without
+// protocols accepts every peer.
+type TransportFilter struct {
+	mu        sync.RWMutex
+	protocols []int
+}
+
+// NewTransportFilter creates a TransportFilter accepting addresses that contain
+// all of the given multiaddr protocol codes.
+func NewTransportFilter(protocols ...int) *TransportFilter {
+	f := &TransportFilter{}
+	f.SetProtocols(protocols...)
+	return f
+}
+
+// SetProtocols replaces the multiaddr protocol codes the filter requires.
+func (f *TransportFilter) SetProtocols(protocols ...int) {
+	f.mu.Lock()
+	f.protocols = append([]int(nil), protocols...)
+	f.mu.Unlock()
+}
+
+func (f *TransportFilter) match(a ma.Multiaddr) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, code := range f.protocols {
+		if _, err := a.ValueForProtocol(code); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryFilter is a QueryFilterFunc accepting peers with at least one matching
+// address.
+func (f *TransportFilter) QueryFilter(_ interface{}, ai peer.AddrInfo) bool {
+	for _, a := range ai.Addrs {
+		if f.match(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutingTableFilter is a RouteTableFilterFunc accepting peers we are
+// connected to over a matching address.
+func (f *TransportFilter) RoutingTableFilter(dht interface{}, p peer.ID) bool {
+	d := dht.(hasHost)
+	for _, c := range d.Host().Network().ConnsToPeer(p) {
+		if f.match(c.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ QueryFilterFunc      = (*TransportFilter)(nil).QueryFilter
+	_ RouteTableFilterFunc = (*TransportFilter)(nil).RoutingTableFilter
+)
+
 func isEUI(ip net.IP) bool {
 	// per rfc 2373
 	return len(ip) == net.IPv6len && ip[11] == 0xff && ip[12] == 0xfe
@@ -9,8 +9,12 @@ import (
 	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/test"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 )
 
 func TestIsRelay(t *testing.T) {
@@ -29,6 +33,77 @@ func TestIsRelay(t *testing.T) {
 
 }
 
+func TestRelayAddrPolicy(t *testing.T) {
+	direct := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	relayed := ma.StringCast("/ip4/1.2.3.5/tcp/4001/p2p/QmdPU7PfRyKehdrP5A3WqmjyD6bhVpU1mLGKppa2FjGDjZ/p2p-circuit")
+	addrs := []ma.Multiaddr{relayed, direct}
+
+	d := &IpfsDHT{relayAddrPolicy: AcceptRelayAddrs}
+	if got := d.applyRelayAddrPolicy(addrs); len(got) != 2 || !got[0].Equal(relayed) {
+		t.Fatalf("unexpected addresses %v", got)
+	}
+	d.relayAddrPolicy = DeprioritizeRelayAddrs
+	if got := d.applyRelayAddrPolicy(addrs); len(got) != 2 || !got[0].Equal(direct) || !got[1].Equal(relayed) {
+		t.Fatalf("unexpected addresses %v", got)
+	}
+	d.relayAddrPolicy = StripRelayAddrs
+	if got := d.applyRelayAddrPolicy(addrs); len(got) != 1 || !got[0].Equal(direct) {
+		t.Fatalf("unexpected addresses %v", got)
+	}
+}
+
+func TestFindPeerRelayAddrPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, RelayAddressPolicy(StripRelayAddrs))
+
+	direct := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	relayed := ma.StringCast("/ip4/1.2.3.5/tcp/4001/p2p/QmdPU7PfRyKehdrP5A3WqmjyD6bhVpU1mLGKppa2FjGDjZ/p2p-circuit")
+	mixed, relayOnly := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	d.peerstore.AddAddrs(mixed, []ma.Multiaddr{relayed, direct}, peerstore.PermanentAddrTTL)
+	d.peerstore.AddAddrs(relayOnly, []ma.Multiaddr{relayed}, peerstore.PermanentAddrTTL)
+	for _, p := range []peer.ID{mixed, relayOnly} {
+		if _, err := d.routingTable.TryAddPeer(p, true, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := pb.NewMessage(pb.Message_FIND_NODE, []byte(relayOnly), 0)
+	resp, err := d.handleFindPeer(ctx, test.RandPeerIDFatal(t), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer only reachable through a relay is left out
+	closer := pb.PBPeersToPeerInfos(resp.CloserPeers)
+	if len(closer) != 1 || closer[0].ID != mixed {
+		t.Fatalf("unexpected closer peers %v", closer)
+	}
+	if len(closer[0].Addrs) != 1 || !closer[0].Addrs[0].Equal(direct) {
+		t.Fatalf("unexpected addresses %v", closer[0].Addrs)
+	}
+}
+
+func TestTransportFilter(t *testing.T) {
+	quic4 := peer.AddrInfo{ID: "quic4", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/udp/4001/quic-v1")}}
+	tcp6 := peer.AddrInfo{ID: "tcp6", Addrs: []ma.Multiaddr{ma.StringCast("/ip6/2001:db8::1/tcp/4001")}}
+
+	f := NewTransportFilter(ma.P_QUIC_V1)
+	if !f.QueryFilter(nil, quic4) || f.QueryFilter(nil, tcp6) {
+		t.Fatal("expected only the QUIC peer to be accepted")
+	}
+
+	f.SetProtocols(ma.P_IP6)
+	if f.QueryFilter(nil, quic4) || !f.QueryFilter(nil, tcp6) {
+		t.Fatal("expected only the IPv6 peer to be accepted")
+	}
+
+	f.SetProtocols(ma.P_IP6, ma.P_QUIC_V1)
+	if f.QueryFilter(nil, quic4) || f.QueryFilter(nil, tcp6) {
+		t.Fatal("expected no peer to be accepted")
+	}
+}
+
 type mockConn struct {
 	local  peer.AddrInfo
 	remote peer.AddrInfo
@@ -1,11 +1,15 @@
 package dht
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
@@ -34,21 +38,29 @@ func (dht *IpfsDHT) handleNewStream(s network.Stream) {
 
 // Returns true on orderly completion of writes (so we can Close the stream).
 func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
-	ctx := dht.ctx
 	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
 
 	mPeer := s.Conn().RemotePeer()
+	shim := dht.protocolShims[s.Protocol()]
 
 	timer := time.AfterFunc(dhtStreamIdleTimeout, func() { _ = s.Reset() })
 	defer timer.Stop()
 
+	// the request is recycled for every message of the stream, so the
+	// handlers must copy whatever they keep from it past their return.
+	req := pb.AcquireMessage()
+	defer pb.ReleaseMessage(req)
+
 	for {
 		if dht.getMode() != modeServer {
-			logger.Debugf("ignoring incoming dht message while not in server mode")
+			dht.ignoreClientModeMessage(mPeer)
+			return false
+		}
+		if dht.greylisted(mPeer) || dht.bans.banned(mPeer) {
 			return false
 		}
 
-		var req pb.Message
+		req.Recycle()
 		msgbytes, err := r.ReadMsg()
 		msgLen := len(msgbytes)
 		if err != nil {
@@ -58,64 +70,120 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			}
 			// This string test is necessary because there isn't a single stream reset error
 			// instance	in use.
-			if c := baseLogger.Check(zap.DebugLevel, "error reading message"); c != nil && err.Error() != "stream reset" {
+			if c := dht.baseLogger.Check(zap.DebugLevel, "error reading message"); c != nil && err.Error() != "stream reset" {
 				c.Write(zap.String("from", mPeer.String()),
 					zap.Error(err))
 			}
 			if msgLen > 0 {
+				dht.strike(mPeer, "unreadable message")
 				attributes := metric.WithAttributes(attribute.String("message_type", "UNKNOWN"))
-				metrics.ReceivedMessages.Add(ctx, 1, attributes)
-				metrics.ReceivedMessageErrors.Add(ctx, 1, attributes)
-				metrics.ReceivedBytes.Add(ctx, int64(msgLen), attributes)
+				metrics.ReceivedMessages.Add(dht.ctx, 1, attributes, dht.protoAttr)
+				metrics.ReceivedMessageErrors.Add(dht.ctx, 1, attributes, dht.protoAttr)
+				metrics.ReceivedBytes.Add(dht.ctx, int64(msgLen), attributes, dht.protoAttr)
 			}
 			return false
 		}
 		err = req.Unmarshal(msgbytes)
 		r.ReleaseMsg(msgbytes)
 		if err != nil {
-			if c := baseLogger.Check(zap.DebugLevel, "error unmarshaling message"); c != nil {
+			if c := dht.baseLogger.Check(zap.DebugLevel, "error unmarshaling message"); c != nil {
 				c.Write(zap.String("from", mPeer.String()),
 					zap.Error(err))
 			}
+			dht.strike(mPeer, "malformed message")
 			attributes := metric.WithAttributes(attribute.String("message_type", "UNKNOWN"))
-			metrics.ReceivedMessages.Add(ctx, 1, attributes)
-			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes)
-			metrics.ReceivedBytes.Add(ctx, int64(msgLen), attributes)
+			metrics.ReceivedMessages.Add(dht.ctx, 1, attributes, dht.protoAttr)
+			metrics.ReceivedMessageErrors.Add(dht.ctx, 1, attributes, dht.protoAttr)
+			metrics.ReceivedBytes.Add(dht.ctx, int64(msgLen), attributes, dht.protoAttr)
 			return false
 		}
 
+		if shim.Request != nil {
+			translated, err := shim.Request(req)
+			if err != nil {
+				if c := dht.baseLogger.Check(zap.DebugLevel, "error translating request"); c != nil {
+					c.Write(zap.String("from", mPeer.String()),
+						zap.String("protocol", string(s.Protocol())),
+						zap.Error(err))
+				}
+				dht.strike(mPeer, "untranslatable request")
+				metrics.ReceivedMessageErrors.Add(dht.ctx, 1, metric.WithAttributes(attribute.String("message_type", req.GetType().String())), dht.protoAttr)
+				return false
+			}
+			*req = *translated
+		}
+
 		timer.Reset(dhtStreamIdleTimeout)
 
+		requestID := internal.NewRequestID()
+		ctx := internal.WithRequestID(dht.ctx, requestID)
+
 		startTime := time.Now()
 		attributes := metric.WithAttributes(attribute.String("message_type", req.GetType().String()))
 
-		metrics.ReceivedMessages.Add(ctx, 1, attributes)
-		metrics.ReceivedBytes.Add(ctx, int64(msgLen), attributes)
+		metrics.ReceivedMessages.Add(ctx, 1, attributes, dht.protoAttr)
+		metrics.ReceivedBytes.Add(ctx, int64(msgLen), attributes, dht.protoAttr)
 
 		if dht.onRequestHook != nil {
-			dht.onRequestHook(ctx, s, &req)
+			// req is recycled, the hook gets a copy it may keep
+			dht.onRequestHook(ctx, s, req.Clone())
+		}
+
+		if err := dht.verifyRequest(ctx, mPeer, req); err != nil {
+			dht.strike(mPeer, "unsigned request")
+			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes, dht.protoAttr)
+			if c := dht.baseLogger.Check(zap.DebugLevel, "rejecting unsigned message"); c != nil {
+				c.Write(zap.String("request_id", requestID),
+					zap.String("from", mPeer.String()),
+					zap.Int32("type", int32(req.GetType())),
+					zap.Error(err))
+			}
+			return false
 		}
 
 		handler := dht.handlerForMsgType(req.GetType())
 		if handler == nil {
-			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes)
-			if c := baseLogger.Check(zap.DebugLevel, "can't handle received message"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
+			// the known types are only missing a handler when disabled
+			if _, known := pb.Message_MessageType_name[int32(req.GetType())]; !known {
+				dht.strike(mPeer, "unknown message type")
+			}
+			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes, dht.protoAttr)
+			if c := dht.baseLogger.Check(zap.DebugLevel, "can't handle received message"); c != nil {
+				c.Write(zap.String("request_id", requestID),
+					zap.String("from", mPeer.String()),
 					zap.Int32("type", int32(req.GetType())))
 			}
 			return false
 		}
 
-		if c := baseLogger.Check(zap.DebugLevel, "handling message"); c != nil {
-			c.Write(zap.String("from", mPeer.String()),
+		if c := dht.baseLogger.Check(zap.DebugLevel, "handling message"); c != nil {
+			c.Write(zap.String("request_id", requestID),
+				zap.String("from", mPeer.String()),
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()))
 		}
-		resp, err := handler(ctx, mPeer, &req)
+		if reason, ok := dht.handlerBudget.acquire(ctx); !ok {
+			metrics.ShedInboundRequests.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("message_type", req.GetType().String()),
+				attribute.String("reason", reason),
+			), dht.protoAttr)
+			if c := dht.baseLogger.Check(zap.DebugLevel, "shedding message"); c != nil {
+				c.Write(zap.String("request_id", requestID),
+					zap.String("from", mPeer.String()),
+					zap.Int32("type", int32(req.GetType())),
+					zap.String("reason", reason))
+			}
+			return false
+		}
+		handlerStart := time.Now()
+		resp, err := handler(ctx, mPeer, req)
+		dht.handlerBudget.release()
+		dht.checkSlowRequest(ctx, mPeer, req, time.Since(handlerStart), attributes)
 		if err != nil {
-			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes)
-			if c := baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
+			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes, dht.protoAttr)
+			if c := dht.baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
+				c.Write(zap.String("request_id", requestID),
+					zap.String("from", mPeer.String()),
 					zap.Int32("type", int32(req.GetType())),
 					zap.Binary("key", req.GetKey()),
 					zap.Error(err))
@@ -123,23 +191,44 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			return false
 		}
 
-		if c := baseLogger.Check(zap.DebugLevel, "handled message"); c != nil {
-			c.Write(zap.String("from", mPeer.String()),
+		if c := dht.baseLogger.Check(zap.DebugLevel, "handled message"); c != nil {
+			c.Write(zap.String("request_id", requestID),
+				zap.String("from", mPeer.String()),
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()),
 				zap.Duration("time", time.Since(startTime)))
 		}
 
 		if resp == nil {
+			dht.bandwidth.record(ctx, mPeer, opServe, 0, wireSize(msgLen))
 			continue
 		}
 
+		resp.Capabilities = uint64(dht.capabilities)
+		resp.Extension = dht.responseExtension(ctx, mPeer, req)
+		if len(resp.CloserPeers) > 0 {
+			resp.SenderRecord = dht.selfRecord.get()
+		}
+		if shim.Response != nil {
+			if resp, err = shim.Response(resp); err != nil {
+				metrics.ReceivedMessageErrors.Add(ctx, 1, attributes, dht.protoAttr)
+				if c := dht.baseLogger.Check(zap.DebugLevel, "error translating response"); c != nil {
+					c.Write(zap.String("request_id", requestID),
+						zap.String("from", mPeer.String()),
+						zap.String("protocol", string(s.Protocol())),
+						zap.Error(err))
+				}
+				return false
+			}
+		}
+
 		// send out response msg
 		err = net.WriteMsg(s, resp)
 		if err != nil {
-			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes)
-			if c := baseLogger.Check(zap.DebugLevel, "error writing response"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
+			metrics.ReceivedMessageErrors.Add(ctx, 1, attributes, dht.protoAttr)
+			if c := dht.baseLogger.Check(zap.DebugLevel, "error writing response"); c != nil {
+				c.Write(zap.String("request_id", requestID),
+					zap.String("from", mPeer.String()),
 					zap.Int32("type", int32(req.GetType())),
 					zap.Binary("key", req.GetKey()),
 					zap.Error(err))
@@ -147,16 +236,58 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			return false
 		}
 
+		dht.bandwidth.record(ctx, mPeer, opServe, msgWireSize(resp), wireSize(msgLen))
+
 		elapsedTime := time.Since(startTime)
 
-		if c := baseLogger.Check(zap.DebugLevel, "responded to message"); c != nil {
-			c.Write(zap.String("from", mPeer.String()),
+		if c := dht.baseLogger.Check(zap.DebugLevel, "responded to message"); c != nil {
+			c.Write(zap.String("request_id", requestID),
+				zap.String("from", mPeer.String()),
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()),
 				zap.Duration("time", elapsedTime))
 		}
 
 		latencyMillis := float64(elapsedTime) / float64(time.Millisecond)
-		metrics.InboundRequestLatency.Record(ctx, latencyMillis, attributes)
+		metrics.InboundRequestLatency.Record(ctx, latencyMillis, attributes, dht.protoAttr)
+	}
+}
+
+// ignoredMessagesLogInterval is the minimum interval between two logs of the
+// messages ignored in client mode.
+const ignoredMessagesLogInterval = time.Minute
+
+// ignoreClientModeMessage counts a message from p ignored because we are not
+// in server mode. Peers sending them think we are a server, e.g. from stale
+// routing tables, which the logs, at most one per minute, help spot.
+func (dht *IpfsDHT) ignoreClientModeMessage(p peer.ID) {
+	metrics.IgnoredClientModeMessages.Add(dht.ctx, 1, dht.protoAttr)
+	n := dht.ignoredMessages.Add(1)
+
+	now := time.Now().UnixNano()
+	last := dht.lastIgnoredLog.Load()
+	if now-last < int64(ignoredMessagesLogInterval) || !dht.lastIgnoredLog.CompareAndSwap(last, now) {
+		dht.logger.Debugw("ignoring incoming dht message while not in server mode", "from", p)
+		return
+	}
+	dht.ignoredMessages.Add(-n)
+	dht.logger.Infow("ignoring incoming dht messages while not in server mode", "last_from", p, "ignored", n)
+}
+
+// checkSlowRequest logs and counts the inbound requests whose handler took
+// longer than the slow request threshold.
+func (dht *IpfsDHT) checkSlowRequest(ctx context.Context, p peer.ID, req *pb.Message, d time.Duration, attributes metric.MeasurementOption) {
+	if dht.slowRequestThreshold <= 0 || d < dht.slowRequestThreshold {
+		return
+	}
+	metrics.SlowInboundRequests.Add(ctx, 1, attributes, dht.protoAttr)
+
+	var key fmt.Stringer = internal.LoggableRecordKeyBytes(req.GetKey())
+	switch req.GetType() {
+	case pb.Message_GET_PROVIDERS, pb.Message_ADD_PROVIDER:
+		key = internal.LoggableProviderRecordBytes(req.GetKey())
+	case pb.Message_FIND_NODE:
+		key = peer.ID(req.GetKey())
 	}
+	dht.requestLogger(ctx).Warnw("slow request", "type", req.GetType(), "key", key, "from", p, "duration", d)
 }
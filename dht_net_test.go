@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+func TestSlowRequestThreshold(t *testing.T) {
+	setupTestTelemetry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, true)
+	fast := setupDHT(ctx, t, false, SlowRequestThreshold(time.Hour))
+	slow := setupDHT(ctx, t, false, SlowRequestThreshold(time.Nanosecond))
+	connectNoSync(t, ctx, client, fast)
+	connectNoSync(t, ctx, client, slow)
+
+	slowPings := func() int64 {
+		return counterValue(t, "libp2p.io/dht/kad/slow_inbound_requests", attribute.String(metrics.KeyMessageType, "PING"))
+	}
+
+	before := slowPings()
+	require.NoError(t, client.protoMessenger.Ping(ctx, fast.self))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, before, slowPings(), "a request below the threshold was counted as slow")
+
+	require.NoError(t, client.protoMessenger.Ping(ctx, slow.self))
+	require.Eventually(t, func() bool { return slowPings() == before+1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOnRequestHookKeepsRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		kept []*pb.Message
+	)
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false, OnRequestHook(func(_ context.Context, _ network.Stream, req *pb.Message) {
+		if req.GetType() == pb.Message_GET_VALUE {
+			mu.Lock()
+			kept = append(kept, req)
+			mu.Unlock()
+		}
+	}))
+	connect(t, ctx, a, b)
+
+	// the requests are read from the same stream, into the same message
+	keys := []string{"/v/first", "/v/second", "/v/third"}
+	for _, k := range keys {
+		_, err := a.msgSender.SendRequest(ctx, b.self, pb.NewMessage(pb.Message_GET_VALUE, []byte(k), 0))
+		require.NoError(t, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, kept, len(keys))
+	for i, k := range keys {
+		require.Equal(t, k, string(kept[i].GetKey()))
+	}
+}
@@ -2,16 +2,22 @@ package dht
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"log/slog"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/libp2p/go-libp2p-kad-dht/amino"
+	"github.com/libp2p/go-libp2p-kad-dht/crawler"
 	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/connmgr"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -19,6 +25,7 @@ import (
 
 	ds "github.com/ipfs/go-datastore"
 	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
 )
 
 // ModeOpt describes what mode the dht should operate in
@@ -34,6 +41,48 @@ const (
 	ModeServer
 	// ModeAutoServer operates in the same way as ModeAuto, but acts as a server when reachability is unknown
 	ModeAutoServer
+	// ModeObserver operates the DHT as a server that only answers routing queries (FIND_NODE and PING). It never
+	// stores nor serves values and provider records, and advertises this with an extra observer protocol.
+	ModeObserver
+)
+
+// ConnectionPreference describes how strongly lookups prefer peers we are
+// already connected to over closer peers that require a new dial.
+type ConnectionPreference = dhtcfg.ConnectionPreference
+
+const (
+	// PreferCloserPeers queries the closest peers first, dialing them if needed
+	PreferCloserPeers ConnectionPreference = iota
+	// PreferConnectedPeers queries connected peers first among the closest candidates, dialing the others afterward
+	PreferConnectedPeers
+	// ConnectedPeersOnly never dials new peers, only connected peers are queried
+	ConnectedPeersOnly
+)
+
+// RelayAddrPolicy describes how relayed addresses learned from other peers are handled.
+type RelayAddrPolicy = dhtcfg.RelayAddrPolicy
+
+const (
+	// AcceptRelayAddrs treats relayed addresses like any other address
+	AcceptRelayAddrs RelayAddrPolicy = iota
+	// DeprioritizeRelayAddrs keeps relayed addresses but orders them after direct ones
+	DeprioritizeRelayAddrs
+	// StripRelayAddrs drops relayed addresses
+	StripRelayAddrs
+)
+
+// DisconnectPolicy describes what happens to the routing table peers that
+// disconnect from us.
+type DisconnectPolicy = dhtcfg.DisconnectPolicy
+
+const (
+	// KeepOnDisconnect leaves disconnected peers in the routing table, until
+	// a routing table refresh or a query fails to reach them
+	KeepOnDisconnect DisconnectPolicy = iota
+	// EvictOnDisconnect removes peers from the routing table as soon as they disconnect
+	EvictOnDisconnect
+	// ProbeOnDisconnect probes peers still disconnected after a grace period, evicting them if they don't answer
+	ProbeOnDisconnect
 )
 
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
@@ -58,6 +107,53 @@ func RoutingTableLatencyTolerance(latency time.Duration) Option {
 	}
 }
 
+// RoutingTableDisconnectPolicy sets what happens to the routing table peers
+// that disconnect. With ProbeOnDisconnect, a peer still disconnected after
+// grace is probed with a FIND_NODE request, and evicted if it doesn't answer;
+// grace is unused by the other policies.
+//
+// The default policy is KeepOnDisconnect.
+func RoutingTableDisconnectPolicy(policy DisconnectPolicy, grace time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		switch policy {
+		case KeepOnDisconnect, EvictOnDisconnect, ProbeOnDisconnect:
+		default:
+			return fmt.Errorf("unknown disconnect policy %d", policy)
+		}
+		if grace < 0 {
+			return fmt.Errorf("disconnect grace period must be non-negative, got %s", grace)
+		}
+		c.RoutingTable.DisconnectPolicy = policy
+		c.RoutingTable.DisconnectGrace = grace
+		return nil
+	}
+}
+
+// RoutingTableProbing replaces the liveness checks of the routing table peers
+// run before every refresh, which ping all the peers not queried recently,
+// with probes scheduled per peer. A peer is first probed minInterval after
+// being added; its interval then doubles, up to maxInterval, every time it
+// answers over an existing connection, and halves when it had to be dialed
+// again, so that unstable peers are probed more often than stable ones.
+// Peers answering our queries are probed later, and the ones failing a probe
+// are evicted. At most rate probes are started per second.
+//
+// A zero rate disables the probes, which is the default.
+func RoutingTableProbing(minInterval, maxInterval time.Duration, rate float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if rate < 0 {
+			return fmt.Errorf("probe rate must be non-negative, got %v", rate)
+		}
+		if rate > 0 && (minInterval <= 0 || maxInterval < minInterval) {
+			return fmt.Errorf("invalid probe intervals [%s, %s]", minInterval, maxInterval)
+		}
+		c.RoutingTable.Probing.MinInterval = minInterval
+		c.RoutingTable.Probing.MaxInterval = maxInterval
+		c.RoutingTable.Probing.Rate = rate
+		return nil
+	}
+}
+
 // RoutingTableRefreshQueryTimeout sets the timeout for routing table refresh
 // queries.
 func RoutingTableRefreshQueryTimeout(timeout time.Duration) Option {
@@ -90,7 +186,7 @@ func Datastore(ds ds.Batching) Option {
 	}
 }
 
-// Mode configures which mode the DHT operates in (Client, Server, Auto).
+// Mode configures which mode the DHT operates in (Client, Server, Auto, Observer).
 //
 // Defaults to ModeAuto.
 func Mode(m ModeOpt) Option {
@@ -147,6 +243,17 @@ func ProtocolPrefix(prefix protocol.ID) Option {
 	}
 }
 
+// RefuseProtocols keeps the peers speaking any of protos out of the routing
+// table, even if they speak the protocols of the DHT too, so that a forked
+// network doesn't get bridged with the one it forked by peers speaking both.
+// See Fork.
+func RefuseProtocols(protos ...protocol.ID) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RefusedProtocols = append(c.RefusedProtocols, protos...)
+		return nil
+	}
+}
+
 // ProtocolExtension adds an application specific protocol to the DHT protocol. For example,
 // /ipfs/lan/kad/1.0.0 instead of /ipfs/kad/1.0.0. extension should be of the form /lan.
 func ProtocolExtension(ext protocol.ID) Option {
@@ -191,10 +298,38 @@ func Concurrency(alpha int) Option {
 // Resiliency configures the number of peers closest to a target that must have responded in order for a given query
 // path to complete.
 //
-// The default value is amino.DefaultResiliency
+// The default value is amino.DefaultResiliency, or the bucket size if smaller.
 func Resiliency(beta int) Option {
 	return func(c *dhtcfg.Config) error {
 		c.Resiliency = beta
+		c.ResiliencyChanged = true
+		return nil
+	}
+}
+
+// IncludeSelfRecord makes a server include its signed peer record in the
+// responses carrying closer peers, whatever their target, so that the peers
+// querying it learn its current addresses, signed by its key, rather than the
+// ones third parties return, possibly outdated. All DHTs add the records they
+// receive to the certified address book of their host, if it has one; the
+// host must have one to sign the records, see libp2p.DisableSignedPeerRecord.
+func IncludeSelfRecord() Option {
+	return func(c *dhtcfg.Config) error {
+		c.SelfRecord = true
+		return nil
+	}
+}
+
+// PingProbes makes the DHT probe the liveness of the routing table peers
+// advertising pb.CapPing with a PING request instead of a FIND_NODE of
+// themselves, sparing the closer peers of the response: the bulk of the probe
+// bandwidth of large routing tables. The DHT advertises pb.CapPing in turn.
+// The newly found servers are still checked with a FIND_NODE, to make sure they
+// answer the lookups before being added.
+func PingProbes() Option {
+	return func(c *dhtcfg.Config) error {
+		c.PingProbes = true
+		c.Capabilities |= pb.CapPing
 		return nil
 	}
 }
@@ -208,6 +343,49 @@ func LookupCheckConcurrency(n int) Option {
 	}
 }
 
+// LookupCheckTimeout bounds the FIND_NODE request a newly found server must
+// answer before being added to the routing table. The same timeout applies to
+// the probes of the routing table peers.
+//
+// Defaults to the routing table refresh query timeout.
+func LookupCheckTimeout(timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("lookup check timeout must be positive, got %s", timeout)
+		}
+		c.LookupCheckTimeout = timeout
+		return nil
+	}
+}
+
+// DisableLookupCheck adds the servers we connect to to the routing table as
+// soon as identify reports they speak our protocol, without first checking
+// that they answer a FIND_NODE request. It saves a request per new peer on
+// trusted networks, where every server is known to be queryable, but lets
+// unresponsive peers into the routing table elsewhere.
+func DisableLookupCheck() Option {
+	return func(c *dhtcfg.Config) error {
+		c.DisableLookupCheck = true
+		return nil
+	}
+}
+
+// MaxOutboundRequests limits the number of simultaneous outbound query RPCs (and
+// the dials they require) across all concurrent lookups of the DHT. While
+// several lookups are running they share the limit fairly, so a burst of
+// routing calls cannot exhaust file descriptors or the resource manager budget.
+//
+// The default value is 0, meaning unlimited.
+func MaxOutboundRequests(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("max outbound requests must be non-negative, got %d", n)
+		}
+		c.MaxOutboundRequests = n
+		return nil
+	}
+}
+
 // MaxRecordAge specifies the maximum time that any node will hold onto a record ("PutValue record")
 // from the time its received. This does not apply to any other forms of validity that
 // the record may contain.
@@ -266,6 +444,493 @@ func QueryFilter(filter QueryFilterFunc) Option {
 	}
 }
 
+// DialBackoff configures the backoff applied to peers that fail to dial during
+// queries. After a dial failure the peer is not dialed again by any query for
+// base, and every consecutive failure doubles that duration up to max. A base of
+// 0 disables the backoff.
+//
+// Defaults to a base of 30 seconds and a max of 30 minutes. The DHTs of the
+// process backing off for the default durations share a cache, while the ones
+// configured with other durations keep a cache of their own.
+func DialBackoff(base, max time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if base < 0 || max < 0 {
+			return fmt.Errorf("dial backoff durations must be non-negative")
+		}
+		c.DialBackoff.Base = base
+		c.DialBackoff.Max = max
+		c.DialBackoff.Shared = nil
+		return nil
+	}
+}
+
+// SharedDialBackoff makes the DHT use cache for its dial backoff, instead of the
+// cache configured by DialBackoff. The DHTs running on the same host should
+// share a cache, as a peer that can't be dialed by one of them can't be dialed
+// by the others either. See NewDialBackoffCache.
+func SharedDialBackoff(cache DialBackoffCache) Option {
+	return func(c *dhtcfg.Config) error {
+		if cache == nil {
+			return fmt.Errorf("shared dial backoff cache can't be nil")
+		}
+		c.DialBackoff.Shared = cache
+		if b, ok := cache.(*dialBackoff); ok {
+			c.DialBackoff.Base = b.base
+			c.DialBackoff.Max = b.max
+		}
+		return nil
+	}
+}
+
+// AdaptiveRequestTimeout sets the timeout of the requests sent to a peer from
+// the average round trip time measured with it: multiplier times the RTT,
+// bounded by floor and ceiling. Lookups then give up quickly on unresponsive
+// peers of a fast network, while slow peers answering within their usual time
+// aren't abandoned. The ceiling applies to the peers whose RTT is unknown, and
+// no request waits for its response more than 10 seconds anyway.
+//
+// Peers timing out fail the queries' requests like unreachable ones, and are
+// evicted from the routing table, so the floor must leave room for the peers
+// answering slowly under load. By default, and with a zero multiplier,
+// requests are only bounded by their context and the 10 seconds read timeout.
+func AdaptiveRequestTimeout(floor, ceiling time.Duration, multiplier float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if multiplier < 0 {
+			return fmt.Errorf("request timeout multiplier must be non-negative, got %v", multiplier)
+		}
+		if multiplier > 0 && (floor <= 0 || ceiling < floor) {
+			return fmt.Errorf("invalid request timeout bounds [%s, %s]", floor, ceiling)
+		}
+		c.RequestTimeout.Floor = floor
+		c.RequestTimeout.Ceiling = ceiling
+		c.RequestTimeout.Multiplier = multiplier
+		return nil
+	}
+}
+
+// SelfAudit makes a server check, every interval, whether it is still among
+// the closest peers to a random sample of up to sample of the keys it stores,
+// value records and provider records alike. As the network changes, closer
+// servers join and the records a server received drift out of its part of the
+// keyspace: the reports passed to report quantify how much of the storage is
+// still correctly placed, and list the misplaced keys along with the closest
+// peers to them, for a re-balancing process to hand them off. report may be
+// nil, the last report is returned by IpfsDHT.LastSelfAudit either way.
+//
+// Each sampled key costs a lookup. The self-audit is disabled by default.
+func SelfAudit(interval time.Duration, sample int, report func(SelfAuditReport)) Option {
+	return func(c *dhtcfg.Config) error {
+		if interval <= 0 || sample <= 0 {
+			return fmt.Errorf("self-audit interval and sample must be positive, got %s and %d", interval, sample)
+		}
+		c.SelfAudit.Interval = interval
+		c.SelfAudit.Sample = sample
+		c.SelfAudit.Report = report
+		return nil
+	}
+}
+
+// BackgroundCrawl makes the DHT keep knowledge of the whole keyspace, beyond
+// the neighborhood the routing table covers: the keyspace is split into 2^bits
+// regions, and a lookup for a random key of the next region is run every
+// interval. The peers found seed the later lookups for keys of the same
+// region, so that the first lookup of a cold key range starts a few hops
+// closer to its target. Each region is refreshed every interval*2^bits.
+//
+// The crawl costs a lookup per interval, far less than the full routing table
+// of the fullrt package. bits is best chosen so that each region holds a few
+// buckets worth of servers, and is at most 16. It is disabled by default.
+func BackgroundCrawl(interval time.Duration, bits int) Option {
+	return func(c *dhtcfg.Config) error {
+		if interval <= 0 {
+			return fmt.Errorf("background crawl interval must be positive, got %s", interval)
+		}
+		if bits < 1 || bits > 16 {
+			return fmt.Errorf("background crawl bits must be between 1 and 16, got %d", bits)
+		}
+		c.BackgroundCrawl.Interval = interval
+		c.BackgroundCrawl.Bits = bits
+		return nil
+	}
+}
+
+// CircuitBreaker stops sending RPCs to a peer once failures of them failed in
+// a row within window, so that queries don't keep waiting on the timeouts of
+// a flapping peer. The RPCs to the peer then fail right away until cooldown
+// elapsed, after which a single RPC is let through: the breaker closes if it
+// succeeds, and opens again for cooldown otherwise. A zero failures disables
+// the breaker, which is the default.
+func CircuitBreaker(failures int, window, cooldown time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if failures < 0 {
+			return fmt.Errorf("circuit breaker failures must be non-negative, got %d", failures)
+		}
+		if failures > 0 && (window <= 0 || cooldown <= 0) {
+			return fmt.Errorf("circuit breaker window and cooldown must be positive")
+		}
+		c.CircuitBreaker.Failures = failures
+		c.CircuitBreaker.Window = window
+		c.CircuitBreaker.Cooldown = cooldown
+		return nil
+	}
+}
+
+// DisableValueCorrections stops SearchValue (and thus GetValue) from pushing
+// the best record it found back to the closest peers holding an outdated one.
+func DisableValueCorrections() Option {
+	return func(c *dhtcfg.Config) error {
+		c.ValueCorrection.Disabled = true
+		return nil
+	}
+}
+
+// ValueCorrectionLimits bounds the corrections SearchValue sends to the closest
+// peers holding an outdated record: at most maxPeers peers are corrected per
+// query, and at most rate corrections are sent per second across all queries.
+// 0 means no limit. Corrections are reported as routing.Value query events with
+// "correction" as Extra.
+//
+// By default corrections are not limited.
+func ValueCorrectionLimits(maxPeers int, rate float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if maxPeers < 0 || rate < 0 {
+			return fmt.Errorf("value correction limits must be non-negative")
+		}
+		c.ValueCorrection.MaxPeers = maxPeers
+		c.ValueCorrection.Rate = rate
+		return nil
+	}
+}
+
+// RecordConflictResolver configures a hook called when SearchValue (and thus
+// GetValue) finds several valid but different records for a key. The hook sees
+// every candidate with the peers that returned it and may choose or merge the
+// winner, beyond what the validator's Select allows, and decide which peers
+// receive the winning record as a correction.
+func RecordConflictResolver(resolver ConflictResolver) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ConflictResolver = resolver
+		return nil
+	}
+}
+
+// NamespaceReplication sets the number of closest peers PutValue stores the
+// records of the given namespace (e.g. "ipns") with, instead of the bucket
+// size. Per call, the Replication routing option and WithReplication take
+// precedence.
+func NamespaceReplication(ns string, n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 1 {
+			return fmt.Errorf("replication must be positive, got %d", n)
+		}
+		if c.NamespaceReplication == nil {
+			c.NamespaceReplication = make(map[string]int)
+		}
+		c.NamespaceReplication[ns] = n
+		return nil
+	}
+}
+
+// KeyspaceGapReplication makes Provide store the provider records of the keys
+// falling into a keyspace gap, a region of the keyspace with abnormally few
+// reachable servers, with extra more peers than the others. gaps is called on
+// every Provide and typically returns the gaps crawler.FindGaps found in the
+// last crawl of the network, in the keyspace of the DHT.
+//
+// By default, the replication doesn't depend on the key.
+func KeyspaceGapReplication(gaps func() crawler.Gaps, extra int) Option {
+	return func(c *dhtcfg.Config) error {
+		if gaps == nil {
+			return fmt.Errorf("keyspace gaps source is required")
+		}
+		if extra < 1 {
+			return fmt.Errorf("extra replication must be positive, got %d", extra)
+		}
+		c.KeyspaceGaps.InGap = func(id kb.ID) bool { return gaps().Contains(id) }
+		c.KeyspaceGaps.ExtraReplication = extra
+		return nil
+	}
+}
+
+// ReprovideMissingOnly makes Provide skip, once it found the closest peers to
+// the key, the ones it stored our provider record on less than refresh ago,
+// and only send ADD_PROVIDER to the other ones, whose copy may expire before
+// the next reprovide. A couple of the skipped peers are asked for the record
+// first: if one of them lost it, the other ones are sent the record again.
+// Reproviding stable keys then costs a couple of GET_PROVIDERS instead of a
+// full record per peer.
+//
+// The DHT remembers when it stored its records on each peer in memory, for
+// the most recently provided keys: records stored before a restart, or by
+// optimistic provides, are always stored again. refresh must be less than the
+// provider record validity; half of it suits the usual reprovide interval.
+//
+// Disabled by default.
+func ReprovideMissingOnly(refresh time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if refresh <= 0 || refresh >= providers.ProvideValidity {
+			return fmt.Errorf("reprovide refresh must be between 0 and %s, got %s", providers.ProvideValidity, refresh)
+		}
+		c.ReprovideRefresh = refresh
+		return nil
+	}
+}
+
+// ProvideSchedulerLimits configures the budget of the provide scheduler running
+// the provides queued with ScheduleProvide: at most workers provides run
+// concurrently, and at most rate provides are started per second (0 meaning
+// unlimited). Every provide costs a lookup and up to a bucket size of
+// ADD_PROVIDER RPCs, so these limits keep applications announcing thousands of
+// keys from starving interactive lookups.
+//
+// Defaults to 4 workers and 10 provides per second.
+func ProvideSchedulerLimits(workers int, rate float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if workers < 1 {
+			return fmt.Errorf("provide scheduler needs at least one worker, got %d", workers)
+		}
+		if rate < 0 {
+			return fmt.Errorf("provide scheduler rate must be non-negative, got %f", rate)
+		}
+		c.ProvideScheduler.Workers = workers
+		c.ProvideScheduler.Rate = rate
+		return nil
+	}
+}
+
+// ProvideBudget caps the RPCs sent by the provides queued with ScheduleProvide,
+// lookup requests and ADD_PROVIDER messages alike, to rpcs per interval. The
+// scheduler waits for the next interval once the budget is used up; a provide
+// started with budget left may exceed it, the excess being taken from the
+// next intervals. The budget used is reported by ProvideSchedulerStats.
+//
+// Disabled by default, the provides only being bounded by the
+// ProvideSchedulerLimits.
+func ProvideBudget(rpcs int, interval time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if rpcs < 0 {
+			return fmt.Errorf("provide budget must be non-negative, got %d", rpcs)
+		}
+		if rpcs > 0 && interval <= 0 {
+			return fmt.Errorf("provide budget interval must be positive, got %s", interval)
+		}
+		c.ProvideScheduler.Budget = rpcs
+		c.ProvideScheduler.BudgetInterval = interval
+		return nil
+	}
+}
+
+// BandwidthAccountingPeers sets the number of most recently active peers whose
+// bandwidth is accounted (see BandwidthByPeer). Zero disables per-peer
+// accounting; the totals and the per-operation figures are always kept.
+//
+// Defaults to 1024.
+func BandwidthAccountingPeers(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("bandwidth accounting peers must be non-negative")
+		}
+		c.BandwidthAccountingPeers = n
+		return nil
+	}
+}
+
+// CompactRoutingTable makes the DHT use a low-memory routing table, packing
+// its peers in a byte slice per bucket, for embedded devices. It trades some
+// CPU (the Kademlia keys of the peers are not cached) and precision (its
+// timestamps have a one second resolution) for a much smaller footprint. It
+// can't be combined with RoutingTablePeerDiversityFilter, and RoutingTable
+// returns a snapshot of the compact table with it.
+func CompactRoutingTable() Option {
+	return func(c *dhtcfg.Config) error {
+		c.RoutingTable.Compact = true
+		return nil
+	}
+}
+
+// UseProfile applies the given resource profile (e.g. BatterySaverProfile),
+// overriding the routing table refresh interval, MaxOutboundRequests,
+// ProvideSchedulerLimits and whether the BackgroundCrawl runs. The profile
+// can be changed later with SetProfile.
+func UseProfile(p Profile) Option {
+	return func(c *dhtcfg.Config) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		c.RoutingTable.AutoRefresh = p.RefreshInterval > 0
+		if p.RefreshInterval > 0 {
+			c.RoutingTable.RefreshInterval = p.RefreshInterval
+		}
+		c.MaxOutboundRequests = p.MaxOutboundRequests
+		c.ProvideScheduler.Workers = p.ProvideWorkers
+		c.ProvideScheduler.Rate = p.ProvideRate
+		c.BackgroundCrawl.Paused = p.PauseCrawl
+		return nil
+	}
+}
+
+// ProxyFor makes the DHT run lookups on behalf of the given client peers, which
+// use a ProxyClient to reach it. The DHT advertises the proxy protocol
+// (<prefix>/kad/proxy/1.0.0) and resets the proxy streams of any other peer.
+//
+// Defaults to proxying for no one.
+func ProxyFor(clients ...peer.ID) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProxyClients = append(c.ProxyClients, clients...)
+		return nil
+	}
+}
+
+// ClientCache makes the DHT, while in client mode, cache the valid records and
+// provider entries it finds during its own lookups and consult this cache
+// before the network, so that repeated resolutions of the same key (e.g. an
+// IPNS name) don't hit the network every time. At most size entries are cached,
+// each for at most ttl. Cached records are validated again before being used,
+// and cached providers only spare the lookup when they are as many as the
+// requested count. The cache isn't consulted in server mode.
+//
+// Disabled by default.
+func ClientCache(size int, ttl time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if size < 0 || ttl < 0 {
+			return fmt.Errorf("client cache size and ttl must be non-negative")
+		}
+		c.PassiveCache.Size = size
+		c.PassiveCache.TTL = ttl
+		return nil
+	}
+}
+
+// NegativeCacheTTL makes FindPeer and FindProviders cache "not found" results
+// for the given duration, so that applications retrying lookups for content or
+// peers that aren't on the network don't each trigger a full lookup. Per call,
+// the cache can be bypassed with WithoutNegativeCache and the TTL overridden
+// with WithNegativeCacheTTL.
+//
+// Defaults to 0, i.e. misses are only cached for calls using
+// WithNegativeCacheTTL.
+func NegativeCacheTTL(ttl time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.NegativeCacheTTL = ttl
+		return nil
+	}
+}
+
+// VerifyFindPeerAddrs makes FindPeer verify the addresses of the peer it found
+// before returning them, by connecting to the peer unless we are already
+// connected to it. A successful connection refreshes the peer's addresses in the
+// peerstore; on failure the stale addresses are removed from the peerstore and
+// FindPeer returns routing.ErrNotFound instead of addresses that are likely
+// dead. timeout bounds the connection attempt. If the FindPeer context expires
+// first, the addresses are kept and FindPeer returns the context error.
+//
+// Disabled by default.
+func VerifyFindPeerAddrs(timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.FindPeerVerifyTimeout = timeout
+		return nil
+	}
+}
+
+// RelayAddressPolicy configures how relayed (/p2p-circuit) addresses found in
+// closer peer and provider responses are handled, both when they are stored in
+// the peerstore and routing table and when they are returned to the caller.
+// Relayed DHT servers give poor query performance:
+//   - AcceptRelayAddrs keeps them as is;
+//   - DeprioritizeRelayAddrs orders them after direct addresses, and queries
+//     peers only reachable through a relay last;
+//   - StripRelayAddrs drops them, and keeps peers only reachable through a
+//     relay out of the routing table.
+//
+// Defaults to AcceptRelayAddrs.
+func RelayAddressPolicy(policy RelayAddrPolicy) Option {
+	return func(c *dhtcfg.Config) error {
+		switch policy {
+		case AcceptRelayAddrs, DeprioritizeRelayAddrs, StripRelayAddrs:
+		default:
+			return fmt.Errorf("unknown relay address policy %d", policy)
+		}
+		c.RelayAddrPolicy = policy
+		return nil
+	}
+}
+
+// QueryConnectionPreference configures how strongly lookups prefer peers we are
+// already connected to over strictly closer peers that require a new dial.
+// ConnectedPeersOnly is meant for constrained environments where opening new
+// connections is not acceptable; lookups may then end further from the target.
+//
+// Defaults to PreferCloserPeers.
+func QueryConnectionPreference(pref ConnectionPreference) Option {
+	return func(c *dhtcfg.Config) error {
+		switch pref {
+		case PreferCloserPeers, PreferConnectedPeers, ConnectedPeersOnly:
+		default:
+			return fmt.Errorf("unknown connection preference %d", pref)
+		}
+		c.ConnectionPreference = pref
+		return nil
+	}
+}
+
+// DialRanker configures the function used to order the peers a lookup is about
+// to dial. The ranker is given a window of the closest not yet queried peers
+// (closest first) and the lookup queries them in the returned order. See
+// AddressQualityDialRanker for a ranker preferring previously reachable peers
+// and public QUIC addresses, and LatencyDialRanker for one preferring the peers
+// with the lowest RTT in the host's peerstore.
+//
+// By default, peers are queried closest first.
+func DialRanker(ranker DialRankFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.DialRanker = ranker
+		return nil
+	}
+}
+
+// RankPeers configures the function ordering the candidate peers at every step
+// of the lookups, given their distance to the target, RTT, connectedness and
+// dial backoff, in place of the closest-first order. It supersedes the
+// DialRanker and the ConnectionPreference, letting applications implement
+// latency-optimized routing or plug in a peer reputation system. The ranker can
+// be replaced at runtime with SetPeerRanker.
+//
+// Ranking far peers first slows the lookups down, as they converge on the
+// target with fewer bits per hop.
+func RankPeers(r PeerRanker) Option {
+	return func(c *dhtcfg.Config) error {
+		c.PeerRanker = r
+		return nil
+	}
+}
+
+// GeoLocation configures a resolver locating the IP addresses of the routing
+// table peers, to break the routing table down by region and autonomous
+// system in RoutingTableInfo. The peers are located in the background as they
+// are added, by their first public address, and their locations are cached.
+//
+// By default, the routing table peers aren't located.
+func GeoLocation(resolve GeoResolver) Option {
+	return func(c *dhtcfg.Config) error {
+		c.GeoResolver = resolve
+		return nil
+	}
+}
+
+// ProviderFilter configures a function applied to the providers found by
+// FindProviders and FindProvidersAsync before they are yielded. It is given
+// each batch of providers as it is found (the ones held locally, then the ones
+// returned by each queried peer) and may drop, rewrite or reorder them; the
+// dropped providers don't count towards the requested number of providers.
+// See PublicProviders for a filter dropping the providers without a public
+// address, and WithProviderFilter to filter the results of a single call.
+func ProviderFilter(f ProviderFilterFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProviderFilter = f
+		return nil
+	}
+}
+
 // RoutingTableFilter sets a function that approves which peers may be added to the routing table. The host should
 // already have at least one connection to the peer under consideration.
 func RoutingTableFilter(filter RouteTableFilterFunc) Option {
@@ -295,6 +960,22 @@ func BootstrapPeersFunc(getBootstrapPeers func() []peer.AddrInfo) Option {
 	}
 }
 
+// RememberPeers configures the DHT to persist up to size routing table peers
+// that have been in the routing table for at least minAge in its datastore.
+// On the next start, these peers are tried before the configured bootstrap
+// peers whenever the routing table is empty, reducing the dependency on
+// centralized bootstrap infrastructure. The peers that fail to connect then,
+// or that haven't been seen in the routing table for a week, are forgotten.
+//
+// Defaults to disabled (size 0).
+func RememberPeers(size int, minAge time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RememberedPeers.Size = size
+		c.RememberedPeers.MinAge = minAge
+		return nil
+	}
+}
+
 // RoutingTablePeerDiversityFilter configures the implementation of the `PeerIPGroupFilter` that will be used
 // to construct the diversity filter for the Routing Table.
 // Please see the docs for `peerdiversity.PeerIPGroupFilter` AND `peerdiversity.Filter` for more details.
@@ -362,6 +1043,26 @@ func AddressFilter(f func([]ma.Multiaddr) []ma.Multiaddr) Option {
 	}
 }
 
+// StreamPool configures the streams the DHT sends its requests over. Up to
+// maxPerPeer requests can be in flight to a peer at once, each over its own
+// stream. Streams unused for idleTimeout are closed, and idle streams are
+// checked with a PING every healthCheckInterval so that broken ones aren't
+// handed to a request. A zero idleTimeout keeps streams open until they fail,
+// and a zero healthCheckInterval disables the checks.
+//
+// It has no effect along with WithCustomMessageSender.
+//
+// Defaults to 4 streams per peer, closed after 45 seconds of inactivity, and
+// no health checks.
+func StreamPool(maxPerPeer int, idleTimeout, healthCheckInterval time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.StreamPool.MaxStreamsPerPeer = maxPerPeer
+		c.StreamPool.IdleTimeout = idleTimeout
+		c.StreamPool.HealthCheckInterval = healthCheckInterval
+		return nil
+	}
+}
+
 // WithCustomMessageSender configures the pb.MessageSender of the IpfsDHT to use the
 // custom implementation of the pb.MessageSender
 func WithCustomMessageSender(messageSenderBuilder func(h host.Host, protos []protocol.ID) pb.MessageSenderWithDisconnect) Option {
@@ -371,8 +1072,417 @@ func WithCustomMessageSender(messageSenderBuilder func(h host.Host, protos []pro
 	}
 }
 
+// SlowRequestThreshold makes the DHT log at the Warn level, with their key,
+// peer and duration, the inbound requests whose handler takes longer than d,
+// and count them in the slow_inbound_requests metric. This surfaces slow
+// datastores or provider stores without enabling debug logging.
+//
+// Disabled by default.
+func SlowRequestThreshold(d time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if d < 0 {
+			return fmt.Errorf("slow request threshold must be non-negative")
+		}
+		c.SlowRequestThreshold = d
+		return nil
+	}
+}
+
+// LatencyBuckets sets the bucket boundaries, in milliseconds, of the request
+// latency histograms, New failing if they can't be set. The histograms are
+// shared by all the DHTs of the process, so the DHTs setting their buckets
+// must agree on them, and be created before the first request: processes
+// setting up their DHTs later may call metrics.SetLatencyBuckets at startup
+// instead.
+func LatencyBuckets(bounds ...float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if len(bounds) == 0 {
+			return fmt.Errorf("no latency buckets")
+		}
+		if !sort.Float64sAreSorted(bounds) {
+			return fmt.Errorf("latency buckets must be sorted")
+		}
+		c.LatencyBuckets = append([]float64(nil), bounds...)
+		return nil
+	}
+}
+
+// Logger makes the DHT log through l instead of the package-wide "dht"
+// logger, which lets processes running several DHTs tell their logs apart,
+// for instance with l.With(zap.String("dht", "wan")). The provider manager,
+// the routing table refresh and the message sender of the DHT log through l
+// too, instead of their own package-wide loggers.
+func Logger(l *zap.Logger) Option {
+	return func(c *dhtcfg.Config) error {
+		if l == nil {
+			return fmt.Errorf("logger must not be nil")
+		}
+		c.Logger = l
+		return nil
+	}
+}
+
+// SlogHandler makes the DHT log through the log/slog handler h instead of
+// the package-wide "dht" logger. The handler decides which levels are
+// enabled.
+func SlogHandler(h slog.Handler) Option {
+	return func(c *dhtcfg.Config) error {
+		if h == nil {
+			return fmt.Errorf("slog handler must not be nil")
+		}
+		c.Logger = newSlogLogger(h)
+		return nil
+	}
+}
+
+// AdvertiseCapabilities adds caps to the optional protocol features the DHT
+// advertises in its responses. Applications implementing an extension on top
+// of the DHT protocol, with OnRequestHook or a custom message sender, use it
+// to let their peers discover it.
+//
+// Defaults to no capabilities.
+func AdvertiseCapabilities(caps pb.Capabilities) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Capabilities |= caps
+		return nil
+	}
+}
+
+// ProtocolShim translates the messages of a legacy protocol version to and
+// from the current one. Request converts the inbound requests before they are
+// handled and Response converts our responses before they are sent. A nil
+// function leaves the messages unchanged.
+type ProtocolShim = dhtcfg.ProtocolShim
+
+// ServeProtocol makes the DHT, in server mode, also answer requests received
+// over the protocol p, translating them with shim. Serving both an old (e.g.
+// forked) protocol and the current one lets a network upgrade roll out
+// without every node switching at once. The DHT still only queries peers over
+// its own protocol.
+func ServeProtocol(p protocol.ID, shim ProtocolShim) Option {
+	return func(c *dhtcfg.Config) error {
+		if c.ProtocolShims == nil {
+			c.ProtocolShims = make(map[protocol.ID]ProtocolShim)
+		}
+		c.ProtocolShims[p] = shim
+		return nil
+	}
+}
+
+// KeyspaceHash maps the keys and the peer IDs into the Kademlia keyspace with
+// hash instead of sha256, e.g. to use a faster hash or the identity for keys
+// that are already uniformly distributed hashes. The outputs of hash are
+// truncated or zero-padded to 32 bytes.
+//
+// Nodes using different hashes can't work together, so name is inserted in
+// the protocol ID (/<prefix>/<name>/kad/1.0.0) to keep them apart. The
+// routing table of the standard library hashes with sha256, so this option
+// also enables CompactRoutingTable.
+func KeyspaceHash(name string, hash func(data []byte) []byte) Option {
+	return func(c *dhtcfg.Config) error {
+		if hash == nil {
+			return fmt.Errorf("keyspace hash must not be nil")
+		}
+		c.KeyspaceHash.Name = name
+		c.KeyspaceHash.Hash = func(data []byte) []byte {
+			var out [sha256.Size]byte
+			copy(out[:], hash(data))
+			return out[:]
+		}
+		c.RoutingTable.Compact = true
+		return nil
+	}
+}
+
+// QueryWorkers bounds the number of goroutines sending the requests of the
+// lookups, follow-ups included. The workers are shared by all the lookups and
+// reused from one request to the next. A request occupies its worker while
+// the peer is dialed and until it answers, further requests waiting for a
+// worker while n of them are busy.
+//
+// The default value is 0, starting workers as needed.
+func QueryWorkers(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("query workers must be non-negative, got %d", n)
+		}
+		c.QueryWorkers = n
+		return nil
+	}
+}
+
+// InboundHandlerBudget bounds the number of inbound requests handled
+// concurrently to max, so that a server flooded with requests degrades
+// predictably rather than piling up goroutines. A request over the bound
+// waits up to queueTimeout for another one to complete, at most max requests
+// waiting at once; otherwise the request is shed by resetting its stream.
+// Shed requests are counted in the shed_inbound_requests metric.
+//
+// The default value is 0, meaning unbounded.
+func InboundHandlerBudget(max int, queueTimeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if max < 0 || queueTimeout < 0 {
+			return fmt.Errorf("inbound handler budget must be non-negative")
+		}
+		c.InboundHandlers.Max = max
+		c.InboundHandlers.QueueTimeout = queueTimeout
+		return nil
+	}
+}
+
+// ProviderWriteBehind makes the default provider store keep the provider
+// records it receives in memory and write them to the datastore in batches
+// every interval, taking the datastore writes out of the handling of
+// ADD_PROVIDER requests. If walPath is not empty, the records are also
+// appended to a log at that path, so that a crash loses none of them. See
+// providers.WriteBehind.
+//
+// It has no effect when a custom provider store is set. Disabled by default.
+func ProviderWriteBehind(interval time.Duration, walPath string) Option {
+	return func(c *dhtcfg.Config) error {
+		if interval < 0 {
+			return fmt.Errorf("provider write-behind interval must be non-negative")
+		}
+		c.ProviderWriteBehind.Interval = interval
+		c.ProviderWriteBehind.WALPath = walPath
+		return nil
+	}
+}
+
+// LookupMemoryBudget bounds the memory held by the lookups running
+// concurrently, estimated from the peers they learned about and their
+// requests in flight. Once the budget is used up, new lookups wait for
+// running ones to finish, or fail with ErrLookupMemoryExhausted if failFast
+// is set, so that a spike of routing calls can't make the process balloon.
+// A lookup that is admitted is never cut short, and one is always admitted
+// when no other lookup is running.
+//
+// The default value is 0, meaning unbounded.
+func LookupMemoryBudget(bytes int64, failFast bool) Option {
+	return func(c *dhtcfg.Config) error {
+		if bytes < 0 {
+			return fmt.Errorf("lookup memory budget must be non-negative, got %d", bytes)
+		}
+		c.LookupMemory.Budget = bytes
+		c.LookupMemory.FailFast = failFast
+		return nil
+	}
+}
+
+// CapabilityCacheTTL sets how long the optional protocol features a peer
+// advertised in a response are remembered. Once expired, they are unknown
+// until the peer answers another request, so extensions are not used with it
+// in the meantime. See PeerSupports.
+//
+// The default value is 1 hour.
+func CapabilityCacheTTL(ttl time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if ttl <= 0 {
+			return fmt.Errorf("capability cache TTL must be positive, got %s", ttl)
+		}
+		c.CapabilityCacheTTL = ttl
+		return nil
+	}
+}
+
+// ShardBits partitions the keyspace into 2^n shards, a key or a peer
+// belonging to the shard given by the first n bits of its keyspace position.
+// See WithinShard and GetClosestPeersInShard.
+//
+// Default: 0, the whole keyspace being a single shard
+func ShardBits(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ShardBits = n
+		return nil
+	}
+}
+
+// OnDialFailure registers a callback invoked for every failed dial of a peer
+// by a lookup, with the addresses known for the peer and the error of each
+// address dialed. Peers missing from lookup results are most often peers that
+// couldn't be dialed: the callback makes these failures visible. The context
+// is the one of the lookup, carrying its request ID and query label. Dials
+// skipped because of the dial backoff or the ConnectedPeersOnly connection
+// preference aren't reported.
+// Note: the callback runs on the lookup worker dialing the peer, so it must
+// return quickly.
+func OnDialFailure(f DialFailureHook) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnDialFailure = f
+		return nil
+	}
+}
+
+// OnOutboundRequest registers a hook invoked before every outbound RPC, with
+// the target peer and the message about to be sent: the hook may mutate the
+// message, delay the RPC by blocking (until ctx is done at the latest), or
+// veto it by returning an error. A vetoed RPC fails with an error matching
+// both ErrSendVetoed and the hook's error, and lookups don't hold it against
+// the peer. It is the outbound counterpart of OnRequestHook, for traffic
+// shaping experiments and policy enforcement.
+// Note: the hook runs on the goroutine sending the RPC, for every RPC of the
+// lookups, refreshes and probes.
+func OnOutboundRequest(f OutboundHook) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnOutbound = f
+		return nil
+	}
+}
+
+// OnRequestExtension registers a hook invoked by servers for every request
+// they respond to, after its handler, returning the data to piggyback on the
+// response in its extension field, nil for none. The extension of the request,
+// set by the sender with OnOutboundRequest, is in req.Extension. Extensions
+// larger than 4KiB are dropped, the field being meant for small application
+// data; servers not setting the hook ignore it.
+// Note: the hook runs on the goroutine handling the stream of the peer.
+func OnRequestExtension(f RequestExtensionHook) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnRequestExtension = f
+		return nil
+	}
+}
+
+// OnResponseExtension registers a hook invoked for every response carrying
+// extension data, set by the server with OnRequestExtension.
+// Note: the hook runs on the goroutine sending the RPC.
+func OnResponseExtension(f ResponseExtensionHook) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnResponseExtension = f
+		return nil
+	}
+}
+
+// SignStorageRequests makes the DHT sign its storage requests (PUT_VALUE and
+// ADD_PROVIDER) with the private key of the host, for the servers requiring
+// them to be signed. See RequireSignedStorageRequests.
+func SignStorageRequests() Option {
+	return func(c *dhtcfg.Config) error {
+		c.RequestSigning.Sign = true
+		return nil
+	}
+}
+
+// RequireSignedStorageRequests makes a server reject the storage requests
+// (PUT_VALUE and ADD_PROVIDER) not signed by the key of the peer sending them.
+// The stream being authenticated already, the signature brings
+// non-repudiation: every accepted request is passed to audit (if not nil) as
+// marshaled by its sender, and can be verified by a third party later with
+// pb.VerifyMessage and the public key of the sender, attributing the stored
+// records to an authenticated origin.
+//
+// The signatures cover the whole message: requests translated from another
+// protocol version, or carrying fields this version doesn't know, are
+// rejected.
+func RequireSignedStorageRequests(audit func(ctx context.Context, req SignedRequest)) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RequestSigning.Require = true
+		c.RequestSigning.Audit = audit
+		return nil
+	}
+}
+
+// PropagateBans blocks the connections of the peers banned with BanPeer with
+// b, typically the connection gater of the host, and unblocks them with
+// UnbanPeer, so that the DHT and connection-level policies stay consistent.
+// The banned peers are disconnected too.
+func PropagateBans(b PeerBlocker) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Bans.Propagate = b
+		return nil
+	}
+}
+
+// BansFromGater bans the peers g refuses to dial, typically the connection
+// gater of the host, on top of the ones banned with BanPeer. Its verdicts are
+// checked as peers are met, so they are never out of date.
+func BansFromGater(g connmgr.ConnectionGater) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Bans.Source = g
+		return nil
+	}
+}
+
+// GreylistPeers makes a server report the peers sending messages that fail to
+// unmarshal or violate the protocol (unknown message types, requests missing a
+// required signature...) to g, and reset the streams of the peers it
+// greylisted without reading them. See NewGreylist, which also keeps the
+// greylisted peers from reconnecting when installed as connection gater of the
+// host.
+func GreylistPeers(g PeerGreylist) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Greylist = g
+		return nil
+	}
+}
+
+// ProviderDenylist makes a server refuse to store the provider records of the
+// keys l denies, and to serve the ones it has: the GET_PROVIDERS requests of
+// these keys are answered with closer peers only. It lets the operators of
+// public servers comply with takedown requests, see ParseDenylist to load the
+// lists in the compact denylist format.
+//
+// l is called for every GET_PROVIDERS and ADD_PROVIDER request and must be
+// safe for concurrent use.
+func ProviderDenylist(l Denylist) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Denylist = l
+		return nil
+	}
+}
+
+// SpamKeyDetection makes a server flag the keys receiving more than threshold
+// ADD_PROVIDER records per window, from all peers, as flooded. The records of a
+// flagged key are then handled according to policy, until its rate drops below
+// half the threshold. report, if not nil, is called when a key is flagged and
+// when it is cleared, for operators to review the floods.
+//
+// The rates are estimated with a count-min sketch of fixed size, over a
+// window sliding with the time: they may be overestimated, but never
+// underestimated.
+func SpamKeyDetection(threshold int, window time.Duration, policy SpamKeyPolicy, report func(SpamKeyEvent)) Option {
+	return func(c *dhtcfg.Config) error {
+		if threshold <= 0 {
+			return fmt.Errorf("spam key threshold must be positive, got %d", threshold)
+		}
+		if window <= 0 {
+			return fmt.Errorf("spam key window must be positive, got %s", window)
+		}
+		c.SpamKeys.Threshold = threshold
+		c.SpamKeys.Window = window
+		c.SpamKeys.Policy = policy
+		c.SpamKeys.Report = report
+		return nil
+	}
+}
+
+// OriginQuota bounds what a single peer may store on this server: at most
+// records value records, providers provider records, and bytes of both (the
+// marshaled records and the keys of the provider records). Zero means
+// unlimited. When a peer exceeds its quota, its oldest entries are evicted,
+// and the record is rejected if larger than the whole byte quota on its own.
+//
+// The quotas are tracked in memory from the start of the DHT and are lost on
+// restart: the datastore doesn't record which peer stored a record, so the
+// records stored before don't count against any quota and are only dropped
+// once they expire. The records overwritten by a local put stop counting
+// against the quota of the peer that stored them.
+func OriginQuota(records, providers int, bytes int64) Option {
+	return func(c *dhtcfg.Config) error {
+		if records < 0 || providers < 0 || bytes < 0 {
+			return fmt.Errorf("origin quotas must not be negative")
+		}
+		c.OriginQuota.Records = records
+		c.OriginQuota.Providers = providers
+		c.OriginQuota.Bytes = bytes
+		return nil
+	}
+}
+
 // OnRequestHook registers a callback function that will be invoked for every
-// incoming DHT protocol message.
+// incoming DHT protocol message. The context carries the request ID the
+// message is logged with, see RequestID. req is a copy of the message, which
+// the callback may keep.
 // Note: Ensure that the callback executes efficiently, as it will block the
 // entire message handler.
 func OnRequestHook(f func(ctx context.Context, s network.Stream, req *pb.Message)) Option {
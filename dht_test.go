@@ -3,6 +3,7 @@ package dht
 import (
 	"bytes"
 	"context"
+	"crypto/sha512"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,9 +12,11 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-kad-dht/crawler"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
@@ -337,6 +340,116 @@ func TestValueGetSet(t *testing.T) {
 	}
 }
 
+func TestPutValueReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+
+	stored := func(key string) int {
+		n := 0
+		for _, d := range dhts[1:] {
+			if rec, err := d.getLocal(ctx, key); err == nil && rec != nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	require.NoError(t, dhts[0].PutValue(ctx, "/v/a", []byte("a"), Replication(1)))
+	require.Equal(t, 1, stored("/v/a"))
+
+	require.NoError(t, dhts[0].PutValue(WithReplication(ctx, 2), "/v/b", []byte("b")))
+	require.Equal(t, 2, stored("/v/b"))
+
+	require.NoError(t, dhts[0].PutValue(ctx, "/v/c", []byte("c")))
+	require.Equal(t, 3, stored("/v/c"))
+}
+
+func TestKeyspaceGapReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the keys starting with a 0 bit are in a gap
+	gaps := crawler.Gaps{{Prefix: make(kb.ID, 32), Bits: 1}}
+	d := setupDHT(ctx, t, false, KeyspaceGapReplication(func() crawler.Gaps { return gaps }, 5))
+	require.Equal(t, 5, d.Config().KeyspaceGapReplication)
+
+	var inGap, outOfGap int
+	for _, c := range testCaseCids {
+		mh := c.Hash()
+		n := d.provideReplication(ctx, mh)
+		if d.kadKey(string(mh))[0]&0x80 == 0 {
+			require.Equal(t, d.bucketSize+5, n)
+			inGap++
+		} else {
+			require.Equal(t, d.bucketSize, n)
+			outOfGap++
+		}
+	}
+	require.Positive(t, inGap)
+	require.Positive(t, outOfGap)
+
+	_, err := New(ctx, d.host, KeyspaceGapReplication(func() crawler.Gaps { return gaps }, 0))
+	require.Error(t, err)
+}
+
+func TestDynamicQuorum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+	require.NoError(t, dhts[1].PutValue(ctx, "/v/hello", []byte("world")))
+
+	var sizes []int
+	val, err := dhts[0].GetValue(ctx, "/v/hello", DynamicQuorum(func(networkSize int) int {
+		sizes = append(sizes, networkSize)
+		return 1
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "world", string(val))
+	// there is no network size estimate in such a small network
+	require.Equal(t, []int{0}, sizes)
+}
+
+func TestImprovementTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var stalled atomic.Value // peer.ID
+	d := setupDHT(ctx, t, false, OnOutboundRequest(func(ctx context.Context, p peer.ID, msg *pb.Message) error {
+		if p == stalled.Load() && msg.GetType() == pb.Message_GET_VALUE {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}))
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, d, a)
+	connect(t, ctx, d, b)
+	stalled.Store(b.self)
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = internal.FormatRFC3339(time.Now())
+	require.NoError(t, a.putLocal(ctx, "/v/hello", rec))
+
+	// b never responds, the lookup stops once a's record got no better
+	tctx, tcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer tcancel()
+	val, err := d.GetValue(tctx, "/v/hello", ImprovementTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, "world", string(val))
+
+	_, err = d.GetValue(ctx, "/v/hello", ImprovementTimeout(-time.Second))
+	require.Error(t, err)
+}
+
 func TestValueSetInvalid(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -473,6 +586,138 @@ func TestSearchValue(t *testing.T) {
 	}
 }
 
+func TestRecordConflictResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var candidates []RecordCandidate
+	d := setupDHT(ctx, t, false, RecordConflictResolver(
+		func(key string, cands []RecordCandidate, best []byte, closest []peer.ID) ConflictResolution {
+			candidates = cands
+			// prefer the value the validator considers older, and don't correct anyone
+			return ConflictResolution{Value: []byte("valid"), Correct: []peer.ID{}}
+		}))
+	dhtA := setupDHT(ctx, t, false)
+	dhtB := setupDHT(ctx, t, false)
+	for _, dht := range []*IpfsDHT{d, dhtA, dhtB} {
+		dht.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	}
+	connect(t, ctx, d, dhtA)
+	connect(t, ctx, d, dhtB)
+
+	for dht, val := range map[*IpfsDHT]string{dhtA: "valid", dhtB: "newer"} {
+		rec := record.MakePutRecord("/v/hello", []byte(val))
+		rec.TimeReceived = internal.FormatRFC3339(time.Now())
+		require.NoError(t, dht.putLocal(ctx, "/v/hello", rec))
+	}
+
+	val, err := d.GetValue(ctx, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, "valid", string(val))
+	require.Len(t, candidates, 2)
+
+	// no correction was sent
+	time.Sleep(100 * time.Millisecond)
+	rec, err := dhtB.getLocal(ctx, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, "newer", string(rec.GetValue()))
+}
+
+func TestValueCorrectionLimits(t *testing.T) {
+	peers := []peer.ID{"a", "b", "c", "d"}
+
+	d := &IpfsDHT{}
+	require.Equal(t, peers, d.correctionTargets(peers))
+
+	d.correction.maxPeers = 2
+	require.Equal(t, peers[:2], d.correctionTargets(peers))
+
+	d.correction.maxPeers = 0
+	d.correction.limiter = newCorrectionLimiter(3)
+	require.Equal(t, peers[:3], d.correctionTargets(peers))
+	require.Empty(t, d.correctionTargets(peers))
+
+	// a correction every other second
+	d.correction.limiter = newCorrectionLimiter(0.5)
+	require.Equal(t, peers[:1], d.correctionTargets(peers))
+	require.Empty(t, d.correctionTargets(peers))
+	d.correction.limiter.last = d.correction.limiter.last.Add(-2 * time.Second)
+	require.Equal(t, peers[:1], d.correctionTargets(peers))
+
+	d.correction.disabled = true
+	require.Empty(t, d.correctionTargets(peers))
+}
+
+func TestOfflineRouting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false)
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	require.NoError(t, d2.PutValue(ctx, "/v/remote", []byte("remote")))
+	require.NoError(t, d2.Provide(ctx, testCaseCids[0], true))
+	require.NoError(t, d1.PutValue(ctx, "/v/local", []byte("local")))
+
+	offline := WithOffline(ctx)
+
+	val, err := d1.GetValue(offline, "/v/local")
+	require.NoError(t, err)
+	require.Equal(t, "local", string(val))
+
+	// d1 only holds the values and provider records it was sent
+	require.NoError(t, d1.datastore.Delete(ctx, mkDsKey("/v/remote")))
+	_, err = d1.GetValue(ctx, "/v/remote", routing.Offline)
+	require.ErrorIs(t, err, routing.ErrNotFound)
+
+	d3 := setupDHT(ctx, t, false)
+	connect(t, ctx, d3, d1)
+	provs, err := d3.FindProviders(offline, testCaseCids[0])
+	require.NoError(t, err)
+	require.Empty(t, provs)
+
+	_, err = d3.FindPeer(offline, d2.self)
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	pi, err := d3.FindPeer(offline, d1.self)
+	require.NoError(t, err)
+	require.Equal(t, d1.self, pi.ID)
+}
+
+func TestClientCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, true, ClientCache(16, time.Minute))
+	server := setupDHT(ctx, t, false)
+	connectNoSync(t, ctx, client, server)
+	wait(t, ctx, client, server)
+
+	rec := record.MakePutRecord("/v/cached", []byte("cached"))
+	rec.TimeReceived = internal.FormatRFC3339(time.Now())
+	require.NoError(t, server.putLocal(ctx, "/v/cached", rec))
+	require.NoError(t, server.ProviderStore().AddProvider(ctx, testCaseCids[0].Hash(), peer.AddrInfo{ID: server.self}))
+
+	val, err := client.GetValue(ctx, "/v/cached")
+	require.NoError(t, err)
+	require.Equal(t, "cached", string(val))
+	provs, err := client.FindProviders(ctx, testCaseCids[0])
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+
+	// the network is gone, the cache answers
+	require.NoError(t, client.host.Network().ClosePeer(server.self))
+	client.routingTable.RemovePeer(server.self)
+
+	val, err = client.GetValue(ctx, "/v/cached")
+	require.NoError(t, err)
+	require.Equal(t, "cached", string(val))
+	provs, err = client.FindProviders(ctx, testCaseCids[0])
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, server.self, provs[0].ID)
+}
+
 func TestValueGetInvalid(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -573,6 +818,146 @@ func TestProvides(t *testing.T) {
 	}
 }
 
+func TestProviderSearch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+
+	c := testCaseCids[0]
+	require.NoError(t, dhts[2].Provide(ctx, c, true))
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+	searchCtx, search := WithProviderSearch(ctxT)
+	callerCtx, cancelCaller := context.WithCancel(searchCtx)
+	first, ok := <-dhts[0].FindProvidersAsync(callerCtx, c, 0)
+	cancelCaller()
+	require.True(t, ok)
+	require.Equal(t, dhts[2].self, first.ID)
+
+	provs, err := search.Wait(ctxT)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, dhts[2].self, provs[0].ID)
+}
+
+func TestProvideProgress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	var events []ProvideProgress
+	pctx := WithProvideProgress(ctx, func(p ProvideProgress) {
+		events = append(events, p)
+	})
+	require.NoError(t, dhts[0].Provide(pctx, testCaseCids[0], true))
+
+	require.Len(t, events, 4)
+	require.Equal(t, ProvideLookupDone, events[0].Phase)
+	require.Equal(t, 2, events[0].Total)
+	require.Equal(t, ProvidePutDone, events[1].Phase)
+	require.Equal(t, ProvidePutDone, events[2].Phase)
+	last := events[3]
+	require.Equal(t, ProvideDone, last.Phase)
+	require.NoError(t, last.Err)
+	require.Equal(t, 2, last.Succeeded)
+	require.Equal(t, 0, last.Failed)
+}
+
+func TestScheduleProvide(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false, ProvideSchedulerLimits(1, 0))
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	// duplicate keys are coalesced
+	require.NoError(t, d1.ScheduleProvide(testCaseCids[0], testCaseCids[1], testCaseCids[0]))
+	require.LessOrEqual(t, d1.ScheduledProvides(), 2)
+
+	require.Eventually(t, func() bool {
+		for _, c := range testCaseCids[:2] {
+			provs, err := d2.providerStore.GetProviders(ctx, c.Hash())
+			if err != nil || len(provs) != 1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, d1.ScheduledProvides())
+}
+
+func TestScheduleProvideQueueFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, ProvideSchedulerLimits(1, 0.001))
+	d.provideScheduler.mu.Lock()
+	d.provideScheduler.maxQueued = 2
+	d.provideScheduler.mu.Unlock()
+
+	// the keys are refused all together
+	require.ErrorIs(t, d.ScheduleProvide(testCaseCids[:3]...), ErrProvideQueueFull)
+	require.Zero(t, d.ScheduledProvides())
+	require.NoError(t, d.ScheduleProvide(testCaseCids[:2]...))
+}
+
+func TestProvideBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false, ProvideSchedulerLimits(1, 0), ProvideBudget(1, time.Hour))
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	require.NoError(t, d1.ScheduleProvide(testCaseCids[:2]...))
+
+	// the first provide uses up the budget, the second waits for the next
+	// interval
+	require.Eventually(t, func() bool {
+		provs, err := d2.providerStore.GetProviders(ctx, testCaseCids[0].Hash())
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	provs, err := d2.providerStore.GetProviders(ctx, testCaseCids[1].Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs)
+
+	st := d1.ProvideSchedulerStats()
+	require.Equal(t, 1, st.Queued)
+	require.Equal(t, 1, st.Budget)
+	require.Equal(t, time.Hour, st.BudgetInterval)
+	require.GreaterOrEqual(t, st.BudgetUsed, int64(1))
+	require.Equal(t, st.BudgetUsed, st.RPCs)
+	require.Positive(t, st.Bytes)
+
+	for _, opt := range []Option{ProvideBudget(-1, time.Hour), ProvideBudget(1, 0)} {
+		_, err := New(ctx, d1.host, opt)
+		require.Error(t, err)
+	}
+}
+
 type testMessageSender struct {
 	sendRequest func(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error)
 	sendMessage func(ctx context.Context, p peer.ID, pmes *pb.Message) error
@@ -1333,6 +1718,30 @@ func TestFindPeerWithQueryFilter(t *testing.T) {
 	require.Equal(t, filteredPeer.ID(), p.ID, "Didnt find expected peer.")
 }
 
+func TestFindPeerNegativeCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false)
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	// a peer that isn't connected to the network
+	missing := setupDHT(ctx, t, false).self
+	cctx := WithNegativeCacheTTL(ctx, time.Minute)
+	_, err := d1.FindPeer(cctx, missing)
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	require.True(t, d1.negativeCache.has(ctx, negativeCachePeerKey(string(missing))))
+	require.False(t, d1.negativeCache.has(WithoutNegativeCache(ctx), negativeCachePeerKey(string(missing))))
+
+	// the cached miss is returned without a lookup
+	d1.routingTable.RemovePeer(d2.self)
+	_, err = d1.FindPeer(ctx, missing)
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	_, err = d1.FindPeer(WithoutNegativeCache(ctx), missing)
+	require.ErrorIs(t, err, kb.ErrLookupFailure)
+}
+
 func TestConnectCollision(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -1568,6 +1977,87 @@ func TestInvalidServer(t *testing.T) {
 	}
 }
 
+func TestObserverMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	obs := setupDHT(ctx, t, false, Mode(ModeObserver))
+	// a only knows b through obs
+	connect(t, ctx, a, obs)
+	connect(t, ctx, obs, b)
+
+	require.Eventually(t, func() bool { return a.IsObserver(obs.self) }, 5*time.Second, 10*time.Millisecond)
+	require.False(t, obs.IsObserver(a.self))
+	// observers are kept in the routing tables
+	require.Equal(t, obs.self, a.routingTable.Find(obs.self))
+
+	// observers answer routing queries
+	closer, err := a.protoMessenger.GetClosestPeers(ctx, obs.self, b.self)
+	require.NoError(t, err)
+	require.NotEmpty(t, closer)
+
+	// but refuse to store records
+	rec := record.MakePutRecord("/v/observed", []byte("value"))
+	require.Error(t, a.protoMessenger.PutValue(ctx, obs.self, rec))
+	stored, err := obs.getLocal(ctx, "/v/observed")
+	require.NoError(t, err)
+	require.Nil(t, stored)
+
+	// lookups go through them
+	peers, err := a.GetClosestPeers(ctx, "/v/observed")
+	require.NoError(t, err)
+	require.Contains(t, peers, b.self)
+	require.Contains(t, peers, obs.self)
+
+	// but they are not picked to store records
+	require.NoError(t, a.PutValue(ctx, "/v/observed", []byte("value")))
+	stored, err = b.getLocal(ctx, "/v/observed")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	stored, err = obs.getLocal(ctx, "/v/observed")
+	require.NoError(t, err)
+	require.Nil(t, stored)
+}
+
+func TestProxyClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, true)
+	stranger := setupDHT(ctx, t, true)
+	proxy := setupDHT(ctx, t, false, ProxyFor(client.self))
+	servers := setupDHTS(t, ctx, 3)
+	for _, d := range servers {
+		connect(t, ctx, proxy, d)
+	}
+	connectNoSync(t, ctx, client, proxy)
+	connectNoSync(t, ctx, stranger, proxy)
+
+	require.NoError(t, servers[0].PutValue(ctx, "/v/proxied", []byte("proxied")))
+	require.NoError(t, servers[1].Provide(ctx, testCaseCids[0], true))
+
+	pc := NewProxyClient(client.host, proxy.self, "/test")
+	val, err := pc.GetValue(ctx, "/v/proxied")
+	require.NoError(t, err)
+	require.Equal(t, "proxied", string(val))
+
+	var provs []peer.ID
+	for p := range pc.FindProvidersAsync(ctx, testCaseCids[0], 1) {
+		provs = append(provs, p.ID)
+	}
+	require.Equal(t, []peer.ID{servers[1].self}, provs)
+
+	closest, err := pc.GetClosestPeers(ctx, string(servers[2].self))
+	require.NoError(t, err)
+	require.NotEmpty(t, closest)
+
+	// only the designated clients are served
+	_, err = NewProxyClient(stranger.host, proxy.self, "/test").GetValue(ctx, "/v/proxied")
+	require.ErrorIs(t, err, routing.ErrNotFound)
+}
+
 func TestClientModeFindPeer(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -1989,6 +2479,26 @@ func TestClientModeAtInit(t *testing.T) {
 	assert.True(t, errors.Is(err, multistream.ErrNotSupported[protocol.ID]{}))
 }
 
+func TestIgnoredClientModeMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, true)
+	p := peer.ID("sender")
+
+	// the first message is logged right away, the next ones are counted
+	// until the next log
+	client.ignoreClientModeMessage(p)
+	require.Equal(t, int64(0), client.ignoredMessages.Load())
+	client.ignoreClientModeMessage(p)
+	client.ignoreClientModeMessage(p)
+	require.Equal(t, int64(2), client.ignoredMessages.Load())
+
+	client.lastIgnoredLog.Store(time.Now().Add(-ignoredMessagesLogInterval).UnixNano())
+	client.ignoreClientModeMessage(p)
+	require.Equal(t, int64(0), client.ignoredMessages.Load())
+}
+
 func TestModeChange(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -2465,3 +2975,244 @@ func TestAddrFilter(t *testing.T) {
 	}
 	require.Equal(t, len(publicAddrs)+len(privAddrs), len(d3.host.Peerstore().Addrs(peerid)))
 }
+
+func TestConfigValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer h.Close()
+
+	_, err = New(ctx, h, testPrefix,
+		BucketSize(4),
+		Resiliency(5),
+		Concurrency(0),
+		RoutingTableRefreshPeriod(0),
+	)
+	var cerr *ConfigError
+	require.ErrorAs(t, err, &cerr)
+	require.Len(t, cerr.Violations, 3)
+	require.Contains(t, err.Error(), "resiliency (5) must not exceed the bucket size (4)")
+	require.Contains(t, err.Error(), "concurrency must be positive")
+	require.Contains(t, err.Error(), "refresh interval must be positive")
+
+	_, err = New(ctx, h, BucketSize(4), DisableValues())
+	require.ErrorAs(t, err, &cerr)
+	require.Len(t, cerr.Violations, 2)
+
+	// the default resiliency is lowered to a smaller bucket size
+	d, err := New(ctx, h, testPrefix, BucketSize(2))
+	require.NoError(t, err)
+	defer d.Close()
+	require.Equal(t, 2, d.Config().Resiliency)
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, AdvertiseCapabilities(pb.CapPaging|pb.CapRecordTTL))
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+
+	require.NoError(t, b.Ping(ctx, a.self))
+
+	caps := b.PeerCapabilities(a.self)
+	require.True(t, caps.Has(pb.CapPaging|pb.CapRecordTTL))
+	require.False(t, caps.Has(pb.CapCompression))
+
+	require.NoError(t, a.Ping(ctx, b.self))
+	require.Zero(t, a.PeerCapabilities(b.self))
+}
+
+func TestPeerSupports(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, AdvertiseCapabilities(pb.CapPaging))
+	b := setupDHT(ctx, t, false, CapabilityCacheTTL(time.Minute))
+	require.False(t, b.PeerSupports(a.self, pb.CapPaging))
+	connect(t, ctx, a, b)
+
+	require.NoError(t, b.Ping(ctx, a.self))
+	require.True(t, b.PeerSupports(a.self, pb.CapPaging))
+	require.False(t, b.PeerSupports(a.self, pb.CapPaging|pb.CapCompression))
+}
+
+func TestCapabilityCacheExpiry(t *testing.T) {
+	c := newCapabilityCache(time.Millisecond)
+	c.set(peer.ID("peer"), pb.CapPaging)
+	caps, ok := c.get(peer.ID("peer"))
+	require.True(t, ok)
+	require.Equal(t, pb.CapPaging, caps)
+
+	time.Sleep(5 * time.Millisecond)
+	_, ok = c.get(peer.ID("peer"))
+	require.False(t, ok)
+
+	// expired entries are swept once the cache grows
+	for i := 0; i < minCapabilitySweep; i++ {
+		c.set(peer.ID(fmt.Sprint(i)), pb.CapPaging)
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.set(peer.ID("last"), pb.CapPaging)
+	require.Len(t, c.peers, 1)
+}
+
+func TestServeProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const legacy = protocol.ID("/legacy/kad/1.0.0")
+	var translated atomic.Int32
+	shim := ProtocolShim{
+		// legacy peers address values as /old/<name>
+		Request: func(req *pb.Message) (*pb.Message, error) {
+			req.Key = bytes.Replace(req.Key, []byte("/old/"), []byte("/v/"), 1)
+			return req, nil
+		},
+		Response: func(resp *pb.Message) (*pb.Message, error) {
+			translated.Add(1)
+			if rec := resp.GetRecord(); rec != nil {
+				rec.Key = bytes.Replace(rec.Key, []byte("/v/"), []byte("/old/"), 1)
+			}
+			return resp, nil
+		},
+	}
+
+	server := setupDHT(ctx, t, false, ServeProtocol(legacy, shim))
+	client := setupDHT(ctx, t, true, V1ProtocolOverride(legacy))
+	require.Contains(t, server.Config().ServerProtocols, legacy)
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = internal.FormatRFC3339(time.Now())
+	require.NoError(t, server.putLocal(ctx, "/v/hello", rec))
+
+	require.NoError(t, client.host.Connect(ctx, peer.AddrInfo{ID: server.self, Addrs: server.host.Addrs()}))
+	got, _, err := client.protoMessenger.GetValue(ctx, server.self, "/old/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), got.GetValue())
+	require.NotZero(t, translated.Load())
+}
+
+func TestKeyspaceHash(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hash := KeyspaceHash("sha512-256", func(data []byte) []byte {
+		h := sha512.Sum512_256(data)
+		return h[:]
+	})
+	dhts := setupDHTS(t, ctx, 5, hash)
+	for _, d := range dhts {
+		require.Equal(t, protocol.ID("/test/sha512-256/kad/1.0.0"), d.protocols[0])
+		require.True(t, d.Config().RoutingTable.Compact)
+	}
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	require.NoError(t, dhts[1].PutValue(ctx, "/v/hello", []byte("world")))
+	val, err := dhts[4].GetValue(ctx, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+
+	sum := sha512.Sum512_256([]byte(dhts[0].self))
+	require.Equal(t, sum[:], dhts[0].PeerKey())
+
+	// lookup events are in the keyspace of the hash too
+	lctx, lcancel := context.WithCancel(ctx)
+	lctx, events := RegisterForLookupEvents(lctx)
+	_, err = dhts[0].GetClosestPeers(lctx, "foo")
+	require.NoError(t, err)
+	lcancel()
+	keySum := sha512.Sum512_256([]byte("foo"))
+	var n int
+	for ev := range events {
+		require.Equal(t, kb.ID(keySum[:]), ev.Key.Kad)
+		require.Equal(t, kb.ID(sum[:]), ev.Node.Kad)
+		n++
+	}
+	require.NotZero(t, n)
+}
+
+func TestGetClosestPeersToKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 8)
+	for i := range dhts {
+		for j := i + 1; j < len(dhts); j++ {
+			// dhts[0] has to discover dhts[5] through the lookup
+			if i != 0 || j != 5 {
+				connect(t, ctx, dhts[i], dhts[j])
+			}
+		}
+	}
+
+	var kadID [32]byte
+	copy(kadID[:], dhts[5].PeerKey())
+	kadID[31] ^= 1
+
+	peers, err := dhts[0].GetClosestPeersToKey(ctx, kadID)
+	require.NoError(t, err)
+	require.NotEmpty(t, peers)
+	require.Equal(t, dhts[5].self, peers[0])
+}
+
+func TestPeerProtocolsUpdated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+	require.Equal(t, b.self, a.routingTable.Find(b.self))
+
+	em, err := a.host.EventBus().Emitter(new(event.EvtPeerProtocolsUpdated))
+	require.NoError(t, err)
+	defer em.Close()
+
+	// b stops speaking the DHT protocol
+	require.NoError(t, a.peerstore.RemoveProtocols(b.self, a.protocols...))
+	require.NoError(t, em.Emit(event.EvtPeerProtocolsUpdated{Peer: b.self, Removed: a.protocols}))
+	require.Eventually(t, func() bool { return a.routingTable.Find(b.self) == "" }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, a.stoppedDHT(b.self))
+
+	// and starts again
+	require.NoError(t, a.peerstore.AddProtocols(b.self, a.protocols...))
+	require.NoError(t, em.Emit(event.EvtPeerProtocolsUpdated{Peer: b.self, Added: a.protocols}))
+	require.Eventually(t, func() bool { return a.routingTable.Find(b.self) == b.self }, 5*time.Second, 10*time.Millisecond)
+	require.False(t, a.stoppedDHT(b.self))
+}
+
+func TestLookupCheckPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// b advertises the DHT protocol but never answers
+	mute := func(t *testing.T) *IpfsDHT {
+		b := setupDHT(ctx, t, false)
+		for _, proto := range b.serverProtocols {
+			b.host.SetStreamHandler(proto, func(s network.Stream) { s.Reset() })
+		}
+		return b
+	}
+
+	t.Run("checked", func(t *testing.T) {
+		a := setupDHT(ctx, t, false, LookupCheckTimeout(time.Second))
+		require.Equal(t, time.Second, a.lookupCheckTimeout)
+		b := mute(t)
+		connectNoSync(t, ctx, a, b)
+		time.Sleep(200 * time.Millisecond)
+		require.Empty(t, a.routingTable.Find(b.self))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		a := setupDHT(ctx, t, false, DisableLookupCheck())
+		b := mute(t)
+		connectNoSync(t, ctx, a, b)
+		require.Eventually(t, func() bool { return a.routingTable.Find(b.self) == b.self }, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// errDialBackoff is returned when a query skips dialing a peer that recently
+// failed to dial.
+var errDialBackoff = errors.New("peer is in dial backoff")
+
+// errNoNewDials is returned when a query would need to dial a peer while
+// configured with ConnectedPeersOnly.
+var errNoNewDials = errors.New("not dialing new peers")
+
+// maxDialBackoffEntries bounds the size of the dial backoff cache, expired
+// entries are pruned once it is reached.
+const maxDialBackoffEntries = 4096
+
+// DialBackoffCache is a negative cache of the peers that recently failed to
+// dial. See the SharedDialBackoff option.
+type DialBackoffCache = dhtcfg.DialBackoffCache
+
+// defaultDialBackoff is the dial backoff cache shared by all the DHTs of the
+// process backing off peers for the default durations, so that a peer failing
+// to dial for one of them isn't dialed again by the others either.
+var defaultDialBackoff = newDialBackoff(dhtcfg.DefaultDialBackoffBase, dhtcfg.DefaultDialBackoffMax)
+
+// dialBackoff is a DialBackoffCache in which every consecutive failure doubles
+// the time during which the peer is not dialed again, up to max.
+type dialBackoff struct {
+	base, max time.Duration
+
+	mu      sync.Mutex
+	entries map[peer.ID]*dialBackoffEntry
+}
+
+var _ DialBackoffCache = (*dialBackoff)(nil)
+
+type dialBackoffEntry struct {
+	tries int
+	until time.Time
+}
+
+func newDialBackoff(base, max time.Duration) *dialBackoff {
+	if max < base {
+		max = base
+	}
+	return &dialBackoff{
+		base:    base,
+		max:     max,
+		entries: make(map[peer.ID]*dialBackoffEntry),
+	}
+}
+
+// NewDialBackoffCache returns a cache backing off peers that fail to dial as
+// described by the DialBackoff option, to be shared by several DHTs with the
+// SharedDialBackoff option.
+func NewDialBackoffCache(base, max time.Duration) (DialBackoffCache, error) {
+	if base <= 0 || max < 0 {
+		return nil, fmt.Errorf("dial backoff base must be positive and max non-negative")
+	}
+	return newDialBackoff(base, max), nil
+}
+
+// dialBackoffFor returns the dial backoff cache of cfg, nil if the backoff is
+// disabled.
+func dialBackoffFor(cfg dhtcfg.Config) DialBackoffCache {
+	switch {
+	case cfg.DialBackoff.Shared != nil:
+		return cfg.DialBackoff.Shared
+	case cfg.DialBackoff.Base <= 0:
+		return nil
+	case cfg.DialBackoff.Base == defaultDialBackoff.base && cfg.DialBackoff.Max == defaultDialBackoff.max:
+		return defaultDialBackoff
+	default:
+		return newDialBackoff(cfg.DialBackoff.Base, cfg.DialBackoff.Max)
+	}
+}
+
+// DialBackoffCache returns the dial backoff cache of the DHT, nil if the
+// backoff is disabled.
+func (dht *IpfsDHT) DialBackoffCache() DialBackoffCache {
+	return dht.dialBackoff
+}
+
+// BackedOff reports whether dialing p should be skipped.
+func (b *dialBackoff) BackedOff(p peer.ID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[p]
+	return ok && time.Now().Before(e.until)
+}
+
+// DialFailed records a dial failure to p and extends its backoff.
+func (b *dialBackoff) DialFailed(p peer.ID) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[p]
+	// forget about failures that happened long ago
+	if ok && now.Sub(e.until) > b.max {
+		ok = false
+	}
+	if !ok {
+		if len(b.entries) >= maxDialBackoffEntries {
+			b.pruneLocked(now)
+		}
+		e = &dialBackoffEntry{}
+		b.entries[p] = e
+	}
+
+	e.tries++
+	d := b.base
+	for i := 1; i < e.tries && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	e.until = now.Add(d)
+}
+
+// DialSucceeded clears the backoff of p.
+func (b *dialBackoff) DialSucceeded(p peer.ID) {
+	b.mu.Lock()
+	delete(b.entries, p)
+	b.mu.Unlock()
+}
+
+func (b *dialBackoff) pruneLocked(now time.Time) {
+	for p, e := range b.entries {
+		if now.After(e.until) {
+			delete(b.entries, p)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialBackoff(t *testing.T) {
+	b := newDialBackoff(time.Minute, 3*time.Minute)
+	p := peer.ID("peer")
+	require.False(t, b.BackedOff(p))
+
+	b.DialFailed(p)
+	require.True(t, b.BackedOff(p))
+	require.WithinDuration(t, time.Now().Add(time.Minute), b.entries[p].until, time.Second)
+
+	b.DialFailed(p)
+	require.WithinDuration(t, time.Now().Add(2*time.Minute), b.entries[p].until, time.Second)
+
+	// capped at max
+	b.DialFailed(p)
+	require.WithinDuration(t, time.Now().Add(3*time.Minute), b.entries[p].until, time.Second)
+
+	b.DialSucceeded(p)
+	require.False(t, b.BackedOff(p))
+
+	_, err := NewDialBackoffCache(0, time.Minute)
+	require.Error(t, err)
+}
+
+func TestDefaultDialBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the DHTs backing off for the default durations share a cache
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	require.Same(t, defaultDialBackoff, a.DialBackoffCache())
+	require.Same(t, defaultDialBackoff, b.DialBackoffCache())
+
+	c := setupDHT(ctx, t, false, DisableAutoRefresh(), DialBackoff(time.Minute, time.Hour))
+	require.NotSame(t, defaultDialBackoff, c.DialBackoffCache())
+	d := setupDHT(ctx, t, false, DisableAutoRefresh(), DialBackoff(0, 0))
+	require.Nil(t, d.DialBackoffCache())
+
+	_, err := New(ctx, a.host, SharedDialBackoff(nil))
+	require.Error(t, err)
+}
+
+func TestSharedDialBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache, err := NewDialBackoffCache(time.Minute, time.Hour)
+	require.NoError(t, err)
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), SharedDialBackoff(cache))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh(), SharedDialBackoff(cache))
+	require.Equal(t, time.Minute, a.Config().DialBackoff.Base)
+
+	p := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/127.0.0.1/tcp/1")
+	a.peerstore.AddAddrs(p, []ma.Multiaddr{addr}, peerstore.TempAddrTTL)
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer dialCancel()
+	require.Error(t, a.dialPeer(dialCtx, p))
+	require.ErrorIs(t, a.dialPeer(dialCtx, p), errDialBackoff)
+	// the failure is known to the other DHT sharing the cache
+	require.ErrorIs(t, b.dialPeer(dialCtx, p), errDialBackoff)
+}
+
+func TestDialBackoffKeepsPeersInRoutingTable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, DisableAutoRefresh(), DialBackoff(time.Minute, time.Hour))
+	p := test.RandPeerIDFatal(t)
+	_, err := d.routingTable.TryAddPeer(p, true, false)
+	require.NoError(t, err)
+	d.dialBackoff.DialFailed(p)
+
+	// the lookup skips p, but doesn't hold the backoff against it
+	_, err = d.GetClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, p, d.routingTable.Find(p))
+}
@@ -0,0 +1,42 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+)
+
+// DialFailure describes a failed dial of a peer by a lookup, see
+// OnDialFailure.
+type DialFailure = dhtcfg.DialFailure
+
+// AddrError is the error dialing a peer on one of its addresses.
+type AddrError = dhtcfg.AddrError
+
+// DialFailureHook is called for every failed dial of a lookup, see
+// OnDialFailure.
+type DialFailureHook = dhtcfg.DialFailureHook
+
+// reportDialFailure passes the failure to dial p to the OnDialFailure hook.
+func (dht *IpfsDHT) reportDialFailure(ctx context.Context, p peer.ID, d time.Duration, err error) {
+	if dht.onDialFailure == nil {
+		return
+	}
+	f := DialFailure{
+		Peer:     p,
+		Addrs:    dht.peerstore.Addrs(p),
+		Duration: d,
+		Err:      err,
+	}
+	var dialErr *swarm.DialError
+	if errors.As(err, &dialErr) {
+		for _, te := range dialErr.DialErrors {
+			f.AddrErrors = append(f.AddrErrors, AddrError{Addr: te.Address, Err: te.Cause})
+		}
+	}
+	dht.onDialFailure(ctx, f)
+}
@@ -0,0 +1,43 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnDialFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var failures []DialFailure
+	d := setupDHT(ctx, t, false, DisableAutoRefresh(), DialBackoff(time.Minute, time.Hour), OnDialFailure(func(ctx context.Context, f DialFailure) {
+		failures = append(failures, f)
+	}))
+	require.True(t, d.Config().OnDialFailure)
+
+	p := test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/127.0.0.1/tcp/1")
+	d.peerstore.AddAddrs(p, []ma.Multiaddr{addr}, peerstore.TempAddrTTL)
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer dialCancel()
+	require.Error(t, d.dialPeer(dialCtx, p))
+
+	require.Len(t, failures, 1)
+	f := failures[0]
+	require.Equal(t, p, f.Peer)
+	require.Error(t, f.Err)
+	require.Len(t, f.AddrErrors, 1)
+	require.True(t, f.AddrErrors[0].Addr.Equal(addr))
+	require.Error(t, f.AddrErrors[0].Err)
+
+	// the dials skipped by the backoff aren't reported
+	require.ErrorIs(t, d.dialPeer(dialCtx, p), errDialBackoff)
+	require.Len(t, failures, 1)
+}
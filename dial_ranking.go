@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// DialRankFunc orders the candidate peers a lookup is about to query. The
+// candidates are passed closest to the target first; the lookup queries the
+// peers in the order of the returned slice.
+type DialRankFunc = dhtcfg.DialRankFunc
+
+var (
+	_ DialRankFunc = AddressQualityDialRanker
+	_ DialRankFunc = LatencyDialRanker
+)
+
+// AddressQualityDialRanker ranks the candidates by the quality of their known
+// addresses, keeping the closest-first order among equally ranked peers. Peers
+// that were previously reachable come first, followed by peers with a public
+// QUIC address and then peers with any public, non-relayed address.
+//
+// Racing the address families of a single peer is left to the host's dialer
+// (the libp2p swarm dials QUIC, TCP, IPv4 and IPv6 addresses in a staggered,
+// happy-eyeballs fashion).
+func AddressQualityDialRanker(dht interface{}, candidates []peer.AddrInfo) []peer.AddrInfo {
+	d, ok := dht.(hasHost)
+	if !ok {
+		return candidates
+	}
+	h := d.Host()
+
+	scores := make(map[peer.ID]int, len(candidates))
+	for _, ai := range candidates {
+		score := 0
+		if h.Network().Connectedness(ai.ID) == network.Connected || h.Peerstore().LatencyEWMA(ai.ID) > 0 {
+			score += 4
+		}
+		for _, a := range ai.Addrs {
+			if isRelayAddr(a) || !isPublicAddr(a) {
+				continue
+			}
+			score |= 1
+			if isQUICAddr(a) {
+				score |= 2
+				break
+			}
+		}
+		scores[ai.ID] = score
+	}
+
+	ranked := append([]peer.AddrInfo(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i].ID] > scores[ranked[j].ID]
+	})
+	return ranked
+}
+
+// LatencyDialRanker ranks the candidates by the average RTT recorded in the
+// latency book of the host's peerstore, lowest first. The peerstore is fed by
+// the DHT requests as well as by the other subsystems of the host, such as
+// Bitswap or the identify and ping services. Peers without a known RTT come
+// last, keeping the closest-first order.
+func LatencyDialRanker(dht interface{}, candidates []peer.AddrInfo) []peer.AddrInfo {
+	d, ok := dht.(hasHost)
+	if !ok {
+		return candidates
+	}
+	ps := d.Host().Peerstore()
+
+	rtts := make(map[peer.ID]time.Duration, len(candidates))
+	for _, ai := range candidates {
+		rtts[ai.ID] = ps.LatencyEWMA(ai.ID)
+	}
+
+	ranked := append([]peer.AddrInfo(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ri, rj := rtts[ranked[i].ID], rtts[ranked[j].ID]
+		if ri <= 0 || rj <= 0 {
+			return ri > 0 && rj <= 0
+		}
+		return ri < rj
+	})
+	return ranked
+}
+
+func isQUICAddr(a ma.Multiaddr) bool {
+	found := false
+	ma.ForEach(a, func(c ma.Component) bool {
+		found = c.Protocol().Code == ma.P_QUIC_V1
+		return !found
+	})
+	return found
+}
+
+// rankQueryCandidates picks up to n peers to query next from the heard peers,
+// given closest first. The dial ranker and the connection preference, if any,
+// reorder a window of the 2n closest candidates so that better reachable peers
+// are dialed first, unless a peer ranker orders them.
+func (q *query) rankQueryCandidates(heard []peer.ID, n int) []peer.ID {
+	if n <= 0 {
+		return nil
+	}
+	if r := q.dht.peerRanker.Load(); r != nil {
+		return q.rankWith(*r, heard, n)
+	}
+	closestFirst := q.dht.dialRanker == nil &&
+		q.dht.connPreference == PreferCloserPeers &&
+		q.dht.relayAddrPolicy != DeprioritizeRelayAddrs
+	if closestFirst || len(heard) <= 1 {
+		if len(heard) > n {
+			heard = heard[:n]
+		}
+		return heard
+	}
+
+	window := heard
+	if len(window) > 2*n {
+		window = window[:2*n]
+	}
+	candidates := make([]peer.AddrInfo, len(window))
+	for i, p := range window {
+		candidates[i] = q.dht.peerstore.PeerInfo(p)
+	}
+
+	ranked := candidates
+	if q.dht.dialRanker != nil {
+		ranked = q.dht.dialRanker(q.dht, candidates)
+	}
+	if q.dht.relayAddrPolicy == DeprioritizeRelayAddrs {
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return !onlyRelayAddrs(ranked[i].Addrs) && onlyRelayAddrs(ranked[j].Addrs)
+		})
+	}
+	if q.dht.connPreference != PreferCloserPeers {
+		// connected peers go first, without dialing anyone
+		net := q.dht.host.Network()
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return net.Connectedness(ranked[i].ID) == network.Connected &&
+				net.Connectedness(ranked[j].ID) != network.Connected
+		})
+	}
+	known := make(map[peer.ID]struct{}, len(window))
+	for _, p := range window {
+		known[p] = struct{}{}
+	}
+	peersToQuery := make([]peer.ID, 0, n)
+	for _, ai := range ranked {
+		if len(peersToQuery) == n {
+			break
+		}
+		// only accept peers that were candidates, and only once
+		if _, ok := known[ai.ID]; ok {
+			delete(known, ai.ID)
+			peersToQuery = append(peersToQuery, ai.ID)
+		}
+	}
+	return peersToQuery
+}
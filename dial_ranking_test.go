@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressQualityDialRanker(t *testing.T) {
+	ctx := context.Background()
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	private := peer.AddrInfo{ID: "private", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.0.1/tcp/4001")}}
+	tcp := peer.AddrInfo{ID: "tcp", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}}
+	quic := peer.AddrInfo{ID: "quic", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.5/udp/4001/quic-v1")}}
+	relayed := peer.AddrInfo{ID: "relayed", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.6/tcp/4001/p2p/QmdPU7PfRyKehdrP5A3WqmjyD6bhVpU1mLGKppa2FjGDjZ/p2p-circuit")}}
+	known := peer.AddrInfo{ID: "known"}
+	d.host.Peerstore().RecordLatency(known.ID, 10)
+
+	ranked := AddressQualityDialRanker(d, []peer.AddrInfo{private, relayed, tcp, quic, known})
+	var ids []peer.ID
+	for _, ai := range ranked {
+		ids = append(ids, ai.ID)
+	}
+	require.Equal(t, []peer.ID{known.ID, quic.ID, tcp.ID, private.ID, relayed.ID}, ids)
+}
+
+func TestConnectedPeersOnly(t *testing.T) {
+	ctx := context.Background()
+	d1 := setupDHT(ctx, t, false, QueryConnectionPreference(ConnectedPeersOnly))
+	d2 := setupDHT(ctx, t, false)
+	d3 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	require.NoError(t, d1.dialPeer(ctx, d2.self))
+	d1.peerstore.AddAddrs(d3.self, d3.host.Addrs(), time.Minute)
+	require.ErrorIs(t, d1.dialPeer(ctx, d3.self), errNoNewDials)
+	require.NotEqual(t, network.Connected, d1.host.Network().Connectedness(d3.self))
+}
+
+func TestLatencyDialRanker(t *testing.T) {
+	ctx := context.Background()
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	unknown1 := peer.AddrInfo{ID: "unknown1"}
+	slow := peer.AddrInfo{ID: "slow"}
+	unknown2 := peer.AddrInfo{ID: "unknown2"}
+	fast := peer.AddrInfo{ID: "fast"}
+	d.host.Peerstore().RecordLatency(slow.ID, 200*time.Millisecond)
+	d.host.Peerstore().RecordLatency(fast.ID, 10*time.Millisecond)
+
+	ranked := LatencyDialRanker(d, []peer.AddrInfo{unknown1, slow, unknown2, fast})
+	var ids []peer.ID
+	for _, ai := range ranked {
+		ids = append(ids, ai.ID)
+	}
+	require.Equal(t, []peer.ID{fast.ID, slow.ID, unknown1.ID, unknown2.ID}, ids)
+}
+
+func TestRankPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	farthestFirst := func(target []byte, candidates []PeerCandidate) []peer.ID {
+		calls.Add(1)
+		ids := make([]peer.ID, 0, len(candidates))
+		for i := len(candidates) - 1; i >= 0; i-- {
+			c := candidates[i]
+			if len(c.Distance) == 0 || c.BackedOff {
+				panic("unexpected candidate")
+			}
+			// peers that weren't candidates are ignored
+			ids = append(ids, c.ID, "unknown")
+		}
+		return ids
+	}
+
+	d := setupDHT(ctx, t, false, RankPeers(farthestFirst))
+	require.True(t, d.Config().PeerRanker)
+	others := setupDHTS(t, ctx, 4)
+	connect(t, ctx, d, others[0])
+	for _, o := range others[1:] {
+		connect(t, ctx, others[0], o)
+	}
+
+	peers, err := d.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.Len(t, peers, 4)
+	require.Positive(t, calls.Load())
+
+	// a ranker leaving all the candidates out doesn't stall the lookups
+	d.SetPeerRanker(func([]byte, []PeerCandidate) []peer.ID { return nil })
+	peers, err = d.GetClosestPeers(ctx, "baz")
+	require.NoError(t, err)
+	require.Len(t, peers, 4)
+
+	d.SetPeerRanker(nil)
+	calls.Store(0)
+	_, err = d.GetClosestPeers(ctx, "bar")
+	require.NoError(t, err)
+	require.Zero(t, calls.Load())
+}
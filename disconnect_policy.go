@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// The reasons peers are evicted from the routing table for, as reported by
+// the routing table eviction metric.
+const (
+	evictDisconnected  = "disconnected"
+	evictProbeFailed   = "probe_failed"
+	evictDialFailed    = "dial_failed"
+	evictQueryFailed   = "query_failed"
+	evictStoppedDHT    = "stopped_dht"
+	evictRefreshFailed = "refresh_failed"
+	evictBanned        = "banned"
+)
+
+// evictPeer removes p from the routing table, counting the eviction if it
+// was in it.
+func (dht *IpfsDHT) evictPeer(p peer.ID, reason string) {
+	if dht.routingTable.Find(p) == "" {
+		return
+	}
+	dht.routingTable.RemovePeer(p)
+	metrics.RoutingTableEvictions.Add(dht.ctx, 1, metric.WithAttributes(attribute.String("reason", reason)), dht.protoAttr)
+}
+
+// refreshEvictions is the routing table as seen by the refresh manager, whose
+// evictions are counted.
+type refreshEvictions struct {
+	routingTable
+	dht *IpfsDHT
+}
+
+func (rt refreshEvictions) RemovePeer(p peer.ID) {
+	rt.dht.evictPeer(p, evictRefreshFailed)
+}
+
+// disconnectTracker applies the disconnect policy to the routing table
+// peers. With ProbeOnDisconnect, it holds a timer per disconnected peer,
+// stopped if the peer reconnects within the grace period.
+type disconnectTracker struct {
+	dht    *IpfsDHT
+	policy DisconnectPolicy
+	grace  time.Duration
+
+	mu     sync.Mutex
+	probes map[peer.ID]*time.Timer
+}
+
+func newDisconnectTracker(dht *IpfsDHT, policy DisconnectPolicy, grace time.Duration) *disconnectTracker {
+	return &disconnectTracker{
+		dht:    dht,
+		policy: policy,
+		grace:  grace,
+		probes: make(map[peer.ID]*time.Timer),
+	}
+}
+
+// connectednessChanged applies the policy to a peer whose connectedness
+// changed.
+func (t *disconnectTracker) connectednessChanged(p peer.ID, c network.Connectedness) {
+	if c == network.Connected {
+		t.cancelProbe(p)
+		return
+	}
+	if t.dht.routingTable.Find(p) == "" {
+		return
+	}
+	switch t.policy {
+	case EvictOnDisconnect:
+		t.dht.evictPeer(p, evictDisconnected)
+	case ProbeOnDisconnect:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.probes[p]; !ok {
+			t.probes[p] = time.AfterFunc(t.grace, func() { t.probe(p) })
+		}
+	}
+}
+
+func (t *disconnectTracker) cancelProbe(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timer, ok := t.probes[p]; ok {
+		timer.Stop()
+		delete(t.probes, p)
+	}
+}
+
+// probe evicts p unless it reconnected or answers a FIND_NODE request.
+func (t *disconnectTracker) probe(p peer.ID) {
+	t.mu.Lock()
+	delete(t.probes, p)
+	t.mu.Unlock()
+
+	dht := t.dht
+	if dht.ctx.Err() != nil || dht.host.Network().Connectedness(p) == network.Connected {
+		return
+	}
+	ctx, cancel := context.WithTimeout(dht.ctx, dht.lookupCheckTimeout)
+	defer cancel()
+	if err := dht.probePeer(ctx, p); err != nil && dht.ctx.Err() == nil {
+		dht.logger.Debugw("evicting disconnected peer after failed probe", "peer", p, "error", err)
+		dht.evictPeer(p, evictProbeFailed)
+	}
+}
+
+// stop cancels the pending probes.
+func (t *disconnectTracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for p, timer := range t.probes {
+		timer.Stop()
+		delete(t.probes, p)
+	}
+}
@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisconnectPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the test swarms don't emit their events on the bus of the host
+	disconnected := func(t *testing.T, a, b *IpfsDHT) {
+		em, err := a.host.EventBus().Emitter(new(event.EvtPeerConnectednessChanged))
+		require.NoError(t, err)
+		defer em.Close()
+		require.NoError(t, em.Emit(event.EvtPeerConnectednessChanged{Peer: b.self, Connectedness: network.NotConnected}))
+	}
+	disconnect := func(t *testing.T, opts ...Option) (*IpfsDHT, *IpfsDHT) {
+		a := setupDHT(ctx, t, false, opts...)
+		b := setupDHT(ctx, t, false)
+		connect(t, ctx, a, b)
+		require.Equal(t, b.self, a.routingTable.Find(b.self))
+		require.NoError(t, a.host.Network().ClosePeer(b.self))
+		disconnected(t, a, b)
+		return a, b
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		a, b := disconnect(t)
+		time.Sleep(100 * time.Millisecond)
+		require.Equal(t, b.self, a.routingTable.Find(b.self))
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		a, b := disconnect(t, RoutingTableDisconnectPolicy(EvictOnDisconnect, 0))
+		require.Eventually(t, func() bool { return a.routingTable.Find(b.self) == "" }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("probe", func(t *testing.T) {
+		a, b := disconnect(t,
+			RoutingTableDisconnectPolicy(ProbeOnDisconnect, 20*time.Millisecond),
+			// bounds the probes
+			RoutingTableRefreshQueryTimeout(time.Second),
+		)
+		// b answers the probe
+		time.Sleep(200 * time.Millisecond)
+		require.Equal(t, b.self, a.routingTable.Find(b.self))
+
+		// b is gone
+		require.NoError(t, b.host.Close())
+		disconnected(t, a, b)
+		require.Eventually(t, func() bool { return a.routingTable.Find(b.self) == "" }, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// DefaultDiscoveryTTL is the TTL of an advertisement made without the
+	// discovery.TTL option.
+	DefaultDiscoveryTTL = 3 * time.Hour
+
+	// defaultDiscoveryLimit is the number of peers FindPeers returns
+	// without the discovery.Limit option.
+	defaultDiscoveryLimit = 100
+
+	// discoveryProvideTimeout bounds Advertise when its context has no
+	// deadline, as the provide lookup would otherwise run unbounded.
+	discoveryProvideTimeout = time.Minute
+)
+
+// Discovery implements discovery.Discovery with provider records: peers
+// advertising a namespace provide its hash, and peers looking for the
+// namespace find its providers. Namespaces are hashed the same way as the
+// RoutingDiscovery of go-libp2p, so that both can discover each other.
+type Discovery struct {
+	dht *IpfsDHT
+}
+
+var _ discovery.Discovery = (*Discovery)(nil)
+
+// NewDiscovery returns a discovery.Discovery advertising and finding peers
+// with the provider records of dht.
+func NewDiscovery(dht *IpfsDHT) *Discovery {
+	return &Discovery{dht: dht}
+}
+
+// NamespaceCid returns the CID that peers advertising ns provide.
+func NamespaceCid(ns string) (cid.Cid, error) {
+	h, err := multihash.Sum([]byte(ns), multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, h), nil
+}
+
+// Advertise provides the hash of ns to the network. It returns the TTL of the
+// advertisement, which must be renewed before it elapses. The TTL is the one
+// of the discovery.TTL option, DefaultDiscoveryTTL otherwise, capped at half
+// the lifetime of provider records so that advertisements never lapse.
+func (d *Discovery) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	var options discovery.Options
+	if err := options.Apply(opts...); err != nil {
+		return 0, err
+	}
+	if options.Ttl < 0 {
+		return 0, fmt.Errorf("negative advertisement ttl: %s", options.Ttl)
+	}
+
+	ttl := options.Ttl
+	if ttl == 0 {
+		ttl = DefaultDiscoveryTTL
+	}
+	if maxTTL := providers.ProvideValidity / 2; ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	c, err := NamespaceCid(ns)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, discoveryProvideTimeout)
+		defer cancel()
+	}
+	if err := d.dht.Provide(ctx, c, true); err != nil {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// FindPeers returns the peers advertising ns, up to the discovery.Limit
+// option or 100 peers. Every peer is returned once, with the addresses known
+// for it, and the local peer is left out.
+func (d *Discovery) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	options := discovery.Options{Limit: defaultDiscoveryLimit}
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	c, err := NamespaceCid(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	// ask for one more provider, as the local peer may be one of them
+	count := options.Limit
+	if count > 0 {
+		count++
+	}
+	provs := d.dht.FindProvidersAsync(ctx, c, count)
+
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+
+		seen := make(map[peer.ID]struct{})
+		for ai := range provs {
+			if ai.ID == d.dht.self {
+				continue
+			}
+			if _, ok := seen[ai.ID]; ok {
+				continue
+			}
+			if options.Limit > 0 && len(seen) == options.Limit {
+				// drain the lookup, which stops with ctx
+				continue
+			}
+			seen[ai.ID] = struct{}{}
+			if len(ai.Addrs) == 0 {
+				ai.Addrs = d.dht.peerstore.Addrs(ai.ID)
+			}
+
+			select {
+			case out <- ai:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
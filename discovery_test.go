@@ -0,0 +1,42 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	ttl, err := NewDiscovery(dhts[1]).Advertise(ctx, "topic")
+	require.NoError(t, err)
+	require.Equal(t, DefaultDiscoveryTTL, ttl)
+	ttl, err = NewDiscovery(dhts[2]).Advertise(ctx, "topic", discovery.TTL(100*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 24*time.Hour, ttl)
+
+	find := func(d *IpfsDHT, opts ...discovery.Option) []peer.ID {
+		ch, err := NewDiscovery(d).FindPeers(ctx, "topic", opts...)
+		require.NoError(t, err)
+		var found []peer.ID
+		for ai := range ch {
+			require.NotEmpty(t, ai.Addrs)
+			found = append(found, ai.ID)
+		}
+		return found
+	}
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self}, find(dhts[3]))
+	require.Equal(t, []peer.ID{dhts[2].self}, find(dhts[1]))
+	require.Len(t, find(dhts[3], discovery.Limit(1)), 1)
+}
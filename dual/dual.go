@@ -4,6 +4,7 @@ package dual
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -99,7 +100,8 @@ func DHTOption(opts ...dht.Option) Option {
 // IpfsDHT internal constructions, modulo additional options used by the Dual DHT to enforce
 // the LAN-vs-WAN distinction.
 // Note: query or routing table functional options provided as arguments to this function
-// will be overriden by this constructor.
+// will be overriden by this constructor, and the LAN DHT uses the dial backoff cache of the
+// WAN DHT.
 func New(ctx context.Context, h host.Host, options ...Option) (*DHT, error) {
 	var cfg config
 	err := cfg.apply(
@@ -143,6 +145,11 @@ func New(ctx context.Context, h host.Host, options ...Option) (*DHT, error) {
 	if wan.Mode() != dht.ModeClient {
 		cfg.lan = append(cfg.lan, dht.Mode(dht.ModeServer))
 	}
+	// A peer that can't be dialed by the WAN DHT can't be dialed by the LAN
+	// DHT either.
+	if backoff := wan.DialBackoffCache(); backoff != nil {
+		cfg.lan = append(cfg.lan, dht.SharedDialBackoff(backoff))
+	}
 	lan, err := dht.New(ctx, h, cfg.lan...)
 	if err != nil {
 		return nil, err
@@ -159,7 +166,7 @@ func (dht *DHT) Close() error {
 
 // WANActive returns true when the WAN DHT is active (has peers).
 func (dht *DHT) WANActive() bool {
-	return dht.WAN.RoutingTable().Size() > 0
+	return dht.WAN.RoutingTableSize() > 0
 }
 
 // Provide adds the given cid to the content routing system.
@@ -307,20 +314,59 @@ func (dht *DHT) FindPeer(ctx context.Context, pid peer.ID) (pi peer.AddrInfo, er
 
 func combineErrors(erra, errb error) error {
 	// if the errors are the same, just return one.
-	if erra == errb {
+	if sameCauses(erra, errb) {
 		return erra
 	}
 
 	// If one of the errors is a kb lookup failure (no peers in routing
 	// table), return the other.
-	if erra == kb.ErrLookupFailure {
+	if errors.Is(erra, kb.ErrLookupFailure) {
 		return errb
-	} else if errb == kb.ErrLookupFailure {
+	} else if errors.Is(errb, kb.ErrLookupFailure) {
 		return erra
 	}
 	return multierror.Append(erra, errb).ErrorOrNil()
 }
 
+// sameCauses reports whether erra and errb wrap the same errors, such as the
+// not found errors both DHTs return, wrapped with the context's error, when
+// the context is canceled.
+func sameCauses(erra, errb error) bool {
+	if erra == nil || errb == nil {
+		return erra == errb
+	}
+	for _, cause := range causes(erra) {
+		if !errors.Is(errb, cause) {
+			return false
+		}
+	}
+	for _, cause := range causes(errb) {
+		if !errors.Is(erra, cause) {
+			return false
+		}
+	}
+	return true
+}
+
+// causes returns the errors at the end of the wrapping chains of err.
+func causes(err error) []error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		if inner := e.Unwrap(); inner != nil {
+			return causes(inner)
+		}
+	case interface{ Unwrap() []error }:
+		var out []error
+		for _, inner := range e.Unwrap() {
+			out = append(out, causes(inner)...)
+		}
+		if len(out) > 0 {
+			return out
+		}
+	}
+	return []error{err}
+}
+
 // Bootstrap allows callers to hint to the routing system to get into a
 // Boostrapped state and remain there.
 func (dht *DHT) Bootstrap(ctx context.Context) (err error) {
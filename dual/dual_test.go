@@ -2,9 +2,11 @@ package dual
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
@@ -13,6 +15,8 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/routing"
+	ptest "github.com/libp2p/go-libp2p/core/test"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
 	"github.com/multiformats/go-multiaddr"
@@ -204,6 +208,18 @@ func TestDualModes(t *testing.T) {
 	}
 }
 
+func TestDualSharedDialBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// even with durations of their own, the WAN and LAN DHTs share a cache
+	d := setupDHT(ctx, t, dht.DialBackoff(time.Minute, time.Hour))
+	defer d.Close()
+
+	require.NotNil(t, d.WAN.DialBackoffCache())
+	require.Equal(t, d.WAN.DialBackoffCache(), d.LAN.DialBackoffCache())
+}
+
 func TestFindProviderAsync(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
@@ -388,6 +404,25 @@ func TestFindPeer(t *testing.T) {
 	assertUniqueMultiaddrs(t, p.Addrs)
 }
 
+func TestFindPeerCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	d, wan, lan := setupTier(ctx, t)
+	defer d.Close()
+	defer wan.Close()
+	defer lan.Close()
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := d.FindPeer(canceled, ptest.RandPeerIDFatal(t))
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	require.ErrorIs(t, err, context.Canceled)
+	// both DHTs failed the same way, the error is reported once
+	var merr *multierror.Error
+	require.False(t, errors.As(err, &merr), "got combined error: %s", err)
+}
+
 func assertUniqueMultiaddrs(t *testing.T, addrs []multiaddr.Multiaddr) {
 	set := make(map[string]bool)
 	for _, addr := range addrs {
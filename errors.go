@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// Errors returned by the DHT's public API. Callers should match them with
+// errors.Is and errors.As rather than by comparing error strings, as most of
+// them are wrapped with more context before being returned.
+var (
+	// ErrNotFound is returned when a lookup completes without finding the
+	// requested value or peer. It is the same value as routing.ErrNotFound.
+	// When a lookup is cut short by its context, the returned error matches
+	// both ErrNotFound and the context's error, and is no longer equal to
+	// ErrNotFound: compare errors with errors.Is, not ==.
+	ErrNotFound = routing.ErrNotFound
+
+	// ErrNoPeersInRoutingTable is returned when a lookup can't start because
+	// the routing table is empty. It is the same value as
+	// kbucket.ErrLookupFailure.
+	ErrNoPeersInRoutingTable = kb.ErrLookupFailure
+
+	// ErrQuorumNotReached is matched by a *QuorumError, returned by GetValue
+	// when the RequireQuorum option is set and too few peers responded.
+	ErrQuorumNotReached = errors.New("quorum not reached")
+
+	// ErrInvalidRecord is matched by a *ValidationError, returned when a
+	// record is rejected by the DHT's validator.
+	ErrInvalidRecord = errors.New("invalid record")
+
+	// ErrInvalidKey is returned when a key or CID can't be looked up, such as
+	// an empty key or an undefined CID.
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrOutdatedRecord is returned by PutValue when the local datastore
+	// holds a record for the key that the validator prefers to the new one.
+	ErrOutdatedRecord = errors.New("can't replace a newer value with an older value")
+
+	// ErrLookupMemoryExhausted is matched by the *OverloadError returned by
+	// the routing calls when the LookupMemoryBudget is used up by the running
+	// lookups and failing fast was requested.
+	ErrLookupMemoryExhausted = errors.New("lookup memory budget exhausted")
+
+	// ErrSendVetoed is matched by the errors of the outbound RPCs vetoed by
+	// the OnOutboundRequest hook, which also unwrap to the hook's error.
+	ErrSendVetoed = errors.New("outbound RPC vetoed")
+
+	// ErrPathsDiverged is matched by a *DivergenceError, returned by GetValue
+	// when the independent lookups of the CrossValidate option disagree.
+	ErrPathsDiverged = errors.New("lookup paths diverged")
+
+	// ErrTooFewPeersForPaths is returned by GetValue with the CrossValidate
+	// option when the routing table doesn't hold enough peers to seed both
+	// lookup paths.
+	ErrTooFewPeersForPaths = errors.New("not enough peers for independent lookup paths")
+
+	// ErrAnnouncerClosed is returned by Announcer.Push once the announcer is
+	// closed, and reported for the keys it dropped when closed.
+	ErrAnnouncerClosed = errors.New("announcer closed")
+
+	// ErrProvideQueueFull is returned by ScheduleProvide when the provide
+	// scheduler can't queue the keys without exceeding its bound.
+	ErrProvideQueueFull = errors.New("provide queue full")
+)
+
+// ConfigError is returned by New when the configuration resulting from the
+// options is invalid. Its Violations list every problem found, so that all of
+// them can be fixed at once.
+type ConfigError = dhtcfg.ConfigError
+
+// ValidationError is returned when a record fails validation. It matches
+// ErrInvalidRecord and unwraps to the error returned by the validator.
+type ValidationError struct {
+	Key string
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid record for key %q: %s", e.Key, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+func (e *ValidationError) Is(target error) bool { return target == ErrInvalidRecord }
+
+// QuorumError is returned by GetValue when the RequireQuorum option is set
+// and fewer than Needed peers responded with a value. It matches
+// ErrQuorumNotReached.
+type QuorumError struct {
+	Needed int
+	Got    int
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("quorum not reached: needed %d responses, got %d", e.Needed, e.Got)
+}
+
+func (e *QuorumError) Is(target error) bool { return target == ErrQuorumNotReached }
+
+// DivergenceError is returned by GetValue with the CrossValidate option when
+// its independent lookups found different best records for Key. Values holds
+// the value found by each path, nil if it found none. It matches
+// ErrPathsDiverged.
+type DivergenceError struct {
+	Key    string
+	Values [2][]byte
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("lookup paths diverged for key %q", e.Key)
+}
+
+func (e *DivergenceError) Is(target error) bool { return target == ErrPathsDiverged }
+
+// notFound returns ErrNotFound, wrapped with the context's error if the
+// lookup that failed to find anything was interrupted by ctx.
+func notFound(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return ErrNotFound
+}
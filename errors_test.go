@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicAPIErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+
+	err := d.PutValue(ctx, "/unknown/key", []byte("value"))
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	require.Equal(t, "/unknown/key", verr.Key)
+	require.ErrorIs(t, err, ErrInvalidRecord)
+
+	err = d.Provide(ctx, cid.Cid{}, true)
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	_, err = d.GetClosestPeers(ctx, "")
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	_, err = d.GetClosestPeers(ctx, "foo")
+	require.ErrorIs(t, err, ErrNoPeersInRoutingTable)
+}
+
+func TestRequireQuorum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	connect(t, ctx, dhts[0], dhts[1])
+
+	require.NoError(t, dhts[0].PutValue(ctx, "/v/hello", []byte("world")))
+
+	val, err := dhts[1].GetValue(ctx, "/v/hello", Quorum(1), RequireQuorum())
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+
+	val, err = dhts[1].GetValue(ctx, "/v/hello", Quorum(3), RequireQuorum())
+	require.ErrorIs(t, err, ErrQuorumNotReached)
+	var qerr *QuorumError
+	require.ErrorAs(t, err, &qerr)
+	require.Equal(t, 3, qerr.Needed)
+	require.Equal(t, 1, qerr.Got)
+	require.Equal(t, []byte("world"), val)
+
+	// Without RequireQuorum the best value is returned as before.
+	val, err = dhts[1].GetValue(ctx, "/v/hello", Quorum(3))
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+}
+
+func TestNotFoundWrapsContextError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := notFound(ctx)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, ErrNotFound, notFound(context.Background()))
+}
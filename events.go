@@ -7,6 +7,7 @@ import (
 
 	"github.com/google/uuid"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	kbucket "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
@@ -19,9 +20,13 @@ type KeyKadID struct {
 
 // NewKeyKadID creates a KeyKadID from a string Kademlia ID.
 func NewKeyKadID(k string) *KeyKadID {
+	return newKeyKadID(nil, k)
+}
+
+func newKeyKadID(h internal.KeyspaceHash, k string) *KeyKadID {
 	return &KeyKadID{
 		Key: k,
-		Kad: kbucket.ConvertKey(k),
+		Kad: h.ID([]byte(k)),
 	}
 }
 
@@ -33,27 +38,39 @@ type PeerKadID struct {
 
 // NewPeerKadID creates a PeerKadID from a libp2p Peer ID.
 func NewPeerKadID(p peer.ID) *PeerKadID {
+	return newPeerKadID(nil, p)
+}
+
+func newPeerKadID(h internal.KeyspaceHash, p peer.ID) *PeerKadID {
 	return &PeerKadID{
 		Peer: p,
-		Kad:  kbucket.ConvertPeerID(p),
+		Kad:  h.ID([]byte(p)),
 	}
 }
 
 // NewPeerKadIDSlice creates a slice of PeerKadID from the passed slice of libp2p Peer IDs.
 func NewPeerKadIDSlice(p []peer.ID) []*PeerKadID {
+	return newPeerKadIDSlice(nil, p)
+}
+
+func newPeerKadIDSlice(h internal.KeyspaceHash, p []peer.ID) []*PeerKadID {
 	r := make([]*PeerKadID, len(p))
 	for i := range p {
-		r[i] = NewPeerKadID(p[i])
+		r[i] = newPeerKadID(h, p[i])
 	}
 	return r
 }
 
 // OptPeerKadID returns a pointer to a PeerKadID or nil if the passed Peer ID is it's default value.
 func OptPeerKadID(p peer.ID) *PeerKadID {
+	return optPeerKadID(nil, p)
+}
+
+func optPeerKadID(h internal.KeyspaceHash, p peer.ID) *PeerKadID {
 	if p == "" {
 		return nil
 	}
-	return NewPeerKadID(p)
+	return newPeerKadID(h, p)
 }
 
 // NewLookupEvent creates a LookupEvent automatically converting the node
@@ -65,11 +82,24 @@ func NewLookupEvent(
 	request *LookupUpdateEvent,
 	response *LookupUpdateEvent,
 	terminate *LookupTerminateEvent,
+) *LookupEvent {
+	return newLookupEvent(nil, node, id, key, request, response, terminate)
+}
+
+// newLookupEvent is NewLookupEvent for the keyspace of h.
+func newLookupEvent(
+	h internal.KeyspaceHash,
+	node peer.ID,
+	id uuid.UUID,
+	key string,
+	request *LookupUpdateEvent,
+	response *LookupUpdateEvent,
+	terminate *LookupTerminateEvent,
 ) *LookupEvent {
 	return &LookupEvent{
-		Node:      NewPeerKadID(node),
+		Node:      newPeerKadID(h, node),
 		ID:        id,
-		Key:       NewKeyKadID(key),
+		Key:       newKeyKadID(h, key),
 		Request:   request,
 		Response:  response,
 		Terminate: terminate,
@@ -91,6 +121,8 @@ type LookupEvent struct {
 	Response *LookupUpdateEvent
 	// Terminate, if not nil, describe a termination event.
 	Terminate *LookupTerminateEvent
+	// RequestID is the ID of the routing call the lookup is part of.
+	RequestID string `json:",omitempty"`
 }
 
 // NewLookupUpdateEvent creates a new lookup update event, automatically converting the passed peer IDs to peer Kad IDs.
@@ -101,14 +133,27 @@ func NewLookupUpdateEvent(
 	waiting []peer.ID,
 	queried []peer.ID,
 	unreachable []peer.ID,
+) *LookupUpdateEvent {
+	return newLookupUpdateEvent(nil, cause, source, heard, waiting, queried, unreachable)
+}
+
+// newLookupUpdateEvent is NewLookupUpdateEvent for the keyspace of h.
+func newLookupUpdateEvent(
+	h internal.KeyspaceHash,
+	cause peer.ID,
+	source peer.ID,
+	heard []peer.ID,
+	waiting []peer.ID,
+	queried []peer.ID,
+	unreachable []peer.ID,
 ) *LookupUpdateEvent {
 	return &LookupUpdateEvent{
-		Cause:       OptPeerKadID(cause),
-		Source:      OptPeerKadID(source),
-		Heard:       NewPeerKadIDSlice(heard),
-		Waiting:     NewPeerKadIDSlice(waiting),
-		Queried:     NewPeerKadIDSlice(queried),
-		Unreachable: NewPeerKadIDSlice(unreachable),
+		Cause:       optPeerKadID(h, cause),
+		Source:      optPeerKadID(h, source),
+		Heard:       newPeerKadIDSlice(h, heard),
+		Waiting:     newPeerKadIDSlice(h, waiting),
+		Queried:     newPeerKadIDSlice(h, queried),
+		Unreachable: newPeerKadIDSlice(h, unreachable),
 	}
 }
 
@@ -241,6 +286,10 @@ func PublishLookupEvent(ctx context.Context, ev *LookupEvent) {
 		return
 	}
 
+	if ev.RequestID == "" {
+		ev.RequestID = internal.RequestID(ctx)
+	}
+
 	// We *want* to panic here.
 	ech := ich.(*lookupEventChannel)
 	ech.send(ctx, ev)
@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// PutValueToPeers stores the record key/value with the given peers, without
+// looking up the closest peers to key first, for applications that already
+// know them, e.g. from a previous GetClosestPeers. Unlike PutValue, it doesn't
+// store the record locally, and skips this host if listed.
+//
+// It returns the peers that stored the record. Failing to reach some of the
+// peers isn't an error.
+func (dht *IpfsDHT) PutValueToPeers(ctx context.Context, key string, value []byte, peers []peer.ID) ([]peer.ID, error) {
+	ctx = startRequest(ctx, "PutValueToPeers")
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+	if err := dht.validateRecord(ctx, key, value); err != nil {
+		return nil, &ValidationError{Key: key, Err: err}
+	}
+
+	rec := record.MakePutRecord(key, value)
+	rec.TimeReceived = internal.FormatRFC3339(time.Now())
+	return dht.fanOut(ctx, peers, func(ctx context.Context, p peer.ID) error {
+		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+			Type: routing.Value,
+			ID:   p,
+		})
+		return dht.protoMessenger.PutValue(ctx, p, rec)
+	})
+}
+
+// ProvideToPeers announces this host as a provider of key to the given peers,
+// without looking up the closest peers to key first. Unlike Provide, it
+// doesn't add the provider record to the local provider store, and skips this
+// host if listed.
+//
+// It returns the peers the provider record was sent to, provider records not
+// being acknowledged. Failing to reach some of the peers isn't an error.
+func (dht *IpfsDHT) ProvideToPeers(ctx context.Context, key cid.Cid, peers []peer.ID) ([]peer.ID, error) {
+	ctx = startRequest(ctx, "ProvideToPeers")
+	if !dht.enableProviders {
+		return nil, routing.ErrNotSupported
+	} else if !key.Defined() {
+		return nil, fmt.Errorf("%w: undefined cid", ErrInvalidKey)
+	}
+
+	keyMH := key.Hash()
+	self := peer.AddrInfo{
+		ID:    dht.self,
+		Addrs: dht.filterAddrs(dht.host.Addrs()),
+	}
+	return dht.fanOut(ctx, peers, func(ctx context.Context, p peer.ID) error {
+		return dht.protoMessenger.PutProviderAddrs(ctx, p, keyMH, self)
+	})
+}
+
+// fanOut runs send against every distinct peer of peers but this host
+// concurrently, returning the peers it succeeded with.
+func (dht *IpfsDHT) fanOut(ctx context.Context, peers []peer.ID, send func(context.Context, peer.ID) error) ([]peer.ID, error) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		reached []peer.ID
+	)
+	seen := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		if _, ok := seen[p]; ok || p == dht.self {
+			continue
+		}
+		seen[p] = struct{}{}
+
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			if err := send(ctx, p); err != nil {
+				dht.requestLogger(ctx).Debugw("failed to send record to peer", "peer", p, "error", err)
+				return
+			}
+			mu.Lock()
+			reached = append(reached, p)
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return reached, ctx.Err()
+}
@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutToPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, d, a)
+	connect(t, ctx, d, b)
+
+	reached, err := d.PutValueToPeers(ctx, "/v/hello", []byte("world"), []peer.ID{a.self, d.self, a.self})
+	require.NoError(t, err)
+	require.Equal(t, []peer.ID{a.self}, reached)
+	rec, err := a.getLocal(ctx, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), rec.GetValue())
+	for _, s := range []*IpfsDHT{d, b} {
+		rec, err := s.getLocal(ctx, "/v/hello")
+		require.NoError(t, err)
+		require.Nil(t, rec)
+	}
+
+	_, err = d.PutValueToPeers(ctx, "/invalid/hello", []byte("world"), []peer.ID{a.self})
+	require.ErrorIs(t, err, ErrInvalidRecord)
+
+	key := testCaseCids[0]
+	reached, err = d.ProvideToPeers(ctx, key, []peer.ID{b.self})
+	require.NoError(t, err)
+	require.Equal(t, []peer.ID{b.self}, reached)
+	require.Eventually(t, func() bool {
+		provs, err := b.ProviderStore().GetProviders(ctx, key.Hash())
+		return err == nil && len(provs) == 1 && provs[0].ID == d.self
+	}, 5*time.Second, 10*time.Millisecond)
+	provs, err := a.ProviderStore().GetProviders(ctx, key.Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs)
+}
@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// maxExtensionSize is the size of the largest extension servers piggyback on
+// their responses.
+const maxExtensionSize = 4 << 10
+
+// RequestExtensionHook sets the extension data of the responses of a server,
+// see OnRequestExtension.
+type RequestExtensionHook = dhtcfg.RequestExtensionHook
+
+// ResponseExtensionHook receives the extension data of the responses, see
+// OnResponseExtension.
+type ResponseExtensionHook = dhtcfg.ResponseExtensionHook
+
+// responseExtension returns the extension of the response to req of p, if
+// any.
+func (dht *IpfsDHT) responseExtension(ctx context.Context, p peer.ID, req *pb.Message) []byte {
+	if dht.onRequestExtension == nil {
+		return nil
+	}
+	ext := dht.onRequestExtension(ctx, p, req)
+	if len(ext) > maxExtensionSize {
+		dht.logger.Warnw("dropping oversized response extension", "size", len(ext), "max", maxExtensionSize)
+		return nil
+	}
+	return ext
+}
+
+// extensionSender passes the extension data of the responses to the
+// OnResponseExtension hook.
+type extensionSender struct {
+	pb.MessageSenderWithDisconnect
+	hook ResponseExtensionHook
+}
+
+func (s *extensionSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+	if err == nil && len(resp.GetExtension()) > 0 {
+		s.hook(ctx, p, resp)
+	}
+	return resp, err
+}
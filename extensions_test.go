@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+func TestMessageExtensions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		received = make(map[peer.ID][]byte)
+	)
+	client := setupDHT(ctx, t, false,
+		OnOutboundRequest(func(ctx context.Context, p peer.ID, msg *pb.Message) error {
+			msg.Extension = []byte("hello")
+			return nil
+		}),
+		OnResponseExtension(func(ctx context.Context, p peer.ID, resp *pb.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[p] = resp.GetExtension()
+		}))
+	server := setupDHT(ctx, t, false, OnRequestExtension(func(ctx context.Context, p peer.ID, req *pb.Message) []byte {
+		if string(req.GetKey()) == "large" {
+			return bytes.Repeat([]byte{1}, maxExtensionSize+1)
+		}
+		return append([]byte("re: "), req.GetExtension()...)
+	}))
+	legacy := setupDHT(ctx, t, false)
+	connect(t, ctx, client, server)
+	connect(t, ctx, client, legacy)
+	require.True(t, server.Config().OnRequestExtension)
+	require.True(t, client.Config().OnResponseExtension)
+
+	for _, p := range []peer.ID{server.self, legacy.self} {
+		_, err := client.protoMessenger.GetClosestPeers(ctx, p, "key")
+		require.NoError(t, err)
+	}
+	mu.Lock()
+	require.Equal(t, map[peer.ID][]byte{server.self: []byte("re: hello")}, received)
+	delete(received, server.self)
+	mu.Unlock()
+
+	_, err := client.protoMessenger.GetClosestPeers(ctx, server.self, "large")
+	require.NoError(t, err)
+	mu.Lock()
+	require.Empty(t, received)
+	mu.Unlock()
+}
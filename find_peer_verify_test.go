@@ -0,0 +1,31 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPeerAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, VerifyFindPeerAddrs(5*time.Second))
+	p := test.RandPeerIDFatal(t)
+	d.peerstore.AddAddrs(p, []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/1")}, peerstore.TempAddrTTL)
+
+	// the addresses are kept when the caller gives up
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	require.ErrorIs(t, d.verifyPeerAddrs(cctx, p), context.Canceled)
+	require.NotEmpty(t, d.peerstore.Addrs(p))
+
+	require.ErrorIs(t, d.verifyPeerAddrs(ctx, p), routing.ErrNotFound)
+	require.Empty(t, d.peerstore.Addrs(p))
+}
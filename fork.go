@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/libp2p/go-libp2p-kad-dht/amino"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// canonicalMetricsPrefix prefixes the names of the metrics of the DHT.
+const canonicalMetricsPrefix = "libp2p.io/dht/kad"
+
+var forkNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Fork derives the identifiers of a DHT network forked from the Amino DHT from
+// its name, so that its peers don't mix with the ones of other networks:
+//
+//	f, _ := dht.NewFork("mynet")
+//	d, _ := dht.New(ctx, h, append(f.Options(),
+//		f.NamespacedValidator("ipns", ipns.Validator{KeyBook: h.Peerstore()}),
+//	)...)
+type Fork struct {
+	name string
+}
+
+// NewFork returns the Fork named name, made of lowercase letters, digits,
+// dots, dashes and underscores.
+func NewFork(name string) (Fork, error) {
+	if !forkNameRegexp.MatchString(name) {
+		return Fork{}, fmt.Errorf("invalid network name %q", name)
+	}
+	if protocol.ID("/"+name) == amino.ProtocolPrefix {
+		return Fork{}, fmt.Errorf("network name %q is the one of the Amino DHT", name)
+	}
+	return Fork{name: name}, nil
+}
+
+// Name returns the name of the network.
+func (f Fork) Name() string { return f.name }
+
+// ProtocolPrefix returns the protocol prefix of the network, /<name>.
+func (f Fork) ProtocolPrefix() protocol.ID {
+	return protocol.ID("/" + f.name)
+}
+
+// Protocols returns the protocols spoken by the peers of the network, as set
+// by Options.
+func (f Fork) Protocols() []protocol.ID {
+	return []protocol.ID{f.ProtocolPrefix() + kad1}
+}
+
+// Namespace returns the record namespace of the network standing for ns, so
+// that its records can't be mistaken for the ones of other networks.
+func (f Fork) Namespace(ns string) string {
+	return f.name + "-" + ns
+}
+
+// NamespacedValidator adds v as the validator of the records of the network
+// in namespace ns, see Namespace.
+func (f Fork) NamespacedValidator(ns string, v record.Validator) Option {
+	return NamespacedValidator(f.Namespace(ns), v)
+}
+
+// MetricsPrefix returns the prefix of the metric names of the network,
+// libp2p.io/dht/<name>.
+func (f Fork) MetricsPrefix() string {
+	return "libp2p.io/dht/" + f.name
+}
+
+// MetricName returns the name of the metric of the network standing for the
+// DHT metric name, to rename the metrics with OpenTelemetry views. The metrics
+// of the DHT are also tagged with its protocol, telling the networks apart.
+func (f Fork) MetricName(name string) string {
+	if rest, ok := strings.CutPrefix(name, canonicalMetricsPrefix+"/"); ok {
+		return f.MetricsPrefix() + "/" + rest
+	}
+	return name
+}
+
+// Options returns the options making a DHT join the network: its protocols,
+// and refusing the peers speaking the protocols of the Amino DHT into the
+// routing table, which would otherwise bridge both networks.
+func (f Fork) Options() []Option {
+	return []Option{
+		ProtocolPrefix(f.ProtocolPrefix()),
+		RefuseProtocols(amino.Protocols...),
+	}
+}
+
+// foreignPeer reports whether p speaks one of the refused protocols, counting
+// the peers kept out of the routing table.
+func (dht *IpfsDHT) foreignPeer(p peer.ID) bool {
+	if len(dht.refusedProtocols) == 0 {
+		return false
+	}
+	proto, err := dht.peerstore.FirstSupportedProtocol(p, dht.refusedProtocols...)
+	if err != nil || proto == "" {
+		return false
+	}
+	metrics.RefusedForeignPeers.Add(dht.ctx, 1, dht.protoAttr)
+	dht.logger.Debugw("refusing peer of another network", "peer", p, "protocol", proto)
+	return true
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libp2p/go-libp2p-kad-dht/amino"
+)
+
+func TestNewFork(t *testing.T) {
+	for _, name := range []string{"", "My Net", "a/b", "ipfs"} {
+		_, err := NewFork(name)
+		require.Error(t, err, name)
+	}
+
+	f, err := NewFork("mynet")
+	require.NoError(t, err)
+	require.Equal(t, protocol.ID("/mynet"), f.ProtocolPrefix())
+	require.Equal(t, []protocol.ID{"/mynet/kad/1.0.0"}, f.Protocols())
+	require.Equal(t, "mynet-ipns", f.Namespace("ipns"))
+	require.Equal(t, "libp2p.io/dht/mynet/received_messages", f.MetricName("libp2p.io/dht/kad/received_messages"))
+	require.Equal(t, "other", f.MetricName("other"))
+}
+
+func TestForkRefusesCanonicalPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := NewFork("mynet")
+	require.NoError(t, err)
+	a := setupDHT(ctx, t, false, f.Options()...)
+	b := setupDHT(ctx, t, false, f.Options()...)
+	require.Equal(t, f.Protocols(), a.Config().Protocols)
+	require.Equal(t, amino.Protocols, a.Config().RefusedProtocols)
+	connect(t, ctx, a, b)
+
+	// a peer of the fork also speaking the canonical protocol
+	bridge := setupDHT(ctx, t, false, f.Options()...)
+	bridge.host.SetStreamHandler(amino.ProtocolID, func(s network.Stream) { s.Reset() })
+	connectNoSync(t, ctx, a, bridge)
+	require.Eventually(t, func() bool {
+		protos, err := a.peerstore.SupportsProtocols(bridge.self, amino.ProtocolID)
+		return err == nil && len(protos) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	valid, err := a.validRTPeer(bridge.self)
+	require.NoError(t, err)
+	require.False(t, valid)
+	a.validPeerFound(bridge.self)
+	a.validPeerFound(b.self)
+	require.Empty(t, a.routingTable.Find(bridge.self))
+	require.Equal(t, b.self, a.routingTable.Find(b.self))
+
+	_, err = New(ctx, a.host, append(f.Options(), RefuseProtocols(f.Protocols()...))...)
+	require.Error(t, err)
+}
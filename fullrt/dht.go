@@ -28,7 +28,6 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
-	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log/v2"
 
 	kaddht "github.com/libp2p/go-libp2p-kad-dht"
@@ -123,14 +122,13 @@ func NewFullRT(h host.Host, protocolPrefix protocol.ID, options ...Option) (*Ful
 		return nil, err
 	}
 
-	dhtcfg := &internalConfig.Config{
-		Datastore:        dssync.MutexWrap(ds.NewMapDatastore()),
-		Validator:        record.NamespacedValidator{},
-		ValidatorChanged: false,
-		EnableProviders:  true,
-		EnableValues:     true,
-		ProtocolPrefix:   protocolPrefix,
+	// start from the defaults of the DHT so that the options not set by the
+	// caller pass validation
+	dhtcfg := &internalConfig.Config{}
+	if err := dhtcfg.Apply(internalConfig.Defaults); err != nil {
+		return nil, err
 	}
+	dhtcfg.ProtocolPrefix = protocolPrefix
 
 	if err := dhtcfg.Apply(fullrtcfg.dhtOpts...); err != nil {
 		return nil, err
@@ -172,9 +170,11 @@ func NewFullRT(h host.Host, protocolPrefix protocol.ID, options ...Option) (*Ful
 
 	var bsPeers []*peer.AddrInfo
 
-	for _, ai := range dhtcfg.BootstrapPeers() {
-		tmpai := ai
-		bsPeers = append(bsPeers, &tmpai)
+	if dhtcfg.BootstrapPeers != nil {
+		for _, ai := range dhtcfg.BootstrapPeers() {
+			tmpai := ai
+			bsPeers = append(bsPeers, &tmpai)
+		}
 	}
 
 	rt := &FullRT{
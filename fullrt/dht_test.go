@@ -5,6 +5,12 @@ import (
 	"testing"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/stretchr/testify/require"
+
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
 )
 
 func TestDivideByChunkSize(t *testing.T) {
@@ -84,3 +90,26 @@ func TestDivideByChunkSize(t *testing.T) {
 		}
 	})
 }
+
+func TestNewFullRT(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		prefix protocol.ID
+		opts   []Option
+	}{
+		{name: "defaults", prefix: "/ipfs"},
+		{name: "dht options", prefix: "/ipfs", opts: []Option{DHTOption(kaddht.BucketSize(20))}},
+		{name: "custom prefix", prefix: "/custom", opts: []Option{DHTOption(kaddht.BucketSize(10), kaddht.Concurrency(5))}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+			require.NoError(t, err)
+			h.Start()
+			defer h.Close()
+
+			d, err := NewFullRT(h, tc.prefix, tc.opts...)
+			require.NoError(t, err)
+			require.NoError(t, d.Close())
+		})
+	}
+}
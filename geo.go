@@ -0,0 +1,206 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// Location is where a routing table peer is, see the GeoLocation option.
+type Location = dhtcfg.Location
+
+// GeoResolver locates an IP address, see the GeoLocation option.
+type GeoResolver = dhtcfg.GeoResolver
+
+const (
+	// maxLocatedPeers bounds the number of peers whose location is kept.
+	maxLocatedPeers = 4096
+	// geoQueueSize bounds the number of peers waiting to be located, the
+	// peers added to the routing table past it being left unlocated.
+	geoQueueSize      = 256
+	geoResolveTimeout = 10 * time.Second
+)
+
+// geoLocator locates the peers added to the routing table in the background.
+// A nil *geoLocator doesn't locate anything.
+type geoLocator struct {
+	dht     *IpfsDHT
+	resolve GeoResolver
+	queue   chan peer.ID
+
+	mu      sync.Mutex
+	located *lru.LRU // peer.ID -> Location
+}
+
+func newGeoLocator(dht *IpfsDHT, resolve GeoResolver) *geoLocator {
+	if resolve == nil {
+		return nil
+	}
+	located, err := lru.NewLRU(maxLocatedPeers, nil)
+	if err != nil {
+		panic(err) // only errors if size <= 0
+	}
+	return &geoLocator{dht: dht, resolve: resolve, queue: make(chan peer.ID, geoQueueSize), located: located}
+}
+
+func (g *geoLocator) start() {
+	if g == nil {
+		return
+	}
+	g.dht.wg.Add(1)
+	go func() {
+		defer g.dht.wg.Done()
+		for {
+			select {
+			case p := <-g.queue:
+				g.locate(p)
+			case <-g.dht.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// add queues p to be located, unless it already is.
+func (g *geoLocator) add(p peer.ID) {
+	if g == nil {
+		return
+	}
+	if _, ok := g.location(p); ok {
+		return
+	}
+	select {
+	case g.queue <- p:
+	default:
+	}
+}
+
+func (g *geoLocator) locate(p peer.ID) {
+	ip, ok := g.dht.peerIP(p)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(g.dht.ctx, geoResolveTimeout)
+	defer cancel()
+	loc, err := g.resolve(ctx, ip)
+	if err != nil {
+		g.dht.logger.Debugw("failed to locate peer", "peer", p, "ip", ip, "error", err)
+		return
+	}
+	g.mu.Lock()
+	g.located.Add(p, loc)
+	g.mu.Unlock()
+}
+
+func (g *geoLocator) location(p peer.ID) (Location, bool) {
+	if g == nil {
+		return Location{}, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v, ok := g.located.Get(p)
+	if !ok {
+		return Location{}, false
+	}
+	return v.(Location), true
+}
+
+// peerIP returns the IP address of p to locate it by, a public one if any.
+func (dht *IpfsDHT) peerIP(p peer.ID) (netip.Addr, bool) {
+	var (
+		ip    netip.Addr
+		found bool
+	)
+	for _, a := range dht.peerstore.Addrs(p) {
+		nip, err := manet.ToIP(a)
+		if err != nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(nip)
+		if !ok {
+			continue
+		}
+		if isPublicAddr(a) {
+			return addr.Unmap(), true
+		}
+		if !found {
+			ip, found = addr.Unmap(), true
+		}
+	}
+	return ip, found
+}
+
+// LocationStats aggregates the routing table peers sharing a region or an
+// autonomous system.
+type LocationStats struct {
+	// Key is the region ("country/region"), or the ASN ("AS13335").
+	Key   string
+	Peers int
+	// MedianRTT is the median of the RTTs measured to the peers, zero if
+	// none was measured.
+	MedianRTT time.Duration
+}
+
+// locationStats aggregates peers by the key returned by key, skipping the
+// peers it returns no key for. The largest groups come first.
+func locationStats(peers []RoutingTablePeer, key func(Location) string) []LocationStats {
+	rtts := make(map[string][]time.Duration)
+	counts := make(map[string]int)
+	for _, p := range peers {
+		if p.Location == nil {
+			continue
+		}
+		k := key(*p.Location)
+		if k == "" {
+			continue
+		}
+		counts[k]++
+		if p.RTT > 0 {
+			rtts[k] = append(rtts[k], p.RTT)
+		}
+	}
+
+	stats := make([]LocationStats, 0, len(counts))
+	for k, n := range counts {
+		s := LocationStats{Key: k, Peers: n}
+		if r := rtts[k]; len(r) > 0 {
+			sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+			s.MedianRTT = r[len(r)/2]
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Peers != stats[j].Peers {
+			return stats[i].Peers > stats[j].Peers
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+func regionKey(l Location) string {
+	switch {
+	case l.Country != "" && l.Region != "":
+		return l.Country + "/" + l.Region
+	case l.Country != "":
+		return l.Country
+	default:
+		return l.Region
+	}
+}
+
+func asnKey(l Location) string {
+	if l.ASN == 0 {
+		return ""
+	}
+	return fmt.Sprintf("AS%d", l.ASN)
+}
@@ -0,0 +1,148 @@
+package dht
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// PeerGreylist counts the protocol violations of peers, greylisting the ones
+// committing too many. See GreylistPeers.
+type PeerGreylist = dhtcfg.PeerGreylist
+
+// Greylist greylists the peers committing a number of protocol violations
+// within a window for a period. Installed as connection gater of the host, it
+// also refuses the inbound connections of the greylisted peers, so they can't
+// reconnect and retry right away:
+//
+//	g, _ := dht.NewGreylist(5, time.Minute, time.Hour)
+//	h, _ := libp2p.New(libp2p.ConnectionGater(g))
+//	d, _ := dht.New(ctx, h, dht.GreylistPeers(g))
+type Greylist struct {
+	strikes int
+	window  time.Duration
+	period  time.Duration
+
+	mu        sync.Mutex
+	peers     map[peer.ID]*greylistEntry
+	lastSweep time.Time
+}
+
+type greylistEntry struct {
+	strikes     int
+	windowStart time.Time
+	until       time.Time
+}
+
+var (
+	_ PeerGreylist            = (*Greylist)(nil)
+	_ connmgr.ConnectionGater = (*Greylist)(nil)
+)
+
+// NewGreylist returns a Greylist greylisting the peers committing strikes
+// violations within window for period.
+func NewGreylist(strikes int, window, period time.Duration) (*Greylist, error) {
+	if strikes <= 0 {
+		return nil, fmt.Errorf("greylist strikes must be positive, got %d", strikes)
+	}
+	if window <= 0 || period <= 0 {
+		return nil, fmt.Errorf("greylist window and period must be positive")
+	}
+	return &Greylist{
+		strikes:   strikes,
+		window:    window,
+		period:    period,
+		peers:     make(map[peer.ID]*greylistEntry),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// Strike records a violation of p, reporting whether it got p greylisted.
+func (g *Greylist) Strike(p peer.ID) bool {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.lastSweep) > g.window {
+		for q, e := range g.peers {
+			if now.After(e.until) && now.Sub(e.windowStart) > g.window {
+				delete(g.peers, q)
+			}
+		}
+		g.lastSweep = now
+	}
+
+	e := g.peers[p]
+	if e == nil {
+		e = &greylistEntry{windowStart: now}
+		g.peers[p] = e
+	}
+	if now.Before(e.until) {
+		// a violation on a stream opened before p got greylisted
+		return false
+	}
+	if now.Sub(e.windowStart) > g.window {
+		e.strikes, e.windowStart = 0, now
+	}
+	e.strikes++
+	if e.strikes < g.strikes {
+		return false
+	}
+	e.strikes, e.windowStart, e.until = 0, now, now.Add(g.period)
+	return true
+}
+
+// Greylisted reports whether p is greylisted.
+func (g *Greylist) Greylisted(p peer.ID) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e := g.peers[p]
+	return e != nil && time.Now().Before(e.until)
+}
+
+// InterceptPeerDial implements connmgr.ConnectionGater, accepting all.
+func (g *Greylist) InterceptPeerDial(peer.ID) bool { return true }
+
+// InterceptAddrDial implements connmgr.ConnectionGater, accepting all.
+func (g *Greylist) InterceptAddrDial(peer.ID, ma.Multiaddr) bool { return true }
+
+// InterceptAccept implements connmgr.ConnectionGater, accepting all.
+func (g *Greylist) InterceptAccept(network.ConnMultiaddrs) bool { return true }
+
+// InterceptSecured implements connmgr.ConnectionGater, refusing the inbound
+// connections of the greylisted peers.
+func (g *Greylist) InterceptSecured(dir network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return dir != network.DirInbound || !g.Greylisted(p)
+}
+
+// InterceptUpgraded implements connmgr.ConnectionGater, accepting all.
+func (g *Greylist) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// strike reports a protocol violation of p to the greylist, if any.
+func (dht *IpfsDHT) strike(p peer.ID, violation string) {
+	if dht.greylist == nil || !dht.greylist.Strike(p) {
+		return
+	}
+	metrics.GreylistedPeers.Add(dht.ctx, 1, dht.protoAttr)
+	dht.logger.Infow("greylisted peer", "peer", p, "last_violation", violation)
+}
+
+// greylisted reports whether the streams of p must be reset, counting them.
+func (dht *IpfsDHT) greylisted(p peer.ID) bool {
+	if dht.greylist == nil || !dht.greylist.Greylisted(p) {
+		return false
+	}
+	metrics.GreylistedStreams.Add(dht.ctx, 1, dht.protoAttr)
+	return true
+}
@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-msgio"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGreylist(t *testing.T) {
+	g, err := NewGreylist(2, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	require.False(t, g.Strike("a"))
+	require.False(t, g.Greylisted("a"))
+	require.True(t, g.InterceptSecured(network.DirInbound, "a", nil))
+	require.True(t, g.Strike("a"))
+	require.True(t, g.Greylisted("a"))
+	require.False(t, g.Greylisted("b"))
+
+	require.False(t, g.InterceptSecured(network.DirInbound, "a", nil))
+	require.True(t, g.InterceptSecured(network.DirOutbound, "a", nil))
+
+	_, err = NewGreylist(0, time.Minute, time.Hour)
+	require.Error(t, err)
+}
+
+func TestGreylistPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, err := NewGreylist(2, time.Minute, time.Hour)
+	require.NoError(t, err)
+	server := setupDHT(ctx, t, false, DisableAutoRefresh(), GreylistPeers(g))
+	client := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, client, server)
+	require.True(t, server.Config().Greylist)
+
+	require.NoError(t, client.protoMessenger.Ping(ctx, server.self))
+	for i := 0; i < 2; i++ {
+		s, err := client.host.NewStream(ctx, server.self, server.protocols...)
+		require.NoError(t, err)
+		require.NoError(t, msgio.NewVarintWriter(s).WriteMsg([]byte{0xff, 0xff, 0xff}))
+		// the server resets the stream of the malformed message
+		_, err = s.Read(make([]byte, 1))
+		require.Error(t, err)
+	}
+	require.True(t, g.Greylisted(client.self))
+	require.Error(t, client.protoMessenger.Ping(ctx, server.self))
+}
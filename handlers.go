@@ -5,9 +5,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
 
 	"github.com/gogo/protobuf/proto"
@@ -19,6 +21,8 @@ import (
 )
 
 // dhthandler specifies the signature of functions that handle DHT messages.
+// The request is reused once the response is written, so handlers must copy
+// the parts of it they keep.
 type dhtHandler func(context.Context, peer.ID, *pb.Message) (*pb.Message, error)
 
 func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
@@ -29,6 +33,11 @@ func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 		return dht.handlePing
 	}
 
+	if dht.observer {
+		// observers never store nor serve records
+		return nil
+	}
+
 	if dht.enableValues {
 		switch t {
 		case pb.Message_GET_VALUE:
@@ -50,6 +59,65 @@ func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 	return nil
 }
 
+// MessageHandler describes how the DHT handles a type of request, see
+// Handlers.
+type MessageHandler struct {
+	Type    pb.Message_MessageType
+	Handled bool
+	// Reason tells why an unhandled type is not, e.g. "values disabled".
+	Reason string `json:",omitempty"`
+	// Translated lists the protocols whose requests of this type are
+	// translated by a protocol shim (see ServeProtocol) before being handled.
+	Translated []protocol.ID `json:",omitempty"`
+}
+
+// Handlers returns the dispatch table of the DHT: which request types it
+// handles, and why it doesn't handle the others. Requests are only handled
+// over the protocols the DHT serves, that is in server mode.
+func (dht *IpfsDHT) Handlers() []MessageHandler {
+	var translated []protocol.ID
+	for p := range dht.protocolShims {
+		translated = append(translated, p)
+	}
+	sort.Slice(translated, func(i, j int) bool { return translated[i] < translated[j] })
+
+	types := make([]pb.Message_MessageType, 0, len(pb.Message_MessageType_name))
+	for t := range pb.Message_MessageType_name {
+		types = append(types, pb.Message_MessageType(t))
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	hs := make([]MessageHandler, 0, len(types))
+	for _, t := range types {
+		h := MessageHandler{Type: t, Handled: dht.handlerForMsgType(t) != nil}
+		if h.Handled {
+			h.Translated = append([]protocol.ID(nil), translated...)
+		} else {
+			h.Reason = dht.unhandledReason(t)
+		}
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+// unhandledReason tells why handlerForMsgType has no handler for t.
+func (dht *IpfsDHT) unhandledReason(t pb.Message_MessageType) string {
+	switch t {
+	case pb.Message_GET_VALUE, pb.Message_PUT_VALUE:
+		if dht.observer {
+			return "observer mode"
+		}
+		return "values disabled"
+	case pb.Message_ADD_PROVIDER, pb.Message_GET_PROVIDERS:
+		if dht.observer {
+			return "observer mode"
+		}
+		return "providers disabled"
+	default:
+		return "unknown type"
+	}
+}
+
 func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, err error) {
 	// first, is there even a key?
 	k := pmes.GetKey()
@@ -65,6 +133,9 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, err
 	}
 	resp.Record = rec
+	if rec != nil {
+		dht.countServedRecord(ctx, string(k))
+	}
 
 	// Find closest peer on given cluster to desired key and reply with that info
 	closer := dht.betterPeersToQuery(pmes, p, dht.bucketSize)
@@ -72,9 +143,9 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
 		closerinfos := pstore.PeerInfos(dht.peerstore, closer)
 		for _, pi := range closerinfos {
-			logger.Debugf("handleGetValue returning closer peer: '%s'", pi.ID)
+			dht.requestLogger(ctx).Debugf("handleGetValue returning closer peer: '%s'", pi.ID)
 			if len(pi.Addrs) < 1 {
-				logger.Warnw("no addresses on peer being sent",
+				dht.requestLogger(ctx).Warnw("no addresses on peer being sent",
 					"local", dht.self,
 					"to", p,
 					"sending", pi.ID,
@@ -89,10 +160,10 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 }
 
 func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.Record, error) {
-	logger.Debugf("%s handleGetValue looking into ds", dht.self)
+	dht.requestLogger(ctx).Debugf("%s handleGetValue looking into ds", dht.self)
 	dskey := convertToDsKey(k)
 	buf, err := dht.datastore.Get(ctx, dskey)
-	logger.Debugf("%s handleGetValue looking into ds GOT %v", dht.self, buf)
+	dht.requestLogger(ctx).Debugf("%s handleGetValue looking into ds GOT %v", dht.self, buf)
 
 	if err == ds.ErrNotFound {
 		return nil, nil
@@ -104,24 +175,24 @@ func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.R
 	}
 
 	// if we have the value, send it back
-	logger.Debugf("%s handleGetValue success!", dht.self)
+	dht.requestLogger(ctx).Debugf("%s handleGetValue success!", dht.self)
 
 	rec := new(recpb.Record)
 	err = proto.Unmarshal(buf, rec)
 	if err != nil {
-		logger.Debug("failed to unmarshal DHT record from datastore")
+		dht.requestLogger(ctx).Debug("failed to unmarshal DHT record from datastore")
 		return nil, err
 	}
 
 	var recordIsBad bool
 	recvtime, err := internal.ParseRFC3339(rec.GetTimeReceived())
 	if err != nil {
-		logger.Info("either no receive time set on record, or it was invalid: ", err)
+		dht.requestLogger(ctx).Info("either no receive time set on record, or it was invalid: ", err)
 		recordIsBad = true
 	}
 
 	if time.Since(recvtime) > dht.maxRecordAge {
-		logger.Debug("old record found, tossing.")
+		dht.requestLogger(ctx).Debug("old record found, tossing.")
 		recordIsBad = true
 	}
 
@@ -132,7 +203,7 @@ func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.R
 	if recordIsBad {
 		err := dht.datastore.Delete(ctx, dskey)
 		if err != nil {
-			logger.Error("Failed to delete bad record from datastore: ", err)
+			dht.requestLogger(ctx).Error("Failed to delete bad record from datastore: ", err)
 		}
 
 		return nil, nil // can treat this as not having the record at all
@@ -154,7 +225,7 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 
 	rec := pmes.GetRecord()
 	if rec == nil {
-		logger.Debugw("got nil record from", "from", p)
+		dht.requestLogger(ctx).Debugw("got nil record from", "from", p)
 		return nil, errors.New("nil record")
 	}
 
@@ -165,21 +236,18 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	cleanRecord(rec)
 
 	// Make sure the record is valid (not expired, valid signature etc)
-	if err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue()); err != nil {
-		logger.Infow("bad dht record in PUT", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
+	if err = dht.validateRecord(ctx, string(rec.GetKey()), rec.GetValue()); err != nil {
+		dht.requestLogger(ctx).Infow("bad dht record in PUT", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
 		return nil, err
 	}
 
 	dskey := convertToDsKey(rec.GetKey())
 
-	// fetch the striped lock for this key
-	var indexForLock byte
-	if len(rec.GetKey()) == 0 {
-		indexForLock = 0
-	} else {
-		indexForLock = rec.GetKey()[len(rec.GetKey())-1]
-	}
-	lk := &dht.stripedPutLocks[indexForLock]
+	lk := dht.putLock(rec.GetKey())
+	// the evictions take the put locks of the evicted keys, so they run once
+	// lk is released
+	var evicted []quotaEntry
+	defer func() { dht.evictStored(ctx, p, evicted) }()
 	lk.Lock()
 	defer lk.Unlock()
 
@@ -195,11 +263,11 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		recs := [][]byte{rec.GetValue(), existing.GetValue()}
 		i, err := dht.Validator.Select(string(rec.GetKey()), recs)
 		if err != nil {
-			logger.Warnw("dht record passed validation but failed select", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
+			dht.requestLogger(ctx).Warnw("dht record passed validation but failed select", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
 			return nil, err
 		}
 		if i != 0 {
-			logger.Infow("DHT record in PUT older than existing record (ignoring)", "peer", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()))
+			dht.requestLogger(ctx).Infow("DHT record in PUT older than existing record (ignoring)", "peer", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()))
 			return nil, errors.New("old record")
 		}
 	}
@@ -212,8 +280,16 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, err
 	}
 
-	err = dht.datastore.Put(ctx, dskey, data)
-	return pmes, err
+	entry := quotaEntry{key: string(rec.GetKey()), size: int64(len(data))}
+	if !dht.admitStored(ctx, p, entry) {
+		return nil, errors.New("record exceeds the storage quota")
+	}
+
+	if err := dht.storeRecord(ctx, rec, data); err != nil {
+		return pmes, err
+	}
+	evicted = dht.chargeStored(p, entry)
+	return pmes, nil
 }
 
 // returns nil, nil when either nothing is found or the value found doesn't properly validate.
@@ -224,31 +300,33 @@ func (dht *IpfsDHT) getRecordFromDatastore(ctx context.Context, dskey ds.Key) (*
 		return nil, nil
 	}
 	if err != nil {
-		logger.Errorw("error retrieving record from datastore", "key", dskey, "error", err)
+		dht.requestLogger(ctx).Errorw("error retrieving record from datastore", "key", dskey, "error", err)
 		return nil, err
 	}
 	rec := new(recpb.Record)
 	err = proto.Unmarshal(buf, rec)
 	if err != nil {
 		// Bad data in datastore, log it but don't return an error, we'll just overwrite it
-		logger.Errorw("failed to unmarshal record from datastore", "key", dskey, "error", err)
+		dht.requestLogger(ctx).Errorw("failed to unmarshal record from datastore", "key", dskey, "error", err)
 		return nil, nil
 	}
 
-	err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue())
+	err = dht.validateRecord(ctx, string(rec.GetKey()), rec.GetValue())
 	if err != nil {
 		// Invalid record in datastore, probably expired but don't return an error,
 		// we'll just overwrite it
-		logger.Debugw("local record verify failed", "key", rec.GetKey(), "error", err)
+		dht.requestLogger(ctx).Debugw("local record verify failed", "key", rec.GetKey(), "error", err)
 		return nil, nil
 	}
 
 	return rec, nil
 }
 
+// handlePing answers with an empty PING message, whatever the request
+// carries, see pb.CapPing.
 func (dht *IpfsDHT) handlePing(_ context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
-	logger.Debugf("%s Responding to ping from %s!\n", dht.self, p)
-	return pmes, nil
+	dht.logger.Debugf("%s Responding to ping from %s!\n", dht.self, p)
+	return pb.NewMessage(pb.Message_PING, nil, 0), nil
 }
 
 func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
@@ -292,6 +370,7 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.M
 	// possibly an over-allocation but this array is temporary anyways.
 	withAddresses := make([]peer.AddrInfo, 0, len(closestinfos))
 	for _, pi := range closestinfos {
+		pi.Addrs = dht.applyRelayAddrPolicy(pi.Addrs)
 		if len(pi.Addrs) > 0 {
 			withAddresses = append(withAddresses, pi)
 		}
@@ -311,27 +390,25 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 
 	resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
 
-	// setup providers
-	providers, err := dht.providerStore.GetProviders(ctx, key)
-	if err != nil {
-		return nil, err
-	}
-
-	filtered := make([]peer.AddrInfo, len(providers))
-	for i, provider := range providers {
-		filtered[i] = peer.AddrInfo{
-			ID:    provider.ID,
-			Addrs: dht.filterAddrs(provider.Addrs),
+	// setup providers, unless denied
+	var providers []peer.AddrInfo
+	if !dht.deniedProviders(ctx, key, pmes.GetType()) {
+		var err error
+		if providers, err = dht.providerStore.GetProviders(ctx, key); err != nil {
+			return nil, err
 		}
 	}
 
-	resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), filtered)
+	resp.ProviderPeers = dht.compactProviders(providers)
 
 	// Also send closer peers.
 	closer := dht.betterPeersToQuery(pmes, p, dht.bucketSize)
 	if closer != nil {
 		// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
 		infos := pstore.PeerInfos(dht.peerstore, closer)
+		for i := range infos {
+			infos[i].Addrs = dht.applyRelayAddrPolicy(infos[i].Addrs)
+		}
 		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
 	}
 
@@ -339,14 +416,24 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 }
 
 func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
-	key := pmes.GetKey()
+	// the provider store keeps the key after we return, while pmes is reused
+	key := bytes.Clone(pmes.GetKey())
 	if len(key) > 80 {
 		return nil, fmt.Errorf("handleAddProvider key size too large")
 	} else if len(key) == 0 {
 		return nil, fmt.Errorf("handleAddProvider key is empty")
 	}
 
-	logger.Debugw("adding provider", "from", p, "key", internal.LoggableProviderRecordBytes(key))
+	if dht.deniedProviders(ctx, key, pmes.GetType()) {
+		dht.requestLogger(ctx).Debugw("ignoring provider of denied key", "from", p, "key", internal.LoggableProviderRecordBytes(key))
+		return nil, nil
+	}
+
+	if !dht.spamKeys.allow(ctx, key, time.Now()) {
+		return nil, fmt.Errorf("handleAddProvider key is flooded")
+	}
+
+	dht.requestLogger(ctx).Debugw("adding provider", "from", p, "key", internal.LoggableProviderRecordBytes(key))
 
 	// add provider should use the address given in the message
 	pinfos := pb.PBPeersToPeerInfos(pmes.GetProviderPeers())
@@ -354,19 +441,28 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 		if pi.ID != p {
 			// we should ignore this provider record! not from originator.
 			// (we should sign them and check signature later...)
-			logger.Debugw("received provider from wrong peer", "from", p, "peer", pi.ID)
+			dht.requestLogger(ctx).Debugw("received provider from wrong peer", "from", p, "peer", pi.ID)
 			continue
 		}
 
 		if len(pi.Addrs) < 1 {
-			logger.Debugw("no valid addresses for provider", "from", p)
+			dht.requestLogger(ctx).Debugw("no valid addresses for provider", "from", p)
 			continue
 		}
 
 		// We run the addrs filter after checking for the length,
 		// this allows transient nodes with varying /p2p-circuit addresses to still have their anouncement go through.
 		addrs := dht.filterAddrs(pi.Addrs)
-		dht.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: pi.ID, Addrs: addrs})
+		entry := quotaEntry{provider: true, key: string(key), size: int64(len(key) + len(p))}
+		if !dht.admitStored(ctx, p, entry) {
+			dht.requestLogger(ctx).Debugw("provider record exceeds the storage quota", "from", p)
+			continue
+		}
+		if err := dht.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: pi.ID, Addrs: addrs}); err != nil {
+			dht.requestLogger(ctx).Debugw("failed to add provider", "from", p, "error", err)
+			continue
+		}
+		dht.evictStored(ctx, p, dht.chargeStored(p, entry))
 	}
 
 	return nil, nil
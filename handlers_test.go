@@ -88,6 +88,37 @@ func TestBadMessage(t *testing.T) {
 	}
 }
 
+func TestHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dht := setupDHT(ctx, t, false, DisableValues())
+
+	handlers := dht.Handlers()
+	if len(handlers) != len(pb.Message_MessageType_name) {
+		t.Fatalf("expected %d message types, got %d", len(pb.Message_MessageType_name), len(handlers))
+	}
+	for _, h := range handlers {
+		switch h.Type {
+		case pb.Message_GET_VALUE, pb.Message_PUT_VALUE:
+			if h.Handled || h.Reason != "values disabled" {
+				t.Errorf("expected %s to be disabled with values, got %+v", h.Type, h)
+			}
+		default:
+			if !h.Handled || h.Reason != "" {
+				t.Errorf("expected %s to be handled, got %+v", h.Type, h)
+			}
+		}
+		if h.Handled != (dht.handlerForMsgType(h.Type) != nil) {
+			t.Errorf("dispatch table disagrees with the dispatcher for %s", h.Type)
+		}
+	}
+
+	if cfg := dht.Config(); len(cfg.Handlers) != len(handlers) {
+		t.Errorf("expected the config to include the dispatch table")
+	}
+}
+
 func BenchmarkHandleFindPeer(b *testing.B) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// healthCheckPeers is the maximum number of routing table peers asked for our
+// own closest peers during a health check.
+const healthCheckPeers = 3
+
+// ErrDHTClosed is returned by the health checks once the DHT has been closed.
+var ErrDHTClosed = errors.New("dht closed")
+
+// Healthy checks that the DHT is operational: it must not be closed, its
+// routing table must not be empty and at least one of the peers closest to us
+// must answer a FIND_NODE request for our own peer ID. It is cheap enough to
+// back a liveness probe.
+func (dht *IpfsDHT) Healthy(ctx context.Context) error {
+	if dht.ctx.Err() != nil {
+		return ErrDHTClosed
+	}
+
+	peers := dht.routingTable.NearestPeers(dht.selfKey, healthCheckPeers)
+	if len(peers) == 0 {
+		return kb.ErrLookupFailure
+	}
+
+	var lastErr error
+	for _, p := range peers {
+		if _, err := dht.protoMessenger.GetClosestPeers(ctx, p, dht.self); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("self lookup failed on %d closest peers: %w", len(peers), lastErr)
+}
+
+// Ready returns true once the DHT completed its first routing table refresh
+// and has peers in its routing table. It is intended to back a readiness
+// probe, use WaitReady for custom readiness criteria.
+func (dht *IpfsDHT) Ready() bool {
+	return dht.ctx.Err() == nil && !dht.rtRefreshManager.LastRefreshAt().IsZero() && dht.routingTable.Size() > 0
+}
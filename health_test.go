@@ -0,0 +1,31 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthyAndReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false)
+	d2 := setupDHT(ctx, t, false)
+
+	require.ErrorIs(t, d1.Healthy(ctx), kb.ErrLookupFailure)
+	require.False(t, d1.Ready())
+
+	connect(t, ctx, d1, d2)
+	require.NoError(t, d1.Healthy(ctx))
+
+	require.NoError(t, <-d1.RefreshRoutingTable())
+	require.Eventually(t, d1.Ready, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, d1.Close())
+	require.ErrorIs(t, d1.Healthy(ctx), ErrDHTClosed)
+	require.False(t, d1.Ready())
+}
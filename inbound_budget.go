@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons an inbound request is shed, reported in the shed_inbound_requests
+// metric.
+const (
+	shedQueueFull = "queue_full"
+	shedTimeout   = "queue_timeout"
+)
+
+// handlerBudget bounds the number of inbound requests being handled
+// concurrently. Requests over the bound wait for a slot for up to
+// queueTimeout, while at most as many requests as there are slots wait, and
+// are shed otherwise.
+//
+// A nil *handlerBudget does not limit anything.
+type handlerBudget struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	waiting      atomic.Int32
+}
+
+func newHandlerBudget(max int, queueTimeout time.Duration) *handlerBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &handlerBudget{slots: make(chan struct{}, max), queueTimeout: queueTimeout}
+}
+
+// acquire takes a slot for handling a request. When the request is shed, it
+// returns the reason and false.
+func (b *handlerBudget) acquire(ctx context.Context) (string, bool) {
+	if b == nil {
+		return "", true
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return "", true
+	default:
+	}
+	if b.queueTimeout <= 0 {
+		return shedQueueFull, false
+	}
+	if int(b.waiting.Add(1)) > cap(b.slots) {
+		b.waiting.Add(-1)
+		return shedQueueFull, false
+	}
+	defer b.waiting.Add(-1)
+
+	timer := time.NewTimer(b.queueTimeout)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return "", true
+	case <-timer.C:
+		return shedTimeout, false
+	case <-ctx.Done():
+		return shedTimeout, false
+	}
+}
+
+// saturated reports whether all the slots are taken.
+func (b *handlerBudget) saturated() bool {
+	return b != nil && len(b.slots) == cap(b.slots)
+}
+
+// release gives back the slot taken by acquire.
+func (b *handlerBudget) release() {
+	if b == nil {
+		return
+	}
+	<-b.slots
+}
@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerBudget(t *testing.T) {
+	ctx := context.Background()
+
+	b := newHandlerBudget(1, 0)
+	_, ok := b.acquire(ctx)
+	require.True(t, ok)
+	reason, ok := b.acquire(ctx)
+	require.False(t, ok)
+	require.Equal(t, shedQueueFull, reason)
+	b.release()
+	_, ok = b.acquire(ctx)
+	require.True(t, ok)
+	b.release()
+
+	b = newHandlerBudget(1, 50*time.Millisecond)
+	_, ok = b.acquire(ctx)
+	require.True(t, ok)
+	reason, ok = b.acquire(ctx)
+	require.False(t, ok)
+	require.Equal(t, shedTimeout, reason)
+
+	// one request may wait, and gets the slot once released
+	acquired := make(chan bool)
+	go func() {
+		_, ok := b.acquire(ctx)
+		acquired <- ok
+	}()
+	require.Eventually(t, func() bool { return b.waiting.Load() == 1 }, time.Second, time.Millisecond)
+	reason, ok = b.acquire(ctx)
+	require.False(t, ok)
+	require.Equal(t, shedQueueFull, reason)
+	b.release()
+	require.True(t, <-acquired)
+	b.release()
+
+	require.Nil(t, newHandlerBudget(0, time.Second))
+}
+
+func TestInboundHandlerBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false, InboundHandlerBudget(1, 0))
+	connect(t, ctx, a, b)
+	require.NoError(t, a.Ping(ctx, b.self))
+
+	// requests are shed while the only handler is busy
+	_, ok := b.handlerBudget.acquire(ctx)
+	require.True(t, ok)
+	require.Error(t, a.Ping(ctx, b.self))
+	b.handlerBudget.release()
+	require.NoError(t, a.Ping(ctx, b.self))
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"context"
 	"fmt"
+	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/ipfs/boxo/ipns"
@@ -12,21 +14,99 @@ import (
 	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/connmgr"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
 )
 
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
 const DefaultPrefix protocol.ID = amino.ProtocolPrefix
 
+// The default durations of the dial backoff.
+const (
+	DefaultDialBackoffBase = 30 * time.Second
+	DefaultDialBackoffMax  = 30 * time.Minute
+)
+
 // ModeOpt describes what mode the dht should operate in
 type ModeOpt int
 
+// ConnectionPreference describes how strongly lookups prefer connected peers
+type ConnectionPreference int
+
+// RelayAddrPolicy describes how relayed addresses are handled
+type RelayAddrPolicy int
+
+// DisconnectPolicy describes what happens to routing table peers that
+// disconnect
+type DisconnectPolicy int
+
+// SpamKeyPolicy describes how the provider records of flooded keys are handled
+type SpamKeyPolicy int
+
+// SpamKeyEvent reports a key receiving an anomalous ADD_PROVIDER rate
+type SpamKeyEvent struct {
+	Key      []byte
+	Start    time.Time
+	End      time.Time // zero while the flood lasts
+	Rate     float64   // estimated records per window when reported
+	Rejected int       // records rejected so far
+}
+
+// RecordCandidate is a distinct record value found by a lookup along with the peers that returned it
+type RecordCandidate struct {
+	Value []byte
+	From  []peer.ID
+}
+
+// ConflictResolution is the outcome of a ConflictResolver
+type ConflictResolution struct {
+	Value   []byte
+	Correct []peer.ID
+}
+
+// ConflictResolver chooses the winner among divergent records
+type ConflictResolver func(key string, candidates []RecordCandidate, best []byte, closest []peer.ID) ConflictResolution
+
+// MisplacedKey is a stored key the local peer is no longer among the closest
+// peers to
+type MisplacedKey struct {
+	Key       string
+	Providers bool
+	Closest   []peer.ID
+}
+
+// SelfAuditReport is the outcome of a self-audit of the stored keys
+type SelfAuditReport struct {
+	At        time.Time
+	Sampled   int
+	Placed    int
+	Misplaced []MisplacedKey
+}
+
+// PlacedRatio returns the ratio of the sampled keys the local peer is among
+// the closest peers to, 1 if no key was sampled.
+func (r SelfAuditReport) PlacedRatio() float64 {
+	if r.Sampled == 0 {
+		return 1
+	}
+	return float64(r.Placed) / float64(r.Sampled)
+}
+
+// ProtocolShim translates the messages of a legacy protocol version to and
+// from the current one
+type ProtocolShim struct {
+	Request  func(req *pb.Message) (*pb.Message, error)
+	Response func(resp *pb.Message) (*pb.Message, error)
+}
+
 // QueryFilterFunc is a filter applied when considering peers to dial when querying
 type QueryFilterFunc func(dht interface{}, ai peer.AddrInfo) bool
 
@@ -34,6 +114,113 @@ type QueryFilterFunc func(dht interface{}, ai peer.AddrInfo) bool
 // the local route table.
 type RouteTableFilterFunc func(dht interface{}, p peer.ID) bool
 
+// PeerCandidate is a peer a lookup may query next, with what is known of it
+type PeerCandidate struct {
+	ID             peer.ID
+	Addrs          []ma.Multiaddr
+	Distance       []byte        // XOR distance to the target
+	RTT            time.Duration // zero if unknown
+	Connected      bool
+	InRoutingTable bool
+	BackedOff      bool // failed its last dials
+}
+
+// PeerRanker orders the candidate peers of a lookup step
+type PeerRanker func(target []byte, candidates []PeerCandidate) []peer.ID
+
+// DialRankFunc orders the candidate peers a query is about to dial
+type DialRankFunc func(dht interface{}, candidates []peer.AddrInfo) []peer.AddrInfo
+
+// Location is where an IP address is, as found by a GeoResolver. Unknown
+// fields are left empty.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, e.g. "DE".
+	Country string `json:",omitempty"`
+	// Region is a free-form region, e.g. "eu-central" or "Hesse".
+	Region string `json:",omitempty"`
+	// ASN is the number of the autonomous system announcing the address.
+	ASN uint32 `json:",omitempty"`
+}
+
+// GeoResolver locates an IP address.
+type GeoResolver func(ctx context.Context, ip netip.Addr) (Location, error)
+
+// DialFailure describes a failed dial of a peer by a lookup.
+type DialFailure struct {
+	Peer peer.ID
+	// Addrs are the addresses known for the peer.
+	Addrs []ma.Multiaddr
+	// AddrErrors are the errors of the addresses dialed, when the swarm
+	// reported them. At most 16 are reported.
+	AddrErrors []AddrError
+	Duration   time.Duration
+	Err        error
+}
+
+// AddrError is the error dialing a peer on one of its addresses.
+type AddrError struct {
+	Addr ma.Multiaddr
+	Err  error
+}
+
+// DialFailureHook is called for every failed dial of a lookup.
+type DialFailureHook func(ctx context.Context, f DialFailure)
+
+// OutboundHook is called before every outbound RPC, and may mutate, delay or
+// veto it by returning an error.
+type OutboundHook func(ctx context.Context, p peer.ID, msg *pb.Message) error
+
+// PeerBlocker blocks and unblocks the connections of peers, like the
+// BasicConnectionGater of go-libp2p.
+type PeerBlocker interface {
+	BlockPeer(p peer.ID) error
+	UnblockPeer(p peer.ID) error
+}
+
+// RequestExtensionHook is called by servers for every request they respond
+// to, returning the extension data of the response, nil for none.
+type RequestExtensionHook func(ctx context.Context, p peer.ID, req *pb.Message) []byte
+
+// ResponseExtensionHook is called for every response carrying extension data.
+type ResponseExtensionHook func(ctx context.Context, p peer.ID, resp *pb.Message)
+
+// SignedRequest is a storage request whose signature was verified, as
+// marshaled by its sender.
+type SignedRequest struct {
+	From    peer.ID
+	Message []byte
+}
+
+// ProviderFilterFunc filters, rewrites or reorders a batch of provider
+// records found for key before they are yielded
+type ProviderFilterFunc func(ctx context.Context, key []byte, provs []peer.AddrInfo) []peer.AddrInfo
+
+// DialBackoffCache is a negative cache of the peers that recently failed to
+// dial, consulted by the queries before dialing a peer.
+type DialBackoffCache interface {
+	// BackedOff reports whether dialing p should be skipped.
+	BackedOff(p peer.ID) bool
+	// DialFailed records a dial failure to p.
+	DialFailed(p peer.ID)
+	// DialSucceeded records a successful dial to p.
+	DialSucceeded(p peer.ID)
+}
+
+// Denylist tells the keys, multihashes, whose providers a server refuses to
+// store and serve.
+type Denylist interface {
+	Denied(key []byte) bool
+}
+
+// PeerGreylist counts the protocol violations of peers, greylisting the ones
+// committing too many
+type PeerGreylist interface {
+	// Strike records a violation of p, reporting whether it got p greylisted.
+	Strike(p peer.ID) bool
+	// Greylisted reports whether p is greylisted.
+	Greylisted(p peer.ID) bool
+}
+
 // Config is a structure containing all the options that can be used when constructing a DHT.
 type Config struct {
 	Datastore              ds.Batching
@@ -45,6 +232,7 @@ type Config struct {
 	BucketSize             int
 	Concurrency            int
 	Resiliency             int
+	ResiliencyChanged      bool // if false, Resiliency is lowered to a smaller BucketSize
 	MaxRecordAge           time.Duration
 	EnableProviders        bool
 	EnableValues           bool
@@ -53,6 +241,21 @@ type Config struct {
 	LookupCheckConcurrency int
 	MsgSenderBuilder       func(h host.Host, protos []protocol.ID) pb.MessageSenderWithDisconnect
 
+	// LookupCheckTimeout bounds the FIND_NODE request checking that a newly
+	// found server answers before adding it to the routing table; zero
+	// means RoutingTable.RefreshQueryTimeout. DisableLookupCheck adds the
+	// servers without checking them.
+	LookupCheckTimeout time.Duration
+	DisableLookupCheck bool
+
+	// SelfRecord includes our signed peer record in the responses carrying
+	// closer peers.
+	SelfRecord bool
+
+	// PingProbes advertises pb.CapPing and probes the routing table peers
+	// advertising it with a PING instead of a FIND_NODE.
+	PingProbes bool
+
 	RoutingTable struct {
 		RefreshQueryTimeout time.Duration
 		RefreshInterval     time.Duration
@@ -61,11 +264,30 @@ type Config struct {
 		CheckInterval       time.Duration
 		PeerFilter          RouteTableFilterFunc
 		DiversityFilter     peerdiversity.PeerIPGroupFilter
+		Compact             bool
+		// DisconnectPolicy applies to the peers that disconnect, after
+		// DisconnectGrace for the policies probing them.
+		DisconnectPolicy DisconnectPolicy
+		DisconnectGrace  time.Duration
+		// Probing replaces the liveness checks run before every refresh
+		// with probes scheduled per peer, between MinInterval and
+		// MaxInterval apart, at most Rate per second. A zero Rate keeps
+		// the refresh checks.
+		Probing struct {
+			MinInterval time.Duration
+			MaxInterval time.Duration
+			Rate        float64
+		}
 	}
 
 	BootstrapPeers func() []peer.AddrInfo
 	AddressFilter  func([]ma.Multiaddr) []ma.Multiaddr
 	OnRequestHook  func(ctx context.Context, s network.Stream, req *pb.Message)
+	OnDialFailure  DialFailureHook
+	OnOutbound     OutboundHook
+
+	OnRequestExtension  RequestExtensionHook
+	OnResponseExtension ResponseExtensionHook
 
 	// test specific Config options
 	DisableFixLowPeers          bool
@@ -73,6 +295,266 @@ type Config struct {
 
 	EnableOptimisticProvide       bool
 	OptimisticProvideJobsPoolSize int
+
+	// RememberedPeers configures the persisted set of long-lived routing
+	// table peers used as fallback bootstrappers on the next start.
+	RememberedPeers struct {
+		Size   int
+		MinAge time.Duration
+	}
+
+	// MaxOutboundRequests bounds the number of simultaneous outbound query
+	// RPCs across all lookups. Zero means unlimited.
+	MaxOutboundRequests int
+
+	// DialRanker orders the candidate peers of a lookup before they are
+	// dialed. If nil, candidates are queried closest first.
+	DialRanker DialRankFunc
+
+	// PeerRanker, if set, orders the candidate peers of every lookup step
+	// in place of the DialRanker and connection preference.
+	PeerRanker PeerRanker
+
+	// RefusedProtocols lists the protocols whose speakers are kept out of
+	// the routing table, to isolate forked networks.
+	RefusedProtocols []protocol.ID
+
+	// GeoResolver locates the routing table peers, nil to leave them
+	// unlocated.
+	GeoResolver GeoResolver
+
+	// ProviderFilter is applied to the providers found by FindProviders
+	// before they are yielded. If nil, all of them are.
+	ProviderFilter ProviderFilterFunc
+
+	// DialBackoff configures the backoff applied by queries to the peers
+	// that recently failed to dial. A zero Base disables it. Shared is the
+	// cache used instead of one derived from Base and Max, if set.
+	DialBackoff struct {
+		Base   time.Duration
+		Max    time.Duration
+		Shared DialBackoffCache
+	}
+
+	// RequestTimeout derives the timeout of the requests sent to a peer from
+	// its round trip time: Multiplier times the average RTT, within
+	// [Floor, Ceiling], Ceiling when the RTT is unknown. Zero Multiplier
+	// disables it.
+	RequestTimeout struct {
+		Floor      time.Duration
+		Ceiling    time.Duration
+		Multiplier float64
+	}
+
+	// CircuitBreaker stops the RPCs to a peer after Failures consecutive
+	// failures within Window, until Cooldown elapsed. Zero Failures
+	// disables it.
+	CircuitBreaker struct {
+		Failures int
+		Window   time.Duration
+		Cooldown time.Duration
+	}
+
+	// SelfAudit samples up to Sample of the stored keys every Interval and
+	// checks that the server is still among the closest peers to them,
+	// passing the outcome to Report. Zero Interval disables it.
+	SelfAudit struct {
+		Interval time.Duration
+		Sample   int
+		Report   func(SelfAuditReport)
+	}
+
+	// RequestSigning controls the signatures of the storage RPCs: Sign signs
+	// ours, Require rejects the ones of other peers without a valid
+	// signature, passing the others to Audit if set.
+	RequestSigning struct {
+		Sign    bool
+		Require bool
+		Audit   func(context.Context, SignedRequest)
+	}
+
+	// Greylist, if set, is told about the peers sending malformed or
+	// unexpected messages, and their streams are reset while greylisted.
+	Greylist PeerGreylist
+
+	Bans struct {
+		// Propagate, if set, blocks the connections of the banned peers.
+		Propagate PeerBlocker
+		// Source, if set, bans the peers it refuses to dial.
+		Source connmgr.ConnectionGater
+	}
+
+	// Denylist, if set, is consulted by the GET_PROVIDERS and ADD_PROVIDER
+	// handlers.
+	Denylist Denylist
+
+	// SpamKeys flags the keys receiving more than Threshold ADD_PROVIDER
+	// records per Window, handling their records according to Policy, and
+	// reports the floods to Report. Zero Threshold disables it.
+	SpamKeys struct {
+		Threshold int
+		Window    time.Duration
+		Policy    SpamKeyPolicy
+		Report    func(SpamKeyEvent)
+	}
+
+	// OriginQuota bounds the records, provider records and bytes of them a
+	// single peer may have stored on this server, the oldest ones being
+	// evicted to make room for new ones. Zero limits are unlimited.
+	OriginQuota struct {
+		Records   int
+		Providers int
+		Bytes     int64
+	}
+
+	// BackgroundCrawl looks up a key of each of the 2^Bits regions of the
+	// keyspace in turn, one every Interval, to seed the lookups with the
+	// peers found. Zero Interval disables it, and Paused suspends it, as the
+	// low-power profile does.
+	BackgroundCrawl struct {
+		Interval time.Duration
+		Bits     int
+		Paused   bool
+	}
+
+	// ConnectionPreference controls whether lookups favor already connected
+	// peers over closer ones that need a new dial.
+	ConnectionPreference ConnectionPreference
+
+	// RelayAddrPolicy controls how relayed addresses learned from other
+	// peers are stored and returned.
+	RelayAddrPolicy RelayAddrPolicy
+
+	// FindPeerVerifyTimeout bounds the connection attempt FindPeer makes to
+	// verify the addresses it returns. Zero disables verification.
+	FindPeerVerifyTimeout time.Duration
+
+	// NegativeCacheTTL is how long FindPeer and FindProviders misses are
+	// cached. Zero disables the cache.
+	NegativeCacheTTL time.Duration
+
+	// ProvideScheduler bounds the provides queued with ScheduleProvide: the
+	// number of concurrent provides, the provides started per second (0
+	// meaning unlimited) and the RPCs they send per BudgetInterval (0
+	// meaning unlimited).
+	ProvideScheduler struct {
+		Workers        int
+		Rate           float64
+		Budget         int
+		BudgetInterval time.Duration
+	}
+
+	// ReprovideRefresh makes Provide skip the closest peers holding a
+	// provider record of ours stored less than ReprovideRefresh ago. Zero
+	// disables it.
+	ReprovideRefresh time.Duration
+
+	// NamespaceReplication overrides, per record namespace, the number of
+	// closest peers PutValue stores records with.
+	NamespaceReplication map[string]int
+
+	// KeyspaceGaps raises the replication of the provider records of the
+	// keys InGap reports in a region of the keyspace with abnormally few
+	// reachable servers, by ExtraReplication peers. A nil InGap disables it.
+	KeyspaceGaps struct {
+		InGap            func(id kb.ID) bool
+		ExtraReplication int
+	}
+
+	// ConflictResolver picks the winner among the divergent records found by
+	// SearchValue.
+	ConflictResolver ConflictResolver
+
+	// ValueCorrection controls the push-back of the best record to the peers
+	// SearchValue found holding an outdated one. MaxPeers caps the corrected
+	// peers per query and Rate the corrections per second, 0 meaning no limit.
+	ValueCorrection struct {
+		Disabled bool
+		MaxPeers int
+		Rate     float64
+	}
+
+	// PassiveCache bounds the cache of records and provider entries a client
+	// mode node observes during its own lookups. A zero Size disables it.
+	PassiveCache struct {
+		Size int
+		TTL  time.Duration
+	}
+
+	// ProxyClients are the peers we run lookups for, over the proxy protocol.
+	ProxyClients []peer.ID
+
+	// BandwidthAccountingPeers is the number of most recently active peers
+	// whose bandwidth is accounted. Zero disables per-peer accounting.
+	BandwidthAccountingPeers int
+
+	// LatencyBuckets are the bucket boundaries of the latency histograms, in
+	// milliseconds, nil for the metrics.DefaultLatencyBuckets.
+	LatencyBuckets []float64
+
+	// SlowRequestThreshold is the handler duration above which inbound
+	// requests are logged and counted as slow. Zero disables it.
+	SlowRequestThreshold time.Duration
+
+	// Logger is the logger of the DHT instance. When nil, the package-wide
+	// "dht" logger is used.
+	Logger *zap.Logger
+
+	// Capabilities are the optional protocol features advertised in our
+	// responses.
+	Capabilities pb.Capabilities
+
+	// ProtocolShims are the additional protocols served, with the shims
+	// translating their messages.
+	ProtocolShims map[protocol.ID]ProtocolShim
+
+	// KeyspaceHash maps keys and peer IDs into the Kademlia keyspace. A nil
+	// Hash is sha256. Name is part of the protocol ID.
+	KeyspaceHash struct {
+		Name string
+		Hash func([]byte) []byte
+	}
+
+	// ShardBits is the number of leading keyspace bits identifying a shard,
+	// 0 meaning that the whole keyspace is a single shard.
+	ShardBits int
+
+	// StreamPool configures the outbound streams of the default message
+	// sender, used when MsgSenderBuilder is nil.
+	StreamPool net.StreamPoolConfig
+
+	// QueryWorkers bounds the goroutines sending the requests of the
+	// lookups, 0 meaning unbounded.
+	QueryWorkers int
+
+	// InboundHandlers bounds the inbound requests handled concurrently.
+	InboundHandlers struct {
+		// Max is the number of requests, 0 meaning unbounded.
+		Max int
+		// QueueTimeout is how long a request over Max waits for a handler
+		// before its stream is reset, 0 resetting it right away.
+		QueueTimeout time.Duration
+	}
+
+	// ProviderWriteBehind configures the write-behind of the default
+	// provider store, disabled when its Interval is 0.
+	ProviderWriteBehind struct {
+		Interval time.Duration
+		WALPath  string
+	}
+
+	// LookupMemory bounds the estimated memory held by the running lookups.
+	LookupMemory struct {
+		// Budget is the number of bytes, 0 meaning unbounded.
+		Budget int64
+		// FailFast makes new lookups fail rather than wait when the budget
+		// is used up.
+		FailFast bool
+	}
+
+	// CapabilityCacheTTL is how long the capabilities of a peer are
+	// remembered after it advertised them.
+	CapabilityCacheTTL time.Duration
 }
 
 func EmptyQueryFilter(_ interface{}, ai peer.AddrInfo) bool { return true }
@@ -104,6 +586,9 @@ func (c *Config) ApplyFallbacks(h host.Host) error {
 			return fmt.Errorf("the default Validator was changed without being marked as changed")
 		}
 	}
+	if !c.ResiliencyChanged && c.BucketSize > 0 && c.Resiliency > c.BucketSize {
+		c.Resiliency = c.BucketSize
+	}
 	return nil
 }
 
@@ -119,7 +604,7 @@ var Defaults = func(o *Config) error {
 	o.EnableProviders = true
 	o.EnableValues = true
 	o.QueryPeerFilter = EmptyQueryFilter
-	o.MsgSenderBuilder = net.NewMessageSenderImpl
+	o.StreamPool = net.DefaultStreamPoolConfig
 
 	o.RoutingTable.LatencyTolerance = 10 * time.Second
 	o.RoutingTable.RefreshQueryTimeout = 10 * time.Second
@@ -134,46 +619,208 @@ var Defaults = func(o *Config) error {
 	o.Resiliency = amino.DefaultResiliency
 	o.LookupCheckConcurrency = 256
 
+	o.RememberedPeers.MinAge = time.Hour
+
+	o.DialBackoff.Base = DefaultDialBackoffBase
+	o.DialBackoff.Max = DefaultDialBackoffMax
+
+	o.ProvideScheduler.Workers = 4
+	o.ProvideScheduler.Rate = 10
+	o.BandwidthAccountingPeers = 1024
+	o.CapabilityCacheTTL = time.Hour
+
 	// MAGIC: It makes sense to set it to a multiple of OptProvReturnRatio * BucketSize. We chose a multiple of 4.
 	o.OptimisticProvideJobsPoolSize = 60
 
 	return nil
 }
 
+// ConfigError lists every violation found while validating a configuration.
+type ConfigError struct {
+	Violations []error
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Error()
+	}
+	return "invalid dht configuration: " + strings.Join(msgs, "; ")
+}
+
+func (e *ConfigError) Unwrap() []error { return e.Violations }
+
+// Validate checks the configuration once all the options have been applied,
+// and returns a *ConfigError listing all the violations, if any.
 func (c *Config) Validate() error {
-	// Configuration is validated and enforced only if prefix matches Amino DHT
-	if c.ProtocolPrefix != DefaultPrefix {
-		return nil
+	var violations []error
+	violate := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Errorf(format, args...))
+	}
+
+	if c.Datastore == nil {
+		violate("a datastore is required")
+	}
+	if c.Validator == nil {
+		violate("a record validator is required")
 	}
+	if c.BucketSize <= 0 {
+		violate("bucket size must be positive, got %d", c.BucketSize)
+	}
+	if c.Concurrency <= 0 {
+		violate("concurrency must be positive, got %d", c.Concurrency)
+	}
+	if c.Resiliency <= 0 {
+		violate("resiliency must be positive, got %d", c.Resiliency)
+	} else if c.BucketSize > 0 && c.Resiliency > c.BucketSize {
+		violate("resiliency (%d) must not exceed the bucket size (%d)", c.Resiliency, c.BucketSize)
+	}
+	if c.LookupCheckConcurrency <= 0 {
+		violate("lookup check concurrency must be positive, got %d", c.LookupCheckConcurrency)
+	}
+	if c.LookupCheckTimeout < 0 {
+		violate("lookup check timeout must not be negative, got %s", c.LookupCheckTimeout)
+	}
+	if c.MaxRecordAge <= 0 {
+		violate("max record age must be positive, got %s", c.MaxRecordAge)
+	}
+	if c.RoutingTable.LatencyTolerance <= 0 {
+		violate("routing table latency tolerance must be positive, got %s", c.RoutingTable.LatencyTolerance)
+	}
+	if c.RoutingTable.AutoRefresh {
+		if c.RoutingTable.RefreshInterval <= 0 {
+			violate("routing table refresh interval must be positive when auto refresh is enabled, got %s", c.RoutingTable.RefreshInterval)
+		}
+		if c.RoutingTable.RefreshQueryTimeout <= 0 {
+			violate("routing table refresh query timeout must be positive when auto refresh is enabled, got %s", c.RoutingTable.RefreshQueryTimeout)
+		}
+	}
+	if c.RoutingTable.Compact && c.RoutingTable.DiversityFilter != nil {
+		violate("the compact routing table does not support diversity filters")
+	}
+	if c.DialBackoff.Base > 0 && c.DialBackoff.Max < c.DialBackoff.Base {
+		violate("dial backoff max (%s) must not be lower than its base (%s)", c.DialBackoff.Max, c.DialBackoff.Base)
+	}
+	if c.EnableOptimisticProvide && c.OptimisticProvideJobsPoolSize <= 0 {
+		violate("optimistic provide requires a positive jobs pool size, got %d", c.OptimisticProvideJobsPoolSize)
+	}
+	if c.PassiveCache.Size > 0 && c.PassiveCache.TTL <= 0 {
+		violate("the client cache requires a positive ttl")
+	}
+	if c.KeyspaceHash.Hash != nil {
+		if c.KeyspaceHash.Name == "" {
+			violate("a custom keyspace hash must be named")
+		}
+		if !c.RoutingTable.Compact {
+			violate("a custom keyspace hash requires the compact routing table")
+		}
+	}
+	if c.StreamPool.MaxStreamsPerPeer < 1 {
+		violate("at least one stream per peer is required")
+	}
+	if c.StreamPool.IdleTimeout < 0 || c.StreamPool.HealthCheckInterval < 0 {
+		violate("stream pool timeouts must not be negative")
+	}
+	if c.InboundHandlers.Max < 0 || c.InboundHandlers.QueueTimeout < 0 {
+		violate("inbound handler budget must not be negative")
+	}
+	if c.ProviderWriteBehind.Interval < 0 {
+		violate("provider write-behind interval must not be negative")
+	}
+	if c.LookupMemory.Budget < 0 {
+		violate("lookup memory budget must not be negative")
+	}
+	if c.CapabilityCacheTTL <= 0 {
+		violate("capability cache TTL must be positive, got %s", c.CapabilityCacheTTL)
+	}
+	if c.RoutingTable.DisconnectGrace < 0 {
+		violate("routing table disconnect grace period must not be negative")
+	}
+	if p := c.RoutingTable.Probing; p.Rate < 0 {
+		violate("routing table probe rate must not be negative")
+	} else if p.Rate > 0 && (p.MinInterval <= 0 || p.MaxInterval < p.MinInterval) {
+		violate("routing table probe intervals must be positive, the maximum no lower than the minimum")
+	}
+	if rt := c.RequestTimeout; rt.Multiplier < 0 {
+		violate("request timeout multiplier must not be negative")
+	} else if rt.Multiplier > 0 && (rt.Floor <= 0 || rt.Ceiling < rt.Floor) {
+		violate("request timeout floor (%s) must be positive and not above the ceiling (%s)", rt.Floor, rt.Ceiling)
+	}
+	if cb := c.CircuitBreaker; cb.Failures < 0 {
+		violate("circuit breaker failures must not be negative")
+	} else if cb.Failures > 0 && (cb.Window <= 0 || cb.Cooldown <= 0) {
+		violate("circuit breaker window and cooldown must be positive")
+	}
+	if sa := c.SelfAudit; sa.Interval < 0 {
+		violate("self-audit interval must not be negative")
+	} else if sa.Interval > 0 && sa.Sample <= 0 {
+		violate("self-audit sample must be positive, got %d", sa.Sample)
+	}
+	if sk := c.SpamKeys; sk.Threshold < 0 {
+		violate("spam key threshold must not be negative")
+	} else if sk.Threshold > 0 && sk.Window <= 0 {
+		violate("spam key window must be positive, got %s", sk.Window)
+	}
+	if oq := c.OriginQuota; oq.Records < 0 || oq.Providers < 0 || oq.Bytes < 0 {
+		violate("origin quotas must not be negative")
+	}
+	if bc := c.BackgroundCrawl; bc.Interval < 0 {
+		violate("background crawl interval must not be negative")
+	} else if bc.Interval > 0 && (bc.Bits < 1 || bc.Bits > 16) {
+		violate("background crawl bits must be between 1 and 16, got %d", bc.Bits)
+	}
+	if c.QueryWorkers < 0 {
+		violate("query workers must not be negative")
+	}
+	if c.ShardBits < 0 || c.ShardBits > 32 {
+		violate("shard bits must be between 0 and 32")
+	}
+	if c.ConflictResolver != nil && !c.EnableValues {
+		violate("a conflict resolver is set but values are disabled")
+	}
+
+	// The Amino DHT settings are enforced only if the prefix matches it.
+	if c.ProtocolPrefix == DefaultPrefix {
+		violations = append(violations, c.aminoViolations()...)
+	}
+
+	if len(violations) > 0 {
+		return &ConfigError{Violations: violations}
+	}
+	return nil
+}
+
+func (c *Config) aminoViolations() []error {
+	var violations []error
 	if c.BucketSize != amino.DefaultBucketSize {
-		return fmt.Errorf("protocol prefix %s must use bucket size %d", DefaultPrefix, amino.DefaultBucketSize)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must use bucket size %d", DefaultPrefix, amino.DefaultBucketSize))
 	}
 	if !c.EnableProviders {
-		return fmt.Errorf("protocol prefix %s must have providers enabled", DefaultPrefix)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must have providers enabled", DefaultPrefix))
 	}
 	if !c.EnableValues {
-		return fmt.Errorf("protocol prefix %s must have values enabled", DefaultPrefix)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must have values enabled", DefaultPrefix))
 	}
 
 	nsval, isNSVal := c.Validator.(record.NamespacedValidator)
 	if !isNSVal {
-		return fmt.Errorf("protocol prefix %s must use a namespaced Validator", DefaultPrefix)
+		return append(violations, fmt.Errorf("protocol prefix %s must use a namespaced Validator", DefaultPrefix))
 	}
 
 	if len(nsval) != 2 {
-		return fmt.Errorf("protocol prefix %s must have exactly two namespaced validators - /pk and /ipns", DefaultPrefix)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must have exactly two namespaced validators - /pk and /ipns", DefaultPrefix))
 	}
 
 	if pkVal, pkValFound := nsval["pk"]; !pkValFound {
-		return fmt.Errorf("protocol prefix %s must support the /pk namespaced Validator", DefaultPrefix)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must support the /pk namespaced Validator", DefaultPrefix))
 	} else if _, ok := pkVal.(record.PublicKeyValidator); !ok {
-		return fmt.Errorf("protocol prefix %s must use the record.PublicKeyValidator for the /pk namespace", DefaultPrefix)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must use the record.PublicKeyValidator for the /pk namespace", DefaultPrefix))
 	}
 
 	if ipnsVal, ipnsValFound := nsval["ipns"]; !ipnsValFound {
-		return fmt.Errorf("protocol prefix %s must support the /ipns namespaced Validator", DefaultPrefix)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must support the /ipns namespaced Validator", DefaultPrefix))
 	} else if _, ok := ipnsVal.(ipns.Validator); !ok {
-		return fmt.Errorf("protocol prefix %s must use ipns.Validator for the /ipns namespace", DefaultPrefix)
+		violations = append(violations, fmt.Errorf("protocol prefix %s must use ipns.Validator for the /ipns namespace", DefaultPrefix))
 	}
-	return nil
+	return violations
 }
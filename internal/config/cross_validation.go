@@ -0,0 +1,11 @@
+package config
+
+import "github.com/libp2p/go-libp2p/core/routing"
+
+type CrossValidateOptionKey struct{}
+
+// GetCrossValidate defaults to false if no option is found
+func GetCrossValidate(opts *routing.Options) bool {
+	cross, _ := opts.Other[CrossValidateOptionKey{}].(bool)
+	return cross
+}
@@ -1,6 +1,10 @@
 package config
 
-import "github.com/libp2p/go-libp2p/core/routing"
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/routing"
+)
 
 type QuorumOptionKey struct{}
 
@@ -14,3 +18,27 @@ func GetQuorum(opts *routing.Options) int {
 	}
 	return responsesNeeded
 }
+
+type QuorumFuncOptionKey struct{}
+
+// GetQuorumFunc returns nil if no option is found
+func GetQuorumFunc(opts *routing.Options) func(networkSize int) int {
+	f, _ := opts.Other[QuorumFuncOptionKey{}].(func(networkSize int) int)
+	return f
+}
+
+type RequireQuorumOptionKey struct{}
+
+// GetRequireQuorum defaults to false if no option is found
+func GetRequireQuorum(opts *routing.Options) bool {
+	required, _ := opts.Other[RequireQuorumOptionKey{}].(bool)
+	return required
+}
+
+type ImprovementTimeoutOptionKey struct{}
+
+// GetImprovementTimeout defaults to 0 if no option is found
+func GetImprovementTimeout(opts *routing.Options) time.Duration {
+	d, _ := opts.Other[ImprovementTimeoutOptionKey{}].(time.Duration)
+	return d
+}
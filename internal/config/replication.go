@@ -0,0 +1,11 @@
+package config
+
+import "github.com/libp2p/go-libp2p/core/routing"
+
+type ReplicationOptionKey struct{}
+
+// GetReplication returns 0 if no option is found
+func GetReplication(opts *routing.Options) int {
+	n, _ := opts.Other[ReplicationOptionKey{}].(int)
+	return n
+}
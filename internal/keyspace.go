@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"bytes"
+	"sort"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ks "github.com/whyrusleeping/go-keyspace"
+)
+
+// KeyspaceHash maps keys and peer IDs into the Kademlia keyspace. Its outputs
+// must all have the same length. The nil KeyspaceHash is sha256, the hash of
+// the Amino DHT.
+type KeyspaceHash func(data []byte) []byte
+
+// ID returns the keyspace ID of data.
+func (h KeyspaceHash) ID(data []byte) kb.ID {
+	if h == nil {
+		return kb.ConvertKey(string(data))
+	}
+	return kb.ID(h(data))
+}
+
+// Key returns the XOR keyspace key of data.
+func (h KeyspaceHash) Key(data []byte) ks.Key {
+	if h == nil {
+		return ks.XORKeySpace.Key(data)
+	}
+	return ks.Key{Space: ks.XORKeySpace, Original: data, Bytes: h(data)}
+}
+
+// Distance returns the XOR distance between the position of data in the
+// keyspace and target.
+func (h KeyspaceHash) Distance(data []byte, target kb.ID) []byte {
+	d := h.ID(data)
+	for i := range d {
+		d[i] ^= target[i]
+	}
+	return d
+}
+
+// SortClosestPeers sorts peers by their distance to target, closest first.
+func (h KeyspaceHash) SortClosestPeers(peers []peer.ID, target kb.ID) []peer.ID {
+	dists := make(map[peer.ID][]byte, len(peers))
+	for _, p := range peers {
+		dists[p] = h.Distance([]byte(p), target)
+	}
+	sorted := append([]peer.ID(nil), peers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(dists[sorted[i]], dists[sorted[j]]) < 0
+	})
+	return sorted
+}
@@ -0,0 +1,16 @@
+package internal
+
+import "context"
+
+type queryLabelKey struct{}
+
+// WithQueryLabel returns a context carrying the given application label.
+func WithQueryLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, queryLabelKey{}, label)
+}
+
+// QueryLabel returns the application label carried by the context, if any.
+func QueryLabel(ctx context.Context) string {
+	l, _ := ctx.Value(queryLabelKey{}).(string)
+	return l
+}
@@ -1,25 +1,22 @@
 package net
 
 import (
-	"bufio"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-msgio"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
 
-	//lint:ignore SA1019 TODO migrate away from gogo pb
-	"github.com/libp2p/go-msgio/protoio"
-
-	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 )
@@ -29,54 +26,94 @@ var dhtReadMessageTimeout = 10 * time.Second
 // ErrReadTimeout is an error that occurs when no message is read within the timeout period.
 var ErrReadTimeout = fmt.Errorf("timed out reading response")
 
+// ErrNoResponse is matched by the errors of the requests that were written to
+// the peer, but whose response couldn't be read.
+var ErrNoResponse = fmt.Errorf("no response read")
+
+// ErrSenderClosed is returned by the message senders once closed.
+var ErrSenderClosed = fmt.Errorf("message sender closed")
+
 var logger = logging.Logger("dht")
 
 // messageSenderImpl is responsible for sending requests and messages to peers efficiently, including reuse of streams.
 // It also tracks metrics for sent requests and messages.
 type messageSenderImpl struct {
-	host      host.Host // the network services we need
-	smlk      sync.Mutex
-	strmap    map[peer.ID]*peerMessageSender
+	host   host.Host // the network services we need
+	smlk   sync.Mutex
+	strmap map[peer.ID]*peerMessageSender
+	// closed is set by Close, after which no stream is opened
+	closed    bool
 	protocols []protocol.ID
+	pool      StreamPoolConfig
+	// protoAttr tags the metrics with our primary protocol.
+	protoAttr metric.MeasurementOption
+	logger    *zap.SugaredLogger
 }
 
+// NewMessageSenderImpl returns a message sender pooling its streams with the
+// DefaultStreamPoolConfig. Idle streams are only closed when they are found
+// expired, and are not health checked. The sender implements io.Closer, to
+// reset its streams once done with it.
 func NewMessageSenderImpl(h host.Host, protos []protocol.ID) pb.MessageSenderWithDisconnect {
+	return newMessageSenderImpl(h, protos, DefaultStreamPoolConfig)
+}
+
+// NewPooledMessageSender returns a message sender pooling its streams as set
+// by cfg. Until ctx is canceled, the idle streams are closed in the background
+// once they expire, and health checked if cfg.HealthCheckInterval is set. The
+// sender logs through l, or the package-wide logger if l is nil.
+func NewPooledMessageSender(ctx context.Context, h host.Host, protos []protocol.ID, cfg StreamPoolConfig, l *zap.SugaredLogger) pb.MessageSenderWithDisconnect {
+	m := newMessageSenderImpl(h, protos, cfg)
+	if l != nil {
+		m.logger = l
+	}
+	if cfg.IdleTimeout > 0 || cfg.HealthCheckInterval > 0 {
+		go m.maintainStreams(ctx)
+	}
+	return m
+}
+
+func newMessageSenderImpl(h host.Host, protos []protocol.ID, cfg StreamPoolConfig) *messageSenderImpl {
+	if cfg.MaxStreamsPerPeer < 1 {
+		cfg.MaxStreamsPerPeer = 1
+	}
+	protoAttr := metric.WithAttributes()
+	if len(protos) > 0 {
+		protoAttr = metrics.WithProtocol(protos[0])
+	}
 	return &messageSenderImpl{
 		host:      h,
 		strmap:    make(map[peer.ID]*peerMessageSender),
 		protocols: protos,
+		pool:      cfg,
+		protoAttr: protoAttr,
+		logger:    &logger.SugaredLogger,
 	}
 }
 
 func (m *messageSenderImpl) OnDisconnect(ctx context.Context, p peer.ID) {
 	m.smlk.Lock()
-	defer m.smlk.Unlock()
 	ms, ok := m.strmap[p]
-	if !ok {
-		return
+	if ok {
+		delete(m.strmap, p)
 	}
-	delete(m.strmap, p)
+	m.smlk.Unlock()
 
-	// Do this asynchronously as ms.lk can block for a while.
-	go func() {
-		if err := ms.lk.Lock(ctx); err != nil {
-			return
-		}
-		defer ms.lk.Unlock()
+	if ok {
 		ms.invalidate()
-	}()
+	}
 }
 
 // SendRequest sends out a request, but also makes sure to
 // measure the RTT for latency measurements.
 func (m *messageSenderImpl) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
-	tags := metrics.UpsertMessageType(pmes)
+	tags := metrics.MessageAttributes(ctx, pmes)
 
 	ms, err := m.messageSenderForPeer(ctx, p)
 	if err != nil {
-		metrics.SentRequests.Add(ctx, 1, tags)
-		metrics.SentRequestErrors.Add(ctx, 1, tags)
-		logger.Debugw("request failed to open message sender", "error", err, "to", p)
+		metrics.SentRequests.Add(ctx, 1, tags, m.protoAttr)
+		metrics.SentRequestErrors.Add(ctx, 1, tags, m.protoAttr)
+		m.logger.Debugw("request failed to open message sender", "error", err, "to", p)
 		return nil, err
 	}
 
@@ -84,57 +121,78 @@ func (m *messageSenderImpl) SendRequest(ctx context.Context, p peer.ID, pmes *pb
 
 	rpmes, err := ms.SendRequest(ctx, pmes)
 	if err != nil {
-		metrics.SentRequests.Add(ctx, 1, tags)
-		metrics.SentRequestErrors.Add(ctx, 1, tags)
-		logger.Debugw("request failed", "error", err, "to", p)
+		metrics.SentRequests.Add(ctx, 1, tags, m.protoAttr)
+		metrics.SentRequestErrors.Add(ctx, 1, tags, m.protoAttr)
+		m.logger.Debugw("request failed", "error", err, "to", p)
 		return nil, err
 	}
 
-	metrics.SentRequests.Add(ctx, 1, tags)
-	metrics.SentBytes.Add(ctx, int64(pmes.Size()), tags)
+	metrics.SentRequests.Add(ctx, 1, tags, m.protoAttr)
+	metrics.SentBytes.Add(ctx, int64(pmes.Size()), tags, m.protoAttr)
 	metrics.OutboundRequestLatency.Record(ctx,
 		float64(time.Since(start))/float64(time.Millisecond),
-		tags)
+		tags, m.protoAttr)
 	m.host.Peerstore().RecordLatency(p, time.Since(start))
 	return rpmes, nil
 }
 
 // SendMessage sends out a message
 func (m *messageSenderImpl) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
-	tags := metrics.UpsertMessageType(pmes)
+	tags := metrics.MessageAttributes(ctx, pmes)
 
 	ms, err := m.messageSenderForPeer(ctx, p)
 	if err != nil {
-		metrics.SentMessages.Add(ctx, 1, tags)
-		metrics.SentMessageErrors.Add(ctx, 1, tags)
-		logger.Debugw("message failed to open message sender", "error", err, "to", p)
+		metrics.SentMessages.Add(ctx, 1, tags, m.protoAttr)
+		metrics.SentMessageErrors.Add(ctx, 1, tags, m.protoAttr)
+		m.logger.Debugw("message failed to open message sender", "error", err, "to", p)
 		return err
 	}
 
 	if err := ms.SendMessage(ctx, pmes); err != nil {
-		metrics.SentMessages.Add(ctx, 1, tags)
-		metrics.SentMessageErrors.Add(ctx, 1, tags)
-		logger.Debugw("message failed", "error", err, "to", p)
+		metrics.SentMessages.Add(ctx, 1, tags, m.protoAttr)
+		metrics.SentMessageErrors.Add(ctx, 1, tags, m.protoAttr)
+		m.logger.Debugw("message failed", "error", err, "to", p)
 		return err
 	}
 
-	metrics.SentMessages.Add(ctx, 1, tags)
-	metrics.SentBytes.Add(ctx, int64(pmes.Size()), tags)
+	metrics.SentMessages.Add(ctx, 1, tags, m.protoAttr)
+	metrics.SentBytes.Add(ctx, int64(pmes.Size()), tags, m.protoAttr)
+	return nil
+}
+
+// Close resets the streams of the sender, and makes the requests sent from now
+// on fail with ErrSenderClosed. The streams in use are reset once released.
+func (m *messageSenderImpl) Close() error {
+	m.smlk.Lock()
+	strmap := m.strmap
+	m.strmap = make(map[peer.ID]*peerMessageSender)
+	m.closed = true
+	m.smlk.Unlock()
+
+	for _, ms := range strmap {
+		ms.invalidate()
+	}
 	return nil
 }
 
 func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID) (*peerMessageSender, error) {
 	m.smlk.Lock()
+	if m.closed {
+		m.smlk.Unlock()
+		return nil, ErrSenderClosed
+	}
 	ms, ok := m.strmap[p]
 	if ok {
 		m.smlk.Unlock()
 		return ms, nil
 	}
-	ms = &peerMessageSender{p: p, m: m, lk: internal.NewCtxMutex()}
+	ms = newPeerMessageSender(m, p)
 	m.strmap[p] = ms
 	m.smlk.Unlock()
 
-	if err := ms.prepOrInvalidate(ctx); err != nil {
+	// open a first stream, so that unreachable peers are forgotten right away
+	s, err := ms.acquire(ctx)
+	if err != nil {
 		m.smlk.Lock()
 		defer m.smlk.Unlock()
 
@@ -144,176 +202,178 @@ func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID)
 			if ms != msCur {
 				return msCur, nil
 			}
-			// Not changed, remove the now invalid stream from the
+			// Not changed, remove the now invalid sender from the
 			// map.
 			delete(m.strmap, p)
 		}
+		ms.invalidate()
 		// Invalid but not in map. Must have been removed by a disconnect.
 		return nil, err
 	}
+	ms.release(s, true)
 	// All ready to go.
 	return ms, nil
 }
 
-// peerMessageSender is responsible for sending requests and messages to a particular peer
-type peerMessageSender struct {
-	s  network.Stream
-	r  msgio.ReadCloser
-	lk internal.CtxMutex
-	p  peer.ID
-	m  *messageSenderImpl
-
-	invalid   bool
-	singleMes int
-}
-
-// invalidate is called before this peerMessageSender is removed from the strmap.
-// It prevents the peerMessageSender from being reused/reinitialized and then
-// forgotten (leaving the stream open).
-func (ms *peerMessageSender) invalidate() {
-	ms.invalid = true
-	if ms.s != nil {
-		_ = ms.s.Reset()
-		ms.s = nil
-	}
-}
-
-func (ms *peerMessageSender) prepOrInvalidate(ctx context.Context) error {
-	if err := ms.lk.Lock(ctx); err != nil {
-		return err
-	}
-	defer ms.lk.Unlock()
-
-	if err := ms.prep(ctx); err != nil {
-		ms.invalidate()
-		return err
-	}
-	return nil
-}
-
-func (ms *peerMessageSender) prep(ctx context.Context) error {
-	if ms.invalid {
-		return fmt.Errorf("message sender has been invalidated")
-	}
-	if ms.s != nil {
-		return nil
-	}
-
-	// We only want to speak to peers using our primary protocols. We do not want to query any peer that only speaks
-	// one of the secondary "server" protocols that we happen to support (e.g. older nodes that we can respond to for
-	// backwards compatibility reasons).
-	nstr, err := ms.m.host.NewStream(ctx, ms.p, ms.m.protocols...)
-	if err != nil {
-		return err
-	}
-
-	ms.r = msgio.NewVarintReaderSize(nstr, network.MessageSizeMax)
-	ms.s = nstr
-
-	return nil
-}
-
 // streamReuseTries is the number of times we will try to reuse a stream to a
 // given peer before giving up and reverting to the old one-message-per-stream
 // behaviour.
 const streamReuseTries = 3
 
+// SendMessage queues pmes and writes it along with the other messages queued
+// for the peer in the meantime, unless a concurrent sender wrote it first.
 func (ms *peerMessageSender) SendMessage(ctx context.Context, pmes *pb.Message) error {
-	if err := ms.lk.Lock(ctx); err != nil {
-		return err
-	}
-	defer ms.lk.Unlock()
+	pm := &pendingMessage{mes: pmes, done: make(chan error, 1)}
+	ms.mu.Lock()
+	ms.pending = append(ms.pending, pm)
+	ms.mu.Unlock()
 
-	retry := false
-	for {
-		if err := ms.prep(ctx); err != nil {
+	s, err := ms.acquire(ctx)
+	if err != nil {
+		if ms.dequeue(pm) {
 			return err
 		}
+		// a concurrent sender is writing it
+		return <-pm.done
+	}
 
-		if err := ms.writeMsg(pmes); err != nil {
-			_ = ms.s.Reset()
-			ms.s = nil
-
-			if retry {
-				logger.Debugw("error writing message", "error", err)
-				return err
-			}
-			logger.Debugw("error writing message", "error", err, "retrying", true)
-			retry = true
-			continue
-		}
-
-		var err error
-		if ms.singleMes > streamReuseTries {
-			err = ms.s.Close()
-			ms.s = nil
-		} else if retry {
-			ms.singleMes++
-		}
+	select {
+	case err := <-pm.done:
+		ms.release(s, true)
+		return err
+	default:
+	}
 
+	// pmes may have been taken by a concurrent sender over another stream,
+	// in which case the batch doesn't hold it, and its outcome is awaited.
+	if s, err = ms.send(ctx, s, ms.takePending(), nil); err == nil {
+		ms.release(s, true)
+	}
+	select {
+	case err := <-pm.done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
-	if err := ms.lk.Lock(ctx); err != nil {
+	s, err := ms.acquire(ctx)
+	if err != nil {
 		return nil, err
 	}
-	defer ms.lk.Unlock()
 
+	// the queued messages go out ahead of the request, as they get no response
+	batch := ms.takePending()
 	retry := false
 	for {
-		if err := ms.prep(ctx); err != nil {
-			return nil, err
-		}
-
-		if err := ms.writeMsg(pmes); err != nil {
-			_ = ms.s.Reset()
-			ms.s = nil
-
-			if retry {
-				logger.Debugw("error writing message", "error", err)
+		if s == nil {
+			if s, err = ms.acquireNew(ctx); err != nil {
 				return nil, err
 			}
-			logger.Debugw("error writing message", "error", err, "retrying", true)
-			retry = true
-			continue
+		}
+		s, err = ms.send(ctx, s, batch, pmes)
+		batch = nil
+		if err != nil {
+			return nil, err
 		}
 
 		mes := new(pb.Message)
-		if err := ms.ctxReadMsg(ctx, mes); err != nil {
-			_ = ms.s.Reset()
-			ms.s = nil
+		if err := s.ctxReadMsg(ctx, mes); err != nil {
+			ms.release(s, false)
+			s = nil
 			if err == context.Canceled {
 				// retry would be same error
-				return nil, err
+				return nil, fmt.Errorf("%w: %w", ErrNoResponse, err)
 			}
 			if retry {
-				logger.Debugw("error reading message", "error", err)
-				return nil, err
+				ms.m.logger.Debugw("error reading message", "error", err)
+				return nil, fmt.Errorf("%w: %w", ErrNoResponse, err)
 			}
-			logger.Debugw("error reading message", "error", err, "retrying", true)
+			ms.m.logger.Debugw("error reading message", "error", err, "retrying", true)
 			retry = true
 			continue
 		}
 
-		var err error
-		if ms.singleMes > streamReuseTries {
-			err = ms.s.Close()
-			ms.s = nil
-		} else if retry {
-			ms.singleMes++
+		if retry {
+			ms.noteRetry()
+		}
+		ms.release(s, true)
+		return mes, nil
+	}
+}
+
+// send writes the messages of batch followed by req, if not nil, over s with
+// a single write. On failure, it retries once over another stream. It returns
+// the stream the messages were written to, which the caller must release.
+func (ms *peerMessageSender) send(ctx context.Context, s *pooledStream, batch []*pendingMessage, req *pb.Message) (*pooledStream, error) {
+	msgs := make([]*pb.Message, 0, len(batch)+1)
+	for _, p := range batch {
+		msgs = append(msgs, p.mes)
+	}
+	if req != nil {
+		msgs = append(msgs, req)
+	}
+	if len(msgs) == 0 {
+		return s, nil
+	}
+	if len(msgs) > 1 {
+		metrics.CoalescedMessages.Add(ctx, int64(len(msgs)), ms.m.protoAttr)
+	}
+
+	err := WriteMsgs(s.s, msgs...)
+	if err != nil {
+		ms.release(s, false)
+		ms.m.logger.Debugw("error writing message", "error", err, "retrying", true)
+
+		if s, err = ms.acquireNew(ctx); err == nil {
+			if err = WriteMsgs(s.s, msgs...); err != nil {
+				ms.release(s, false)
+				ms.m.logger.Debugw("error writing message", "error", err)
+			} else {
+				ms.noteRetry()
+			}
 		}
+	}
+
+	for _, p := range batch {
+		p.done <- err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-		return mes, err
+// dequeue removes pm from the pending messages, reporting whether it was
+// still there.
+func (ms *peerMessageSender) dequeue(pm *pendingMessage) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, p := range ms.pending {
+		if p == pm {
+			ms.pending = append(ms.pending[:i], ms.pending[i+1:]...)
+			return true
+		}
 	}
+	return false
+}
+
+func (ms *peerMessageSender) takePending() []*pendingMessage {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	batch := ms.pending
+	ms.pending = nil
+	return batch
 }
 
-func (ms *peerMessageSender) writeMsg(pmes *pb.Message) error {
-	return WriteMsg(ms.s, pmes)
+// pendingMessage is a message queued for a peer until it is written.
+type pendingMessage struct {
+	mes  *pb.Message
+	done chan error
 }
 
-func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) error {
+func (s *pooledStream) ctxReadMsg(ctx context.Context, mes *pb.Message) error {
 	errc := make(chan error, 1)
 	go func(r msgio.ReadCloser) {
 		defer close(errc)
@@ -324,7 +384,7 @@ func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) er
 			return
 		}
 		errc <- mes.Unmarshal(bytes)
-	}(ms.r)
+	}(s.r)
 
 	t := time.NewTimer(dhtReadMessageTimeout)
 	defer t.Stop()
@@ -339,36 +399,49 @@ func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) er
 	}
 }
 
-// The Protobuf writer performs multiple small writes when writing a message.
-// We need to buffer those writes, to make sure that we're not sending a new
-// packet for every single write.
-type bufferedDelimitedWriter struct {
-	*bufio.Writer
-	protoio.WriteCloser
-}
+// maxPooledBufferSize bounds the buffers kept in bufferPool, so that a single
+// large message doesn't stay allocated for the lifetime of the pool.
+const maxPooledBufferSize = 64 << 10
 
-var writerPool = sync.Pool{
+var bufferPool = sync.Pool{
 	New: func() interface{} {
-		w := bufio.NewWriter(nil)
-		return &bufferedDelimitedWriter{
-			Writer:      w,
-			WriteCloser: protoio.NewDelimitedWriter(w),
-		}
+		b := make([]byte, 0, 4<<10)
+		return &b
 	},
 }
 
+// WriteMsg writes mes to w, prefixed with its varint encoded length.
 func WriteMsg(w io.Writer, mes *pb.Message) error {
-	bw := writerPool.Get().(*bufferedDelimitedWriter)
-	bw.Reset(w)
-	err := bw.WriteMsg(mes)
+	return WriteMsgs(w, mes)
+}
+
+// WriteMsgs writes msgs to w, each prefixed with its varint encoded length.
+// The messages are marshaled into a pooled buffer and written with a single
+// call, so that they aren't copied again nor sent in several packets.
+func WriteMsgs(w io.Writer, msgs ...*pb.Message) error {
+	bp := bufferPool.Get().(*[]byte)
+	buf := (*bp)[:0]
+
+	var err error
+	for _, mes := range msgs {
+		size := mes.Size()
+		buf = binary.AppendUvarint(buf, uint64(size))
+		n := len(buf)
+		if cap(buf) < n+size {
+			buf = append(buf, make([]byte, size)...)
+		}
+		buf = buf[:n+size]
+		if _, err = mes.MarshalToSizedBuffer(buf[n:]); err != nil {
+			break
+		}
+	}
 	if err == nil {
-		err = bw.Flush()
+		_, err = w.Write(buf)
 	}
-	bw.Reset(nil)
-	writerPool.Put(bw)
-	return err
-}
 
-func (w *bufferedDelimitedWriter) Flush() error {
-	return w.Writer.Flush()
+	if cap(buf) <= maxPooledBufferSize {
+		*bp = buf[:0]
+		bufferPool.Put(bp)
+	}
+	return err
 }
@@ -1,12 +1,21 @@
 package net
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-msgio"
+
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
 
@@ -37,3 +46,236 @@ func TestInvalidMessageSenderTracking(t *testing.T) {
 		t.Fatal("should have no message senders in map")
 	}
 }
+
+func TestWriteMsg(t *testing.T) {
+	var buf bytes.Buffer
+	for _, size := range []int{10, 100 << 10} {
+		in := pb.NewMessage(pb.Message_PUT_VALUE, bytes.Repeat([]byte{'k'}, size), 0)
+		require.NoError(t, WriteMsg(&buf, in))
+	}
+
+	r := msgio.NewVarintReaderSize(&buf, 1<<20)
+	for _, size := range []int{10, 100 << 10} {
+		data, err := r.ReadMsg()
+		require.NoError(t, err)
+		out := new(pb.Message)
+		require.NoError(t, out.Unmarshal(data))
+		require.Len(t, out.Key, size)
+		require.Equal(t, pb.Message_PUT_VALUE, out.Type)
+	}
+}
+
+func BenchmarkWriteMsg(b *testing.B) {
+	mes := pb.NewMessage(pb.Message_FIND_NODE, []byte("some key of a realistic length!!"), 0)
+	mes.CloserPeers = make([]pb.Message_Peer, 20)
+	for i := range mes.CloserPeers {
+		mes.CloserPeers[i].Addrs = [][]byte{make([]byte, 20), make([]byte, 20)}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := WriteMsg(io.Discard, mes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCoalescedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const proto = protocol.ID("/test/kad/1.0.0")
+	newHost := func() *bhost.BasicHost {
+		h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		h.Start()
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	client, server := newHost(), newHost()
+	require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+
+	received := make(chan string, 10)
+	server.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		for {
+			data, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			var mes pb.Message
+			require.NoError(t, mes.Unmarshal(data))
+			received <- string(mes.Key)
+			if mes.Type == pb.Message_PING {
+				require.NoError(t, WriteMsg(s, &mes))
+			}
+		}
+	})
+
+	m := newMessageSenderImpl(client, []protocol.ID{proto}, StreamPoolConfig{MaxStreamsPerPeer: 1})
+	ms, err := m.messageSenderForPeer(ctx, server.ID())
+	require.NoError(t, err)
+
+	// hold the only stream so that the messages are queued
+	s, err := ms.acquire(ctx)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mes := pb.NewMessage(pb.Message_ADD_PROVIDER, []byte(fmt.Sprint(i)), 0)
+			require.NoError(t, m.SendMessage(ctx, server.ID(), mes))
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		return len(ms.pending) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	ms.release(s, true)
+
+	resp, err := m.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_PING, []byte("ping"), 0))
+	require.NoError(t, err)
+	require.Equal(t, pb.Message_PING, resp.Type)
+	wg.Wait()
+
+	var keys []string
+	for i := 0; i < 4; i++ {
+		keys = append(keys, <-received)
+	}
+	require.ElementsMatch(t, []string{"0", "1", "2", "ping"}, keys)
+	require.Equal(t, "ping", keys[3])
+}
+
+func TestStreamPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const proto = protocol.ID("/test/kad/1.0.0")
+	newHost := func() *bhost.BasicHost {
+		h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		h.Start()
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	client, server := newHost(), newHost()
+	require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+	server.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		for {
+			data, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			var mes pb.Message
+			if mes.Unmarshal(data) != nil || WriteMsg(s, &mes) != nil {
+				return
+			}
+		}
+	})
+
+	m := newMessageSenderImpl(client, []protocol.ID{proto}, StreamPoolConfig{
+		MaxStreamsPerPeer:   2,
+		IdleTimeout:         time.Hour,
+		HealthCheckInterval: time.Nanosecond,
+	})
+	ms, err := m.messageSenderForPeer(ctx, server.ID())
+	require.NoError(t, err)
+	open := func() int {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		return ms.open
+	}
+
+	s1, err := ms.acquire(ctx)
+	require.NoError(t, err)
+	s2, err := ms.acquire(ctx)
+	require.NoError(t, err)
+	require.NotSame(t, s1, s2)
+
+	// the pool is exhausted until a stream is released
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = ms.acquire(tctx)
+	tcancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	ms.release(s1, true)
+	s3, err := ms.acquire(ctx)
+	require.NoError(t, err)
+	require.Same(t, s1, s3)
+	ms.release(s1, true)
+	ms.release(s2, true)
+	require.Equal(t, 2, open())
+
+	// broken streams fail their health check
+	_ = s2.s.Reset()
+	ms.maintain(ctx)
+	require.Equal(t, 1, open())
+
+	m.pool.IdleTimeout = time.Nanosecond
+	ms.maintain(ctx)
+	require.Equal(t, 0, open())
+
+	resp, err := m.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_PING, nil, 0))
+	require.NoError(t, err)
+	require.Equal(t, pb.Message_PING, resp.Type)
+}
+
+func TestSendMessageTakenByConcurrentSender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const proto = protocol.ID("/test/kad/1.0.0")
+	newHost := func() *bhost.BasicHost {
+		h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		h.Start()
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	client, server := newHost(), newHost()
+	require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+	server.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		_, _ = io.Copy(io.Discard, s)
+	})
+
+	m := newMessageSenderImpl(client, []protocol.ID{proto}, StreamPoolConfig{MaxStreamsPerPeer: 2})
+	ms, err := m.messageSenderForPeer(ctx, server.ID())
+	require.NoError(t, err)
+
+	// hold both streams so that the message is queued
+	s1, err := ms.acquire(ctx)
+	require.NoError(t, err)
+	s2, err := ms.acquire(ctx)
+	require.NoError(t, err)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- m.SendMessage(ctx, server.ID(), pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("k"), 0))
+	}()
+	require.Eventually(t, func() bool {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		return len(ms.pending) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a concurrent sender takes the message, and is still writing it when
+	// the second stream is released
+	batch := ms.takePending()
+	require.Len(t, batch, 1)
+	ms.release(s2, true)
+	select {
+	case err := <-sent:
+		t.Fatalf("SendMessage returned %v before its message was written", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	writeErr := fmt.Errorf("write failed")
+	batch[0].done <- writeErr
+	ms.release(s1, false)
+	require.ErrorIs(t, <-sent, writeErr)
+}
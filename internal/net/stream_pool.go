@@ -0,0 +1,299 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// StreamPoolConfig configures the outbound streams kept open to every peer.
+type StreamPoolConfig struct {
+	// MaxStreamsPerPeer is the number of streams a peer can be sent
+	// requests over concurrently. Further requests wait for a stream.
+	MaxStreamsPerPeer int
+	// IdleTimeout is the time after which an unused stream is closed, 0
+	// keeping them open until they fail.
+	IdleTimeout time.Duration
+	// HealthCheckInterval is the time after which an idle stream is checked
+	// with a PING, 0 disabling the checks.
+	HealthCheckInterval time.Duration
+}
+
+// DefaultStreamPoolConfig is the stream pool configuration of
+// NewMessageSenderImpl. Its IdleTimeout is shorter than the minute after
+// which the DHT servers reset idle streams.
+var DefaultStreamPoolConfig = StreamPoolConfig{
+	MaxStreamsPerPeer: 4,
+	IdleTimeout:       45 * time.Second,
+}
+
+// peerMessageSender is responsible for sending requests and messages to a particular peer,
+// over a pool of streams.
+type peerMessageSender struct {
+	p peer.ID
+	m *messageSenderImpl
+
+	mu sync.Mutex
+	// idle are the open streams that aren't in use, the most recently used last.
+	idle []*pooledStream
+	// open is the number of open streams, idle or not.
+	open int
+	// released is closed, and replaced, whenever a stream is released.
+	released chan struct{}
+	invalid  bool
+	// singleMes counts the retries that had to use a new stream, reverting
+	// to one message per stream once it exceeds streamReuseTries.
+	singleMes int
+
+	// pending are the messages queued by SendMessage, written by the next
+	// sender to acquire a stream along with its own message.
+	pending []*pendingMessage
+}
+
+type pooledStream struct {
+	s network.Stream
+	r msgio.ReadCloser
+
+	lastUsed    time.Time
+	lastChecked time.Time
+}
+
+func newPeerMessageSender(m *messageSenderImpl, p peer.ID) *peerMessageSender {
+	return &peerMessageSender{p: p, m: m, released: make(chan struct{})}
+}
+
+// acquire returns an idle stream, or opens a new one if the peer has fewer
+// than MaxStreamsPerPeer. Otherwise, it waits for a stream to be released.
+func (ms *peerMessageSender) acquire(ctx context.Context) (*pooledStream, error) {
+	return ms.acquireStream(ctx, false)
+}
+
+// acquireNew is acquire for a new stream, closing an idle stream if needed to
+// stay within MaxStreamsPerPeer. It is used to retry over a stream that
+// doesn't share the fate of one that just failed.
+func (ms *peerMessageSender) acquireNew(ctx context.Context) (*pooledStream, error) {
+	return ms.acquireStream(ctx, true)
+}
+
+func (ms *peerMessageSender) acquireStream(ctx context.Context, fresh bool) (*pooledStream, error) {
+	for {
+		ms.mu.Lock()
+		if ms.invalid {
+			ms.mu.Unlock()
+			return nil, fmt.Errorf("message sender has been invalidated")
+		}
+
+		if n := len(ms.idle); fresh && n > 0 && ms.open >= ms.m.pool.MaxStreamsPerPeer {
+			s := ms.idle[0]
+			ms.idle = append(ms.idle[:0], ms.idle[1:]...)
+			ms.open--
+			ms.mu.Unlock()
+			_ = s.s.Close()
+			continue
+		}
+
+		if n := len(ms.idle); !fresh && n > 0 {
+			s := ms.idle[n-1]
+			ms.idle = ms.idle[:n-1]
+			if timeout := ms.m.pool.IdleTimeout; timeout > 0 && time.Since(s.lastUsed) > timeout {
+				ms.open--
+				ms.mu.Unlock()
+				_ = s.s.Close()
+				metrics.OutboundStreamsReaped.Add(ctx, 1, ms.m.protoAttr)
+				continue
+			}
+			ms.mu.Unlock()
+			metrics.OutboundStreamReuses.Add(ctx, 1, ms.m.protoAttr)
+			return s, nil
+		}
+
+		if ms.open < ms.m.pool.MaxStreamsPerPeer {
+			ms.open++
+			ms.mu.Unlock()
+			s, err := ms.openStream(ctx)
+			if err != nil {
+				ms.mu.Lock()
+				ms.open--
+				ms.notifyLocked()
+				ms.mu.Unlock()
+				return nil, err
+			}
+			return s, nil
+		}
+
+		released := ms.released
+		ms.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (ms *peerMessageSender) openStream(ctx context.Context) (*pooledStream, error) {
+	// We only want to speak to peers using our primary protocols. We do not want to query any peer that only speaks
+	// one of the secondary "server" protocols that we happen to support (e.g. older nodes that we can respond to for
+	// backwards compatibility reasons).
+	nstr, err := ms.m.host.NewStream(ctx, ms.p, ms.m.protocols...)
+	if err != nil {
+		return nil, err
+	}
+	metrics.OutboundStreamsOpened.Add(ctx, 1, ms.m.protoAttr)
+
+	now := time.Now()
+	return &pooledStream{
+		s:           nstr,
+		r:           msgio.NewVarintReaderSize(nstr, network.MessageSizeMax),
+		lastUsed:    now,
+		lastChecked: now,
+	}, nil
+}
+
+// release gives s back to the pool once used. Unhealthy streams are reset.
+func (ms *peerMessageSender) release(s *pooledStream, healthy bool) {
+	if healthy {
+		now := time.Now()
+		s.lastUsed, s.lastChecked = now, now
+	}
+	ms.putBack(s, healthy)
+}
+
+func (ms *peerMessageSender) putBack(s *pooledStream, healthy bool) {
+	ms.mu.Lock()
+	keep := healthy && !ms.invalid && ms.singleMes <= streamReuseTries
+	if keep {
+		ms.idle = append(ms.idle, s)
+	} else {
+		ms.open--
+	}
+	ms.notifyLocked()
+	ms.mu.Unlock()
+
+	switch {
+	case keep:
+	case healthy:
+		_ = s.s.Close()
+	default:
+		_ = s.s.Reset()
+	}
+}
+
+func (ms *peerMessageSender) notifyLocked() {
+	close(ms.released)
+	ms.released = make(chan struct{})
+}
+
+// noteRetry records that a message had to be retried over a new stream.
+func (ms *peerMessageSender) noteRetry() {
+	ms.mu.Lock()
+	ms.singleMes++
+	ms.mu.Unlock()
+}
+
+// invalidate is called before this peerMessageSender is removed from the strmap.
+// It resets the idle streams and prevents the ones in use from being reused.
+func (ms *peerMessageSender) invalidate() {
+	ms.mu.Lock()
+	ms.invalid = true
+	idle := ms.idle
+	ms.idle = nil
+	ms.open -= len(idle)
+	ms.notifyLocked()
+	ms.mu.Unlock()
+
+	for _, s := range idle {
+		_ = s.s.Reset()
+	}
+}
+
+// maintainStreams closes the expired idle streams and health checks the
+// other ones until ctx is canceled.
+func (m *messageSenderImpl) maintainStreams(ctx context.Context) {
+	interval := m.pool.IdleTimeout
+	if hc := m.pool.HealthCheckInterval; hc > 0 && (interval <= 0 || hc < interval) {
+		interval = hc
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		m.smlk.Lock()
+		senders := make([]*peerMessageSender, 0, len(m.strmap))
+		for _, ms := range m.strmap {
+			senders = append(senders, ms)
+		}
+		m.smlk.Unlock()
+
+		for _, ms := range senders {
+			ms.maintain(ctx)
+		}
+	}
+}
+
+func (ms *peerMessageSender) maintain(ctx context.Context) {
+	cfg := ms.m.pool
+	now := time.Now()
+
+	ms.mu.Lock()
+	var expired, unchecked []*pooledStream
+	kept := ms.idle[:0]
+	for _, s := range ms.idle {
+		switch {
+		case cfg.IdleTimeout > 0 && now.Sub(s.lastUsed) > cfg.IdleTimeout:
+			expired = append(expired, s)
+		case cfg.HealthCheckInterval > 0 && now.Sub(s.lastChecked) > cfg.HealthCheckInterval:
+			// taken out of the pool while being checked
+			unchecked = append(unchecked, s)
+		default:
+			kept = append(kept, s)
+		}
+	}
+	clear(ms.idle[len(kept):])
+	ms.idle = kept
+	if len(expired) > 0 {
+		ms.open -= len(expired)
+		ms.notifyLocked()
+	}
+	ms.mu.Unlock()
+
+	for _, s := range expired {
+		_ = s.s.Close()
+	}
+	if len(expired) > 0 {
+		metrics.OutboundStreamsReaped.Add(ctx, int64(len(expired)), ms.m.protoAttr)
+	}
+
+	for _, s := range unchecked {
+		err := s.ping(ctx)
+		if err != nil {
+			ms.m.logger.Debugw("stream health check failed", "to", ms.p, "error", err)
+			metrics.OutboundStreamHealthCheckFailures.Add(ctx, 1, ms.m.protoAttr)
+		} else {
+			s.lastChecked = time.Now()
+		}
+		// the idle time keeps running, checks don't count as uses
+		ms.putBack(s, err == nil)
+	}
+}
+
+func (s *pooledStream) ping(ctx context.Context) error {
+	if err := WriteMsg(s.s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		return err
+	}
+	return s.ctxReadMsg(ctx, new(pb.Message))
+}
@@ -0,0 +1,23 @@
+package internal
+
+import "context"
+
+type operationKey struct{}
+
+// WithOperation returns a context attributing the work done with it to the
+// given routing operation. The outermost operation wins: if ctx is already
+// attributed to one, it is returned as is, so that the lookups a Provide runs
+// are accounted to the Provide.
+func WithOperation(ctx context.Context, op string) context.Context {
+	if Operation(ctx) != "" {
+		return ctx
+	}
+	return context.WithValue(ctx, operationKey{}, op)
+}
+
+// Operation returns the routing operation the context is attributed to, if
+// any.
+func Operation(ctx context.Context) string {
+	op, _ := ctx.Value(operationKey{}).(string)
+	return op
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the given request ID. Like
+// WithOperation, the outermost ID wins, so that the lookups run on behalf of
+// a routing call share its ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if RequestID(ctx) != "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID generates a random request ID.
+func NewRequestID() string {
+	return uuid.NewString()
+}
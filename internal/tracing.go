@@ -12,6 +12,12 @@ import (
 )
 
 func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if l := QueryLabel(ctx); l != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("QueryLabel", l)))
+	}
+	if id := RequestID(ctx); id != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("RequestID", id)))
+	}
 	return otel.Tracer("go-libp2p-kad-dht").Start(ctx, fmt.Sprintf("KademliaDHT.%s", name), opts...)
 }
 
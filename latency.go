@@ -0,0 +1,43 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// latencySender records the RTT of the successful requests into the latency
+// book of the host's peerstore, which is shared with the other subsystems of
+// the host. It wraps the senders given with a custom MsgSenderBuilder; the
+// default sender records the latencies itself, without the time taken to open
+// the stream.
+type latencySender struct {
+	pb.MessageSenderWithDisconnect
+	metrics peerstore.Metrics
+}
+
+func (s *latencySender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	start := time.Now()
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+	if err == nil {
+		s.metrics.RecordLatency(p, time.Since(start))
+	}
+	return resp, err
+}
+
+// peerLatency returns the average RTT the peerstore measured with p, falling
+// back to the duration of the request p answered during this query.
+func (q *query) peerLatency(p peer.ID) (time.Duration, bool) {
+	queryTime, ok := q.peerTimes[p]
+	if !ok {
+		return 0, false
+	}
+	if rtt := q.dht.peerstore.LatencyEWMA(p); rtt > 0 {
+		return rtt, true
+	}
+	return queryTime, true
+}
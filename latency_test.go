@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/stretchr/testify/require"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+type stubSender struct {
+	delay time.Duration
+	err   error
+}
+
+func (s *stubSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	time.Sleep(s.delay)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return pmes, nil
+}
+
+func (s *stubSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	return s.err
+}
+
+func (s *stubSender) OnDisconnect(ctx context.Context, p peer.ID) {}
+
+func TestLatencySender(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	defer ps.Close()
+
+	stub := &stubSender{delay: 10 * time.Millisecond, err: errors.New("boom")}
+	s := &latencySender{MessageSenderWithDisconnect: stub, metrics: ps}
+
+	_, err = s.SendRequest(context.Background(), "p", &pb.Message{})
+	require.Error(t, err)
+	require.Zero(t, ps.LatencyEWMA("p"), "failed requests must not be recorded")
+
+	stub.err = nil
+	_, err = s.SendRequest(context.Background(), "p", &pb.Message{})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, ps.LatencyEWMA("p"), stub.delay)
+}
@@ -1,8 +1,10 @@
 package dht
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
@@ -22,9 +24,10 @@ import (
 func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) ([]peer.ID, error) {
 	ctx, span := internal.StartSpan(ctx, "IpfsDHT.GetClosestPeers", trace.WithAttributes(internal.KeyAsAttribute("Key", key)))
 	defer span.End()
+	ctx = startRequest(ctx, "GetClosestPeers")
 
 	if key == "" {
-		return nil, fmt.Errorf("can't lookup empty key")
+		return nil, fmt.Errorf("%w: can't lookup empty key", ErrInvalidKey)
 	}
 
 	//TODO: I can break the interface! return []peer.ID
@@ -40,19 +43,98 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) ([]peer.ID,
 
 	// tracking lookup results for network size estimator
 	if err = dht.nsEstimator.Track(key, lookupRes.closest); err != nil {
-		logger.Warnf("network size estimator track peers: %s", err)
+		dht.requestLogger(ctx).Warnf("network size estimator track peers: %s", err)
 	}
 
 	if ns, err := dht.nsEstimator.NetworkSize(); err == nil {
-		metrics.SetNetworkSize(int64(ns))
+		metrics.SetProtocolNetworkSize(dht.protocols[0], int64(ns))
 	}
 
 	// refresh the cpl for this key as the query was successful
-	dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(key), time.Now())
+	dht.routingTable.ResetCplRefreshedAtForID(dht.kadKey(key), time.Now())
 
 	return lookupRes.peers, nil
 }
 
+// GetClosestPeersToKey is GetClosestPeers for a raw point of the keyspace
+// rather than for the hash of a key, letting applications place arbitrary
+// structures in the keyspace deterministically.
+//
+// Remote peers hash the keys they are asked about, so kadID can't be sent to
+// them as is. Instead, every FIND_NODE request is made for the closest peer to
+// kadID found so far: as peers are looked up by their hashed ID, the answers
+// converge towards kadID just like a regular lookup does.
+func (dht *IpfsDHT) GetClosestPeersToKey(ctx context.Context, kadID [32]byte) ([]peer.ID, error) {
+	target := kb.ID(kadID[:])
+	key := string(kadID[:])
+	ctx, span := internal.StartSpan(ctx, "IpfsDHT.GetClosestPeersToKey", trace.WithAttributes(internal.KeyAsAttribute("Key", key)))
+	defer span.End()
+	ctx = startRequest(ctx, "GetClosestPeersToKey")
+
+	probe := newKeyspaceProbe(dht, target)
+	queryFn := func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+		peers, err := dht.pmGetClosestPeers(string(probe.closest()))(ctx, p)
+		probe.observe(peers)
+		return peers, err
+	}
+	lookupRes, err := dht.runLookupWithFollowupToID(ctx, key, target, queryFn, func(*qpeerset.QueryPeerset) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil || !lookupRes.completed {
+		return lookupRes.peers, err
+	}
+
+	dht.routingTable.ResetCplRefreshedAtForID(target, time.Now())
+
+	return lookupRes.peers, nil
+}
+
+// keyspaceProbe tracks the closest known peer to a keyspace point, whose ID
+// is used as the key of the FIND_NODE requests sent towards that point.
+type keyspaceProbe struct {
+	dht    *IpfsDHT
+	target kb.ID
+
+	mu       sync.Mutex
+	best     peer.ID
+	bestDist []byte
+}
+
+func newKeyspaceProbe(dht *IpfsDHT, target kb.ID) *keyspaceProbe {
+	kp := &keyspaceProbe{dht: dht, target: target}
+	for _, p := range dht.routingTable.NearestPeers(target, 1) {
+		kp.consider(p)
+	}
+	if kp.best == "" {
+		kp.best = dht.self
+	}
+	return kp
+}
+
+func (kp *keyspaceProbe) closest() peer.ID {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	return kp.best
+}
+
+func (kp *keyspaceProbe) observe(peers []*peer.AddrInfo) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	for _, ai := range peers {
+		kp.consider(ai.ID)
+	}
+}
+
+// consider must be called with mu held, or before the probe is shared.
+func (kp *keyspaceProbe) consider(p peer.ID) {
+	dist := kp.dht.keyspaceHash.Distance([]byte(p), kp.target)
+	if kp.bestDist == nil || bytes.Compare(dist, kp.bestDist) < 0 {
+		kp.best, kp.bestDist = p, dist
+	}
+}
+
 // pmGetClosestPeers is the protocol messenger version of the GetClosestPeer queryFn.
 func (dht *IpfsDHT) pmGetClosestPeers(key string) queryFn {
 	return func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
@@ -64,7 +146,7 @@ func (dht *IpfsDHT) pmGetClosestPeers(key string) queryFn {
 
 		peers, err := dht.protoMessenger.GetClosestPeers(ctx, p, peer.ID(key))
 		if err != nil {
-			logger.Debugf("error getting closer peers: %s", err)
+			dht.logger.Debugf("error getting closer peers: %s", err)
 			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 				Type:  routing.QueryError,
 				ID:    p,
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// lookupPeerMemory is the estimated memory held by a lookup for every
+	// peer of its peer set: the entry, the peer ID and its keyspace key.
+	lookupPeerMemory = 256
+	// lookupRequestMemory is the estimated memory held by a lookup for every
+	// request in flight, mostly the response with its peers and addresses.
+	lookupRequestMemory = 8 << 10
+)
+
+// lookupMemory bounds the estimated memory held by the lookups running
+// concurrently on a DHT instance. A lookup is admitted while the memory in
+// use is below the budget, and then charged for the peers it learns about.
+// Admitted lookups may go over the budget, which only delays the next ones:
+// they wait, or fail with an *OverloadError matching ErrLookupMemoryExhausted
+// when failFast is set.
+//
+// A nil *lookupMemory does not limit anything.
+type lookupMemory struct {
+	budget   int64
+	failFast bool
+
+	mu   sync.Mutex
+	used int64
+	// freed is closed (and replaced) every time memory is released.
+	freed chan struct{}
+}
+
+func newLookupMemory(budget int64, failFast bool) *lookupMemory {
+	if budget <= 0 {
+		return nil
+	}
+	return &lookupMemory{budget: budget, failFast: failFast, freed: make(chan struct{})}
+}
+
+// admit waits until a lookup needing initial bytes fits in the budget, or
+// the context is cancelled. A lookup is always admitted when no other one is
+// running, whatever its size. The returned charge must be released once the
+// lookup is done.
+func (m *lookupMemory) admit(ctx context.Context, initial int64) (*lookupCharge, error) {
+	if m == nil {
+		return nil, nil
+	}
+	for {
+		m.mu.Lock()
+		if m.used == 0 || m.used+initial <= m.budget {
+			m.used += initial
+			m.mu.Unlock()
+			return &lookupCharge{m: m, n: initial}, nil
+		}
+		if m.failFast {
+			m.mu.Unlock()
+			return nil, &OverloadError{Reasons: []OverloadReason{OverloadLookupMemory}}
+		}
+		freed := m.freed
+		m.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// saturated reports whether the running lookups use up the budget.
+func (m *lookupMemory) saturated() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used >= m.budget
+}
+
+// lookupCharge is the memory charged to a single lookup.
+type lookupCharge struct {
+	m *lookupMemory
+	n int64
+}
+
+// add charges n more bytes to the lookup.
+func (c *lookupCharge) add(n int64) {
+	if c == nil || n == 0 {
+		return
+	}
+	c.m.mu.Lock()
+	c.m.used += n
+	c.m.mu.Unlock()
+	c.n += n
+}
+
+// release gives back all the memory charged to the lookup.
+func (c *lookupCharge) release() {
+	if c == nil {
+		return
+	}
+	c.m.mu.Lock()
+	c.m.used -= c.n
+	close(c.m.freed)
+	c.m.freed = make(chan struct{})
+	c.m.mu.Unlock()
+	c.n = 0
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupMemory(t *testing.T) {
+	ctx := context.Background()
+	m := newLookupMemory(1000, false)
+
+	// a lookup is admitted alone, even over the budget
+	c1, err := m.admit(ctx, 600)
+	require.NoError(t, err)
+	c1.add(600)
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = m.admit(tctx, 100)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	admitted := make(chan *lookupCharge)
+	go func() {
+		c, _ := m.admit(ctx, 600)
+		admitted <- c
+	}()
+	c1.release()
+	c2 := <-admitted
+	require.NotNil(t, c2)
+
+	m.failFast = true
+	_, err = m.admit(ctx, 600)
+	require.ErrorIs(t, err, ErrLookupMemoryExhausted)
+	c3, err := m.admit(ctx, 400)
+	require.NoError(t, err)
+	c3.release()
+	c2.release()
+	require.Zero(t, m.used)
+}
+
+func TestLookupMemoryDisabled(t *testing.T) {
+	m := newLookupMemory(0, true)
+	require.Nil(t, m)
+	c, err := m.admit(context.Background(), 1<<40)
+	require.NoError(t, err)
+	c.add(1 << 40)
+	c.release()
+}
+
+func TestLookupMemoryBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4, LookupMemoryBudget(64<<10, true))
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+	d := dhts[0]
+
+	_, err := d.GetClosestPeers(ctx, "hello")
+	require.NoError(t, err)
+	require.Zero(t, d.lookupMemory.used)
+
+	// a running lookup holding the whole budget
+	c, err := d.lookupMemory.admit(ctx, 64<<10)
+	require.NoError(t, err)
+	_, err = d.GetClosestPeers(ctx, "hello")
+	require.ErrorIs(t, err, ErrLookupMemoryExhausted)
+	c.release()
+
+	_, err = d.GetClosestPeers(ctx, "hello")
+	require.NoError(t, err)
+}
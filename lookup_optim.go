@@ -11,7 +11,6 @@ import (
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
-	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multihash"
 	ks "github.com/whyrusleeping/go-keyspace"
@@ -79,6 +78,9 @@ type optimisticState struct {
 
 	// putProvDone counts the ADD_PROVIDER RPCs that have completed (successful and unsuccessful)
 	putProvDone atomic.Int32
+
+	// reports the progress of the provide operation to the user, if requested
+	progress *provideProgressTracker
 }
 
 func (dht *IpfsDHT) newOptimisticState(ctx context.Context, key string) (*optimisticState, error) {
@@ -97,7 +99,7 @@ func (dht *IpfsDHT) newOptimisticState(ctx context.Context, key string) (*optimi
 		dht:                 dht,
 		key:                 key,
 		doneChan:            make(chan struct{}, returnThreshold), // buffered channel to not miss events
-		ksKey:               ks.XORKeySpace.Key([]byte(key)),
+		ksKey:               dht.keyspaceHash.Key([]byte(key)),
 		networkSize:         networkSize,
 		peerStates:          map[peer.ID]addProviderRPCState{},
 		individualThreshold: individualThreshold,
@@ -111,7 +113,7 @@ func (dht *IpfsDHT) optimisticProvide(outerCtx context.Context, keyMH multihash.
 	key := string(keyMH)
 
 	if key == "" {
-		return fmt.Errorf("can't lookup empty key")
+		return fmt.Errorf("%w: can't lookup empty key", ErrInvalidKey)
 	}
 
 	// initialize new context for all putProvider operations.
@@ -126,6 +128,7 @@ func (dht *IpfsDHT) optimisticProvide(outerCtx context.Context, keyMH multihash.
 		putCtxCancel()
 		return err
 	}
+	es.progress = provideProgressTrackerFromContext(outerCtx)
 
 	// initialize context that finishes when this function returns
 	innerCtx, innerCtxCancel := context.WithCancel(outerCtx)
@@ -151,13 +154,14 @@ func (dht *IpfsDHT) optimisticProvide(outerCtx context.Context, keyMH multihash.
 	// Store the provider records with all the closest peers we haven't already contacted/scheduled interaction with.
 	es.peerStatesLk.Lock()
 	for _, p := range lookupRes.peers {
-		if _, found := es.peerStates[p]; found {
+		if _, found := es.peerStates[p]; found || es.dht.IsObserver(p) {
 			continue
 		}
 
 		go es.putProviderRecord(p)
 		es.peerStates[p] = scheduled
 	}
+	es.progress.lookupDone(len(es.peerStates))
 	es.peerStatesLk.Unlock()
 
 	// wait until a threshold number of RPCs have completed
@@ -169,15 +173,15 @@ func (dht *IpfsDHT) optimisticProvide(outerCtx context.Context, keyMH multihash.
 
 	// tracking lookup results for network size estimator as "completed" is true
 	if err = dht.nsEstimator.Track(key, lookupRes.closest); err != nil {
-		logger.Warnf("network size estimator track peers: %s", err)
+		dht.logger.Warnf("network size estimator track peers: %s", err)
 	}
 
 	if ns, err := dht.nsEstimator.NetworkSize(); err == nil {
-		metrics.SetNetworkSize(int64(ns))
+		metrics.SetProtocolNetworkSize(dht.protocols[0], int64(ns))
 	}
 
 	// refresh the cpl for this key as the query was successful
-	dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(key), time.Now())
+	dht.routingTable.ResetCplRefreshedAtForID(dht.kadKey(key), time.Now())
 
 	return nil
 }
@@ -192,10 +196,10 @@ func (os *optimisticState) stopFn(qps *qpeerset.QueryPeerset) bool {
 	distances := make([]float64, os.dht.bucketSize)
 	for i, p := range closest {
 		// calculate distance of peer p to the target key
-		distances[i] = netsize.NormedDistance(p, os.ksKey)
+		distances[i] = netsize.NormedKeyDistance(os.dht.keyspaceHash.Key([]byte(p)), os.ksKey)
 
 		// Check if we have already scheduled interaction or have actually interacted with that peer
-		if _, found := os.peerStates[p]; found {
+		if _, found := os.peerStates[p]; found || os.dht.IsObserver(p) {
 			continue
 		}
 
@@ -247,6 +251,7 @@ func (os *optimisticState) putProviderRecord(pid peer.ID) {
 		os.peerStates[pid] = success
 	}
 	os.peerStatesLk.Unlock()
+	os.progress.putDone(pid, err)
 
 	// indicate that this ADD_PROVIDER RPC has completed
 	os.doneChan <- struct{}{}
@@ -2,9 +2,12 @@ package metrics
 
 import (
 	"context"
+	"sync"
 	"sync/atomic"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
@@ -17,91 +20,385 @@ var (
 	// KeyInstanceID identifies a dht instance by the pointer address.
 	// Useful for differentiating between different dhts that have the same peer id.
 	KeyInstanceID = "instance_id"
+	// KeyQueryLabel is the application label attached to the context of a
+	// routing call (see dht.WithQueryLabel).
+	KeyQueryLabel = "query_label"
+	// KeyOperation is the routing operation (e.g. "GetValue") bytes are
+	// attributed to.
+	KeyOperation = "operation"
+	// KeyNamespace is the namespace of a value record (e.g. "ipns"), "other"
+	// for the namespaces the validator doesn't know.
+	KeyNamespace = "namespace"
+	// KeyProtocol is the primary protocol of the DHT instance recording the
+	// measurement (e.g. "/ipfs/lan/kad/1.0.0"), telling apart the networks
+	// joined by the DHTs of a process.
+	KeyProtocol = "protocol"
+	// KeyAgent is the agent of a peer, its agent version trimmed to its name
+	// and version (e.g. "kubo/0.25.0"), "other" beyond the most common ones.
+	KeyAgent = "agent"
+	// KeyTransport is a transport a peer listens on (e.g. "quic-v1").
+	KeyTransport = "transport"
+	// KeyPeerProtocol is a DHT protocol a peer supports, unlike KeyProtocol
+	// which is the one of the DHT instance recording the measurement, "other"
+	// beyond the most common ones.
+	KeyPeerProtocol = "peer_protocol"
 )
 
+// WithProtocol sets the KeyProtocol of a measurement to p.
+func WithProtocol(p protocol.ID) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String(KeyProtocol, string(p)))
+}
+
 // UpsertMessageType is a convenience upserts the message type
 // of a pb.Message into the KeyMessageType.
 func UpsertMessageType(m *pb.Message) metric.MeasurementOption {
 	return metric.WithAttributes(attribute.String(KeyMessageType, m.Type.String()))
 }
 
+// MessageAttributes returns the message type of a pb.Message together with
+// the query label carried by the context, if any.
+func MessageAttributes(ctx context.Context, m *pb.Message) metric.MeasurementOption {
+	if l := internal.QueryLabel(ctx); l != "" {
+		return metric.WithAttributes(
+			attribute.String(KeyMessageType, m.Type.String()),
+			attribute.String(KeyQueryLabel, l),
+		)
+	}
+	return UpsertMessageType(m)
+}
+
 // Measures
 var (
 	meter = otel.Meter("libp2p.io/dht/kad")
 
 	// Define OpenTelemetry counters
-	ReceivedMessages, _ = meter.Int64Counter(
+	ReceivedMessages = newInt64Counter(
 		"libp2p.io/dht/kad/received_messages",
 		metric.WithDescription("Total number of messages received per RPC"),
 	)
 
-	ReceivedMessageErrors, _ = meter.Int64Counter(
+	ReceivedMessageErrors = newInt64Counter(
 		"libp2p.io/dht/kad/received_message_errors",
 		metric.WithDescription("Total number of errors for messages received per RPC"),
 	)
 
-	ReceivedBytes, _ = meter.Int64Counter(
+	ReceivedBytes = newInt64Counter(
 		"libp2p.io/dht/kad/received_bytes",
 		metric.WithDescription("Total received bytes per RPC"),
 		metric.WithUnit("By"),
 	)
 
-	InboundRequestLatency, _ = meter.Float64Histogram(
+	InboundRequestLatency = newFloat64Histogram(
 		"libp2p.io/dht/kad/inbound_request_latency",
 		metric.WithDescription("Latency per RPC"),
 		metric.WithUnit("ms"),
 	)
 
-	OutboundRequestLatency, _ = meter.Float64Histogram(
+	OutboundRequestLatency = newFloat64Histogram(
 		"libp2p.io/dht/kad/outbound_request_latency",
 		metric.WithDescription("Latency per RPC"),
 		metric.WithUnit("ms"),
 	)
 
-	SentMessages, _ = meter.Int64Counter(
+	ShedInboundRequests = newInt64Counter(
+		"libp2p.io/dht/kad/shed_inbound_requests",
+		metric.WithDescription("Total number of inbound requests rejected by resetting their stream because the handler budget was exhausted, per RPC and reason"),
+	)
+
+	RoutingTableEvictions = newInt64Counter(
+		"libp2p.io/dht/kad/routing_table_evictions",
+		metric.WithDescription("Total number of peers removed from the routing table, per reason"),
+	)
+
+	StoredRecords = newInt64Counter(
+		"libp2p.io/dht/kad/stored_records",
+		metric.WithDescription("Total number of value records written to the datastore, per namespace"),
+	)
+
+	StoredRecordBytes = newInt64Counter(
+		"libp2p.io/dht/kad/stored_record_bytes",
+		metric.WithDescription("Total size of the value records written to the datastore, per namespace"),
+		metric.WithUnit("By"),
+	)
+
+	ServedRecords = newInt64Counter(
+		"libp2p.io/dht/kad/served_records",
+		metric.WithDescription("Total number of value records returned to GET_VALUE requests, per namespace"),
+	)
+
+	RecordValidations = newInt64Counter(
+		"libp2p.io/dht/kad/record_validations",
+		metric.WithDescription("Total number of value records validated, per namespace and result"),
+	)
+
+	LookupChecks = newInt64Counter(
+		"libp2p.io/dht/kad/lookup_checks",
+		metric.WithDescription("Total number of newly found servers checked before adding them to the routing table, per outcome"),
+	)
+
+	SlowInboundRequests = newInt64Counter(
+		"libp2p.io/dht/kad/slow_inbound_requests",
+		metric.WithDescription("Total number of inbound requests whose handler exceeded the slow request threshold, per RPC"),
+	)
+
+	SentMessages = newInt64Counter(
 		"libp2p.io/dht/kad/sent_messages",
 		metric.WithDescription("Total number of messages sent per RPC"),
 	)
 
-	SentMessageErrors, _ = meter.Int64Counter(
+	SentMessageErrors = newInt64Counter(
 		"libp2p.io/dht/kad/sent_message_errors",
 		metric.WithDescription("Total number of errors for messages sent per RPC"),
 	)
 
-	SentRequests, _ = meter.Int64Counter(
+	SentRequests = newInt64Counter(
 		"libp2p.io/dht/kad/sent_requests",
 		metric.WithDescription("Total number of requests sent per RPC"),
 	)
 
-	SentRequestErrors, _ = meter.Int64Counter(
+	SentRequestErrors = newInt64Counter(
 		"libp2p.io/dht/kad/sent_request_errors",
 		metric.WithDescription("Total number of errors for requests sent per RPC"),
 	)
 
-	SentBytes, _ = meter.Int64Counter(
+	SentBytes = newInt64Counter(
 		"libp2p.io/dht/kad/sent_bytes",
 		metric.WithDescription("Total sent bytes per RPC"),
 		metric.WithUnit("By"),
 	)
 
+	OperationSentBytes = newInt64Counter(
+		"libp2p.io/dht/kad/operation_sent_bytes",
+		metric.WithDescription("Total sent bytes per routing operation"),
+		metric.WithUnit("By"),
+	)
+
+	OperationReceivedBytes = newInt64Counter(
+		"libp2p.io/dht/kad/operation_received_bytes",
+		metric.WithDescription("Total received bytes per routing operation"),
+		metric.WithUnit("By"),
+	)
+
+	ValueCorrections = newInt64Counter(
+		"libp2p.io/dht/kad/value_corrections",
+		metric.WithDescription("Total number of corrective PUT_VALUE sent to peers holding an outdated record"),
+	)
+
+	OutboundStreamsOpened = newInt64Counter(
+		"libp2p.io/dht/kad/outbound_streams_opened",
+		metric.WithDescription("Total number of streams opened to send requests and messages"),
+	)
+
+	OutboundStreamReuses = newInt64Counter(
+		"libp2p.io/dht/kad/outbound_stream_reuses",
+		metric.WithDescription("Total number of writes made over an already open stream"),
+	)
+
+	OutboundStreamsReaped = newInt64Counter(
+		"libp2p.io/dht/kad/outbound_streams_reaped",
+		metric.WithDescription("Total number of idle streams closed after their idle timeout"),
+	)
+
+	OutboundStreamHealthCheckFailures = newInt64Counter(
+		"libp2p.io/dht/kad/outbound_stream_health_check_failures",
+		metric.WithDescription("Total number of idle streams reset after failing a health check"),
+	)
+
+	CoalescedMessages = newInt64Counter(
+		"libp2p.io/dht/kad/coalesced_messages",
+		metric.WithDescription("Total number of outbound messages written together with other messages to the same peer"),
+	)
+
+	CircuitBreakerTransitions = newInt64Counter(
+		"libp2p.io/dht/kad/circuit_breaker_transitions",
+		metric.WithDescription("Total number of per-peer circuit breaker state changes, per new state"),
+	)
+
+	OpenCircuitBreakers = newInt64UpDownCounter(
+		"libp2p.io/dht/kad/open_circuit_breakers",
+		metric.WithDescription("Number of peers whose circuit breaker is open or half-open"),
+	)
+
+	KeyAvailabilityChecks = newInt64Counter(
+		"libp2p.io/dht/kad/key_availability_checks",
+		metric.WithDescription("Total number of availability checks of the monitored keys, per kind of key and outcome"),
+	)
+
+	UnavailableKeys = newInt64UpDownCounter(
+		"libp2p.io/dht/kad/unavailable_keys",
+		metric.WithDescription("Number of monitored keys that failed their last availability check"),
+	)
+
+	SelfAuditKeys = newInt64Counter(
+		"libp2p.io/dht/kad/self_audit_keys",
+		metric.WithDescription("Total number of stored keys sampled by self-audits, per outcome (placed, misplaced)"),
+	)
+
+	RoutingTableRefreshes = newInt64Counter(
+		"libp2p.io/dht/kad/routing_table_refreshes",
+		metric.WithDescription("Total number of completed routing table refreshes, per outcome (success, failure)"),
+	)
+
+	RefreshCplDuration = newFloat64Histogram(
+		"libp2p.io/dht/kad/refresh_cpl_duration",
+		metric.WithDescription("Duration of the refreshes of the routing table buckets, per cpl and outcome"),
+		metric.WithUnit("ms"),
+	)
+
+	LastRoutingTableRefresh = newInt64Gauge(
+		"libp2p.io/dht/kad/last_routing_table_refresh",
+		metric.WithDescription("Unix time of the end of the last successful routing table refresh"),
+		metric.WithUnit("s"),
+	)
+
+	IgnoredClientModeMessages = newInt64Counter(
+		"libp2p.io/dht/kad/ignored_client_mode_messages",
+		metric.WithDescription("Total number of inbound messages ignored because the DHT was not in server mode"),
+	)
+
+	OriginQuotaRejections = newInt64Counter(
+		"libp2p.io/dht/kad/origin_quota_rejections",
+		metric.WithDescription("Total number of records and provider records rejected for exceeding the storage quota of their origin peer, per kind"),
+	)
+
+	OriginQuotaEvictions = newInt64Counter(
+		"libp2p.io/dht/kad/origin_quota_evictions",
+		metric.WithDescription("Total number of records and provider records evicted to keep their origin peer within its storage quota, per kind"),
+	)
+
+	DeniedProviderRequests = newInt64Counter(
+		"libp2p.io/dht/kad/denied_provider_requests",
+		metric.WithDescription("Total number of provider records not stored or served because their key is denied, per message type"),
+	)
+
+	SpamKeysDetected = newInt64Counter(
+		"libp2p.io/dht/kad/spam_keys_detected",
+		metric.WithDescription("Total number of keys flagged for receiving an anomalous ADD_PROVIDER rate"),
+	)
+
+	SpamKeyRejections = newInt64Counter(
+		"libp2p.io/dht/kad/spam_key_rejections",
+		metric.WithDescription("Total number of provider records rejected because their key was flagged as flooded"),
+	)
+
+	GreylistedPeers = newInt64Counter(
+		"libp2p.io/dht/kad/greylisted_peers",
+		metric.WithDescription("Total number of peers greylisted for sending malformed or unexpected messages"),
+	)
+
+	GreylistedStreams = newInt64Counter(
+		"libp2p.io/dht/kad/greylisted_streams",
+		metric.WithDescription("Total number of inbound streams of greylisted peers reset"),
+	)
+
+	CandidatePeers = newInt64Counter(
+		"libp2p.io/dht/kad/candidate_peers",
+		metric.WithDescription("Total number of candidate peers fed to the routing table by other discovery subsystems, by outcome"),
+	)
+
+	ReprovideSkippedPeers = newInt64Counter(
+		"libp2p.io/dht/kad/reprovide_skipped_peers",
+		metric.WithDescription("Total number of closest peers Provide skipped as they already held a fresh provider record"),
+	)
+
+	AnnouncedKeys = newInt64Counter(
+		"libp2p.io/dht/kad/announced_keys",
+		metric.WithDescription("Total number of keys pushed to announcers that were provided, failed or dropped"),
+	)
+
+	BannedPeers = newInt64Counter(
+		"libp2p.io/dht/kad/banned_peers",
+		metric.WithDescription("Total number of peers banned from the DHT"),
+	)
+
+	RefusedForeignPeers = newInt64Counter(
+		"libp2p.io/dht/kad/refused_foreign_peers",
+		metric.WithDescription("Total number of times a peer speaking a refused protocol was kept out of the routing table"),
+	)
+
+	LookupPathDivergences = newInt64Counter(
+		"libp2p.io/dht/kad/lookup_path_divergences",
+		metric.WithDescription("Total number of cross-validated value lookups whose independent paths found different records"),
+	)
+
 	networkSize int64
+	// protocolNetworkSizes holds the network size estimations set with
+	// SetProtocolNetworkSize, by protocol.
+	protocolNetworkSizes sync.Map
+)
+
+var (
+	openStreamsInstrument = newInt64ObservableGauge("libp2p.io/dht/kad/open_streams",
+		"Number of open DHT streams, per direction (inbound, outbound)", "")
+	oldestStreamAgeInstrument = newObservableGauge("libp2p.io/dht/kad/oldest_stream_age",
+		"Age of the oldest open DHT stream, per direction (inbound, outbound)", "s")
 )
 
+// Gauges computed on demand, see RegisterObserver
+var (
+	RoutingTableChurn = newObservableGauge("libp2p.io/dht/kad/routing_table_churn",
+		"Fraction of the routing table peers replaced per hour, over the last hour", "")
+	LookupDeadPeerRatio = newObservableGauge("libp2p.io/dht/kad/lookup_dead_peer_ratio",
+		"Moving average of the fraction of the peers contacted by lookups that were unreachable", "")
+	PeerAgents = newObservableGauge("libp2p.io/dht/kad/peer_agents",
+		"Number of routing table and crawled peers, per agent", "")
+	PeerTransports = newObservableGauge("libp2p.io/dht/kad/peer_transports",
+		"Number of routing table and crawled peers, per transport they listen on", "")
+	PeerProtocols = newObservableGauge("libp2p.io/dht/kad/peer_protocols",
+		"Number of routing table and crawled peers, per DHT protocol they support", "")
+)
+
+var networkSizeInstrument = newInstrument("libp2p.io/dht/kad/network_size", Gauge, "Network size estimation", "")
+
 func init() {
 	// Register an observable gauge
 	meter.Int64ObservableGauge(
-		"libp2p.io/dht/kad/network_size",
-		metric.WithDescription("Network size estimation"),
+		networkSizeInstrument.Name,
+		metric.WithDescription(networkSizeInstrument.Description),
 		metric.WithInt64Callback(networkSizeCallback),
 	)
+
+	gauges := make([]metric.Observable, 0, len(observables))
+	for _, g := range observables {
+		gauges = append(gauges, g)
+	}
+	meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		Observe(func(inst *Instrument, value float64, attrs attribute.Set) {
+			switch g := observables[inst].(type) {
+			case metric.Int64ObservableGauge:
+				o.ObserveInt64(g, int64(value), metric.WithAttributeSet(attrs))
+			case metric.Float64ObservableGauge:
+				o.ObserveFloat64(g, value, metric.WithAttributeSet(attrs))
+			}
+		})
+		return nil
+	}, gauges...)
 }
 
 func networkSizeCallback(ctx context.Context, observer metric.Int64Observer) error {
-	observer.Observe(atomic.LoadInt64(&networkSize), metric.WithAttributes(attribute.String("instance", "default")))
+	if size := atomic.LoadInt64(&networkSize); size != 0 {
+		observer.Observe(size, metric.WithAttributes(attribute.String("instance", "default")))
+	}
+	protocolNetworkSizes.Range(func(p, size any) bool {
+		observer.Observe(size.(int64), WithProtocol(p.(protocol.ID)))
+		return true
+	})
 	return nil
 }
 
 // Function to update the network size estimation
+//
+// Deprecated: the estimations of the DHTs of a process joining different
+// networks overwrite each other, use SetProtocolNetworkSize.
 func SetNetworkSize(size int64) {
 	atomic.StoreInt64(&networkSize, size)
 }
+
+// SetProtocolNetworkSize updates the network size estimation of the network
+// the DHTs speaking protocol p belong to.
+func SetProtocolNetworkSize(p protocol.ID, size int64) {
+	protocolNetworkSizes.Store(p, size)
+	record(context.Background(), networkSizeInstrument, float64(size), func() attribute.Set {
+		return attribute.NewSet(attribute.String(KeyProtocol, string(p)))
+	})
+}
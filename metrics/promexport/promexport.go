@@ -0,0 +1,241 @@
+// Package promexport exports the DHT metrics to Prometheus directly, for the
+// deployments without an OpenTelemetry SDK and its Prometheus exporter.
+//
+//	if err := promexport.Register(prometheus.DefaultRegisterer); err != nil {
+//		return err
+//	}
+//
+// The metric names are the instrument names with the characters Prometheus
+// doesn't allow replaced with underscores, and the unit and "_total" suffixes
+// the OpenTelemetry exporter adds: "libp2p.io/dht/kad/received_messages" is
+// exported as "libp2p_io_dht_kad_received_messages_total". Latencies are
+// exported in seconds.
+package promexport
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type config struct {
+	buckets map[string][]float64
+}
+
+// Option configures Register.
+type Option func(*config) error
+
+// Buckets sets the buckets of the histogram instrument named name (e.g.
+// "libp2p.io/dht/kad/inbound_request_latency"), in the exported unit. By
+// default, the buckets are the metrics.LatencyBuckets set when registering.
+func Buckets(name string, buckets []float64) Option {
+	return func(c *config) error {
+		if len(buckets) == 0 {
+			return fmt.Errorf("no buckets for %s", name)
+		}
+		if !sort.Float64sAreSorted(buckets) {
+			return fmt.Errorf("buckets for %s must be sorted", name)
+		}
+		c.buckets[name] = append([]float64(nil), buckets...)
+		return nil
+	}
+}
+
+// Register registers a collector with reg exporting the measurements of all
+// the DHT instruments from now on. Counters start at zero when registered.
+func Register(reg prometheus.Registerer, opts ...Option) error {
+	cfg := config{buckets: make(map[string][]float64)}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return err
+		}
+	}
+
+	c := &collector{families: make(map[*metrics.Instrument]*family)}
+	for _, inst := range metrics.Instruments() {
+		f := &family{
+			inst:   inst,
+			name:   metricName(inst),
+			scale:  1,
+			series: make(map[attribute.Distinct]*series),
+		}
+		if inst.Unit == "ms" {
+			f.scale = 1e-3
+		}
+		if inst.Kind == metrics.Histogram {
+			f.buckets = cfg.buckets[inst.Name]
+			if f.buckets == nil {
+				for _, b := range metrics.LatencyBuckets() {
+					f.buckets = append(f.buckets, b*f.scale)
+				}
+			}
+		}
+		c.families[inst] = f
+	}
+	if err := reg.Register(c); err != nil {
+		return err
+	}
+	metrics.AddSink(c)
+	return nil
+}
+
+// metricName returns the Prometheus name of inst.
+func metricName(inst *metrics.Instrument) string {
+	name := sanitize(inst.Name)
+	switch inst.Unit {
+	case "By":
+		if !strings.HasSuffix(name, "_bytes") {
+			name += "_bytes"
+		}
+	case "ms", "s":
+		name += "_seconds"
+	}
+	if inst.Kind == metrics.Counter {
+		name += "_total"
+	}
+	return name
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// collector is an unchecked prometheus.Collector: the label names of an
+// instrument are only known once measured, so its series are exported with
+// all the label names seen so far, empty when unset.
+type collector struct {
+	families map[*metrics.Instrument]*family
+}
+
+type family struct {
+	inst    *metrics.Instrument
+	name    string
+	scale   float64
+	buckets []float64
+
+	mu     sync.Mutex
+	labels []attribute.Key
+	series map[attribute.Distinct]*series
+}
+
+type series struct {
+	attrs attribute.Set
+	value float64
+	// histograms only
+	count  uint64
+	counts []uint64
+}
+
+var _ metrics.Sink = (*collector)(nil)
+
+func (c *collector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *collector) Record(_ context.Context, inst *metrics.Instrument, value float64, attrs attribute.Set) {
+	f, ok := c.families[inst]
+	if !ok {
+		return
+	}
+	value *= f.scale
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[attrs.Equivalent()]
+	if !ok {
+		s = &series{attrs: attrs}
+		if f.inst.Kind == metrics.Histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[attrs.Equivalent()] = s
+		for _, k := range attrs.ToSlice() {
+			f.addLabel(k.Key)
+		}
+	}
+	switch f.inst.Kind {
+	case metrics.Gauge:
+		s.value = value
+	case metrics.Histogram:
+		s.value += value
+		s.count++
+		if i := sort.SearchFloat64s(f.buckets, value); i < len(f.buckets) {
+			s.counts[i]++
+		}
+	default:
+		s.value += value
+	}
+}
+
+func (f *family) addLabel(k attribute.Key) {
+	i := sort.Search(len(f.labels), func(i int) bool { return f.labels[i] >= k })
+	if i < len(f.labels) && f.labels[i] == k {
+		return
+	}
+	f.labels = append(f.labels, "")
+	copy(f.labels[i+1:], f.labels[i:])
+	f.labels[i] = k
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	metrics.Observe(func(inst *metrics.Instrument, value float64, attrs attribute.Set) {
+		c.Record(context.Background(), inst, value, attrs)
+	})
+	for _, f := range c.families {
+		f.collect(ch)
+	}
+}
+
+func (f *family) collect(ch chan<- prometheus.Metric) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+
+	labelNames := make([]string, len(f.labels))
+	for i, k := range f.labels {
+		labelNames[i] = sanitize(string(k))
+	}
+	desc := prometheus.NewDesc(f.name, f.inst.Description, labelNames, nil)
+
+	for _, s := range f.series {
+		labelValues := make([]string, len(f.labels))
+		for i, k := range f.labels {
+			if v, ok := s.attrs.Value(k); ok {
+				labelValues[i] = v.Emit()
+			}
+		}
+		var (
+			m   prometheus.Metric
+			err error
+		)
+		switch f.inst.Kind {
+		case metrics.Counter:
+			m, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, s.value, labelValues...)
+		case metrics.Histogram:
+			buckets := make(map[float64]uint64, len(f.buckets))
+			var cumulative uint64
+			for i, b := range f.buckets {
+				cumulative += s.counts[i]
+				buckets[b] = cumulative
+			}
+			m, err = prometheus.NewConstHistogram(desc, s.count, s.value, buckets, labelValues...)
+		default:
+			m, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, s.value, labelValues...)
+		}
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			continue
+		}
+		ch <- m
+	}
+}
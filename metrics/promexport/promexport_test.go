@@ -0,0 +1,92 @@
+package promexport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+func TestRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := Register(reg, Buckets("libp2p.io/dht/kad/inbound_request_latency", []float64{.001, .01, .1})); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	lan := metrics.WithProtocol("/ipfs/lan/kad/1.0.0")
+	find := metric.WithAttributes(attribute.String(metrics.KeyMessageType, "FIND_NODE"))
+	metrics.ReceivedMessages.Add(ctx, 2, find, lan)
+	metrics.ReceivedMessages.Add(ctx, 1, find)
+	metrics.InboundRequestLatency.Record(ctx, 5, lan)
+	metrics.InboundRequestLatency.Record(ctx, 50, lan)
+	metrics.SetProtocolNetworkSize("/ipfs/lan/kad/1.0.0", 42)
+	unregister := metrics.RegisterStreams("/ipfs/lan/kad/1.0.0", func() []metrics.OpenStreams {
+		return []metrics.OpenStreams{{Direction: "inbound", Open: 3, Oldest: time.Minute}}
+	})
+	defer unregister()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+
+	received := families["libp2p_io_dht_kad_received_messages_total"]
+	if received == nil || len(received.Metric) != 2 {
+		t.Fatalf("expected two received messages series, got %v", received)
+	}
+	for _, m := range received.Metric {
+		labels := make(map[string]string)
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		want := 1.0
+		if labels[metrics.KeyProtocol] == "/ipfs/lan/kad/1.0.0" {
+			want = 2
+		}
+		if labels[metrics.KeyMessageType] != "FIND_NODE" || m.Counter.GetValue() != want {
+			t.Errorf("unexpected series %v", m)
+		}
+	}
+
+	latency := families["libp2p_io_dht_kad_inbound_request_latency_seconds"]
+	if latency == nil || len(latency.Metric) != 1 {
+		t.Fatalf("expected one latency series, got %v", latency)
+	}
+	h := latency.Metric[0].Histogram
+	if h.GetSampleCount() != 2 || h.GetSampleSum() != .055 {
+		t.Errorf("unexpected histogram %v", h)
+	}
+	if b := h.Bucket; len(b) != 3 || b[0].GetCumulativeCount() != 0 || b[1].GetCumulativeCount() != 1 || b[2].GetCumulativeCount() != 2 {
+		t.Errorf("unexpected buckets %v", b)
+	}
+
+	streams := families["libp2p_io_dht_kad_open_streams"]
+	if streams == nil || len(streams.Metric) != 1 || streams.Metric[0].Gauge.GetValue() != 3 {
+		t.Errorf("unexpected open streams %v", streams)
+	}
+	age := families["libp2p_io_dht_kad_oldest_stream_age_seconds"]
+	if age == nil || len(age.Metric) != 1 || age.Metric[0].Gauge.GetValue() != 60 {
+		t.Errorf("unexpected oldest stream age %v", age)
+	}
+
+	size := families["libp2p_io_dht_kad_network_size"]
+	if size == nil || len(size.Metric) != 1 || size.Metric[0].Gauge.GetValue() != 42 {
+		t.Errorf("unexpected network size %v", size)
+	}
+}
+
+func TestBucketsValidation(t *testing.T) {
+	if err := Register(prometheus.NewRegistry(), Buckets("x", []float64{1, .1})); err == nil {
+		t.Fatal("expected unsorted buckets to be rejected")
+	}
+}
@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/embedded"
+)
+
+// InstrumentKind is the kind of a DHT instrument.
+type InstrumentKind int
+
+const (
+	// Counter instruments only go up.
+	Counter InstrumentKind = iota
+	// UpDownCounter instruments go up and down.
+	UpDownCounter
+	// Histogram instruments record a distribution of values.
+	Histogram
+	// Gauge instruments are set to their current value.
+	Gauge
+)
+
+// Instrument describes one of the instruments of the DHT.
+type Instrument struct {
+	Name        string
+	Description string
+	Unit        string
+	Kind        InstrumentKind
+}
+
+// Sink receives the measurements of the DHT instruments, in addition to the
+// OpenTelemetry meter. It lets exporters do without an OpenTelemetry SDK,
+// see the promexport package. Record must be safe for concurrent use.
+type Sink interface {
+	Record(ctx context.Context, inst *Instrument, value float64, attrs attribute.Set)
+}
+
+var (
+	instruments []*Instrument
+
+	sinksLk sync.Mutex
+	sinks   atomic.Pointer[[]Sink]
+)
+
+// Instruments returns the instruments of the DHT.
+func Instruments() []*Instrument {
+	return append([]*Instrument(nil), instruments...)
+}
+
+// AddSink makes s receive the measurements of all the DHT instruments from
+// now on. The gauges are replayed to it with their current values.
+func AddSink(s Sink) {
+	sinksLk.Lock()
+	var ss []Sink
+	if cur := sinks.Load(); cur != nil {
+		ss = append(ss, *cur...)
+	}
+	ss = append(ss, s)
+	sinks.Store(&ss)
+	sinksLk.Unlock()
+
+	protocolNetworkSizes.Range(func(p, size any) bool {
+		s.Record(context.Background(), networkSizeInstrument, float64(size.(int64)), attribute.NewSet(attribute.String(KeyProtocol, string(p.(protocol.ID)))))
+		return true
+	})
+}
+
+// record passes a measurement to the sinks. attrs is only called if there
+// are sinks, as merging the attributes of the options allocates.
+func record(ctx context.Context, inst *Instrument, value float64, attrs func() attribute.Set) {
+	ss := sinks.Load()
+	if ss == nil {
+		return
+	}
+	set := attrs()
+	for _, s := range *ss {
+		s.Record(ctx, inst, value, set)
+	}
+}
+
+func newInstrument(name string, kind InstrumentKind, desc, unit string) *Instrument {
+	inst := &Instrument{Name: name, Description: desc, Unit: unit, Kind: kind}
+	instruments = append(instruments, inst)
+	return inst
+}
+
+type int64Counter struct {
+	metric.Int64Counter
+	inst *Instrument
+}
+
+func newInt64Counter(name string, opts ...metric.Int64CounterOption) metric.Int64Counter {
+	c, _ := meter.Int64Counter(name, opts...)
+	cfg := metric.NewInt64CounterConfig(opts...)
+	return int64Counter{c, newInstrument(name, Counter, cfg.Description(), cfg.Unit())}
+}
+
+func (c int64Counter) Add(ctx context.Context, incr int64, opts ...metric.AddOption) {
+	c.Int64Counter.Add(ctx, incr, opts...)
+	record(ctx, c.inst, float64(incr), func() attribute.Set { return metric.NewAddConfig(opts).Attributes() })
+}
+
+type int64UpDownCounter struct {
+	metric.Int64UpDownCounter
+	inst *Instrument
+}
+
+func newInt64UpDownCounter(name string, opts ...metric.Int64UpDownCounterOption) metric.Int64UpDownCounter {
+	c, _ := meter.Int64UpDownCounter(name, opts...)
+	cfg := metric.NewInt64UpDownCounterConfig(opts...)
+	return int64UpDownCounter{c, newInstrument(name, UpDownCounter, cfg.Description(), cfg.Unit())}
+}
+
+func (c int64UpDownCounter) Add(ctx context.Context, incr int64, opts ...metric.AddOption) {
+	c.Int64UpDownCounter.Add(ctx, incr, opts...)
+	record(ctx, c.inst, float64(incr), func() attribute.Set { return metric.NewAddConfig(opts).Attributes() })
+}
+
+type int64Gauge struct {
+	metric.Int64Gauge
+	inst *Instrument
+}
+
+func newInt64Gauge(name string, opts ...metric.Int64GaugeOption) metric.Int64Gauge {
+	g, _ := meter.Int64Gauge(name, opts...)
+	cfg := metric.NewInt64GaugeConfig(opts...)
+	return int64Gauge{g, newInstrument(name, Gauge, cfg.Description(), cfg.Unit())}
+}
+
+func (g int64Gauge) Record(ctx context.Context, value int64, opts ...metric.RecordOption) {
+	g.Int64Gauge.Record(ctx, value, opts...)
+	record(ctx, g.inst, float64(value), func() attribute.Set { return metric.NewRecordConfig(opts).Attributes() })
+}
+
+// DefaultLatencyBuckets are the default bucket boundaries of the latency
+// histograms, in milliseconds, from the sub-millisecond requests of LAN peers
+// to the multi-second tails of the WAN.
+var DefaultLatencyBuckets = []float64{
+	.05, .1, .25, .5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000,
+}
+
+var (
+	latencyBucketsLk sync.Mutex
+	latencyBuckets   = DefaultLatencyBuckets
+	// histogramsCreated is set once the first latency measurement created
+	// the histograms, fixing their buckets.
+	histogramsCreated bool
+)
+
+// LatencyBuckets returns the bucket boundaries of the latency histograms, in
+// milliseconds.
+func LatencyBuckets() []float64 {
+	latencyBucketsLk.Lock()
+	defer latencyBucketsLk.Unlock()
+	return append([]float64(nil), latencyBuckets...)
+}
+
+// SetLatencyBuckets sets the bucket boundaries, in milliseconds, the latency
+// histograms (InboundRequestLatency, OutboundRequestLatency and
+// RefreshCplDuration) advise the OpenTelemetry SDK to use. The histograms are
+// shared by all the DHTs of the process, so this is a process-wide setting, to
+// call once at startup: as the histograms are created with the first latency
+// measurement, it fails once one was made with other boundaries.
+// Exponential histograms are configured with a view of the SDK instead.
+func SetLatencyBuckets(bounds []float64) error {
+	if len(bounds) == 0 {
+		return fmt.Errorf("no latency buckets")
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		return fmt.Errorf("latency buckets must be sorted")
+	}
+	latencyBucketsLk.Lock()
+	defer latencyBucketsLk.Unlock()
+	if histogramsCreated {
+		if slices.Equal(bounds, latencyBuckets) {
+			return nil
+		}
+		return fmt.Errorf("latency histograms already created with buckets %v", latencyBuckets)
+	}
+	latencyBuckets = append([]float64(nil), bounds...)
+	return nil
+}
+
+// float64Histogram is created on its first measurement, so that its buckets
+// can be set with SetLatencyBuckets.
+type float64Histogram struct {
+	embedded.Float64Histogram
+	inst *Instrument
+	opts []metric.Float64HistogramOption
+
+	once sync.Once
+	h    metric.Float64Histogram
+}
+
+func newFloat64Histogram(name string, opts ...metric.Float64HistogramOption) metric.Float64Histogram {
+	cfg := metric.NewFloat64HistogramConfig(opts...)
+	return &float64Histogram{inst: newInstrument(name, Histogram, cfg.Description(), cfg.Unit()), opts: opts}
+}
+
+func (h *float64Histogram) Record(ctx context.Context, value float64, opts ...metric.RecordOption) {
+	h.once.Do(func() {
+		latencyBucketsLk.Lock()
+		histogramsCreated = true
+		bounds := latencyBuckets
+		latencyBucketsLk.Unlock()
+		h.h, _ = meter.Float64Histogram(h.inst.Name, append(h.opts[:len(h.opts):len(h.opts)], metric.WithExplicitBucketBoundaries(bounds...))...)
+	})
+	h.h.Record(ctx, value, opts...)
+	record(ctx, h.inst, value, func() attribute.Set { return metric.NewRecordConfig(opts).Attributes() })
+}
+
+// Observer reports the current values of gauges computed on demand, see
+// RegisterObserver.
+type Observer func(observe func(inst *Instrument, value float64, attrs ...attribute.KeyValue))
+
+type observer struct {
+	protocol protocol.ID
+	f        Observer
+}
+
+// observers holds the observers registered with RegisterObserver.
+var observers sync.Map
+
+// observables are the OpenTelemetry instruments of the gauges computed on
+// demand, metric.Int64ObservableGauge or metric.Float64ObservableGauge.
+var observables = make(map[*Instrument]metric.Observable)
+
+func newObservableGauge(name, desc, unit string) *Instrument {
+	inst := newInstrument(name, Gauge, desc, unit)
+	observables[inst], _ = meter.Float64ObservableGauge(name, metric.WithDescription(desc), metric.WithUnit(unit))
+	return inst
+}
+
+func newInt64ObservableGauge(name, desc, unit string) *Instrument {
+	inst := newInstrument(name, Gauge, desc, unit)
+	observables[inst], _ = meter.Int64ObservableGauge(name, metric.WithDescription(desc), metric.WithUnit(unit))
+	return inst
+}
+
+// OpenStreams are the open streams of a DHT in one direction.
+type OpenStreams struct {
+	// Direction is "inbound" or "outbound".
+	Direction string
+	Open      int
+	// Oldest is the age of the oldest open stream.
+	Oldest time.Duration
+}
+
+// RegisterStreams makes the gauges of the open streams of the DHT speaking
+// protocol p report the streams returned by f, until unregistered.
+func RegisterStreams(p protocol.ID, f func() []OpenStreams) (unregister func()) {
+	return RegisterObserver(p, func(observe func(*Instrument, float64, ...attribute.KeyValue)) {
+		for _, s := range f() {
+			dir := attribute.String("direction", s.Direction)
+			observe(openStreamsInstrument, float64(s.Open), dir)
+			observe(oldestStreamAgeInstrument, s.Oldest.Seconds(), dir)
+		}
+	})
+}
+
+// RegisterObserver makes f report the values of the gauges computed on
+// demand, like RoutingTableChurn, for the DHT speaking protocol p until
+// unregistered. The values are tagged with p, and the attributes f passes.
+func RegisterObserver(p protocol.ID, f Observer) (unregister func()) {
+	o := &observer{protocol: p, f: f}
+	observers.Store(o, struct{}{})
+	return func() { observers.Delete(o) }
+}
+
+// Observe reports the current values of the gauges computed on demand to
+// observe. It is called by the sinks before exporting.
+func Observe(observe func(inst *Instrument, value float64, attrs attribute.Set)) {
+	observers.Range(func(k, _ any) bool {
+		o := k.(*observer)
+		o.f(func(inst *Instrument, value float64, attrs ...attribute.KeyValue) {
+			attrs = append(attrs, attribute.String(KeyProtocol, string(o.protocol)))
+			observe(inst, value, attribute.NewSet(attrs...))
+		})
+		return true
+	})
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetLatencyBuckets(t *testing.T) {
+	if err := SetLatencyBuckets([]float64{1, .1}); err == nil {
+		t.Fatal("expected unsorted buckets to be rejected")
+	}
+	if err := SetLatencyBuckets([]float64{.1, 1, 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	InboundRequestLatency.Record(context.Background(), 2)
+
+	if err := SetLatencyBuckets([]float64{.1, 1, 10}); err != nil {
+		t.Fatalf("expected the same buckets to be accepted, got %s", err)
+	}
+	if err := SetLatencyBuckets([]float64{1, 10}); err == nil {
+		t.Fatal("expected the buckets to be fixed once the histograms are created")
+	}
+	if b := LatencyBuckets(); len(b) != 3 || b[0] != .1 {
+		t.Fatalf("unexpected buckets %v", b)
+	}
+}
@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxNegativeCacheEntries bounds the size of the negative cache, expired
+// entries are pruned once it is reached and, if it is still full, new misses
+// are not cached.
+const maxNegativeCacheEntries = 8192
+
+type negativeCacheOptionsKey struct{}
+
+type negativeCacheOptions struct {
+	bypass bool
+	ttl    time.Duration
+}
+
+func negativeCacheOptionsFromContext(ctx context.Context) negativeCacheOptions {
+	o, _ := ctx.Value(negativeCacheOptionsKey{}).(negativeCacheOptions)
+	return o
+}
+
+// WithoutNegativeCache returns a context making FindPeer and FindProviders
+// calls ignore cached "not found" results and always perform a lookup.
+func WithoutNegativeCache(ctx context.Context) context.Context {
+	o := negativeCacheOptionsFromContext(ctx)
+	o.bypass = true
+	return context.WithValue(ctx, negativeCacheOptionsKey{}, o)
+}
+
+// WithNegativeCacheTTL returns a context making FindPeer and FindProviders
+// calls cache a "not found" result for ttl instead of the TTL configured with
+// the NegativeCacheTTL option. A negative ttl disables caching the result.
+func WithNegativeCacheTTL(ctx context.Context, ttl time.Duration) context.Context {
+	o := negativeCacheOptionsFromContext(ctx)
+	o.ttl = ttl
+	return context.WithValue(ctx, negativeCacheOptionsKey{}, o)
+}
+
+// negativeCache remembers the keys recent lookups failed to find anything for,
+// so that retries for missing content or peers don't each trigger a full
+// lookup.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{ttl: ttl, entries: make(map[string]time.Time)}
+}
+
+// has reports whether a lookup for key recently found nothing, unless the
+// context bypasses the cache.
+func (c *negativeCache) has(ctx context.Context, key string) bool {
+	if negativeCacheOptionsFromContext(ctx).bypass {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.entries[key]
+	if ok && time.Now().After(expires) {
+		delete(c.entries, key)
+		return false
+	}
+	return ok
+}
+
+// add records that the lookup for key found nothing.
+func (c *negativeCache) add(ctx context.Context, key string) {
+	ttl := c.ttl
+	if o := negativeCacheOptionsFromContext(ctx); o.ttl != 0 {
+		ttl = o.ttl
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxNegativeCacheEntries {
+		for k, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNegativeCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = now.Add(ttl)
+}
+
+func negativeCachePeerKey(key string) string     { return "/peer/" + key }
+func negativeCacheProviderKey(key string) string { return "/providers/" + key }
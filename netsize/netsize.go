@@ -11,6 +11,7 @@ import (
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	kbucket "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/peer"
 	ks "github.com/whyrusleeping/go-keyspace"
@@ -35,7 +36,8 @@ var (
 
 type Estimator struct {
 	localID    kbucket.ID
-	rt         *kbucket.RoutingTable
+	hash       internal.KeyspaceHash
+	rt         RoutingTable
 	bucketSize int
 
 	measurementsLk sync.RWMutex
@@ -44,7 +46,20 @@ type Estimator struct {
 	netSizeCache int32
 }
 
-func NewEstimator(localID peer.ID, rt *kbucket.RoutingTable, bucketSize int) *Estimator {
+// RoutingTable is the part of the routing table the Estimator relies on,
+// implemented by *kbucket.RoutingTable.
+type RoutingTable interface {
+	NPeersForCpl(cpl uint) int
+}
+
+func NewEstimator(localID peer.ID, rt RoutingTable, bucketSize int) *Estimator {
+	return NewEstimatorWithHash(localID, rt, bucketSize, nil)
+}
+
+// NewEstimatorWithHash creates an Estimator for a DHT mapping keys and peer IDs
+// into its keyspace with hash. A nil hash is sha256.
+func NewEstimatorWithHash(localID peer.ID, rt RoutingTable, bucketSize int, hash func([]byte) []byte) *Estimator {
+	h := internal.KeyspaceHash(hash)
 	// initialize map to hold measurement observations
 	measurements := map[int][]measurement{}
 	for i := 0; i < bucketSize; i++ {
@@ -52,7 +67,8 @@ func NewEstimator(localID peer.ID, rt *kbucket.RoutingTable, bucketSize int) *Es
 	}
 
 	return &Estimator{
-		localID:      kbucket.ConvertPeerID(localID),
+		localID:      h.ID([]byte(localID)),
+		hash:         h,
 		rt:           rt,
 		bucketSize:   bucketSize,
 		measurements: measurements,
@@ -62,7 +78,16 @@ func NewEstimator(localID peer.ID, rt *kbucket.RoutingTable, bucketSize int) *Es
 
 // NormedDistance calculates the normed XOR distance of the given keys (from 0 to 1).
 func NormedDistance(p peer.ID, k ks.Key) float64 {
-	pKey := ks.XORKeySpace.Key([]byte(p))
+	return normedDistance(ks.XORKeySpace.Key([]byte(p)), k)
+}
+
+// NormedKeyDistance is NormedDistance for a peer already mapped into the
+// keyspace, e.g. with a custom hash.
+func NormedKeyDistance(pKey ks.Key, k ks.Key) float64 {
+	return normedDistance(pKey, k)
+}
+
+func normedDistance(pKey ks.Key, k ks.Key) float64 {
 	ksDistance := new(big.Float).SetInt(pKey.Distance(k))
 	normedDist, _ := new(big.Float).Quo(ksDistance, keyspaceMaxFloat).Float64()
 	return normedDist
@@ -99,7 +124,7 @@ func (e *Estimator) Track(key string, peers []peer.ID) error {
 	weight := e.calcWeight(key, peers)
 
 	// Map given key to the Kademlia key space (hash it)
-	ksKey := ks.XORKeySpace.Key([]byte(key))
+	ksKey := e.hash.Key([]byte(key))
 
 	// the maximum age timestamp of the measurement data points
 	maxAgeTs := now.Add(-MaxMeasurementAge)
@@ -107,7 +132,7 @@ func (e *Estimator) Track(key string, peers []peer.ID) error {
 	for i, p := range peers {
 		// Construct measurement struct
 		m := measurement{
-			distance:  NormedDistance(p, ksKey),
+			distance:  normedDistance(e.hash.Key([]byte(p)), ksKey),
 			weight:    weight,
 			timestamp: now,
 		}
@@ -235,14 +260,14 @@ func (e *Estimator) NetworkSize() (int32, error) {
 // the Track function gets called. But they seem sometimes not to be added.
 func (e *Estimator) calcWeight(key string, peers []peer.ID) float64 {
 
-	cpl := kbucket.CommonPrefixLen(kbucket.ConvertKey(key), e.localID)
+	cpl := kbucket.CommonPrefixLen(e.hash.ID([]byte(key)), e.localID)
 	bucketLevel := e.rt.NPeersForCpl(uint(cpl))
 
 	if bucketLevel < e.bucketSize {
 		// routing table doesn't have a full bucket. Check how many peers would fit into that bucket
 		peerLevel := 0
 		for _, p := range peers {
-			if cpl == kbucket.CommonPrefixLen(kbucket.ConvertPeerID(p), e.localID) {
+			if cpl == kbucket.CommonPrefixLen(e.hash.ID([]byte(p)), e.localID) {
 				peerLevel += 1
 			}
 		}
@@ -282,3 +307,59 @@ func (e *Estimator) garbageCollect() {
 		}
 	}
 }
+
+// Measurement is a data point of an Estimator, as exported by Measurements.
+type Measurement struct {
+	// Bucket is the rank of the peer the distance was measured to, among
+	// the closest peers to the key.
+	Bucket    int
+	Distance  float64
+	Weight    float64
+	Timestamp time.Time
+}
+
+// Measurements returns the data points the estimate is currently based on.
+func (e *Estimator) Measurements() []Measurement {
+	e.measurementsLk.RLock()
+	defer e.measurementsLk.RUnlock()
+
+	var ms []Measurement
+	for i := 0; i < e.bucketSize; i++ {
+		for _, m := range e.measurements[i] {
+			ms = append(ms, Measurement{Bucket: i, Distance: m.distance, Weight: m.weight, Timestamp: m.timestamp})
+		}
+	}
+	return ms
+}
+
+// Restore adds data points exported by the Measurements of another Estimator,
+// for instance of a previous run. Data points out of the measurement time
+// window, or of a bucket this Estimator doesn't have, are ignored.
+func (e *Estimator) Restore(ms []Measurement) {
+	e.measurementsLk.Lock()
+	defer e.measurementsLk.Unlock()
+
+	maxAgeTs := time.Now().Add(-MaxMeasurementAge)
+	for _, m := range ms {
+		if m.Bucket < 0 || m.Bucket >= e.bucketSize || !m.Timestamp.After(maxAgeTs) {
+			continue
+		}
+		e.measurements[m.Bucket] = append(e.measurements[m.Bucket], measurement{
+			distance:  m.Distance,
+			weight:    m.Weight,
+			timestamp: m.Timestamp,
+		})
+	}
+	for i := 0; i < e.bucketSize; i++ {
+		measurements := e.measurements[i]
+		sort.SliceStable(measurements, func(a, b int) bool {
+			return measurements[a].timestamp.Before(measurements[b].timestamp)
+		})
+		if len(measurements) > MaxMeasurementsThreshold {
+			e.measurements[i] = measurements[len(measurements)-MaxMeasurementsThreshold:]
+		}
+	}
+
+	// invalidate cache
+	atomic.StoreInt32(&e.netSizeCache, invalidEstimate)
+}
@@ -42,3 +42,28 @@ func TestNormedDistance(t *testing.T) {
 	assert.Greater(t, 1.0, dist)
 	assert.Less(t, dist, 1.0)
 }
+
+func TestMeasurementsRestore(t *testing.T) {
+	bucketSize := 20
+
+	pid, err := pt.RandPeerID()
+	require.NoError(t, err)
+	rt, err := kbucket.NewRoutingTable(bucketSize, kbucket.ConvertPeerID(pid), time.Second, nil, time.Second, nil)
+	require.NoError(t, err)
+
+	e := NewEstimator(pid, rt, bucketSize)
+	now := time.Now()
+	ms := []Measurement{
+		{Bucket: 1, Distance: 0.2, Weight: 1, Timestamp: now},
+		{Bucket: 1, Distance: 0.1, Weight: 1, Timestamp: now.Add(-time.Minute)},
+		{Bucket: 2, Distance: 0.3, Weight: 1, Timestamp: now.Add(-2 * MaxMeasurementAge)},
+		{Bucket: bucketSize, Distance: 0.3, Weight: 1, Timestamp: now},
+	}
+	e.Restore(ms)
+
+	restored := e.Measurements()
+	require.Len(t, restored, 2)
+	// sorted by time within a bucket
+	assert.Equal(t, ms[1], restored[0])
+	assert.Equal(t, ms[0], restored[1])
+}
@@ -0,0 +1,29 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// IsObserver reports whether p advertised (via libp2p identify) that it runs
+// the DHT in ModeObserver, and so will not store nor serve records. Observers
+// still answer routing queries.
+func (dht *IpfsDHT) IsObserver(p peer.ID) bool {
+	protos, err := dht.peerstore.SupportsProtocols(p, dht.observerProtocol)
+	return err == nil && len(protos) > 0
+}
+
+type storageLookupKey struct{}
+
+// withStorageLookup returns a context making the lookups run with it look for
+// the peers a record is stored on. Observers are queried as any other peer,
+// but left out of the closest peers returned, as they would reject the record.
+func withStorageLookup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, storageLookupKey{}, true)
+}
+
+func isStorageLookup(ctx context.Context) bool {
+	storage, _ := ctx.Value(storageLookupKey{}).(bool)
+	return storage
+}
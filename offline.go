@@ -0,0 +1,19 @@
+package dht
+
+import "context"
+
+type offlineKey struct{}
+
+// WithOffline returns a context making GetValue, SearchValue, FindProviders,
+// FindProvidersAsync and FindPeer only consult the local datastore, provider
+// store and peerstore and return promptly, without starting network lookups.
+// For GetValue and SearchValue, this is the same as passing the routing.Offline
+// option.
+func WithOffline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, offlineKey{}, true)
+}
+
+func isOffline(ctx context.Context) bool {
+	offline, _ := ctx.Value(offlineKey{}).(bool)
+	return offline
+}
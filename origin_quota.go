@@ -0,0 +1,301 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+)
+
+// originSweepInterval is how often the usage of all the origins is pruned of
+// its expired entries, forgetting the peers that stopped storing.
+const originSweepInterval = time.Hour
+
+// providerRemover is implemented by the provider stores that can delete a
+// single record, like providers.ProviderManager.
+type providerRemover interface {
+	RemoveProvider(ctx context.Context, key []byte, p peer.ID) error
+}
+
+// originQuotas tracks what each peer stored on this server, in the order it
+// stored it, to keep it within the limits set with OriginQuota.
+//
+// A nil *originQuotas enforces no quota.
+type originQuotas struct {
+	maxRecords   int
+	maxProviders int
+	maxBytes     int64
+	recordTTL    time.Duration
+
+	mu      sync.Mutex
+	origins map[peer.ID]*originUsage
+	// record key -> peer that stored it last, kept for an evicted record
+	// until evictStored deletes it
+	owners    map[string]peer.ID
+	lastSweep time.Time
+}
+
+type originUsage struct {
+	entries   []quotaEntry // oldest first
+	records   int
+	providers int
+	bytes     int64
+}
+
+type quotaEntry struct {
+	provider bool
+	key      string
+	size     int64
+	expires  time.Time
+}
+
+func (e quotaEntry) kind() string {
+	if e.provider {
+		return "provider"
+	}
+	return "record"
+}
+
+func newOriginQuotas(records, providers int, bytes int64, recordTTL time.Duration) *originQuotas {
+	if records == 0 && providers == 0 && bytes == 0 {
+		return nil
+	}
+	return &originQuotas{
+		maxRecords:   records,
+		maxProviders: providers,
+		maxBytes:     bytes,
+		recordTTL:    recordTTL,
+		origins:      make(map[peer.ID]*originUsage),
+		owners:       make(map[string]peer.ID),
+		lastSweep:    time.Now(),
+	}
+}
+
+// fits reports whether e fits within the byte quota on its own.
+func (q *originQuotas) fits(e quotaEntry) bool {
+	return q.maxBytes == 0 || e.size <= q.maxBytes
+}
+
+// admit accounts for e stored by p, returning the entries of p to evict to
+// make room for it.
+func (q *originQuotas) admit(p peer.ID, e quotaEntry) (evicted []quotaEntry) {
+	now := time.Now()
+	if e.provider {
+		e.expires = now.Add(providers.ProvideValidity)
+	} else {
+		e.expires = now.Add(q.recordTTL)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.Sub(q.lastSweep) > originSweepInterval {
+		for o := range q.origins {
+			q.prune(o, now)
+		}
+		q.lastSweep = now
+	}
+
+	u := q.prune(p, now)
+	if u == nil {
+		u = new(originUsage)
+		q.origins[p] = u
+	}
+	// storing a key again makes it the newest entry
+	u.remove(e.provider, e.key)
+	if !e.provider {
+		if prev, ok := q.owners[e.key]; ok && prev != p {
+			if pu := q.origins[prev]; pu != nil {
+				pu.remove(false, e.key)
+				if len(pu.entries) == 0 {
+					delete(q.origins, prev)
+				}
+			}
+		}
+		q.owners[e.key] = p
+	}
+	u.add(e)
+
+	for {
+		var i int
+		ok := true
+		switch {
+		case q.maxRecords > 0 && u.records > q.maxRecords:
+			i, ok = u.oldest(func(e quotaEntry) bool { return !e.provider })
+		case q.maxProviders > 0 && u.providers > q.maxProviders:
+			i, ok = u.oldest(func(e quotaEntry) bool { return e.provider })
+		case q.maxBytes > 0 && u.bytes > q.maxBytes:
+			i, ok = 0, len(u.entries) > 0
+		default:
+			ok = false
+		}
+		if !ok {
+			return evicted
+		}
+		evicted = append(evicted, u.removeAt(i))
+	}
+}
+
+// evictable reports whether the record key evicted from the quota of p is
+// still to be deleted: it was neither stored again, by p or another peer,
+// nor overwritten by a local put. It forgets the owner of the key if so.
+func (q *originQuotas) evictable(key string, p peer.ID) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.owners[key] != p {
+		return false
+	}
+	if u := q.origins[p]; u != nil && u.has(false, key) {
+		return false
+	}
+	delete(q.owners, key)
+	return true
+}
+
+// release stops counting the record key against the quota of the peer that
+// stored it, once it is overwritten by a local put.
+func (q *originQuotas) release(key string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	prev, ok := q.owners[key]
+	if !ok {
+		return
+	}
+	delete(q.owners, key)
+	if u := q.origins[prev]; u != nil {
+		u.remove(false, key)
+		if len(u.entries) == 0 {
+			delete(q.origins, prev)
+		}
+	}
+}
+
+// prune drops the expired entries of p, returning its usage or nil if it has
+// none left.
+func (q *originQuotas) prune(p peer.ID, now time.Time) *originUsage {
+	u := q.origins[p]
+	if u == nil {
+		return nil
+	}
+	for i := 0; i < len(u.entries); {
+		if e := u.entries[i]; now.After(e.expires) {
+			u.removeAt(i)
+			if !e.provider && q.owners[e.key] == p {
+				delete(q.owners, e.key)
+			}
+			continue
+		}
+		i++
+	}
+	if len(u.entries) == 0 {
+		delete(q.origins, p)
+		return nil
+	}
+	return u
+}
+
+func (u *originUsage) add(e quotaEntry) {
+	u.entries = append(u.entries, e)
+	if e.provider {
+		u.providers++
+	} else {
+		u.records++
+	}
+	u.bytes += e.size
+}
+
+func (u *originUsage) removeAt(i int) quotaEntry {
+	e := u.entries[i]
+	u.entries = append(u.entries[:i], u.entries[i+1:]...)
+	if e.provider {
+		u.providers--
+	} else {
+		u.records--
+	}
+	u.bytes -= e.size
+	return e
+}
+
+func (u *originUsage) remove(provider bool, key string) {
+	for i, e := range u.entries {
+		if e.provider == provider && e.key == key {
+			u.removeAt(i)
+			return
+		}
+	}
+}
+
+func (u *originUsage) has(provider bool, key string) bool {
+	for _, e := range u.entries {
+		if e.provider == provider && e.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// oldest returns the index of the oldest entry matching match, or false if
+// there is none.
+func (u *originUsage) oldest(match func(quotaEntry) bool) (int, bool) {
+	for i, e := range u.entries {
+		if match(e) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// admitStored reports whether p may store the record or provider record e.
+// Once stored, e is charged to the quota of p with chargeStored.
+func (dht *IpfsDHT) admitStored(ctx context.Context, p peer.ID, e quotaEntry) bool {
+	if dht.originQuotas == nil || dht.originQuotas.fits(e) {
+		return true
+	}
+	metrics.OriginQuotaRejections.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", e.kind())), dht.protoAttr)
+	return false
+}
+
+// chargeStored accounts for the record or provider record e stored by p,
+// returning the entries to pass to evictStored to keep p within its quota.
+func (dht *IpfsDHT) chargeStored(p peer.ID, e quotaEntry) []quotaEntry {
+	if dht.originQuotas == nil {
+		return nil
+	}
+	return dht.originQuotas.admit(p, e)
+}
+
+// evictStored deletes the entries of p evicted by chargeStored, but for the
+// records stored again or overwritten by a local put since. It must not be
+// called with a put lock held.
+func (dht *IpfsDHT) evictStored(ctx context.Context, p peer.ID, evicted []quotaEntry) {
+	for _, e := range evicted {
+		metrics.OriginQuotaEvictions.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", e.kind())), dht.protoAttr)
+		if e.provider {
+			r, ok := dht.providerStore.(providerRemover)
+			if !ok {
+				continue
+			}
+			if err := r.RemoveProvider(ctx, []byte(e.key), p); err != nil {
+				dht.requestLogger(ctx).Warnw("failed to evict provider record", "from", p, "error", err)
+			}
+			continue
+		}
+
+		lk := dht.putLock([]byte(e.key))
+		lk.Lock()
+		if dht.originQuotas.evictable(e.key, p) {
+			if err := dht.datastore.Delete(ctx, convertToDsKey([]byte(e.key))); err != nil {
+				dht.requestLogger(ctx).Warnw("failed to evict record", "from", p, "error", err)
+			}
+		}
+		lk.Unlock()
+	}
+}
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginQuota(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := setupDHT(ctx, t, false, DisableAutoRefresh(), OriginQuota(2, 2, 0))
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, server)
+	connect(t, ctx, b, server)
+
+	require.Equal(t, 2, server.Config().OriginQuota.Records)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord(fmt.Sprintf("/v/a%d", i), []byte("a"))))
+	}
+	require.NoError(t, b.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord("/v/b", []byte("b"))))
+	// b storing a record of a makes it count against the quota of b
+	require.NoError(t, b.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord("/v/a2", []byte("b"))))
+	require.NoError(t, a.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord("/v/a3", []byte("a"))))
+
+	stored := func(key string) bool {
+		rec, err := server.getLocal(ctx, key)
+		require.NoError(t, err)
+		return rec != nil
+	}
+	require.False(t, stored("/v/a0"), "the oldest record of a should have been evicted")
+	require.True(t, stored("/v/a1"))
+	require.True(t, stored("/v/a2"))
+	require.True(t, stored("/v/a3"))
+	require.True(t, stored("/v/b"))
+
+	for _, c := range testCaseCids[:3] {
+		require.NoError(t, a.protoMessenger.PutProvider(ctx, server.self, c.Hash(), a.host))
+	}
+	require.Eventually(t, func() bool {
+		provs, _ := server.providerStore.GetProviders(ctx, testCaseCids[2].Hash())
+		return len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	provs, err := server.providerStore.GetProviders(ctx, testCaseCids[0].Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs, "the oldest provider record of a should have been evicted")
+	provs, err = server.providerStore.GetProviders(ctx, testCaseCids[1].Hash())
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+}
+
+func TestOriginQuotaBytes(t *testing.T) {
+	q := newOriginQuotas(0, 0, 10, time.Hour)
+
+	evicted := q.admit("a", quotaEntry{key: "1", size: 4})
+	require.Empty(t, evicted)
+	q.admit("a", quotaEntry{provider: true, key: "2", size: 4})
+	evicted = q.admit("a", quotaEntry{key: "3", size: 4})
+	require.Len(t, evicted, 1)
+	require.Equal(t, "1", evicted[0].key)
+	require.True(t, q.evictable("1", "a"))
+	require.False(t, q.evictable("1", "a"), "an evicted record should be deleted once")
+
+	// other origins have their own quota
+	require.True(t, q.fits(quotaEntry{key: "4", size: 10}))
+	evicted = q.admit("b", quotaEntry{key: "4", size: 10})
+	require.Empty(t, evicted)
+
+	require.False(t, q.fits(quotaEntry{key: "5", size: 11}), "a record larger than the quota should be rejected")
+}
+
+func TestOriginQuotaLocalPut(t *testing.T) {
+	q := newOriginQuotas(1, 0, 0, time.Hour)
+
+	q.admit("a", quotaEntry{key: "1", size: 1})
+	evicted := q.admit("a", quotaEntry{key: "2", size: 1})
+	require.Len(t, evicted, 1)
+
+	// a local put of the evicted record before it is deleted keeps it
+	q.release("1")
+	require.False(t, q.evictable("1", "a"))
+
+	// and a record overwritten locally no longer counts against the quota
+	q.release("2")
+	evicted = q.admit("a", quotaEntry{key: "3", size: 1})
+	require.Empty(t, evicted)
+}
+
+func TestOriginQuotaFailedStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, OriginQuota(0, 1, 0))
+	provider := setupDHT(ctx, t, false)
+
+	fail := true
+	d.providerStore = &testProviderManager{
+		addProvider: func(ctx context.Context, key []byte, prov peer.AddrInfo) error {
+			if fail {
+				return errors.New("store failed")
+			}
+			return nil
+		},
+		close: func() error { return nil },
+	}
+	addProvider := func(key string) {
+		pmes := &pb.Message{
+			Type:          pb.Message_ADD_PROVIDER,
+			Key:           []byte(key),
+			ProviderPeers: pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: provider.self, Addrs: provider.host.Addrs()}}),
+		}
+		_, err := d.handleAddProvider(ctx, provider.self, pmes)
+		require.NoError(t, err)
+	}
+	charged := func() []quotaEntry {
+		d.originQuotas.mu.Lock()
+		defer d.originQuotas.mu.Unlock()
+		if u := d.originQuotas.origins[provider.self]; u != nil {
+			return append([]quotaEntry(nil), u.entries...)
+		}
+		return nil
+	}
+
+	// a record that failed to be stored doesn't count against the quota
+	addProvider("k1")
+	require.Empty(t, charged())
+
+	fail = false
+	addProvider("k2")
+	entries := charged()
+	require.Len(t, entries, 1)
+	require.Equal(t, "k2", entries[0].key)
+}
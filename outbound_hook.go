@@ -0,0 +1,35 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// OutboundHook is called before every outbound RPC, see OnOutboundRequest.
+type OutboundHook = dhtcfg.OutboundHook
+
+// hookSender passes the outbound RPCs through the OnOutboundRequest hook
+// before sending them. It wraps the circuit breakers, so that vetoed RPCs
+// don't count as failures of the peer.
+type hookSender struct {
+	pb.MessageSenderWithDisconnect
+	hook OutboundHook
+}
+
+func (s *hookSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	if err := s.hook(ctx, p, pmes); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSendVetoed, err)
+	}
+	return s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+}
+
+func (s *hookSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	if err := s.hook(ctx, p, pmes); err != nil {
+		return fmt.Errorf("%w: %w", ErrSendVetoed, err)
+	}
+	return s.MessageSenderWithDisconnect.SendMessage(ctx, p, pmes)
+}
@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnOutboundRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errPolicy := errors.New("policy")
+	var veto atomic.Bool
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), OnOutboundRequest(func(ctx context.Context, p peer.ID, msg *pb.Message) error {
+		if veto.Load() {
+			return errPolicy
+		}
+		msg.ClusterLevelRaw = 7
+		return nil
+	}))
+	var clusterLevel atomic.Int32
+	b := setupDHT(ctx, t, false, DisableAutoRefresh(), OnRequestHook(func(ctx context.Context, s network.Stream, req *pb.Message) {
+		clusterLevel.Store(req.ClusterLevelRaw)
+	}))
+	connect(t, ctx, a, b)
+	require.True(t, a.Config().OnOutboundRequest)
+
+	// the message is mutated before being sent
+	_, err := a.protoMessenger.GetClosestPeers(ctx, b.self, a.self)
+	require.NoError(t, err)
+	require.EqualValues(t, 7, clusterLevel.Load())
+
+	// vetoed RPCs fail without evicting the peer
+	veto.Store(true)
+	_, err = a.protoMessenger.GetClosestPeers(ctx, b.self, a.self)
+	require.ErrorIs(t, err, ErrSendVetoed)
+	require.ErrorIs(t, err, errPolicy)
+	_, _ = a.GetClosestPeers(ctx, "key")
+	require.NotEqual(t, "", a.routingTable.Find(b.self))
+}
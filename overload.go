@@ -0,0 +1,147 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// OverloadReason names a saturated resource of the DHT.
+type OverloadReason string
+
+const (
+	// OverloadOutboundRequests: all the slots of MaxOutboundRequests are in use.
+	OverloadOutboundRequests OverloadReason = "outbound_requests"
+	// OverloadQueryWorkers: the requests of the lookups are queued, waiting
+	// for one of the QueryWorkers.
+	OverloadQueryWorkers OverloadReason = "query_workers"
+	// OverloadLookupMemory: the running lookups use up the LookupMemoryBudget.
+	OverloadLookupMemory OverloadReason = "lookup_memory"
+	// OverloadInboundHandlers: all the InboundHandlerBudget slots are busy
+	// handling requests.
+	OverloadInboundHandlers OverloadReason = "inbound_handlers"
+	// OverloadProvideQueue: the provides queued with ScheduleProvide will
+	// take more than a minute to run at the configured rate.
+	OverloadProvideQueue OverloadReason = "provide_queue"
+	// OverloadResourceLimits: the resource manager of the host recently
+	// refused to open a stream for the DHT.
+	OverloadResourceLimits OverloadReason = "resource_limits"
+)
+
+const (
+	// provideBacklogLimit is the time to run the queued provides above which
+	// the provide scheduler is saturated.
+	provideBacklogLimit = time.Minute
+	// resourceLimitWindow is how long the DHT is deemed saturated after the
+	// resource manager refused a stream.
+	resourceLimitWindow = 10 * time.Second
+)
+
+// ErrOverloaded is matched by an *OverloadError, returned by Overloaded when
+// the DHT is saturated.
+var ErrOverloaded = errors.New("dht overloaded")
+
+// OverloadError lists the saturated resources of the DHT. It matches
+// ErrOverloaded, and ErrLookupMemoryExhausted when the lookup memory budget
+// is among them.
+type OverloadError struct {
+	Reasons []OverloadReason
+}
+
+func (e *OverloadError) Error() string {
+	reasons := make([]string, len(e.Reasons))
+	for i, r := range e.Reasons {
+		reasons[i] = string(r)
+	}
+	return "dht overloaded: " + strings.Join(reasons, ", ")
+}
+
+func (e *OverloadError) Is(target error) bool {
+	if target == ErrOverloaded {
+		return true
+	}
+	if target == ErrLookupMemoryExhausted {
+		for _, r := range e.Reasons {
+			if r == OverloadLookupMemory {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Overloaded returns an *OverloadError if the work queues or the limits of the
+// DHT are saturated, nil otherwise. Upper layers, such as content routing
+// systems announcing many keys, should back off while it returns an error
+// rather than piling up more routing calls, which would only wait longer.
+//
+// Only the resources bounded by the configuration are checked: a DHT without
+// MaxOutboundRequests, QueryWorkers, LookupMemoryBudget or InboundHandlerBudget
+// can only be saturated by its provide queue or the resource manager.
+func (dht *IpfsDHT) Overloaded() error {
+	var reasons []OverloadReason
+	if dht.outboundLimiter.Load().saturated() {
+		reasons = append(reasons, OverloadOutboundRequests)
+	}
+	if dht.queryWorkers.saturated() {
+		reasons = append(reasons, OverloadQueryWorkers)
+	}
+	if dht.lookupMemory.saturated() {
+		reasons = append(reasons, OverloadLookupMemory)
+	}
+	if dht.handlerBudget.saturated() {
+		reasons = append(reasons, OverloadInboundHandlers)
+	}
+	if dht.provideScheduler.saturated() {
+		reasons = append(reasons, OverloadProvideQueue)
+	}
+	if dht.resourceLimits.hitSince(time.Now().Add(-resourceLimitWindow)) {
+		reasons = append(reasons, OverloadResourceLimits)
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return &OverloadError{Reasons: reasons}
+}
+
+// resourceLimits remembers when the resource manager last refused a stream.
+type resourceLimits struct {
+	lastHit atomic.Int64 // unix nanoseconds, 0 if never
+}
+
+func (l *resourceLimits) observe(err error) {
+	if err != nil && errors.Is(err, network.ErrResourceLimitExceeded) {
+		l.lastHit.Store(time.Now().UnixNano())
+	}
+}
+
+// hitSince reports whether a stream was refused after t.
+func (l *resourceLimits) hitSince(t time.Time) bool {
+	last := l.lastHit.Load()
+	return last != 0 && last > t.UnixNano()
+}
+
+// resourceLimitSender records the requests failing on the resource manager
+// limits.
+type resourceLimitSender struct {
+	pb.MessageSenderWithDisconnect
+	limits *resourceLimits
+}
+
+func (s *resourceLimitSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+	s.limits.observe(err)
+	return resp, err
+}
+
+func (s *resourceLimitSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	err := s.MessageSenderWithDisconnect.SendMessage(ctx, p, pmes)
+	s.limits.observe(err)
+	return err
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-test/random"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverloaded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, InboundHandlerBudget(1, 0), LookupMemoryBudget(1000, true))
+	connect(t, ctx, d, setupDHT(ctx, t, false))
+	require.NoError(t, d.Overloaded())
+
+	_, ok := d.handlerBudget.acquire(ctx)
+	require.True(t, ok)
+	charge, err := d.lookupMemory.admit(ctx, 1000)
+	require.NoError(t, err)
+	d.resourceLimits.observe(fmt.Errorf("opening stream: %w", network.ErrResourceLimitExceeded))
+
+	err = d.Overloaded()
+	require.ErrorIs(t, err, ErrOverloaded)
+	require.ErrorIs(t, err, ErrLookupMemoryExhausted)
+	var oe *OverloadError
+	require.ErrorAs(t, err, &oe)
+	require.Equal(t, []OverloadReason{OverloadLookupMemory, OverloadInboundHandlers, OverloadResourceLimits}, oe.Reasons)
+
+	// lookups failing fast report the overload
+	_, err = d.GetClosestPeers(ctx, "key")
+	require.ErrorIs(t, err, ErrOverloaded)
+
+	d.handlerBudget.release()
+	charge.release()
+	d.resourceLimits.lastHit.Store(time.Now().Add(-2 * resourceLimitWindow).UnixNano())
+	require.NoError(t, d.Overloaded())
+}
+
+func TestOverloadedProvideQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, ProvideSchedulerLimits(1, 1))
+	require.NoError(t, d.ScheduleProvide(random.Cids(2*int(provideBacklogLimit/time.Second))...))
+	err := d.Overloaded()
+	var oe *OverloadError
+	require.ErrorAs(t, err, &oe)
+	require.Equal(t, []OverloadReason{OverloadProvideQueue}, oe.Reasons)
+}
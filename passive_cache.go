@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// passiveCache holds the valid records and provider entries a client-mode node
+// observed during its own lookups, so that repeated resolutions of the same
+// key don't hit the network every time. Entries expire after a TTL and the
+// least recently used ones are evicted once the cache is full.
+//
+// A nil *passiveCache caches nothing.
+type passiveCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache *lru.LRU
+}
+
+type passiveCacheEntry struct {
+	value     []byte
+	providers []peer.AddrInfo
+	expires   time.Time
+}
+
+func newPassiveCache(size int, ttl time.Duration) *passiveCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	cache, err := lru.NewLRU(size, nil)
+	if err != nil {
+		panic(err) // only errors if size <= 0
+	}
+	return &passiveCache{ttl: ttl, cache: cache}
+}
+
+func (c *passiveCache) get(key string) (passiveCacheEntry, bool) {
+	if c == nil {
+		return passiveCacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return passiveCacheEntry{}, false
+	}
+	e := v.(passiveCacheEntry)
+	if time.Now().After(e.expires) {
+		c.cache.Remove(key)
+		return passiveCacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *passiveCache) add(key string, e passiveCacheEntry) {
+	if c == nil {
+		return
+	}
+	e.expires = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	c.cache.Add(key, e)
+	c.mu.Unlock()
+}
+
+// cachedValue returns the cached record value for key, if it is still valid,
+// in client mode. A server holds the records it is responsible for and must
+// see the updates of the others.
+func (dht *IpfsDHT) cachedValue(key string) ([]byte, bool) {
+	if dht.getMode() != modeClient {
+		return nil, false
+	}
+	e, ok := dht.passiveCache.get("/value/" + key)
+	if !ok {
+		return nil, false
+	}
+	// the record may have expired since it was cached (e.g. an IPNS record)
+	if err := dht.Validator.Validate(key, e.value); err != nil {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// cacheValue caches a valid record value found by a lookup, in client mode.
+func (dht *IpfsDHT) cacheValue(key string, value []byte) {
+	if dht.getMode() != modeClient {
+		return
+	}
+	dht.passiveCache.add("/value/"+key, passiveCacheEntry{value: value})
+}
+
+// cachedProviders returns the cached provider entries for key, in client mode.
+func (dht *IpfsDHT) cachedProviders(key string) ([]peer.AddrInfo, bool) {
+	if dht.getMode() != modeClient {
+		return nil, false
+	}
+	e, ok := dht.passiveCache.get("/providers/" + key)
+	return e.providers, ok
+}
+
+// cacheProviders caches the provider entries found by a lookup, in client mode.
+func (dht *IpfsDHT) cacheProviders(key string, providers []peer.AddrInfo) {
+	if dht.getMode() != modeClient || len(providers) == 0 {
+		return
+	}
+	dht.passiveCache.add("/providers/"+key, passiveCacheEntry{providers: providers})
+}
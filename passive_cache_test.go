@@ -0,0 +1,27 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassiveCacheClientOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, ClientCache(10, time.Hour))
+	key := string(testCaseCids[0].Hash())
+	d.passiveCache.add("/providers/"+key, passiveCacheEntry{providers: []peer.AddrInfo{{ID: "p"}}})
+
+	_, ok := d.cachedProviders(key)
+	require.False(t, ok)
+
+	require.NoError(t, d.setMode(modeClient))
+	provs, ok := d.cachedProviders(key)
+	require.True(t, ok)
+	require.Len(t, provs, 1)
+}
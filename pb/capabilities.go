@@ -0,0 +1,28 @@
+package dht_pb
+
+// Capabilities is a bitfield of the optional protocol features a peer
+// supports. Servers advertise theirs in the Capabilities field of their
+// responses, letting clients adapt to each peer instead of relying on the
+// protocol ID alone. Unknown bits must be ignored.
+type Capabilities uint64
+
+const (
+	// CapPaging is set by peers able to split large responses into pages.
+	CapPaging Capabilities = 1 << iota
+	// CapCompression is set by peers accepting compressed messages.
+	CapCompression
+	// CapRecordTTL is set by peers honoring the TTL requested for the
+	// records they store.
+	CapRecordTTL
+	// CapMetadataRecords is set by peers storing provider records with
+	// metadata.
+	CapMetadataRecords
+	// CapPing is set by peers answering PING requests with an empty PING
+	// response, a liveness probe cheaper than a FIND_NODE.
+	CapPing
+)
+
+// Has reports whether all the capabilities of f are set in c.
+func (c Capabilities) Has(f Capabilities) bool {
+	return c&f == f
+}
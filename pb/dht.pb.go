@@ -115,10 +115,22 @@ type Message struct {
 	CloserPeers []Message_Peer `protobuf:"bytes,8,rep,name=closerPeers,proto3" json:"closerPeers"`
 	// Used to return Providers
 	// GET_VALUE, ADD_PROVIDER, GET_PROVIDERS
-	ProviderPeers        []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	ProviderPeers []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
+	// Bitfield of the optional protocol features supported by the sender
+	// of a response
+	Capabilities uint64 `protobuf:"varint,11,opt,name=capabilities,proto3" json:"capabilities,omitempty"`
+	// Signature of the request by the key of its sender, over the message
+	// without it
+	Signature []byte `protobuf:"bytes,12,opt,name=signature,proto3" json:"signature,omitempty"`
+	// Signed peer record of the sender of a response, as a marshaled
+	// envelope
+	SenderRecord []byte `protobuf:"bytes,13,opt,name=senderRecord,proto3" json:"senderRecord,omitempty"`
+	// Application data piggybacked on a request or response, opaque to the
+	// DHT
+	Extension            []byte   `protobuf:"bytes,14,opt,name=extension,proto3" json:"extension,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
@@ -196,6 +208,34 @@ func (m *Message) GetProviderPeers() []Message_Peer {
 	return nil
 }
 
+func (m *Message) GetCapabilities() uint64 {
+	if m != nil {
+		return m.Capabilities
+	}
+	return 0
+}
+
+func (m *Message) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *Message) GetSenderRecord() []byte {
+	if m != nil {
+		return m.SenderRecord
+	}
+	return nil
+}
+
+func (m *Message) GetExtension() []byte {
+	if m != nil {
+		return m.Extension
+	}
+	return nil
+}
+
 type Message_Peer struct {
 	// ID of a given peer.
 	Id byteString `protobuf:"bytes,1,opt,name=id,proto3,customtype=byteString" json:"id"`
@@ -265,37 +305,38 @@ func init() {
 func init() { proto.RegisterFile("dht.proto", fileDescriptor_616a434b24c97ff4) }
 
 var fileDescriptor_616a434b24c97ff4 = []byte{
-	// 469 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0xb1, 0x6f, 0x9b, 0x40,
-	0x18, 0xc5, 0x73, 0x80, 0xdd, 0xf8, 0x03, 0x3b, 0xe4, 0x94, 0x01, 0xb9, 0x92, 0x83, 0x3c, 0xd1,
-	0xc1, 0x20, 0xd1, 0xb5, 0xaa, 0x6a, 0x03, 0x8d, 0x2c, 0xa5, 0xd8, 0xba, 0x38, 0xe9, 0x68, 0x19,
-	0xb8, 0x12, 0x54, 0xd7, 0x87, 0x00, 0xa7, 0xf2, 0xd6, 0x3f, 0x2f, 0x63, 0xe7, 0x0e, 0x51, 0xe5,
-	0xa9, 0x7f, 0x46, 0xc5, 0x11, 0x5a, 0xec, 0x25, 0x13, 0xef, 0x7d, 0xf7, 0x7e, 0xe2, 0xdd, 0xa7,
-	0x83, 0x4e, 0x74, 0x5f, 0x98, 0x69, 0xc6, 0x0a, 0x86, 0xdb, 0x5c, 0x06, 0x7d, 0x3b, 0x4e, 0x8a,
-	0xfb, 0x6d, 0x60, 0x86, 0xec, 0x9b, 0xb5, 0x4e, 0x82, 0xd4, 0x4e, 0xad, 0x98, 0x8d, 0x2a, 0x35,
-	0xca, 0x68, 0xc8, 0xb2, 0xc8, 0x4a, 0x03, 0xab, 0x52, 0x15, 0xdb, 0x1f, 0x35, 0x98, 0x98, 0xc5,
-	0xcc, 0xe2, 0xe3, 0x60, 0xfb, 0x85, 0x3b, 0x6e, 0xb8, 0xaa, 0xe2, 0xc3, 0x3f, 0x12, 0xbc, 0xfa,
-	0x44, 0xf3, 0x7c, 0x15, 0x53, 0x6c, 0x81, 0x54, 0xec, 0x52, 0xaa, 0x21, 0x1d, 0x19, 0x3d, 0xfb,
-	0xb5, 0x59, 0xb5, 0x30, 0x9f, 0x8f, 0xeb, 0xef, 0x62, 0x97, 0x52, 0xc2, 0x83, 0xd8, 0x80, 0xb3,
-	0x70, 0xbd, 0xcd, 0x0b, 0x9a, 0x5d, 0xd3, 0x07, 0xba, 0x26, 0xab, 0xef, 0x1a, 0xe8, 0xc8, 0x68,
-	0x91, 0xe3, 0x31, 0x56, 0x41, 0xfc, 0x4a, 0x77, 0x9a, 0xa0, 0x23, 0x43, 0x21, 0xa5, 0xc4, 0x6f,
-	0xa0, 0x5d, 0xf5, 0xd6, 0x44, 0x1d, 0x19, 0xb2, 0x7d, 0x6e, 0xd6, 0xd7, 0x08, 0x4c, 0xc2, 0x15,
-	0x79, 0x0e, 0xe0, 0x77, 0x20, 0x87, 0x6b, 0x96, 0xd3, 0x6c, 0x4e, 0x69, 0x96, 0x6b, 0xa7, 0xba,
-	0x68, 0xc8, 0xf6, 0xc5, 0x71, 0xbd, 0xf2, 0x70, 0x22, 0x3d, 0x3e, 0x5d, 0x9e, 0x90, 0x66, 0x1c,
-	0x7f, 0x80, 0x6e, 0x9a, 0xb1, 0x87, 0x24, 0xaa, 0xf9, 0xce, 0x8b, 0xfc, 0x21, 0xd0, 0xff, 0x81,
-	0x40, 0x2a, 0x15, 0x1e, 0x82, 0x90, 0x44, 0x7c, 0x3d, 0xca, 0x04, 0x97, 0xc9, 0x5f, 0x4f, 0x97,
-	0x10, 0xec, 0x0a, 0x7a, 0x53, 0x64, 0xc9, 0x26, 0x26, 0x42, 0x12, 0xe1, 0x0b, 0x68, 0xad, 0xa2,
-	0x28, 0xcb, 0x35, 0x41, 0x17, 0x0d, 0x85, 0x54, 0x06, 0xbf, 0x07, 0x08, 0xd9, 0x66, 0x43, 0xc3,
-	0x22, 0x61, 0x1b, 0x7e, 0xe3, 0x9e, 0x3d, 0x38, 0x6e, 0xe0, 0xfc, 0x4b, 0xf0, 0x1d, 0x37, 0x88,
-	0x61, 0x02, 0x72, 0x63, 0xfd, 0xb8, 0x0b, 0x9d, 0xf9, 0xed, 0x62, 0x79, 0x37, 0xbe, 0xbe, 0xf5,
-	0xd4, 0x93, 0xd2, 0x5e, 0x79, 0xb5, 0x45, 0x58, 0x05, 0x65, 0xec, 0xba, 0xcb, 0x39, 0x99, 0xdd,
-	0x4d, 0x5d, 0x8f, 0xa8, 0x02, 0x3e, 0x87, 0x6e, 0x19, 0xa8, 0x27, 0x37, 0xaa, 0x58, 0x32, 0x1f,
-	0xa7, 0xbe, 0xbb, 0xf4, 0x67, 0xae, 0xa7, 0x4a, 0xf8, 0x14, 0xa4, 0xf9, 0xd4, 0xbf, 0x52, 0x5b,
-	0xc3, 0xcf, 0xd0, 0x3b, 0x2c, 0x52, 0xd2, 0xfe, 0x6c, 0xb1, 0x74, 0x66, 0xbe, 0xef, 0x39, 0x0b,
-	0xcf, 0xad, 0xfe, 0xf8, 0xdf, 0x22, 0x7c, 0x06, 0xb2, 0x33, 0xf6, 0xeb, 0x84, 0x2a, 0x60, 0x0c,
-	0x3d, 0x67, 0xec, 0x37, 0x28, 0x55, 0x9c, 0x28, 0x8f, 0xfb, 0x01, 0xfa, 0xb9, 0x1f, 0xa0, 0xdf,
-	0xfb, 0x01, 0x0a, 0xda, 0xfc, 0xfd, 0xbd, 0xfd, 0x1b, 0x00, 0x00, 0xff, 0xff, 0x8d, 0x1a, 0xa1,
-	0xbe, 0xf7, 0x02, 0x00, 0x00,
+	// 490 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0x31, 0x6f, 0x9b, 0x40,
+	0x1c, 0xc5, 0x73, 0x80, 0xdd, 0xf8, 0x0f, 0x76, 0xc8, 0x29, 0x03, 0x72, 0x25, 0x07, 0x79, 0xa2,
+	0x83, 0x41, 0xa2, 0x6b, 0x55, 0xd5, 0x36, 0x34, 0xb2, 0x94, 0x62, 0xeb, 0xe2, 0xa4, 0xa3, 0x65,
+	0xe0, 0x4a, 0x4e, 0x75, 0x7d, 0x08, 0x70, 0x2a, 0x6f, 0xfd, 0x00, 0xfd, 0x60, 0x19, 0x3b, 0x77,
+	0x88, 0x2a, 0x7f, 0x92, 0x8a, 0x23, 0xb4, 0xb6, 0x97, 0x4c, 0xbc, 0xf7, 0xbf, 0xf7, 0x83, 0xc7,
+	0xdd, 0x41, 0x2b, 0xbe, 0x2f, 0xec, 0x34, 0xe3, 0x05, 0xc7, 0x4d, 0x21, 0xc3, 0xae, 0x9b, 0xb0,
+	0xe2, 0x7e, 0x13, 0xda, 0x11, 0xff, 0xe6, 0xac, 0x58, 0x98, 0xba, 0xa9, 0x93, 0xf0, 0x41, 0xa5,
+	0x06, 0x19, 0x8d, 0x78, 0x16, 0x3b, 0x69, 0xe8, 0x54, 0xaa, 0x62, 0xbb, 0x83, 0x3d, 0x26, 0xe1,
+	0x09, 0x77, 0xc4, 0x38, 0xdc, 0x7c, 0x11, 0x4e, 0x18, 0xa1, 0xaa, 0x78, 0xff, 0x67, 0x03, 0x5e,
+	0x7d, 0xa2, 0x79, 0xbe, 0x4c, 0x28, 0x76, 0x40, 0x29, 0xb6, 0x29, 0x35, 0x90, 0x89, 0xac, 0x8e,
+	0xfb, 0xda, 0xae, 0x5a, 0xd8, 0xcf, 0xcb, 0xf5, 0x73, 0xbe, 0x4d, 0x29, 0x11, 0x41, 0x6c, 0xc1,
+	0x59, 0xb4, 0xda, 0xe4, 0x05, 0xcd, 0xae, 0xe9, 0x03, 0x5d, 0x91, 0xe5, 0x77, 0x03, 0x4c, 0x64,
+	0x35, 0xc8, 0xf1, 0x18, 0xeb, 0x20, 0x7f, 0xa5, 0x5b, 0x43, 0x32, 0x91, 0xa5, 0x91, 0x52, 0xe2,
+	0x37, 0xd0, 0xac, 0x7a, 0x1b, 0xb2, 0x89, 0x2c, 0xd5, 0x3d, 0xb7, 0xeb, 0xdf, 0x08, 0x6d, 0x22,
+	0x14, 0x79, 0x0e, 0xe0, 0x77, 0xa0, 0x46, 0x2b, 0x9e, 0xd3, 0x6c, 0x46, 0x69, 0x96, 0x1b, 0xa7,
+	0xa6, 0x6c, 0xa9, 0xee, 0xc5, 0x71, 0xbd, 0x72, 0x71, 0xa4, 0x3c, 0x3e, 0x5d, 0x9e, 0x90, 0xfd,
+	0x38, 0xfe, 0x00, 0xed, 0x34, 0xe3, 0x0f, 0x2c, 0xae, 0xf9, 0xd6, 0x8b, 0xfc, 0x21, 0x80, 0xfb,
+	0xa0, 0x45, 0xcb, 0x74, 0x19, 0xb2, 0x15, 0x2b, 0x18, 0xcd, 0x0d, 0xd5, 0x44, 0x96, 0x42, 0x0e,
+	0x66, 0xdd, 0x1f, 0x08, 0x94, 0x32, 0x8d, 0xfb, 0x20, 0xb1, 0x58, 0x6c, 0xa1, 0x36, 0xc2, 0xe5,
+	0xdb, 0x7e, 0x3f, 0x5d, 0x42, 0xb8, 0x2d, 0xe8, 0x4d, 0x91, 0xb1, 0x75, 0x42, 0x24, 0x16, 0xe3,
+	0x0b, 0x68, 0x2c, 0xe3, 0x38, 0xcb, 0x0d, 0xc9, 0x94, 0x2d, 0x8d, 0x54, 0x06, 0xbf, 0x07, 0x88,
+	0xf8, 0x7a, 0x4d, 0xa3, 0x82, 0xf1, 0xb5, 0xd8, 0x95, 0x8e, 0xdb, 0x3b, 0x6e, 0x39, 0xfe, 0x97,
+	0x10, 0xe7, 0xb0, 0x47, 0xf4, 0x19, 0xa8, 0x7b, 0x47, 0x84, 0xdb, 0xd0, 0x9a, 0xdd, 0xce, 0x17,
+	0x77, 0xc3, 0xeb, 0x5b, 0x5f, 0x3f, 0x29, 0xed, 0x95, 0x5f, 0x5b, 0x84, 0x75, 0xd0, 0x86, 0x9e,
+	0xb7, 0x98, 0x91, 0xe9, 0xdd, 0xc4, 0xf3, 0x89, 0x2e, 0xe1, 0x73, 0x68, 0x97, 0x81, 0x7a, 0x72,
+	0xa3, 0xcb, 0x25, 0xf3, 0x71, 0x12, 0x78, 0x8b, 0x60, 0xea, 0xf9, 0xba, 0x82, 0x4f, 0x41, 0x99,
+	0x4d, 0x82, 0x2b, 0xbd, 0xd1, 0xff, 0x0c, 0x9d, 0xc3, 0x22, 0x25, 0x1d, 0x4c, 0xe7, 0x8b, 0xf1,
+	0x34, 0x08, 0xfc, 0xf1, 0xdc, 0xf7, 0xaa, 0x2f, 0xfe, 0xb7, 0x08, 0x9f, 0x81, 0x3a, 0x1e, 0x06,
+	0x75, 0x42, 0x97, 0x30, 0x86, 0xce, 0x78, 0x18, 0xec, 0x51, 0xba, 0x3c, 0xd2, 0x1e, 0x77, 0x3d,
+	0xf4, 0x6b, 0xd7, 0x43, 0x7f, 0x76, 0x3d, 0x14, 0x36, 0xc5, 0x1d, 0x7d, 0xfb, 0x37, 0x00, 0x00,
+	0xff, 0xff, 0x90, 0x30, 0x29, 0x5a, 0x1b, 0x03, 0x00, 0x00,
 }
 
 func (m *Message) Marshal() (dAtA []byte, err error) {
@@ -322,6 +363,32 @@ func (m *Message) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.Extension) > 0 {
+		i -= len(m.Extension)
+		copy(dAtA[i:], m.Extension)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Extension)))
+		i--
+		dAtA[i] = 0x72
+	}
+	if len(m.SenderRecord) > 0 {
+		i -= len(m.SenderRecord)
+		copy(dAtA[i:], m.SenderRecord)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.SenderRecord)))
+		i--
+		dAtA[i] = 0x6a
+	}
+	if len(m.Signature) > 0 {
+		i -= len(m.Signature)
+		copy(dAtA[i:], m.Signature)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Signature)))
+		i--
+		dAtA[i] = 0x62
+	}
+	if m.Capabilities != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.Capabilities))
+		i--
+		dAtA[i] = 0x58
+	}
 	if m.ClusterLevelRaw != 0 {
 		i = encodeVarintDht(dAtA, i, uint64(m.ClusterLevelRaw))
 		i--
@@ -476,6 +543,21 @@ func (m *Message) Size() (n int) {
 	if m.ClusterLevelRaw != 0 {
 		n += 1 + sovDht(uint64(m.ClusterLevelRaw))
 	}
+	if m.Capabilities != 0 {
+		n += 1 + sovDht(uint64(m.Capabilities))
+	}
+	l = len(m.Signature)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	l = len(m.SenderRecord)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	l = len(m.Extension)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -716,6 +798,127 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Capabilities", wireType)
+			}
+			m.Capabilities = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Capabilities |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
+			if m.Signature == nil {
+				m.Signature = []byte{}
+			}
+			iNdEx = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SenderRecord", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SenderRecord = append(m.SenderRecord[:0], dAtA[iNdEx:postIndex]...)
+			if m.SenderRecord == nil {
+				m.SenderRecord = []byte{}
+			}
+			iNdEx = postIndex
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Extension", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Extension = append(m.Extension[:0], dAtA[iNdEx:postIndex]...)
+			if m.Extension == nil {
+				m.Extension = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDht(dAtA[iNdEx:])
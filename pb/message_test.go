@@ -1,7 +1,11 @@
 package dht_pb
 
 import (
+	"crypto/rand"
+	"errors"
 	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
 )
 
 func TestBadAddrsDontReturnNil(t *testing.T) {
@@ -13,3 +17,111 @@ func TestBadAddrsDontReturnNil(t *testing.T) {
 		t.Fatal("shouldnt have any multiaddrs")
 	}
 }
+
+func TestRecycle(t *testing.T) {
+	in := NewMessage(Message_GET_VALUE, []byte("hello"), 0)
+	in.CloserPeers = []Message_Peer{{Id: byteString("peer")}}
+	buf, err := in.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := AcquireMessage()
+	defer ReleaseMessage(m)
+	if err := m.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	key := m.Key
+
+	m.Recycle()
+	if len(m.Key) != 0 || len(m.CloserPeers) != 0 || m.Type != 0 {
+		t.Fatal("recycled message isn't empty")
+	}
+	if err := m.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Key) != "hello" || len(m.CloserPeers) != 1 || m.Type != Message_GET_VALUE {
+		t.Fatalf("unexpected message after reuse: %v", m)
+	}
+	if &key[0] != &m.Key[0] {
+		t.Fatal("key buffer wasn't reused")
+	}
+}
+
+func TestClone(t *testing.T) {
+	m := NewMessage(Message_GET_VALUE, []byte("hello"), 0)
+	m.CloserPeers = []Message_Peer{{Id: byteString("peer"), Addrs: [][]byte{[]byte("addr")}}}
+
+	c := m.Clone()
+	m.Recycle()
+	if string(c.Key) != "hello" || len(c.CloserPeers) != 1 || string(c.CloserPeers[0].Addrs[0]) != "addr" || c.Type != Message_GET_VALUE {
+		t.Fatalf("clone changed with the original: %v", c)
+	}
+}
+
+func benchmarkUnmarshal(b *testing.B, pooled bool) {
+	in := NewMessage(Message_FIND_NODE, []byte("some key of a realistic length!!"), 0)
+	buf, err := in.Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if pooled {
+			m := AcquireMessage()
+			if err := m.Unmarshal(buf); err != nil {
+				b.Fatal(err)
+			}
+			ReleaseMessage(m)
+		} else {
+			m := new(Message)
+			if err := m.Unmarshal(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B)       { benchmarkUnmarshal(b, false) }
+func BenchmarkUnmarshalPooled(b *testing.B) { benchmarkUnmarshal(b, true) }
+
+func TestSignMessage(t *testing.T) {
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMessage(Message_PUT_VALUE, []byte("/v/hello"), 0)
+	if err := VerifyMessage(pub, m); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("expected ErrUnsigned, got %v", err)
+	}
+	if err := SignMessage(priv, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// the signature survives the round trip
+	buf, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received Message
+	if err := received.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyMessage(pub, &received); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyMessage(other, &received); err == nil {
+		t.Fatal("expected the signature not to verify with another key")
+	}
+	received.Key = []byte("/v/tampered")
+	if err := VerifyMessage(pub, &received); err == nil {
+		t.Fatal("expected the signature of a modified message not to verify")
+	}
+}
@@ -0,0 +1,53 @@
+package dht_pb
+
+import "sync"
+
+// maxPooledKeySize bounds the key buffers kept by pooled messages, so that a
+// single large key doesn't stay allocated for the lifetime of the pool.
+const maxPooledKeySize = 1024
+
+var messagePool = sync.Pool{
+	New: func() interface{} { return new(Message) },
+}
+
+// AcquireMessage returns an empty message from a pool. Unmarshaling into it
+// reuses the buffers of the previously released messages instead of
+// allocating new ones. It must be given back with ReleaseMessage.
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// ReleaseMessage empties m and returns it to the pool. Neither m nor the
+// slices it references may be used afterwards, as the next message
+// unmarshaled into it overwrites them.
+func ReleaseMessage(m *Message) {
+	m.Recycle()
+	messagePool.Put(m)
+}
+
+// Clone returns a deep copy of m, sharing no buffer with it, for the pooled
+// messages that must outlive their release.
+func (m *Message) Clone() *Message {
+	c := new(Message)
+	if data, err := m.Marshal(); err == nil {
+		_ = c.Unmarshal(data)
+	}
+	return c
+}
+
+// Recycle empties m, keeping its key buffer and the capacity of its peer
+// lists for the next Unmarshal. The record and the peers themselves are
+// dropped, since they are usually retained by whoever handled the message.
+func (m *Message) Recycle() {
+	key := m.Key[:0]
+	if cap(key) > maxPooledKeySize {
+		key = nil
+	}
+	clear(m.CloserPeers)
+	clear(m.ProviderPeers)
+	*m = Message{
+		Key:           key,
+		CloserPeers:   m.CloserPeers[:0],
+		ProviderPeers: m.ProviderPeers[:0],
+	}
+}
@@ -0,0 +1,67 @@
+package dht_pb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// signingDomain prefixes the signed bytes of a message, so that a request
+// signature can't be passed off as a signature of anything else.
+const signingDomain = "libp2p-kad-dht-request:"
+
+// ErrUnsigned is returned by VerifyMessage for the messages without a
+// signature.
+var ErrUnsigned = errors.New("message not signed")
+
+// signedBytes returns the bytes the signature of m is computed over: the
+// message without its signature, prefixed by the signing domain.
+func signedBytes(m *Message) ([]byte, error) {
+	sig := m.Signature
+	m.Signature = nil
+	defer func() { m.Signature = sig }()
+
+	b := make([]byte, len(signingDomain)+m.Size())
+	copy(b, signingDomain)
+	if _, err := m.MarshalToSizedBuffer(b[len(signingDomain):]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SignMessage sets the Signature of m, signing the rest of the message with
+// key. m must not be modified afterwards.
+func SignMessage(key crypto.PrivKey, m *Message) error {
+	b, err := signedBytes(m)
+	if err != nil {
+		return err
+	}
+	sig, err := key.Sign(b)
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// VerifyMessage checks that m was signed by the private key of key. As the
+// signature covers the message as re-marshaled by the receiver, fields the
+// receiver doesn't know may fail the verification.
+func VerifyMessage(key crypto.PubKey, m *Message) error {
+	if len(m.Signature) == 0 {
+		return ErrUnsigned
+	}
+	b, err := signedBytes(m)
+	if err != nil {
+		return err
+	}
+	ok, err := key.Verify(b, m.Signature)
+	if err != nil {
+		return fmt.Errorf("verifying message signature: %w", err)
+	}
+	if !ok {
+		return errors.New("invalid message signature")
+	}
+	return nil
+}
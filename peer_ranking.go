@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// PeerCandidate is a peer a lookup may query next, see PeerRanker. Distance
+// is its XOR distance to the target in the keyspace, compared as a big-endian
+// integer, RTT the average in the latency book of the host's peerstore, and
+// BackedOff reports the peers not dialed after failing their last dials.
+type PeerCandidate = dhtcfg.PeerCandidate
+
+// PeerRanker orders the candidate peers of a lookup step: up to twice as many
+// not yet queried peers as the lookup is about to query, closest to the target
+// key first. The lookup queries the returned peers first, ignoring the ones
+// that weren't candidates. The candidates left out are only queried when the
+// returned ones don't fill the step, closest first, so that the lookup never
+// starves. Reputation systems can be plugged in by keeping track of the peers
+// by ID and ranking the disreputable ones last or leaving them out.
+//
+// The ranker runs on the coordinating goroutine of every lookup, so it must
+// be fast and safe for concurrent use.
+type PeerRanker = dhtcfg.PeerRanker
+
+// SetPeerRanker replaces the peer ranker the lookups use from their next step
+// on, see RankPeers. A nil ranker restores the default order.
+func (dht *IpfsDHT) SetPeerRanker(r PeerRanker) {
+	if r == nil {
+		dht.peerRanker.Store(nil)
+		return
+	}
+	dht.peerRanker.Store(&r)
+}
+
+// rankWith picks up to n peers to query next from the heard peers, given
+// closest first, in the order of r. The shortfall of the peers returned by r
+// is filled with the other heard peers, as a lookup with no peer to query and
+// none in flight would wait forever.
+func (q *query) rankWith(r PeerRanker, heard []peer.ID, n int) []peer.ID {
+	dht := q.dht
+	candidates := make([]PeerCandidate, len(heard))
+	for i, p := range heard {
+		candidates[i] = PeerCandidate{
+			ID:             p,
+			Addrs:          dht.peerstore.Addrs(p),
+			Distance:       q.queryPeers.GetDistance(p),
+			RTT:            dht.peerstore.LatencyEWMA(p),
+			Connected:      dht.host.Network().Connectedness(p) == network.Connected,
+			InRoutingTable: dht.routingTable.Find(p) != "",
+			BackedOff:      dht.dialBackoff != nil && dht.dialBackoff.BackedOff(p),
+		}
+	}
+
+	known := make(map[peer.ID]struct{}, len(heard))
+	for _, p := range heard {
+		known[p] = struct{}{}
+	}
+	peersToQuery := make([]peer.ID, 0, n)
+	for _, p := range r([]byte(q.key), candidates) {
+		if len(peersToQuery) == n {
+			break
+		}
+		// only accept peers that were candidates, and only once
+		if _, ok := known[p]; ok {
+			delete(known, p)
+			peersToQuery = append(peersToQuery, p)
+		}
+	}
+	for _, p := range heard {
+		if len(peersToQuery) == n {
+			break
+		}
+		if _, ok := known[p]; ok {
+			peersToQuery = append(peersToQuery, p)
+		}
+	}
+	return peersToQuery
+}
@@ -0,0 +1,235 @@
+package dht
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// probeScheduler checks the liveness of the routing table peers, each at its
+// own interval, instead of pinging all the peers not heard from at every
+// refresh. A peer starts at minInterval; the interval doubles, up to
+// maxInterval, every time the peer answers a probe over an existing
+// connection, and halves when it had to be dialed again. Peers failing a
+// probe are evicted. Probes are started at most rate times per second
+// altogether, and postponed when the peer answers one of our queries.
+//
+// A nil *probeScheduler probes nothing.
+type probeScheduler struct {
+	dht         *IpfsDHT
+	minInterval time.Duration
+	maxInterval time.Duration
+	// spacing is the minimal time between two probes, 1/rate.
+	spacing time.Duration
+
+	mu    sync.Mutex
+	peers map[peer.ID]*probeState
+	queue probeQueue
+	wake  chan struct{}
+}
+
+type probeState struct {
+	p        peer.ID
+	interval time.Duration
+	next     time.Time
+	// index is the position in the queue, -1 while being probed.
+	index int
+}
+
+func newProbeScheduler(dht *IpfsDHT, minInterval, maxInterval time.Duration, rate float64) *probeScheduler {
+	if rate <= 0 {
+		return nil
+	}
+	return &probeScheduler{
+		dht:         dht,
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		spacing:     time.Duration(float64(time.Second) / rate),
+		peers:       make(map[peer.ID]*probeState),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// add schedules the probes of a peer added to the routing table.
+func (s *probeScheduler) add(p peer.ID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.peers[p]; ok {
+		return
+	}
+	st := &probeState{p: p, interval: s.minInterval, next: time.Now().Add(s.minInterval)}
+	s.peers[p] = st
+	heap.Push(&s.queue, st)
+	s.notify()
+}
+
+// remove stops probing a peer removed from the routing table.
+func (s *probeScheduler) remove(p peer.ID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.peers[p]
+	if !ok {
+		return
+	}
+	delete(s.peers, p)
+	if st.index >= 0 {
+		heap.Remove(&s.queue, st.index)
+	}
+}
+
+// heard postpones the next probe of a peer that just answered a query.
+func (s *probeScheduler) heard(p peer.ID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.peers[p]
+	if !ok || st.index < 0 {
+		return
+	}
+	st.next = time.Now().Add(st.interval)
+	heap.Fix(&s.queue, st.index)
+}
+
+func (s *probeScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *probeScheduler) start() {
+	if s == nil {
+		return
+	}
+	s.dht.wg.Add(1)
+	go func() {
+		defer s.dht.wg.Done()
+		s.run(s.dht.ctx)
+	}()
+}
+
+func (s *probeScheduler) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		st, wait := s.due(time.Now())
+		if st != nil {
+			s.dht.wg.Add(1)
+			go func() {
+				defer s.dht.wg.Done()
+				s.probe(ctx, st)
+			}()
+			// the rate bounds the probes started, not the ones due
+			wait = s.spacing
+		}
+		timer.Reset(wait)
+	}
+}
+
+// due pops the peer to probe now, if any, or returns how long to wait for it.
+func (s *probeScheduler) due(now time.Time) (*probeState, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return nil, s.maxInterval
+	}
+	if st := s.queue[0]; st.next.After(now) {
+		return nil, st.next.Sub(now)
+	}
+	return heap.Pop(&s.queue).(*probeState), 0
+}
+
+func (s *probeScheduler) probe(ctx context.Context, st *probeState) {
+	dht := s.dht
+	connected := dht.host.Network().Connectedness(st.p) == network.Connected
+
+	pctx, cancel := context.WithTimeout(ctx, dht.lookupCheckTimeout)
+	err := dht.probePeer(pctx, st.p)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		dht.logger.Debugw("evicting peer after failed probe", "peer", st.p, "error", err)
+		s.remove(st.p)
+		dht.evictPeer(st.p, evictProbeFailed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[st.p] != st {
+		// removed while being probed
+		return
+	}
+	if connected {
+		st.interval = min(2*st.interval, s.maxInterval)
+	} else {
+		st.interval = max(st.interval/2, s.minInterval)
+	}
+	st.next = time.Now().Add(st.interval)
+	heap.Push(&s.queue, st)
+	s.notify()
+}
+
+// interval returns the current probe interval of p, 0 if it isn't probed.
+func (s *probeScheduler) interval(p peer.ID) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.peers[p]; ok {
+		return st.interval
+	}
+	return 0
+}
+
+// probeQueue is a heap of the peers waiting for a probe, the earliest due
+// first.
+type probeQueue []*probeState
+
+func (q probeQueue) Len() int           { return len(q) }
+func (q probeQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q probeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *probeQueue) Push(x any) {
+	st := x.(*probeState)
+	st.index = len(*q)
+	*q = append(*q, st)
+}
+
+func (q *probeQueue) Pop() any {
+	old := *q
+	st := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	st.index = -1
+	return st
+}
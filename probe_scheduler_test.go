@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false,
+		RoutingTableProbing(20*time.Millisecond, 80*time.Millisecond, 100),
+		// bounds the probes
+		RoutingTableRefreshQueryTimeout(time.Second),
+	)
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+	require.Equal(t, b.self, a.routingTable.Find(b.self))
+
+	// b stays connected, it is probed less and less often
+	require.Eventually(t, func() bool { return a.probes.interval(b.self) == 80*time.Millisecond }, 5*time.Second, 10*time.Millisecond)
+
+	// b is gone
+	require.NoError(t, b.host.Close())
+	require.Eventually(t, func() bool { return a.routingTable.Find(b.self) == "" }, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, a.probes.interval(b.self))
+}
+
+func TestProbeSchedulerQueue(t *testing.T) {
+	require.Nil(t, newProbeScheduler(nil, time.Minute, time.Hour, 0))
+	s := newProbeScheduler(nil, time.Minute, time.Hour, 10)
+	require.Equal(t, 100*time.Millisecond, s.spacing)
+
+	for _, p := range []peer.ID{"a", "b", "c"} {
+		s.add(p)
+	}
+	s.heard("a")
+	s.remove("c")
+
+	now := time.Now()
+	st, wait := s.due(now)
+	require.Nil(t, st)
+	require.InDelta(t, time.Minute, wait, float64(time.Second))
+
+	// b is due first, a was heard from since it was added
+	now = now.Add(2 * time.Minute)
+	st, _ = s.due(now)
+	require.Equal(t, peer.ID("b"), st.p)
+	st, _ = s.due(now)
+	require.Equal(t, peer.ID("a"), st.p)
+	st, wait = s.due(now)
+	require.Nil(t, st)
+	require.Equal(t, time.Hour, wait)
+}
+
+func TestPingProbes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		received []pb.Message_MessageType
+	)
+	a := setupDHT(ctx, t, false, PingProbes(), OnRequestHook(func(_ context.Context, _ network.Stream, req *pb.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, req.GetType())
+	}))
+	b := setupDHT(ctx, t, false, PingProbes())
+	legacy := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+	connect(t, ctx, a, legacy)
+	require.True(t, b.PeerSupports(a.self, pb.CapPing))
+
+	mu.Lock()
+	received = nil
+	mu.Unlock()
+	require.NoError(t, b.probePeer(ctx, a.self))
+	mu.Lock()
+	require.Equal(t, []pb.Message_MessageType{pb.Message_PING}, received)
+	received = nil
+	mu.Unlock()
+
+	// peers without ping probes check with a FIND_NODE
+	require.NoError(t, legacy.probePeer(ctx, a.self))
+	mu.Lock()
+	require.Equal(t, []pb.Message_MessageType{pb.Message_FIND_NODE}, received)
+	mu.Unlock()
+}
@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+)
+
+// Profile groups the knobs bounding the background work and the resources
+// of the DHT. Mobile nodes typically switch between DefaultProfile and
+// BatterySaverProfile with SetProfile, following the device state (charging,
+// metered network, ...).
+type Profile struct {
+	// RefreshInterval is the interval between two periodic routing table
+	// refreshes, the main background traffic of the DHT. Zero disables them.
+	RefreshInterval time.Duration
+	// MaxOutboundRequests caps the simultaneous outbound query RPCs, and so
+	// the concurrent dials. Zero means unlimited.
+	MaxOutboundRequests int
+	// ProvideWorkers and ProvideRate bound the provides queued with
+	// ScheduleProvide. A low rate batches the announcements over time.
+	ProvideWorkers int
+	ProvideRate    float64
+	// PauseCrawl suspends the BackgroundCrawl, if enabled, until a profile
+	// resumes it.
+	PauseCrawl bool
+}
+
+var (
+	// DefaultProfile matches the default configuration of the DHT.
+	DefaultProfile = Profile{
+		RefreshInterval: 10 * time.Minute,
+		ProvideWorkers:  4,
+		ProvideRate:     10,
+	}
+
+	// BatterySaverProfile refreshes the routing table hourly, caps the
+	// concurrent requests, trickles the scheduled provides and pauses the
+	// background crawl, trading lookup latency and routing table freshness for
+	// battery and bandwidth.
+	BatterySaverProfile = Profile{
+		RefreshInterval:     time.Hour,
+		MaxOutboundRequests: 6,
+		ProvideWorkers:      1,
+		ProvideRate:         0.5,
+		PauseCrawl:          true,
+	}
+)
+
+func (p Profile) validate() error {
+	if p.RefreshInterval < 0 || p.MaxOutboundRequests < 0 || p.ProvideWorkers < 0 || p.ProvideRate < 0 {
+		return fmt.Errorf("profile limits must be non-negative")
+	}
+	return nil
+}
+
+// Profile returns the current resource profile of the DHT.
+func (dht *IpfsDHT) Profile() Profile {
+	dht.profileLk.Lock()
+	defer dht.profileLk.Unlock()
+	return dht.profile
+}
+
+// SetProfile switches the DHT to the given resource profile at runtime.
+// Running lookups keep the outbound request limit they started with.
+func (dht *IpfsDHT) SetProfile(p Profile) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	dht.setProfileLk.Lock()
+	defer dht.setProfileLk.Unlock()
+
+	dht.profileLk.Lock()
+	dht.profile = p
+	dht.profileLk.Unlock()
+
+	// the refresh manager may be waiting on the profile lock, e.g. in a
+	// refresh query, so it is not held while applying the profile
+	dht.outboundLimiter.Store(newOutboundLimiter(p.MaxOutboundRequests))
+	dht.provideScheduler.setLimits(p.ProvideWorkers, p.ProvideRate)
+	dht.rtRefreshManager.SetRefreshInterval(p.RefreshInterval)
+	return nil
+}
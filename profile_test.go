@@ -0,0 +1,38 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetProfile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, UseProfile(BatterySaverProfile))
+	require.Equal(t, BatterySaverProfile, d.Profile())
+	require.Equal(t, 6, d.outboundLimiter.Load().limit)
+	require.True(t, d.Config().BackgroundCrawl.Paused)
+
+	running := func() int {
+		d.provideScheduler.mu.Lock()
+		defer d.provideScheduler.mu.Unlock()
+		return d.provideScheduler.running
+	}
+	require.Equal(t, 1, running())
+
+	require.NoError(t, d.SetProfile(DefaultProfile))
+	require.Equal(t, DefaultProfile, d.Profile())
+	require.Nil(t, d.outboundLimiter.Load())
+	require.Equal(t, 4, running())
+	require.False(t, d.Config().BackgroundCrawl.Paused)
+
+	require.NoError(t, d.SetProfile(BatterySaverProfile))
+	require.Eventually(t, func() bool { return running() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	require.Error(t, d.SetProfile(Profile{ProvideRate: -1}))
+	require.Equal(t, BatterySaverProfile, d.Profile())
+}
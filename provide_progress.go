@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ProvidePhase identifies the step of a Provide operation a ProvideProgress
+// event reports.
+type ProvidePhase int
+
+const (
+	// ProvideLookupDone is reported once the closest peers to the key have been found.
+	ProvideLookupDone ProvidePhase = iota
+	// ProvidePutDone is reported every time a provider record put to a peer completes.
+	ProvidePutDone
+	// ProvideDone is reported once, when Provide returns.
+	ProvideDone
+)
+
+// ProvideProgress describes the progress of a Provide operation.
+type ProvideProgress struct {
+	Phase ProvidePhase
+
+	// Peer and Err are the peer the provider record was put to and the reason
+	// the put failed, if it did, for ProvidePutDone events. For ProvideDone
+	// events Err is the error returned by Provide.
+	Peer peer.ID
+	Err  error
+
+	// Total is the number of peers the provider record is put to, known once
+	// the lookup is done. Succeeded and Failed count the completed puts.
+	Total     int
+	Succeeded int
+	Failed    int
+}
+
+type provideProgressKey struct{}
+
+// WithProvideProgress returns a context making Provide calls report their
+// progress to fn. fn is called synchronously and serially, it should return
+// quickly.
+//
+// With optimistic provide enabled, provider records keep being put in the
+// background after Provide returned; these puts are not reported.
+func WithProvideProgress(ctx context.Context, fn func(ProvideProgress)) context.Context {
+	return context.WithValue(ctx, provideProgressKey{}, fn)
+}
+
+// provideProgressTracker accumulates the progress of a single Provide call. A
+// nil *provideProgressTracker reports nothing.
+type provideProgressTracker struct {
+	fn func(ProvideProgress)
+
+	mu       sync.Mutex
+	progress ProvideProgress
+	done     bool
+}
+
+type provideProgressTrackerKey struct{}
+
+// withProvideProgressTracker sets up the progress tracking of a Provide call
+// if the caller asked for it with WithProvideProgress.
+func withProvideProgressTracker(ctx context.Context) (context.Context, *provideProgressTracker) {
+	fn, _ := ctx.Value(provideProgressKey{}).(func(ProvideProgress))
+	if fn == nil {
+		return ctx, nil
+	}
+	t := &provideProgressTracker{fn: fn}
+	return context.WithValue(ctx, provideProgressTrackerKey{}, t), t
+}
+
+func provideProgressTrackerFromContext(ctx context.Context) *provideProgressTracker {
+	t, _ := ctx.Value(provideProgressTrackerKey{}).(*provideProgressTracker)
+	return t
+}
+
+func (t *provideProgressTracker) report(update func(p *ProvideProgress)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	update(&t.progress)
+	t.fn(t.progress)
+}
+
+func (t *provideProgressTracker) lookupDone(total int) {
+	t.report(func(p *ProvideProgress) {
+		p.Phase = ProvideLookupDone
+		p.Peer, p.Err = "", nil
+		p.Total = total
+	})
+}
+
+func (t *provideProgressTracker) putDone(pid peer.ID, err error) {
+	t.report(func(p *ProvideProgress) {
+		p.Phase = ProvidePutDone
+		p.Peer, p.Err = pid, err
+		if err != nil {
+			p.Failed++
+		} else {
+			p.Succeeded++
+		}
+	})
+}
+
+func (t *provideProgressTracker) finish(err error) {
+	t.report(func(p *ProvideProgress) {
+		p.Phase = ProvideDone
+		p.Peer, p.Err = "", err
+	})
+	if t != nil {
+		t.mu.Lock()
+		t.done = true
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,419 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// scheduledProvideTimeout bounds a single Provide run by the provide
+// scheduler.
+const scheduledProvideTimeout = time.Minute
+
+// maxScheduledProvides bounds the keys waiting in the provide scheduler.
+const maxScheduledProvides = 1 << 16
+
+// provideScheduler runs the Provide operations queued with ScheduleProvide in
+// the background, with a bounded number of workers and at a bounded rate, so
+// that announcing many keys does not starve interactive lookups. Keys queued
+// several times before being provided are only provided once.
+type provideScheduler struct {
+	dht *IpfsDHT
+
+	mu       sync.Mutex
+	workers  int
+	running  int
+	interval time.Duration
+	queue    []*scheduledProvide
+	pending  map[string]*scheduledProvide
+	// maxQueued bounds the length of queue
+	maxQueued int
+	next      time.Time
+	// closed is set once the DHT is closed and the queue drained
+	closed bool
+	// budget accounts the RPCs sent by the scheduled provides
+	budget *provideBudget
+
+	wake chan struct{}
+}
+
+// scheduledProvide is a key queued in the provide scheduler, and the
+// functions to call once it is provided.
+type scheduledProvide struct {
+	key  cid.Cid
+	done []func(cid.Cid, error)
+}
+
+func newProvideScheduler(dht *IpfsDHT, workers int, rate float64, budget *provideBudget) *provideScheduler {
+	return &provideScheduler{
+		dht:       dht,
+		workers:   workers,
+		interval:  provideInterval(rate),
+		pending:   make(map[string]*scheduledProvide),
+		maxQueued: maxScheduledProvides,
+		budget:    budget,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func provideInterval(rate float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+func (s *provideScheduler) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spawnLocked()
+
+	s.dht.wg.Add(1)
+	go func() {
+		defer s.dht.wg.Done()
+		<-s.dht.ctx.Done()
+		s.close(s.dht.ctx.Err())
+	}()
+}
+
+// close fails the keys still queued with err, and makes enqueue refuse new
+// ones.
+func (s *provideScheduler) close(err error) {
+	s.mu.Lock()
+	queue := s.queue
+	s.queue, s.pending, s.closed = nil, nil, true
+	s.mu.Unlock()
+	for _, sp := range queue {
+		sp.finish(err)
+	}
+}
+
+// spawnLocked starts the workers missing to reach s.workers.
+func (s *provideScheduler) spawnLocked() {
+	for ; s.running < s.workers; s.running++ {
+		s.dht.wg.Add(1)
+		go func() {
+			defer s.dht.wg.Done()
+			s.work(s.dht.ctx)
+		}()
+	}
+}
+
+// setLimits changes the number of workers and the rate of the scheduler.
+// Surplus workers exit once done with their current provide.
+func (s *provideScheduler) setLimits(workers int, rate float64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.workers = workers
+	s.interval = provideInterval(rate)
+	if s.dht.ctx.Err() == nil {
+		s.spawnLocked()
+	}
+	s.mu.Unlock()
+	// wake idle workers so that surplus ones exit
+	s.signal()
+}
+
+// retire reports whether the calling worker is surplus, in which case it must
+// exit.
+func (s *provideScheduler) retire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running > s.workers {
+		s.running--
+		return true
+	}
+	return false
+}
+
+// enqueue queues keys, calling done, if not nil, with the outcome of the
+// provide of each of them. Once the DHT is closed, the keys are refused with
+// the error of its context, and they are all refused with ErrProvideQueueFull
+// if the new ones don't fit within maxQueued.
+func (s *provideScheduler) enqueue(keys []cid.Cid, done func(cid.Cid, error)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return s.dht.ctx.Err()
+	}
+	added := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		if _, ok := s.pending[string(k.Hash())]; !ok {
+			added[string(k.Hash())] = struct{}{}
+		}
+	}
+	if len(s.queue)+len(added) > s.maxQueued {
+		s.mu.Unlock()
+		return ErrProvideQueueFull
+	}
+	for _, k := range keys {
+		mh := string(k.Hash())
+		sp, ok := s.pending[mh]
+		if !ok {
+			sp = &scheduledProvide{key: k}
+			s.pending[mh] = sp
+			s.queue = append(s.queue, sp)
+		}
+		if done != nil {
+			sp.done = append(sp.done, done)
+		}
+	}
+	s.mu.Unlock()
+	s.signal()
+	return nil
+}
+
+func (s *provideScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue returns the next key to provide and the time at which the rate
+// limit allows providing it.
+func (s *provideScheduler) dequeue() (*scheduledProvide, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return nil, time.Time{}, false
+	}
+	k := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	delete(s.pending, string(k.key.Hash()))
+
+	now := time.Now()
+	at := s.next
+	if at.Before(now) {
+		at = now
+	}
+	s.next = at.Add(s.interval)
+	return k, at, true
+}
+
+func (sp *scheduledProvide) finish(err error) {
+	for _, done := range sp.done {
+		done(sp.key, err)
+	}
+}
+
+func (s *provideScheduler) len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// saturated reports whether the queued keys take longer than
+// provideBacklogLimit to provide at the configured rate.
+func (s *provideScheduler) saturated() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interval > 0 && time.Duration(len(s.queue))*s.interval > provideBacklogLimit
+}
+
+func (s *provideScheduler) work(ctx context.Context) {
+	for {
+		if s.retire() {
+			// let another idle worker check whether it is surplus too
+			s.signal()
+			return
+		}
+		// the keys stay queued, and coalesced, while the budget is used up
+		if s.budget.wait(ctx) != nil {
+			return
+		}
+		sp, at, ok := s.dequeue()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		// other workers may be waiting for work too
+		s.signal()
+
+		if d := time.Until(at); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				sp.finish(ctx.Err())
+				return
+			}
+		}
+
+		pctx, cancel := context.WithTimeout(withProvideBudget(ctx, s.budget), scheduledProvideTimeout)
+		err := s.dht.Provide(pctx, sp.key, true)
+		if err != nil {
+			s.dht.logger.Debugw("scheduled provide failed", "cid", sp.key, "error", err)
+		}
+		cancel()
+		sp.finish(err)
+	}
+}
+
+// ScheduleProvide queues the given keys to be provided in the background by
+// the provide scheduler, instead of providing them right away like Provide.
+// The scheduler bounds the number of concurrent provides and their rate (see
+// the ProvideSchedulerLimits option) and coalesces keys that are queued again
+// before being provided. At most 65536 keys wait in the queue: if the new keys
+// don't fit, none of them is queued and ErrProvideQueueFull is returned.
+func (dht *IpfsDHT) ScheduleProvide(keys ...cid.Cid) error {
+	if !dht.enableProviders {
+		return routing.ErrNotSupported
+	}
+	for _, k := range keys {
+		if !k.Defined() {
+			return fmt.Errorf("invalid cid: undefined")
+		}
+	}
+	return dht.provideScheduler.enqueue(keys, nil)
+}
+
+// ScheduledProvides returns the number of keys waiting to be provided by the
+// provide scheduler.
+func (dht *IpfsDHT) ScheduledProvides() int {
+	return dht.provideScheduler.len()
+}
+
+// ProvideSchedulerStats accounts the work of the provide scheduler.
+type ProvideSchedulerStats struct {
+	// Queued is the number of keys waiting to be provided.
+	Queued int
+	// RPCs and Bytes are the RPCs sent, and the bytes of the messages
+	// exchanged, by the scheduled provides.
+	RPCs  int64
+	Bytes int64
+	// Budget is the number of RPCs the scheduled provides may send per
+	// BudgetInterval, 0 if unlimited (see the ProvideBudget option), and
+	// BudgetUsed the number they sent in the current interval, the excess
+	// of the previous intervals included.
+	Budget         int
+	BudgetInterval time.Duration
+	BudgetUsed     int64
+}
+
+// ProvideSchedulerStats returns the state of the provide scheduler, and the
+// budget its provides used.
+func (dht *IpfsDHT) ProvideSchedulerStats() ProvideSchedulerStats {
+	if dht.provideScheduler == nil {
+		return ProvideSchedulerStats{}
+	}
+	st := ProvideSchedulerStats{Queued: dht.provideScheduler.len()}
+	dht.provideScheduler.budget.stats(&st)
+	return st
+}
+
+// provideBudget accounts the RPCs sent by the scheduled provides, and caps
+// them to limit per interval if limit is positive. A provide started with
+// budget left may use more than what is left: the excess is carried over to
+// the next intervals.
+type provideBudget struct {
+	limit    int64
+	interval time.Duration
+
+	mu sync.Mutex
+	// used is the number of RPCs sent since start, the beginning of the
+	// current interval.
+	used  int64
+	start time.Time
+	rpcs  int64
+	bytes int64
+}
+
+func newProvideBudget(limit int, interval time.Duration) *provideBudget {
+	return &provideBudget{limit: int64(limit), interval: interval, start: time.Now()}
+}
+
+// rollLocked starts the current interval, carrying over the excess of the
+// previous ones.
+func (b *provideBudget) rollLocked(now time.Time) {
+	if b.limit <= 0 {
+		return
+	}
+	elapsed := int64(now.Sub(b.start) / b.interval)
+	if elapsed == 0 {
+		return
+	}
+	b.start = b.start.Add(time.Duration(elapsed) * b.interval)
+	b.used -= elapsed * b.limit
+	if b.used < 0 {
+		b.used = 0
+	}
+}
+
+// wait blocks until the budget isn't used up.
+func (b *provideBudget) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.rollLocked(now)
+		if b.limit <= 0 || b.used < b.limit {
+			b.mu.Unlock()
+			return nil
+		}
+		// the next interval may still be used up by the excess, the
+		// budget is checked again then
+		d := b.start.Add(b.interval).Sub(now)
+		b.mu.Unlock()
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// charge accounts an RPC that exchanged sent and received bytes.
+func (b *provideBudget) charge(sent, received int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(time.Now())
+	b.used++
+	b.rpcs++
+	b.bytes += int64(sent + received)
+}
+
+func (b *provideBudget) stats(st *ProvideSchedulerStats) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(time.Now())
+	st.RPCs, st.Bytes = b.rpcs, b.bytes
+	if b.limit > 0 {
+		st.Budget, st.BudgetInterval, st.BudgetUsed = int(b.limit), b.interval, b.used
+	}
+}
+
+type provideBudgetKey struct{}
+
+// withProvideBudget returns a context charging the RPCs sent with it to b.
+func withProvideBudget(ctx context.Context, b *provideBudget) context.Context {
+	return context.WithValue(ctx, provideBudgetKey{}, b)
+}
+
+// chargeProvideBudget charges an RPC sent with ctx to its provide budget, if
+// any.
+func chargeProvideBudget(ctx context.Context, sent, received int) {
+	if b, ok := ctx.Value(provideBudgetKey{}).(*provideBudget); ok {
+		b.charge(sent, received)
+	}
+}
@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// maxProviderPeersSize bounds the encoded size of the providers of a
+// GET_PROVIDERS response, leaving the rest of network.MessageSizeMax to the
+// closer peers and the other fields.
+const maxProviderPeersSize = network.MessageSizeMax / 2
+
+// compactProviders prepares the providers of a GET_PROVIDERS response: the
+// records of the same provider are merged, the addresses of the providers with
+// a signed peer record are replaced by the certified ones, and the providers
+// are ordered by usefulness, signed ones first, then the ones with addresses,
+// so that the least useful are dropped if they don't fit within
+// maxProviderPeersSize.
+func (dht *IpfsDHT) compactProviders(providers []peer.AddrInfo) []pb.Message_Peer {
+	cab, _ := peerstore.GetCertifiedAddrBook(dht.peerstore)
+
+	merged := make([]peer.AddrInfo, 0, len(providers))
+	signed := make(map[peer.ID]bool)
+	index := make(map[peer.ID]int, len(providers))
+	for _, prov := range providers {
+		if i, ok := index[prov.ID]; ok {
+			if !signed[prov.ID] {
+				addrs := append(append([]ma.Multiaddr(nil), merged[i].Addrs...), prov.Addrs...)
+				merged[i].Addrs = ma.Unique(addrs)
+			}
+			continue
+		}
+		index[prov.ID] = len(merged)
+		if addrs := certifiedAddrs(cab, prov.ID); addrs != nil {
+			signed[prov.ID] = true
+			prov.Addrs = addrs
+		}
+		merged = append(merged, prov)
+	}
+
+	for i := range merged {
+		merged[i].Addrs = dht.filterAddrs(dht.applyRelayAddrPolicy(merged[i].Addrs))
+	}
+	rank := func(ai peer.AddrInfo) int {
+		switch {
+		case signed[ai.ID]:
+			return 0
+		case len(ai.Addrs) > 0:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return rank(merged[i]) < rank(merged[j]) })
+
+	pbps := pb.PeerInfosToPBPeers(dht.host.Network(), merged)
+	size := 0
+	for i := range pbps {
+		if size += pbps[i].Size(); size > maxProviderPeersSize {
+			return pbps[:i]
+		}
+	}
+	return pbps
+}
+
+// certifiedAddrs returns the addresses of the signed peer record of p in cab,
+// nil if there is none.
+func certifiedAddrs(cab peerstore.CertifiedAddrBook, p peer.ID) []ma.Multiaddr {
+	if cab == nil {
+		return nil
+	}
+	env := cab.GetPeerRecord(p)
+	if env == nil {
+		return nil
+	}
+	rec, err := env.Record()
+	if err != nil {
+		return nil
+	}
+	if pr, ok := rec.(*peer.PeerRecord); ok && len(pr.Addrs) > 0 {
+		return pr.Addrs
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/record"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// staticProviderStore returns the same providers for every key.
+type staticProviderStore []peer.AddrInfo
+
+func (s staticProviderStore) AddProvider(context.Context, []byte, peer.AddrInfo) error { return nil }
+
+func (s staticProviderStore) GetProviders(context.Context, []byte) ([]peer.AddrInfo, error) {
+	return s, nil
+}
+
+func (s staticProviderStore) Close() error { return nil }
+
+func TestCompactProviders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sk, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	signedID, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	plain, bare := peer.ID("plain"), peer.ID("bare")
+
+	addr1 := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	addr2 := ma.StringCast("/ip4/1.2.3.4/udp/4001/quic-v1")
+	certified := ma.StringCast("/ip4/5.6.7.8/tcp/4001")
+
+	store := staticProviderStore{
+		{ID: bare},
+		{ID: plain, Addrs: []ma.Multiaddr{addr1}},
+		{ID: signedID, Addrs: []ma.Multiaddr{addr1}},
+		{ID: plain, Addrs: []ma.Multiaddr{addr1, addr2}},
+	}
+	server := setupDHT(ctx, t, false, ProviderStore(store))
+	client := setupDHT(ctx, t, true)
+	connectNoSync(t, ctx, client, server)
+
+	env, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: signedID, Addrs: []ma.Multiaddr{certified}}), sk)
+	require.NoError(t, err)
+	cab, ok := peerstore.GetCertifiedAddrBook(server.peerstore)
+	require.True(t, ok)
+	_, err = cab.ConsumePeerRecord(env, peerstore.PermanentAddrTTL)
+	require.NoError(t, err)
+
+	provs, _, err := client.protoMessenger.GetProviders(ctx, server.self, testCaseCids[0].Hash())
+	require.NoError(t, err)
+	require.Len(t, provs, 3)
+
+	// signed providers come first, with their certified addresses
+	require.Equal(t, signedID, provs[0].ID)
+	require.Equal(t, []ma.Multiaddr{certified}, provs[0].Addrs)
+	// the records of the same provider are merged
+	require.Equal(t, plain, provs[1].ID)
+	require.ElementsMatch(t, []ma.Multiaddr{addr1, addr2}, provs[1].Addrs)
+	require.Equal(t, bare, provs[2].ID)
+	require.Empty(t, provs[2].Addrs)
+}
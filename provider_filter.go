@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// ProviderFilterFunc filters, rewrites or reorders a batch of providers found
+// for key, the multihash of the searched CID, before they are yielded. It must
+// not modify provs in place.
+type ProviderFilterFunc = dhtcfg.ProviderFilterFunc
+
+var _ ProviderFilterFunc = PublicProviders
+
+type providerFilterKey struct{}
+
+// WithProviderFilter returns a context making FindProviders and
+// FindProvidersAsync calls apply f to the providers they find, after the
+// filter configured with the ProviderFilter option, if any.
+//
+// The results of a filtered call aren't cached, as they may not suit other
+// callers.
+func WithProviderFilter(ctx context.Context, f ProviderFilterFunc) context.Context {
+	return context.WithValue(ctx, providerFilterKey{}, f)
+}
+
+func providerFilterFromContext(ctx context.Context) ProviderFilterFunc {
+	f, _ := ctx.Value(providerFilterKey{}).(ProviderFilterFunc)
+	return f
+}
+
+// PublicProviders drops the providers without a public, non-relayed address,
+// including the providers returned without addresses.
+func PublicProviders(_ context.Context, _ []byte, provs []peer.AddrInfo) []peer.AddrInfo {
+	kept := make([]peer.AddrInfo, 0, len(provs))
+	for _, ai := range provs {
+		for _, a := range ai.Addrs {
+			if isPublicAddr(a) && !isRelayAddr(a) {
+				kept = append(kept, ai)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// filterProviders applies the configured and the per-call provider filters to
+// a batch of providers found for key.
+func (dht *IpfsDHT) filterProviders(ctx context.Context, key []byte, provs []peer.AddrInfo) []peer.AddrInfo {
+	if f := dht.providerFilter; f != nil && len(provs) > 0 {
+		provs = f(ctx, key, provs)
+	}
+	if f := providerFilterFromContext(ctx); f != nil && len(provs) > 0 {
+		provs = f(ctx, key, provs)
+	}
+	return provs
+}
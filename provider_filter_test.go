@@ -0,0 +1,67 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicProviders(t *testing.T) {
+	public := peer.AddrInfo{ID: "public", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.0.1/tcp/4001"), ma.StringCast("/ip4/1.2.3.4/tcp/4001")}}
+	private := peer.AddrInfo{ID: "private", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.0.1/tcp/4001")}}
+	relayed := peer.AddrInfo{ID: "relayed", Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.6/tcp/4001/p2p/QmdPU7PfRyKehdrP5A3WqmjyD6bhVpU1mLGKppa2FjGDjZ/p2p-circuit")}}
+	unknown := peer.AddrInfo{ID: "unknown"}
+
+	kept := PublicProviders(context.Background(), nil, []peer.AddrInfo{private, public, relayed, unknown})
+	require.Equal(t, []peer.AddrInfo{public}, kept)
+}
+
+func TestProviderFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testCaseCids[0]
+	p1, p2, p3 := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	dropP1 := func(_ context.Context, k []byte, provs []peer.AddrInfo) []peer.AddrInfo {
+		require.Equal(t, []byte(key.Hash()), k)
+		var kept []peer.AddrInfo
+		for _, ai := range provs {
+			if ai.ID != p1 {
+				kept = append(kept, ai)
+			}
+		}
+		return kept
+	}
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), ProviderFilter(dropP1))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+	for _, p := range []peer.ID{p1, p2, p3} {
+		require.NoError(t, b.ProviderStore().AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: p}))
+	}
+
+	found := func(ctx context.Context) []peer.ID {
+		provs, err := a.FindProviders(ctx, key)
+		require.NoError(t, err)
+		var ids []peer.ID
+		for _, ai := range provs {
+			ids = append(ids, ai.ID)
+		}
+		return ids
+	}
+	require.ElementsMatch(t, []peer.ID{p2, p3}, found(ctx))
+
+	onlyP3 := func(_ context.Context, _ []byte, provs []peer.AddrInfo) []peer.AddrInfo {
+		for _, ai := range provs {
+			if ai.ID == p3 {
+				return []peer.AddrInfo{ai}
+			}
+		}
+		return nil
+	}
+	require.Equal(t, []peer.ID{p3}, found(WithProviderFilter(ctx, onlyP3)))
+}
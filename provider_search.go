@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ProviderSearch is a handle on a provider lookup started by FindProvidersAsync
+// with the context returned by WithProviderSearch, that keeps running in the
+// background once the caller stops reading.
+type ProviderSearch struct {
+	done chan struct{}
+
+	mu        sync.Mutex
+	cancel    context.CancelFunc
+	canceled  bool
+	providers []peer.AddrInfo
+}
+
+type providerSearchKey struct{}
+
+// WithProviderSearch returns a context making the FindProvidersAsync call made
+// with it complete its lookup in the background. Time-to-first-provider
+// dominates user-perceived latency: the caller can take the first providers
+// yielded and cancel the context, which closes the channel, while the rest of
+// the lookup keeps running to warm the caches, looking for up to count
+// providers (0 meaning all of them). All the providers found, including the
+// ones yielded, can be awaited through the returned ProviderSearch.
+//
+// The background lookup is not bound to the cancellation of ctx: it ends once
+// it completes, when ProviderSearch.Cancel is called or when the DHT is
+// closed. The context must be used for a single FindProvidersAsync call.
+func WithProviderSearch(ctx context.Context) (context.Context, *ProviderSearch) {
+	s := &ProviderSearch{done: make(chan struct{})}
+	return context.WithValue(ctx, providerSearchKey{}, s), s
+}
+
+func providerSearchFromContext(ctx context.Context) *ProviderSearch {
+	s, _ := ctx.Value(providerSearchKey{}).(*ProviderSearch)
+	return s
+}
+
+// Done returns a channel that is closed once the lookup has completed.
+func (s *ProviderSearch) Done() <-chan struct{} {
+	return s.done
+}
+
+// Providers returns the providers found so far.
+func (s *ProviderSearch) Providers() []peer.AddrInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]peer.AddrInfo(nil), s.providers...)
+}
+
+// Wait blocks until the lookup completes and returns all the providers found.
+// If ctx is done first, the providers found so far are returned along with the
+// context error; the lookup keeps running.
+func (s *ProviderSearch) Wait(ctx context.Context) ([]peer.AddrInfo, error) {
+	select {
+	case <-s.done:
+		return s.Providers(), nil
+	case <-ctx.Done():
+		return s.Providers(), ctx.Err()
+	}
+}
+
+// Cancel stops the background lookup.
+func (s *ProviderSearch) Cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.canceled = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// start returns the context of the background lookup, which keeps the values
+// of ctx but is only canceled by Cancel and when dhtCtx is done.
+func (s *ProviderSearch) start(ctx, dhtCtx context.Context) context.Context {
+	bgCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(dhtCtx, cancel)
+	s.mu.Lock()
+	s.cancel = func() {
+		stop()
+		cancel()
+	}
+	if s.canceled {
+		cancel()
+	}
+	s.mu.Unlock()
+	return bgCtx
+}
+
+// forward records the providers found by the lookup, yielding them on out
+// until ctx is done, when out is closed while the lookup keeps running.
+func (s *ProviderSearch) forward(ctx context.Context, found <-chan peer.AddrInfo, out chan<- peer.AddrInfo) {
+	defer close(s.done)
+	defer s.Cancel()
+
+	callerDone := ctx.Done()
+	for {
+		select {
+		case p, ok := <-found:
+			if !ok {
+				if out != nil {
+					close(out)
+				}
+				return
+			}
+			s.mu.Lock()
+			s.providers = append(s.providers, p)
+			s.mu.Unlock()
+			if out == nil {
+				continue
+			}
+			select {
+			case out <- p:
+			case <-callerDone:
+				close(out)
+				out, callerDone = nil, nil
+			}
+		case <-callerDone:
+			close(out)
+			out, callerDone = nil, nil
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+)
+
+// ProviderSource tells where a provider record yielded by FindProviders came
+// from.
+type ProviderSource struct {
+	// Peer is the DHT server that reported the provider record, or the local
+	// peer for the records held in the local provider store.
+	Peer peer.ID
+	// ReceivedAt is the time the record was received at. For the records of
+	// the local provider store, it's the time the provider last announced it,
+	// if the provider store keeps it. The DHT protocol doesn't carry the time
+	// remote records were created at.
+	ReceivedAt time.Time
+}
+
+// ProviderSources collects the sources of the providers found by the
+// FindProviders and FindProvidersAsync calls made with the context returned by
+// WithProviderSources. It is safe for concurrent use, and may be read while the
+// calls are still running.
+type ProviderSources struct {
+	mu      sync.Mutex
+	sources map[peer.ID][]ProviderSource
+}
+
+type providerSourcesKey struct{}
+
+// WithProviderSources returns a context making FindProviders and
+// FindProvidersAsync calls record which DHT servers reported each provider
+// they yield, and when, into the returned ProviderSources. A provider reported
+// by several servers is attributed to all the ones queried before the call
+// ended, which helps telling stale or poisoned provider records apart.
+//
+// The providers served from the passive cache of a client have no sources.
+func WithProviderSources(ctx context.Context) (context.Context, *ProviderSources) {
+	s := &ProviderSources{sources: make(map[peer.ID][]ProviderSource)}
+	return context.WithValue(ctx, providerSourcesKey{}, s), s
+}
+
+func providerSourcesFromContext(ctx context.Context) *ProviderSources {
+	s, _ := ctx.Value(providerSourcesKey{}).(*ProviderSources)
+	return s
+}
+
+// Sources returns the sources of provider p, in the order they reported it.
+func (s *ProviderSources) Sources(p peer.ID) []ProviderSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ProviderSource(nil), s.sources[p]...)
+}
+
+// All returns the sources of all the providers.
+func (s *ProviderSources) All() map[peer.ID][]ProviderSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make(map[peer.ID][]ProviderSource, len(s.sources))
+	for p, srcs := range s.sources {
+		all[p] = append([]ProviderSource(nil), srcs...)
+	}
+	return all
+}
+
+// add records that from reported the providers provs. A nil *ProviderSources
+// records nothing.
+func (s *ProviderSources) add(from peer.ID, provs []peer.AddrInfo, receivedAt func(peer.ID) time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+next:
+	for _, ai := range provs {
+		for _, src := range s.sources[ai.ID] {
+			if src.Peer == from {
+				continue next
+			}
+		}
+		s.sources[ai.ID] = append(s.sources[ai.ID], ProviderSource{Peer: from, ReceivedAt: receivedAt(ai.ID)})
+	}
+}
+
+// providerRecordGetter is implemented by the provider stores that keep the
+// time their records were added at, like providers.ProviderManager.
+type providerRecordGetter interface {
+	GetProviderRecords(ctx context.Context, key []byte) ([]providers.ProviderRecord, error)
+}
+
+// addLocal records the providers of key found in the local provider store.
+func (s *ProviderSources) addLocal(ctx context.Context, dht *IpfsDHT, key []byte, provs []peer.AddrInfo) {
+	if s == nil || len(provs) == 0 {
+		return
+	}
+	added := make(map[peer.ID]time.Time)
+	if g, ok := dht.providerStore.(providerRecordGetter); ok {
+		if recs, err := g.GetProviderRecords(ctx, key); err == nil {
+			for _, r := range recs {
+				added[r.Provider] = r.Added
+			}
+		}
+	}
+	s.add(dht.self, provs, func(p peer.ID) time.Time { return added[p] })
+}
+
+// addRemote records the providers reported by from just now.
+func (s *ProviderSources) addRemote(from peer.ID, provs []peer.AddrInfo) {
+	if s == nil || len(provs) == 0 {
+		return
+	}
+	now := time.Now()
+	s.add(from, provs, func(peer.ID) time.Time { return now })
+}
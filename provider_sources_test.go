@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderSources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testCaseCids[0]
+	remote, local := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	c := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+	connect(t, ctx, a, c)
+	require.NoError(t, a.ProviderStore().AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: local}))
+	require.NoError(t, b.ProviderStore().AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: remote}))
+	require.NoError(t, c.ProviderStore().AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: remote}))
+
+	sctx, sources := WithProviderSources(ctx)
+	provs, err := a.FindProviders(sctx, key)
+	require.NoError(t, err)
+	require.Len(t, provs, 2)
+
+	localSrcs := sources.Sources(local)
+	require.Len(t, localSrcs, 1)
+	require.Equal(t, a.self, localSrcs[0].Peer)
+	require.False(t, localSrcs[0].ReceivedAt.IsZero())
+
+	var from []peer.ID
+	for _, src := range sources.Sources(remote) {
+		require.False(t, src.ReceivedAt.IsZero())
+		from = append(from, src.Peer)
+	}
+	require.ElementsMatch(t, []peer.ID{b.self, c.self}, from)
+	require.Len(t, sources.All(), 2)
+
+	// without WithProviderSources nothing is recorded
+	_, err = a.FindProviders(ctx, key)
+	require.NoError(t, err)
+	require.Len(t, sources.All(), 2)
+}
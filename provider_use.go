@@ -0,0 +1,103 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+)
+
+// maxUsedProviders bounds the number of connected providers whose addresses
+// are extended once they disconnect.
+const maxUsedProviders = 1024
+
+// usedProviders remembers the connected providers reported to ProviderUsed.
+// While a peer is connected, the host keeps its addresses with the connected
+// TTL and downgrades them to the recently connected TTL on disconnection, so
+// their TTL is extended again once the provider disconnects.
+type usedProviders struct {
+	mu    sync.Mutex
+	peers *lru.LRU
+}
+
+func newUsedProviders() *usedProviders {
+	peers, err := lru.NewLRU(maxUsedProviders, nil)
+	if err != nil {
+		panic(err) // only errors if size <= 0
+	}
+	return &usedProviders{peers: peers}
+}
+
+func (u *usedProviders) add(p peer.ID) {
+	u.mu.Lock()
+	u.peers.Add(p, struct{}{})
+	u.mu.Unlock()
+}
+
+// disconnected reports whether p was a used provider, forgetting it.
+func (u *usedProviders) disconnected(p peer.ID) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.peers.Remove(p)
+}
+
+// ProviderUsed signals that the application successfully connected to p, a
+// provider of key returned by FindProviders or FindProvidersAsync. The
+// addresses of p are kept in the peerstore for providers.ProviderAddrTTL, and
+// the provider record of p for key is refreshed where this node holds it: in
+// its provider store and in the passive cache of a client. The next lookups of
+// key are then more likely to be answered with dialable addresses, or without
+// hitting the network.
+//
+// Providers not known to this node for key only get their addresses extended.
+func (dht *IpfsDHT) ProviderUsed(ctx context.Context, key cid.Cid, p peer.ID) error {
+	if p == dht.self {
+		return nil
+	}
+
+	addrs := dht.peerstore.Addrs(p)
+	for _, c := range dht.host.Network().ConnsToPeer(p) {
+		addrs = append(addrs, c.RemoteMultiaddr())
+	}
+	dht.peerstore.AddAddrs(p, addrs, providers.ProviderAddrTTL)
+	if hasValidConnectedness(dht.host, p) {
+		dht.usedProviders.add(p)
+	}
+
+	mh := key.Hash()
+	if cached, ok := dht.cachedProviders(string(mh)); ok && containsProvider(cached, p) {
+		dht.passiveCache.add("/providers/"+string(mh), passiveCacheEntry{providers: cached})
+	}
+
+	provs, err := dht.providerStore.GetProviders(ctx, mh)
+	if err != nil {
+		return err
+	}
+	if containsProvider(provs, p) {
+		return dht.providerStore.AddProvider(ctx, mh, peer.AddrInfo{ID: p})
+	}
+	return nil
+}
+
+// providerDisconnected extends the addresses of a used provider that
+// disconnected, which the host just downgraded to the recently connected TTL.
+func (dht *IpfsDHT) providerDisconnected(p peer.ID, c network.Connectedness) {
+	if c == network.Connected || c == network.Limited || !dht.usedProviders.disconnected(p) {
+		return
+	}
+	dht.peerstore.AddAddrs(p, dht.peerstore.Addrs(p), providers.ProviderAddrTTL)
+}
+
+func containsProvider(provs []peer.AddrInfo, p peer.ID) bool {
+	for _, ai := range provs {
+		if ai.ID == p {
+			return true
+		}
+	}
+	return false
+}
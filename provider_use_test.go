@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderUsed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	c := setupDHT(ctx, t, false, DisableAutoRefresh())
+	key := testCaseCids[0]
+
+	// c was only heard of, its addresses are temporary
+	a.peerstore.AddAddrs(c.self, c.host.Addrs(), peerstore.TempAddrTTL)
+	require.NoError(t, a.ProviderUsed(ctx, key, c.self))
+	a.peerstore.UpdateAddrs(c.self, peerstore.TempAddrTTL, 0)
+	require.NotEmpty(t, a.peerstore.Addrs(c.self))
+	// c isn't a provider known to a
+	provs, err := a.providerStore.GetProviders(ctx, key.Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs)
+
+	// b is connected, its addresses are extended when it disconnects
+	connect(t, ctx, a, b)
+	require.NoError(t, a.providerStore.AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: b.self}))
+	require.NoError(t, a.ProviderUsed(ctx, key, b.self))
+	provs, err = a.providerStore.GetProviders(ctx, key.Hash())
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+
+	require.NoError(t, a.host.Network().ClosePeer(b.self))
+	// the test swarms don't emit their connectedness events on the bus of the host
+	a.providerDisconnected(b.self, network.NotConnected)
+	a.peerstore.UpdateAddrs(b.self, peerstore.RecentlyConnectedAddrTTL, 0)
+	require.NotEmpty(t, a.peerstore.Addrs(b.self))
+}
@@ -0,0 +1,284 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-base32"
+)
+
+// The version 2 layout of the provider records keeps the records under
+// ProvidersKeyPrefix, keyed by key and provider, and adds two indexes of
+// empty values next to them:
+//
+//	/providers-index/expiry/<expiry>/<key>/<provider>
+//	/providers-index/peer/<provider>/<key>
+//
+// where <expiry> is the Unix time, in seconds, at which the record expires as
+// a fixed width hexadecimal number. Expired records are found by scanning the
+// expiry index in order up to the current time, and the keys a peer provides
+// by a prefix scan of the peer index.
+// Keys and providers are base32 encoded, as in the records.
+//
+// Index entries may outlive their record, which is checked for when using
+// them, and the expiry index keeps an entry per time a record was added.
+const (
+	providersIndexPrefix = "/providers-index/"
+	provExpiryPrefix     = providersIndexPrefix + "expiry/"
+	provPeerPrefix       = providersIndexPrefix + "peer/"
+)
+
+// LayoutVersion is the version of the datastore layout of the provider
+// records written by this package.
+const LayoutVersion = 2
+
+// layoutVersionKey holds the layout version of the provider records once
+// the datastore was migrated to it. It is missing from datastores written
+// with the first layout, which had no index.
+var layoutVersionKey = ds.NewKey(providersIndexPrefix + "version")
+
+// expiryOf returns the Unix time at which a record added at t expires.
+func expiryOf(t time.Time) int64 {
+	return t.Add(ProvideValidity).Unix()
+}
+
+func mkProvExpiryKey(expiry int64, k []byte, p peer.ID) ds.Key {
+	return ds.RawKey(fmt.Sprintf("%s%016x/%s/%s", provExpiryPrefix, expiry,
+		base32.RawStdEncoding.EncodeToString(k), base32.RawStdEncoding.EncodeToString([]byte(p))))
+}
+
+func mkProvPeerPrefix(p peer.ID) string {
+	return provPeerPrefix + base32.RawStdEncoding.EncodeToString([]byte(p))
+}
+
+func mkProvPeerKey(p peer.ID, k []byte) ds.Key {
+	return ds.RawKey(mkProvPeerPrefix(p) + "/" + base32.RawStdEncoding.EncodeToString(k))
+}
+
+// parseProvExpiryKey returns the expiry, key and provider of an expiry index
+// entry.
+func parseProvExpiryKey(dsk string) (int64, []byte, peer.ID, error) {
+	parts := strings.Split(strings.TrimPrefix(dsk, provExpiryPrefix), "/")
+	if len(parts) != 3 {
+		return 0, nil, "", fmt.Errorf("malformed provider expiry index key %q", dsk)
+	}
+	expiry, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	k, err := base32.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, nil, "", err
+	}
+	p, err := base32.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, "", err
+	}
+	return expiry, k, peer.ID(p), nil
+}
+
+// parseProvKey returns the key and provider of a provider record.
+func parseProvKey(dsk string) ([]byte, peer.ID, error) {
+	parts := strings.Split(strings.TrimPrefix(dsk, ProvidersKeyPrefix), "/")
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("malformed provider record key %q", dsk)
+	}
+	k, err := base32.RawStdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := base32.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, "", err
+	}
+	return k, peer.ID(p), nil
+}
+
+// writeProviderIndex adds the index entries of a record added at t.
+func writeProviderIndex(ctx context.Context, dstore ds.Write, k []byte, p peer.ID, t time.Time) error {
+	if err := dstore.Put(ctx, mkProvExpiryKey(expiryOf(t), k, p), []byte{}); err != nil {
+		return err
+	}
+	return dstore.Put(ctx, mkProvPeerKey(p, k), []byte{})
+}
+
+// deleteProviderEntry deletes a record and its entry in the peer index, its
+// expiry index entries being left to the garbage collection.
+func deleteProviderEntry(ctx context.Context, dstore ds.Write, k []byte, p peer.ID) error {
+	if err := dstore.Delete(ctx, ds.NewKey(mkProvKeyFor(k, p))); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	if err := dstore.Delete(ctx, mkProvPeerKey(p, k)); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// layoutMigrated reports whether the provider records of dstore have the
+// current layout.
+func layoutMigrated(ctx context.Context, dstore ds.Datastore) (bool, error) {
+	v, err := dstore.Get(ctx, layoutVersionKey)
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(v) == strconv.Itoa(LayoutVersion), nil
+}
+
+func setLayoutMigrated(ctx context.Context, dstore ds.Write) error {
+	return dstore.Put(ctx, layoutVersionKey, []byte(strconv.Itoa(LayoutVersion)))
+}
+
+// queryLegacyRecords starts a scan of the provider records to index.
+func queryLegacyRecords(ctx context.Context, dstore ds.Datastore) (dsq.Results, error) {
+	return dstore.Query(ctx, dsq.Query{Prefix: ProvidersKeyPrefix})
+}
+
+// indexLegacyRecord adds the index entries of a record found by
+// queryLegacyRecords.
+func indexLegacyRecord(ctx context.Context, dstore ds.Write, e dsq.Entry) error {
+	k, p, err := parseProvKey(e.Key)
+	if err != nil {
+		return err
+	}
+	t, err := readTimeValue(e.Value)
+	if err != nil {
+		return err
+	}
+	return writeProviderIndex(ctx, dstore, k, p, t)
+}
+
+// MigrateLayout migrates the provider records of dstore to LayoutVersion,
+// indexing them by expiry and by provider. It is a no-op if the records
+// already have that layout.
+//
+// A ProviderManager migrates its datastore while serving requests, so
+// MigrateLayout is only needed to migrate a datastore offline.
+func MigrateLayout(ctx context.Context, dstore ds.Batching) error {
+	if done, err := layoutMigrated(ctx, dstore); err != nil || done {
+		return err
+	}
+
+	b, err := dstore.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := queryLegacyRecords(ctx, dstore)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	n := 0
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		if err := indexLegacyRecord(ctx, b, e.Entry); err != nil {
+			log.Warnw("skipping malformed provider record", "key", e.Key, "error", err)
+			continue
+		}
+		if n++; n%batchBufferSize == 0 {
+			if err := b.Commit(ctx); err != nil {
+				return err
+			}
+			if b, err = dstore.Batch(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if err := setLayoutMigrated(ctx, b); err != nil {
+		return err
+	}
+	return b.Commit(ctx)
+}
+
+// readProvTime reads the time a record was added at, reporting false if
+// there is no record. Unparsable times are reported as the zero time.
+func readProvTime(ctx context.Context, dstore ds.Datastore, k []byte, p peer.ID) (time.Time, bool, error) {
+	v, err := dstore.Get(ctx, ds.NewKey(mkProvKeyFor(k, p)))
+	if err == ds.ErrNotFound {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	t, _ := readTimeValue(v)
+	return t, true, nil
+}
+
+// collectExpiryEntry garbage collects the record of an expiry index entry if
+// it expired by now, and the entry itself. It reports whether the entry
+// expires after now, ending the scan of the index ordered by expiry.
+func (pm *ProviderManager) collectExpiryEntry(dsk string, now time.Time) bool {
+	expiry, k, p, err := parseProvExpiryKey(dsk)
+	if err == nil && expiry >= now.Unix() {
+		return true
+	}
+	if err == nil {
+		t, found, err := readProvTime(pm.ctx, pm.dstore, k, p)
+		switch {
+		case err != nil:
+			pm.logger.Error("failed to read provider record for GC: ", err)
+			return false
+		case found && now.Sub(t) > ProvideValidity:
+			if err := deleteProviderEntry(pm.ctx, pm.dstore, k, p); err != nil {
+				pm.logger.Error("failed to remove provider record from disk: ", err)
+			}
+		}
+	}
+	// the record was collected, re-added with a later expiry, or never found
+	if err := pm.dstore.Delete(pm.ctx, ds.RawKey(dsk)); err != nil && err != ds.ErrNotFound {
+		pm.logger.Error("failed to remove provider expiry index entry from disk: ", err)
+	}
+	return false
+}
+
+// providedKeys returns the keys p has live records for, from the peer index
+// and the records not written yet.
+func (pm *ProviderManager) providedKeys(ctx context.Context, p peer.ID) ([][]byte, error) {
+	var keys [][]byte
+	seen := make(map[string]struct{})
+	now := time.Now()
+	for k, provs := range pm.pending {
+		if t, ok := provs[p]; ok && now.Sub(t) <= ProvideValidity {
+			keys = append(keys, []byte(k))
+			seen[k] = struct{}{}
+		}
+	}
+
+	res, err := pm.dstore.Query(ctx, dsq.Query{Prefix: mkProvPeerPrefix(p), KeysOnly: true})
+	if err != nil {
+		return keys, err
+	}
+	defer res.Close()
+	for e := range res.Next() {
+		if e.Error != nil {
+			return keys, e.Error
+		}
+		i := strings.LastIndexByte(e.Key, '/')
+		k, err := base32.RawStdEncoding.DecodeString(e.Key[i+1:])
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[string(k)]; ok {
+			continue
+		}
+		t, found, err := readProvTime(ctx, pm.dstore, k, p)
+		if err != nil {
+			return keys, err
+		}
+		if found && now.Sub(t) <= ProvideValidity {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
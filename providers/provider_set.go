@@ -32,3 +32,40 @@ func (ps *providerSet) setVal(p peer.ID, t time.Time) {
 
 	ps.set[p] = t
 }
+
+// dropExpired removes the providers set more than ProvideValidity before now.
+// The providers slice is replaced rather than edited in place, as it may have
+// been handed out already.
+func (ps *providerSet) dropExpired(now time.Time) {
+	var live []peer.ID
+	for i, p := range ps.providers {
+		if now.Sub(ps.set[p]) <= ProvideValidity {
+			if live != nil {
+				live = append(live, p)
+			}
+			continue
+		}
+		if live == nil {
+			live = append(make([]peer.ID, 0, len(ps.providers)-1), ps.providers[:i]...)
+		}
+		delete(ps.set, p)
+	}
+	if live != nil {
+		ps.providers = live
+	}
+}
+
+// remove drops p from the set, replacing the providers slice like dropExpired.
+func (ps *providerSet) remove(p peer.ID) {
+	if _, found := ps.set[p]; !found {
+		return
+	}
+	delete(ps.set, p)
+	rest := make([]peer.ID, 0, len(ps.providers)-1)
+	for _, q := range ps.providers {
+		if q != p {
+			rest = append(rest, q)
+		}
+	}
+	ps.providers = rest
+}
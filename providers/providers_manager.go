@@ -20,6 +20,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	peerstoreImpl "github.com/libp2p/go-libp2p/p2p/host/peerstore"
 	"github.com/multiformats/go-base32"
+	"go.uber.org/zap"
 )
 
 const (
@@ -58,12 +59,32 @@ type ProviderManager struct {
 	cache  lru.LRUCache
 	pstore peerstore.Peerstore
 	dstore *autobatch.Datastore
+	// store is the datastore under dstore, which unlike dstore can be
+	// read outside of the run method once dstore is flushed, see
+	// ScanProviders.
+	store ds.Batching
 
 	newprovs chan *addProv
 	getprovs chan *getProv
+	getkeys  chan *getKeys
+	exports  chan *exportProvs
+	flushes  chan chan error
+	removals chan *removeProv
+
+	// legacyLayout is set until the datastore is migrated to LayoutVersion.
+	legacyLayout bool
 
 	cleanupInterval time.Duration
 
+	// flushInterval is the period of the write-behind flushes, 0 if the
+	// records are written as they're added. See WriteBehind.
+	flushInterval time.Duration
+	walPath       string
+	wal           *providerWAL
+	pending       pendingProvs
+
+	logger *zap.SugaredLogger
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -92,6 +113,15 @@ func CleanupInterval(d time.Duration) Option {
 	}
 }
 
+// Logger makes the provider manager log through l instead of the
+// package-wide "providers" logger.
+func Logger(l *zap.SugaredLogger) Option {
+	return func(pm *ProviderManager) error {
+		pm.logger = l
+		return nil
+	}
+}
+
 // Cache sets the LRU cache implementation.
 // Defaults to a simple LRU cache.
 func Cache(c lru.LRUCache) Option {
@@ -105,12 +135,30 @@ type addProv struct {
 	ctx context.Context
 	key []byte
 	val peer.ID
+	// at is the time the record was added at, for imported records. It is
+	// zero for the records added now.
+	at time.Time
 }
 
 type getProv struct {
 	ctx  context.Context
 	key  []byte
 	resp chan []peer.ID
+	// records is set instead of resp to get the records with their time.
+	records chan []ProviderRecord
+}
+
+type removeProv struct {
+	ctx  context.Context
+	key  []byte
+	prov peer.ID
+	resp chan error
+}
+
+type getKeys struct {
+	ctx  context.Context
+	prov peer.ID
+	resp chan [][]byte
 }
 
 // NewProviderManager constructor
@@ -119,7 +167,12 @@ func NewProviderManager(local peer.ID, ps peerstore.Peerstore, dstore ds.Batchin
 	pm.self = local
 	pm.getprovs = make(chan *getProv)
 	pm.newprovs = make(chan *addProv)
+	pm.getkeys = make(chan *getKeys)
+	pm.exports = make(chan *exportProvs)
+	pm.flushes = make(chan chan error)
+	pm.removals = make(chan *removeProv)
 	pm.pstore = ps
+	pm.store = dstore
 	pm.dstore = autobatch.NewAutoBatching(dstore, batchBufferSize)
 	cache, err := lru.NewLRU(lruCacheSize, nil)
 	if err != nil {
@@ -127,10 +180,23 @@ func NewProviderManager(local peer.ID, ps peerstore.Peerstore, dstore ds.Batchin
 	}
 	pm.cache = cache
 	pm.cleanupInterval = defaultCleanupInterval
+	pm.logger = &log.SugaredLogger
 	if err := pm.applyOptions(opts...); err != nil {
 		return nil, err
 	}
 	pm.ctx, pm.cancel = context.WithCancel(context.Background())
+	migrated, err := layoutMigrated(pm.ctx, pm.dstore)
+	if err != nil {
+		pm.cancel()
+		return nil, err
+	}
+	pm.legacyLayout = !migrated
+	if pm.flushInterval > 0 {
+		if err := pm.startWriteBehind(); err != nil {
+			pm.cancel()
+			return nil, err
+		}
+	}
 	pm.run()
 	return pm, nil
 }
@@ -143,26 +209,79 @@ func (pm *ProviderManager) run() {
 		var gcQuery dsq.Results
 		gcTimer := time.NewTimer(pm.cleanupInterval)
 
+		var flushTick <-chan time.Time
+		if pm.flushInterval > 0 {
+			flushTicker := time.NewTicker(pm.flushInterval)
+			defer flushTicker.Stop()
+			flushTick = flushTicker.C
+		}
+
 		defer func() {
 			gcTimer.Stop()
 			if gcQuery != nil {
 				// don't really care if this fails.
 				_ = gcQuery.Close()
 			}
+			if err := pm.flushPending(context.Background()); err != nil {
+				pm.logger.Error("failed to flush pending provider records: ", err)
+			}
 			if err := pm.dstore.Flush(context.Background()); err != nil {
-				log.Error("failed to flush datastore: ", err)
+				pm.logger.Error("failed to flush datastore: ", err)
+			}
+			if pm.wal != nil {
+				if err := pm.wal.close(); err != nil {
+					pm.logger.Error("failed to close provider write-behind log: ", err)
+				}
 			}
 		}()
 
 		var gcQueryRes <-chan dsq.Result
 		var gcSkip map[string]struct{}
 		var gcTime time.Time
+		// gcIndexed is set when the GC round scans the expiry index rather
+		// than all the records.
+		var gcIndexed bool
+		endGCRound := func() {
+			if err := gcQuery.Close(); err != nil {
+				pm.logger.Error("failed to close provider GC query: ", err)
+			}
+			gcTimer.Reset(pm.cleanupInterval)
+
+			// cleanup GC round
+			gcQueryRes = nil
+			gcSkip = nil
+			gcQuery = nil
+		}
+
+		// the records are indexed in the background, as the layout is migrated
+		var migrateQuery dsq.Results
+		var migrateRes <-chan dsq.Result
+		if pm.legacyLayout {
+			q, err := queryLegacyRecords(pm.ctx, pm.dstore)
+			if err != nil {
+				pm.logger.Error("provider record layout migration query failed: ", err)
+			} else {
+				migrateQuery = q
+				migrateRes = q.Next()
+				defer func() {
+					if migrateQuery != nil {
+						_ = migrateQuery.Close()
+					}
+				}()
+			}
+		}
+
 		for {
 			select {
 			case np := <-pm.newprovs:
-				err := pm.addProv(np.ctx, np.key, np.val)
+				var err error
+				if np.at.IsZero() {
+					err = pm.addProv(np.ctx, np.key, np.val)
+				} else {
+					err = pm.importProv(np.ctx, np.key, np.val, np.at)
+				}
 				if err != nil {
-					log.Error("error adding new providers: ", err)
+					pm.logger.Error("error adding new providers: ", err)
 					continue
 				}
 				if gcSkip != nil {
@@ -170,29 +289,73 @@ func (pm *ProviderManager) run() {
 					// as we've updated it since the GC started.
 					gcSkip[mkProvKeyFor(np.key, np.val)] = struct{}{}
 				}
+			case <-flushTick:
+				if err := pm.flushPending(pm.ctx); err != nil {
+					pm.logger.Error("failed to flush pending provider records: ", err)
+				}
 			case gp := <-pm.getprovs:
+				if gp.records != nil {
+					gp.records <- pm.providerRecordsForKey(gp.ctx, gp.key)
+					break
+				}
 				provs, err := pm.getProvidersForKey(gp.ctx, gp.key)
 				if err != nil && err != ds.ErrNotFound {
-					log.Error("error reading providers: ", err)
+					pm.logger.Error("error reading providers: ", err)
 				}
 
 				// set the cap so the user can't append to this.
 				gp.resp <- provs[0:len(provs):len(provs)]
-			case res, ok := <-gcQueryRes:
+			case rp := <-pm.removals:
+				rp.resp <- pm.removeProv(rp.ctx, rp.key, rp.prov)
+			case ex := <-pm.exports:
+				recs, err := pm.exportProvs(ex.ctx)
+				ex.resp <- exportResult{recs, err}
+			case resp := <-pm.flushes:
+				resp <- pm.dstore.Flush(pm.ctx)
+			case gk := <-pm.getkeys:
+				keys, err := pm.providedKeys(gk.ctx, gk.prov)
+				if err != nil {
+					pm.logger.Error("error reading provided keys: ", err)
+				}
+				gk.resp <- keys
+			case res, ok := <-migrateRes:
 				if !ok {
-					if err := gcQuery.Close(); err != nil {
-						log.Error("failed to close provider GC query: ", err)
+					if err := migrateQuery.Close(); err != nil {
+						pm.logger.Error("failed to close provider record layout migration query: ", err)
 					}
-					gcTimer.Reset(pm.cleanupInterval)
-
-					// cleanup GC round
-					gcQueryRes = nil
-					gcSkip = nil
-					gcQuery = nil
+					migrateQuery, migrateRes = nil, nil
+					err := setLayoutMigrated(pm.ctx, pm.dstore)
+					if err == nil {
+						err = pm.dstore.Flush(pm.ctx)
+					}
+					if err != nil {
+						pm.logger.Error("failed to record provider record layout migration: ", err)
+						continue
+					}
+					pm.legacyLayout = false
+					continue
+				}
+				if res.Error != nil {
+					pm.logger.Error("got error from provider record layout migration query: ", res.Error)
+					continue
+				}
+				if err := indexLegacyRecord(pm.ctx, pm.dstore, res.Entry); err != nil {
+					pm.logger.Warnw("failed to index provider record", "key", res.Key, "error", err)
+				}
+			case res, ok := <-gcQueryRes:
+				if !ok {
+					endGCRound()
 					continue
 				}
 				if res.Error != nil {
-					log.Error("got error from GC query: ", res.Error)
+					pm.logger.Error("got error from GC query: ", res.Error)
+					continue
+				}
+				if gcIndexed {
+					if pm.collectExpiryEntry(res.Key, gcTime) {
+						// the rest of the index expires later
+						endGCRound()
+					}
 					continue
 				}
 				if _, ok := gcSkip[res.Key]; ok {
@@ -206,13 +369,17 @@ func (pm *ProviderManager) run() {
 				switch {
 				case err != nil:
 					// couldn't parse the time
-					log.Error("parsing providers record from disk: ", err)
+					pm.logger.Error("parsing providers record from disk: ", err)
 					fallthrough
 				case gcTime.Sub(t) > ProvideValidity:
 					// or expired
-					err = pm.dstore.Delete(pm.ctx, ds.RawKey(res.Key))
+					if k, p, err := parseProvKey(res.Key); err == nil {
+						err = deleteProviderEntry(pm.ctx, pm.dstore, k, p)
+					} else {
+						err = pm.dstore.Delete(pm.ctx, ds.RawKey(res.Key))
+					}
 					if err != nil && err != ds.ErrNotFound {
-						log.Error("failed to remove provider record from disk: ", err)
+						pm.logger.Error("failed to remove provider record from disk: ", err)
 					}
 				}
 
@@ -223,12 +390,21 @@ func (pm *ProviderManager) run() {
 				// Much faster than GCing.
 				pm.cache.Purge()
 
-				// Now, kick off a GC of the datastore.
-				q, err := pm.dstore.Query(pm.ctx, dsq.Query{
-					Prefix: ProvidersKeyPrefix,
-				})
+				// Now, kick off a GC of the datastore. Once the records are
+				// indexed, only the expired ones are visited.
+				query := dsq.Query{Prefix: ProvidersKeyPrefix}
+				gcIndexed = !pm.legacyLayout
+				if gcIndexed {
+					query = dsq.Query{
+						Prefix:   provExpiryPrefix,
+						KeysOnly: true,
+						Orders:   []dsq.Order{dsq.OrderByKey{}},
+					}
+				}
+				q, err := pm.dstore.Query(pm.ctx, query)
 				if err != nil {
-					log.Error("provider record GC query failed: ", err)
+					pm.logger.Error("provider record GC query failed: ", err)
+					gcTimer.Reset(pm.cleanupInterval)
 					continue
 				}
 				gcQuery = q
@@ -270,22 +446,31 @@ func (pm *ProviderManager) AddProvider(ctx context.Context, k []byte, provInfo p
 
 // addProv updates the cache if needed
 func (pm *ProviderManager) addProv(ctx context.Context, k []byte, p peer.ID) error {
-	now := time.Now()
+	return pm.setProv(ctx, k, p, time.Now())
+}
+
+func (pm *ProviderManager) setProv(ctx context.Context, k []byte, p peer.ID, t time.Time) error {
 	if provs, ok := pm.cache.Get(string(k)); ok {
-		provs.(*providerSet).setVal(p, now)
+		provs.(*providerSet).setVal(p, t)
 	} // else not cached, just write through
 
-	return writeProviderEntry(ctx, pm.dstore, k, p, now)
+	if pm.flushInterval > 0 {
+		return pm.stageProv(k, p, t)
+	}
+	return writeProviderEntry(ctx, pm.dstore, k, p, t)
 }
 
-// writeProviderEntry writes the provider into the datastore
-func writeProviderEntry(ctx context.Context, dstore ds.Datastore, k []byte, p peer.ID, t time.Time) error {
+// writeProviderEntry writes the provider into the datastore, and indexes it
+func writeProviderEntry(ctx context.Context, dstore ds.Write, k []byte, p peer.ID, t time.Time) error {
 	dsk := mkProvKeyFor(k, p)
 
 	buf := make([]byte, 16)
 	n := binary.PutVarint(buf, t.UnixNano())
 
-	return dstore.Put(ctx, ds.NewKey(dsk), buf[:n])
+	if err := dstore.Put(ctx, ds.NewKey(dsk), buf[:n]); err != nil {
+		return err
+	}
+	return writeProviderIndex(ctx, dstore, k, p, t)
 }
 
 func mkProvKeyFor(k []byte, p peer.ID) string {
@@ -296,6 +481,40 @@ func mkProvKey(k []byte) string {
 	return ProvidersKeyPrefix + base32.RawStdEncoding.EncodeToString(k)
 }
 
+// RemoveProvider removes the record of prov providing k, if any.
+func (pm *ProviderManager) RemoveProvider(ctx context.Context, k []byte, prov peer.ID) error {
+	rp := &removeProv{
+		ctx:  ctx,
+		key:  k,
+		prov: prov,
+		resp: make(chan error, 1), // buffered to prevent sender from blocking
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case pm.removals <- rp:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-rp.resp:
+		return err
+	}
+}
+
+func (pm *ProviderManager) removeProv(ctx context.Context, k []byte, p peer.ID) error {
+	if provs, ok := pm.cache.Get(string(k)); ok {
+		provs.(*providerSet).remove(p)
+	}
+	if pending := pm.pending[string(k)]; pending != nil {
+		delete(pending, p)
+		if len(pending) == 0 {
+			delete(pm.pending, string(k))
+		}
+	}
+	return deleteProviderEntry(ctx, pm.dstore, k, p)
+}
+
 // GetProviders returns the set of providers for the given key.
 // This method _does not_ copy the set. Do not modify it.
 func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.AddrInfo, error) {
@@ -320,6 +539,28 @@ func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.A
 	}
 }
 
+// ProvidedKeys returns the keys the given peer has live provider records
+// for. Before the datastore is migrated to LayoutVersion, the records not
+// indexed yet are missing from the result.
+func (pm *ProviderManager) ProvidedKeys(ctx context.Context, p peer.ID) ([][]byte, error) {
+	gk := &getKeys{
+		ctx:  ctx,
+		prov: p,
+		resp: make(chan [][]byte, 1), // buffered to prevent sender from blocking
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case pm.getkeys <- gk:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case keys := <-gk.resp:
+		return keys, nil
+	}
+}
+
 func (pm *ProviderManager) getProvidersForKey(ctx context.Context, k []byte) ([]peer.ID, error) {
 	pset, err := pm.getProviderSetForKey(ctx, k)
 	if err != nil {
@@ -332,13 +573,23 @@ func (pm *ProviderManager) getProvidersForKey(ctx context.Context, k []byte) ([]
 func (pm *ProviderManager) getProviderSetForKey(ctx context.Context, k []byte) (*providerSet, error) {
 	cached, ok := pm.cache.Get(string(k))
 	if ok {
-		return cached.(*providerSet), nil
+		// the GC only runs periodically, don't serve the records that
+		// expired since
+		pset := cached.(*providerSet)
+		pset.dropExpired(time.Now())
+		if len(pset.providers) == 0 {
+			pm.cache.Remove(string(k))
+		}
+		return pset, nil
 	}
 
-	pset, err := loadProviderSet(ctx, pm.dstore, k)
+	pset, err := loadProviderSet(ctx, pm.dstore, k, pm.logger)
 	if err != nil {
 		return nil, err
 	}
+	for p, t := range pm.pending[string(k)] {
+		pset.setVal(p, t)
+	}
 
 	if len(pset.providers) > 0 {
 		pm.cache.Add(string(k), pset)
@@ -348,7 +599,7 @@ func (pm *ProviderManager) getProviderSetForKey(ctx context.Context, k []byte) (
 }
 
 // loads the ProviderSet out of the datastore
-func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*providerSet, error) {
+func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte, logger *zap.SugaredLogger) (*providerSet, error) {
 	res, err := dstore.Query(ctx, dsq.Query{Prefix: mkProvKey(k)})
 	if err != nil {
 		return nil, err
@@ -363,7 +614,7 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 			break
 		}
 		if e.Error != nil {
-			log.Error("got an error: ", e.Error)
+			logger.Error("got an error: ", e.Error)
 			continue
 		}
 
@@ -372,13 +623,17 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 		switch {
 		case err != nil:
 			// couldn't parse the time
-			log.Error("parsing providers record from disk: ", err)
+			logger.Error("parsing providers record from disk: ", err)
 			fallthrough
 		case now.Sub(t) > ProvideValidity:
 			// or just expired
-			err = dstore.Delete(ctx, ds.RawKey(e.Key))
+			if pk, p, err := parseProvKey(e.Key); err == nil {
+				err = deleteProviderEntry(ctx, dstore, pk, p)
+			} else {
+				err = dstore.Delete(ctx, ds.RawKey(e.Key))
+			}
 			if err != nil && err != ds.ErrNotFound {
-				log.Error("failed to remove provider record from disk: ", err)
+				logger.Error("failed to remove provider record from disk: ", err)
 			}
 			continue
 		}
@@ -387,10 +642,10 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 
 		decstr, err := base32.RawStdEncoding.DecodeString(e.Key[lix+1:])
 		if err != nil {
-			log.Error("base32 decoding error: ", err)
+			logger.Error("base32 decoding error: ", err)
 			err = dstore.Delete(ctx, ds.RawKey(e.Key))
 			if err != nil && err != ds.ErrNotFound {
-				log.Error("failed to remove provider record from disk: ", err)
+				logger.Error("failed to remove provider record from disk: ", err)
 			}
 			continue
 		}
@@ -2,9 +2,13 @@ package providers
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -121,7 +125,7 @@ func TestProvidersSerialization(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	pset, err := loadProviderSet(context.Background(), dstore, k)
+	pset, err := loadProviderSet(context.Background(), dstore, k, &log.SugaredLogger)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -366,3 +370,485 @@ func TestWriteUpdatesCache(t *testing.T) {
 		t.Fatalf("expected h1 to be provided by 2 peers, is by %d", len(c1Provs))
 	}
 }
+
+func TestCachedProvidersExpire(t *testing.T) {
+	pval := ProvideValidity
+	ProvideValidity = 100 * time.Millisecond
+	defer func() { ProvideValidity = pval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p1 := peer.ID("a")
+	h1 := internal.Hash([]byte("1"))
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm, err := NewProviderManager(p1, ps, dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+
+	pm.AddProvider(ctx, h1, peer.AddrInfo{ID: p1})
+	// force into the cache
+	if provs, _ := pm.GetProviders(ctx, h1); len(provs) != 1 {
+		t.Fatalf("expected h1 to be provided by 1 peer, is by %d", len(provs))
+	}
+
+	// the cached record expires before the GC runs
+	time.Sleep(2 * ProvideValidity)
+	if provs, _ := pm.GetProviders(ctx, h1); len(provs) != 0 {
+		t.Fatalf("expected the expired provider to be dropped, got %d providers", len(provs))
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	walPath := filepath.Join(t.TempDir(), "providers.wal")
+
+	// records left in the log by a crash, the last one torn
+	wal, err := openProviderWAL(walPath, func([]byte, peer.ID, time.Time) {}, &log.SugaredLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := internal.Hash([]byte("crashed"))
+	if err := wal.append(crashed, peer.ID("provider1"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.f.Write([]byte{5, 'a'}); err != nil {
+		t.Fatal(err)
+	}
+	wal.close()
+
+	p, err := NewProviderManager(peer.ID("self"), ps, dstore, WriteBehind(time.Hour, walPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := dstore.Has(ctx, ds.NewKey(mkProvKeyFor(crashed, peer.ID("provider1")))); !has {
+		t.Fatal("record of the log was not written to the datastore")
+	}
+	if fi, err := os.Stat(walPath); err != nil || fi.Size() != 0 {
+		t.Fatal("log was not emptied", err)
+	}
+
+	// new records are served, and logged, but not written
+	k := internal.Hash([]byte("test"))
+	if err := p.AddProvider(ctx, k, peer.AddrInfo{ID: peer.ID("provider2")}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := p.GetProviders(ctx, k); len(resp) != 1 {
+		t.Fatalf("expected 1 provider, got %d", len(resp))
+	}
+	dsk := ds.NewKey(mkProvKeyFor(k, peer.ID("provider2")))
+	if has, _ := dstore.Has(ctx, dsk); has {
+		t.Fatal("record was written before the flush")
+	}
+	if fi, err := os.Stat(walPath); err != nil || fi.Size() == 0 {
+		t.Fatal("record was not logged", err)
+	}
+
+	// closing flushes
+	p.Close()
+	if has, _ := dstore.Has(ctx, dsk); !has {
+		t.Fatal("record was not written on close")
+	}
+	if fi, err := os.Stat(walPath); err != nil || fi.Size() != 0 {
+		t.Fatal("log was not emptied", err)
+	}
+}
+
+// commitCounter counts the non-empty batches committed to its datastore.
+type commitCounter struct {
+	ds.Batching
+	commits atomic.Int32
+}
+
+func (c *commitCounter) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := c.Batching.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &countedBatch{Batch: b, c: c}, nil
+}
+
+type countedBatch struct {
+	ds.Batch
+	c    *commitCounter
+	puts int
+}
+
+func (b *countedBatch) Put(ctx context.Context, k ds.Key, v []byte) error {
+	b.puts++
+	return b.Batch.Put(ctx, k, v)
+}
+
+func (b *countedBatch) Commit(ctx context.Context) error {
+	if b.puts > 0 {
+		b.c.commits.Add(1)
+	}
+	return b.Batch.Commit(ctx)
+}
+
+func TestWriteBehindSingleBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstore := &commitCounter{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+	p, err := NewProviderManager(peer.ID("self"), ps, dstore, WriteBehind(time.Hour, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more writes than the auto-batching buffer holds
+	var keys []ds.Key
+	for i := 0; i < batchBufferSize; i++ {
+		k := internal.Hash([]byte(fmt.Sprint("key", i)))
+		prov := peer.ID(fmt.Sprint("provider", i))
+		if err := p.AddProvider(ctx, k, peer.AddrInfo{ID: prov}); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, ds.NewKey(mkProvKeyFor(k, prov)))
+	}
+	before := dstore.commits.Load()
+
+	// the pending records are written with a single batch
+	p.Close()
+	if n := dstore.commits.Load() - before; n != 1 {
+		t.Fatalf("expected the flush to commit 1 batch, got %d", n)
+	}
+	for _, k := range keys {
+		if has, _ := dstore.Has(ctx, k); !has {
+			t.Fatalf("record %s was not written", k)
+		}
+	}
+}
+
+func TestLayoutMigration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+
+	// records written with the first layout, which had no index
+	prov := peer.ID("provider")
+	var keys []mh.Multihash
+	for i := 0; i < 3; i++ {
+		k := internal.Hash([]byte(fmt.Sprint(i)))
+		keys = append(keys, k)
+		buf := binary.AppendVarint(nil, time.Now().UnixNano())
+		if err := dstore.Put(ctx, ds.NewKey(mkProvKeyFor(k, prov)), buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := NewProviderManager(peer.ID("self"), ps, dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for i := 0; ; i++ {
+		if done, _ := layoutMigrated(ctx, dstore); done {
+			break
+		}
+		if i == 100 {
+			t.Fatal("datastore was not migrated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	added := internal.Hash([]byte("added"))
+	if err := p.AddProvider(ctx, added, peer.AddrInfo{ID: prov}); err != nil {
+		t.Fatal(err)
+	}
+	provided, err := p.ProvidedKeys(ctx, prov)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provided) != len(keys)+1 {
+		t.Fatalf("expected %d provided keys, got %d", len(keys)+1, len(provided))
+	}
+	if provided, _ := p.ProvidedKeys(ctx, peer.ID("other")); len(provided) != 0 {
+		t.Fatalf("expected no provided keys, got %d", len(provided))
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	ctx := context.Background()
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+
+	k := internal.Hash([]byte("test"))
+	now := time.Now()
+	buf := binary.AppendVarint(nil, now.UnixNano())
+	if err := dstore.Put(ctx, ds.NewKey(mkProvKeyFor(k, peer.ID("provider"))), buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateLayout(ctx, dstore); err != nil {
+		t.Fatal(err)
+	}
+	if done, _ := layoutMigrated(ctx, dstore); !done {
+		t.Fatal("datastore was not marked as migrated")
+	}
+	for _, key := range []ds.Key{mkProvExpiryKey(expiryOf(now), k, peer.ID("provider")), mkProvPeerKey(peer.ID("provider"), k)} {
+		if has, _ := dstore.Has(ctx, key); !has {
+			t.Fatalf("missing index entry %s", key)
+		}
+	}
+}
+
+func TestIndexedGC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	if err := setLayoutMigrated(ctx, dstore); err != nil {
+		t.Fatal(err)
+	}
+	expired := internal.Hash([]byte("expired"))
+	if err := writeProviderEntry(ctx, dstore, expired, peer.ID("provider"), time.Now().Add(-ProvideValidity-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProviderManager(peer.ID("self"), ps, dstore, CleanupInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := internal.Hash([]byte("live"))
+	if err := p.AddProvider(ctx, live, peer.AddrInfo{ID: peer.ID("provider")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	p.Close()
+
+	res, err := dstore.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the live record, its two index entries, and the layout version
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 datastore entries, got %v", entries)
+	}
+	if has, _ := dstore.Has(ctx, ds.NewKey(mkProvKeyFor(live, peer.ID("provider")))); !has {
+		t.Fatal("live record was collected")
+	}
+}
+
+func TestExportImportProviders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewProviderManager(peer.ID("self"), ps, dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	k := internal.Hash([]byte("test"))
+	if err := src.AddProvider(ctx, k, peer.AddrInfo{ID: peer.ID("provider")}); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := src.ExportProviders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("expected 1 exported record, got %d", len(recs))
+	}
+
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	dst, err := NewProviderManager(peer.ID("self"), ps, dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := ProviderRecord{Key: k, Provider: peer.ID("expired"), Added: time.Now().Add(-ProvideValidity - time.Minute)}
+	if err := dst.ImportProviders(ctx, append(recs, expired)); err != nil {
+		t.Fatal(err)
+	}
+	if provs, _ := dst.GetProviders(ctx, k); len(provs) != 1 || provs[0].ID != peer.ID("provider") {
+		t.Fatalf("expected the imported provider, got %v", provs)
+	}
+	dst.Close()
+
+	// the time the record was added at is kept
+	added, found, err := readProvTime(ctx, dstore, k, peer.ID("provider"))
+	if err != nil || !found {
+		t.Fatal("imported record was not written", err)
+	}
+	if !added.Equal(recs[0].Added) {
+		t.Fatalf("expected the record added at %s, got %s", recs[0].Added, added)
+	}
+}
+
+func TestScanProviders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	k := internal.Hash([]byte("test"))
+	if err := writeProviderEntry(ctx, dstore, k, peer.ID("live"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeProviderEntry(ctx, dstore, k, peer.ID("expired"), time.Now().Add(-ProvideValidity-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	pm, err := NewProviderManager(peer.ID("self"), ps, dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+
+	var recs []ProviderRecord
+	if err := pm.ScanProviders(ctx, func(rec ProviderRecord) { recs = append(recs, rec) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Provider != peer.ID("live") || string(recs[0].Key) != string(k) {
+		t.Fatalf("expected the live record, got %v", recs)
+	}
+}
+
+func TestGetProviderRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := NewProviderManager(peer.ID("self"), ps, dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+
+	k := internal.Hash([]byte("test"))
+	before := time.Now()
+	if err := pm.AddProvider(ctx, k, peer.AddrInfo{ID: peer.ID("provider")}); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := pm.GetProviderRecords(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Provider != peer.ID("provider") {
+		t.Fatalf("expected the provider record, got %v", recs)
+	}
+	if recs[0].Added.Before(before) || recs[0].Added.After(time.Now()) {
+		t.Fatalf("unexpected record time %s", recs[0].Added)
+	}
+
+	recs, err = pm.GetProviderRecords(ctx, internal.Hash([]byte("other")))
+	if err != nil || len(recs) != 0 {
+		t.Fatalf("expected no records, got %v, %v", recs, err)
+	}
+}
+
+func TestRemoveProvider(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	pm, err := NewProviderManager(peer.ID("self"), ps, dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := internal.Hash([]byte("test"))
+	for _, p := range []peer.ID{"a", "b"} {
+		if err := pm.AddProvider(ctx, k, peer.AddrInfo{ID: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pm.RemoveProvider(ctx, k, peer.ID("a")); err != nil {
+		t.Fatal(err)
+	}
+	// removing an unknown record is a no-op
+	if err := pm.RemoveProvider(ctx, k, peer.ID("c")); err != nil {
+		t.Fatal(err)
+	}
+	provs, _ := pm.GetProviders(ctx, k)
+	if len(provs) != 1 || provs[0].ID != peer.ID("b") {
+		t.Fatalf("expected only b to be left, got %v", provs)
+	}
+	pm.Close()
+
+	// the record is gone from the datastore too
+	pm, err = NewProviderManager(peer.ID("self"), ps, dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	provs, _ = pm.GetProviders(ctx, k)
+	if len(provs) != 1 || provs[0].ID != peer.ID("b") {
+		t.Fatalf("expected only b to be stored, got %v", provs)
+	}
+}
+
+func TestRemoveProviderKeepsReturnedSlices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, err := NewProviderManager(peer.ID("self"), ps, dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+
+	k := internal.Hash([]byte("test"))
+	for _, p := range []peer.ID{"a", "b", "c"} {
+		if err := pm.AddProvider(ctx, k, peer.AddrInfo{ID: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// hold the slice the run loop hands out, as GetProviders does
+	gp := &getProv{ctx: ctx, key: k, resp: make(chan []peer.ID, 1)}
+	pm.getprovs <- gp
+	provs := <-gp.resp
+	want := append([]peer.ID(nil), provs...)
+
+	if err := pm.RemoveProvider(ctx, k, want[0]); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(provs, want) {
+		t.Fatalf("returned providers changed by a removal: got %v, want %v", provs, want)
+	}
+}
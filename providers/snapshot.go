@@ -0,0 +1,207 @@
+package providers
+
+import (
+	"context"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ProviderRecord is a provider record as exported and imported by
+// ExportProviders and ImportProviders.
+type ProviderRecord struct {
+	Key      []byte
+	Provider peer.ID
+	// Added is the time the record was added at, which it expires
+	// ProvideValidity after.
+	Added time.Time
+}
+
+type exportProvs struct {
+	ctx  context.Context
+	resp chan exportResult
+}
+
+type exportResult struct {
+	recs []ProviderRecord
+	err  error
+}
+
+// ExportProviders returns all the live provider records. The provider
+// addresses are left in the peerstore.
+func (pm *ProviderManager) ExportProviders(ctx context.Context) ([]ProviderRecord, error) {
+	ex := &exportProvs{
+		ctx:  ctx,
+		resp: make(chan exportResult, 1), // buffered to prevent sender from blocking
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case pm.exports <- ex:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ex.resp:
+		return res.recs, res.err
+	}
+}
+
+// ScanProviders calls fn with the live provider records of the datastore as
+// it reads them, without holding them all in memory like ExportProviders. The
+// records not written yet by the write-behind are left out.
+func (pm *ProviderManager) ScanProviders(ctx context.Context, fn func(ProviderRecord)) error {
+	// the batched records are written first, so that the datastore can be
+	// read without blocking the other operations during the scan
+	flushed := make(chan error, 1)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case pm.flushes <- flushed:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-flushed:
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := pm.store.Query(ctx, dsq.Query{Prefix: ProvidersKeyPrefix})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	now := time.Now()
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		k, p, err := parseProvKey(e.Key)
+		if err != nil {
+			continue
+		}
+		t, err := readTimeValue(e.Value)
+		if err != nil || now.Sub(t) > ProvideValidity {
+			continue
+		}
+		fn(ProviderRecord{Key: k, Provider: p, Added: t})
+	}
+	return ctx.Err()
+}
+
+// GetProviderRecords returns the provider records for the given key, with the
+// time they were added at.
+func (pm *ProviderManager) GetProviderRecords(ctx context.Context, k []byte) ([]ProviderRecord, error) {
+	gp := &getProv{
+		ctx:     ctx,
+		key:     k,
+		records: make(chan []ProviderRecord, 1), // buffered to prevent sender from blocking
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case pm.getprovs <- gp:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case recs := <-gp.records:
+		return recs, nil
+	}
+}
+
+func (pm *ProviderManager) providerRecordsForKey(ctx context.Context, k []byte) []ProviderRecord {
+	pset, err := pm.getProviderSetForKey(ctx, k)
+	if err != nil {
+		if err != ds.ErrNotFound {
+			pm.logger.Error("error reading providers: ", err)
+		}
+		return nil
+	}
+	recs := make([]ProviderRecord, 0, len(pset.providers))
+	for _, p := range pset.providers {
+		recs = append(recs, ProviderRecord{Key: k, Provider: p, Added: pset.set[p]})
+	}
+	return recs
+}
+
+// ImportProviders adds provider records exported by another provider manager,
+// keeping the time they were added at. Expired records are dropped, and
+// records already known are only updated if the imported one is more recent.
+func (pm *ProviderManager) ImportProviders(ctx context.Context, recs []ProviderRecord) error {
+	now := time.Now()
+	for _, rec := range recs {
+		if rec.Added.IsZero() || now.Sub(rec.Added) > ProvideValidity {
+			continue
+		}
+		prov := &addProv{
+			ctx: ctx,
+			key: rec.Key,
+			val: rec.Provider,
+			at:  rec.Added,
+		}
+		select {
+		case pm.newprovs <- prov:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// exportProvs reads the live records of the datastore, and the ones not
+// written yet.
+func (pm *ProviderManager) exportProvs(ctx context.Context) ([]ProviderRecord, error) {
+	res, err := pm.dstore.Query(ctx, dsq.Query{Prefix: ProvidersKeyPrefix})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	now := time.Now()
+	var recs []ProviderRecord
+	for e := range res.Next() {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		k, p, err := parseProvKey(e.Key)
+		if err != nil {
+			continue
+		}
+		if _, ok := pm.pending[string(k)][p]; ok {
+			// the pending record is more recent
+			continue
+		}
+		t, err := readTimeValue(e.Value)
+		if err != nil || now.Sub(t) > ProvideValidity {
+			continue
+		}
+		recs = append(recs, ProviderRecord{Key: k, Provider: p, Added: t})
+	}
+	for k, provs := range pm.pending {
+		for p, t := range provs {
+			recs = append(recs, ProviderRecord{Key: []byte(k), Provider: p, Added: t})
+		}
+	}
+	return recs, nil
+}
+
+// importProv adds an imported record, unless a more recent one is known.
+func (pm *ProviderManager) importProv(ctx context.Context, k []byte, p peer.ID, t time.Time) error {
+	if pt, ok := pm.pending[string(k)][p]; ok && !pt.Before(t) {
+		return nil
+	}
+	known, found, err := readProvTime(ctx, pm.dstore, k, p)
+	if err != nil {
+		return err
+	}
+	if found && !known.Before(t) {
+		return nil
+	}
+	return pm.setProv(ctx, k, p, t)
+}
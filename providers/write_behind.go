@@ -0,0 +1,208 @@
+package providers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+)
+
+// WriteBehind makes the provider manager keep the provider records it is
+// given in memory, and write them to the datastore in a single batch every
+// interval, rather than one datastore put per record.
+//
+// If walPath is not empty, every record is also appended to a log file at
+// that path before AddProvider returns. Records left in the log by a crash
+// are written to the datastore when the next provider manager starts, and
+// the log is emptied after every flush. The log is not synced to disk: it
+// protects against the process crashing, not the host.
+func WriteBehind(interval time.Duration, walPath string) Option {
+	return func(pm *ProviderManager) error {
+		if interval <= 0 {
+			return fmt.Errorf("write-behind flush interval must be positive")
+		}
+		pm.flushInterval = interval
+		pm.walPath = walPath
+		return nil
+	}
+}
+
+// pendingProvs are the provider records not flushed to the datastore yet,
+// by key and provider.
+type pendingProvs map[string]map[peer.ID]time.Time
+
+func (pp pendingProvs) add(k []byte, p peer.ID, t time.Time) {
+	provs, ok := pp[string(k)]
+	if !ok {
+		provs = make(map[peer.ID]time.Time)
+		pp[string(k)] = provs
+	}
+	provs[p] = t
+}
+
+// startWriteBehind writes the records left in the log by the previous
+// provider manager, if any, and starts the log anew.
+func (pm *ProviderManager) startWriteBehind() error {
+	pm.pending = make(pendingProvs)
+	if pm.walPath == "" {
+		return nil
+	}
+	wal, err := openProviderWAL(pm.walPath, pm.pending.add, pm.logger)
+	if err != nil {
+		return fmt.Errorf("opening provider write-behind log: %w", err)
+	}
+	pm.wal = wal
+	if err := pm.flushPending(pm.ctx); err != nil {
+		wal.close()
+		return fmt.Errorf("flushing provider write-behind log: %w", err)
+	}
+	// the log may end with a torn record, that new records must not follow
+	return wal.truncate()
+}
+
+// stageProv adds a provider record to the ones written at the next flush.
+func (pm *ProviderManager) stageProv(k []byte, p peer.ID, t time.Time) error {
+	if pm.wal != nil {
+		if err := pm.wal.append(k, p, t); err != nil {
+			return err
+		}
+	}
+	pm.pending.add(k, p, t)
+	return nil
+}
+
+// flushPending writes the pending provider records to the datastore in one
+// batch, and empties the log once they're persisted.
+func (pm *ProviderManager) flushPending(ctx context.Context) error {
+	if len(pm.pending) == 0 {
+		return nil
+	}
+	// the batch goes straight to the underlying datastore, the writes
+	// buffered until now must land first not to override it
+	if err := pm.dstore.Flush(ctx); err != nil {
+		return err
+	}
+	b, err := pm.store.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for k, provs := range pm.pending {
+		for p, t := range provs {
+			if err := writeProviderEntry(ctx, b, []byte(k), p, t); err != nil {
+				return err
+			}
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		return err
+	}
+	clear(pm.pending)
+	if pm.wal != nil {
+		return pm.wal.truncate()
+	}
+	return nil
+}
+
+// providerWAL is the log of the provider records not flushed yet. Every
+// record is the uvarint prefixed key, the uvarint prefixed peer ID and the
+// varint time of the record.
+type providerWAL struct {
+	f   *os.File
+	buf []byte
+}
+
+// openProviderWAL opens the log at path, creating it if needed, and calls
+// replay for every record found in it.
+func openProviderWAL(path string, replay func(k []byte, p peer.ID, t time.Time), logger *zap.SugaredLogger) (*providerWAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		k, p, t, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a record torn by a crash ends the log
+			logger.Warnw("truncated provider write-behind log", "path", path, "error", err)
+			break
+		}
+		replay(k, p, t)
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &providerWAL{f: f}, nil
+}
+
+func readWALRecord(r *bufio.Reader) ([]byte, peer.ID, time.Time, error) {
+	k, err := readWALField(r)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	p, err := readWALField(r)
+	if err != nil {
+		return nil, "", time.Time{}, eofIsUnexpected(err)
+	}
+	nsec, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, "", time.Time{}, eofIsUnexpected(err)
+	}
+	return k, peer.ID(p), time.Unix(0, nsec), nil
+}
+
+func readWALField(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<16 {
+		return nil, fmt.Errorf("oversized field of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, eofIsUnexpected(err)
+	}
+	return b, nil
+}
+
+func eofIsUnexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (w *providerWAL) append(k []byte, p peer.ID, t time.Time) error {
+	b := binary.AppendUvarint(w.buf[:0], uint64(len(k)))
+	b = append(b, k...)
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	b = append(b, p...)
+	b = binary.AppendVarint(b, t.UnixNano())
+	w.buf = b
+	_, err := w.f.Write(b)
+	return err
+}
+
+func (w *providerWAL) truncate() error {
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := w.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *providerWAL) close() error {
+	return w.f.Close()
+}
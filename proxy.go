@@ -0,0 +1,287 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+const kadProxy protocol.ID = "/kad/proxy/1.0.0"
+
+// proxyRequestTimeout bounds the lookup a proxy performs for a single request.
+var proxyRequestTimeout = time.Minute
+
+// The proxy protocol reuses the DHT messages with delegation semantics: a
+// FIND_NODE, GET_PROVIDERS or GET_VALUE request sent to a proxy asks it to run
+// the whole iterative lookup on our behalf, rather than to answer from its own
+// routing table and datastore. The proxy streams back the results as it finds
+// them, one or more responses per request, and a response carrying no closer
+// peers, no providers and no record ends the request.
+
+// handleProxyStream serves the lookups of the designated proxy clients.
+func (dht *IpfsDHT) handleProxyStream(s network.Stream) {
+	if _, ok := dht.proxyClients[s.Conn().RemotePeer()]; !ok {
+		_ = s.Reset()
+		return
+	}
+
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	for {
+		msgbytes, err := r.ReadMsg()
+		if err != nil {
+			r.ReleaseMsg(msgbytes)
+			if err == io.EOF {
+				_ = s.Close()
+			} else {
+				_ = s.Reset()
+			}
+			return
+		}
+		var req pb.Message
+		err = req.Unmarshal(msgbytes)
+		r.ReleaseMsg(msgbytes)
+		if err == nil {
+			err = dht.proxyRequest(s, &req)
+		}
+		if err != nil {
+			dht.logger.Debugw("failed to proxy request", "from", s.Conn().RemotePeer(), "type", req.GetType(), "error", err)
+			_ = s.Reset()
+			return
+		}
+	}
+}
+
+func (dht *IpfsDHT) proxyRequest(s network.Stream, req *pb.Message) error {
+	ctx, cancel := context.WithTimeout(dht.ctx, proxyRequestTimeout)
+	defer cancel()
+
+	key := req.GetKey()
+	if len(key) == 0 {
+		return fmt.Errorf("empty key")
+	}
+
+	switch req.GetType() {
+	case pb.Message_FIND_NODE:
+		peers, err := dht.GetClosestPeers(ctx, string(key))
+		if err != nil {
+			return err
+		}
+		infos := make([]peer.AddrInfo, len(peers))
+		for i, p := range peers {
+			infos[i] = dht.peerstore.PeerInfo(p)
+		}
+		resp := pb.NewMessage(req.GetType(), key, 0)
+		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
+		if len(resp.CloserPeers) > 0 {
+			if err := net.WriteMsg(s, resp); err != nil {
+				return err
+			}
+		}
+	case pb.Message_GET_PROVIDERS:
+		mh, err := multihash.Cast(key)
+		if err != nil {
+			return err
+		}
+		for p := range dht.FindProvidersAsync(ctx, cid.NewCidV1(cid.Raw, mh), 0) {
+			resp := pb.NewMessage(req.GetType(), key, 0)
+			resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), []peer.AddrInfo{p})
+			if err := net.WriteMsg(s, resp); err != nil {
+				return err
+			}
+		}
+	case pb.Message_GET_VALUE:
+		vals, err := dht.SearchValue(ctx, string(key))
+		if err != nil {
+			return err
+		}
+		for v := range vals {
+			resp := pb.NewMessage(req.GetType(), key, 0)
+			resp.Record = record.MakePutRecord(string(key), v)
+			if err := net.WriteMsg(s, resp); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported proxy request type %s", req.GetType())
+	}
+
+	return net.WriteMsg(s, pb.NewMessage(req.GetType(), key, 0))
+}
+
+// ProxyClient runs lookups through a DHT server configured with ProxyFor to
+// serve this host, instead of running them itself. This suits NATed or
+// battery-powered nodes that can't afford to maintain a routing table and to
+// dial the many peers of an iterative lookup.
+//
+// The proxy is trusted: its results are returned as they are.
+type ProxyClient struct {
+	host     host.Host
+	proxy    peer.ID
+	protocol protocol.ID
+	logger   *zap.SugaredLogger
+}
+
+// NewProxyClient returns a client using proxy, which must be reachable by h.
+// protocolPrefix is the protocol prefix of the proxy's DHT (e.g. "/ipfs").
+func NewProxyClient(h host.Host, proxy peer.ID, protocolPrefix protocol.ID) *ProxyClient {
+	return &ProxyClient{
+		host:     h,
+		proxy:    proxy,
+		protocol: protocolPrefix + kadProxy,
+		logger:   &logger.SugaredLogger,
+	}
+}
+
+// SetLogger makes the client log through l instead of the package-wide "dht"
+// logger, like the Logger option of the DHT.
+func (c *ProxyClient) SetLogger(l *zap.SugaredLogger) {
+	c.logger = l
+}
+
+// requestLogger returns the logger of the client, tagged with the request ID
+// of ctx if any.
+func (c *ProxyClient) requestLogger(ctx context.Context) *zap.SugaredLogger {
+	if id := internal.RequestID(ctx); id != "" {
+		return c.logger.With("request_id", id)
+	}
+	return c.logger
+}
+
+// request sends req to the proxy and calls onResp with each response carrying
+// results, until the proxy signals the end of the request.
+func (c *ProxyClient) request(ctx context.Context, req *pb.Message, onResp func(*pb.Message) error) error {
+	s, err := c.host.NewStream(ctx, c.proxy, c.protocol)
+	if err != nil {
+		return err
+	}
+	defer context.AfterFunc(ctx, func() { _ = s.Reset() })()
+
+	if err := net.WriteMsg(s, req); err != nil {
+		_ = s.Reset()
+		return err
+	}
+
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	for {
+		msgbytes, err := r.ReadMsg()
+		if err != nil {
+			_ = s.Reset()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		var resp pb.Message
+		err = resp.Unmarshal(msgbytes)
+		r.ReleaseMsg(msgbytes)
+		if err != nil {
+			_ = s.Reset()
+			return err
+		}
+		if len(resp.CloserPeers) == 0 && len(resp.ProviderPeers) == 0 && resp.Record == nil {
+			return s.Close()
+		}
+		if err := onResp(&resp); err != nil {
+			_ = s.Reset()
+			return err
+		}
+	}
+}
+
+// GetClosestPeers returns the peers closest to key, as found by the proxy.
+func (c *ProxyClient) GetClosestPeers(ctx context.Context, key string) ([]peer.AddrInfo, error) {
+	var closest []peer.AddrInfo
+	err := c.request(ctx, pb.NewMessage(pb.Message_FIND_NODE, []byte(key), 0), func(resp *pb.Message) error {
+		for _, p := range pb.PBPeersToPeerInfos(resp.GetCloserPeers()) {
+			closest = append(closest, *p)
+		}
+		return nil
+	})
+	return closest, err
+}
+
+// FindProvidersAsync streams the providers of key found by the proxy, up to
+// count of them (0 for no limit).
+func (c *ProxyClient) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		found := 0
+		errDone := fmt.Errorf("enough providers")
+		err := c.request(ctx, pb.NewMessage(pb.Message_GET_PROVIDERS, key.Hash(), 0), func(resp *pb.Message) error {
+			for _, p := range pb.PBPeersToPeerInfos(resp.GetProviderPeers()) {
+				select {
+				case out <- *p:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				found++
+				if count > 0 && found >= count {
+					return errDone
+				}
+			}
+			return nil
+		})
+		if err != nil && err != errDone {
+			c.requestLogger(ctx).Debugw("proxied provider lookup failed", "proxy", c.proxy, "key", key, "error", err)
+		}
+	}()
+	return out
+}
+
+// SearchValue streams the increasingly better values for key found by the
+// proxy.
+func (c *ProxyClient) SearchValue(ctx context.Context, key string) (<-chan []byte, error) {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		err := c.request(ctx, pb.NewMessage(pb.Message_GET_VALUE, []byte(key), 0), func(resp *pb.Message) error {
+			select {
+			case out <- resp.GetRecord().GetValue():
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			c.requestLogger(ctx).Debugw("proxied value lookup failed", "proxy", c.proxy, "key", internal.LoggableRecordKeyString(key), "error", err)
+		}
+	}()
+	return out, nil
+}
+
+// GetValue returns the best value for key found by the proxy.
+func (c *ProxyClient) GetValue(ctx context.Context, key string) ([]byte, error) {
+	vals, err := c.SearchValue(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var best []byte
+	found := false
+	for v := range vals {
+		best, found = v, true
+	}
+	if !found {
+		return nil, routing.ErrNotFound
+	}
+	return best, nil
+}
@@ -1,11 +1,11 @@
 package qpeerset
 
 import (
-	"math/big"
+	"bytes"
 	"sort"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p/core/peer"
-	ks "github.com/whyrusleeping/go-keyspace"
 )
 
 // PeerState describes the state of a peer ID during the lifecycle of an individual lookup.
@@ -22,22 +22,35 @@ const (
 	PeerUnreachable
 )
 
+// numPeerStates is the number of peer states.
+const numPeerStates = int(PeerUnreachable) + 1
+
 // QueryPeerset maintains the state of a Kademlia asynchronous lookup.
 // The lookup state is a set of peers, each labeled with a peer state.
 type QueryPeerset struct {
-	// the key being searched for
-	key ks.Key
+	// the keyspace position being searched for
+	target []byte
+	// hash maps peer IDs into the keyspace of target
+	hash internal.KeyspaceHash
 
-	// all known peers
+	// all known peers, in the order they were added
 	all []queryPeerState
+	// index maps every known peer to its position in all
+	index map[peer.ID]int
+	// order are the positions in all, closest peer first once sorted
+	order []int
+	// counts is the number of peers in every state
+	counts [numPeerStates]int
 
 	// sorted is true if all is currently in sorted order
 	sorted bool
 }
 
 type queryPeerState struct {
-	id         peer.ID
-	distance   *big.Int
+	id peer.ID
+	// distance is the XOR distance to the target, compared as a big-endian
+	// integer of the keyspace width.
+	distance   []byte
 	state      PeerState
 	referredBy peer.ID
 }
@@ -45,39 +58,52 @@ type queryPeerState struct {
 type sortedQueryPeerset QueryPeerset
 
 func (sqp *sortedQueryPeerset) Len() int {
-	return len(sqp.all)
+	return len(sqp.order)
 }
 
 func (sqp *sortedQueryPeerset) Swap(i, j int) {
-	sqp.all[i], sqp.all[j] = sqp.all[j], sqp.all[i]
+	sqp.order[i], sqp.order[j] = sqp.order[j], sqp.order[i]
 }
 
 func (sqp *sortedQueryPeerset) Less(i, j int) bool {
-	di, dj := sqp.all[i].distance, sqp.all[j].distance
-	return di.Cmp(dj) == -1
+	return bytes.Compare(sqp.all[sqp.order[i]].distance, sqp.all[sqp.order[j]].distance) < 0
 }
 
 // NewQueryPeerset creates a new empty set of peers.
 // key is the target key of the lookup that this peer set is for.
 func NewQueryPeerset(key string) *QueryPeerset {
+	return NewQueryPeersetWithHash(key, nil)
+}
+
+// NewQueryPeersetWithHash creates a new empty set of peers, ordered by their
+// distance to key in the keyspace defined by hash. A nil hash is sha256.
+func NewQueryPeersetWithHash(key string, hash func([]byte) []byte) *QueryPeerset {
+	h := internal.KeyspaceHash(hash)
+	return NewQueryPeersetForID(h.ID([]byte(key)), hash)
+}
+
+// NewQueryPeersetForID creates a new empty set of peers, ordered by their
+// distance to the keyspace point id. hash maps the peer IDs into the
+// keyspace, a nil hash being sha256.
+func NewQueryPeersetForID(id []byte, hash func([]byte) []byte) *QueryPeerset {
 	return &QueryPeerset{
-		key:    ks.XORKeySpace.Key([]byte(key)),
+		target: id,
+		hash:   internal.KeyspaceHash(hash),
 		all:    []queryPeerState{},
+		index:  make(map[peer.ID]int),
 		sorted: false,
 	}
 }
 
 func (qp *QueryPeerset) find(p peer.ID) int {
-	for i := range qp.all {
-		if qp.all[i].id == p {
-			return i
-		}
+	if i, ok := qp.index[p]; ok {
+		return i
 	}
 	return -1
 }
 
-func (qp *QueryPeerset) distanceToKey(p peer.ID) *big.Int {
-	return ks.XORKeySpace.Key([]byte(p)).Distance(qp.key)
+func (qp *QueryPeerset) distanceToKey(p peer.ID) []byte {
+	return qp.hash.Distance([]byte(p), qp.target)
 }
 
 // TryAdd adds the peer p to the peer set.
@@ -87,12 +113,14 @@ func (qp *QueryPeerset) distanceToKey(p peer.ID) *big.Int {
 func (qp *QueryPeerset) TryAdd(p, referredBy peer.ID) bool {
 	if qp.find(p) >= 0 {
 		return false
-	} else {
-		qp.all = append(qp.all,
-			queryPeerState{id: p, distance: qp.distanceToKey(p), state: PeerHeard, referredBy: referredBy})
-		qp.sorted = false
-		return true
 	}
+	qp.index[p] = len(qp.all)
+	qp.order = append(qp.order, len(qp.all))
+	qp.all = append(qp.all,
+		queryPeerState{id: p, distance: qp.distanceToKey(p), state: PeerHeard, referredBy: referredBy})
+	qp.counts[PeerHeard]++
+	qp.sorted = false
+	return true
 }
 
 func (qp *QueryPeerset) sort() {
@@ -106,7 +134,10 @@ func (qp *QueryPeerset) sort() {
 // SetState sets the state of peer p to s.
 // If p is not in the peerset, SetState panics.
 func (qp *QueryPeerset) SetState(p peer.ID, s PeerState) {
-	qp.all[qp.find(p)].state = s
+	e := &qp.all[qp.find(p)]
+	qp.counts[e.state]--
+	qp.counts[s]++
+	e.state = s
 }
 
 // GetState returns the state of peer p.
@@ -121,24 +152,30 @@ func (qp *QueryPeerset) GetReferrer(p peer.ID) peer.ID {
 	return qp.all[qp.find(p)].referredBy
 }
 
+// GetDistance returns the XOR distance of peer p to the key, in the keyspace.
+// If p is not in the peerset, GetDistance panics.
+func (qp *QueryPeerset) GetDistance(p peer.ID) []byte {
+	return qp.all[qp.find(p)].distance
+}
+
 // GetClosestNInStates returns the closest to the key peers, which are in one of the given states.
 // It returns n peers or less, if fewer peers meet the condition.
 // The returned peers are sorted in ascending order by their distance to the key.
 func (qp *QueryPeerset) GetClosestNInStates(n int, states ...PeerState) (result []peer.ID) {
 	qp.sort()
-	m := make(map[PeerState]struct{}, len(states))
-	for i := range states {
-		m[states[i]] = struct{}{}
+	var mask uint
+	for _, s := range states {
+		mask |= 1 << uint(s)
 	}
 
-	for _, p := range qp.all {
-		if _, ok := m[p.state]; ok {
+	for _, i := range qp.order {
+		if len(result) == n {
+			break
+		}
+		if p := &qp.all[i]; mask&(1<<uint(p.state)) != 0 {
 			result = append(result, p.id)
 		}
 	}
-	if len(result) >= n {
-		return result[:n]
-	}
 	return result
 }
 
@@ -150,10 +187,10 @@ func (qp *QueryPeerset) GetClosestInStates(states ...PeerState) (result []peer.I
 
 // NumHeard returns the number of peers in state PeerHeard.
 func (qp *QueryPeerset) NumHeard() int {
-	return len(qp.GetClosestInStates(PeerHeard))
+	return qp.counts[PeerHeard]
 }
 
 // NumWaiting returns the number of peers in state PeerWaiting.
 func (qp *QueryPeerset) NumWaiting() int {
-	return len(qp.GetClosestInStates(PeerWaiting))
+	return qp.counts[PeerWaiting]
 }
@@ -84,3 +84,31 @@ func TestQPeerSet(t *testing.T) {
 	require.Equal(t, []peer.ID{peer3, peer1}, qp.GetClosestInStates(PeerHeard))
 	require.Equal(t, 2, qp.NumHeard())
 }
+
+func BenchmarkQueryPeerset(b *testing.B) {
+	peers := make([]peer.ID, 200)
+	for i := range peers {
+		peers[i] = test.RandPeerIDFatal(b)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// a lookup hearing of 20 peers from every peer it queries, 3 at a time
+	for i := 0; i < b.N; i++ {
+		qp := NewQueryPeerset("key")
+		for j := 0; j < len(peers); j += 20 {
+			for _, p := range peers[j : j+20] {
+				qp.TryAdd(p, peers[0])
+			}
+			for _, p := range qp.GetClosestNInStates(3-qp.NumWaiting(), PeerHeard) {
+				qp.SetState(p, PeerWaiting)
+			}
+			for _, p := range qp.GetClosestInStates(PeerWaiting) {
+				if qp.GetState(p) == PeerWaiting {
+					qp.SetState(p, PeerQueried)
+				}
+			}
+			_ = qp.NumHeard()
+		}
+	}
+}
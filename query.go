@@ -3,7 +3,6 @@ package dht
 import (
 	"context"
 	"errors"
-	"fmt"
 	"math"
 	"sync"
 	"time"
@@ -49,18 +48,27 @@ type query struct {
 	// queryPeers is the set of peers known by this query and their respective states.
 	queryPeers *qpeerset.QueryPeerset
 
-	// terminated is set when the first worker thread encounters the termination condition.
-	// Its role is to make sure that once termination is determined, it is sticky.
-	terminated bool
+	// state drives the lookup over queryPeers.
+	state *lookupState
 
-	// waitGroup ensures lookup does not end until all query goroutines complete.
+	// waitGroup ensures lookup does not end until all the requests sent to the query workers complete.
 	waitGroup sync.WaitGroup
 
 	// the function that will be used to query a single peer.
 	queryFn queryFn
 
-	// stopFn is used to determine if we should stop the WHOLE disjoint query.
-	stopFn stopFn
+	// limiter bounds the outbound requests of this query against the ones
+	// of every other query.
+	limiter *outboundLimiterQuery
+
+	// memory is the share of the lookup memory budget charged to this query.
+	memory *lookupCharge
+
+	// resultSize is the number of closest peers the query returns.
+	resultSize int
+	// storage is set if the result is the peers a record is stored on,
+	// which leaves the observers out.
+	storage bool
 }
 
 type lookupWithFollowupResult struct {
@@ -81,14 +89,30 @@ type lookupWithFollowupResult struct {
 // After the lookup is complete the query function is run (unless stopped) against all of the top K peers from the
 // lookup that have not already been successfully queried.
 func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+	if s, ok := shardFromContext(ctx); ok {
+		// peers outside of the shard only route the lookup
+		queryFn = dht.shardQueryFn(s, queryFn, dht.pmGetClosestPeers(target))
+	}
+	if path, ok := lookupPathFromContext(ctx); ok {
+		queryFn = path.queryFn(queryFn)
+	}
+	return dht.runLookupWithFollowupToID(ctx, target, dht.kadKey(target), queryFn, stopFn)
+}
+
+// runLookupWithFollowupToID is runLookupWithFollowup for a lookup converging
+// to the keyspace point targetKadID rather than to the hash of target.
+func (dht *IpfsDHT) runLookupWithFollowupToID(ctx context.Context, target string, targetKadID kb.ID, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
 	ctx, span := internal.StartSpan(ctx, "IpfsDHT.RunLookupWithFollowup", trace.WithAttributes(internal.KeyAsAttribute("Target", target)))
 	defer span.End()
 
 	// run the query
-	lookupRes, qps, err := dht.runQuery(ctx, target, queryFn, stopFn)
+	lookupRes, qps, err := dht.runQuery(ctx, target, targetKadID, queryFn, stopFn)
 	if err != nil {
 		return nil, err
 	}
+	if s, ok := shardFromContext(ctx); ok {
+		dht.filterShard(s, lookupRes)
+	}
 
 	// query all of the top K peers we've either Heard about or have outstanding queries we're Waiting on.
 	// This ensures that all of the top K results have been queried which adds to resiliency against churn for query
@@ -114,12 +138,17 @@ func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, qu
 	doneCh := make(chan struct{}, len(queryPeers))
 	followUpCtx, cancelFollowUp := context.WithCancel(ctx)
 	defer cancelFollowUp()
+	limiter := dht.outboundLimiter.Load().register()
+	defer limiter.close()
 	for _, p := range queryPeers {
 		qp := p
-		go func() {
-			_, _ = queryFn(followUpCtx, qp)
+		dht.queryWorkers.submit(func() {
+			if limiter.acquire(followUpCtx) == nil {
+				_, _ = queryFn(followUpCtx, qp)
+				limiter.release()
+			}
 			doneCh <- struct{}{}
-		}()
+		})
 	}
 
 	// wait for all queries to complete before returning, aborting ongoing queries if we've been externally stopped
@@ -152,13 +181,23 @@ processFollowUp:
 	return lookupRes, nil
 }
 
-func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, *qpeerset.QueryPeerset, error) {
+func (dht *IpfsDHT) runQuery(ctx context.Context, target string, targetKadID kb.ID, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, *qpeerset.QueryPeerset, error) {
 	ctx, span := internal.StartSpan(ctx, "IpfsDHT.RunQuery")
 	defer span.End()
 
 	// pick the K closest peers to the key in our Routing table.
-	targetKadID := kb.ConvertKey(target)
 	seedPeers := dht.routingTable.NearestPeers(targetKadID, dht.bucketSize)
+	// and the closest ones the background crawl found, if any.
+	seedPeers = dht.crawl.seed(targetKadID, seedPeers, dht.bucketSize)
+	if path, ok := lookupPathFromContext(ctx); ok && len(seedPeers) > 0 {
+		if seedPeers = path.seeds(seedPeers); len(seedPeers) == 0 {
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type:  routing.QueryError,
+				Extra: ErrTooFewPeersForPaths.Error(),
+			})
+			return nil, nil, ErrTooFewPeersForPaths
+		}
+	}
 	if len(seedPeers) == 0 {
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
@@ -167,24 +206,48 @@ func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn
 		return nil, nil, kb.ErrLookupFailure
 	}
 
+	// wait for the lookup to fit in the memory budget, its requests in flight
+	// being charged upfront and its peers as they are heard of
+	memory, err := dht.lookupMemory.admit(ctx, int64(dht.alpha)*lookupRequestMemory)
+	if err != nil {
+		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+			Type:  routing.QueryError,
+			Extra: err.Error(),
+		})
+		return nil, nil, err
+	}
+	defer memory.release()
+
 	q := &query{
 		id:         uuid.New(),
 		key:        target,
 		ctx:        ctx,
 		dht:        dht,
-		queryPeers: qpeerset.NewQueryPeerset(target),
+		queryPeers: qpeerset.NewQueryPeersetForID(targetKadID, dht.keyspaceHash),
 		seedPeers:  seedPeers,
 		peerTimes:  make(map[peer.ID]time.Duration),
-		terminated: false,
 		queryFn:    queryFn,
-		stopFn:     stopFn,
+		limiter:    dht.outboundLimiter.Load().register(),
+		memory:     memory,
+		resultSize: dht.lookupSize(ctx),
+		storage:    isStorageLookup(ctx),
+	}
+	q.state = &lookupState{
+		self:   dht.self,
+		peers:  q.queryPeers,
+		alpha:  dht.alpha,
+		beta:   dht.beta,
+		stopFn: stopFn,
+		rank:   q.rankQueryCandidates,
 	}
 
 	// run the query
 	q.run()
+	q.limiter.close()
 
 	if ctx.Err() == nil {
 		q.recordValuablePeers()
+		dht.churn.lookupDone(q.queryPeers)
 	}
 
 	res := q.constructLookupResult(targetKadID)
@@ -200,18 +263,19 @@ func (q *query) recordPeerIsValuable(p peer.ID) {
 
 func (q *query) recordValuablePeers() {
 	// Valuable peers algorithm:
-	// Label the seed peer that responded to a query in the shortest amount of time as the "most valuable peer" (MVP)
+	// Label the seed peer that responded to a query in the shortest amount of time as the "most valuable peer" (MVP),
+	// preferring the average RTT shared through the peerstore to the duration of this single query
 	// Each seed peer that responded to a query within some range (i.e. 2x) of the MVP's time is a valuable peer
 	// Mark the MVP and all the other valuable peers as valuable
 	mvpDuration := time.Duration(math.MaxInt64)
 	for _, p := range q.seedPeers {
-		if queryTime, ok := q.peerTimes[p]; ok && queryTime < mvpDuration {
+		if queryTime, ok := q.peerLatency(p); ok && queryTime < mvpDuration {
 			mvpDuration = queryTime
 		}
 	}
 
 	for _, p := range q.seedPeers {
-		if queryTime, ok := q.peerTimes[p]; ok && queryTime < mvpDuration*2 {
+		if queryTime, ok := q.peerLatency(p); ok && queryTime < mvpDuration*2 {
 			q.recordPeerIsValuable(p)
 		}
 	}
@@ -225,27 +289,34 @@ func (q *query) constructLookupResult(target kb.ID) *lookupWithFollowupResult {
 	// Lookup and starvation are both valid ways for a lookup to complete. (Starvation does not imply failure.)
 	// Lookup termination (as defined in isLookupTermination) is not possible in small networks.
 	// Starvation is a successful query termination in small networks.
-	if !(q.isLookupTermination() || q.isStarvationTermination()) {
+	if !(q.state.isLookupTermination() || q.state.isStarvationTermination()) {
 		completed = false
 	}
 
 	// extract the top K not unreachable peers
 	var peers []peer.ID
 	peerState := make(map[peer.ID]qpeerset.PeerState)
-	qp := q.queryPeers.GetClosestNInStates(q.dht.bucketSize, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
+	qp := q.queryPeers.GetClosestInStates(qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
 	for _, p := range qp {
+		if len(peers) == q.resultSize {
+			break
+		}
+		// observers route the lookup, but reject the records stored on them
+		if q.storage && q.dht.IsObserver(p) {
+			continue
+		}
 		state := q.queryPeers.GetState(p)
 		peerState[p] = state
 		peers = append(peers, p)
 	}
 
 	// get the top K overall peers
-	sortedPeers := kb.SortClosestPeers(peers, target)
-	if len(sortedPeers) > q.dht.bucketSize {
-		sortedPeers = sortedPeers[:q.dht.bucketSize]
+	sortedPeers := q.dht.keyspaceHash.SortClosestPeers(peers, target)
+	if len(sortedPeers) > q.resultSize {
+		sortedPeers = sortedPeers[:q.resultSize]
 	}
 
-	closest := q.queryPeers.GetClosestNInStates(q.dht.bucketSize, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried, qpeerset.PeerUnreachable)
+	closest := q.queryPeers.GetClosestNInStates(q.resultSize, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried, qpeerset.PeerUnreachable)
 
 	// return the top K not unreachable peers as well as their states at the end of the query
 	res := &lookupWithFollowupResult{
@@ -271,6 +342,9 @@ type queryUpdate struct {
 	queryDuration time.Duration
 }
 
+// run is the coordinator loop of the query. It is the only goroutine touching
+// the lookup state: it applies the outcome of every request as it comes in,
+// and hands the requests the state schedules over to the query workers.
 func (q *query) run() {
 	ctx, span := internal.StartSpan(q.ctx, "IpfsDHT.Query.Run")
 	defer span.End()
@@ -278,9 +352,9 @@ func (q *query) run() {
 	pathCtx, cancelPath := context.WithCancel(ctx)
 	defer cancelPath()
 
-	alpha := q.dht.alpha
-
-	ch := make(chan *queryUpdate, alpha)
+	// at most alpha requests are in flight, so that the workers never block
+	// on reporting their outcome
+	ch := make(chan *queryUpdate, q.dht.alpha)
 	ch <- &queryUpdate{cause: q.dht.self, heard: q.seedPeers}
 
 	// return only once all outstanding queries have completed.
@@ -295,29 +369,21 @@ func (q *query) run() {
 			q.terminate(pathCtx, cancelPath, LookupCancelled)
 		}
 
-		// calculate the maximum number of queries we could be spawning.
-		// Note: NumWaiting will be updated in spawnQuery
-		maxNumQueriesToSpawn := alpha - q.queryPeers.NumWaiting()
-
-		// termination is triggered on end-of-lookup conditions or starvation of unused peers
-		// it also returns the peers we should query next for a maximum of `maxNumQueriesToSpawn` peers.
-		ready, reason, qPeers := q.isReadyToTerminate(pathCtx, maxNumQueriesToSpawn)
-		if ready {
-			q.terminate(pathCtx, cancelPath, reason)
-		}
-
-		if q.terminated {
+		// termination is triggered on end-of-lookup conditions or starvation of unused peers,
+		// otherwise the state returns the peers to query next.
+		step := q.state.next()
+		if step.done {
+			q.terminate(pathCtx, cancelPath, step.reason)
 			return
 		}
 
-		// try spawning the queries, if there are no available peers to query then we won't spawn them
-		for _, p := range qPeers {
+		for _, p := range step.query {
 			q.spawnQuery(pathCtx, cause, p, ch)
 		}
 	}
 }
 
-// spawnQuery starts one query, if an available heard peer is found
+// spawnQuery sends a request to a peer the lookup state moved to waiting.
 func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID, ch chan<- *queryUpdate) {
 	ctx, span := internal.StartSpan(ctx, "IpfsDHT.SpawnQuery", trace.WithAttributes(
 		attribute.String("Cause", cause.String()),
@@ -326,11 +392,13 @@ func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID
 	defer span.End()
 
 	PublishLookupEvent(ctx,
-		NewLookupEvent(
+		newLookupEvent(
+			q.dht.keyspaceHash,
 			q.dht.self,
 			q.id,
 			q.key,
-			NewLookupUpdateEvent(
+			newLookupUpdateEvent(
+				q.dht.keyspaceHash,
 				cause,
 				q.queryPeers.GetReferrer(queryPeer),
 				nil,                  // heard
@@ -342,64 +410,21 @@ func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID
 			nil,
 		),
 	)
-	q.queryPeers.SetState(queryPeer, qpeerset.PeerWaiting)
 	q.waitGroup.Add(1)
-	go q.queryPeer(ctx, ch, queryPeer)
-}
-
-func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool, LookupTerminationReason, []peer.ID) {
-	// give the application logic a chance to terminate
-	if q.stopFn(q.queryPeers) {
-		return true, LookupStopped, nil
-	}
-	if q.isStarvationTermination() {
-		return true, LookupStarvation, nil
-	}
-	if q.isLookupTermination() {
-		return true, LookupCompleted, nil
-	}
-
-	// The peers we query next should be ones that we have only Heard about.
-	var peersToQuery []peer.ID
-	peers := q.queryPeers.GetClosestInStates(qpeerset.PeerHeard)
-	count := 0
-	for _, p := range peers {
-		peersToQuery = append(peersToQuery, p)
-		count++
-		if count == nPeersToQuery {
-			break
-		}
-	}
-
-	return false, -1, peersToQuery
-}
-
-// From the set of all nodes that are not unreachable,
-// if the closest beta nodes are all queried, the lookup can terminate.
-func (q *query) isLookupTermination() bool {
-	peers := q.queryPeers.GetClosestNInStates(q.dht.beta, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
-	for _, p := range peers {
-		if q.queryPeers.GetState(p) != qpeerset.PeerQueried {
-			return false
-		}
-	}
-	return true
-}
-
-func (q *query) isStarvationTermination() bool {
-	return q.queryPeers.NumHeard() == 0 && q.queryPeers.NumWaiting() == 0
+	q.dht.queryWorkers.submit(func() { q.queryPeer(ctx, ch, queryPeer) })
 }
 
 func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason LookupTerminationReason) {
 	ctx, span := internal.StartSpan(ctx, "IpfsDHT.Query.Terminate", trace.WithAttributes(attribute.Stringer("Reason", reason)))
 	defer span.End()
 
-	if q.terminated {
+	if q.state.terminated {
 		return
 	}
 
 	PublishLookupEvent(ctx,
-		NewLookupEvent(
+		newLookupEvent(
+			q.dht.keyspaceHash,
 			q.dht.self,
 			q.id,
 			q.key,
@@ -409,7 +434,7 @@ func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason
 		),
 	)
 	cancel() // abort outstanding queries
-	q.terminated = true
+	q.state.terminated = true
 }
 
 // queryPeer queries a single peer and reports its findings on the channel.
@@ -422,11 +447,32 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 
 	dialCtx, queryCtx := ctx, ctx
 
+	// the peer may have dropped the DHT protocol since we heard about it
+	if q.dht.stoppedDHT(p) {
+		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+		return
+	}
+
+	// wait for an outbound slot shared with the other queries
+	if err := q.limiter.acquire(ctx); err != nil {
+		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+		return
+	}
+	defer q.limiter.release()
+
+	// don't wait on a peer that keeps failing, the failures that opened its
+	// breaker already evicted it, nor on a banned one
+	if q.dht.breakers.isOpen(p) || q.dht.bans.banned(p) {
+		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+		return
+	}
+
 	// dial the peer
 	if err := q.dht.dialPeer(dialCtx, p); err != nil {
 		// remove the peer if there was a dial failure..but not because of a context cancellation
-		if dialCtx.Err() == nil {
-			q.dht.peerStoppedDHT(p)
+		// or because we refrained from dialing it
+		if dialCtx.Err() == nil && !errors.Is(err, errNoNewDials) && !errors.Is(err, errDialBackoff) {
+			q.dht.peerStoppedDHT(p, evictDialFailed)
 		}
 		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
 		return
@@ -436,8 +482,8 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 	// send query RPC to the remote peer
 	newPeers, err := q.queryFn(queryCtx, p)
 	if err != nil {
-		if queryCtx.Err() == nil {
-			q.dht.peerStoppedDHT(p)
+		if queryCtx.Err() == nil && !errors.Is(err, errCircuitOpen) && !errors.Is(err, ErrSendVetoed) && !errors.Is(err, errOtherLookupPath) {
+			q.dht.peerStoppedDHT(p, evictQueryFailed)
 		}
 		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
 		return
@@ -452,7 +498,7 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 	saw := []peer.ID{}
 	for _, next := range newPeers {
 		if next.ID == q.dht.self { // don't add self.
-			logger.Debugf("PEERS CLOSER -- worker for: %v found self", p)
+			q.dht.requestLogger(ctx).Debugf("PEERS CLOSER -- worker for: %v found self", p)
 			continue
 		}
 
@@ -465,6 +511,9 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 		// add the next peer to the query if matches the query target even if it would otherwise fail the query filter
 		// TODO: this behavior is really specific to how FindPeer works and not GetClosestPeers or any other function
 		isTarget := string(next.ID) == q.key
+		if !isTarget && (q.dht.stoppedDHT(next.ID) || q.dht.bans.banned(next.ID)) {
+			continue
+		}
 		if isTarget || q.dht.queryPeerFilter(q.dht, *next) {
 			q.dht.maybeAddAddrs(next.ID, next.Addrs, pstore.TempAddrTTL)
 			saw = append(saw, next.ID)
@@ -475,16 +524,15 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 }
 
 func (q *query) updateState(ctx context.Context, up *queryUpdate) {
-	if q.terminated {
-		panic("update should not be invoked after the logical lookup termination")
-	}
 	PublishLookupEvent(ctx,
-		NewLookupEvent(
+		newLookupEvent(
+			q.dht.keyspaceHash,
 			q.dht.self,
 			q.id,
 			q.key,
 			nil,
-			NewLookupUpdateEvent(
+			newLookupUpdateEvent(
+				q.dht.keyspaceHash,
 				up.cause,
 				up.cause,
 				up.heard,       // heard
@@ -495,32 +543,10 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 			nil,
 		),
 	)
-	for _, p := range up.heard {
-		if p == q.dht.self { // don't add self.
-			continue
-		}
-		q.queryPeers.TryAdd(p, up.cause)
-	}
+	q.memory.add(int64(q.state.apply(up)) * lookupPeerMemory)
 	for _, p := range up.queried {
-		if p == q.dht.self { // don't add self.
-			continue
-		}
-		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
-			q.queryPeers.SetState(p, qpeerset.PeerQueried)
+		if p != q.dht.self {
 			q.peerTimes[p] = up.queryDuration
-		} else {
-			panic(fmt.Errorf("kademlia protocol error: tried to transition to the queried state from state %v", st))
-		}
-	}
-	for _, p := range up.unreachable {
-		if p == q.dht.self { // don't add self.
-			continue
-		}
-
-		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
-			q.queryPeers.SetState(p, qpeerset.PeerUnreachable)
-		} else {
-			panic(fmt.Errorf("kademlia protocol error: tried to transition to the unreachable state from state %v", st))
 		}
 	}
 }
@@ -534,23 +560,40 @@ func (dht *IpfsDHT) dialPeer(ctx context.Context, p peer.ID) error {
 		return nil
 	}
 
-	logger.Debug("not connected. dialing.")
+	if dht.connPreference == ConnectedPeersOnly {
+		return errNoNewDials
+	}
+
+	if dht.dialBackoff != nil && dht.dialBackoff.BackedOff(p) {
+		dht.requestLogger(ctx).Debugf("not dialing %s: %s", p, errDialBackoff)
+		return errDialBackoff
+	}
+
+	dht.requestLogger(ctx).Debug("not connected. dialing.")
 	routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 		Type: routing.DialingPeer,
 		ID:   p,
 	})
 
 	pi := peer.AddrInfo{ID: p}
+	start := time.Now()
 	if err := dht.host.Connect(ctx, pi); err != nil {
-		logger.Debugf("error connecting: %s", err)
+		dht.requestLogger(ctx).Debugf("error connecting: %s", err)
+		dht.reportDialFailure(ctx, p, time.Since(start), err)
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
 			Extra: err.Error(),
 			ID:    p,
 		})
 
+		if ctx.Err() == nil && dht.dialBackoff != nil {
+			dht.dialBackoff.DialFailed(p)
+		}
 		return err
 	}
-	logger.Debugf("connected. dial success.")
+	if dht.dialBackoff != nil {
+		dht.dialBackoff.DialSucceeded(p)
+	}
+	dht.requestLogger(ctx).Debugf("connected. dial success.")
 	return nil
 }
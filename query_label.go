@@ -0,0 +1,22 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// WithQueryLabel attaches an application label (e.g. "bitswap" or
+// "ipns-resolve") to the context. Routing calls made with the returned context
+// tag their outbound RPC metrics with the "query_label" attribute and their
+// trace spans with the "QueryLabel" attribute, so a node serving multiple
+// subsystems can attribute DHT load.
+func WithQueryLabel(ctx context.Context, label string) context.Context {
+	return internal.WithQueryLabel(ctx, label)
+}
+
+// QueryLabel returns the application label attached to the context with
+// WithQueryLabel, or the empty string.
+func QueryLabel(ctx context.Context) string {
+	return internal.QueryLabel(ctx)
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// The global meter and tracer providers only take effect once, so the tests
+// share them.
+var (
+	testTelemetryOnce sync.Once
+	testMetricReader  *sdkmetric.ManualReader
+	testSpans         *tracetest.SpanRecorder
+)
+
+func setupTestTelemetry() {
+	testTelemetryOnce.Do(func() {
+		testMetricReader = sdkmetric.NewManualReader()
+		otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(testMetricReader)))
+		testSpans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(labeledSampler{}),
+			sdktrace.WithSpanProcessor(testSpans),
+		))
+	})
+}
+
+// labeledSampler only samples the spans carrying a query label, so that the
+// other tests don't pay for recording theirs.
+type labeledSampler struct{}
+
+func (labeledSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, kv := range p.Attributes {
+		if kv.Key == "QueryLabel" {
+			return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample}
+		}
+	}
+	return sdktrace.SamplingResult{Decision: sdktrace.Drop}
+}
+
+func (labeledSampler) Description() string { return "labeledSampler" }
+
+// counterValue returns the sum of the data points of the counter name that
+// carry all of attrs.
+func counterValue(t *testing.T, name string, attrs ...attribute.KeyValue) int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, testMetricReader.Collect(context.Background(), &rm))
+	var sum int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			data, ok := m.Data.(metricdata.Sum[int64])
+			require.True(t, ok, "%s is not an int64 counter", name)
+		points:
+			for _, dp := range data.DataPoints {
+				for _, kv := range attrs {
+					if v, ok := dp.Attributes.Value(kv.Key); !ok || v != kv.Value {
+						continue points
+					}
+				}
+				sum += dp.Value
+			}
+		}
+	}
+	return sum
+}
+
+func TestQueryLabel(t *testing.T) {
+	setupTestTelemetry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false)
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	labeled := func() int64 {
+		return counterValue(t, "libp2p.io/dht/kad/sent_requests",
+			attribute.String(metrics.KeyQueryLabel, "test-query-label"),
+			attribute.String(metrics.KeyMessageType, "FIND_NODE"))
+	}
+	before := labeled()
+
+	_, err := d1.GetClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, before, labeled(), "an unlabeled request was counted with the label")
+
+	lctx := WithQueryLabel(ctx, "test-query-label")
+	require.Equal(t, "test-query-label", QueryLabel(lctx))
+	_, err = d1.GetClosestPeers(lctx, "key")
+	require.NoError(t, err)
+	require.Greater(t, labeled(), before)
+
+	spanLabeled := false
+	for _, s := range testSpans.Ended() {
+		for _, kv := range s.Attributes() {
+			if kv == attribute.String("QueryLabel", "test-query-label") {
+				spanLabeled = true
+			}
+		}
+	}
+	require.True(t, spanLabeled, "no span carries the query label")
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"context"
+	"sync"
+)
+
+// outboundLimiter bounds the number of simultaneous outbound query RPCs
+// (including the dials they require) across all the lookups of a DHT
+// instance. Slots are shared fairly: while several lookups are running, each
+// of them may hold at most its fair share of the limit, so a single large
+// lookup cannot starve the others.
+//
+// A nil *outboundLimiter does not limit anything.
+type outboundLimiter struct {
+	limit int
+
+	mu      sync.Mutex
+	inUse   int
+	queries int
+	// changed is closed (and replaced) every time a slot is released or the
+	// set of registered lookups changes.
+	changed chan struct{}
+}
+
+func newOutboundLimiter(limit int) *outboundLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &outboundLimiter{limit: limit, changed: make(chan struct{})}
+}
+
+// register adds a new lookup sharing the limiter. The returned handle must be
+// closed once the lookup is done.
+func (l *outboundLimiter) register() *outboundLimiterQuery {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	l.queries++
+	l.notifyLocked()
+	l.mu.Unlock()
+	return &outboundLimiterQuery{l: l}
+}
+
+func (l *outboundLimiter) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// shareLocked returns the number of slots a single lookup may hold.
+func (l *outboundLimiter) shareLocked() int {
+	if l.queries <= 1 {
+		return l.limit
+	}
+	return (l.limit + l.queries - 1) / l.queries
+}
+
+// outboundLimiterQuery is the handle a single lookup uses to acquire slots
+// from the outboundLimiter.
+type outboundLimiterQuery struct {
+	l     *outboundLimiter
+	inUse int
+}
+
+// acquire blocks until the lookup may issue one more outbound request or the
+// context is cancelled.
+func (q *outboundLimiterQuery) acquire(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	l := q.l
+	for {
+		l.mu.Lock()
+		if l.inUse < l.limit && q.inUse < l.shareLocked() {
+			l.inUse++
+			q.inUse++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// saturated reports whether all the slots are in use.
+func (l *outboundLimiter) saturated() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inUse >= l.limit
+}
+
+// release returns a slot obtained with acquire.
+func (q *outboundLimiterQuery) release() {
+	if q == nil {
+		return
+	}
+	l := q.l
+	l.mu.Lock()
+	l.inUse--
+	q.inUse--
+	l.notifyLocked()
+	l.mu.Unlock()
+}
+
+// close unregisters the lookup from the limiter.
+func (q *outboundLimiterQuery) close() {
+	if q == nil {
+		return
+	}
+	l := q.l
+	l.mu.Lock()
+	l.queries--
+	l.notifyLocked()
+	l.mu.Unlock()
+}
@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboundLimiterFairShare(t *testing.T) {
+	ctx := context.Background()
+	l := newOutboundLimiter(4)
+
+	q1 := l.register()
+	defer q1.close()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, q1.acquire(ctx))
+	}
+
+	// the limit is exhausted
+	q2 := l.register()
+	defer q2.close()
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q2.acquire(tctx), context.DeadlineExceeded)
+
+	// once q1 gives back its slots, it may not take more than its fair share
+	acquired := make(chan struct{})
+	go func() {
+		_ = q2.acquire(ctx)
+		_ = q2.acquire(ctx)
+		close(acquired)
+	}()
+	q1.release()
+	q1.release()
+	<-acquired
+
+	q1.release()
+	require.NoError(t, q1.acquire(ctx))
+	tctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q1.acquire(tctx), context.DeadlineExceeded)
+}
+
+func TestOutboundLimiterDisabled(t *testing.T) {
+	l := newOutboundLimiter(0)
+	require.Nil(t, l)
+	q := l.register()
+	require.NoError(t, q.acquire(context.Background()))
+	q.release()
+	q.close()
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// lookupState is the state machine of a lookup. It is only ever touched by
+// the coordinator loop of the query (see query.run), which applies the
+// outcome of every request and asks it what to do next. It performs no I/O:
+// the requests it schedules are sent by the query workers.
+type lookupState struct {
+	self  peer.ID
+	peers *qpeerset.QueryPeerset
+
+	// alpha is the number of requests in flight, beta the number of closest
+	// peers that must have answered for the lookup to complete.
+	alpha int
+	beta  int
+
+	stopFn stopFn
+	// rank picks at most n of the heard peers, closest first, to query next.
+	rank func(heard []peer.ID, n int) []peer.ID
+
+	// terminated is sticky: once set, the lookup schedules no more requests.
+	terminated bool
+}
+
+// lookupStep is what the coordinator has to do after advancing a lookup.
+type lookupStep struct {
+	// query are the peers to send a request to. They are already waiting.
+	query []peer.ID
+	// done reports that the lookup terminated, for reason.
+	done   bool
+	reason LookupTerminationReason
+}
+
+// apply moves the peers of an update to their new state, returning the number
+// of peers added to the peer set. It panics on an invalid transition, which
+// would be a bug of the coordinator.
+func (s *lookupState) apply(up *queryUpdate) (added int) {
+	if s.terminated {
+		panic("update should not be invoked after the logical lookup termination")
+	}
+	for _, p := range up.heard {
+		if p == s.self { // don't add self.
+			continue
+		}
+		if s.peers.TryAdd(p, up.cause) {
+			added++
+		}
+	}
+	for _, p := range up.queried {
+		if p == s.self { // don't add self.
+			continue
+		}
+		if st := s.peers.GetState(p); st == qpeerset.PeerWaiting {
+			s.peers.SetState(p, qpeerset.PeerQueried)
+		} else {
+			panic(fmt.Errorf("kademlia protocol error: tried to transition to the queried state from state %v", st))
+		}
+	}
+	for _, p := range up.unreachable {
+		if p == s.self { // don't add self.
+			continue
+		}
+		if st := s.peers.GetState(p); st == qpeerset.PeerWaiting {
+			s.peers.SetState(p, qpeerset.PeerUnreachable)
+		} else {
+			panic(fmt.Errorf("kademlia protocol error: tried to transition to the unreachable state from state %v", st))
+		}
+	}
+	return added
+}
+
+// next returns the step following the last applied update: either the lookup
+// terminates, or the closest heard peers are queried up to alpha requests in
+// flight.
+func (s *lookupState) next() lookupStep {
+	if s.terminated {
+		return lookupStep{done: true, reason: LookupCancelled}
+	}
+	// give the application logic a chance to terminate
+	if s.stopFn(s.peers) {
+		return lookupStep{done: true, reason: LookupStopped}
+	}
+	if s.isStarvationTermination() {
+		return lookupStep{done: true, reason: LookupStarvation}
+	}
+	if s.isLookupTermination() {
+		return lookupStep{done: true, reason: LookupCompleted}
+	}
+
+	// The peers we query next should be ones that we have only Heard about.
+	n := s.alpha - s.peers.NumWaiting()
+	if n <= 0 {
+		return lookupStep{}
+	}
+	// the ranking only considers twice as many candidates as it picks
+	heard := s.peers.GetClosestNInStates(2*n, qpeerset.PeerHeard)
+	next := s.rank(heard, n)
+	for _, p := range next {
+		s.peers.SetState(p, qpeerset.PeerWaiting)
+	}
+	return lookupStep{query: next}
+}
+
+// From the set of all nodes that are not unreachable,
+// if the closest beta nodes are all queried, the lookup can terminate.
+func (s *lookupState) isLookupTermination() bool {
+	peers := s.peers.GetClosestNInStates(s.beta, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
+	for _, p := range peers {
+		if s.peers.GetState(p) != qpeerset.PeerQueried {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *lookupState) isStarvationTermination() bool {
+	return s.peers.NumHeard() == 0 && s.peers.NumWaiting() == 0
+}
@@ -0,0 +1,222 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+// simNetwork is a network of peers each knowing up to bucketSize peers per
+// bucket of its routing table, to drive a lookupState without I/O.
+type simNetwork struct {
+	hash        internal.KeyspaceHash
+	known       map[peer.ID][]peer.ID
+	unreachable map[peer.ID]bool
+}
+
+func newSimNetwork(n, bucketSize int) ([]peer.ID, *simNetwork) {
+	sim := &simNetwork{known: make(map[peer.ID][]peer.ID), unreachable: make(map[peer.ID]bool)}
+	peers := make([]peer.ID, n)
+	for i := range peers {
+		peers[i] = peer.ID(fmt.Sprintf("sim-peer-%d", i))
+	}
+	for _, p := range peers {
+		id := sim.hash.ID([]byte(p))
+		buckets := make(map[int]int)
+		for _, o := range peers {
+			cpl := kb.CommonPrefixLen(id, sim.hash.ID([]byte(o)))
+			if o != p && buckets[cpl] < bucketSize {
+				buckets[cpl]++
+				sim.known[p] = append(sim.known[p], o)
+			}
+		}
+	}
+	return peers, sim
+}
+
+func (sim *simNetwork) closest(peers []peer.ID, target kb.ID, n int) []peer.ID {
+	sorted := sim.hash.SortClosestPeers(append([]peer.ID(nil), peers...), target)
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// run drives a lookup for target from seeds, answering the requests in the
+// order they are scheduled.
+func (sim *simNetwork) run(t *testing.T, target kb.ID, seeds []peer.ID, alpha, beta, k int) (*qpeerset.QueryPeerset, LookupTerminationReason) {
+	qps := qpeerset.NewQueryPeersetForID(target, sim.hash)
+	s := &lookupState{
+		self:   "self",
+		peers:  qps,
+		alpha:  alpha,
+		beta:   beta,
+		stopFn: func(*qpeerset.QueryPeerset) bool { return false },
+		rank: func(heard []peer.ID, n int) []peer.ID {
+			if len(heard) > n {
+				heard = heard[:n]
+			}
+			return heard
+		},
+	}
+
+	s.apply(&queryUpdate{cause: s.self, heard: seeds})
+	var inFlight []peer.ID
+	for {
+		step := s.next()
+		if step.done {
+			// the requests still in flight are canceled
+			return qps, step.reason
+		}
+		inFlight = append(inFlight, step.query...)
+		require.LessOrEqual(t, len(inFlight), alpha)
+		require.NotEmpty(t, inFlight, "stalled lookup")
+
+		p := inFlight[0]
+		inFlight = inFlight[1:]
+		if sim.unreachable[p] {
+			s.apply(&queryUpdate{cause: p, unreachable: []peer.ID{p}})
+			continue
+		}
+		heard := sim.closest(sim.known[p], target, k)
+		s.apply(&queryUpdate{cause: p, heard: heard, queried: []peer.ID{p}})
+	}
+}
+
+func TestLookupStateConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	peers, sim := newSimNetwork(500, 8)
+	for _, i := range rng.Perm(len(peers))[:50] {
+		sim.unreachable[peers[i]] = true
+	}
+	var reachable []peer.ID
+	for _, p := range peers {
+		if !sim.unreachable[p] {
+			reachable = append(reachable, p)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		target := sim.hash.ID([]byte(fmt.Sprintf("key-%d", i)))
+		seeds := []peer.ID{peers[rng.Intn(len(peers))], peers[rng.Intn(len(peers))], peers[rng.Intn(len(peers))]}
+
+		qps, reason := sim.run(t, target, seeds, 3, 3, 20)
+		require.Equal(t, LookupCompleted, reason)
+		// the lookup ends with the closest reachable peers queried, which is
+		// what the previous goroutine per request coordinator converged to
+		require.Equal(t, sim.closest(reachable, target, 3),
+			qps.GetClosestNInStates(3, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried))
+	}
+}
+
+func TestLookupStateTermination(t *testing.T) {
+	_, sim := newSimNetwork(10, 2)
+	target := sim.hash.ID([]byte("key"))
+
+	// seeds that can't be reached starve the lookup
+	seeds := []peer.ID{"gone-1", "gone-2"}
+	for _, p := range seeds {
+		sim.unreachable[p] = true
+	}
+	qps, reason := sim.run(t, target, seeds, 3, 3, 20)
+	require.Equal(t, LookupStarvation, reason)
+	require.Empty(t, qps.GetClosestInStates(qpeerset.PeerQueried))
+
+	// the stop function is checked before scheduling requests
+	s := &lookupState{
+		self:   "self",
+		peers:  qpeerset.NewQueryPeersetForID(target, sim.hash),
+		alpha:  3,
+		beta:   3,
+		stopFn: func(qps *qpeerset.QueryPeerset) bool { return qps.NumHeard() > 1 },
+		rank:   func(heard []peer.ID, n int) []peer.ID { return heard[:min(n, len(heard))] },
+	}
+	s.apply(&queryUpdate{cause: s.self, heard: []peer.ID{"a"}})
+	step := s.next()
+	require.False(t, step.done)
+	require.Equal(t, []peer.ID{"a"}, step.query)
+	s.apply(&queryUpdate{cause: "a", heard: []peer.ID{"b", "c"}, queried: []peer.ID{"a"}})
+	step = s.next()
+	require.True(t, step.done)
+	require.Equal(t, LookupStopped, step.reason)
+
+	s.terminated = true
+	require.True(t, s.next().done)
+}
+
+func TestQueryWorkerPool(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	p := newQueryWorkerPool(2, done)
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		p.submit(func() {
+			defer wg.Done()
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		})
+	}
+	wg.Wait()
+	require.EqualValues(t, 2, maxRunning.Load())
+
+	// idle workers are reused rather than started anew
+	p = newQueryWorkerPool(0, done)
+	for i := 0; i < 10; i++ {
+		ran := make(chan struct{})
+		p.submit(func() { close(ran) })
+		<-ran
+		require.Eventually(t, func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return p.idle == 1
+		}, time.Second, time.Millisecond)
+	}
+	p.mu.Lock()
+	require.Equal(t, 1, p.running)
+	p.mu.Unlock()
+}
+
+func TestQueryWorkersLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 12, QueryWorkers(1))
+	for i := 1; i < len(dhts); i++ {
+		for j := i + 1; j < len(dhts); j++ {
+			connect(t, ctx, dhts[i], dhts[j])
+		}
+	}
+	connect(t, ctx, dhts[0], dhts[1])
+
+	// a single worker still reaches every peer of the network
+	peers, err := dhts[0].GetClosestPeers(ctx, "hello")
+	require.NoError(t, err)
+	var want []peer.ID
+	for _, d := range dhts[1:] {
+		want = append(want, d.self)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	require.Equal(t, want, peers)
+}
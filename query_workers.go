@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// queryWorkerIdleTimeout is how long an idle query worker waits for a new
+// request before exiting.
+const queryWorkerIdleTimeout = 30 * time.Second
+
+// queryWorkerPool runs the requests of the lookups on a set of long lived
+// goroutines, rather than on a new goroutine per request. Workers are
+// started on demand, up to max of them when max is positive, and exit after
+// queryWorkerIdleTimeout without work. Requests submitted while max workers
+// are busy are queued.
+//
+// submit never blocks, so that the coordinator loop of a query keeps
+// consuming the outcome of the requests it already scheduled.
+type queryWorkerPool struct {
+	max  int
+	done <-chan struct{}
+
+	// work hands a request over to an idle worker.
+	work chan func()
+
+	mu sync.Mutex
+	// running counts the workers, idle counts the ones waiting on work
+	// that no submit claimed yet.
+	running int
+	idle    int
+	queue   []func()
+}
+
+func newQueryWorkerPool(max int, done <-chan struct{}) *queryWorkerPool {
+	return &queryWorkerPool{max: max, done: done, work: make(chan func())}
+}
+
+// submit runs job on a worker.
+func (p *queryWorkerPool) submit(job func()) {
+	p.mu.Lock()
+	switch {
+	case p.idle > 0:
+		p.idle--
+		p.mu.Unlock()
+		select {
+		case p.work <- job:
+		case <-p.done:
+			// the idle workers are exiting
+			go job()
+		}
+	case p.max <= 0 || p.running < p.max:
+		p.running++
+		p.mu.Unlock()
+		go p.worker(job)
+	default:
+		p.queue = append(p.queue, job)
+		p.mu.Unlock()
+	}
+}
+
+func (p *queryWorkerPool) worker(job func()) {
+	timer := time.NewTimer(queryWorkerIdleTimeout)
+	defer timer.Stop()
+
+	for {
+		job()
+
+		p.mu.Lock()
+		if len(p.queue) > 0 {
+			job = p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			p.mu.Unlock()
+			continue
+		}
+		p.idle++
+		p.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(queryWorkerIdleTimeout)
+
+		select {
+		case job = <-p.work:
+			continue
+		case <-timer.C:
+		case <-p.done:
+		}
+
+		p.mu.Lock()
+		if p.idle == 0 {
+			// every idle worker was claimed by a submit, one of which is
+			// handing its request over to this worker, unless the pool is
+			// closed
+			p.mu.Unlock()
+			select {
+			case job = <-p.work:
+				continue
+			case <-p.done:
+			}
+			p.mu.Lock()
+		} else {
+			p.idle--
+		}
+		p.running--
+		p.mu.Unlock()
+		return
+	}
+}
+
+// saturated reports whether requests are queued, waiting for a worker.
+func (p *queryWorkerPool) saturated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue) > 0
+}
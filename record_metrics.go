@@ -0,0 +1,58 @@
+package dht
+
+import (
+	"context"
+
+	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// otherNamespace labels the records of the namespaces the validator doesn't
+// know, whose number is unbounded.
+const otherNamespace = "other"
+
+// recordNamespace returns the namespace the record metrics attribute key to.
+func (dht *IpfsDHT) recordNamespace(key string) string {
+	ns, _, err := record.SplitKey(key)
+	if err != nil {
+		return otherNamespace
+	}
+	if nsval, ok := dht.Validator.(record.NamespacedValidator); ok && nsval[ns] != nil {
+		return ns
+	}
+	return otherNamespace
+}
+
+// validateRecord validates the value of a record, counting the result.
+func (dht *IpfsDHT) validateRecord(ctx context.Context, key string, value []byte) error {
+	err := dht.Validator.Validate(key, value)
+	result := "valid"
+	if err != nil {
+		result = "invalid"
+	}
+	metrics.RecordValidations.Add(ctx, 1, metric.WithAttributes(
+		attribute.String(metrics.KeyNamespace, dht.recordNamespace(key)),
+		attribute.String("result", result),
+	), dht.protoAttr)
+	return err
+}
+
+// storeRecord writes a marshalled record to the datastore, counting it.
+func (dht *IpfsDHT) storeRecord(ctx context.Context, rec *recpb.Record, data []byte) error {
+	if err := storeRecord(ctx, dht.datastore, convertToDsKey(rec.GetKey()), rec, data); err != nil {
+		return err
+	}
+	ns := metric.WithAttributes(attribute.String(metrics.KeyNamespace, dht.recordNamespace(string(rec.GetKey()))))
+	metrics.StoredRecords.Add(ctx, 1, ns, dht.protoAttr)
+	metrics.StoredRecordBytes.Add(ctx, int64(len(data)), ns, dht.protoAttr)
+	return nil
+}
+
+// countServedRecord counts a record returned to a GET_VALUE request.
+func (dht *IpfsDHT) countServedRecord(ctx context.Context, key string) {
+	metrics.ServedRecords.Add(ctx, 1, metric.WithAttributes(attribute.String(metrics.KeyNamespace, dht.recordNamespace(key))), dht.protoAttr)
+}
@@ -27,7 +27,7 @@ func (dht *IpfsDHT) GetPublicKey(ctx context.Context, p peer.ID) (ci.PubKey, err
 		return nil, routing.ErrNotSupported
 	}
 
-	logger.Debugf("getPublicKey for: %s", p)
+	dht.requestLogger(ctx).Debugf("getPublicKey for: %s", p)
 
 	// Check locally. Will also try to extract the public key from the peer
 	// ID itself if possible (if inlined).
@@ -66,7 +66,7 @@ func (dht *IpfsDHT) GetPublicKey(ctx context.Context, p peer.ID) (ci.PubKey, err
 			// Found the public key
 			err := dht.peerstore.AddPubKey(p, r.pubk)
 			if err != nil {
-				logger.Errorw("failed to add public key to peerstore", "peer", p)
+				dht.requestLogger(ctx).Errorw("failed to add public key to peerstore", "peer", p)
 			}
 			return r.pubk, nil
 		}
@@ -88,13 +88,13 @@ func (dht *IpfsDHT) getPublicKeyFromDHT(ctx context.Context, p peer.ID) (ci.PubK
 
 	pubk, err := ci.UnmarshalPublicKey(val)
 	if err != nil {
-		logger.Errorf("Could not unmarshal public key retrieved from DHT for %v", p)
+		dht.requestLogger(ctx).Errorf("Could not unmarshal public key retrieved from DHT for %v", p)
 		return nil, err
 	}
 
 	// Note: No need to check that public key hash matches peer ID
 	// because this is done by GetValues()
-	logger.Debugf("Got public key for %s from DHT", p)
+	dht.requestLogger(ctx).Debugf("Got public key for %s from DHT", p)
 	return pubk, nil
 }
 
@@ -119,20 +119,20 @@ func (dht *IpfsDHT) getPublicKeyFromNode(ctx context.Context, p peer.ID) (ci.Pub
 
 	pubk, err := ci.UnmarshalPublicKey(record.GetValue())
 	if err != nil {
-		logger.Errorf("Could not unmarshal public key for %v", p)
+		dht.requestLogger(ctx).Errorf("Could not unmarshal public key for %v", p)
 		return nil, err
 	}
 
 	// Make sure the public key matches the peer ID
 	id, err := peer.IDFromPublicKey(pubk)
 	if err != nil {
-		logger.Errorf("Could not extract peer id from public key for %v", p)
+		dht.requestLogger(ctx).Errorf("Could not extract peer id from public key for %v", p)
 		return nil, err
 	}
 	if id != p {
 		return nil, fmt.Errorf("public key %v does not match peer %v", id, p)
 	}
 
-	logger.Debugf("Got public key from node %v itself", p)
+	dht.requestLogger(ctx).Debugf("Got public key from node %v itself", p)
 	return pubk, nil
 }
@@ -0,0 +1,284 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"github.com/multiformats/go-base32"
+)
+
+// The value records are stored at the root of the datastore, under their
+// base32 encoded key. Since the second layout, they are also indexed by the
+// time they were received at:
+//
+//	/records-index/received/<time>/<record datastore key>
+//
+// where <time> is the Unix time, in seconds, as a fixed width hexadecimal
+// number, so that the records older than the max record age are found by an
+// ordered scan of the index rather than of the whole datastore. An entry may
+// outlive its record, or the record may have been received again since, which
+// the garbage collection checks for.
+const (
+	recordsIndexPrefix    = "/records-index/"
+	recordReceivedPrefix  = recordsIndexPrefix + "received/"
+	recordsLayoutVersion  = 2
+	recordsGCInterval     = time.Hour
+	recordsMigrationBatch = 256
+)
+
+var recordsLayoutVersionKey = ds.NewKey(recordsIndexPrefix + "version")
+
+func mkRecordReceivedKey(received time.Time, dskey ds.Key) ds.Key {
+	return ds.RawKey(fmt.Sprintf("%s%016x%s", recordReceivedPrefix, received.Unix(), dskey.String()))
+}
+
+// parseRecordReceivedKey returns the receive time and the record key of a
+// received index entry.
+func parseRecordReceivedKey(dsk string) (int64, ds.Key, error) {
+	rest := strings.TrimPrefix(dsk, recordReceivedPrefix)
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return 0, ds.Key{}, fmt.Errorf("malformed record index key %q", dsk)
+	}
+	received, err := strconv.ParseInt(rest[:i], 16, 64)
+	if err != nil {
+		return 0, ds.Key{}, err
+	}
+	return received, ds.RawKey(rest[i:]), nil
+}
+
+// storeRecord writes the marshalled record to the datastore, and indexes it
+// by receive time.
+func storeRecord(ctx context.Context, dstore ds.Write, dskey ds.Key, rec *recpb.Record, data []byte) error {
+	if err := dstore.Put(ctx, dskey, data); err != nil {
+		return err
+	}
+	received, err := internal.ParseRFC3339(rec.GetTimeReceived())
+	if err != nil {
+		// records without a receive time are tossed when read
+		return nil
+	}
+	return dstore.Put(ctx, mkRecordReceivedKey(received, dskey), []byte{})
+}
+
+func recordsLayoutMigrated(ctx context.Context, dstore ds.Read) (bool, error) {
+	v, err := dstore.Get(ctx, recordsLayoutVersionKey)
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(v) == strconv.Itoa(recordsLayoutVersion), nil
+}
+
+// isRecordKey reports whether dskey is the key of a value record: a single
+// base32 segment.
+func isRecordKey(dskey string) bool {
+	if strings.Count(dskey, "/") != 1 {
+		return false
+	}
+	_, err := base32.RawStdEncoding.DecodeString(dskey[1:])
+	return err == nil
+}
+
+// parseStoredRecord returns the value record stored at dskey, and whether data
+// is one: a datastore shared with other applications may hold keys that look
+// like ours, which must be left alone.
+func parseStoredRecord(dskey ds.Key, data []byte) (*recpb.Record, bool) {
+	rec := new(recpb.Record)
+	if proto.Unmarshal(data, rec) != nil {
+		return nil, false
+	}
+	return rec, convertToDsKey(rec.GetKey()) == dskey
+}
+
+// migrateRecordsLayout indexes the value records of dstore by receive time,
+// if not done yet. The records are indexed as the datastore is scanned, in
+// batches of recordsMigrationBatch.
+func migrateRecordsLayout(ctx context.Context, dstore ds.Datastore) error {
+	if done, err := recordsLayoutMigrated(ctx, dstore); err != nil || done {
+		return err
+	}
+
+	res, err := dstore.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	// batch the index writes when the datastore supports it
+	var batch ds.Batch
+	bds, batching := dstore.(ds.Batching)
+	if batching {
+		if batch, err = bds.Batch(ctx); err != nil {
+			return err
+		}
+	}
+	put := func(k ds.Key, v []byte) error {
+		if batching {
+			return batch.Put(ctx, k, v)
+		}
+		return dstore.Put(ctx, k, v)
+	}
+	indexed := 0
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		if !isRecordKey(e.Key) {
+			continue
+		}
+		dskey := ds.RawKey(e.Key)
+		data, err := dstore.Get(ctx, dskey)
+		if err == ds.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rec, ok := parseStoredRecord(dskey, data)
+		if !ok {
+			continue
+		}
+		received, err := internal.ParseRFC3339(rec.GetTimeReceived())
+		if err != nil {
+			continue
+		}
+		if err := put(mkRecordReceivedKey(received, dskey), []byte{}); err != nil {
+			return err
+		}
+		if indexed++; batching && indexed%recordsMigrationBatch == 0 {
+			if err := batch.Commit(ctx); err != nil {
+				return err
+			}
+			if batch, err = bds.Batch(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if err := put(recordsLayoutVersionKey, []byte(strconv.Itoa(recordsLayoutVersion))); err != nil {
+		return err
+	}
+	if batching {
+		return batch.Commit(ctx)
+	}
+	return nil
+}
+
+// gcRecords deletes the records received more than maxAge before now, and
+// their index entries. Only the records indexed by the DHT are considered,
+// and only if they are still value records of the DHT.
+func gcRecords(ctx context.Context, dstore ds.Datastore, now time.Time, maxAge time.Duration) error {
+	res, err := dstore.Query(ctx, dsq.Query{
+		Prefix:   recordReceivedPrefix,
+		KeysOnly: true,
+		Orders:   []dsq.Order{dsq.OrderByKey{}},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	cutoff := now.Add(-maxAge).Unix()
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		received, dskey, err := parseRecordReceivedKey(e.Key)
+		if err == nil && received >= cutoff {
+			// the rest of the index was received later
+			return nil
+		}
+		if err == nil {
+			if err := deleteIfExpired(ctx, dstore, dskey, now, maxAge); err != nil {
+				return err
+			}
+		}
+		if err := dstore.Delete(ctx, ds.RawKey(e.Key)); err != nil && err != ds.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIfExpired deletes the record at dskey unless it was received again
+// since its index entry was written, or it isn't one of our records.
+func deleteIfExpired(ctx context.Context, dstore ds.Datastore, dskey ds.Key, now time.Time, maxAge time.Duration) error {
+	data, err := dstore.Get(ctx, dskey)
+	if err == ds.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rec, ok := parseStoredRecord(dskey, data)
+	if !ok {
+		return nil
+	}
+	if received, err := internal.ParseRFC3339(rec.GetTimeReceived()); err == nil && now.Sub(received) <= maxAge {
+		return nil
+	}
+	if err := dstore.Delete(ctx, dskey); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// runRecordsGCLoop indexes the records of a datastore written with the first
+// layout, then periodically deletes the expired records. A failed migration is
+// retried before every collection, which meanwhile only sees the records
+// indexed already.
+func (dht *IpfsDHT) runRecordsGCLoop() {
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+
+		migrated := false
+		migrate := func() {
+			if err := migrateRecordsLayout(dht.ctx, dht.datastore); err != nil {
+				dht.logger.Warnw("failed to migrate the records datastore layout", "error", err)
+				return
+			}
+			migrated = true
+		}
+		migrate()
+
+		ticker := time.NewTicker(recordsGCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !migrated {
+					migrate()
+				}
+				if err := gcRecords(dht.ctx, dht.datastore, time.Now(), dht.maxRecordAge); err != nil {
+					dht.logger.Warnw("failed to garbage collect records", "error", err)
+				}
+			case <-dht.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// MigrateDatastore migrates a datastore written by an earlier version of this
+// package to the current layout, indexing the provider records by expiry and
+// provider, and the value records by receive time. A DHT migrates its
+// datastore in the background when started; MigrateDatastore is meant for
+// migrating offline, before starting it.
+func MigrateDatastore(ctx context.Context, dstore ds.Batching) error {
+	if err := providers.MigrateLayout(ctx, dstore); err != nil {
+		return err
+	}
+	return migrateRecordsLayout(ctx, dstore)
+}
@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func putTestRecord(t *testing.T, dstore ds.Datastore, key string, received time.Time, index bool) ds.Key {
+	t.Helper()
+	rec := &recpb.Record{Key: []byte(key), Value: []byte("value"), TimeReceived: internal.FormatRFC3339(received)}
+	data, err := proto.Marshal(rec)
+	require.NoError(t, err)
+	dskey := mkDsKey(key)
+	if index {
+		require.NoError(t, storeRecord(context.Background(), dstore, dskey, rec, data))
+	} else {
+		require.NoError(t, dstore.Put(context.Background(), dskey, data))
+	}
+	return dskey
+}
+
+func TestRecordsLayoutMigrationAndGC(t *testing.T) {
+	ctx := context.Background()
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	maxAge := time.Hour
+	now := time.Now()
+
+	// records written with the first layout
+	old := putTestRecord(t, dstore, "old", now.Add(-2*maxAge), false)
+	fresh := putTestRecord(t, dstore, "fresh", now, false)
+	require.NoError(t, dstore.Put(ctx, rememberedPeersDsKey, []byte("{}")))
+	// a key of another application sharing the datastore, which looks like
+	// one of our records
+	foreign := mkDsKey("foreign")
+	data, err := proto.Marshal(&recpb.Record{Key: []byte("other"), TimeReceived: internal.FormatRFC3339(now.Add(-2 * maxAge))})
+	require.NoError(t, err)
+	require.NoError(t, dstore.Put(ctx, foreign, data))
+
+	require.NoError(t, MigrateDatastore(ctx, dstore))
+	has, _ := dstore.Has(ctx, mkRecordReceivedKey(now.Add(-2*maxAge), foreign))
+	require.False(t, has, "foreign key was indexed")
+	done, err := recordsLayoutMigrated(ctx, dstore)
+	require.NoError(t, err)
+	require.True(t, done)
+
+	// a record received again after its first index entry expired
+	again := putTestRecord(t, dstore, "again", now.Add(-2*maxAge), true)
+	putTestRecord(t, dstore, "again", now, true)
+
+	require.NoError(t, gcRecords(ctx, dstore, now, maxAge))
+	has, _ = dstore.Has(ctx, old)
+	require.False(t, has, "expired record was not collected")
+	for _, k := range []ds.Key{fresh, again, rememberedPeersDsKey, foreign} {
+		has, _ := dstore.Has(ctx, k)
+		require.True(t, has, "%s was collected", k)
+	}
+
+	// the expired index entries are gone, the live ones remain
+	for _, k := range []ds.Key{mkRecordReceivedKey(now.Add(-2*maxAge), old), mkRecordReceivedKey(now.Add(-2*maxAge), again)} {
+		has, _ := dstore.Has(ctx, k)
+		require.False(t, has, "index entry %s was not collected", k)
+	}
+	has, _ = dstore.Has(ctx, mkRecordReceivedKey(now, fresh))
+	require.True(t, has)
+}
@@ -381,3 +381,21 @@ func TestValuesDisabled(t *testing.T) {
 		})
 	}
 }
+
+func TestRecordNamespace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	for key, ns := range map[string]string{
+		"/v/hello":  "v",
+		"/pk/hello": "pk",
+		// the label set is bounded by the validator namespaces
+		"/unknown/hello": otherNamespace,
+		"hello":          otherNamespace,
+	} {
+		if got := d.recordNamespace(key); got != ns {
+			t.Errorf("namespace of %q: expected %q, got %q", key, ns, got)
+		}
+	}
+}
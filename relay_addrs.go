@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// applyRelayAddrPolicy strips or reorders the relayed addresses of a peer
+// according to the configured RelayAddrPolicy.
+func (dht *IpfsDHT) applyRelayAddrPolicy(addrs []ma.Multiaddr) []ma.Multiaddr {
+	switch dht.relayAddrPolicy {
+	case StripRelayAddrs:
+		direct := make([]ma.Multiaddr, 0, len(addrs))
+		for _, a := range addrs {
+			if !isRelayAddr(a) {
+				direct = append(direct, a)
+			}
+		}
+		return direct
+	case DeprioritizeRelayAddrs:
+		sorted := make([]ma.Multiaddr, 0, len(addrs))
+		var relayed []ma.Multiaddr
+		for _, a := range addrs {
+			if isRelayAddr(a) {
+				relayed = append(relayed, a)
+			} else {
+				sorted = append(sorted, a)
+			}
+		}
+		return append(sorted, relayed...)
+	default:
+		return addrs
+	}
+}
+
+// onlyRelayed returns true if all the connections to p or, if there are none,
+// all its known addresses are relayed.
+func (dht *IpfsDHT) onlyRelayed(p peer.ID) bool {
+	if conns := dht.host.Network().ConnsToPeer(p); len(conns) > 0 {
+		for _, c := range conns {
+			if !isRelayAddr(c.RemoteMultiaddr()) {
+				return false
+			}
+		}
+		return true
+	}
+	return onlyRelayAddrs(dht.peerstore.Addrs(p))
+}
+
+// onlyRelayAddrs returns true if addrs is not empty and only contains relayed
+// addresses.
+func onlyRelayAddrs(addrs []ma.Multiaddr) bool {
+	for _, a := range addrs {
+		if !isRelayAddr(a) {
+			return false
+		}
+	}
+	return len(addrs) > 0
+}
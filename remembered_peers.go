@@ -0,0 +1,205 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// rememberedPeersDsKey is the datastore key under which the remembered peers
+// are persisted. Record keys are base32 encoded (upper case) so this key can't
+// collide with them.
+var rememberedPeersDsKey = ds.NewKey("/bootstrap/remembered-peers")
+
+// rememberedPeersSaveInterval is the interval at which the set of remembered
+// peers is written to the datastore.
+var rememberedPeersSaveInterval = 10 * time.Minute
+
+// rememberedPeersExpiry is the time after which a remembered peer that hasn't
+// been seen in the routing table is forgotten.
+var rememberedPeersExpiry = 7 * 24 * time.Hour
+
+type rememberedPeersRecord struct {
+	Peers []peer.AddrInfo
+	// LastSeen is when the peers, keyed by their string encoding, were last
+	// seen in the routing table. The records persisted before it was tracked
+	// lack it.
+	LastSeen map[string]time.Time `json:",omitempty"`
+}
+
+// rememberedPeer is a remembered peer, with the last time it was seen in the
+// routing table.
+type rememberedPeer struct {
+	peer.AddrInfo
+	lastSeen time.Time
+}
+
+// RememberedPeers returns the set of long-lived peers that will be used as
+// fallback bootstrappers. It is empty unless the RememberPeers option is set.
+func (dht *IpfsDHT) RememberedPeers() []peer.AddrInfo {
+	dht.rememberedPeersLk.Lock()
+	defer dht.rememberedPeersLk.Unlock()
+	peers := make([]peer.AddrInfo, len(dht.rememberedPeers))
+	for i, rp := range dht.rememberedPeers {
+		peers[i] = rp.AddrInfo
+	}
+	return peers
+}
+
+// forgetRememberedPeers removes peers from the remembered peers.
+func (dht *IpfsDHT) forgetRememberedPeers(peers []peer.ID) {
+	if len(peers) == 0 {
+		return
+	}
+	forgotten := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		forgotten[p] = struct{}{}
+	}
+
+	dht.rememberedPeersLk.Lock()
+	defer dht.rememberedPeersLk.Unlock()
+	kept := dht.rememberedPeers[:0]
+	for _, rp := range dht.rememberedPeers {
+		if _, ok := forgotten[rp.ID]; !ok {
+			kept = append(kept, rp)
+		}
+	}
+	dht.rememberedPeers = kept
+}
+
+// loadRememberedPeers reads the remembered peers persisted by a previous run.
+func (dht *IpfsDHT) loadRememberedPeers(ctx context.Context) error {
+	buf, err := dht.datastore.Get(ctx, rememberedPeersDsKey)
+	if err == ds.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var rec rememberedPeersRecord
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	peers := make([]rememberedPeer, 0, len(rec.Peers))
+	for _, ai := range rec.Peers {
+		if ai.ID == dht.self || len(ai.Addrs) == 0 {
+			continue
+		}
+		lastSeen, ok := rec.LastSeen[ai.ID.String()]
+		if !ok {
+			// give the peers of older records a chance to be seen again
+			lastSeen = now
+		}
+		if now.Sub(lastSeen) > rememberedPeersExpiry {
+			continue
+		}
+		peers = append(peers, rememberedPeer{AddrInfo: ai, lastSeen: lastSeen})
+	}
+	if len(peers) > dht.rememberedPeersSize {
+		peers = peers[:dht.rememberedPeersSize]
+	}
+
+	dht.rememberedPeersLk.Lock()
+	dht.rememberedPeers = peers
+	dht.rememberedPeersLk.Unlock()
+	return nil
+}
+
+// saveRememberedPeers updates the set of remembered peers from the routing
+// table and persists it. The longest lived routing table peers come first,
+// previously remembered peers are used to fill up the remaining slots, unless
+// they haven't been seen in the routing table for rememberedPeersExpiry.
+func (dht *IpfsDHT) saveRememberedPeers(ctx context.Context) error {
+	infos := dht.routingTable.GetPeerInfos()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].AddedAt.Before(infos[j].AddedAt)
+	})
+
+	now := time.Now()
+	inTable := make(map[peer.ID]struct{}, len(infos))
+	for _, pi := range infos {
+		inTable[pi.Id] = struct{}{}
+	}
+	added := make(map[peer.ID]struct{}, dht.rememberedPeersSize)
+	peers := make([]rememberedPeer, 0, dht.rememberedPeersSize)
+	for _, pi := range infos {
+		if len(peers) == dht.rememberedPeersSize {
+			break
+		}
+		if now.Sub(pi.AddedAt) < dht.rememberedPeersMinAge {
+			// infos is sorted, every following peer is younger
+			break
+		}
+		addrs := dht.filterAddrs(dht.peerstore.Addrs(pi.Id))
+		if len(addrs) == 0 {
+			continue
+		}
+		added[pi.Id] = struct{}{}
+		peers = append(peers, rememberedPeer{AddrInfo: peer.AddrInfo{ID: pi.Id, Addrs: addrs}, lastSeen: now})
+	}
+
+	dht.rememberedPeersLk.Lock()
+	for _, rp := range dht.rememberedPeers {
+		if len(peers) == dht.rememberedPeersSize {
+			break
+		}
+		if _, ok := added[rp.ID]; ok {
+			continue
+		}
+		if _, ok := inTable[rp.ID]; ok {
+			rp.lastSeen = now
+		} else if now.Sub(rp.lastSeen) > rememberedPeersExpiry {
+			continue
+		}
+		peers = append(peers, rp)
+	}
+	dht.rememberedPeers = peers
+	dht.rememberedPeersLk.Unlock()
+
+	rec := rememberedPeersRecord{
+		Peers:    make([]peer.AddrInfo, len(peers)),
+		LastSeen: make(map[string]time.Time, len(peers)),
+	}
+	for i, rp := range peers {
+		rec.Peers[i] = rp.AddrInfo
+		rec.LastSeen[rp.ID.String()] = rp.lastSeen
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return dht.datastore.Put(ctx, rememberedPeersDsKey, buf)
+}
+
+// runRememberedPeersLoop periodically persists the remembered peers, and
+// once more when the DHT is closed.
+func (dht *IpfsDHT) runRememberedPeersLoop() {
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+
+		ticker := time.NewTicker(rememberedPeersSaveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := dht.saveRememberedPeers(dht.ctx); err != nil {
+					dht.logger.Warnw("failed to persist remembered peers", "error", err)
+				}
+			case <-dht.ctx.Done():
+				if err := dht.saveRememberedPeers(context.Background()); err != nil {
+					dht.logger.Warnw("failed to persist remembered peers", "error", err)
+				}
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"context"
+
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/multiformats/go-multihash"
+)
+
+type replicationKey struct{}
+
+// WithReplication returns a context overriding the number of closest peers
+// PutValue and Provide calls store the record with, for applications with
+// different durability needs. A Replication routing option passed to PutValue
+// takes precedence.
+func WithReplication(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, replicationKey{}, n)
+}
+
+// replicationFor returns the number of peers a record for key should be
+// stored with: the per call value if any, then the value configured for the
+// key's namespace and finally the bucket size.
+func (dht *IpfsDHT) replicationFor(ctx context.Context, key string, perCall int) int {
+	if perCall > 0 {
+		return perCall
+	}
+	if n, ok := ctx.Value(replicationKey{}).(int); ok && n > 0 {
+		return n
+	}
+	if ns, _, err := record.SplitKey(key); err == nil {
+		if n, ok := dht.nsReplication[ns]; ok {
+			return n
+		}
+	}
+	return dht.bucketSize
+}
+
+// provideReplication returns the number of peers the provider record for
+// keyMH should be stored with, raised if keyMH is in a keyspace gap.
+func (dht *IpfsDHT) provideReplication(ctx context.Context, keyMH multihash.Multihash) int {
+	n := dht.replicationFor(ctx, string(keyMH), 0)
+	if dht.inKeyspaceGap != nil && dht.inKeyspaceGap(dht.kadKey(string(keyMH))) {
+		n += dht.gapReplication
+	}
+	return n
+}
+
+type lookupSizeKey struct{}
+
+// withLookupSize returns a context making the lookups run with it return the
+// n closest peers instead of the bucket size.
+func withLookupSize(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, lookupSizeKey{}, n)
+}
+
+func (dht *IpfsDHT) lookupSize(ctx context.Context) int {
+	if n, ok := ctx.Value(lookupSizeKey{}).(int); ok && n > 0 {
+		return n
+	}
+	return dht.bucketSize
+}
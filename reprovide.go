@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// maxLedgerKeys bounds the keys whose provider record puts the provide ledger
+// remembers.
+const maxLedgerKeys = 1 << 16
+
+// ledgerProbes is the number of peers holding a fresh copy of a provider
+// record, according to the provide ledger, that a reprovide asks for the
+// record to check that the ledger can be trusted.
+const ledgerProbes = 2
+
+// provideLedger remembers when Provide stored our provider records on each of
+// the closest peers, so that reprovides skip the peers holding a fresh copy
+// (see the ReprovideMissingOnly option). A nil *provideLedger remembers
+// nothing and makes Provide store the records on all the closest peers.
+type provideLedger struct {
+	refresh time.Duration
+
+	mu sync.Mutex
+	// keys maps multihashes to the times the record was stored on each
+	// peer.
+	keys *lru.LRU
+}
+
+func newProvideLedger(refresh time.Duration) *provideLedger {
+	if refresh <= 0 {
+		return nil
+	}
+	keys, _ := lru.NewLRU(maxLedgerKeys, nil)
+	return &provideLedger{refresh: refresh, keys: keys}
+}
+
+func (l *provideLedger) stored(key multihash.Multihash, p peer.ID) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	puts, ok := l.keys.Get(string(key))
+	if !ok {
+		puts = make(map[peer.ID]time.Time)
+		l.keys.Add(string(key), puts)
+	}
+	puts.(map[peer.ID]time.Time)[p] = time.Now()
+}
+
+// fresh returns the peers among peers the record of key was stored on less
+// than refresh ago.
+func (l *provideLedger) fresh(key multihash.Multihash, peers []peer.ID) map[peer.ID]struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v, ok := l.keys.Get(string(key))
+	if !ok {
+		return nil
+	}
+	puts := v.(map[peer.ID]time.Time)
+	fresh := make(map[peer.ID]struct{})
+	for _, p := range peers {
+		if t, ok := puts[p]; ok && time.Since(t) < l.refresh {
+			fresh[p] = struct{}{}
+		}
+	}
+	// forget the puts to peers that are no longer among the closest, or
+	// that are due for a refresh anyway
+	for p := range puts {
+		if _, ok := fresh[p]; !ok {
+			delete(puts, p)
+		}
+	}
+	return fresh
+}
+
+// missingProviderPeers returns the peers among the closest peers to key that
+// Provide must store our provider record on: the ones we didn't store it on
+// recently. The ledger is trusted for the other ones as long as a sample of
+// them still holds the record according to a GET_PROVIDERS request; if one of
+// them lost it, only the peers found holding it are skipped.
+// Without the ReprovideMissingOnly option, it returns all of them.
+func (dht *IpfsDHT) missingProviderPeers(ctx context.Context, key multihash.Multihash, peers []peer.ID) []peer.ID {
+	if dht.provideLedger == nil {
+		return peers
+	}
+	fresh := dht.provideLedger.fresh(key, peers)
+	if len(fresh) == 0 {
+		return peers
+	}
+
+	probes := make([]peer.ID, 0, len(fresh))
+	for p := range fresh {
+		probes = append(probes, p)
+	}
+	rand.Shuffle(len(probes), func(i, j int) { probes[i], probes[j] = probes[j], probes[i] })
+	if len(probes) > ledgerProbes {
+		probes = probes[:ledgerProbes]
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		held = make(map[peer.ID]struct{})
+	)
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			provs, _, err := dht.protoMessenger.GetProviders(ctx, p, key)
+			if err != nil {
+				dht.requestLogger(ctx).Debugw("failed to check provider record", "key", internal.LoggableProviderRecordBytes(key), "peer", p, "error", err)
+				return
+			}
+			for _, prov := range provs {
+				if prov.ID == dht.self {
+					mu.Lock()
+					held[p] = struct{}{}
+					mu.Unlock()
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// the sampled peers all hold the record, trust the ledger for the others
+	if len(held) == len(probes) {
+		held = fresh
+	}
+
+	missing := make([]peer.ID, 0, len(peers)-len(held))
+	for _, p := range peers {
+		if _, ok := held[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	if len(held) > 0 {
+		metrics.ReprovideSkippedPeers.Add(ctx, int64(len(held)), dht.protoAttr)
+	}
+	return missing
+}
@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReprovideMissingOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false, ReprovideMissingOnly(time.Hour))
+	d2 := setupDHT(ctx, t, false)
+	connect(t, ctx, d1, d2)
+
+	provide := func() int {
+		var total int
+		pctx := WithProvideProgress(ctx, func(p ProvideProgress) {
+			if p.Phase == ProvideLookupDone {
+				total = p.Total
+			}
+		})
+		require.NoError(t, d1.Provide(pctx, testCaseCids[0], true))
+		return total
+	}
+
+	require.Equal(t, 1, provide())
+	require.Eventually(t, func() bool {
+		provs, err := d2.providerStore.GetProviders(ctx, testCaseCids[0].Hash())
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// d2 holds a fresh record
+	require.Equal(t, 0, provide())
+
+	// records stored long ago are stored again
+	d1.provideLedger.refresh = 0
+	require.Equal(t, 1, provide())
+}
+
+func TestReprovideMissingOnlyProbes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var probes atomic.Int32
+	countProbes := OnRequestHook(func(_ context.Context, _ network.Stream, req *pb.Message) {
+		if req.GetType() == pb.Message_GET_PROVIDERS {
+			probes.Add(1)
+		}
+	})
+	d := setupDHT(ctx, t, false, ReprovideMissingOnly(time.Hour))
+	servers := make([]*IpfsDHT, 4)
+	for i := range servers {
+		servers[i] = setupDHT(ctx, t, false, countProbes)
+		connect(t, ctx, d, servers[i])
+	}
+
+	provide := func(c cid.Cid) int {
+		var total int
+		pctx := WithProvideProgress(ctx, func(p ProvideProgress) {
+			if p.Phase == ProvideLookupDone {
+				total = p.Total
+			}
+		})
+		require.NoError(t, d.Provide(pctx, c, true))
+		return total
+	}
+
+	require.Equal(t, len(servers), provide(testCaseCids[0]))
+	require.Eventually(t, func() bool {
+		for _, s := range servers {
+			provs, err := s.providerStore.GetProviders(ctx, testCaseCids[0].Hash())
+			if err != nil || len(provs) != 1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// only a sample of the peers holding a fresh record are asked for it
+	probes.Store(0)
+	require.Equal(t, 0, provide(testCaseCids[0]))
+	require.EqualValues(t, ledgerProbes, probes.Load())
+
+	// the ledger isn't trusted once a sampled peer turns out to miss the
+	// record
+	for _, s := range servers {
+		d.provideLedger.stored(testCaseCids[1].Hash(), s.self)
+	}
+	require.Equal(t, len(servers), provide(testCaseCids[1]))
+}
+
+func TestReprovideMissingOnlyOption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	require.Nil(t, d.provideLedger)
+	require.Zero(t, d.Config().ReprovideRefresh)
+
+	for _, refresh := range []time.Duration{0, 100 * 24 * time.Hour} {
+		_, err := New(ctx, d.host, ReprovideMissingOnly(refresh))
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,46 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// WithRequestID attaches a request ID to the context. Routing calls generate
+// a random ID when the context has none, so this is only needed to correlate
+// the DHT's work with an ID the application already uses. The ID is logged
+// with the call's log lines, set as the "RequestID" attribute of its trace
+// spans and as the RequestID of its lookup events.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return internal.WithRequestID(ctx, id)
+}
+
+// RequestID returns the request ID attached to the context, if any. The
+// contexts passed to the OnRequestHook callback carry the ID of the inbound
+// request.
+func RequestID(ctx context.Context) string {
+	return internal.RequestID(ctx)
+}
+
+// startRequest attributes ctx to the routing operation op and gives it a
+// request ID unless it already carries one.
+func startRequest(ctx context.Context, op string) context.Context {
+	ctx = internal.WithOperation(ctx, op)
+	if internal.RequestID(ctx) == "" {
+		ctx = internal.WithRequestID(ctx, internal.NewRequestID())
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("RequestID", internal.RequestID(ctx)))
+	return ctx
+}
+
+// requestLogger returns the DHT's logger, annotated with the request ID
+// carried by ctx, if any.
+func (dht *IpfsDHT) requestLogger(ctx context.Context) *zap.SugaredLogger {
+	if id := internal.RequestID(ctx); id != "" {
+		return dht.logger.With("request_id", id)
+	}
+	return dht.logger
+}
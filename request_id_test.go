@@ -0,0 +1,49 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var inbound []string
+	hook := OnRequestHook(func(ctx context.Context, _ network.Stream, _ *pb.Message) {
+		mu.Lock()
+		inbound = append(inbound, RequestID(ctx))
+		mu.Unlock()
+	})
+
+	dhts := setupDHTS(t, ctx, 2, hook)
+	connect(t, ctx, dhts[0], dhts[1])
+
+	lctx, events := RegisterForLookupEvents(WithRequestID(ctx, "my-request"))
+	_, err := dhts[0].GetClosestPeers(lctx, "foo")
+	require.NoError(t, err)
+	cancel()
+
+	var n int
+	for ev := range events {
+		require.Equal(t, "my-request", ev.RequestID)
+		n++
+	}
+	require.NotZero(t, n)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, inbound)
+	seen := make(map[string]struct{})
+	for _, id := range inbound {
+		require.NotEmpty(t, id)
+		require.NotContains(t, seen, id)
+		seen[id] = struct{}{}
+	}
+}
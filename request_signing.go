@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SignedRequest is a storage request whose signature was verified, as
+// marshaled by its sender, see RequireSignedStorageRequests.
+type SignedRequest = dhtcfg.SignedRequest
+
+// storageRequest tells whether messages of type t are storage requests, the
+// ones signed.
+func storageRequest(t pb.Message_MessageType) bool {
+	return t == pb.Message_PUT_VALUE || t == pb.Message_ADD_PROVIDER
+}
+
+// signingSender signs the storage requests before sending them.
+type signingSender struct {
+	pb.MessageSenderWithDisconnect
+	key crypto.PrivKey
+}
+
+func (s *signingSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	if storageRequest(pmes.GetType()) {
+		if err := pb.SignMessage(s.key, pmes); err != nil {
+			return nil, fmt.Errorf("signing request: %w", err)
+		}
+	}
+	return s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+}
+
+func (s *signingSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	if storageRequest(pmes.GetType()) {
+		if err := pb.SignMessage(s.key, pmes); err != nil {
+			return fmt.Errorf("signing request: %w", err)
+		}
+	}
+	return s.MessageSenderWithDisconnect.SendMessage(ctx, p, pmes)
+}
+
+// verifyRequest checks that the storage requests are signed by p when
+// required, and passes them to the audit hook.
+func (dht *IpfsDHT) verifyRequest(ctx context.Context, p peer.ID, req *pb.Message) error {
+	if !dht.requireSigned || !storageRequest(req.GetType()) {
+		return nil
+	}
+	key := dht.peerstore.PubKey(p)
+	if key == nil {
+		return fmt.Errorf("no public key for %s", p)
+	}
+	if err := pb.VerifyMessage(key, req); err != nil {
+		return err
+	}
+	if dht.auditSigned != nil {
+		raw, err := req.Marshal()
+		if err != nil {
+			return err
+		}
+		dht.auditSigned(ctx, SignedRequest{From: p, Message: raw})
+	}
+	return nil
+}
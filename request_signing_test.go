@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireSignedStorageRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		audited []SignedRequest
+	)
+	server := setupDHT(ctx, t, false, DisableAutoRefresh(), RequireSignedStorageRequests(func(ctx context.Context, req SignedRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+		audited = append(audited, req)
+	}))
+	signing := setupDHT(ctx, t, false, DisableAutoRefresh(), SignStorageRequests())
+	unsigned := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, signing, server)
+	connect(t, ctx, unsigned, server)
+
+	require.True(t, signing.Config().RequestSigning.Sign)
+	require.True(t, server.Config().RequestSigning.Require)
+
+	require.NoError(t, signing.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord("/v/signed", []byte("a"))))
+	require.Error(t, unsigned.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord("/v/unsigned", []byte("b"))))
+
+	rec, err := server.getLocal(ctx, "/v/unsigned")
+	require.NoError(t, err)
+	require.Nil(t, rec)
+
+	// the audited request can be verified by a third party
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, audited, 1)
+	require.Equal(t, signing.self, audited[0].From)
+	var req pb.Message
+	require.NoError(t, req.Unmarshal(audited[0].Message))
+	require.Equal(t, "/v/signed", string(req.GetKey()))
+	require.NoError(t, pb.VerifyMessage(signing.peerstore.PubKey(signing.self), &req))
+
+	// non storage requests don't need a signature
+	_, err = unsigned.protoMessenger.GetClosestPeers(ctx, server.self, unsigned.self)
+	require.NoError(t, err)
+}
@@ -0,0 +1,58 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// requestTimeouts derives the timeout of the requests sent to a peer from the
+// average RTT the peerstore measured with it.
+//
+// A nil *requestTimeouts doesn't bound the requests.
+type requestTimeouts struct {
+	floor, ceiling time.Duration
+	multiplier     float64
+	metrics        peerstore.Metrics
+}
+
+func newRequestTimeouts(floor, ceiling time.Duration, multiplier float64, m peerstore.Metrics) *requestTimeouts {
+	if multiplier <= 0 {
+		return nil
+	}
+	return &requestTimeouts{floor: floor, ceiling: ceiling, multiplier: multiplier, metrics: m}
+}
+
+// timeout returns the timeout of the requests to p.
+func (t *requestTimeouts) timeout(p peer.ID) time.Duration {
+	rtt := t.metrics.LatencyEWMA(p)
+	if rtt <= 0 {
+		return t.ceiling
+	}
+	return min(max(time.Duration(float64(rtt)*t.multiplier), t.floor), t.ceiling)
+}
+
+// timeoutSender bounds every request by the timeout of its peer. A request
+// timing out fails with an error matching net.ErrReadTimeout, so that it isn't
+// mistaken for the caller's context expiring.
+type timeoutSender struct {
+	pb.MessageSenderWithDisconnect
+	timeouts *requestTimeouts
+}
+
+func (s *timeoutSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	timeout := s.timeouts.timeout(p)
+	rctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(rctx, p, pmes)
+	if err != nil && ctx.Err() == nil && rctx.Err() != nil {
+		return nil, fmt.Errorf("%w: no response from %s within %s", net.ErrReadTimeout, p, timeout)
+	}
+	return resp, err
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+)
+
+func TestRequestTimeouts(t *testing.T) {
+	require.Nil(t, newRequestTimeouts(time.Second, 10*time.Second, 0, nil))
+
+	ps, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	defer ps.Close()
+	rt := newRequestTimeouts(time.Second, 10*time.Second, 10, ps)
+
+	// unknown RTT
+	require.Equal(t, 10*time.Second, rt.timeout("unknown"))
+
+	for p, rtt := range map[peer.ID]time.Duration{
+		"fast":   10 * time.Millisecond,
+		"medium": 300 * time.Millisecond,
+		"slow":   3 * time.Second,
+	} {
+		ps.RecordLatency(p, rtt)
+	}
+	require.Equal(t, time.Second, rt.timeout("fast"))
+	require.Equal(t, 3*time.Second, rt.timeout("medium"))
+	require.Equal(t, 10*time.Second, rt.timeout("slow"))
+}
+
+func TestAdaptiveRequestTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, AdaptiveRequestTimeout(100*time.Millisecond, 200*time.Millisecond, 10))
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+
+	// b stops answering
+	for _, proto := range b.serverProtocols {
+		b.host.SetStreamHandler(proto, func(s network.Stream) {
+			<-ctx.Done()
+			s.Reset()
+		})
+	}
+	require.NoError(t, a.host.Network().ClosePeer(b.self))
+
+	start := time.Now()
+	err := a.Ping(ctx, b.self)
+	require.ErrorIs(t, err, net.ErrReadTimeout)
+	require.NotErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
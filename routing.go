@@ -12,11 +12,13 @@ import (
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/libp2p/go-libp2p/core/routing"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	internalConfig "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	kb "github.com/libp2p/go-libp2p-kbucket"
@@ -33,16 +35,17 @@ import (
 func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts ...routing.Option) (err error) {
 	ctx, end := tracer.PutValue(dhtName, ctx, key, value, opts...)
 	defer func() { end(err) }()
+	ctx = startRequest(ctx, "PutValue")
 
 	if !dht.enableValues {
 		return routing.ErrNotSupported
 	}
 
-	logger.Debugw("putting value", "key", internal.LoggableRecordKeyString(key))
+	dht.requestLogger(ctx).Debugw("putting value", "key", internal.LoggableRecordKeyString(key))
 
 	// don't even allow local users to put bad values.
-	if err := dht.Validator.Validate(key, value); err != nil {
-		return err
+	if err := dht.validateRecord(ctx, key, value); err != nil {
+		return &ValidationError{Key: key, Err: err}
 	}
 
 	old, err := dht.getLocal(ctx, key)
@@ -59,7 +62,7 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 			return err
 		}
 		if i != 0 {
-			return fmt.Errorf("can't replace a newer value with an older value")
+			return ErrOutdatedRecord
 		}
 	}
 
@@ -70,7 +73,13 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 		return err
 	}
 
-	peers, err := dht.GetClosestPeers(ctx, key)
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return err
+	}
+	replication := dht.replicationFor(ctx, key, internalConfig.GetReplication(&cfg))
+
+	peers, err := dht.GetClosestPeers(withStorageLookup(withLookupSize(ctx, replication)), key)
 	if err != nil {
 		return err
 	}
@@ -89,7 +98,7 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 
 			err := dht.protoMessenger.PutValue(ctx, p, rec)
 			if err != nil {
-				logger.Debugf("failed putting value to peer: %s", err)
+				dht.requestLogger(ctx).Debugf("failed putting value to peer: %s", err)
 			}
 		}(p)
 	}
@@ -108,6 +117,7 @@ type recvdVal struct {
 func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Option) (result []byte, err error) {
 	ctx, end := tracer.GetValue(dhtName, ctx, key, opts...)
 	defer func() { end(result, err) }()
+	ctx = startRequest(ctx, "GetValue")
 
 	if !dht.enableValues {
 		return nil, routing.ErrNotSupported
@@ -119,6 +129,14 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 		return nil, err
 	}
 	opts = append(opts, Quorum(internalConfig.GetQuorum(&cfg)))
+	if internalConfig.GetCrossValidate(&cfg) && !cfg.Offline && !isOffline(ctx) {
+		return dht.crossValidatedValue(ctx, key, dht.quorum(&cfg))
+	}
+	var tally *quorumTally
+	if internalConfig.GetRequireQuorum(&cfg) {
+		tally = &quorumTally{}
+		opts = append(opts, withQuorumTally(tally))
+	}
 
 	responses, err := dht.SearchValue(ctx, key, opts...)
 	if err != nil {
@@ -135,9 +153,12 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 	}
 
 	if best == nil {
-		return nil, routing.ErrNotFound
+		return nil, ErrNotFound
+	}
+	if tally != nil && tally.needed > 0 && tally.got < tally.needed {
+		return best, &QuorumError{Needed: tally.needed, Got: tally.got}
 	}
-	logger.Debugf("GetValue %v %x", internal.LoggableRecordKeyString(key), best)
+	dht.requestLogger(ctx).Debugf("GetValue %v %x", internal.LoggableRecordKeyString(key), best)
 	return best, nil
 }
 
@@ -145,6 +166,7 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing.Option) (ch <-chan []byte, err error) {
 	ctx, end := tracer.SearchValue(dhtName, ctx, key, opts...)
 	defer func() { ch, err = end(ch, err) }()
+	ctx = startRequest(ctx, "SearchValue")
 
 	if !dht.enableValues {
 		return nil, routing.ErrNotSupported
@@ -155,52 +177,167 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing
 		return nil, err
 	}
 
-	responsesNeeded := 0
-	if !cfg.Offline {
-		responsesNeeded = internalConfig.GetQuorum(&cfg)
+	if cfg.Offline || isOffline(ctx) {
+		return dht.searchLocalValue(ctx, key)
+	}
+
+	tally := getQuorumTally(&cfg)
+	if val, ok := dht.cachedValue(key); ok && tally == nil {
+		out := make(chan []byte, 1)
+		out <- val
+		close(out)
+		return out, nil
+	}
+
+	responsesNeeded := dht.quorum(&cfg)
+	if tally != nil {
+		tally.needed = responsesNeeded
 	}
 
 	stopCh := make(chan struct{})
-	valCh, lookupRes := dht.getValues(ctx, key, stopCh)
+	stop := sync.OnceFunc(func() { close(stopCh) })
+	valCh, lookupRes, _ := dht.getValues(ctx, key, stopCh)
+
+	var deadline *improvementDeadline
+	searchCtx := ctx
+	if d := internalConfig.GetImprovementTimeout(&cfg); d > 0 {
+		deadline = &improvementDeadline{timeout: d, stop: stop}
+		searchCtx, deadline.cancelSearch = context.WithCancel(ctx)
+	}
+
+	var cands *recordCandidates
+	if dht.conflictResolver != nil {
+		cands = &recordCandidates{}
+	}
 
 	out := make(chan []byte)
 	go func() {
 		defer close(out)
-		best, peersWithBest, aborted := dht.searchValueQuorum(ctx, key, valCh, stopCh, out, responsesNeeded)
-		if best == nil || aborted {
+		defer deadline.cancel()
+		best, peersWithBest, aborted := dht.searchValueQuorum(searchCtx, key, valCh, stop, out, responsesNeeded, cands, tally, deadline)
+		// like reaching the quorum, the deadline doesn't wait for the lookup
+		aborted = aborted || searchCtx.Err() != nil
+		if best == nil {
+			return
+		}
+		dht.cacheValue(key, best)
+		if aborted {
 			return
 		}
 
-		updatePeers := make([]peer.ID, 0, dht.bucketSize)
+		var updatePeers []peer.ID
 		select {
 		case l := <-lookupRes:
 			if l == nil {
 				return
 			}
 
-			for _, p := range l.peers {
-				if _, ok := peersWithBest[p]; !ok {
-					updatePeers = append(updatePeers, p)
+			var changed bool
+			best, updatePeers, changed = dht.resolveConflict(key, cands, best, l.peers, peersWithBest)
+			if changed {
+				select {
+				case out <- best:
+				case <-ctx.Done():
+					return
 				}
 			}
 		case <-ctx.Done():
 			return
 		}
 
+		updatePeers = dht.correctionTargets(updatePeers)
+		for _, p := range updatePeers {
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type:  routing.Value,
+				ID:    p,
+				Extra: "correction",
+			})
+		}
 		dht.updatePeerValues(dht.Context(), key, best, updatePeers)
 	}()
 
 	return out, nil
 }
 
-func (dht *IpfsDHT) searchValueQuorum(ctx context.Context, key string, valCh <-chan recvdVal, stopCh chan struct{},
-	out chan<- []byte, nvals int,
+// quorum returns the number of values a value lookup waits for, set by the
+// Quorum or DynamicQuorum options.
+func (dht *IpfsDHT) quorum(cfg *routing.Options) int {
+	if f := internalConfig.GetQuorumFunc(cfg); f != nil {
+		ns, err := dht.nsEstimator.NetworkSize()
+		if err != nil {
+			ns = 0
+		}
+		return f(int(ns))
+	}
+	return internalConfig.GetQuorum(cfg)
+}
+
+// searchLocalValue streams the value stored in the local datastore, if any.
+func (dht *IpfsDHT) searchLocalValue(ctx context.Context, key string) (<-chan []byte, error) {
+	out := make(chan []byte, 1)
+	defer close(out)
+	rec, err := dht.getLocal(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		out <- rec.GetValue()
+	}
+	return out, nil
+}
+
+// improvementDeadline stops a value lookup and cancels the processing of its
+// values when no better record arrived within the timeout set with
+// ImprovementTimeout.
+//
+// A nil *improvementDeadline never stops the lookup.
+type improvementDeadline struct {
+	timeout      time.Duration
+	stop         func()
+	cancelSearch context.CancelFunc
+	timer        *time.Timer
+}
+
+func (d *improvementDeadline) expire() {
+	d.stop()
+	d.cancelSearch()
+}
+
+// improved restarts the deadline, on a better record.
+func (d *improvementDeadline) improved() {
+	if d == nil {
+		return
+	}
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.timeout, d.expire)
+		return
+	}
+	d.timer.Reset(d.timeout)
+}
+
+func (d *improvementDeadline) cancel() {
+	if d == nil {
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancelSearch()
+}
+
+func (dht *IpfsDHT) searchValueQuorum(ctx context.Context, key string, valCh <-chan recvdVal, stop func(),
+	out chan<- []byte, nvals int, cands *recordCandidates, tally *quorumTally, deadline *improvementDeadline,
 ) ([]byte, map[peer.ID]struct{}, bool) {
 	numResponses := 0
 	return dht.processValues(ctx, key, valCh,
 		func(ctx context.Context, v recvdVal, better bool) bool {
 			numResponses++
+			if tally != nil && v.From != dht.self {
+				tally.got++
+			}
+			cands.add(v)
 			if better {
+				deadline.improved()
 				select {
 				case out <- v.Val:
 				case <-ctx.Done():
@@ -209,7 +346,7 @@ func (dht *IpfsDHT) searchValueQuorum(ctx context.Context, key string, valCh <-c
 			}
 
 			if nvals > 0 && numResponses > nvals {
-				close(stopCh)
+				stop()
 				return true
 			}
 			return false
@@ -240,7 +377,7 @@ loop:
 				}
 				sel, err := dht.Validator.Select(key, [][]byte{best, v.Val})
 				if err != nil {
-					logger.Warnw("failed to select best value", "key", internal.LoggableRecordKeyString(key), "error", err)
+					dht.requestLogger(ctx).Warnw("failed to select best value", "key", internal.LoggableRecordKeyString(key), "error", err)
 					continue
 				}
 				if sel != 1 {
@@ -268,7 +405,7 @@ func (dht *IpfsDHT) updatePeerValues(ctx context.Context, key string, val []byte
 			if p == dht.self {
 				err := dht.putLocal(ctx, key, fixupRec)
 				if err != nil {
-					logger.Error("Error correcting local dht entry:", err)
+					dht.requestLogger(ctx).Error("Error correcting local dht entry:", err)
 				}
 				return
 			}
@@ -276,17 +413,21 @@ func (dht *IpfsDHT) updatePeerValues(ctx context.Context, key string, val []byte
 			defer cancel()
 			err := dht.protoMessenger.PutValue(ctx, p, fixupRec)
 			if err != nil {
-				logger.Debug("Error correcting DHT entry: ", err)
+				dht.requestLogger(ctx).Debug("Error correcting DHT entry: ", err)
 			}
+			metrics.ValueCorrections.Add(ctx, 1, metric.WithAttributes(attribute.Bool("success", err == nil)), dht.protoAttr)
 		}(p)
 	}
 }
 
-func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan struct{}) (<-chan recvdVal, <-chan *lookupWithFollowupResult) {
+// getValues streams the values found for key. The lookup result is sent once
+// it completes, or the error it failed with otherwise.
+func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan struct{}) (<-chan recvdVal, <-chan *lookupWithFollowupResult, <-chan error) {
 	valCh := make(chan recvdVal, 1)
 	lookupResCh := make(chan *lookupWithFollowupResult, 1)
+	lookupErrCh := make(chan error, 1)
 
-	logger.Debugw("finding value", "key", internal.LoggableRecordKeyString(key))
+	dht.requestLogger(ctx).Debugw("finding value", "key", internal.LoggableRecordKeyString(key))
 
 	if rec, err := dht.getLocal(ctx, key); rec != nil && err == nil {
 		select {
@@ -301,6 +442,7 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 	go func() {
 		defer close(valCh)
 		defer close(lookupResCh)
+		defer close(lookupErrCh)
 		lookupRes, err := dht.runLookupWithFollowup(ctx, key,
 			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 				// For DHT query command
@@ -311,7 +453,7 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 
 				rec, peers, err := dht.protoMessenger.GetValue(ctx, p, key)
 				if err != nil {
-					logger.Debugf("error getting closer peers: %s", err)
+					dht.requestLogger(ctx).Debugf("error getting closer peers: %s", err)
 					return nil, err
 				}
 
@@ -328,12 +470,12 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 
 				val := rec.GetValue()
 				if val == nil {
-					logger.Debug("received a nil record value")
+					dht.requestLogger(ctx).Debug("received a nil record value")
 					return peers, nil
 				}
-				if err := dht.Validator.Validate(key, val); err != nil {
+				if err := dht.validateRecord(ctx, key, val); err != nil {
 					// make sure record is valid
-					logger.Debugw("received invalid record (discarded)", "error", err)
+					dht.requestLogger(ctx).Debugw("received invalid record (discarded)", "error", err)
 					return peers, nil
 				}
 
@@ -359,16 +501,17 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 			},
 		)
 		if err != nil {
+			lookupErrCh <- err
 			return
 		}
 		lookupResCh <- lookupRes
 
 		if ctx.Err() == nil {
-			dht.refreshRTIfNoShortcut(kb.ConvertKey(key), lookupRes)
+			dht.refreshRTIfNoShortcut(dht.kadKey(key), lookupRes)
 		}
 	}()
 
-	return valCh, lookupResCh
+	return valCh, lookupResCh, lookupErrCh
 }
 
 func (dht *IpfsDHT) refreshRTIfNoShortcut(key kb.ID, lookupRes *lookupWithFollowupResult) {
@@ -386,14 +529,15 @@ func (dht *IpfsDHT) refreshRTIfNoShortcut(key kb.ID, lookupRes *lookupWithFollow
 func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err error) {
 	ctx, end := tracer.Provide(dhtName, ctx, key, brdcst)
 	defer func() { end(err) }()
+	ctx = startRequest(ctx, "Provide")
 
 	if !dht.enableProviders {
 		return routing.ErrNotSupported
 	} else if !key.Defined() {
-		return fmt.Errorf("invalid cid: undefined")
+		return fmt.Errorf("%w: undefined cid", ErrInvalidKey)
 	}
 	keyMH := key.Hash()
-	logger.Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	dht.requestLogger(ctx).Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
 
 	// add self locally
 	dht.providerStore.AddProvider(ctx, keyMH, peer.AddrInfo{ID: dht.self})
@@ -401,10 +545,15 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 		return nil
 	}
 
+	ctx, progress := withProvideProgressTracker(ctx)
+	defer func() { progress.finish(err) }()
+
+	ctx = withStorageLookup(withLookupSize(ctx, dht.provideReplication(ctx, keyMH)))
+
 	if dht.enableOptProv {
 		err := dht.optimisticProvide(ctx, keyMH)
 		if errors.Is(err, netsize.ErrNotEnoughData) {
-			logger.Debugln("not enough data for optimistic provide taking classic approach")
+			dht.requestLogger(ctx).Debugln("not enough data for optimistic provide taking classic approach")
 			return dht.classicProvide(ctx, keyMH)
 		}
 		return err
@@ -450,19 +599,27 @@ func (dht *IpfsDHT) classicProvide(ctx context.Context, keyMH multihash.Multihas
 		return err
 	}
 
+	peers = dht.missingProviderPeers(ctx, keyMH, peers)
+
+	progress := provideProgressTrackerFromContext(ctx)
+	progress.lookupDone(len(peers))
+
 	wg := sync.WaitGroup{}
 	for _, p := range peers {
 		wg.Add(1)
 		go func(p peer.ID) {
 			defer wg.Done()
-			logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
+			dht.requestLogger(ctx).Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
 			err := dht.protoMessenger.PutProviderAddrs(ctx, p, keyMH, peer.AddrInfo{
 				ID:    dht.self,
 				Addrs: dht.filterAddrs(dht.host.Addrs()),
 			})
 			if err != nil {
-				logger.Debug(err)
+				dht.requestLogger(ctx).Debug(err)
+			} else {
+				dht.provideLedger.stored(keyMH, p)
 			}
+			progress.putDone(p, err)
 		}(p)
 	}
 	wg.Wait()
@@ -477,7 +634,7 @@ func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrIn
 	if !dht.enableProviders {
 		return nil, routing.ErrNotSupported
 	} else if !c.Defined() {
-		return nil, fmt.Errorf("invalid cid: undefined")
+		return nil, fmt.Errorf("%w: undefined cid", ErrInvalidKey)
 	}
 
 	var providers []peer.AddrInfo
@@ -491,10 +648,12 @@ func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrIn
 // Peers will be returned on the channel as soon as they are found, even before
 // the search query completes. If count is zero then the query will run until it
 // completes. Note: not reading from the returned channel may block the query
-// from progressing.
+// from progressing. See WithProviderSearch to complete the query in the
+// background once the first providers are found.
 func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) (ch <-chan peer.AddrInfo) {
 	ctx, end := tracer.FindProvidersAsync(dhtName, ctx, key, count)
 	defer func() { ch = end(ch, nil) }()
+	ctx = startRequest(ctx, "FindProviders")
 
 	if !dht.enableProviders || !key.Defined() {
 		peerOut := make(chan peer.AddrInfo)
@@ -506,7 +665,13 @@ func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count i
 
 	keyMH := key.Hash()
 
-	logger.Debugw("finding providers", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	dht.requestLogger(ctx).Debugw("finding providers", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	if s := providerSearchFromContext(ctx); s != nil {
+		found := make(chan peer.AddrInfo)
+		go dht.findProvidersAsyncRoutine(s.start(ctx, dht.ctx), keyMH, count, found)
+		go s.forward(ctx, found, peerOut)
+		return peerOut
+	}
 	go dht.findProvidersAsyncRoutine(ctx, keyMH, count, peerOut)
 	return peerOut
 }
@@ -542,6 +707,9 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 	if err != nil {
 		return
 	}
+	provs = dht.filterProviders(ctx, key, provs)
+	sources := providerSourcesFromContext(ctx)
+	sources.addLocal(ctx, dht, key, provs)
 	for _, p := range provs {
 		// NOTE: Assuming that this list of peers is unique
 		if psTryAdd(p) {
@@ -566,6 +734,31 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 		}
 	}
 
+	if isOffline(ctx) {
+		return
+	}
+
+	if cached, ok := dht.cachedProviders(string(key)); ok {
+		for _, p := range dht.filterProviders(ctx, key, cached) {
+			if psTryAdd(p) {
+				select {
+				case peerOut <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		if !findAll && psSize() >= count {
+			return
+		}
+	}
+
+	negKey := negativeCacheProviderKey(string(key))
+	if len(provs) == 0 && dht.negativeCache.has(ctx, negKey) {
+		dht.requestLogger(ctx).Debugw("providers recently not found", "mh", internal.LoggableProviderRecordBytes(key))
+		return
+	}
+
 	lookupRes, err := dht.runLookupWithFollowup(ctx, string(key),
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
@@ -579,34 +772,43 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 				return nil, err
 			}
 
-			logger.Debugf("%d provider entries", len(provs))
+			dht.requestLogger(ctx).Debugf("%d provider entries", len(provs))
 
-			// Add unique providers from request, up to 'count'
+			found := make([]peer.AddrInfo, 0, len(provs))
 			for _, prov := range provs {
+				prov.Addrs = dht.applyRelayAddrPolicy(prov.Addrs)
 				dht.maybeAddAddrs(prov.ID, prov.Addrs, peerstore.TempAddrTTL)
-				logger.Debugf("got provider: %s", prov)
-				if psTryAdd(*prov) {
-					logger.Debugf("using provider: %s", prov)
+				dht.requestLogger(ctx).Debugf("got provider: %s", prov)
+				found = append(found, *prov)
+			}
+
+			found = dht.filterProviders(ctx, key, found)
+			sources.addRemote(p, found)
+
+			// Add unique providers from request, up to 'count'
+			for _, prov := range found {
+				if psTryAdd(prov) {
+					dht.requestLogger(ctx).Debugf("using provider: %s", prov)
 					select {
-					case peerOut <- *prov:
+					case peerOut <- prov:
 						span.AddEvent("found provider", trace.WithAttributes(
 							attribute.Stringer("peer", prov.ID),
 							attribute.Stringer("from", p),
 							attribute.Int("provider_addrs_count", len(prov.Addrs)),
 						))
 					case <-ctx.Done():
-						logger.Debug("context timed out sending more providers")
+						dht.requestLogger(ctx).Debug("context timed out sending more providers")
 						return nil, ctx.Err()
 					}
 				}
 				if !findAll && psSize() >= count {
-					logger.Debugf("got enough providers (%d/%d)", psSize(), count)
+					dht.requestLogger(ctx).Debugf("got enough providers (%d/%d)", psSize(), count)
 					return nil, nil
 				}
 			}
 
 			// Give closer peers back to the query to be queried
-			logger.Debugf("got closer peers: %d %s", len(closest), closest)
+			dht.requestLogger(ctx).Debugf("got closer peers: %d %s", len(closest), closest)
 
 			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 				Type:      routing.PeerResponse,
@@ -622,26 +824,62 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 	)
 
 	if err == nil && ctx.Err() == nil {
-		dht.refreshRTIfNoShortcut(kb.ConvertKey(string(key)), lookupRes)
+		dht.refreshRTIfNoShortcut(dht.kadKey(string(key)), lookupRes)
+		if providerFilterFromContext(ctx) != nil {
+			// the results of this call may not suit the other callers
+			return
+		}
+		if lookupRes.completed && psSize() == 0 {
+			dht.negativeCache.add(ctx, negKey)
+		}
+		if lookupRes.completed {
+			psLock.Lock()
+			found := make([]peer.AddrInfo, 0, len(ps))
+			for _, p := range ps {
+				found = append(found, p)
+			}
+			psLock.Unlock()
+			dht.cacheProviders(string(key), found)
+		}
 	}
 }
 
 // FindPeer searches for a peer with given ID.
+//
+// If the peer isn't found, the error matches routing.ErrNotFound. It is
+// routing.ErrNotFound itself when the lookup completed, but when the lookup
+// was cut short by ctx it also wraps the context's error, so callers must
+// match it with errors.Is(err, routing.ErrNotFound) rather than compare it.
 func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (pi peer.AddrInfo, err error) {
 	ctx, end := tracer.FindPeer(dhtName, ctx, id)
 	defer func() { end(pi, err) }()
+	ctx = startRequest(ctx, "FindPeer")
 
 	if err := id.Validate(); err != nil {
 		return peer.AddrInfo{}, err
 	}
 
-	logger.Debugw("finding peer", "peer", id)
+	dht.requestLogger(ctx).Debugw("finding peer", "peer", id)
 
 	// Check if were already connected to them
 	if pi := dht.FindLocal(ctx, id); pi.ID != "" {
 		return pi, nil
 	}
 
+	if isOffline(ctx) {
+		if pi := dht.peerstore.PeerInfo(id); len(pi.Addrs) > 0 {
+			pi.Addrs = dht.applyRelayAddrPolicy(pi.Addrs)
+			return pi, nil
+		}
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+
+	negKey := negativeCachePeerKey(string(id))
+	if dht.negativeCache.has(ctx, negKey) {
+		dht.requestLogger(ctx).Debugw("peer recently not found", "peer", id)
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+
 	lookupRes, err := dht.runLookupWithFollowup(ctx, string(id),
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
@@ -652,7 +890,7 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (pi peer.AddrInfo,
 
 			peers, err := dht.protoMessenger.GetClosestPeers(ctx, p, id)
 			if err != nil {
-				logger.Debugf("error getting closer peers: %s", err)
+				dht.requestLogger(ctx).Debugf("error getting closer peers: %s", err)
 				return nil, err
 			}
 
@@ -687,8 +925,39 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (pi peer.AddrInfo,
 	// Return peer information if we tried to dial the peer during the query or we are (or recently were) connected
 	// to the peer.
 	if dialedPeerDuringQuery || hasValidConnectedness(dht.host, id) {
-		return dht.peerstore.PeerInfo(id), nil
+		if err := dht.verifyPeerAddrs(ctx, id); err != nil {
+			return peer.AddrInfo{}, err
+		}
+		pi := dht.peerstore.PeerInfo(id)
+		pi.Addrs = dht.applyRelayAddrPolicy(pi.Addrs)
+		return pi, nil
 	}
 
-	return peer.AddrInfo{}, routing.ErrNotFound
+	if lookupRes.completed {
+		dht.negativeCache.add(ctx, negKey)
+	}
+	return peer.AddrInfo{}, notFound(ctx)
+}
+
+// verifyPeerAddrs checks, when FindPeer address verification is enabled, that
+// the addresses we know for id work by connecting to it. Connecting refreshes
+// the peerstore entry through identify, while addresses that fail to connect
+// are removed from the peerstore and routing.ErrNotFound is returned. If ctx
+// expires first, the addresses are kept and its error is returned.
+func (dht *IpfsDHT) verifyPeerAddrs(ctx context.Context, id peer.ID) error {
+	if dht.findPeerVerifyTimeout <= 0 || hasValidConnectedness(dht.host, id) {
+		return nil
+	}
+
+	vctx, cancel := context.WithTimeout(ctx, dht.findPeerVerifyTimeout)
+	defer cancel()
+	if err := dht.host.Connect(vctx, peer.AddrInfo{ID: id}); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		dht.requestLogger(ctx).Debugw("failed to verify addresses of found peer", "peer", id, "error", err)
+		dht.peerstore.ClearAddrs(id)
+		return routing.ErrNotFound
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package dht
 
 import (
+	"fmt"
+	"time"
+
 	internalConfig "github.com/libp2p/go-libp2p-kad-dht/internal/config"
 	"github.com/libp2p/go-libp2p/core/routing"
 )
@@ -19,3 +22,118 @@ func Quorum(n int) routing.Option {
 		return nil
 	}
 }
+
+// RequireQuorum is a DHT option that makes GetValue fail with a *QuorumError
+// when the lookup completes before the quorum set by Quorum or DynamicQuorum
+// was reached. The best value found, if any, is still returned alongside the
+// error. Without it, GetValue returns the best value it found regardless of
+// how many peers responded.
+func RequireQuorum() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[internalConfig.RequireQuorumOptionKey{}] = true
+		return nil
+	}
+}
+
+// quorumTally records the quorum of a single value lookup and the number of
+// remote peers that responded, so that GetValue can enforce RequireQuorum.
+type quorumTally struct {
+	needed int
+	got    int
+}
+
+type quorumTallyKey struct{}
+
+func withQuorumTally(t *quorumTally) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[quorumTallyKey{}] = t
+		return nil
+	}
+}
+
+func getQuorumTally(opts *routing.Options) *quorumTally {
+	t, _ := opts.Other[quorumTallyKey{}].(*quorumTally)
+	return t
+}
+
+// QuorumFunc computes the quorum of a value lookup from the current estimate
+// of the network size, which is 0 if the estimator has no estimate yet.
+type QuorumFunc func(networkSize int) int
+
+// DynamicQuorum is a DHT option that computes the quorum of a GetValue or
+// SearchValue call with f instead of using a static value, so that read
+// consistency can adapt as the network grows or shrinks. It takes precedence
+// over Quorum.
+func DynamicQuorum(f QuorumFunc) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[internalConfig.QuorumFuncOptionKey{}] = (func(int) int)(f)
+		return nil
+	}
+}
+
+// ImprovementTimeout is a DHT option that stops a SearchValue or GetValue
+// lookup when no better record arrived within d of the last one, trading the
+// freshness of the result for latency. The lookup runs on until a first record
+// arrives. It combines with the quorum, the lookup stopping on whichever
+// comes first.
+//
+// Default: 0, not stopping
+func ImprovementTimeout(d time.Duration) routing.Option {
+	return func(opts *routing.Options) error {
+		if d < 0 {
+			return fmt.Errorf("improvement timeout must not be negative, got %s", d)
+		}
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[internalConfig.ImprovementTimeoutOptionKey{}] = d
+		return nil
+	}
+}
+
+// Replication is a DHT option that overrides the number of closest peers a
+// PutValue call stores the record with. See also WithReplication and the
+// NamespaceReplication DHT option.
+//
+// Default: the DHT bucket size
+func Replication(n int) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[internalConfig.ReplicationOptionKey{}] = n
+		return nil
+	}
+}
+
+// CrossValidate is a DHT option that makes GetValue run two lookups along
+// independent paths, seeded with distinct peers of the routing table and never
+// querying the same peer, and only return a value both of them found to be the
+// best. When the paths disagree, for example because the peers along one of
+// them suppress the latest record, GetValue fails with a *DivergenceError.
+//
+// Each path needs a seed peer of its own, so GetValue fails with
+// ErrTooFewPeersForPaths when the routing table holds a single peer.
+//
+// It doubles the cost of the lookup, so it is meant for high-value keys. The
+// quorum, if any, applies to each path, and the record of the local datastore
+// counts on both. Records are neither cached from nor
+// corrected with the cross-validated lookups.
+func CrossValidate() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[internalConfig.CrossValidateOptionKey{}] = true
+		return nil
+	}
+}
@@ -0,0 +1,167 @@
+// Package rpc provides a client sending individual DHT RPCs to given peers,
+// for measurement tools and integrations needing a finer control than the
+// lookups of the DHT offer. The client speaks the wire protocol of the DHT,
+// reusing a stream per peer, but keeps no routing table and doesn't answer
+// requests.
+package rpc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+var logger = logging.Logger("dht/rpc")
+
+// Client sends DHT RPCs to peers. It is safe for concurrent use.
+type Client struct {
+	host    host.Host
+	sender  pb.MessageSenderWithDisconnect
+	pm      *pb.ProtocolMessenger
+	timeout time.Duration
+
+	sub       event.Subscription
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewClient returns a Client sending RPCs from h. It must be closed to release
+// its streams.
+func NewClient(h host.Host, opts ...Option) (*Client, error) {
+	o := new(options)
+	if err := defaults(o); err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	sender := net.NewMessageSenderImpl(h, o.protocols)
+	pm, err := pb.NewProtocolMessenger(sender)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		host:    h,
+		sender:  sender,
+		pm:      pm,
+		timeout: o.perMsgTimeout,
+		sub:     sub,
+		done:    make(chan struct{}),
+	}
+	go c.dropDisconnected()
+	return c, nil
+}
+
+// dropDisconnected releases the streams of the peers that disconnect.
+func (c *Client) dropDisconnected() {
+	defer close(c.done)
+	for e := range c.sub.Out() {
+		evt := e.(event.EvtPeerConnectednessChanged)
+		if evt.Connectedness != network.Connected {
+			c.sender.OnDisconnect(context.Background(), evt.Peer)
+		}
+	}
+}
+
+// Close releases the resources of the client, resetting its streams. The RPCs
+// sent once closed fail.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.sub.Close()
+		<-c.done
+		if cl, ok := c.sender.(io.Closer); ok {
+			if cerr := cl.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// SendFindNode asks p for the DHT servers closest to key it knows of, FIND_NODE.
+// If p knows the peer whose ID is key, it is included even if it isn't a DHT
+// server.
+func (c *Client) SendFindNode(ctx context.Context, p peer.ID, key []byte) ([]*peer.AddrInfo, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.pm.GetClosestPeers(ctx, p, peer.ID(key))
+}
+
+// SendGetProviders asks p for the providers of key it stores and the DHT
+// servers closest to key it knows of, GET_PROVIDERS.
+func (c *Client) SendGetProviders(ctx context.Context, p peer.ID, key multihash.Multihash) (providers, closer []*peer.AddrInfo, err error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.pm.GetProviders(ctx, p, key)
+}
+
+// SendAddProvider asks p to store prov as a provider of key, ADD_PROVIDER.
+// prov must have addresses. The request isn't acknowledged.
+func (c *Client) SendAddProvider(ctx context.Context, p peer.ID, key multihash.Multihash, prov peer.AddrInfo) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.pm.PutProviderAddrs(ctx, p, key, prov)
+}
+
+// SendGetValue asks p for the record of key it stores, nil if none, and the DHT
+// servers closest to key it knows of, GET_VALUE. The record isn't validated,
+// but must be for key.
+func (c *Client) SendGetValue(ctx context.Context, p peer.ID, key string) (*recpb.Record, []*peer.AddrInfo, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.pm.GetValue(ctx, p, key)
+}
+
+// SendPutValue asks p to store rec, PUT_VALUE.
+func (c *Client) SendPutValue(ctx context.Context, p peer.ID, rec *recpb.Record) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.pm.PutValue(ctx, p, rec)
+}
+
+// SendPing checks that p answers DHT requests, PING.
+func (c *Client) SendPing(ctx context.Context, p peer.ID) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.pm.Ping(ctx, p)
+}
+
+// SendRequest sends the request req to p and returns its response, for the
+// message types and fields the typed methods don't cover.
+func (c *Client) SendRequest(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.sender.SendRequest(ctx, p, req)
+	if err != nil {
+		logger.Debugw("request failed", "to", p, "type", req.GetType(), "error", err)
+	}
+	return resp, err
+}
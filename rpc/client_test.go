@@ -0,0 +1,91 @@
+package rpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/rpc"
+)
+
+type blankValidator struct{}
+
+func (blankValidator) Validate(string, []byte) error        { return nil }
+func (blankValidator) Select(string, [][]byte) (int, error) { return 0, nil }
+
+func newHost(t *testing.T) host.Host {
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	h.Start()
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := dht.New(ctx, newHost(t), dht.Mode(dht.ModeServer), dht.DisableAutoRefresh(),
+		dht.ProtocolPrefix("/test"), dht.NamespacedValidator("v", blankValidator{}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	h := newHost(t)
+	c, err := rpc.NewClient(h, rpc.WithProtocols([]protocol.ID{"/test/kad/1.0.0"}), rpc.WithMsgTimeout(5*time.Second))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: server.Host().ID(), Addrs: server.Host().Addrs()}))
+	p := server.Host().ID()
+
+	require.NoError(t, c.SendPing(ctx, p))
+
+	closer, err := c.SendFindNode(ctx, p, []byte(h.ID()))
+	require.NoError(t, err)
+	require.Empty(t, closer)
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	require.NoError(t, c.SendPutValue(ctx, p, rec))
+	got, _, err := c.SendGetValue(ctx, p, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), got.GetValue())
+
+	key, err := multihash.Sum([]byte("key"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.NoError(t, c.SendAddProvider(ctx, p, key, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+	require.Eventually(t, func() bool {
+		provs, _, err := c.SendGetProviders(ctx, p, key)
+		return err == nil && len(provs) == 1 && provs[0].ID == h.ID()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := c.SendRequest(ctx, p, pb.NewMessage(pb.Message_PING, nil, 0))
+	require.NoError(t, err)
+	require.Equal(t, pb.Message_PING, resp.GetType())
+
+	// closing the client resets its streams
+	require.NoError(t, c.Close())
+	require.Eventually(t, func() bool {
+		for _, conn := range h.Network().ConnsToPeer(p) {
+			for _, s := range conn.GetStreams() {
+				if s.Protocol() == "/test/kad/1.0.0" {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Error(t, c.SendPing(ctx, p))
+
+	_, err = rpc.NewClient(h, rpc.WithProtocols(nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,54 @@
+package rpc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/libp2p/go-libp2p-kad-dht/amino"
+)
+
+// Option is a Client option.
+type Option func(*options) error
+
+type options struct {
+	protocols     []protocol.ID
+	perMsgTimeout time.Duration
+}
+
+// defaults are the default client options, applied before the options passed
+// to NewClient.
+var defaults = func(o *options) error {
+	o.protocols = amino.Protocols
+	o.perMsgTimeout = 10 * time.Second
+	return nil
+}
+
+// WithProtocols sets the DHT protocols the client speaks, in order of
+// preference.
+//
+// Default: amino.Protocols
+func WithProtocols(protocols []protocol.ID) Option {
+	return func(o *options) error {
+		if len(protocols) == 0 {
+			return fmt.Errorf("at least one protocol is required")
+		}
+		o.protocols = append([]protocol.ID{}, protocols...)
+		return nil
+	}
+}
+
+// WithMsgTimeout sets how long an RPC may take, on top of the deadline of its
+// context. Zero disables it.
+//
+// Default: 10s
+func WithMsgTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout < 0 {
+			return fmt.Errorf("message timeout must not be negative, got %s", timeout)
+		}
+		o.perMsgTimeout = timeout
+		return nil
+	}
+}
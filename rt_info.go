@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/rtrefresh"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// RoutingTableInfo describes the content of the routing table, for dashboards
+// and debugging. It is a plain value that can be serialized, to JSON for
+// instance.
+type RoutingTableInfo struct {
+	// Size is the number of peers in the routing table.
+	Size int
+	// Buckets are the non-empty buckets, by increasing common prefix length.
+	Buckets []RoutingTableBucket
+
+	// Regions and ASNs break the located peers down by region and autonomous
+	// system, largest groups first. They are empty without the GeoLocation
+	// option.
+	Regions []LocationStats `json:",omitempty"`
+	ASNs    []LocationStats `json:",omitempty"`
+}
+
+// RoutingTableBucket lists the routing table peers sharing a prefix of Cpl bits
+// with our own key, sorted by peer ID.
+type RoutingTableBucket struct {
+	Cpl   int
+	Peers []RoutingTablePeer
+}
+
+// RoutingTablePeer describes a routing table peer. Times are zero when unknown.
+type RoutingTablePeer struct {
+	ID    peer.ID
+	Addrs []string
+	// AgentVersion is the agent the peer reported through identify.
+	AgentVersion string `json:",omitempty"`
+
+	AddedAt                       time.Time
+	LastUsefulAt                  time.Time
+	LastSuccessfulOutboundQueryAt time.Time
+	// RTT is the moving average of the measured round trip times to the
+	// peer, zero if none was measured.
+	RTT time.Duration
+
+	// DiversityGroups are the IP groups the routing table diversity filter
+	// accounts the peer in, empty without a diversity filter.
+	DiversityGroups []string `json:",omitempty"`
+
+	// Location is where the peer is, nil if it wasn't located (yet), see the
+	// GeoLocation option.
+	Location *Location `json:",omitempty"`
+}
+
+// RoutingTableInfo returns a snapshot of the routing table, with the
+// metadata kept about each peer.
+func (dht *IpfsDHT) RoutingTableInfo() RoutingTableInfo {
+	groups := make(map[peer.ID][]string)
+	for _, s := range dht.routingTable.GetDiversityStats() {
+		for p, keys := range s.Peers {
+			for _, k := range keys {
+				groups[p] = append(groups[p], string(k))
+			}
+		}
+	}
+
+	buckets := make(map[int][]RoutingTablePeer)
+	infos := dht.routingTable.GetPeerInfos()
+	for _, pi := range infos {
+		p := pi.Id
+		addrs := dht.peerstore.Addrs(p)
+		rp := RoutingTablePeer{
+			ID:                            p,
+			Addrs:                         make([]string, 0, len(addrs)),
+			AddedAt:                       pi.AddedAt,
+			LastUsefulAt:                  pi.LastUsefulAt,
+			LastSuccessfulOutboundQueryAt: pi.LastSuccessfulOutboundQueryAt,
+			RTT:                           dht.peerstore.LatencyEWMA(p),
+			DiversityGroups:               groups[p],
+		}
+		for _, a := range addrs {
+			rp.Addrs = append(rp.Addrs, a.String())
+		}
+		sort.Strings(rp.Addrs)
+		if v, err := dht.peerstore.Get(p, "AgentVersion"); err == nil {
+			rp.AgentVersion, _ = v.(string)
+		}
+		if loc, ok := dht.geo.location(p); ok {
+			rp.Location = &loc
+		}
+		cpl := kb.CommonPrefixLen(dht.selfKey, dht.kadPeerID(p))
+		buckets[cpl] = append(buckets[cpl], rp)
+	}
+
+	info := RoutingTableInfo{Size: len(infos), Buckets: make([]RoutingTableBucket, 0, len(buckets))}
+	var all []RoutingTablePeer
+	for cpl, peers := range buckets {
+		sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+		info.Buckets = append(info.Buckets, RoutingTableBucket{Cpl: cpl, Peers: peers})
+		all = append(all, peers...)
+	}
+	if dht.geo != nil {
+		info.Regions = locationStats(all, regionKey)
+		info.ASNs = locationStats(all, asnKey)
+	}
+	sort.Slice(info.Buckets, func(i, j int) bool { return info.Buckets[i].Cpl < info.Buckets[j].Cpl })
+	return info
+}
+
+// RefreshOutcome is the outcome of a completed refresh of the routing table,
+// see LastRefresh.
+type RefreshOutcome = rtrefresh.RefreshOutcome
+
+// CplRefresh is the outcome of the refresh of one bucket of the routing table.
+type CplRefresh = rtrefresh.CplRefresh
+
+// LastRefresh returns the outcome of the last completed refresh of the
+// routing table, false if none completed yet. Along with RoutingTableInfo, it
+// tells why the routing table is stale: refreshes failing, the buckets that
+// couldn't be refreshed, or no refresh running for long.
+func (dht *IpfsDHT) LastRefresh() (RefreshOutcome, bool) {
+	return dht.rtRefreshManager.LastRefresh()
+}
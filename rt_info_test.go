@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingTableInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh())
+	require.Zero(t, a.RoutingTableInfo().Size)
+
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+	a.peerstore.RecordLatency(b.self, time.Millisecond)
+
+	info := a.RoutingTableInfo()
+	require.Equal(t, 1, info.Size)
+	require.Len(t, info.Buckets, 1)
+	bucket := info.Buckets[0]
+	require.Equal(t, kb.CommonPrefixLen(a.selfKey, kb.ConvertPeerID(b.self)), bucket.Cpl)
+	require.Len(t, bucket.Peers, 1)
+	rp := bucket.Peers[0]
+	require.Equal(t, b.self, rp.ID)
+	require.NotEmpty(t, rp.Addrs)
+	require.False(t, rp.AddedAt.IsZero())
+	require.Positive(t, rp.RTT)
+	// no diversity filter
+	require.Empty(t, rp.DiversityGroups)
+
+	data, err := json.Marshal(info)
+	require.NoError(t, err)
+	var decoded RoutingTableInfo
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, rp.ID, decoded.Buckets[0].Peers[0].ID)
+	require.Equal(t, rp.Addrs, decoded.Buckets[0].Peers[0].Addrs)
+}
+
+func TestRoutingTableInfoDiversityGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	h.Start()
+	defer h.Close()
+
+	a, err := New(ctx, h,
+		testPrefix,
+		NamespacedValidator("v", blankValidator{}),
+		Mode(ModeServer),
+		DisableAutoRefresh(),
+		RoutingTablePeerDiversityFilter(NewRTPeerDiversityFilter(h, 10, 10)),
+	)
+	require.NoError(t, err)
+	defer a.Close()
+
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+
+	info := a.RoutingTableInfo()
+	require.Len(t, info.Buckets, 1)
+	require.NotEmpty(t, info.Buckets[0].Peers[0].DiversityGroups)
+}
+
+func TestRoutingTableInfoLocations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolve := func(ctx context.Context, ip netip.Addr) (Location, error) {
+		if !ip.IsLoopback() {
+			return Location{}, fmt.Errorf("unexpected address %s", ip)
+		}
+		return Location{Country: "DE", Region: "Hesse", ASN: 3320}, nil
+	}
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), GeoLocation(resolve))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	c := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+	connect(t, ctx, a, c)
+	a.peerstore.RecordLatency(b.self, time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		info := a.RoutingTableInfo()
+		return len(info.Regions) == 1 && info.Regions[0].Peers == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	info := a.RoutingTableInfo()
+	for _, bucket := range info.Buckets {
+		for _, rp := range bucket.Peers {
+			require.Equal(t, &Location{Country: "DE", Region: "Hesse", ASN: 3320}, rp.Location)
+		}
+	}
+	require.Len(t, info.Regions, 1)
+	require.Equal(t, "DE/Hesse", info.Regions[0].Key)
+	require.Positive(t, info.Regions[0].MedianRTT)
+	require.Len(t, info.ASNs, 1)
+	require.Equal(t, LocationStats{Key: "AS3320", Peers: 2, MedianRTT: info.Regions[0].MedianRTT}, info.ASNs[0])
+	require.True(t, a.Config().GeoResolver)
+
+	// without a resolver, nothing is located
+	info = b.RoutingTableInfo()
+	require.Nil(t, info.Buckets[0].Peers[0].Location)
+	require.Empty(t, info.Regions)
+}
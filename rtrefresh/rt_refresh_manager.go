@@ -10,13 +10,16 @@ import (
 	"github.com/hashicorp/go-multierror"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	kbucket "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-base32"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 var logger = logging.Logger("dht/RtRefreshManager")
@@ -25,11 +28,40 @@ const (
 	peerPingTimeout = 10 * time.Second
 )
 
+// RefreshOutcome is the outcome of a completed refresh of the routing table.
+type RefreshOutcome struct {
+	Start    time.Time
+	Duration time.Duration
+	Forced   bool
+	// Err is nil if the refresh succeeded.
+	Err error
+	// Cpls are the refreshes of the buckets the refresh ran, the buckets
+	// refreshed recently enough being skipped unless Forced.
+	Cpls []CplRefresh
+}
+
+// CplRefresh is the outcome of the refresh of the bucket of a cpl.
+type CplRefresh struct {
+	Cpl      uint
+	Duration time.Duration
+	Err      error
+}
+
 type triggerRefreshReq struct {
 	respCh          chan error
 	forceCplRefresh bool
 }
 
+// RoutingTable is the part of the routing table the RtRefreshManager relies on,
+// implemented by *kbucket.RoutingTable.
+type RoutingTable interface {
+	GetPeerInfos() []kbucket.PeerInfo
+	RemovePeer(p peer.ID)
+	GetTrackedCplsForRefresh() []time.Time
+	NPeersForCpl(cpl uint) int
+	Size() int
+}
+
 type RtRefreshManager struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
@@ -38,7 +70,7 @@ type RtRefreshManager struct {
 	// peerId of this DHT peer i.e. self peerId.
 	h         host.Host
 	dhtPeerId peer.ID
-	rt        *kbucket.RoutingTable
+	rt        RoutingTable
 
 	enableAutoRefresh   bool                                        // should run periodic refreshes ?
 	refreshKeyGenFnc    func(cpl uint) (string, error)              // generate the key for the query to refresh this cpl
@@ -53,11 +85,26 @@ type RtRefreshManager struct {
 	successfulOutboundQueryGracePeriod time.Duration
 
 	triggerRefresh chan *triggerRefreshReq // channel to write refresh requests to.
+	setInterval    chan time.Duration      // channel to write new refresh intervals to.
 
 	refreshDoneCh chan struct{} // write to this channel after every refresh
+
+	lastRefreshAt atomic.Int64 // unix nanoseconds of the last successful refresh
+
+	lastOutcomeLk sync.Mutex
+	lastOutcome   *RefreshOutcome
+	// cpls are the bucket refreshes of the refresh running, only accessed by
+	// the loop.
+	cpls []CplRefresh
+	// metricsOpt tags the metrics, see TagMetrics, nil if unset.
+	metricsOpt metric.MeasurementOption
+
+	disablePeerChecks bool // don't ping the peers before refreshing
+
+	logger *zap.SugaredLogger
 }
 
-func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool,
+func NewRtRefreshManager(h host.Host, rt RoutingTable, autoRefresh bool,
 	refreshKeyGenFnc func(cpl uint) (string, error),
 	refreshQueryFnc func(ctx context.Context, key string) error,
 	refreshPingFnc func(ctx context.Context, p peer.ID) error,
@@ -84,7 +131,9 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 		successfulOutboundQueryGracePeriod: successfulOutboundQueryGracePeriod,
 
 		triggerRefresh: make(chan *triggerRefreshReq),
+		setInterval:    make(chan time.Duration),
 		refreshDoneCh:  refreshDoneCh,
+		logger:         &logger.SugaredLogger,
 	}, nil
 }
 
@@ -93,12 +142,41 @@ func (r *RtRefreshManager) Start() {
 	go r.loop()
 }
 
+// DisablePeerChecks stops the liveness checks of the routing table peers run
+// before every refresh, for callers checking them on their own. It must be
+// called before Start.
+func (r *RtRefreshManager) DisablePeerChecks() {
+	r.disablePeerChecks = true
+}
+
+// TagMetrics adds opt, e.g. the attributes telling the DHT apart, to the
+// measurements of the refreshes. It must be called before Start.
+func (r *RtRefreshManager) TagMetrics(opt metric.MeasurementOption) {
+	r.metricsOpt = opt
+}
+
+// SetLogger makes the refresh manager log through l instead of the
+// package-wide logger. It must be called before Start.
+func (r *RtRefreshManager) SetLogger(l *zap.SugaredLogger) {
+	r.logger = l
+}
+
 func (r *RtRefreshManager) Close() error {
 	r.cancel()
 	r.refcount.Wait()
 	return nil
 }
 
+// SetRefreshInterval changes the interval between two periodic refreshes,
+// starting them if they were disabled. A zero interval stops the periodic
+// refreshes; explicitly requested ones still run.
+func (r *RtRefreshManager) SetRefreshInterval(interval time.Duration) {
+	select {
+	case r.setInterval <- interval:
+	case <-r.ctx.Done():
+	}
+}
+
 // RefreshRoutingTable requests the refresh manager to refresh the Routing Table.
 // If the force parameter is set to true true, all buckets will be refreshed irrespective of when they were last refreshed.
 //
@@ -129,6 +207,36 @@ func (r *RtRefreshManager) RefreshNoWait() {
 	}
 }
 
+// LastRefreshAt returns the time the last successful refresh finished, or the
+// zero time if no refresh succeeded yet.
+func (r *RtRefreshManager) LastRefreshAt() time.Time {
+	ns := r.lastRefreshAt.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (r *RtRefreshManager) metricsTags() metric.MeasurementOption {
+	if r.metricsOpt == nil {
+		return metric.WithAttributes()
+	}
+	return r.metricsOpt
+}
+
+// LastRefresh returns the outcome of the last completed refresh, false if no
+// refresh completed yet.
+func (r *RtRefreshManager) LastRefresh() (RefreshOutcome, bool) {
+	r.lastOutcomeLk.Lock()
+	defer r.lastOutcomeLk.Unlock()
+	if r.lastOutcome == nil {
+		return RefreshOutcome{}, false
+	}
+	o := *r.lastOutcome
+	o.Cpls = append([]CplRefresh(nil), o.Cpls...)
+	return o, true
+}
+
 // pingAndEvictPeers pings Routing Table peers that haven't been heard of/from
 // in the interval they should have been and evict them if they don't reply.
 func (r *RtRefreshManager) pingAndEvictPeers(ctx context.Context) {
@@ -156,14 +264,14 @@ func (r *RtRefreshManager) pingAndEvictPeers(ctx context.Context) {
 			defer span.End()
 
 			if err := r.h.Connect(livelinessCtx, peer.AddrInfo{ID: ps.Id}); err != nil {
-				logger.Debugw("evicting peer after failed connection", "peer", peerIdStr, "error", err)
+				r.logger.Debugw("evicting peer after failed connection", "peer", peerIdStr, "error", err)
 				span.RecordError(err)
 				r.rt.RemovePeer(ps.Id)
 				return
 			}
 
 			if err := r.refreshPingFnc(livelinessCtx, ps.Id); err != nil {
-				logger.Debugw("evicting peer after failed ping", "peer", peerIdStr, "error", err)
+				r.logger.Debugw("evicting peer after failed ping", "peer", peerIdStr, "error", err)
 				span.RecordError(err)
 				r.rt.RemovePeer(ps.Id)
 				return
@@ -180,21 +288,39 @@ func (r *RtRefreshManager) pingAndEvictPeers(ctx context.Context) {
 func (r *RtRefreshManager) loop() {
 	defer r.refcount.Done()
 
+	var ticker *time.Ticker
 	var refreshTickrCh <-chan time.Time
 	if r.enableAutoRefresh {
+		start := time.Now()
 		err := r.doRefresh(r.ctx, true)
 		if err != nil {
-			logger.Warn("failed when refreshing routing table", err)
+			r.logger.Warn("failed when refreshing routing table", err)
 		}
-		t := time.NewTicker(r.refreshInterval)
-		defer t.Stop()
-		refreshTickrCh = t.C
+		r.refreshDone(start, true, err)
+		ticker = time.NewTicker(r.refreshInterval)
+		refreshTickrCh = ticker.C
 	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
 
 	for {
 		var waiting []chan<- error
 		var forced bool
 		select {
+		case interval := <-r.setInterval:
+			if ticker != nil {
+				ticker.Stop()
+				ticker, refreshTickrCh = nil, nil
+			}
+			if interval > 0 {
+				r.refreshInterval = interval
+				ticker = time.NewTicker(interval)
+				refreshTickrCh = ticker.C
+			}
+			continue
 		case <-refreshTickrCh:
 		case triggerRefreshReq := <-r.triggerRefresh:
 			if triggerRefreshReq.respCh != nil {
@@ -221,22 +347,50 @@ func (r *RtRefreshManager) loop() {
 
 		ctx, span := internal.StartSpan(r.ctx, "RefreshManager.Refresh")
 
-		r.pingAndEvictPeers(ctx)
+		if !r.disablePeerChecks {
+			r.pingAndEvictPeers(ctx)
+		}
 
 		// Query for self and refresh the required buckets
+		start := time.Now()
 		err := r.doRefresh(ctx, forced)
+		if err != nil {
+			r.logger.Warnw("failed when refreshing routing table", "error", err)
+		}
+		// record the outcome first, so that the waiters see it in LastRefresh
+		r.refreshDone(start, forced, err)
 		for _, w := range waiting {
 			w <- err
 			close(w)
 		}
-		if err != nil {
-			logger.Warnw("failed when refreshing routing table", "error", err)
-		}
 
 		span.End()
 	}
 }
 
+// refreshDone records the outcome of the refresh started at start.
+func (r *RtRefreshManager) refreshDone(start time.Time, forced bool, err error) {
+	if r.ctx.Err() != nil {
+		// interrupted by Close
+		return
+	}
+	now := time.Now()
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	} else {
+		r.lastRefreshAt.Store(now.UnixNano())
+		metrics.LastRoutingTableRefresh.Record(r.ctx, now.Unix(), r.metricsTags())
+	}
+	metrics.RoutingTableRefreshes.Add(r.ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)), r.metricsTags())
+
+	o := &RefreshOutcome{Start: start, Duration: now.Sub(start), Forced: forced, Err: err, Cpls: r.cpls}
+	r.cpls = nil
+	r.lastOutcomeLk.Lock()
+	r.lastOutcome = o
+	r.lastOutcomeLk.Unlock()
+}
+
 func (r *RtRefreshManager) doRefresh(ctx context.Context, forceRefresh bool) error {
 	ctx, span := internal.StartSpan(ctx, "RefreshManager.doRefresh")
 	defer span.End()
@@ -301,14 +455,28 @@ func min(a int, b int) int {
 
 func (r *RtRefreshManager) refreshCplIfEligible(ctx context.Context, cpl uint, lastRefreshedAt time.Time) error {
 	if time.Since(lastRefreshedAt) <= r.refreshInterval {
-		logger.Debugf("not running refresh for cpl %d as time since last refresh not above interval", cpl)
+		r.logger.Debugf("not running refresh for cpl %d as time since last refresh not above interval", cpl)
 		return nil
 	}
 
 	return r.refreshCpl(ctx, cpl)
 }
 
-func (r *RtRefreshManager) refreshCpl(ctx context.Context, cpl uint) error {
+func (r *RtRefreshManager) refreshCpl(ctx context.Context, cpl uint) (err error) {
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		r.cpls = append(r.cpls, CplRefresh{Cpl: cpl, Duration: d, Err: err})
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		metrics.RefreshCplDuration.Record(ctx, float64(d)/float64(time.Millisecond), metric.WithAttributes(
+			attribute.Int("cpl", int(cpl)),
+			attribute.String("outcome", outcome),
+		), r.metricsTags())
+	}()
+
 	ctx, span := internal.StartSpan(ctx, "RefreshManager.refreshCpl", trace.WithAttributes(attribute.Int("cpl", int(cpl))))
 	defer span.End()
 
@@ -319,7 +487,7 @@ func (r *RtRefreshManager) refreshCpl(ctx context.Context, cpl uint) error {
 		return fmt.Errorf("failed to generated query key for cpl=%d, err=%s", cpl, err)
 	}
 
-	logger.Infof("starting refreshing cpl %d with key %s (routing table size was %d)",
+	r.logger.Infof("starting refreshing cpl %d with key %s (routing table size was %d)",
 		cpl, loggableRawKeyString(key), r.rt.Size())
 
 	if err := r.runRefreshDHTQuery(ctx, key); err != nil {
@@ -328,7 +496,7 @@ func (r *RtRefreshManager) refreshCpl(ctx context.Context, cpl uint) error {
 	}
 
 	sz := r.rt.Size()
-	logger.Infof("finished refreshing cpl %d, routing table size is now %d", cpl, sz)
+	r.logger.Infof("finished refreshing cpl %d, routing table size is now %d", cpl, sz)
 	span.SetAttributes(attribute.Int("NewSize", sz))
 	return nil
 }
@@ -2,11 +2,14 @@ package rtrefresh
 
 import (
 	"context"
+	"errors"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/test"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
 
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
@@ -100,3 +103,41 @@ func TestSkipRefreshOnGapCpls(t *testing.T) {
 	}
 	require.Equal(t, 2, rt.NPeersForCpl(10))
 }
+
+func TestLastRefresh(t *testing.T) {
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableQUIC), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer h.Close()
+
+	rt, err := kb.NewRoutingTable(2, kb.ConvertPeerID(h.ID()), time.Hour, pstore.NewMetrics(), 100*time.Hour, nil)
+	require.NoError(t, err)
+	kfnc := func(cpl uint) (string, error) {
+		return strconv.FormatInt(int64(cpl), 10), nil
+	}
+	failing := errors.New("failing")
+	qfnc := func(_ context.Context, key string) error {
+		if key == "0" {
+			return failing
+		}
+		return nil
+	}
+	refreshDone := make(chan struct{}, 1)
+	r, err := NewRtRefreshManager(h, rt, false, kfnc, qfnc, nil, time.Second, time.Hour, time.Hour, refreshDone)
+	require.NoError(t, err)
+	r.DisablePeerChecks()
+	r.Start()
+	defer r.Close()
+
+	_, ok := r.LastRefresh()
+	require.False(t, ok)
+
+	require.Error(t, <-r.Refresh(true))
+	o, ok := r.LastRefresh()
+	require.True(t, ok)
+	require.True(t, o.Forced)
+	require.Error(t, o.Err)
+	require.NotEmpty(t, o.Cpls)
+	require.Equal(t, uint(0), o.Cpls[0].Cpl)
+	require.ErrorContains(t, o.Cpls[0].Err, failing.Error())
+	require.True(t, r.LastRefreshAt().IsZero())
+}
@@ -0,0 +1,213 @@
+package dht
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-base32"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+)
+
+// MisplacedKey is a key stored by a server that is no longer among the
+// closest peers to it, as found by a self-audit. Closest are the closest
+// peers to the key found by the lookup, closest first. Providers is set for
+// the multihashes of provider records, and unset for value record keys.
+type MisplacedKey = dhtcfg.MisplacedKey
+
+// SelfAuditReport is the outcome of a self-audit of the keys stored by a
+// server, see the SelfAudit option. Placed counts the Sampled keys the server
+// is still among the closest peers to.
+type SelfAuditReport = dhtcfg.SelfAuditReport
+
+// selfAuditor runs the self-audits configured with the SelfAudit option.
+// A nil *selfAuditor doesn't audit anything.
+type selfAuditor struct {
+	dht      *IpfsDHT
+	interval time.Duration
+	sample   int
+	report   func(SelfAuditReport)
+}
+
+func newSelfAuditor(dht *IpfsDHT, interval time.Duration, sample int, report func(SelfAuditReport)) *selfAuditor {
+	if interval <= 0 {
+		return nil
+	}
+	return &selfAuditor{dht: dht, interval: interval, sample: sample, report: report}
+}
+
+func (a *selfAuditor) start() {
+	if a == nil {
+		return
+	}
+	a.dht.wg.Add(1)
+	go func() {
+		defer a.dht.wg.Done()
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if a.dht.getMode() != modeServer {
+					continue
+				}
+				r, err := a.dht.RunSelfAudit(a.dht.ctx, a.sample)
+				if err != nil {
+					if a.dht.ctx.Err() == nil {
+						a.dht.logger.Warnw("self-audit failed", "error", err)
+					}
+					continue
+				}
+				if a.report != nil {
+					a.report(r)
+				}
+			case <-a.dht.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// LastSelfAudit returns the report of the last self-audit, run in the
+// background when enabled with the SelfAudit option, or with RunSelfAudit.
+func (dht *IpfsDHT) LastSelfAudit() (SelfAuditReport, bool) {
+	dht.lastSelfAuditLk.Lock()
+	defer dht.lastSelfAuditLk.Unlock()
+	if dht.lastSelfAudit == nil {
+		return SelfAuditReport{}, false
+	}
+	return *dht.lastSelfAudit, true
+}
+
+// RunSelfAudit samples up to sample of the keys stored by the DHT, looks up
+// the closest peers to each of them, and reports whether the DHT is still
+// among them. See the SelfAudit option to run it periodically.
+func (dht *IpfsDHT) RunSelfAudit(ctx context.Context, sample int) (SelfAuditReport, error) {
+	keys, err := dht.sampleStoredKeys(ctx, sample)
+	if err != nil {
+		return SelfAuditReport{}, err
+	}
+
+	r := SelfAuditReport{At: time.Now()}
+	for _, k := range keys {
+		closest, err := dht.GetClosestPeers(ctx, k.key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return SelfAuditReport{}, ctx.Err()
+			}
+			dht.logger.Debugw("self-audit lookup failed", "error", err)
+			continue
+		}
+		r.Sampled++
+		outcome := "placed"
+		if dht.amongClosest(k.key, closest) {
+			r.Placed++
+		} else {
+			outcome = "misplaced"
+			r.Misplaced = append(r.Misplaced, MisplacedKey{Key: k.key, Providers: k.providers, Closest: closest})
+		}
+		metrics.SelfAuditKeys.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)), dht.protoAttr)
+	}
+
+	dht.lastSelfAuditLk.Lock()
+	dht.lastSelfAudit = &r
+	dht.lastSelfAuditLk.Unlock()
+	return r, nil
+}
+
+// amongClosest reports whether the DHT is among the bucket size closest peers
+// to key, given the closest other peers found by a lookup.
+func (dht *IpfsDHT) amongClosest(key string, closest []peer.ID) bool {
+	ranked := dht.keyspaceHash.SortClosestPeers(append(closest[:len(closest):len(closest)], dht.self), dht.kadKey(key))
+	for i, p := range ranked {
+		if p == dht.self {
+			return i < dht.bucketSize
+		}
+	}
+	return false
+}
+
+// providerScanner is implemented by the provider stores that can stream their
+// records, like providers.ProviderManager.
+type providerScanner interface {
+	ScanProviders(ctx context.Context, fn func(providers.ProviderRecord)) error
+}
+
+type storedKey struct {
+	key       string
+	providers bool
+}
+
+// sampleStoredKeys returns up to n of the value record keys and provider
+// record multihashes stored by the DHT, picked at random.
+func (dht *IpfsDHT) sampleStoredKeys(ctx context.Context, n int) ([]storedKey, error) {
+	var (
+		seen   int
+		sample []storedKey
+	)
+	// reservoir sampling; a key indexed more than once is more likely to be
+	// picked, as is a multihash with several providers, and duplicates are
+	// dropped afterwards
+	add := func(k storedKey) {
+		seen++
+		if len(sample) < n {
+			sample = append(sample, k)
+		} else if i := rand.Intn(seen); i < n {
+			sample[i] = k
+		}
+	}
+
+	if dht.enableValues {
+		err := scanKeys(ctx, dht.datastore, recordReceivedPrefix, func(dsk string) {
+			if _, recKey, err := parseRecordReceivedKey(dsk); err == nil {
+				if key, err := base32.RawStdEncoding.DecodeString(recKey.BaseNamespace()); err == nil {
+					add(storedKey{key: string(key)})
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s, ok := dht.providerStore.(providerScanner); ok && dht.enableProviders {
+		err := s.ScanProviders(ctx, func(rec providers.ProviderRecord) {
+			add(storedKey{key: string(rec.Key), providers: true})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dedup := make(map[storedKey]struct{}, len(sample))
+	keys := sample[:0]
+	for _, k := range sample {
+		if _, ok := dedup[k]; !ok {
+			dedup[k] = struct{}{}
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func scanKeys(ctx context.Context, dstore ds.Read, prefix string, fn func(dsk string)) error {
+	res, err := dstore.Query(ctx, dsq.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		fn(r.Key)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+func TestSelfAudit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reports := make(chan SelfAuditReport, 1)
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), SelfAudit(50*time.Millisecond, 100, func(r SelfAuditReport) {
+		select {
+		case reports <- r:
+		default:
+		}
+	}))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, a, b)
+
+	_, ok := a.LastSelfAudit()
+	require.False(t, ok)
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("/v/audit%d", i)
+		rec := record.MakePutRecord(key, []byte("value"))
+		rec.TimeReceived = internal.FormatRFC3339(time.Now())
+		require.NoError(t, a.putLocal(ctx, key, rec))
+	}
+	require.NoError(t, a.ProviderStore().AddProvider(ctx, testCaseCids[0].Hash(), peer.AddrInfo{ID: b.self}))
+
+	r, err := a.RunSelfAudit(ctx, 100)
+	require.NoError(t, err)
+	require.Equal(t, 6, r.Sampled)
+	// two peers are always among the closest to any key
+	require.Equal(t, 6, r.Placed)
+	require.Empty(t, r.Misplaced)
+	require.Equal(t, 1.0, r.PlacedRatio())
+	last, ok := a.LastSelfAudit()
+	require.True(t, ok)
+	require.Equal(t, r.At, last.At)
+
+	r, err = a.RunSelfAudit(ctx, 2)
+	require.NoError(t, err)
+	require.LessOrEqual(t, r.Sampled, 2)
+
+	select {
+	case r := <-reports:
+		require.Equal(t, 6, r.Sampled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no self-audit report")
+	}
+}
+
+func TestSelfAuditPlacement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), BucketSize(1), Resiliency(1))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh())
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/v/key%d", i)
+		closest := a.keyspaceHash.SortClosestPeers([]peer.ID{a.self, b.self}, a.kadKey(key))
+		require.Equal(t, closest[0] == a.self, a.amongClosest(key, []peer.ID{b.self}), key)
+		require.True(t, a.amongClosest(key, nil))
+	}
+}
@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/record"
+	"go.uber.org/zap"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// selfRecord caches the marshaled signed peer record of the host, included in
+// our responses with IncludeSelfRecord.
+//
+// A nil *selfRecord includes no record.
+type selfRecord struct {
+	cab  peerstore.CertifiedAddrBook
+	self peer.ID
+
+	mu   sync.Mutex
+	env  *record.Envelope
+	data []byte
+}
+
+// get returns the marshaled signed peer record of the host, nil if it has
+// none.
+func (r *selfRecord) get() []byte {
+	if r == nil {
+		return nil
+	}
+	env := r.cab.GetPeerRecord(r.self)
+	if env == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if env != r.env {
+		data, err := env.Marshal()
+		if err != nil {
+			return nil
+		}
+		r.env, r.data = env, data
+	}
+	return r.data
+}
+
+// peerRecordSender adds the signed peer records the peers include in their
+// responses to the certified address book.
+type peerRecordSender struct {
+	pb.MessageSenderWithDisconnect
+	cab    peerstore.CertifiedAddrBook
+	logger *zap.SugaredLogger
+}
+
+func (s *peerRecordSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	resp, err := s.MessageSenderWithDisconnect.SendRequest(ctx, p, pmes)
+	if err == nil && len(resp.GetSenderRecord()) > 0 {
+		consumeSenderRecord(s.cab, p, resp.GetSenderRecord(), s.logger)
+	}
+	return resp, err
+}
+
+// consumeSenderRecord adds the signed peer record data of p to cab, unless it
+// isn't a valid record of p.
+func consumeSenderRecord(cab peerstore.CertifiedAddrBook, p peer.ID, data []byte, logger *zap.SugaredLogger) {
+	env, rec, err := record.ConsumeEnvelope(data, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		logger.Debugw("invalid sender record", "peer", p, "error", err)
+		return
+	}
+	if pr, ok := rec.(*peer.PeerRecord); !ok || pr.PeerID != p {
+		logger.Debugw("sender record of another peer", "peer", p)
+		return
+	}
+	// stale records are ignored
+	_, _ = cab.ConsumePeerRecord(env, peerstore.RecentlyConnectedAddrTTL)
+}
@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+func TestIncludeSelfRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := setupDHT(ctx, t, false, IncludeSelfRecord())
+	legacy := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false)
+	other := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{server, legacy} {
+		connect(t, ctx, other, d)
+		connect(t, ctx, client, d)
+	}
+	require.True(t, server.Config().SelfRecord)
+
+	sender := net.NewMessageSenderImpl(client.host, client.protocols)
+	findNode := func(p peer.ID) *pb.Message {
+		resp, err := sender.SendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, []byte(other.self), 0))
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.CloserPeers)
+		return resp
+	}
+
+	resp := findNode(server.self)
+	_, rec, err := record.ConsumeEnvelope(resp.GetSenderRecord(), peer.PeerRecordEnvelopeDomain)
+	require.NoError(t, err)
+	require.Equal(t, server.self, rec.(*peer.PeerRecord).PeerID)
+	require.Empty(t, findNode(legacy.self).GetSenderRecord())
+
+	// the records are verified before being added
+	ps, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	cab, ok := peerstore.GetCertifiedAddrBook(ps)
+	require.True(t, ok)
+	consumeSenderRecord(cab, legacy.self, resp.GetSenderRecord(), &logger.SugaredLogger)
+	require.Nil(t, cab.GetPeerRecord(legacy.self))
+	consumeSenderRecord(cab, server.self, resp.GetSenderRecord(), &logger.SugaredLogger)
+	require.NotNil(t, cab.GetPeerRecord(server.self))
+}
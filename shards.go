@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Shard identifies a partition of the keyspace, made of the keys and peers
+// whose keyspace position starts with the same ShardBits bits. Shards are
+// numbered from 0 to Shards()-1.
+type Shard uint32
+
+// Shards returns the number of shards the keyspace is partitioned into.
+func (dht *IpfsDHT) Shards() int {
+	return 1 << dht.shardBits
+}
+
+// ShardForKey returns the shard key belongs to.
+func (dht *IpfsDHT) ShardForKey(key string) Shard {
+	return dht.shardOf(dht.kadKey(key))
+}
+
+// ShardForPeer returns the shard p belongs to.
+func (dht *IpfsDHT) ShardForPeer(p peer.ID) Shard {
+	return dht.shardOf(dht.kadPeerID(p))
+}
+
+func (dht *IpfsDHT) shardOf(id kb.ID) Shard {
+	if dht.shardBits == 0 {
+		return 0
+	}
+	return Shard(binary.BigEndian.Uint32(id) >> (32 - dht.shardBits))
+}
+
+// shardTarget moves id into s, keeping the bits following the shard prefix.
+func (dht *IpfsDHT) shardTarget(s Shard, id kb.ID) [32]byte {
+	var target [32]byte
+	copy(target[:], id)
+	if dht.shardBits == 0 {
+		return target
+	}
+	mask := ^uint32(0) << (32 - dht.shardBits)
+	prefix := binary.BigEndian.Uint32(target[:])&^mask | uint32(s)<<(32-dht.shardBits)
+	binary.BigEndian.PutUint32(target[:], prefix)
+	return target
+}
+
+// GetClosestPeersInShard returns the closest peers of shard s to key, as if
+// key belonged to s: the position of key in the keyspace is moved into s,
+// which lets applications place a key deterministically in every shard.
+// Fewer than K peers are returned when the shard is sparsely populated.
+func (dht *IpfsDHT) GetClosestPeersInShard(ctx context.Context, s Shard, key string) ([]peer.ID, error) {
+	ctx = WithinShard(ctx, s)
+	return dht.GetClosestPeersToKey(ctx, dht.shardTarget(s, dht.kadKey(key)))
+}
+
+type shardKey struct{}
+
+// WithinShard returns a context restricting the DHT operations run with it
+// to the peers of shard s: records are only stored with and fetched from
+// them, and lookups only return them. Peers outside of the shard are still
+// used to route the lookups. As the closest peers to a key are in the key's
+// shard, operations on keys of other shards find few peers, if any.
+func WithinShard(ctx context.Context, s Shard) context.Context {
+	return context.WithValue(ctx, shardKey{}, s)
+}
+
+func shardFromContext(ctx context.Context) (Shard, bool) {
+	s, ok := ctx.Value(shardKey{}).(Shard)
+	return s, ok
+}
+
+// shardQueryFn runs queryFn against the peers of s and routeFn against the
+// other ones.
+func (dht *IpfsDHT) shardQueryFn(s Shard, queryFn, routeFn queryFn) queryFn {
+	return func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+		if dht.ShardForPeer(p) != s {
+			return routeFn(ctx, p)
+		}
+		return queryFn(ctx, p)
+	}
+}
+
+// filterShard removes the peers outside of s from the result of a lookup.
+func (dht *IpfsDHT) filterShard(s Shard, res *lookupWithFollowupResult) {
+	peers := make([]peer.ID, 0, len(res.peers))
+	state := make([]qpeerset.PeerState, 0, len(res.state))
+	for i, p := range res.peers {
+		if dht.ShardForPeer(p) == s {
+			peers = append(peers, p)
+			state = append(state, res.state[i])
+		}
+	}
+	res.peers, res.state = peers, state
+}
@@ -0,0 +1,41 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 16, ShardBits(1))
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+	d := dhts[0]
+	require.Equal(t, 2, d.Shards())
+	require.Equal(t, Shard(d.PeerKey()[0]>>7), d.ShardForPeer(d.self))
+	require.Equal(t, Shard(d.kadKey("hello")[0]>>7), d.ShardForKey("hello"))
+
+	for s := Shard(0); s < 2; s++ {
+		peers, err := d.GetClosestPeersInShard(ctx, s, "hello")
+		require.NoError(t, err)
+		require.NotEmpty(t, peers)
+		for _, p := range peers {
+			require.Equal(t, s, d.ShardForPeer(p))
+		}
+	}
+
+	s := d.ShardForKey("hello")
+	peers, err := d.GetClosestPeers(WithinShard(ctx, s), "hello")
+	require.NoError(t, err)
+	for _, p := range peers {
+		require.Equal(t, s, d.ShardForPeer(p))
+	}
+
+	_, err = New(ctx, d.host, ShardBits(33))
+	require.Error(t, err)
+}
@@ -0,0 +1,32 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlogHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	d := setupDHT(ctx, t, false, SlogHandler(h))
+
+	d.logger.Debugw("dropped", "key", "a")
+	require.Zero(t, buf.Len())
+
+	d.logger.With("instance", "wan").Warnw("kept", "key", "b", "count", 2)
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "WARN", entry["level"])
+	require.Equal(t, "kept", entry["msg"])
+	require.Equal(t, "wan", entry["instance"])
+	require.Equal(t, "b", entry["key"])
+	require.EqualValues(t, 2, entry["count"])
+}
@@ -0,0 +1,193 @@
+package dht
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// SpamKeyPolicy describes how the provider records of the keys flagged by
+// SpamKeyDetection are handled.
+type SpamKeyPolicy = dhtcfg.SpamKeyPolicy
+
+const (
+	// RateLimitSpamKeys accepts the records of a flooded key up to the
+	// detection threshold per window, rejecting the excess
+	RateLimitSpamKeys SpamKeyPolicy = iota
+	// RejectSpamKeys rejects all the records of a flooded key
+	RejectSpamKeys
+)
+
+// SpamKeyEvent reports a key flagged by SpamKeyDetection, when flagged and
+// when cleared, End being set then.
+type SpamKeyEvent = dhtcfg.SpamKeyEvent
+
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+// countMinSketch estimates the number of times keys were added, never
+// underestimating it.
+type countMinSketch [sketchDepth][sketchWidth]uint32
+
+func (s *countMinSketch) add(h1, h2 uint32) uint32 {
+	est := ^uint32(0)
+	for i := range s {
+		c := &s[i][(h1+uint32(i)*h2)%sketchWidth]
+		*c++
+		est = min(est, *c)
+	}
+	return est
+}
+
+func (s *countMinSketch) estimate(h1, h2 uint32) uint32 {
+	est := ^uint32(0)
+	for i := range s {
+		est = min(est, s[i][(h1+uint32(i)*h2)%sketchWidth])
+	}
+	return est
+}
+
+// spamDetector counts the ADD_PROVIDER records per key over a sliding window,
+// interpolating between the counts of the current and previous windows, and
+// flags the keys above the threshold.
+//
+// A nil *spamDetector flags no key.
+type spamDetector struct {
+	threshold float64
+	window    time.Duration
+	policy    SpamKeyPolicy
+	report    func(SpamKeyEvent)
+	seed      maphash.Seed
+	protoAttr metric.MeasurementOption
+
+	mu          sync.Mutex
+	cur, prev   *countMinSketch
+	windowStart time.Time
+	flagged     map[string]*spamKey
+}
+
+type spamKey struct {
+	event SpamKeyEvent
+	// tokens of the records accepted under RateLimitSpamKeys
+	tokens float64
+	last   time.Time
+}
+
+func newSpamDetector(threshold int, window time.Duration, policy SpamKeyPolicy, report func(SpamKeyEvent), protoAttr metric.MeasurementOption) *spamDetector {
+	if threshold <= 0 {
+		return nil
+	}
+	return &spamDetector{
+		threshold:   float64(threshold),
+		window:      window,
+		policy:      policy,
+		report:      report,
+		seed:        maphash.MakeSeed(),
+		protoAttr:   protoAttr,
+		cur:         new(countMinSketch),
+		prev:        new(countMinSketch),
+		windowStart: time.Now(),
+		flagged:     make(map[string]*spamKey),
+	}
+}
+
+// allow counts a record of key, reporting whether it may be stored.
+func (d *spamDetector) allow(ctx context.Context, key []byte, now time.Time) bool {
+	if d == nil {
+		return true
+	}
+	h := maphash.Bytes(d.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+
+	var events []SpamKeyEvent
+	defer func() {
+		// outside of the lock, the report may be slow
+		if d.report != nil {
+			for _, e := range events {
+				d.report(e)
+			}
+		}
+	}()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	events = d.rotate(now)
+
+	count := d.cur.add(h1, h2)
+	rate := d.rate(count, d.prev.estimate(h1, h2), now)
+	k, ok := d.flagged[string(key)]
+	switch {
+	case !ok && rate > d.threshold:
+		k = &spamKey{
+			event:  SpamKeyEvent{Key: append([]byte(nil), key...), Start: now},
+			tokens: d.threshold,
+			last:   now,
+		}
+		d.flagged[string(key)] = k
+		k.event.Rate = rate
+		events = append(events, k.event)
+		metrics.SpamKeysDetected.Add(ctx, 1, d.protoAttr)
+	case ok && rate < d.threshold/2:
+		delete(d.flagged, string(key))
+		k.event.End, k.event.Rate = now, rate
+		events = append(events, k.event)
+		return true
+	case !ok:
+		return true
+	}
+
+	if d.policy == RateLimitSpamKeys {
+		k.tokens = min(d.threshold, k.tokens+d.threshold*now.Sub(k.last).Seconds()/d.window.Seconds())
+		k.last = now
+		if k.tokens >= 1 {
+			k.tokens--
+			return true
+		}
+	}
+	k.event.Rejected++
+	metrics.SpamKeyRejections.Add(ctx, 1, d.protoAttr)
+	return false
+}
+
+// rate interpolates the count of a key over the last window.
+func (d *spamDetector) rate(cur, prev uint32, now time.Time) float64 {
+	elapsed := float64(now.Sub(d.windowStart)) / float64(d.window)
+	return float64(cur) + float64(prev)*max(0, 1-elapsed)
+}
+
+// rotate starts a new window if the current one is over, clearing the
+// flagged keys that calmed down and returning their events.
+func (d *spamDetector) rotate(now time.Time) (events []SpamKeyEvent) {
+	elapsed := now.Sub(d.windowStart)
+	if elapsed < d.window {
+		return nil
+	}
+	d.prev, d.cur = d.cur, d.prev
+	*d.cur = countMinSketch{}
+	if elapsed < 2*d.window {
+		d.windowStart = d.windowStart.Add(d.window)
+	} else {
+		// no record for a whole window
+		*d.prev = countMinSketch{}
+		d.windowStart = now
+	}
+
+	for key, k := range d.flagged {
+		h := maphash.String(d.seed, key)
+		h1, h2 := uint32(h), uint32(h>>32)|1
+		if rate := d.rate(0, d.prev.estimate(h1, h2), now); rate < d.threshold/2 {
+			delete(d.flagged, key)
+			k.event.End, k.event.Rate = now, rate
+			events = append(events, k.event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/metric"
+)
+
+func TestSpamDetector(t *testing.T) {
+	ctx := context.Background()
+	var events []SpamKeyEvent
+	d := newSpamDetector(10, time.Minute, RejectSpamKeys, func(e SpamKeyEvent) { events = append(events, e) }, metric.WithAttributes())
+	start := d.windowStart
+
+	for i := 0; i < 10; i++ {
+		require.True(t, d.allow(ctx, []byte("hot"), start.Add(time.Second)))
+	}
+	require.False(t, d.allow(ctx, []byte("hot"), start.Add(time.Second)))
+	require.Len(t, events, 1)
+	require.Equal(t, "hot", string(events[0].Key))
+	require.True(t, events[0].End.IsZero())
+	// other keys aren't affected
+	require.True(t, d.allow(ctx, []byte("cold"), start.Add(time.Second)))
+	require.False(t, d.allow(ctx, []byte("hot"), start.Add(time.Second)))
+
+	// the previous window still weighs in at the start of the next one
+	require.False(t, d.allow(ctx, []byte("hot"), start.Add(61*time.Second)))
+	require.Len(t, events, 1)
+
+	// the key is cleared once its rate dropped
+	require.True(t, d.allow(ctx, []byte("cold"), start.Add(3*time.Minute)))
+	require.Len(t, events, 2)
+	require.Equal(t, "hot", string(events[1].Key))
+	require.False(t, events[1].End.IsZero())
+	require.Equal(t, 3, events[1].Rejected)
+	require.True(t, d.allow(ctx, []byte("hot"), start.Add(3*time.Minute)))
+}
+
+func TestSpamDetectorRateLimit(t *testing.T) {
+	ctx := context.Background()
+	d := newSpamDetector(10, 10*time.Second, RateLimitSpamKeys, nil, metric.WithAttributes())
+	now := d.windowStart
+
+	accepted := 0
+	// 5 records per second, 5 times the threshold, for 8 seconds
+	for i := 0; i < 40; i++ {
+		if d.allow(ctx, []byte("hot"), now.Add(time.Duration(i)*200*time.Millisecond)) {
+			accepted++
+		}
+	}
+	// the records before the key was flagged, then a threshold per window
+	require.GreaterOrEqual(t, accepted, 10)
+	require.Less(t, accepted, 30)
+}
+
+func TestSpamKeyDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reported := make(chan SpamKeyEvent, 1)
+	server := setupDHT(ctx, t, false, DisableAutoRefresh(), SpamKeyDetection(2, time.Hour, RejectSpamKeys, func(e SpamKeyEvent) { reported <- e }))
+	client := setupDHT(ctx, t, false, DisableAutoRefresh())
+	connect(t, ctx, client, server)
+	require.Equal(t, 2, server.Config().SpamKeys.Threshold)
+
+	key := testCaseCids[0].Hash()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, client.protoMessenger.PutProvider(ctx, server.self, key, client.host))
+	}
+	select {
+	case e := <-reported:
+		require.Equal(t, []byte(key), e.Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flooded key wasn't reported")
+	}
+}
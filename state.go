@@ -0,0 +1,253 @@
+package dht
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// The exported state is a stream of JSON values: a stateHeader, followed by
+// any number of stateEntry, each with a single field set.
+const (
+	stateFormat        = "go-libp2p-kad-dht/state"
+	stateFormatVersion = 1
+)
+
+type stateHeader struct {
+	Format   string
+	Version  int
+	Exported time.Time
+}
+
+type stateEntry struct {
+	Peer     *statePeer            `json:",omitempty"`
+	Provider *stateProvider        `json:",omitempty"`
+	Record   []byte                `json:",omitempty"` // marshalled recpb.Record
+	NetSize  []netsize.Measurement `json:",omitempty"`
+}
+
+// statePeer is a routing table peer.
+type statePeer struct {
+	Info                          peer.AddrInfo
+	AddedAt                       time.Time
+	LastUsefulAt                  time.Time
+	LastSuccessfulOutboundQueryAt time.Time
+}
+
+type stateProvider struct {
+	Key      []byte
+	Provider peer.AddrInfo
+	Added    time.Time
+}
+
+// providerStateStore is implemented by the provider stores whose records can
+// be exported and imported, such as *providers.ProviderManager.
+type providerStateStore interface {
+	ExportProviders(ctx context.Context) ([]providers.ProviderRecord, error)
+	ImportProviders(ctx context.Context, recs []providers.ProviderRecord) error
+}
+
+// ExportState writes the state of the DHT to w: the routing table peers with
+// their addresses, the provider records, the local value records and the
+// network size measurements. It is meant to be imported by ImportState in
+// another DHT instance, for instance when moving a DHT server to another
+// host. Provider records are only exported if the provider store supports
+// it, which the default one does.
+func (dht *IpfsDHT) ExportState(w io.Writer) error {
+	ctx := dht.ctx
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(stateHeader{Format: stateFormat, Version: stateFormatVersion, Exported: time.Now()}); err != nil {
+		return err
+	}
+
+	for _, pi := range dht.routingTable.GetPeerInfos() {
+		e := stateEntry{Peer: &statePeer{
+			Info:                          peer.AddrInfo{ID: pi.Id, Addrs: dht.peerstore.Addrs(pi.Id)},
+			AddedAt:                       pi.AddedAt,
+			LastUsefulAt:                  pi.LastUsefulAt,
+			LastSuccessfulOutboundQueryAt: pi.LastSuccessfulOutboundQueryAt,
+		}}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	if ps, ok := dht.providerStore.(providerStateStore); ok && dht.enableProviders {
+		recs, err := ps.ExportProviders(ctx)
+		if err != nil {
+			return fmt.Errorf("exporting provider records: %w", err)
+		}
+		for _, rec := range recs {
+			e := stateEntry{Provider: &stateProvider{
+				Key:      rec.Key,
+				Provider: peer.AddrInfo{ID: rec.Provider, Addrs: dht.peerstore.Addrs(rec.Provider)},
+				Added:    rec.Added,
+			}}
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dht.enableValues {
+		res, err := dht.datastore.Query(ctx, dsq.Query{})
+		if err != nil {
+			return fmt.Errorf("exporting records: %w", err)
+		}
+		for r := range res.Next() {
+			if r.Error != nil {
+				res.Close()
+				return fmt.Errorf("exporting records: %w", r.Error)
+			}
+			if !isRecordKey(r.Key) {
+				continue
+			}
+			if err := enc.Encode(stateEntry{Record: r.Value}); err != nil {
+				res.Close()
+				return err
+			}
+		}
+		res.Close()
+	}
+
+	if ms := dht.nsEstimator.Measurements(); len(ms) > 0 {
+		if err := enc.Encode(stateEntry{NetSize: ms}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ImportState adds the state written by ExportState to the DHT. Routing table
+// peers are added as long as there is room for them, provider records and
+// value records only if they are still valid and more recent than the local
+// ones, and the network size measurements if they are recent enough.
+func (dht *IpfsDHT) ImportState(r io.Reader) error {
+	ctx := dht.ctx
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var h stateHeader
+	if err := dec.Decode(&h); err != nil {
+		return fmt.Errorf("reading DHT state header: %w", err)
+	}
+	if h.Format != stateFormat {
+		return fmt.Errorf("not a DHT state: unknown format %q", h.Format)
+	}
+	if h.Version != stateFormatVersion {
+		return fmt.Errorf("unsupported DHT state version %d", h.Version)
+	}
+
+	var provs []providers.ProviderRecord
+	for {
+		var e stateEntry
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading DHT state: %w", err)
+		}
+
+		switch {
+		case e.Peer != nil:
+			dht.importPeer(e.Peer)
+		case e.Provider != nil:
+			if !dht.enableProviders || e.Provider.Provider.ID == "" {
+				continue
+			}
+			if e.Provider.Provider.ID != dht.self {
+				dht.peerstore.AddAddrs(e.Provider.Provider.ID, e.Provider.Provider.Addrs, providers.ProviderAddrTTL)
+			}
+			provs = append(provs, providers.ProviderRecord{Key: e.Provider.Key, Provider: e.Provider.Provider.ID, Added: e.Provider.Added})
+		case e.Record != nil:
+			if !dht.enableValues {
+				continue
+			}
+			if err := dht.importRecord(ctx, e.Record); err != nil {
+				return err
+			}
+		case e.NetSize != nil:
+			dht.nsEstimator.Restore(e.NetSize)
+		}
+	}
+
+	if len(provs) == 0 {
+		return nil
+	}
+	if ps, ok := dht.providerStore.(providerStateStore); ok {
+		return ps.ImportProviders(ctx, provs)
+	}
+	// the records are re-added now by stores that can't import them
+	for _, rec := range provs {
+		if err := dht.providerStore.AddProvider(ctx, rec.Key, peer.AddrInfo{ID: rec.Provider}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dht *IpfsDHT) importPeer(sp *statePeer) {
+	p := sp.Info.ID
+	if p == "" || p == dht.self {
+		return
+	}
+	dht.peerstore.AddAddrs(p, sp.Info.Addrs, peerstore.RecentlyConnectedAddrTTL)
+	added, err := dht.routingTable.TryAddPeer(p, false, true)
+	if err != nil || !added {
+		return
+	}
+	if !sp.LastUsefulAt.IsZero() {
+		dht.routingTable.UpdateLastUsefulAt(p, sp.LastUsefulAt)
+	}
+	if !sp.LastSuccessfulOutboundQueryAt.IsZero() {
+		dht.routingTable.UpdateLastSuccessfulOutboundQueryAt(p, sp.LastSuccessfulOutboundQueryAt)
+	}
+}
+
+// importRecord stores an exported value record, unless it expired or the
+// local record is better.
+func (dht *IpfsDHT) importRecord(ctx context.Context, data []byte) error {
+	rec := new(recpb.Record)
+	if err := proto.Unmarshal(data, rec); err != nil {
+		return nil
+	}
+	received, err := internal.ParseRFC3339(rec.GetTimeReceived())
+	if err != nil || time.Since(received) > dht.maxRecordAge {
+		return nil
+	}
+	if dht.validateRecord(ctx, string(rec.GetKey()), rec.GetValue()) != nil {
+		return nil
+	}
+
+	dskey := convertToDsKey(rec.GetKey())
+	lk := dht.putLock(rec.GetKey())
+	lk.Lock()
+	defer lk.Unlock()
+
+	existing, err := dht.getRecordFromDatastore(ctx, dskey)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		i, err := dht.Validator.Select(string(rec.GetKey()), [][]byte{rec.GetValue(), existing.GetValue()})
+		if err != nil || i != 0 {
+			return nil
+		}
+	}
+	return dht.storeRecord(ctx, rec, data)
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+	d := dhts[0]
+
+	rec := record.MakePutRecord("/v/state", []byte("value"))
+	rec.TimeReceived = internal.FormatRFC3339(time.Now())
+	require.NoError(t, d.putLocal(ctx, "/v/state", rec))
+	k := internal.Hash([]byte("state"))
+	require.NoError(t, d.providerStore.AddProvider(ctx, k, peer.AddrInfo{ID: dhts[1].self, Addrs: dhts[1].host.Addrs()}))
+
+	var buf bytes.Buffer
+	require.NoError(t, d.ExportState(&buf))
+
+	restored := setupDHT(ctx, t, false)
+	require.NoError(t, restored.ImportState(bytes.NewReader(buf.Bytes())))
+
+	require.Equal(t, dhts[1].self, restored.routingTable.Find(dhts[1].self))
+	require.Equal(t, dhts[2].self, restored.routingTable.Find(dhts[2].self))
+	require.NotEmpty(t, restored.peerstore.Addrs(dhts[1].self))
+
+	got, err := restored.getLocal(ctx, "/v/state")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.Equal(t, []byte("value"), got.GetValue())
+
+	provs, err := restored.providerStore.GetProviders(ctx, k)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, dhts[1].self, provs[0].ID)
+}
+
+func TestImportStateVersion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	err := d.ImportState(strings.NewReader(`{"Format":"go-libp2p-kad-dht/state","Version":99}`))
+	require.ErrorContains(t, err, "unsupported DHT state version")
+	err = d.ImportState(strings.NewReader(`{"Format":"other"}`))
+	require.ErrorContains(t, err, "not a DHT state")
+}
@@ -0,0 +1,58 @@
+package dht
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// StreamStats are the DHT streams open in one direction.
+type StreamStats struct {
+	Open int
+	// Oldest is the age of the oldest open stream, 0 if none.
+	Oldest time.Duration
+}
+
+// Streams returns the DHT streams currently open with other peers, as seen
+// by the host, inbound and outbound. Streams piling up or getting old point
+// to leaks or to a misbehaving stream pool. They are also exported as the
+// libp2p.io/dht/kad/open_streams and oldest_stream_age gauges.
+func (dht *IpfsDHT) Streams() (inbound, outbound StreamStats) {
+	protos := make(map[protocol.ID]struct{}, len(dht.protocols)+len(dht.serverProtocols))
+	for _, p := range dht.protocols {
+		protos[p] = struct{}{}
+	}
+	for _, p := range dht.serverProtocols {
+		protos[p] = struct{}{}
+	}
+
+	now := time.Now()
+	for _, c := range dht.host.Network().Conns() {
+		for _, s := range c.GetStreams() {
+			if _, ok := protos[s.Protocol()]; !ok {
+				continue
+			}
+			stat := s.Stat()
+			st := &outbound
+			if stat.Direction == network.DirInbound {
+				st = &inbound
+			}
+			st.Open++
+			if age := now.Sub(stat.Opened); !stat.Opened.IsZero() && age > st.Oldest {
+				st.Oldest = age
+			}
+		}
+	}
+	return inbound, outbound
+}
+
+func (dht *IpfsDHT) openStreams() []metrics.OpenStreams {
+	in, out := dht.Streams()
+	return []metrics.OpenStreams{
+		{Direction: "inbound", Open: in.Open, Oldest: in.Oldest},
+		{Direction: "outbound", Open: out.Open, Oldest: out.Oldest},
+	}
+}
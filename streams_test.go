@@ -0,0 +1,29 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	connect(t, ctx, a, b)
+
+	// the pool keeps the stream of the ping open
+	require.NoError(t, a.Ping(ctx, b.self))
+
+	_, out := a.Streams()
+	require.Equal(t, 1, out.Open)
+	require.Positive(t, out.Oldest)
+	require.Eventually(t, func() bool {
+		in, _ := b.Streams()
+		return in.Open == 1
+	}, time.Second, 10*time.Millisecond)
+}
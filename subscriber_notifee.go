@@ -6,6 +6,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
 )
 
@@ -62,23 +63,25 @@ func (dht *IpfsDHT) startNetworkSubscriber() error {
 						dht.rtRefreshManager.RefreshNoWait()
 					}
 				case event.EvtPeerProtocolsUpdated:
-					handlePeerChangeEvent(dht, evt.Peer)
+					handlePeerProtocolsUpdated(dht, evt)
 				case event.EvtPeerIdentificationCompleted:
 					handlePeerChangeEvent(dht, evt.Peer)
 				case event.EvtPeerConnectednessChanged:
 					if evt.Connectedness != network.Connected {
 						dht.msgSender.OnDisconnect(dht.ctx, evt.Peer)
 					}
+					dht.disconnects.connectednessChanged(evt.Peer, evt.Connectedness)
+					dht.providerDisconnected(evt.Peer, evt.Connectedness)
 				case event.EvtLocalReachabilityChanged:
 					if dht.auto == ModeAuto || dht.auto == ModeAutoServer {
 						handleLocalReachabilityChangedEvent(dht, evt)
 					} else {
 						// something has gone really wrong if we get an event we did not subscribe to
-						logger.Errorf("received LocalReachabilityChanged event that was not subscribed to")
+						dht.logger.Errorf("received LocalReachabilityChanged event that was not subscribed to")
 					}
 				default:
 					// something has gone really wrong if we get an event for another type
-					logger.Errorf("got wrong type from subscription: %T", e)
+					dht.logger.Errorf("got wrong type from subscription: %T", e)
 				}
 			case <-dht.ctx.Done():
 				return
@@ -89,15 +92,42 @@ func (dht *IpfsDHT) startNetworkSubscriber() error {
 	return nil
 }
 
+// handlePeerProtocolsUpdated applies the identify delta of a connected peer as
+// soon as it is received: a peer that started speaking one of our protocols is
+// considered for the routing table, and one that stopped is removed from it
+// along with its pooled streams. Deltas not involving our protocols are
+// ignored.
+func handlePeerProtocolsUpdated(dht *IpfsDHT, evt event.EvtPeerProtocolsUpdated) {
+	if !dht.anyDHTProtocol(evt.Added) && !dht.anyDHTProtocol(evt.Removed) {
+		return
+	}
+	valid, err := dht.validRTPeer(evt.Peer)
+	if err != nil {
+		dht.logger.Errorf("could not check peerstore for protocol support: err: %s", err)
+		return
+	}
+	if valid {
+		dht.peerFound(evt.Peer)
+		return
+	}
+	dht.peerCapabilities.set(evt.Peer, 0)
+	dht.peerStoppedDHT(evt.Peer, evictStoppedDHT)
+	if dht.anyDHTProtocol(evt.Removed) {
+		dht.msgSender.OnDisconnect(dht.ctx, evt.Peer)
+	}
+}
+
 func handlePeerChangeEvent(dht *IpfsDHT, p peer.ID) {
 	valid, err := dht.validRTPeer(p)
 	if err != nil {
-		logger.Errorf("could not check peerstore for protocol support: err: %s", err)
+		dht.logger.Errorf("could not check peerstore for protocol support: err: %s", err)
 		return
 	} else if valid {
 		dht.peerFound(p)
 	} else {
-		dht.peerStoppedDHT(p)
+		// a peer not speaking our protocols has no use for our extensions
+		dht.peerCapabilities.set(p, 0)
+		dht.peerStoppedDHT(p, evictStoppedDHT)
 	}
 }
 
@@ -117,17 +147,44 @@ func handleLocalReachabilityChangedEvent(dht *IpfsDHT, e event.EvtLocalReachabil
 		target = modeServer
 	}
 
-	logger.Infof("processed event %T; performing dht mode switch", e)
+	dht.logger.Infof("processed event %T; performing dht mode switch", e)
 
 	err := dht.setMode(target)
 	// NOTE: the mode will be printed out as a decimal.
 	if err == nil {
-		logger.Infow("switched DHT mode successfully", "mode", target)
+		dht.logger.Infow("switched DHT mode successfully", "mode", target)
 	} else {
-		logger.Errorw("switching DHT mode failed", "mode", target, "error", err)
+		dht.logger.Errorw("switching DHT mode failed", "mode", target, "error", err)
 	}
 }
 
+// anyDHTProtocol reports whether protos has one of the protocols we query
+// with.
+func (dht *IpfsDHT) anyDHTProtocol(protos []protocol.ID) bool {
+	for _, p := range protos {
+		for _, dp := range dht.protocols {
+			if p == dp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stoppedDHT reports whether p is connected and identify told us it speaks
+// none of the protocols we query with, so that it isn't worth querying.
+func (dht *IpfsDHT) stoppedDHT(p peer.ID) bool {
+	if dht.host.Network().Connectedness(p) != network.Connected {
+		return false
+	}
+	protos, err := dht.peerstore.GetProtocols(p)
+	if err != nil || len(protos) == 0 {
+		// not identified yet
+		return false
+	}
+	return !dht.anyDHTProtocol(protos)
+}
+
 // validRTPeer returns true if the peer supports the DHT protocol and false otherwise. Supporting the DHT protocol means
 // supporting the primary protocols, we do not want to add peers that are speaking obsolete secondary protocols to our
 // routing table
@@ -136,6 +193,9 @@ func (dht *IpfsDHT) validRTPeer(p peer.ID) (bool, error) {
 	if len(b) == 0 || err != nil {
 		return false, err
 	}
+	if dht.foreignPeer(p) || dht.bans.banned(p) {
+		return false, nil
+	}
 
 	return dht.routingTablePeerFilter == nil || dht.routingTablePeerFilter(dht, p), nil
 }
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// correctionLimiter is a token bucket bounding the rate at which SearchValue
+// sends corrective PUT_VALUE RPCs to peers holding outdated records. A nil
+// *correctionLimiter does not limit anything.
+type correctionLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newCorrectionLimiter(rate float64) *correctionLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	// allow bursts of up to one second worth of corrections, and at least
+	// one so that rates below one per second still let some through
+	burst := math.Max(rate, 1)
+	return &correctionLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow consumes a token if one is available.
+func (l *correctionLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// correctionTargets applies the correction policy to the peers a SearchValue
+// would like to correct, closest first.
+func (dht *IpfsDHT) correctionTargets(peers []peer.ID) []peer.ID {
+	if dht.correction.disabled {
+		return nil
+	}
+	if max := dht.correction.maxPeers; max > 0 && len(peers) > max {
+		peers = peers[:max]
+	}
+	allowed := make([]peer.ID, 0, len(peers))
+	for _, p := range peers {
+		if !dht.correction.limiter.allow() {
+			break
+		}
+		allowed = append(allowed, p)
+	}
+	return allowed
+}